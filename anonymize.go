@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// anonymizeAfterYears is the age in years after which transactions are
+// anonymized (ANONYMIZE_AFTER_YEARS, 0 or empty disables the job)
+func anonymizeAfterYears() int {
+	if v, err := strconv.Atoi(os.Getenv("ANONYMIZE_AFTER_YEARS")); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// AnonymizeResult summarizes an anonymization run
+type AnonymizeResult struct {
+	Transactions int64 `json:"transactions"`
+	Artifacts    int64 `json:"artifacts"`
+	Files        int   `json:"files"`
+}
+
+// anonymizeTables are the tables holding transactions that get anonymized:
+// live, archived and trashed
+var anonymizeTables = []string{"transactions", "transactions_archive", transactionsTrashTable}
+
+// anonymizeTransactions strips merchant details, line items and other
+// identifying data from transactions dated before the cutoff, keeping date,
+// category and amounts for long-term statistics. The OCR text and Gemini
+// responses stored for their receipts, the pages they were captured from and
+// the merchant and data of their logged webhook events are removed as well.
+// All of it happens in one database transaction; the receipt files are
+// deleted afterwards when deleteFiles is set.
+func anonymizeTransactions(cutoff time.Time, deleteFiles bool) (*AnonymizeResult, error) {
+	res := &AnonymizeResult{}
+
+	receiptRows, err := db.Query(
+		`SELECT DISTINCT r.id, r.file_name, r.storage_backend FROM receipts r
+		JOIN (SELECT receipt_id, date, anonymized_at FROM `+transactionsAllView+`
+			UNION ALL SELECT receipt_id, date, anonymized_at FROM `+transactionsTrashTable+`) t ON t.receipt_id = r.id
+		WHERE t.date < ? AND t.anonymized_at IS NULL`,
+		cutoff,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find receipts to anonymize: %v", err)
+	}
+	type receiptFile struct {
+		id      int64
+		name    string
+		backend string
+	}
+	var receipts []receiptFile
+	for receiptRows.Next() {
+		var r receiptFile
+		if err := receiptRows.Scan(&r.id, &r.name, &r.backend); err != nil {
+			receiptRows.Close()
+			return nil, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		receipts = append(receipts, r)
+	}
+	receiptRows.Close()
+	if err := receiptRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read receipts to anonymize: %v", err)
+	}
+
+	err = inTx("anonymize", func(tx *sql.Tx) error {
+		*res = AnonymizeResult{}
+
+		// Line items keep their amounts and categories
+		for _, table := range anonymizeTables {
+			if _, err := tx.Exec(
+				`UPDATE transaction_items i JOIN `+table+` t ON t.id = i.transaction_id
+				SET i.description = NULL, i.barcode = NULL
+				WHERE t.date < ? AND t.anonymized_at IS NULL`,
+				cutoff,
+			); err != nil {
+				return fmt.Errorf("failed to anonymize line items: %v", err)
+			}
+		}
+
+		// Loyalty points keep their program and amounts
+		if _, err := tx.Exec(
+			"UPDATE loyalty_points SET card_last4 = NULL, merchant = NULL WHERE earned_on < ?",
+			cutoff,
+		); err != nil {
+			return fmt.Errorf("failed to anonymize loyalty points: %v", err)
+		}
+
+		// Archived and trashed transactions are anonymized the same way
+		for _, table := range anonymizeTables {
+			result, err := tx.Exec(
+				`UPDATE `+table+` SET
+					merchant_raw = NULL, merchant_clean = NULL, merchant_id = NULL, merchant_country = NULL,
+					reference_number = NULL, branch_name = NULL, store_number = NULL, store_address = NULL,
+					extra_fields = NULL, fingerprint = NULL, anonymized_at = NOW()
+				WHERE date < ? AND anonymized_at IS NULL`,
+				cutoff,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to anonymize %s: %v", table, err)
+			}
+			n, _ := result.RowsAffected()
+			res.Transactions += n
+		}
+
+		for _, r := range receipts {
+			result, err := tx.Exec("DELETE FROM receipt_artifacts WHERE receipt_id = ?", r.id)
+			if err != nil {
+				return fmt.Errorf("failed to remove artifacts of receipt %d: %v", r.id, err)
+			}
+			n, _ := result.RowsAffected()
+			res.Artifacts += n
+			if _, err := tx.Exec("UPDATE parse_repairs SET response = NULL WHERE receipt_id = ?", r.id); err != nil {
+				return fmt.Errorf("failed to clear repair responses of receipt %d: %v", r.id, err)
+			}
+			if _, err := tx.Exec("UPDATE receipts SET source_url = NULL, source_title = NULL WHERE id = ?", r.id); err != nil {
+				return fmt.Errorf("failed to clear the source of receipt %d: %v", r.id, err)
+			}
+			// Logged events keep their receipt and the transaction's date,
+			// category and amount, like the transaction itself
+			if _, err := tx.Exec(
+				`UPDATE webhook_events SET envelope = JSON_SET(envelope, '$.transaction.merchant', NULL, '$.data', NULL)
+				WHERE JSON_EXTRACT(envelope, '$.receipt.id') = ?`,
+				r.id,
+			); err != nil {
+				return fmt.Errorf("failed to anonymize events of receipt %d: %v", r.id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !deleteFiles {
+		return res, nil
+	}
+	for _, r := range receipts {
+		store, err := newStorage(r.backend)
+		if err != nil {
+			log.Printf("Anonymize: receipt %d: %v", r.id, err)
+			continue
+		}
+		if err := store.Delete(r.name); err != nil && !os.IsNotExist(err) {
+			log.Printf("Anonymize: failed to delete file of receipt %d: %v", r.id, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE receipts SET checksum = NULL WHERE id = ?", r.id); err != nil {
+			log.Printf("Anonymize: failed to update receipt %d: %v", r.id, err)
+		}
+		res.Files++
+	}
+	return res, nil
+}
+
+// countAnonymizable returns how many transactions are older than the cutoff
+// and not yet anonymized
+func countAnonymizable(cutoff time.Time) (int, error) {
+	var count int
+	err := db.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM `+transactionsAllView+` WHERE date < ? AND anonymized_at IS NULL)
+		+ (SELECT COUNT(*) FROM `+transactionsTrashTable+` WHERE date < ? AND anonymized_at IS NULL)`,
+		cutoff, cutoff,
+	).Scan(&count)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to count transactions: %v", err)
+	}
+	return count, nil
+}
+
+// startAnonymizeScheduler anonymizes transactions older than
+// ANONYMIZE_AFTER_YEARS once a day
+func startAnonymizeScheduler() {
+	years := anonymizeAfterYears()
+	if years == 0 {
+		return
+	}
+	deleteFiles := os.Getenv("ANONYMIZE_DELETE_FILES") == "true"
+
+	log.Printf("Anonymize: transactions older than %d year(s) are anonymized daily", years)
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			res, err := anonymizeTransactions(time.Now().AddDate(-years, 0, 0), deleteFiles)
+			if err != nil {
+				log.Printf("Anonymize: scheduled run failed: %v", err)
+				continue
+			}
+			if res.Transactions > 0 {
+				log.Printf("Anonymize: anonymized %d transaction(s), removed %d artifact(s) and %d file(s)",
+					res.Transactions, res.Artifacts, res.Files)
+			}
+		}
+	}()
+}
+
+// runAnonymize anonymizes old transactions once from the command line.
+//
+// Usage: anonymize [-years N] [-delete-files] [-dry-run]
+func runAnonymize(args []string) error {
+	fs := flag.NewFlagSet("anonymize", flag.ContinueOnError)
+	years := fs.Int("years", anonymizeAfterYears(), "anonymize transactions older than this many years (default ANONYMIZE_AFTER_YEARS)")
+	deleteFiles := fs.Bool("delete-files", os.Getenv("ANONYMIZE_DELETE_FILES") == "true", "also delete the receipt files")
+	dryRun := fs.Bool("dry-run", false, "only count the transactions that would be anonymized")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *years < 1 {
+		return fmt.Errorf("-years must be at least 1")
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().AddDate(-*years, 0, 0)
+	if *dryRun {
+		count, err := countAnonymizable(cutoff)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d transaction(s) dated before %s would be anonymized\n", count, cutoff.Format("2006-01-02"))
+		return nil
+	}
+
+	res, err := anonymizeTransactions(cutoff, *deleteFiles)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Anonymized %d transaction(s), removed %d artifact(s) and %d file(s)\n", res.Transactions, res.Artifacts, res.Files)
+	return nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Scopes of API tokens. ingest may only upload receipts and follow their
+// processing, read may make any GET request, admin may do everything the
+// owner may.
+const (
+	scopeIngest = "ingest"
+	scopeRead   = "read"
+	scopeAdmin  = "admin"
+)
+
+// tokenScopes are the scopes a token can be given
+var tokenScopes = []string{scopeIngest, scopeRead, scopeAdmin}
+
+// apiTokenPrefix starts every API token, so leaked tokens are easy to
+// recognize
+const apiTokenPrefix = "rpt_"
+
+// ingestScopePaths are the uploads an ingest token may send
+var ingestScopePaths = []string{"/receipts/ingest", "/receipts/ingest/batch", "/receipts/capture"}
+
+// APIToken is a personal access token. The secret is only shown when the
+// token is created.
+type APIToken struct {
+	ID     int64    `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// TenantKey is the owner: the creating user, or the tenant of a
+	// request without a user
+	TenantKey  string  `json:"owner"`
+	UserID     *int64  `json:"user_id"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at"`
+	ExpiresAt  *string `json:"expires_at"`
+	RevokedAt  *string `json:"revoked_at"`
+}
+
+// allows reports whether the token's scopes permit a request
+func (t *APIToken) allows(method, path string) bool {
+	if containsString(t.Scopes, scopeAdmin) {
+		return true
+	}
+	read := method == fiber.MethodGet || method == fiber.MethodHead
+	if read && containsString(t.Scopes, scopeRead) {
+		return true
+	}
+	if !containsString(t.Scopes, scopeIngest) {
+		return false
+	}
+	path = routePath(path)
+	if method == fiber.MethodPost {
+		return containsString(ingestScopePaths, path)
+	}
+	// Ingest tokens can follow the receipts they uploaded
+	if read && strings.HasPrefix(path, "/receipts/") {
+		return strings.HasSuffix(path, "/status") || strings.HasSuffix(path, "/events")
+	}
+	return false
+}
+
+// normalizeScopes checks and de-duplicates requested scopes
+func normalizeScopes(scopes []string) ([]string, error) {
+	out := []string{}
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !containsString(tokenScopes, s) {
+			return nil, fmt.Errorf("unknown scope %q, expected %s", s, strings.Join(tokenScopes, ", "))
+		}
+		if !containsString(out, s) {
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("scopes must list at least one of %s", strings.Join(tokenScopes, ", "))
+	}
+	return out, nil
+}
+
+// roleScopes are the scopes a user of a role may give their tokens
+func roleScopes(role string) []string {
+	switch role {
+	case roleAdmin:
+		return tokenScopes
+	case roleMember:
+		return []string{scopeIngest, scopeRead}
+	}
+	return []string{scopeRead}
+}
+
+// apiTokenColumns are the api_tokens columns read by scanAPIToken
+const apiTokenColumns = "id, name, prefix, scopes, tenant_key, user_id, created_at, last_used_at, expires_at, revoked_at"
+
+// scanAPIToken reads a row selected with apiTokenColumns
+func scanAPIToken(row interface{ Scan(...any) error }) (*APIToken, error) {
+	var t APIToken
+	var scopes []byte
+	var userID sql.NullInt64
+	var createdAt time.Time
+	var lastUsed, expires, revoked sql.NullTime
+	if err := row.Scan(&t.ID, &t.Name, &t.Prefix, &scopes, &t.TenantKey, &userID, &createdAt, &lastUsed, &expires, &revoked); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &t.Scopes); err != nil {
+		return nil, fmt.Errorf("invalid scopes of token %d: %v", t.ID, err)
+	}
+	if userID.Valid {
+		t.UserID = &userID.Int64
+	}
+	t.CreatedAt = createdAt.Format(time.RFC3339)
+	for _, f := range []struct {
+		v   sql.NullTime
+		out **string
+	}{{lastUsed, &t.LastUsedAt}, {expires, &t.ExpiresAt}, {revoked, &t.RevokedAt}} {
+		if f.v.Valid {
+			s := f.v.Time.Format(time.RFC3339)
+			*f.out = &s
+		}
+	}
+	return &t, nil
+}
+
+// createAPIToken stores a new token and returns it with its secret
+func createAPIToken(tenant string, userID *int64, name string, scopes []string, expiresAt *time.Time) (*APIToken, string, error) {
+	random, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := apiTokenPrefix + random
+	raw, err := json.Marshal(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	result, err := db.Exec(
+		`INSERT INTO api_tokens (name, token_hash, prefix, scopes, tenant_key, user_id, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		name, hashToken(secret), secret[:len(apiTokenPrefix)+8], raw, tenant, userID, expiresAt,
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create API token: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get API token ID: %v", err)
+	}
+	t, err := scanAPIToken(db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load API token: %v", err)
+	}
+	return t, secret, nil
+}
+
+// apiTokenUser returns the valid token for a secret and its owning user,
+// or a nil token when it is unknown, expired or revoked, or its user is
+// disabled. Use is recorded at most once a minute.
+func apiTokenUser(secret string) (*APIToken, *User, error) {
+	t, err := scanAPIToken(db.QueryRow(
+		`SELECT `+apiTokenColumns+` FROM api_tokens
+		WHERE token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`,
+		hashToken(secret),
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var u *User
+	if t.UserID != nil {
+		u, err = scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", *t.UserID))
+		if err == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if u.Disabled {
+			return nil, nil, nil
+		}
+	}
+
+	_, err = db.Exec(
+		`UPDATE api_tokens SET last_used_at = NOW()
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL 1 MINUTE)`,
+		t.ID,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to record token use: %v", err)
+	}
+	return t, u, nil
+}
+
+// currentToken returns the API token of the request, or nil
+func currentToken(c *fiber.Ctx) *APIToken {
+	t, _ := c.Locals("token").(*APIToken)
+	return t
+}
+
+// revokeAPIToken revokes a token, limited to an owner unless tenant is
+// empty, and returns it, or nil when there is no such token
+func revokeAPIToken(id int, tenant string) (*APIToken, error) {
+	query, args := "UPDATE api_tokens SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", []any{id}
+	if tenant != "" {
+		query += " AND tenant_key = ?"
+		args = append(args, tenant)
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		return nil, fmt.Errorf("failed to revoke API token: %v", err)
+	}
+
+	query, args = "SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", []any{id}
+	if tenant != "" {
+		query += " AND tenant_key = ?"
+		args = append(args, tenant)
+	}
+	t, err := scanAPIToken(db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load API token: %v", err)
+	}
+	return t, nil
+}
+
+// listAPITokens returns the tokens of an owner, or of everyone when tenant
+// is empty, newest first
+func listAPITokens(tenant string) ([]*APIToken, error) {
+	query, args := "SELECT "+apiTokenColumns+" FROM api_tokens", []any{}
+	if tenant != "" {
+		query += " WHERE tenant_key = ?"
+		args = append(args, tenant)
+	}
+	rows, err := db.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API token: %v", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// registerAPITokenRoutes adds the management of personal access tokens
+func registerAPITokenRoutes(app *fiber.App) {
+	app.Get("/me/tokens", func(c *fiber.Ctx) error {
+		tokens, err := listAPITokens(tenantKey(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tokens":  tokens,
+		})
+	})
+
+	// Create a token with {"name", "scopes", "expires_in_days"}; signed-in
+	// users cannot give it more than their role allows. The secret is only
+	// returned here.
+	app.Post("/me/tokens", func(c *fiber.Ctx) error {
+		var req struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days"`
+		}
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "name must be 1-100 characters",
+			})
+		}
+		scopes, err := normalizeScopes(req.Scopes)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if req.ExpiresInDays < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "expires_in_days must not be negative",
+			})
+		}
+
+		var userID *int64
+		if u := currentUser(c); u != nil {
+			userID = &u.ID
+			allowed := roleScopes(u.Role)
+			for _, s := range scopes {
+				if !containsString(allowed, s) {
+					return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+						"error": fmt.Sprintf("The %s role cannot create tokens with the %s scope", u.Role, s),
+					})
+				}
+			}
+		}
+		var expiresAt *time.Time
+		if req.ExpiresInDays > 0 {
+			t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+			expiresAt = &t
+		}
+
+		t, secret, err := createAPIToken(tenantKey(c), userID, req.Name, scopes, expiresAt)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"token":   t,
+			"secret":  secret,
+		})
+	})
+
+	app.Delete("/me/tokens/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid token ID",
+			})
+		}
+		t, err := revokeAPIToken(id, tenantKey(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if t == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Token not found",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"token":   t,
+		})
+	})
+
+	// Every token, e.g. to find unused ones
+	app.Get("/admin/tokens", func(c *fiber.Ctx) error {
+		tokens, err := listAPITokens("")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tokens":  tokens,
+		})
+	})
+
+	app.Delete("/admin/tokens/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid token ID",
+			})
+		}
+		t, err := revokeAPIToken(id, "")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if t == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Token not found",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"token":   t,
+		})
+	})
+}
+
+// runCreateToken creates an API token from the command line, e.g. the
+// first admin token of a deployment with AUTH_REQUIRED
+func runCreateToken(args []string) error {
+	fs := flag.NewFlagSet("create-token", flag.ContinueOnError)
+	name := fs.String("name", "", "name of the token, e.g. the workflow using it")
+	scopes := fs.String("scopes", scopeIngest, "comma-separated scopes: ingest, read, admin")
+	owner := fs.String("owner", defaultTenant, "owner of the token as a tenant key, e.g. tenant:finance")
+	days := fs.Int("expires-in-days", 0, "days until the token expires (0 never)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*name) == "" {
+		return fmt.Errorf("-name is required")
+	}
+	list, err := normalizeScopes(strings.Split(*scopes, ","))
+	if err != nil {
+		return err
+	}
+	if *days < 0 {
+		return fmt.Errorf("-expires-in-days must not be negative")
+	}
+	var expiresAt *time.Time
+	if *days > 0 {
+		t := time.Now().AddDate(0, 0, *days)
+		expiresAt = &t
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	t, secret, err := createAPIToken(*owner, nil, strings.TrimSpace(*name), list, expiresAt)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Token %d (%s) with scopes %s:\n%s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), secret)
+	return nil
+}
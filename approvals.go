@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Approval decisions and statuses
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+// ApprovalRule routes a submitter's receipts at or above MinAmount (in the
+// home currency) to an approver. Submitter "*" matches everyone and a nil
+// Category matches every category.
+type ApprovalRule struct {
+	ID        int64   `json:"id"`
+	Submitter string  `json:"submitter"`
+	Category  *string `json:"category"`
+	MinAmount float64 `json:"min_amount"`
+	Approver  string  `json:"approver"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// ReceiptApproval is a receipt waiting for or decided by an approver
+type ReceiptApproval struct {
+	ID            int64   `json:"id"`
+	ReceiptID     int64   `json:"receipt_id"`
+	TransactionID int64   `json:"transaction_id"`
+	RuleID        *int64  `json:"rule_id"`
+	Submitter     string  `json:"submitter"`
+	Approver      string  `json:"approver"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Merchant      string  `json:"merchant"`
+	Category      string  `json:"category"`
+	Date          *string `json:"date"`
+	Status        string  `json:"status"`
+	Comment       string  `json:"comment,omitempty"`
+	RequestedAt   string  `json:"requested_at"`
+	DecidedAt     *string `json:"decided_at"`
+}
+
+// matchApprovalRule finds the rule for a receipt: rules for the submitter
+// beat rules for everyone, category rules beat catch-all rules, and higher
+// thresholds beat lower ones. Rules naming the submitter as approver are
+// skipped so nobody approves their own receipts.
+func matchApprovalRule(submitter, category string, amount float64) (*ApprovalRule, error) {
+	var r ApprovalRule
+	var cat sql.NullString
+	var createdAt time.Time
+	err := db.QueryRow(
+		`SELECT id, submitter, category, min_amount, approver, created_at
+		FROM approval_rules
+		WHERE (submitter = ? OR submitter = '*') AND (category IS NULL OR category = ?)
+			AND min_amount <= ? AND approver <> ?
+		ORDER BY submitter = '*', category IS NULL, min_amount DESC, id
+		LIMIT 1`,
+		submitter, category, amount, submitter,
+	).Scan(&r.ID, &r.Submitter, &cat, &r.MinAmount, &r.Approver, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to match approval rules: %v", err)
+	}
+	r.Category = nullStringPtr(cat)
+	r.CreatedAt = createdAt.Format(time.RFC3339)
+	return &r, nil
+}
+
+// requestApproval checks whether a processed receipt needs approval and, if
+// so, assigns it to the approver and marks it pending_approval instead of
+// processed
+func requestApproval(in PipelineInput, transactionID int64, data *GeminiParsedData) (bool, error) {
+	submitter := in.Tenant
+	if submitter == "" {
+		submitter = defaultTenant
+	}
+
+	var amount float64
+	err := db.QueryRow(
+		"SELECT COALESCE(home_amount, amount, 0) FROM transactions WHERE id = ?", transactionID,
+	).Scan(&amount)
+	if err != nil {
+		return false, fmt.Errorf("failed to load transaction %d: %v", transactionID, err)
+	}
+
+	rule, err := matchApprovalRule(submitter, data.Category, amount)
+	if err != nil || rule == nil {
+		return false, err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO receipt_approvals (receipt_id, transaction_id, rule_id, submitter, approver, amount, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE transaction_id = VALUES(transaction_id), rule_id = VALUES(rule_id),
+			submitter = VALUES(submitter), approver = VALUES(approver), amount = VALUES(amount),
+			status = VALUES(status), comment = NULL, requested_at = NOW(), decided_at = NULL`,
+		in.ReceiptID, transactionID, rule.ID, submitter, rule.Approver, amount, approvalPending,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to request approval for receipt %d: %v", in.ReceiptID, err)
+	}
+	if _, err := db.Exec("UPDATE receipts SET status = ? WHERE id = ?", "pending_approval", in.ReceiptID); err != nil {
+		return false, fmt.Errorf("failed to mark receipt %d pending approval: %v", in.ReceiptID, err)
+	}
+
+	log.Printf("Receipt %d (%.2f %s) needs approval by %s", in.ReceiptID, amount, homeCurrency(), rule.Approver)
+	go notifyReceiptEvent(eventApprovalRequested, in.ReceiptID, transactionID, data, fiber.Map{
+		"submitter":   submitter,
+		"approver":    rule.Approver,
+		"home_amount": amount,
+		"rule_id":     rule.ID,
+	})
+	return true, nil
+}
+
+const receiptApprovalColumns = `a.id, a.receipt_id, a.transaction_id, a.rule_id, a.submitter, a.approver, a.amount,
+	COALESCE(t.merchant_clean, t.merchant_raw, ''), COALESCE(t.category, ''), t.date,
+	a.status, COALESCE(a.comment, ''), a.requested_at, a.decided_at`
+
+// scanReceiptApproval reads a row selected with receiptApprovalColumns
+func scanReceiptApproval(row interface{ Scan(...any) error }) (*ReceiptApproval, error) {
+	var a ReceiptApproval
+	var ruleID sql.NullInt64
+	var date, decidedAt sql.NullTime
+	var requestedAt time.Time
+	if err := row.Scan(&a.ID, &a.ReceiptID, &a.TransactionID, &ruleID, &a.Submitter, &a.Approver, &a.Amount,
+		&a.Merchant, &a.Category, &date, &a.Status, &a.Comment, &requestedAt, &decidedAt); err != nil {
+		return nil, err
+	}
+	if ruleID.Valid {
+		a.RuleID = &ruleID.Int64
+	}
+	a.Currency = homeCurrency()
+	a.Date = formatNullDate(date)
+	a.RequestedAt = requestedAt.Format(time.RFC3339)
+	if decidedAt.Valid {
+		formatted := decidedAt.Time.Format(time.RFC3339)
+		a.DecidedAt = &formatted
+	}
+	return &a, nil
+}
+
+// registerApprovalRoutes adds the approval rules, listings and decisions.
+// The caller is identified like the pipeline tenant (see tenantKey).
+func registerApprovalRoutes(app *fiber.App) {
+	app.Get("/approvals/rules", func(c *fiber.Ctx) error {
+		rows, err := db.Query(
+			`SELECT id, submitter, category, min_amount, approver, created_at
+			FROM approval_rules ORDER BY submitter, category, min_amount`,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load approval rules: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		rules := []ApprovalRule{}
+		for rows.Next() {
+			var r ApprovalRule
+			var cat sql.NullString
+			var createdAt time.Time
+			if err := rows.Scan(&r.ID, &r.Submitter, &cat, &r.MinAmount, &r.Approver, &createdAt); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read approval rules: %v", err),
+				})
+			}
+			r.Category = nullStringPtr(cat)
+			r.CreatedAt = createdAt.Format(time.RFC3339)
+			rules = append(rules, r)
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"currency": homeCurrency(),
+			"rules":    rules,
+		})
+	})
+
+	app.Post("/approvals/rules", func(c *fiber.Ctx) error {
+		var req struct {
+			Submitter string  `json:"submitter"`
+			Category  string  `json:"category"`
+			MinAmount float64 `json:"min_amount"`
+			Approver  string  `json:"approver"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		req.Submitter = strings.TrimSpace(req.Submitter)
+		if req.Submitter == "" {
+			req.Submitter = "*"
+		}
+		req.Approver = strings.TrimSpace(req.Approver)
+		if req.Approver == "" || req.Approver == "*" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "approver is required",
+			})
+		}
+		if req.Approver == req.Submitter {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "approver cannot be the submitter",
+			})
+		}
+		if req.MinAmount < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "min_amount cannot be negative",
+			})
+		}
+
+		category := strings.TrimSpace(req.Category)
+		result, err := db.Exec(
+			"INSERT INTO approval_rules (submitter, category, min_amount, approver) VALUES (?, ?, ?, ?)",
+			req.Submitter, sql.NullString{String: category, Valid: category != ""}, req.MinAmount, req.Approver,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save approval rule: %v", err),
+			})
+		}
+		id, _ := result.LastInsertId()
+
+		rule := ApprovalRule{
+			ID:        id,
+			Submitter: req.Submitter,
+			MinAmount: req.MinAmount,
+			Approver:  req.Approver,
+			CreatedAt: time.Now().Format(time.RFC3339),
+		}
+		if category != "" {
+			rule.Category = &category
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"rule":    rule,
+		})
+	})
+
+	// Deleting a rule leaves receipts already assigned under it pending
+	app.Delete("/approvals/rules/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid rule ID",
+			})
+		}
+		result, err := db.Exec("DELETE FROM approval_rules WHERE id = ?", id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to delete approval rule: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Approval rule not found",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	// Receipts the caller has to approve, or with role=submitter the
+	// caller's own submissions; status defaults to pending ("all" for every
+	// status)
+	app.Get("/approvals", func(c *fiber.Ctx) error {
+		column := "a.approver"
+		switch c.Query("role", "approver") {
+		case "approver":
+		case "submitter":
+			column = "a.submitter"
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "role must be approver or submitter",
+			})
+		}
+
+		where := column + " = ?"
+		args := []any{tenantKey(c)}
+		status := c.Query("status", approvalPending)
+		switch status {
+		case "all":
+		case approvalPending, approvalApproved, approvalRejected:
+			where += " AND a.status = ?"
+			args = append(args, status)
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "status must be pending, approved, rejected or all",
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT `+receiptApprovalColumns+`
+			FROM receipt_approvals a
+			JOIN receipts r ON r.id = a.receipt_id
+			LEFT JOIN transactions t ON t.id = a.transaction_id
+			WHERE r.deleted_at IS NULL AND `+where+`
+			ORDER BY a.requested_at`,
+			args...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load approvals: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		approvals := []*ReceiptApproval{}
+		for rows.Next() {
+			a, err := scanReceiptApproval(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read approvals: %v", err),
+				})
+			}
+			approvals = append(approvals, a)
+		}
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"count":     len(approvals),
+			"approvals": approvals,
+		})
+	})
+
+	// Approve or reject a pending receipt. Only the assigned approver may
+	// decide; approved receipts become processed and rejected ones rejected.
+	app.Post("/approvals/:id/decision", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid approval ID",
+			})
+		}
+		var req struct {
+			Decision string `json:"decision"`
+			Comment  string `json:"comment"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		var status, receiptStatus string
+		switch req.Decision {
+		case "approve":
+			status, receiptStatus = approvalApproved, "processed"
+		case "reject":
+			status, receiptStatus = approvalRejected, "rejected"
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "decision must be approve or reject",
+			})
+		}
+
+		a, err := scanReceiptApproval(db.QueryRow(
+			`SELECT `+receiptApprovalColumns+`
+			FROM receipt_approvals a
+			LEFT JOIN transactions t ON t.id = a.transaction_id
+			WHERE a.id = ?`,
+			id,
+		))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Approval not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load approval: %v", err),
+			})
+		}
+		if a.Approver != tenantKey(c) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Only the assigned approver can decide",
+			})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to start transaction: %v", err),
+			})
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(
+			`UPDATE receipt_approvals SET status = ?, comment = ?, decided_at = NOW()
+			WHERE id = ? AND status = ?`,
+			status, sql.NullString{String: req.Comment, Valid: req.Comment != ""}, id, approvalPending,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save decision: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("Approval was already %s", a.Status),
+			})
+		}
+		if _, err := tx.Exec("UPDATE receipts SET status = ? WHERE id = ?", receiptStatus, a.ReceiptID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update receipt: %v", err),
+			})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save decision: %v", err),
+			})
+		}
+
+		liveQueries.Invalidate()
+		a.Status, a.Comment = status, req.Comment
+		decidedAt := time.Now().Format(time.RFC3339)
+		a.DecidedAt = &decidedAt
+		go func() {
+			if err := sendWebhook(eventApprovalDecided, a); err != nil {
+				log.Printf("Failed to send %s webhook for receipt %d: %v", eventApprovalDecided, a.ReceiptID, err)
+			}
+			if status == approvalApproved && loadUserSettings(a.Submitter).Notifications.ReceiptProcessed {
+				sendReceiptWebhook(eventReceiptProcessed, a.ReceiptID, a.TransactionID, fiber.Map{
+					"receipt_id":     a.ReceiptID,
+					"transaction_id": a.TransactionID,
+					"date":           a.Date,
+					"merchant":       a.Merchant,
+					"category":       a.Category,
+					"home_amount":    a.Amount,
+					"approved_by":    a.Approver,
+				})
+			}
+		}()
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"approval": a,
+		})
+	})
+}
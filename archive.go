@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// transactionsAllView spans the live and archived transactions; reports
+// read from it when their date range reaches into the archive
+const transactionsAllView = "transactions_all"
+
+// archiveBatchSize is how many transactions are moved per database
+// transaction, keeping locks on the live table short
+const archiveBatchSize = 1000
+
+// tableColumns returns the columns of a table in ordinal order
+func tableColumns(table string) ([]string, error) {
+	rows, err := db.Query(
+		`SELECT column_name FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ?
+		ORDER BY ordinal_position`,
+		table,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, fmt.Errorf("failed to scan %s columns: %v", table, err)
+		}
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
+}
+
+// syncCopyColumns adds columns added to transactions since a table holding
+// copies of its rows (the archive or the trash) was created
+func syncCopyColumns(table string) error {
+	rows, err := db.Query(
+		`SELECT t.column_name, t.column_type
+		FROM information_schema.columns t
+		LEFT JOIN information_schema.columns a
+			ON a.table_schema = t.table_schema AND a.table_name = ? AND a.column_name = t.column_name
+		WHERE t.table_schema = DATABASE() AND t.table_name = 'transactions' AND a.column_name IS NULL
+		ORDER BY t.ordinal_position`,
+		table,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to compare %s columns: %v", table, err)
+	}
+	type missingColumn struct{ name, columnType string }
+	var missing []missingColumn
+	for rows.Next() {
+		var m missingColumn
+		if err := rows.Scan(&m.name, &m.columnType); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan %s columns: %v", table, err)
+		}
+		missing = append(missing, m)
+	}
+	rows.Close()
+
+	for _, m := range missing {
+		// Rows are copied as they are, so the column needs no default or
+		// NOT NULL of its own
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN `%s` %s NULL", table, m.name, m.columnType)
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", table, m.name, err)
+		}
+		log.Printf("Added column %s.%s", table, m.name)
+	}
+	return nil
+}
+
+// syncArchiveColumns brings the archive and trash tables up to the columns
+// of transactions, and recreates the transactions_all view over the live
+// and archived transactions
+func syncArchiveColumns() error {
+	for _, table := range []string{"transactions_archive", transactionsTrashTable} {
+		if err := syncCopyColumns(table); err != nil {
+			return err
+		}
+	}
+
+	columns, err := tableColumns("transactions")
+	if err != nil {
+		return err
+	}
+	list := "`" + strings.Join(columns, "`, `") + "`"
+	view := fmt.Sprintf("CREATE OR REPLACE VIEW %s AS SELECT %s FROM transactions UNION ALL SELECT %s FROM transactions_archive",
+		transactionsAllView, list, list)
+	if _, err := db.Exec(view); err != nil {
+		return fmt.Errorf("failed to create %s view: %v", transactionsAllView, err)
+	}
+	return nil
+}
+
+// archiveHorizon returns the date of the newest archived transaction, or
+// false when nothing has been archived
+func archiveHorizon() (time.Time, bool, error) {
+	var newest sql.NullTime
+	if err := db.QueryRow("SELECT MAX(date) FROM transactions_archive").Scan(&newest); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to read archive horizon: %v", err)
+	}
+	return newest.Time, newest.Valid, nil
+}
+
+// reportTransactionsTable picks the table a report reads: the live table
+// when the from date lies after everything archived, otherwise the view
+// spanning live and archived transactions
+func reportTransactionsTable(c *fiber.Ctx) string {
+	from, err := time.Parse("2006-01-02", c.Query("from"))
+	if err != nil {
+		from = time.Time{}
+	}
+	return transactionsTableSince(from)
+}
+
+// transactionsTableSince is reportTransactionsTable for a from date known
+// to the caller; the zero time reads everything
+func transactionsTableSince(from time.Time) string {
+	horizon, archived, err := archiveHorizon()
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		return transactionsAllView
+	}
+	if !archived || from.After(horizon) {
+		return "transactions"
+	}
+	return transactionsAllView
+}
+
+// archivableTransactionsSQL selects transactions dated before the cutoff
+// that nothing still works on: unbilled project expenses, receipts waiting
+// for approval and receipts being analyzed again stay live
+const archivableTransactionsSQL = `FROM transactions t
+	WHERE t.date < ?
+		AND NOT (t.project_id IS NOT NULL AND t.invoice_id IS NULL)
+		AND NOT EXISTS (SELECT 1 FROM receipt_approvals a WHERE a.transaction_id = t.id AND a.status = 'pending')
+		AND NOT EXISTS (SELECT 1 FROM receipts r WHERE r.id = t.receipt_id AND r.status IN ('pending', 'processing'))`
+
+// unarchiveReceiptTransactions moves a receipt's archived transactions back
+// to the live table, so analyzing the receipt again updates them in place.
+// The archiver moves them back once the receipt is processed.
+func unarchiveReceiptTransactions(receiptID int64) (int64, error) {
+	columns, err := tableColumns("transactions")
+	if err != nil {
+		return 0, err
+	}
+	list := "`" + strings.Join(columns, "`, `") + "`"
+
+	var moved int64
+	err = inTx("unarchive transactions", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			fmt.Sprintf("INSERT INTO transactions (%s) SELECT %s FROM transactions_archive WHERE receipt_id = ?", list, list),
+			receiptID,
+		); err != nil {
+			return fmt.Errorf("failed to copy transactions from the archive: %v", err)
+		}
+		res, err := tx.Exec("DELETE FROM transactions_archive WHERE receipt_id = ?", receiptID)
+		if err != nil {
+			return fmt.Errorf("failed to remove unarchived transactions: %v", err)
+		}
+		moved, _ = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to unarchive transactions of receipt %d: %v", receiptID, err)
+	}
+	return moved, nil
+}
+
+// archiveTransactions moves transactions dated before the cutoff to
+// transactions_archive in batches and returns how many were moved. Their
+// receipts stay in place.
+func archiveTransactions(cutoff time.Time, batchSize int) (int64, error) {
+	columns, err := tableColumns("transactions")
+	if err != nil {
+		return 0, err
+	}
+	list := "`" + strings.Join(columns, "`, `") + "`"
+
+	var moved int64
+	for {
+		rows, err := db.Query("SELECT t.id "+archivableTransactionsSQL+" ORDER BY t.id LIMIT ?", cutoff, batchSize)
+		if err != nil {
+			return moved, fmt.Errorf("failed to select transactions to archive: %v", err)
+		}
+		var ids []any
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return moved, fmt.Errorf("failed to scan transaction: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return moved, nil
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+		err = inTx("archive transactions", func(tx *sql.Tx) error {
+			if _, err := tx.Exec(
+				fmt.Sprintf("INSERT INTO transactions_archive (%s, archived_at) SELECT %s, NOW() FROM transactions WHERE id IN (%s)",
+					list, list, placeholders),
+				ids...,
+			); err != nil {
+				return fmt.Errorf("failed to copy transactions to the archive: %v", err)
+			}
+			if _, err := tx.Exec("DELETE FROM transactions WHERE id IN ("+placeholders+")", ids...); err != nil {
+				return fmt.Errorf("failed to remove archived transactions: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		moved += int64(len(ids))
+	}
+}
+
+// countArchivable returns how many transactions archiveTransactions would
+// move
+func countArchivable(cutoff time.Time) (int64, error) {
+	var count int64
+	if err := db.QueryRow("SELECT COUNT(*) "+archivableTransactionsSQL, cutoff).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count transactions: %v", err)
+	}
+	return count, nil
+}
+
+// archiveAfterYears is the age in years after which transactions move to
+// the archive table (ARCHIVE_AFTER_YEARS, 0 or empty disables the job)
+func archiveAfterYears() int {
+	if v, err := strconv.Atoi(os.Getenv("ARCHIVE_AFTER_YEARS")); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// startArchiveScheduler archives transactions older than
+// ARCHIVE_AFTER_YEARS once a day
+func startArchiveScheduler() {
+	years := archiveAfterYears()
+	if years == 0 {
+		return
+	}
+
+	log.Printf("Archive: transactions older than %d year(s) are archived daily", years)
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			n, err := archiveTransactions(time.Now().AddDate(-years, 0, 0), archiveBatchSize)
+			if err != nil {
+				log.Printf("Archive: scheduled run failed after %d transaction(s): %v", n, err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Archive: archived %d transaction(s)", n)
+			}
+		}
+	}()
+}
+
+// runArchive moves old transactions to the archive table once from the
+// command line.
+//
+// Usage: archive [-before YYYY-MM-DD | -years N] [-batch N] [-dry-run]
+func runArchive(args []string) error {
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	before := fs.String("before", "", "archive transactions dated before this day")
+	years := fs.Int("years", archiveAfterYears(), "archive transactions older than this many years (default ARCHIVE_AFTER_YEARS)")
+	batch := fs.Int("batch", archiveBatchSize, "transactions moved per database transaction")
+	dryRun := fs.Bool("dry-run", false, "only count the transactions that would be archived")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var cutoff time.Time
+	switch {
+	case *before != "":
+		t, err := time.Parse("2006-01-02", *before)
+		if err != nil {
+			return fmt.Errorf("invalid -before date, expected YYYY-MM-DD")
+		}
+		cutoff = t
+	case *years > 0:
+		cutoff = time.Now().AddDate(-*years, 0, 0)
+	default:
+		return fmt.Errorf("-before or -years is required")
+	}
+	if *batch < 1 {
+		return fmt.Errorf("-batch must be at least 1")
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		count, err := countArchivable(cutoff)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d transaction(s) dated before %s would be archived\n", count, cutoff.Format("2006-01-02"))
+		return nil
+	}
+
+	n, err := archiveTransactions(cutoff, *batch)
+	fmt.Printf("Archived %d transaction(s) dated before %s\n", n, cutoff.Format("2006-01-02"))
+	return err
+}
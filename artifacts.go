@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Artifact kinds stored in receipt_artifacts
+const (
+	artifactRotation       = "osd_rotation"
+	artifactOCRText        = "ocr_text"
+	artifactGeminiResponse = "gemini_response"
+	artifactHOCR           = "ocr_hocr"
+	artifactLayoutCheck    = "layout_check"
+)
+
+// artifactCompressMinSize is the smallest artifact worth compressing; the
+// rotation angle and similar short values are stored as they are
+const artifactCompressMinSize = 128
+
+// artifactBackfillBatch is how many uncompressed rows are rewritten at once
+const artifactBackfillBatch = 200
+
+// zstdMagic starts every zstd frame, which is how compressed content is
+// told apart from rows written before compression was enabled
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	artifactEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	artifactDecoder, _ = zstd.NewReader(nil)
+)
+
+// artifactCompressionEnabled reports whether new artifacts are compressed
+// (ARTIFACT_COMPRESSION, on unless set to "off")
+func artifactCompressionEnabled() bool {
+	return os.Getenv("ARTIFACT_COMPRESSION") != "off"
+}
+
+// encodeArtifact returns the stored form of an artifact
+func encodeArtifact(content string) []byte {
+	if !artifactCompressionEnabled() || len(content) < artifactCompressMinSize {
+		return []byte(content)
+	}
+	return artifactEncoder.EncodeAll([]byte(content), nil)
+}
+
+// decodeArtifact returns the text of a stored artifact, compressed or not
+func decodeArtifact(stored []byte) string {
+	if !bytes.HasPrefix(stored, zstdMagic) {
+		return string(stored)
+	}
+	text, err := artifactDecoder.DecodeAll(stored, nil)
+	if err != nil {
+		log.Printf("Artifacts: failed to decompress content: %v", err)
+		return ""
+	}
+	return string(text)
+}
+
+// hashArtifact returns the hex SHA-256 of an artifact's text
+func hashArtifact(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// saveArtifact stores an intermediate pipeline output for a receipt. When
+// the latest artifact of the same kind has identical content, as happens
+// when a receipt is reprocessed, nothing new is stored.
+func saveArtifact(receiptID int64, kind string, content string) error {
+	hash := hashArtifact(content)
+
+	var latest sql.NullString
+	err := db.QueryRow(
+		"SELECT content_hash FROM receipt_artifacts WHERE receipt_id = ? AND kind = ? ORDER BY id DESC LIMIT 1",
+		receiptID, kind,
+	).Scan(&latest)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look up %s artifact: %v", kind, err)
+	}
+	if latest.Valid && latest.String == hash {
+		return nil
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO receipt_artifacts (receipt_id, kind, content, content_hash, content_size) VALUES (?, ?, ?, ?, ?)",
+		receiptID, kind, encodeArtifact(content), hash, len(content),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save %s artifact: %v", kind, err)
+	}
+	return nil
+}
+
+// loadArtifact returns the text of the latest artifact of a kind stored for
+// a receipt; found is false when there is none
+func loadArtifact(receiptID int64, kind string) (content string, found bool, err error) {
+	var stored []byte
+	err = db.QueryRow(
+		"SELECT content FROM receipt_artifacts WHERE receipt_id = ? AND kind = ? ORDER BY id DESC LIMIT 1",
+		receiptID, kind,
+	).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load %s artifact: %v", kind, err)
+	}
+	return decodeArtifact(stored), true, nil
+}
+
+// compressLegacyArtifacts rewrites artifacts stored before compression and
+// hashing were added, a batch at a time, and returns how many were updated
+func compressLegacyArtifacts() (int, error) {
+	updated := 0
+	for {
+		rows, err := db.Query(
+			"SELECT id, content FROM receipt_artifacts WHERE content_size IS NULL ORDER BY id LIMIT ?",
+			artifactBackfillBatch,
+		)
+		if err != nil {
+			return updated, fmt.Errorf("failed to load artifacts: %v", err)
+		}
+		type legacyArtifact struct {
+			id      int64
+			content []byte
+		}
+		var batch []legacyArtifact
+		for rows.Next() {
+			var a legacyArtifact
+			if err := rows.Scan(&a.id, &a.content); err != nil {
+				rows.Close()
+				return updated, fmt.Errorf("failed to scan artifact: %v", err)
+			}
+			batch = append(batch, a)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			return updated, nil
+		}
+
+		for _, a := range batch {
+			text := decodeArtifact(a.content)
+			_, err := db.Exec(
+				"UPDATE receipt_artifacts SET content = ?, content_hash = ?, content_size = ? WHERE id = ?",
+				encodeArtifact(text), hashArtifact(text), len(text), a.id,
+			)
+			if err != nil {
+				return updated, fmt.Errorf("failed to update artifact %d: %v", a.id, err)
+			}
+			updated++
+		}
+	}
+}
+
+// artifactRetentionDays is the age in days after which artifacts are
+// removed (ARTIFACT_RETENTION_DAYS, 0 or empty keeps them). This is
+// independent of transaction anonymization.
+func artifactRetentionDays() int {
+	if v, err := strconv.Atoi(os.Getenv("ARTIFACT_RETENTION_DAYS")); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// artifactRetentionKeepLatest reports whether the newest artifact of each
+// kind is kept for every receipt regardless of age
+// (ARTIFACT_RETENTION_KEEP_LATEST, on unless set to "false")
+func artifactRetentionKeepLatest() bool {
+	return os.Getenv("ARTIFACT_RETENTION_KEEP_LATEST") != "false"
+}
+
+// artifactPruneWhere selects the artifacts created before the cutoff, minus
+// the newest of each receipt and kind when keepLatest is set
+func artifactPruneWhere(keepLatest bool) string {
+	if !keepLatest {
+		return "FROM receipt_artifacts a WHERE a.created_at < ?"
+	}
+	return `FROM receipt_artifacts a
+		JOIN (SELECT receipt_id, kind, MAX(id) AS latest_id FROM receipt_artifacts GROUP BY receipt_id, kind) l
+			ON l.receipt_id = a.receipt_id AND l.kind = a.kind
+		WHERE a.created_at < ? AND a.id < l.latest_id`
+}
+
+// pruneArtifacts deletes artifacts created before the cutoff, or only
+// counts them when dryRun is set
+func pruneArtifacts(cutoff time.Time, keepLatest, dryRun bool) (int64, error) {
+	if dryRun {
+		var count int64
+		if err := db.QueryRow("SELECT COUNT(*) "+artifactPruneWhere(keepLatest), cutoff).Scan(&count); err != nil {
+			return 0, fmt.Errorf("failed to count artifacts: %v", err)
+		}
+		return count, nil
+	}
+
+	result, err := db.Exec("DELETE a "+artifactPruneWhere(keepLatest), cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune artifacts: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// ArtifactKindStats summarizes the stored artifacts of one kind
+type ArtifactKindStats struct {
+	Kind        string `json:"kind"`
+	Count       int64  `json:"count"`
+	StoredBytes int64  `json:"stored_bytes"`
+	RawBytes    int64  `json:"raw_bytes"`
+}
+
+// loadArtifactStats returns artifact counts and sizes per kind; raw bytes
+// of rows not yet backfilled are counted at their stored size
+func loadArtifactStats() ([]ArtifactKindStats, error) {
+	rows, err := db.Query(
+		`SELECT kind, COUNT(*), COALESCE(SUM(LENGTH(content)), 0), COALESCE(SUM(COALESCE(content_size, LENGTH(content))), 0)
+		FROM receipt_artifacts
+		GROUP BY kind
+		ORDER BY kind`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load artifact stats: %v", err)
+	}
+	defer rows.Close()
+
+	stats := []ArtifactKindStats{}
+	for rows.Next() {
+		var s ArtifactKindStats
+		if err := rows.Scan(&s.Kind, &s.Count, &s.StoredBytes, &s.RawBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan artifact stats: %v", err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// startArtifactScheduler compresses artifacts left from before compression
+// was enabled and then, once a day, prunes artifacts older than
+// ARTIFACT_RETENTION_DAYS
+func startArtifactScheduler() {
+	days := artifactRetentionDays()
+	keepLatest := artifactRetentionKeepLatest()
+	if days > 0 {
+		log.Printf("Artifacts: artifacts older than %d day(s) are pruned daily", days)
+	}
+
+	go func() {
+		if n, err := compressLegacyArtifacts(); err != nil {
+			log.Printf("Artifacts: backfill failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Artifacts: compressed %d stored artifact(s)", n)
+		}
+		if days == 0 {
+			return
+		}
+
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			n, err := pruneArtifacts(time.Now().AddDate(0, 0, -days), keepLatest, false)
+			if err != nil {
+				log.Printf("Artifacts: scheduled prune failed: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Artifacts: pruned %d artifact(s)", n)
+			}
+		}
+	}()
+}
+
+// registerArtifactRoutes adds artifact storage statistics and pruning
+func registerArtifactRoutes(app *fiber.App) {
+	// Count and stored vs. uncompressed size of the artifacts per kind
+	app.Get("/admin/artifacts/stats", func(c *fiber.Ctx) error {
+		stats, err := loadArtifactStats()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"compression": artifactCompressionEnabled(),
+			"kinds":       stats,
+		})
+	})
+
+	// Prune artifacts older than days (default ARTIFACT_RETENTION_DAYS).
+	// keep_latest=false also removes the newest artifact of each kind and
+	// dry_run=true only counts.
+	app.Post("/admin/artifacts/prune", func(c *fiber.Ctx) error {
+		days := c.QueryInt("days", artifactRetentionDays())
+		if days < 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "days must be at least 1 (or set ARTIFACT_RETENTION_DAYS)",
+			})
+		}
+		keepLatest := c.QueryBool("keep_latest", artifactRetentionKeepLatest())
+		dryRun := c.QueryBool("dry_run", false)
+
+		cutoff := time.Now().AddDate(0, 0, -days)
+		n, err := pruneArtifacts(cutoff, keepLatest, dryRun)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"dry_run":     dryRun,
+			"cutoff":      cutoff.Format("2006-01-02"),
+			"keep_latest": keepLatest,
+			"artifacts":   n,
+		})
+	})
+}
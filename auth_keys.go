@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// minAPIKeyLength rejects static keys short enough to guess
+const minAPIKeyLength = 16
+
+// staticAPIKey is a key from API_KEYS, sent as X-API-Key
+type staticAPIKey struct {
+	name   string
+	hash   [32]byte
+	scopes []string
+}
+
+// staticAPIKeys are loaded from API_KEYS on startup
+var staticAPIKeys []staticAPIKey
+
+// parseStaticAPIKeys reads comma-separated name:key entries, each with
+// optional scopes joined by +, e.g. n8n:k3y...:ingest+read. Keys without
+// scopes get admin.
+func parseStaticAPIKeys(s string) ([]staticAPIKey, error) {
+	var keys []staticAPIKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected name:key or name:key:scopes", entry)
+		}
+		if len(parts[1]) < minAPIKeyLength {
+			return nil, fmt.Errorf("key %q must be at least %d characters", parts[0], minAPIKeyLength)
+		}
+		scopes := []string{scopeAdmin}
+		if len(parts) == 3 {
+			var err error
+			if scopes, err = normalizeScopes(strings.Split(parts[2], "+")); err != nil {
+				return nil, fmt.Errorf("key %q: %v", parts[0], err)
+			}
+		}
+		keys = append(keys, staticAPIKey{name: parts[0], hash: sha256.Sum256([]byte(parts[1])), scopes: scopes})
+	}
+	return keys, nil
+}
+
+// staticKeyToken returns the token for an X-API-Key header, or nil when it
+// matches no configured key. The tenant stays the hash of the key, as
+// for requests before keys were checked.
+func staticKeyToken(key string) *APIToken {
+	sum := sha256.Sum256([]byte(key))
+	for _, k := range staticAPIKeys {
+		if subtle.ConstantTimeCompare(sum[:], k.hash[:]) == 1 {
+			return &APIToken{
+				Name:      k.name,
+				Prefix:    "static",
+				Scopes:    k.scopes,
+				TenantKey: "key:" + hex.EncodeToString(sum[:])[:16],
+			}
+		}
+	}
+	return nil
+}
+
+// JWTAuth verifies HS256 bearer tokens issued by another service
+type JWTAuth struct {
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+// jwtAuth is set on startup when JWT_SECRET is configured
+var jwtAuth *JWTAuth
+
+// newJWTAuth returns the verifier configured by JWT_SECRET, JWT_ISSUER and
+// JWT_AUDIENCE, or nil when JWT_SECRET is not set
+func newJWTAuth() (*JWTAuth, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("JWT_SECRET must be at least 32 characters")
+	}
+	return &JWTAuth{
+		secret:   []byte(secret),
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+	}, nil
+}
+
+// verify checks a token's signature and claims and returns it as an API
+// token owned by jwt:<sub>. The scopes come from the space-separated scope
+// claim or the scopes list; unknown scopes are ignored.
+func (j *JWTAuth) verify(token string) (*APIToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	enc := base64.RawURLEncoding
+	rawHeader, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	rawClaims, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+
+	// A minute of leeway for clock skew
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if int64(exp) < time.Now().Add(-time.Minute).Unix() {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && int64(nbf) > time.Now().Add(time.Minute).Unix() {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+	if iss, _ := claims["iss"].(string); j.issuer != "" && iss != j.issuer {
+		return nil, fmt.Errorf("token issued by %q", iss)
+	}
+	if j.audience != "" && !containsString(claimStrings(claims["aud"]), j.audience) {
+		return nil, fmt.Errorf("token is not meant for this service")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+
+	requested := claimStrings(claims["scopes"])
+	if s, ok := claims["scope"].(string); ok {
+		requested = append(requested, strings.Fields(s)...)
+	}
+	var scopes []string
+	for _, s := range requested {
+		if containsString(tokenScopes, s) && !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("token grants none of the scopes %s", strings.Join(tokenScopes, ", "))
+	}
+	return &APIToken{Name: sub, Prefix: "jwt", Scopes: scopes, TenantKey: "jwt:" + sub}, nil
+}
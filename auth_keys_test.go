@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStaticAPIKeys(t *testing.T) {
+	tests := []struct {
+		in     string
+		names  []string
+		scopes [][]string
+		ok     bool
+	}{
+		{"", nil, nil, true},
+		{"n8n:0123456789abcdef", []string{"n8n"}, [][]string{{scopeAdmin}}, true},
+		{" n8n:0123456789abcdef:ingest+read , ,ci:fedcba9876543210:READ ",
+			[]string{"n8n", "ci"}, [][]string{{scopeIngest, scopeRead}, {scopeRead}}, true},
+		{"n8n:0123456789abcdef:read+read", []string{"n8n"}, [][]string{{scopeRead}}, true},
+		{"n8n:short", nil, nil, false},
+		{":0123456789abcdef", nil, nil, false},
+		{"0123456789abcdef", nil, nil, false},
+		{"n8n:0123456789abcdef:read:extra", nil, nil, false},
+		{"n8n:0123456789abcdef:write", nil, nil, false},
+		{"n8n:0123456789abcdef:", nil, nil, false},
+	}
+	for _, tt := range tests {
+		keys, err := parseStaticAPIKeys(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseStaticAPIKeys(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		var names []string
+		var scopes [][]string
+		for _, k := range keys {
+			names = append(names, k.name)
+			scopes = append(scopes, k.scopes)
+		}
+		if !reflect.DeepEqual(names, tt.names) || !reflect.DeepEqual(scopes, tt.scopes) {
+			t.Errorf("parseStaticAPIKeys(%q) = %v %v, want %v %v", tt.in, names, scopes, tt.names, tt.scopes)
+		}
+	}
+
+	keys, err := parseStaticAPIKeys("n8n:0123456789abcdef")
+	if err != nil || keys[0].hash != sha256.Sum256([]byte("0123456789abcdef")) {
+		t.Errorf("key hash not stored (%v)", err)
+	}
+}
+
+// signJWT builds an HS256 style token with the given header and claims
+func signJWT(secret string, header, claims map[string]any) string {
+	enc := base64.RawURLEncoding
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	unsigned := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthVerify(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	auth := &JWTAuth{secret: []byte(secret), issuer: "https://id.example.com", audience: "receipts"}
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+
+	// claims returns valid claims with the given changes, nil removing one
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"sub":   "n8n",
+			"iss":   "https://id.example.com",
+			"aud":   "receipts",
+			"exp":   now + 300,
+			"scope": "ingest read",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	valid := signJWT(secret, hs256, claims(nil))
+
+	tests := []struct {
+		name   string
+		token  string
+		scopes []string
+		ok     bool
+	}{
+		{"valid", valid, []string{scopeIngest, scopeRead}, true},
+		{"audience list", signJWT(secret, hs256, claims(map[string]any{"aud": []string{"other", "receipts"}})),
+			[]string{scopeIngest, scopeRead}, true},
+		{"scopes list and claim merged", signJWT(secret, hs256, claims(map[string]any{"scopes": []string{"read", "admin"}})),
+			[]string{scopeRead, scopeAdmin, scopeIngest}, true},
+		{"unknown scopes ignored", signJWT(secret, hs256, claims(map[string]any{"scope": "read write"})),
+			[]string{scopeRead}, true},
+		{"expired within leeway", signJWT(secret, hs256, claims(map[string]any{"exp": now - 30})),
+			[]string{scopeIngest, scopeRead}, true},
+		{"expired", signJWT(secret, hs256, claims(map[string]any{"exp": now - 120})), nil, false},
+		{"no expiry", signJWT(secret, hs256, claims(map[string]any{"exp": nil})), nil, false},
+		{"not valid yet", signJWT(secret, hs256, claims(map[string]any{"nbf": now + 600})), nil, false},
+		{"other issuer", signJWT(secret, hs256, claims(map[string]any{"iss": "https://evil.example.com"})), nil, false},
+		{"other audience", signJWT(secret, hs256, claims(map[string]any{"aud": "billing"})), nil, false},
+		{"no subject", signJWT(secret, hs256, claims(map[string]any{"sub": nil})), nil, false},
+		{"no known scope", signJWT(secret, hs256, claims(map[string]any{"scope": "write"})), nil, false},
+		{"wrong secret", signJWT("fedcba9876543210fedcba9876543210", hs256, claims(nil)), nil, false},
+		{"alg none", signJWT(secret, map[string]any{"alg": "none"}, claims(nil)), nil, false},
+		{"alg HS512", signJWT(secret, map[string]any{"alg": "HS512"}, claims(nil)), nil, false},
+		{"unsigned", valid[:strings.LastIndex(valid, ".")+1], nil, false},
+		{"two parts", "a.b", nil, false},
+		{"garbage", "not.a.token", nil, false},
+	}
+	for _, tt := range tests {
+		tok, err := auth.verify(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verify error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !reflect.DeepEqual(tok.Scopes, tt.scopes) {
+			t.Errorf("%s: scopes = %v, want %v", tt.name, tok.Scopes, tt.scopes)
+		}
+		if tok.TenantKey != "jwt:n8n" || tok.Prefix != "jwt" {
+			t.Errorf("%s: token = %+v, want tenant jwt:n8n", tt.name, tok)
+		}
+	}
+
+	// Without a configured issuer and audience any are accepted
+	open := &JWTAuth{secret: []byte(secret)}
+	if _, err := open.verify(signJWT(secret, hs256, claims(map[string]any{"iss": nil, "aud": nil}))); err != nil {
+		t.Errorf("verify without issuer and audience: %v", err)
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// backupPrefix is the key prefix backups are written under in storage
+const backupPrefix = "backups/"
+
+// backupBinaryKey marks a dumped column value holding base64 encoded bytes
+const backupBinaryKey = "$base64"
+
+// backupTables returns the tables to dump, in schema order so that parent
+// rows are restored before the rows that reference them
+func backupTables() []string {
+	names := make([]string, len(schemaTables))
+	for i, table := range schemaTables {
+		names[i] = table.Name
+	}
+	return names
+}
+
+// BackupManifest describes the contents of a backup archive
+type BackupManifest struct {
+	Version   int                `json:"version"`
+	CreatedAt time.Time          `json:"created_at"`
+	Tables    map[string]int     `json:"tables"`
+	Files     []BackupFileRecord `json:"files"`
+}
+
+// BackupFileRecord references a receipt file at the time of the backup
+type BackupFileRecord struct {
+	ReceiptID      int64  `json:"receipt_id"`
+	FileName       string `json:"file_name"`
+	StorageBackend string `json:"storage_backend"`
+	Checksum       string `json:"checksum,omitempty"`
+	Included       bool   `json:"included"`
+}
+
+// backupStorage returns the storage backend backups are written to
+func backupStorage() (Storage, error) {
+	name := os.Getenv("BACKUP_STORAGE")
+	if name == "" {
+		name = "local"
+	}
+	return newStorage(name)
+}
+
+// createBackup dumps all tables from a single consistent snapshot into a ZIP
+// archive (JSON per table plus a file manifest) and writes it to backup storage.
+// When includeFiles is set the receipt files themselves are added to the archive.
+func createBackup(ctx context.Context, includeFiles bool) (string, *BackupManifest, error) {
+	store, err := backupStorage()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "receipt-backup-*.zip")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// A read-only repeatable-read transaction gives every table the same snapshot
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start snapshot: %v", err)
+	}
+	defer tx.Rollback()
+
+	manifest := &BackupManifest{
+		Version:   1,
+		CreatedAt: time.Now().UTC(),
+		Tables:    make(map[string]int),
+	}
+
+	zw := zip.NewWriter(tmp)
+	for _, table := range backupTables() {
+		rows, err := dumpTable(ctx, tx, table)
+		if err != nil {
+			return "", nil, err
+		}
+		w, err := zw.Create("tables/" + table + ".json")
+		if err != nil {
+			return "", nil, err
+		}
+		if err := json.NewEncoder(w).Encode(rows); err != nil {
+			return "", nil, fmt.Errorf("failed to write %s: %v", table, err)
+		}
+		manifest.Tables[table] = len(rows)
+	}
+
+	fileRows, err := tx.QueryContext(ctx, "SELECT id, file_name, storage_backend, checksum FROM receipts ORDER BY id")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list receipt files: %v", err)
+	}
+	for fileRows.Next() {
+		var rec BackupFileRecord
+		var checksum sql.NullString
+		if err := fileRows.Scan(&rec.ReceiptID, &rec.FileName, &rec.StorageBackend, &checksum); err != nil {
+			fileRows.Close()
+			return "", nil, fmt.Errorf("failed to scan receipt file: %v", err)
+		}
+		rec.Checksum = checksum.String
+		manifest.Files = append(manifest.Files, rec)
+	}
+	fileRows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("failed to close snapshot: %v", err)
+	}
+
+	if includeFiles {
+		for i := range manifest.Files {
+			rec := &manifest.Files[i]
+			if err := addFileToBackup(zw, rec); err != nil {
+				log.Printf("Backup: skipping file for receipt %d: %v", rec.ReceiptID, err)
+				continue
+			}
+			rec.Included = true
+		}
+	}
+
+	w, err := zw.Create("manifest.json")
+	if err != nil {
+		return "", nil, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return "", nil, fmt.Errorf("failed to write manifest: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", nil, fmt.Errorf("failed to finalize archive: %v", err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	key := fmt.Sprintf("%sbackup-%s.zip", backupPrefix, manifest.CreatedAt.Format("20060102_150405"))
+	if err := store.Save(key, tmp); err != nil {
+		return "", nil, fmt.Errorf("failed to store backup: %v", err)
+	}
+
+	return key, manifest, nil
+}
+
+// addFileToBackup copies a receipt file from its storage backend into the archive
+func addFileToBackup(zw *zip.Writer, rec *BackupFileRecord) error {
+	store, err := newStorage(rec.StorageBackend)
+	if err != nil {
+		return err
+	}
+	r, err := store.Open(rec.FileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := zw.Create(path.Join("files", rec.StorageBackend, rec.FileName))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// dumpTable reads every row of a table as column → value maps
+func dumpTable(ctx context.Context, tx *sql.Tx, table string) ([]map[string]any, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT * FROM "+table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]any{}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("failed to scan %s row: %v", table, err)
+		}
+
+		row := make(map[string]any, len(columns))
+		for i, col := range columns {
+			switch v := values[i].(type) {
+			case []byte:
+				if utf8.Valid(v) {
+					row[col] = string(v)
+				} else {
+					// Binary content such as compressed artifacts would be
+					// mangled as a JSON string
+					row[col] = map[string]any{backupBinaryKey: base64.StdEncoding.EncodeToString(v)}
+				}
+			case time.Time:
+				row[col] = v.Format("2006-01-02 15:04:05")
+			default:
+				row[col] = v
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// restoreBackup replaces the contents of all backed-up tables with the rows in
+// the archive. With restoreFiles set, files included in the archive are written
+// back to their storage backend when they are missing there.
+func restoreBackup(ctx context.Context, r io.ReaderAt, size int64, restoreFiles bool) (*BackupManifest, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup archive: %v", err)
+	}
+
+	var manifest BackupManifest
+	if err := readZipJSON(zr, "manifest.json", &manifest); err != nil {
+		return nil, err
+	}
+	// A crafted manifest must not write files outside the storage roots;
+	// it is checked before any data is replaced
+	if restoreFiles {
+		if err := checkBackupFiles(manifest.Files); err != nil {
+			return nil, fmt.Errorf("invalid backup manifest: %v", err)
+		}
+	}
+
+	tables := make(map[string][]map[string]any)
+	for _, table := range backupTables() {
+		if _, ok := manifest.Tables[table]; !ok {
+			// Table was added after this backup was taken; leave it untouched
+			log.Printf("Restore: backup has no %s table, skipping", table)
+			continue
+		}
+		var rows []map[string]any
+		if err := readZipJSON(zr, "tables/"+table+".json", &rows); err != nil {
+			return nil, err
+		}
+		tables[table] = rows
+	}
+
+	// FOREIGN_KEY_CHECKS is per session, so pin a single connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS = 1")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tableNames := backupTables()
+	for i := len(tableNames) - 1; i >= 0; i-- {
+		if _, ok := tables[tableNames[i]]; !ok {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+tableNames[i]); err != nil {
+			return nil, fmt.Errorf("failed to clear %s: %v", tableNames[i], err)
+		}
+	}
+
+	for _, table := range backupTables() {
+		for _, row := range tables[table] {
+			if err := insertBackupRow(ctx, tx, table, row); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit restore: %v", err)
+	}
+
+	if restoreFiles {
+		for _, rec := range manifest.Files {
+			if !rec.Included {
+				continue
+			}
+			if err := restoreBackupFile(zr, rec); err != nil {
+				log.Printf("Restore: failed to restore file for receipt %d: %v", rec.ReceiptID, err)
+			}
+		}
+	}
+
+	return &manifest, nil
+}
+
+// insertBackupRow inserts one dumped row, using only the columns present in it
+func insertBackupRow(ctx context.Context, tx *sql.Tx, table string, row map[string]any) error {
+	columns := make([]string, 0, len(row))
+	for col := range row {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+
+	args := make([]any, len(columns))
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		args[i] = row[col]
+		if m, ok := row[col].(map[string]any); ok {
+			encoded, _ := m[backupBinaryKey].(string)
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return fmt.Errorf("failed to decode %s.%s: %v", table, col, err)
+			}
+			args[i] = data
+		}
+		quoted[i] = "`" + col + "`"
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return fmt.Errorf("failed to restore %s row: %v", table, err)
+	}
+	return nil
+}
+
+// checkBackupFiles rejects manifest files with names that leave the storage
+// root or in backends this deployment does not use
+func checkBackupFiles(files []BackupFileRecord) error {
+	backends := configuredStorageNames()
+	for _, rec := range files {
+		if !rec.Included {
+			continue
+		}
+		if err := checkStorageKey(rec.FileName); err != nil {
+			return fmt.Errorf("receipt %d: %v", rec.ReceiptID, err)
+		}
+		if !containsString(backends, rec.StorageBackend) {
+			return fmt.Errorf("receipt %d: storage backend %q is not configured", rec.ReceiptID, rec.StorageBackend)
+		}
+	}
+	return nil
+}
+
+// restoreBackupFile writes an archived file back to storage if it is missing there
+func restoreBackupFile(zr *zip.Reader, rec BackupFileRecord) error {
+	if err := checkStorageKey(rec.FileName); err != nil {
+		return err
+	}
+	store, err := newStorage(rec.StorageBackend)
+	if err != nil {
+		return err
+	}
+	if existing, err := store.Open(rec.FileName); err == nil {
+		existing.Close()
+		return nil
+	}
+
+	f, err := zr.Open(path.Join("files", rec.StorageBackend, rec.FileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Save(rec.FileName, f)
+}
+
+// readZipJSON decodes a JSON file from an archive, keeping numbers exact
+func readZipJSON(zr *zip.Reader, name string, v any) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("backup archive is missing %s", name)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return nil
+}
+
+// pruneBackups deletes the oldest backups so that at most keep remain
+func pruneBackups(store Storage, keep int) error {
+	keys, err := store.List(backupPrefix)
+	if err != nil {
+		return err
+	}
+	// Backup keys embed their timestamp, so lexical order is chronological
+	sort.Strings(keys)
+	for len(keys) > keep {
+		if err := store.Delete(keys[0]); err != nil {
+			return err
+		}
+		log.Printf("Backup: removed old backup %s", keys[0])
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// startBackupScheduler runs automatic backups every BACKUP_INTERVAL (e.g. "24h"),
+// keeping the newest BACKUP_RETENTION backups (default 7). Disabled when
+// BACKUP_INTERVAL is not set.
+func startBackupScheduler() {
+	intervalStr := os.Getenv("BACKUP_INTERVAL")
+	if intervalStr == "" {
+		return
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		log.Printf("Backup: invalid BACKUP_INTERVAL %q, scheduled backups disabled", intervalStr)
+		return
+	}
+
+	retention := 7
+	if v, err := strconv.Atoi(os.Getenv("BACKUP_RETENTION")); err == nil && v > 0 {
+		retention = v
+	}
+	includeFiles := os.Getenv("BACKUP_INCLUDE_FILES") == "true"
+
+	log.Printf("Backup: scheduled every %v, keeping %d", interval, retention)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			key, _, err := createBackup(context.Background(), includeFiles)
+			if err != nil {
+				log.Printf("Backup: scheduled backup failed: %v", err)
+				continue
+			}
+			log.Printf("Backup: wrote %s", key)
+
+			store, err := backupStorage()
+			if err == nil {
+				err = pruneBackups(store, retention)
+			}
+			if err != nil {
+				log.Printf("Backup: failed to apply retention: %v", err)
+			}
+		}
+	}()
+}
+
+// registerBackupRoutes adds the backup and restore admin endpoints
+func registerBackupRoutes(app *fiber.App) {
+	app.Post("/admin/backup", func(c *fiber.Ctx) error {
+		includeFiles := c.QueryBool("include_files", false)
+
+		key, manifest, err := createBackup(c.Context(), includeFiles)
+		if err != nil {
+			log.Printf("Backup failed: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Backup failed: %v", err),
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success":    true,
+			"key":        key,
+			"created_at": manifest.CreatedAt,
+			"tables":     manifest.Tables,
+			"files":      len(manifest.Files),
+		})
+	})
+
+	app.Get("/admin/backups", func(c *fiber.Ctx) error {
+		store, err := backupStorage()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		keys, err := store.List(backupPrefix)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list backups: %v", err),
+			})
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"backups": keys,
+			"count":   len(keys),
+		})
+	})
+
+	// Restore from a stored backup ({"key": "..."}) or an uploaded archive
+	// (multipart field "file"). Requires confirm=true since it replaces all data.
+	app.Post("/admin/restore", func(c *fiber.Ctx) error {
+		type RestoreRequest struct {
+			Key          string `json:"key" form:"key"`
+			Confirm      bool   `json:"confirm" form:"confirm"`
+			RestoreFiles bool   `json:"restore_files" form:"restore_files"`
+		}
+
+		var req RestoreRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if !req.Confirm {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Restore replaces all existing data; set confirm=true to proceed",
+			})
+		}
+
+		tmp, err := os.CreateTemp("", "receipt-restore-*.zip")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create temp file",
+			})
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if file, err := c.FormFile("file"); err == nil {
+			src, err := file.Open()
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Failed to read uploaded archive",
+				})
+			}
+			_, err = io.Copy(tmp, src)
+			src.Close()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to buffer uploaded archive",
+				})
+			}
+		} else if req.Key != "" {
+			if !strings.HasPrefix(req.Key, backupPrefix) || checkStorageKey(req.Key) != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "key must name a backup below " + backupPrefix,
+				})
+			}
+			store, err := backupStorage()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			src, err := store.Open(req.Key)
+			if err != nil {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Backup not found",
+				})
+			}
+			_, err = io.Copy(tmp, src)
+			src.Close()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to read backup",
+				})
+			}
+		} else {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Provide a backup key or upload an archive in the file field",
+			})
+		}
+
+		info, err := tmp.Stat()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to read backup",
+			})
+		}
+
+		manifest, err := restoreBackup(c.Context(), tmp, info.Size(), req.RestoreFiles)
+		if err != nil {
+			log.Printf("Restore failed: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Restore failed: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":    true,
+			"created_at": manifest.CreatedAt,
+			"tables":     manifest.Tables,
+			"files":      len(manifest.Files),
+		})
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestCheckStorageKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"receipt.jpg", true},
+		{"backups/backup-20240101-000000.zip", true},
+		{"2024/01/receipt..jpg", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"\\windows\\system32", false},
+		{"../etc/passwd", false},
+		{"backups/../../etc/passwd", false},
+		{"backups/..", false},
+		{"a\\..\\..\\b", false},
+	}
+	for _, tt := range tests {
+		if err := checkStorageKey(tt.key); (err == nil) != tt.ok {
+			t.Errorf("checkStorageKey(%q) = %v, want ok %v", tt.key, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckBackupFiles(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "")
+	t.Setenv("DISK_ARCHIVE_BACKEND", "s3")
+
+	tests := []struct {
+		name string
+		rec  BackupFileRecord
+		ok   bool
+	}{
+		{"local file", BackupFileRecord{FileName: "a.jpg", StorageBackend: "local", Included: true}, true},
+		{"archive backend", BackupFileRecord{FileName: "a.jpg", StorageBackend: "s3", Included: true}, true},
+		{"traversal", BackupFileRecord{FileName: "../../etc/cron.d/x", StorageBackend: "local", Included: true}, false},
+		{"absolute", BackupFileRecord{FileName: "/etc/cron.d/x", StorageBackend: "local", Included: true}, false},
+		{"unconfigured backend", BackupFileRecord{FileName: "a.jpg", StorageBackend: "gcs", Included: true}, false},
+		{"not included", BackupFileRecord{FileName: "../x", StorageBackend: "gcs"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkBackupFiles([]BackupFileRecord{tt.rec}); (err == nil) != tt.ok {
+			t.Errorf("%s: checkBackupFiles = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
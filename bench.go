@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchOCROnlyProfile skips the Gemini stage entirely
+const benchOCROnlyProfile = "ocr-only"
+
+// benchStageStats collects timings and token usage for one pipeline stage
+type benchStageStats struct {
+	durations []time.Duration
+	tokens    int
+	errors    int
+}
+
+func (s *benchStageStats) record(d time.Duration, tokens int, err error) {
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.durations = append(s.durations, d)
+	s.tokens += tokens
+}
+
+// percentile returns the nearest-rank percentile of the recorded durations
+func (s *benchStageStats) percentile(p float64) time.Duration {
+	if len(s.durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), s.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// runBench runs the extraction and parsing pipeline over a folder of sample
+// receipts and prints latency percentiles and token usage per stage.
+//
+// Usage: bench -dir ./samples [-n 3] [-profiles ocr-only,gemini-1.5-flash]
+//
+// A profile is either "ocr-only" or a Gemini model name to parse with.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	dir := fs.String("dir", "", "folder containing sample receipts (images and PDFs)")
+	iterations := fs.Int("n", 3, "number of runs per file and profile")
+	profilesFlag := fs.String("profiles", benchOCROnlyProfile+","+geminiModelName(), "comma-separated profiles: ocr-only or Gemini model names")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if *iterations < 1 {
+		return fmt.Errorf("-n must be at least 1")
+	}
+
+	files, err := benchSampleFiles(*dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no sample receipts found in %s", *dir)
+	}
+
+	var profiles []string
+	for _, p := range strings.Split(*profilesFlag, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			profiles = append(profiles, p)
+		}
+	}
+
+	fmt.Printf("Benchmarking %d file(s) x %d run(s) across %d profile(s)\n\n", len(files), *iterations, len(profiles))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tSTAGE\tRUNS\tERRORS\tP50\tP90\tP99\tMAX\tTOKENS\tTOKENS/RUN")
+
+	for _, profile := range profiles {
+		stages, err := benchProfile(profile, files, *iterations)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", profile, err)
+		}
+
+		for _, name := range []string{"extract", "parse", "total"} {
+			s, ok := stages[name]
+			if !ok {
+				continue
+			}
+			tokensPerRun := 0.0
+			if len(s.durations) > 0 {
+				tokensPerRun = float64(s.tokens) / float64(len(s.durations))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\t%v\t%v\t%v\t%d\t%.1f\n",
+				profile, name, len(s.durations), s.errors,
+				s.percentile(50).Round(time.Millisecond),
+				s.percentile(90).Round(time.Millisecond),
+				s.percentile(99).Round(time.Millisecond),
+				s.percentile(100).Round(time.Millisecond),
+				s.tokens, tokensPerRun)
+		}
+	}
+
+	return w.Flush()
+}
+
+// benchProfile runs every sample file through the pipeline for one profile
+func benchProfile(profile string, files []string, iterations int) (map[string]*benchStageStats, error) {
+	stages := map[string]*benchStageStats{
+		"extract": {},
+		"total":   {},
+	}
+
+	var geminiClient *GeminiClient
+	if profile != benchOCROnlyProfile {
+		client, err := NewGeminiClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		client.model = profile
+		geminiClient = client
+		stages["parse"] = &benchStageStats{}
+	}
+
+	for i := 0; i < iterations; i++ {
+		for _, file := range files {
+			start := time.Now()
+			isPDF := strings.ToLower(filepath.Ext(file)) == ".pdf"
+			text, _, err := extractReceiptText(file, isPDF, defaultOCROptions(), nil)
+			stages["extract"].record(time.Since(start), 0, err)
+			if err != nil || geminiClient == nil {
+				stages["total"].record(time.Since(start), 0, err)
+				continue
+			}
+
+			parseStart := time.Now()
+			tokens := 0
+			response, err := geminiClient.AnalyzeReceiptTextWithPrompt(text)
+			if err == nil {
+				tokens = response.TokenCount
+				_, err = parseGeminiJSON(response.Text)
+			}
+			stages["parse"].record(time.Since(parseStart), tokens, err)
+			stages["total"].record(time.Since(start), tokens, err)
+		}
+	}
+
+	return stages, nil
+}
+
+// benchSampleFiles lists the receipt images and PDFs in a folder
+func benchSampleFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+
+	supported := map[string]bool{
+		".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".pdf": true,
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !supported[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	return files, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Budget levels. Degraded processing uses the fallback model, skips the
+// vision fallback and holds low priority receipts; exhausted holds every
+// queued receipt until the next month.
+const (
+	budgetNormal    = "normal"
+	budgetDegraded  = "degraded"
+	budgetExhausted = "exhausted"
+)
+
+// budgetRefreshInterval is how long the month's spend is trusted before it
+// is read from the database again; calls made by this process are added
+// as they happen
+const budgetRefreshInterval = time.Minute
+
+// modelPrice is the price of a model in USD per million tokens
+type modelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// defaultModelPrices are the list prices of common models; GEMINI_PRICES
+// adds or overrides them. Models are matched by the longest prefix, so
+// versioned names like gemini-1.5-flash-002 are covered.
+var defaultModelPrices = map[string]modelPrice{
+	"gemini-1.5-flash":      {0.075, 0.30},
+	"gemini-1.5-flash-8b":   {0.0375, 0.15},
+	"gemini-1.5-pro":        {1.25, 5.00},
+	"gemini-2.0-flash":      {0.10, 0.40},
+	"gemini-2.0-flash-lite": {0.075, 0.30},
+	"gemini-2.5-flash":      {0.30, 2.50},
+	"gemini-2.5-pro":        {1.25, 10.00},
+}
+
+// parseModelPrices reads comma-separated model=input/output entries, e.g.
+// gemini-1.5-pro=1.25/5
+func parseModelPrices(s string) (map[string]modelPrice, error) {
+	prices := map[string]modelPrice{}
+	for model, p := range defaultModelPrices {
+		prices[model] = p
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, price, ok := strings.Cut(entry, "=")
+		in, out, ok2 := strings.Cut(price, "/")
+		if !ok || !ok2 || model == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected model=input/output", entry)
+		}
+		input, err := strconv.ParseFloat(strings.TrimSpace(in), 64)
+		if err != nil || input < 0 {
+			return nil, fmt.Errorf("invalid input price in %q", entry)
+		}
+		output, err := strconv.ParseFloat(strings.TrimSpace(out), 64)
+		if err != nil || output < 0 {
+			return nil, fmt.Errorf("invalid output price in %q", entry)
+		}
+		prices[strings.TrimSpace(model)] = modelPrice{input, output}
+	}
+	return prices, nil
+}
+
+// GeminiBudget caps the Gemini spend per calendar month. Its methods do
+// nothing on a nil budget, so call sites need no checks.
+type GeminiBudget struct {
+	// limit is the monthly cap in USD
+	limit float64
+	// degradeAt is the share of the limit from which processing degrades
+	degradeAt     float64
+	fallbackModel string
+	prices        map[string]modelPrice
+
+	mu       sync.Mutex
+	month    string
+	spent    float64
+	loadedAt time.Time
+}
+
+// geminiBudget is set on startup when GEMINI_MONTHLY_BUDGET is configured
+var geminiBudget *GeminiBudget
+
+// newGeminiBudget returns the budget configured by GEMINI_MONTHLY_BUDGET
+// (USD), GEMINI_BUDGET_DEGRADE_AT (percent, default 80),
+// GEMINI_BUDGET_MODEL (default gemini-1.5-flash) and GEMINI_PRICES, or nil
+// when no budget is set
+func newGeminiBudget() (*GeminiBudget, error) {
+	v := os.Getenv("GEMINI_MONTHLY_BUDGET")
+	if v == "" {
+		return nil, nil
+	}
+	limit, err := strconv.ParseFloat(v, 64)
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("GEMINI_MONTHLY_BUDGET must be a positive amount in USD")
+	}
+	b := &GeminiBudget{limit: limit, degradeAt: 0.8, fallbackModel: "gemini-1.5-flash"}
+	if v := os.Getenv("GEMINI_BUDGET_DEGRADE_AT"); v != "" {
+		pct, err := strconv.ParseFloat(v, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("GEMINI_BUDGET_DEGRADE_AT must be a percentage between 0 and 100")
+		}
+		b.degradeAt = pct / 100
+	}
+	if v := os.Getenv("GEMINI_BUDGET_MODEL"); v != "" {
+		b.fallbackModel = v
+	}
+	if b.prices, err = parseModelPrices(os.Getenv("GEMINI_PRICES")); err != nil {
+		return nil, fmt.Errorf("invalid GEMINI_PRICES: %v", err)
+	}
+	for _, model := range []string{geminiModelName(), b.fallbackModel} {
+		if _, ok := b.price(model); !ok {
+			return nil, fmt.Errorf("no price known for model %s; add it to GEMINI_PRICES", model)
+		}
+	}
+	return b, nil
+}
+
+// price returns the price of the model with the longest matching prefix
+func (b *GeminiBudget) price(model string) (modelPrice, bool) {
+	best, found := "", false
+	for name := range b.prices {
+		if strings.HasPrefix(model, name) && len(name) >= len(best) {
+			best, found = name, true
+		}
+	}
+	return b.prices[best], found
+}
+
+// budgetMonth is the month spend is counted in
+func budgetMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// monthSpent returns this month's spend, reloading it from the database
+// when it is stale or the month changed
+func (b *GeminiBudget) monthSpent() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	month := budgetMonth(time.Now())
+	if month == b.month && time.Since(b.loadedAt) < budgetRefreshInterval {
+		return b.spent
+	}
+	var spent float64
+	if err := db.QueryRow(
+		"SELECT COALESCE(SUM(cost), 0) FROM gemini_usage WHERE month = ?", month,
+	).Scan(&spent); err != nil {
+		log.Printf("Budget: failed to load Gemini spend: %v", err)
+		if month == b.month {
+			return b.spent
+		}
+	}
+	b.month, b.spent, b.loadedAt = month, spent, time.Now()
+	return spent
+}
+
+// level returns the budget level for this month's spend
+func (b *GeminiBudget) level() string {
+	if b == nil {
+		return budgetNormal
+	}
+	spent := b.monthSpent()
+	switch {
+	case spent >= b.limit:
+		return budgetExhausted
+	case spent >= b.limit*b.degradeAt:
+		return budgetDegraded
+	}
+	return budgetNormal
+}
+
+// model returns the model to call instead of the configured one
+func (b *GeminiBudget) model(configured string) string {
+	if b.level() == budgetNormal {
+		return configured
+	}
+	return b.fallbackModel
+}
+
+// visionAllowed reports whether images may be sent to Gemini when OCR
+// fails
+func (b *GeminiBudget) visionAllowed() bool {
+	return b.level() == budgetNormal
+}
+
+// heldPriorities are the priorities whose queued receipts wait for the
+// next month
+func (b *GeminiBudget) heldPriorities() []string {
+	switch b.level() {
+	case budgetExhausted:
+		return priorityOrder
+	case budgetDegraded:
+		return []string{priorityLow}
+	}
+	return nil
+}
+
+// record adds the cost of a Gemini call to this month's usage
+func (b *GeminiBudget) record(model string, usage *genai.UsageMetadata) {
+	if b == nil || usage == nil {
+		return
+	}
+	p, _ := b.price(model)
+	cost := (float64(usage.PromptTokenCount)*p.Input + float64(usage.CandidatesTokenCount)*p.Output) / 1e6
+	month := budgetMonth(time.Now())
+	if _, err := execWithRetry(
+		`INSERT INTO gemini_usage (month, model, requests, prompt_tokens, output_tokens, cost)
+		VALUES (?, ?, 1, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE requests = requests + 1, prompt_tokens = prompt_tokens + VALUES(prompt_tokens),
+			output_tokens = output_tokens + VALUES(output_tokens), cost = cost + VALUES(cost)`,
+		month, model, usage.PromptTokenCount, usage.CandidatesTokenCount, cost,
+	); err != nil {
+		log.Printf("Budget: failed to record Gemini usage: %v", err)
+	}
+
+	b.mu.Lock()
+	before := b.spent
+	if b.month == month {
+		b.spent += cost
+	}
+	after := b.spent
+	b.mu.Unlock()
+	if before < b.limit*b.degradeAt && after >= b.limit*b.degradeAt {
+		log.Printf("Budget: Gemini spend reached %.0f%% of the monthly budget, degrading processing", b.degradeAt*100)
+	}
+	if before < b.limit && after >= b.limit {
+		log.Printf("Budget: monthly Gemini budget of $%.2f used up, holding queued receipts until next month", b.limit)
+	}
+}
+
+// ModelUsage is one model's Gemini usage in a month
+type ModelUsage struct {
+	Model        string  `json:"model"`
+	Requests     int64   `json:"requests"`
+	PromptTokens int64   `json:"prompt_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+}
+
+// BudgetStatus is the state of the monthly Gemini budget
+type BudgetStatus struct {
+	Month       string  `json:"month"`
+	Limit       float64 `json:"limit"`
+	Spent       float64 `json:"spent"`
+	UsedPercent float64 `json:"used_percent"`
+	// DegradeAtPercent is the share of the limit from which processing
+	// degrades
+	DegradeAtPercent float64 `json:"degrade_at_percent"`
+	Level            string  `json:"level"`
+	// Model is the model extraction currently uses
+	Model          string   `json:"model"`
+	VisionFallback bool     `json:"vision_fallback_allowed"`
+	HeldPriorities []string `json:"held_priorities"`
+	// ResumesAt is when held receipts are processed again
+	ResumesAt *string      `json:"resumes_at"`
+	Usage     []ModelUsage `json:"usage"`
+}
+
+// status returns the budget state with this month's usage per model
+func (b *GeminiBudget) status() (*BudgetStatus, error) {
+	if b == nil {
+		return nil, nil
+	}
+	now := time.Now()
+	s := &BudgetStatus{
+		Month:            budgetMonth(now),
+		Limit:            b.limit,
+		Spent:            b.monthSpent(),
+		DegradeAtPercent: b.degradeAt * 100,
+		Level:            b.level(),
+		Model:            b.model(geminiModelName()),
+		VisionFallback:   b.visionAllowed(),
+		HeldPriorities:   b.heldPriorities(),
+		Usage:            []ModelUsage{},
+	}
+	if s.HeldPriorities == nil {
+		s.HeldPriorities = []string{}
+	}
+	s.UsedPercent = s.Spent / s.Limit * 100
+	if s.Level != budgetNormal {
+		next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location()).Format(time.RFC3339)
+		s.ResumesAt = &next
+	}
+
+	rows, err := db.Query(
+		"SELECT model, requests, prompt_tokens, output_tokens, cost FROM gemini_usage WHERE month = ?", s.Month,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Gemini usage: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u ModelUsage
+		if err := rows.Scan(&u.Model, &u.Requests, &u.PromptTokens, &u.OutputTokens, &u.Cost); err != nil {
+			return nil, fmt.Errorf("failed to scan Gemini usage: %v", err)
+		}
+		s.Usage = append(s.Usage, u)
+	}
+	sort.Slice(s.Usage, func(i, j int) bool { return s.Usage[i].Cost > s.Usage[j].Cost })
+	return s, rows.Err()
+}
+
+// registerBudgetRoutes adds the Gemini budget status
+func registerBudgetRoutes(app *fiber.App) {
+	app.Get("/admin/budget", func(c *fiber.Ctx) error {
+		if geminiBudget == nil {
+			return c.JSON(fiber.Map{
+				"success": true,
+				"enabled": false,
+			})
+		}
+		status, err := geminiBudget.status()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"enabled": true,
+			"budget":  status,
+		})
+	})
+}
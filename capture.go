@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxCaptureSize limits decoded screenshot uploads sent as base64 JSON
+const maxCaptureSize = 20 << 20
+
+// webOrderPrompt extracts an online order confirmation page captured by the
+// browser extension. It returns the same fields as the receipt prompt.
+const webOrderPrompt = `The following text comes from a screenshot of an online order confirmation page.
+Extract the order as a receipt in JSON format.
+
+Extract the following information:
+- date: order date (YYYY-MM-DD format), not the delivery date
+- date_raw: the order date exactly as shown on the page
+- merchant_raw: the shop name as shown on the page
+- merchant_clean: cleaned/normalized shop name (use the site's brand, e.g. "Amazon" for amazon.co.uk)
+- category: spending category of the items ordered (e.g., shopping, electronics, groceries, books)
+- amount: order total charged, including shipping and tax
+- subtotal: item subtotal before shipping and tax (if shown)
+- tip: tip amount for delivery orders (if shown)
+- currency: currency code (e.g., USD, EUR, IDR)
+- confidence: your confidence level (0.0 to 1.0)
+- reference_number: the order number or order ID
+- merchant_country: ISO 3166-1 alpha-2 country of the shop, judged from the site domain, address or currency
+
+Ignore navigation menus, recommendations, ads and cookie banners.
+Return ONLY a valid JSON object with these fields. If you cannot extract a field, use null.
+Example: {"date":"2024-01-15","merchant_raw":"Amazon.com","merchant_clean":"Amazon","category":"shopping","amount":45.67,"subtotal":39.99,"currency":"USD","confidence":0.9,"reference_number":"112-4567890-1234567","date_raw":"January 15, 2024","merchant_country":"US"}`
+
+// webOrderPromptFor adds the captured page's URL and title to the prompt
+func webOrderPromptFor(pageURL, title string) string {
+	return fmt.Sprintf("%s\n\nPage URL: %s\nPage title: %s", webOrderPrompt, pageURL, title)
+}
+
+// decodeScreenshotDataURL decodes a "data:image/png;base64,..." URL as
+// returned by chrome.tabs.captureVisibleTab, or plain base64
+func decodeScreenshotDataURL(data string) ([]byte, error) {
+	if strings.HasPrefix(data, "data:") {
+		header, payload, ok := strings.Cut(data, ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return nil, fmt.Errorf("screenshot must be a base64 data URL")
+		}
+		if !strings.HasPrefix(header, "data:image/png") {
+			return nil, fmt.Errorf("screenshot must be a PNG image")
+		}
+		data = payload
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > maxCaptureSize {
+		return nil, fmt.Errorf("screenshot is larger than %d MB", maxCaptureSize>>20)
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// registerCaptureRoutes adds the browser extension capture endpoint
+func registerCaptureRoutes(app *fiber.App) {
+	// Ingest a screenshot of an online order confirmation page. Accepts either
+	// multipart (screenshot file, url, title) or JSON with the screenshot as a
+	// base64 PNG data URL.
+	app.Post("/receipts/capture", requireDiskSpace, func(c *fiber.Ctx) error {
+		var req struct {
+			Screenshot string `json:"screenshot" form:"-"`
+			URL        string `json:"url" form:"url"`
+			Title      string `json:"title" form:"title"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		parsedURL, err := url.Parse(req.URL)
+		if req.URL == "" || err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "A valid http(s) page URL is required",
+			})
+		}
+		if len(req.URL) > 2048 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Page URL is longer than 2048 characters",
+			})
+		}
+		title := strings.TrimSpace(req.Title)
+		if len(title) > 512 {
+			title = title[:512]
+		}
+
+		captureID := uuid.New().String()
+		storedName := fmt.Sprintf("%s_%s.png", captureID, time.Now().Format("20060102_150405"))
+		savePath := filepath.Join(uploadsDir, storedName)
+
+		if file, err := c.FormFile("screenshot"); err == nil {
+			if ct := file.Header.Get("Content-Type"); ct != "" && ct != "image/png" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Screenshot must be a PNG image",
+				})
+			}
+			if err := c.SaveFile(file, savePath); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to save file",
+				})
+			}
+		} else if req.Screenshot != "" {
+			data, err := decodeScreenshotDataURL(req.Screenshot)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			if err := os.WriteFile(savePath, data, 0644); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to save file",
+				})
+			}
+		} else {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "No screenshot provided",
+			})
+		}
+
+		// Screened like /receipts/ingest before anything is recorded
+		tenant := tenantKey(c)
+		quarantineID, reason, err := quarantineUpload(storedName, storedName, channelCapture, PipelineInput{
+			Priority: priorityHigh,
+			Tenant:   tenant,
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to screen file",
+			})
+		}
+		if reason != "" {
+			return quarantineResponse(c, quarantineID, reason)
+		}
+
+		checksum, err := fileChecksum(savePath)
+		if err != nil {
+			log.Printf("Failed to checksum %s: %v", savePath, err)
+		}
+
+		result, err := db.Exec(
+			`INSERT INTO receipts (file_name, status, storage_backend, checksum, source_url, source_title, priority, channel, uploaded_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			storedName,
+			"needs_review",
+			"local",
+			sql.NullString{String: checksum, Valid: checksum != ""},
+			req.URL,
+			sql.NullString{String: title, Valid: title != ""},
+			priorityHigh,
+			channelCapture,
+			time.Now(),
+		)
+		if err != nil {
+			log.Printf("Failed to insert receipt into database: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save receipt to database",
+			})
+		}
+		receiptDBID, err := result.LastInsertId()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get receipt ID",
+			})
+		}
+
+		pipelineResult := processReceipt(c.Context(), PipelineInput{
+			ReceiptID: receiptDBID,
+			Path:      savePath,
+			Config:    loadPipelineConfig(tenant),
+			Prompt:    webOrderPromptFor(req.URL, title),
+			Profile:   "ecommerce",
+			Tenant:    tenant,
+			Settings:  loadUserSettings(tenant),
+			// The user is waiting on the extension popup
+			Priority: priorityHigh,
+		})
+		offloadReceiptFile(receiptDBID, storedName)
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success":     true,
+			"receipt_id":  receiptDBID,
+			"uuid":        captureID,
+			"stored_name": storedName,
+			"source_url":  req.URL,
+			"title":       title,
+			"status":      "needs_review",
+			"ocr":         pipelineResult.ocrResponse(),
+			"gemini":      pipelineResult.geminiResponse(),
+			"pipeline": fiber.Map{
+				"tenant": tenant,
+				"stages": pipelineResult.Stages,
+			},
+		})
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CaptureGoal is a monthly target such as "capture every receipt within 24
+// hours". A goal applies to its month and every later month until a newer
+// goal is set. Each tenant sets its own goals; the receipts they are
+// measured against are those of the whole installation, as in every other
+// report, since receipts are not kept per tenant.
+type CaptureGoal struct {
+	Month           string  `json:"month"`
+	MaxLatencyHours int     `json:"max_latency_hours"`
+	TargetPercent   float64 `json:"target_percent"`
+}
+
+// CaptureMonth summarizes capture latency for receipts uploaded in a month:
+// the time from the purchase to the first upload of the receipt. The
+// purchase is timed by the time printed on the receipt; receipts with only a
+// date count from the end of that day, so latency is never overstated.
+type CaptureMonth struct {
+	Month         string       `json:"month"`
+	Receipts      int          `json:"receipts"`
+	AverageHours  float64      `json:"average_hours"`
+	MedianHours   float64      `json:"median_hours"`
+	P90Hours      float64      `json:"p90_hours"`
+	Goal          *CaptureGoal `json:"goal"`
+	WithinGoalPct *float64     `json:"within_goal_percent"`
+	GoalMet       *bool        `json:"goal_met"`
+}
+
+// loadCaptureGoals returns all goals of a tenant, oldest month first
+func loadCaptureGoals(tenant string) ([]CaptureGoal, error) {
+	rows, err := db.Query(
+		"SELECT month, max_latency_hours, target_percent FROM capture_goals WHERE tenant_key = ? ORDER BY month", tenant,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load capture goals: %v", err)
+	}
+	defer rows.Close()
+
+	goals := []CaptureGoal{}
+	for rows.Next() {
+		var g CaptureGoal
+		var month time.Time
+		if err := rows.Scan(&month, &g.MaxLatencyHours, &g.TargetPercent); err != nil {
+			return nil, fmt.Errorf("failed to scan capture goal: %v", err)
+		}
+		g.Month = month.Format("2006-01")
+		goals = append(goals, g)
+	}
+	return goals, rows.Err()
+}
+
+// goalForMonth returns the most recent goal set for or before the month
+func goalForMonth(goals []CaptureGoal, month string) *CaptureGoal {
+	var found *CaptureGoal
+	for i := range goals {
+		if goals[i].Month <= month {
+			found = &goals[i]
+		}
+	}
+	return found
+}
+
+// percentile returns the p-th percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// latencyTrend fits a line through the monthly average latencies and
+// returns its slope in hours per month; negative means captures are getting
+// faster
+func latencyTrend(months []CaptureMonth) float64 {
+	n := float64(len(months))
+	if n < 2 {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, m := range months {
+		x := float64(i)
+		sumX += x
+		sumY += m.AverageHours
+		sumXY += x * m.AverageHours
+		sumXX += x * x
+	}
+	return (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+}
+
+// roundTenth rounds to one decimal place
+func roundTenth(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// registerCaptureGoalRoutes adds the capture goal and latency report endpoints
+func registerCaptureGoalRoutes(app *fiber.App) {
+	app.Get("/goals/capture", func(c *fiber.Ctx) error {
+		goals, err := loadCaptureGoals(tenantKey(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"current": goalForMonth(goals, time.Now().Format("2006-01")),
+			"goals":   goals,
+		})
+	})
+
+	// Set the goal for a month (YYYY-MM, default this month)
+	app.Put("/goals/capture", func(c *fiber.Ctx) error {
+		var req struct {
+			Month           string   `json:"month"`
+			MaxLatencyHours int      `json:"max_latency_hours"`
+			TargetPercent   *float64 `json:"target_percent"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if req.Month == "" {
+			req.Month = time.Now().Format("2006-01")
+		}
+		month, err := time.Parse("2006-01", req.Month)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "month must be YYYY-MM",
+			})
+		}
+		if req.MaxLatencyHours <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "max_latency_hours must be positive",
+			})
+		}
+		target := 100.0
+		if req.TargetPercent != nil {
+			target = *req.TargetPercent
+		}
+		if target <= 0 || target > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "target_percent must be between 0 and 100",
+			})
+		}
+
+		if _, err := db.Exec(
+			`INSERT INTO capture_goals (tenant_key, month, max_latency_hours, target_percent) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE max_latency_hours = VALUES(max_latency_hours), target_percent = VALUES(target_percent)`,
+			tenantKey(c), month, req.MaxLatencyHours, target,
+		); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save capture goal: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"goal": CaptureGoal{
+				Month:           req.Month,
+				MaxLatencyHours: req.MaxLatencyHours,
+				TargetPercent:   target,
+			},
+		})
+	})
+
+	// Monthly capture latency against the goals, by upload date
+	app.Get("/reports/capture-latency", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "r.uploaded_at")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		goals, err := loadCaptureGoals(tenantKey(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// A receipt uploaded again is flagged as a duplicate of the first
+		// one, whose earliest upload counts. Receipts dated after their
+		// upload (clock or OCR errors) count as captured immediately. The
+		// range is by upload, so old archived transactions are included.
+		// Only the goals are the caller's; the receipts are everyone's.
+		table := transactionsAllView
+		rows, err := db.Query(
+			`SELECT DATE_FORMAT(r.uploaded_at, '%Y-%m'), GREATEST(TIMESTAMPDIFF(MINUTE,
+				IF(t.purchase_time IS NULL, TIMESTAMP(t.date + INTERVAL 1 DAY), TIMESTAMP(t.date, t.purchase_time)),
+				LEAST(r.uploaded_at, COALESCE((SELECT MIN(d.uploaded_at) FROM receipts d WHERE d.duplicate_of = r.id), r.uploaded_at))
+			), 0)
+			FROM receipts r
+			JOIN `+table+` t ON t.id = (SELECT MIN(id) FROM `+table+` WHERE receipt_id = r.id)
+			WHERE t.date IS NOT NULL AND r.deleted_at IS NULL AND `+dateCond+`
+			ORDER BY r.uploaded_at`,
+			args...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build capture latency report: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		var order []string
+		latencies := map[string][]float64{}
+		for rows.Next() {
+			var month string
+			var minutes int64
+			if err := rows.Scan(&month, &minutes); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read capture latency report: %v", err),
+				})
+			}
+			if _, ok := latencies[month]; !ok {
+				order = append(order, month)
+			}
+			latencies[month] = append(latencies[month], float64(minutes)/60)
+		}
+
+		months := []CaptureMonth{}
+		for _, month := range order {
+			values := latencies[month]
+			sort.Float64s(values)
+			total := 0.0
+			for _, v := range values {
+				total += v
+			}
+			m := CaptureMonth{
+				Month:        month,
+				Receipts:     len(values),
+				AverageHours: roundTenth(total / float64(len(values))),
+				MedianHours:  roundTenth(percentile(values, 50)),
+				P90Hours:     roundTenth(percentile(values, 90)),
+				Goal:         goalForMonth(goals, month),
+			}
+			if m.Goal != nil {
+				within := 0
+				for _, v := range values {
+					if v <= float64(m.Goal.MaxLatencyHours) {
+						within++
+					}
+				}
+				pct := roundTenth(float64(within) / float64(len(values)) * 100)
+				met := pct >= m.Goal.TargetPercent
+				m.WithinGoalPct, m.GoalMet = &pct, &met
+			}
+			months = append(months, m)
+		}
+
+		trend := latencyTrend(months)
+		direction := "flat"
+		if trend < -1 {
+			direction = "improving"
+		} else if trend > 1 {
+			direction = "worsening"
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"months":  months,
+			"trend": fiber.Map{
+				// Change in average latency per month, from a linear fit
+				"hours_per_month": roundTenth(trend),
+				"direction":       direction,
+			},
+		})
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Category suggestion states in the approval queue
+const (
+	suggestionPending  = "pending"
+	suggestionApproved = "approved"
+	suggestionRejected = "rejected"
+)
+
+// minSuggestionSamples and minSuggestionShare decide when a merchant's
+// history agrees strongly enough on a category to suggest it as default
+const (
+	minSuggestionSamples = 3
+	minSuggestionShare   = 0.8
+)
+
+// lowConfidenceThreshold is the parse confidence below which a transaction's
+// category is reviewed by the categorization job (CATEGORY_LOW_CONFIDENCE,
+// default 0.7)
+func lowConfidenceThreshold() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("CATEGORY_LOW_CONFIDENCE"), 64); err == nil && v > 0 && v <= 1 {
+		return v
+	}
+	return 0.7
+}
+
+// CategorySuggestion is a proposed merchant default category awaiting approval
+type CategorySuggestion struct {
+	ID              int64   `json:"id"`
+	MerchantID      int64   `json:"merchant_id"`
+	Merchant        string  `json:"merchant"`
+	CurrentCategory string  `json:"current_category"`
+	Category        string  `json:"category"`
+	Reason          string  `json:"reason"`
+	Samples         int     `json:"samples"`
+	Share           float64 `json:"share"`
+	Status          string  `json:"status"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+// reviewCategorizations looks at merchants whose transactions since the
+// given time were corrected by a user or parsed with low confidence, and
+// queues a default-category suggestion when the merchant's corrected and
+// confident history agrees on a category other than its current default.
+// It returns the number of new suggestions.
+func reviewCategorizations(since time.Time) (int, error) {
+	rows, err := db.Query(
+		`SELECT DISTINCT m.id, m.name, COALESCE(m.default_category, '')
+		FROM transactions t JOIN merchants m ON m.id = t.merchant_id
+		WHERE (t.category_corrected = TRUE AND t.category_corrected_at >= ?)
+			OR (t.created_at >= ? AND (t.confidence IS NULL OR t.confidence < ?))`,
+		since, since, lowConfidenceThreshold(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find categorizations to review: %v", err)
+	}
+
+	type candidate struct {
+		id       int64
+		name     string
+		category string
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.name, &c.category); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan merchant: %v", err)
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+
+	created := 0
+	for _, c := range candidates {
+		category, samples, share, err := merchantCategoryConsensus(c.id)
+		if err != nil {
+			return created, err
+		}
+		if samples < minSuggestionSamples || share < minSuggestionShare || strings.EqualFold(category, c.category) {
+			continue
+		}
+
+		// Don't queue the same suggestion twice while it awaits a decision
+		var pending int
+		if err := db.QueryRow(
+			"SELECT COUNT(*) FROM category_suggestions WHERE merchant_id = ? AND category = ? AND status = ?",
+			c.id, category, suggestionPending,
+		).Scan(&pending); err != nil {
+			return created, fmt.Errorf("failed to check pending suggestions: %v", err)
+		}
+		if pending > 0 {
+			continue
+		}
+
+		reason := fmt.Sprintf("%d of %d corrected or confidently parsed receipts are %s", int(share*float64(samples)+0.5), samples, category)
+		if _, err := db.Exec(
+			`INSERT INTO category_suggestions (merchant_id, current_category, category, reason, samples, share, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			c.id, sql.NullString{String: c.category, Valid: c.category != ""}, category, reason, samples, share, suggestionPending,
+		); err != nil {
+			return created, fmt.Errorf("failed to queue category suggestion: %v", err)
+		}
+		created++
+	}
+	return created, nil
+}
+
+// merchantCategoryConsensus returns the most common category across a
+// merchant's user-corrected and high-confidence transactions, with the
+// number of transactions considered and the category's share of them
+func merchantCategoryConsensus(merchantID int64) (string, int, float64, error) {
+	rows, err := db.Query(
+		`SELECT LOWER(category), COUNT(*) FROM transactions
+		WHERE merchant_id = ? AND category IS NOT NULL
+			AND (category_corrected = TRUE OR confidence >= ?)
+		GROUP BY LOWER(category)
+		ORDER BY COUNT(*) DESC`,
+		merchantID, lowConfidenceThreshold(),
+	)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to load merchant categories: %v", err)
+	}
+	defer rows.Close()
+
+	best, bestCount, total := "", 0, 0
+	for rows.Next() {
+		var category string
+		var count int
+		if err := rows.Scan(&category, &count); err != nil {
+			return "", 0, 0, fmt.Errorf("failed to scan merchant category: %v", err)
+		}
+		if best == "" {
+			best, bestCount = category, count
+		}
+		total += count
+	}
+	if total == 0 {
+		return "", 0, 0, rows.Err()
+	}
+	return best, total, float64(bestCount) / float64(total), rows.Err()
+}
+
+// applyMerchantCategory replaces the parsed category with the merchant's
+// approved default category, if it has one
+func applyMerchantCategory(data *GeminiParsedData) (bool, error) {
+	name := data.MerchantClean
+	if name == "" {
+		name = data.MerchantRaw
+	}
+	if name == "" {
+		return false, nil
+	}
+
+	var category sql.NullString
+	err := db.QueryRow("SELECT default_category FROM merchants WHERE name = ?", name).Scan(&category)
+	if err == sql.ErrNoRows || (err == nil && !category.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load merchant default category: %v", err)
+	}
+	if strings.EqualFold(data.Category, category.String) {
+		return false, nil
+	}
+	data.Category = category.String
+	return true, nil
+}
+
+// startCategorizationScheduler runs the categorization review every
+// CATEGORY_REVIEW_INTERVAL (default weekly, "off" disables it)
+func startCategorizationScheduler() {
+	intervalStr := os.Getenv("CATEGORY_REVIEW_INTERVAL")
+	if intervalStr == "off" {
+		return
+	}
+	interval := 7 * 24 * time.Hour
+	if intervalStr != "" {
+		v, err := time.ParseDuration(intervalStr)
+		if err != nil || v <= 0 {
+			log.Printf("Categorization: invalid CATEGORY_REVIEW_INTERVAL %q, scheduled review disabled", intervalStr)
+			return
+		}
+		interval = v
+	}
+
+	log.Printf("Categorization: review scheduled every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			created, err := reviewCategorizations(time.Now().Add(-interval))
+			if err != nil {
+				log.Printf("Categorization: scheduled review failed: %v", err)
+				continue
+			}
+			log.Printf("Categorization: queued %d suggestion(s) for approval", created)
+		}
+	}()
+}
+
+// decideSuggestion approves or rejects a pending suggestion. Approving sets
+// the merchant's default category.
+func decideSuggestion(id int, approve bool) error {
+	return inTx("decide category suggestion", func(tx *sql.Tx) error {
+		var merchantID int64
+		var category, status string
+		err := tx.QueryRow(
+			"SELECT merchant_id, category, status FROM category_suggestions WHERE id = ? FOR UPDATE", id,
+		).Scan(&merchantID, &category, &status)
+		if err != nil {
+			return err
+		}
+		if status != suggestionPending {
+			return fmt.Errorf("suggestion is already %s", status)
+		}
+
+		newStatus := suggestionRejected
+		if approve {
+			newStatus = suggestionApproved
+			if _, err := tx.Exec("UPDATE merchants SET default_category = ? WHERE id = ?", category, merchantID); err != nil {
+				return fmt.Errorf("failed to update merchant default category: %v", err)
+			}
+			// Older suggestions for the merchant are superseded
+			if _, err := tx.Exec(
+				"UPDATE category_suggestions SET status = ?, decided_at = NOW() WHERE merchant_id = ? AND status = ? AND id <> ?",
+				suggestionRejected, merchantID, suggestionPending, id,
+			); err != nil {
+				return fmt.Errorf("failed to close superseded suggestions: %v", err)
+			}
+		}
+		if _, err := tx.Exec(
+			"UPDATE category_suggestions SET status = ?, decided_at = NOW() WHERE id = ?", newStatus, id,
+		); err != nil {
+			return fmt.Errorf("failed to update suggestion: %v", err)
+		}
+		return nil
+	})
+}
+
+// registerCategorizationRoutes adds category correction and the approval
+// queue endpoints
+func registerCategorizationRoutes(app *fiber.App) {
+	// Correct a transaction's category; corrections feed the weekly review
+	app.Patch("/transactions/:id/category", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+
+		var req struct {
+			Category string `json:"category"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		req.Category = strings.TrimSpace(req.Category)
+		if req.Category == "" || len(req.Category) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Category must be 1-100 characters",
+			})
+		}
+
+		result, err := db.Exec(
+			"UPDATE transactions SET category = ?, category_corrected = TRUE, category_corrected_at = NOW() WHERE id = ?",
+			req.Category, id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update category: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists int
+			if err := db.QueryRow("SELECT COUNT(*) FROM transactions WHERE id = ?", id).Scan(&exists); err == nil && exists == 0 {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Transaction not found",
+				})
+			}
+		}
+
+		liveQueries.Invalidate()
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"id":       id,
+			"category": req.Category,
+		})
+	})
+
+	// Run the categorization review now over the last `days` days (default 7)
+	app.Post("/categorization/review", func(c *fiber.Ctx) error {
+		days := c.QueryInt("days", 7)
+		if days < 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "days must be at least 1",
+			})
+		}
+
+		created, err := reviewCategorizations(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"suggestions": created,
+		})
+	})
+
+	// List suggestions, pending ones by default
+	app.Get("/categorization/suggestions", func(c *fiber.Ctx) error {
+		status := c.Query("status", suggestionPending)
+
+		rows, err := db.Query(
+			`SELECT s.id, s.merchant_id, m.name, COALESCE(s.current_category, ''), s.category, s.reason,
+				s.samples, s.share, s.status, s.created_at
+			FROM category_suggestions s JOIN merchants m ON m.id = s.merchant_id
+			WHERE s.status = ?
+			ORDER BY s.created_at DESC`,
+			status,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list suggestions: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		suggestions := []CategorySuggestion{}
+		for rows.Next() {
+			var s CategorySuggestion
+			var createdAt time.Time
+			if err := rows.Scan(&s.ID, &s.MerchantID, &s.Merchant, &s.CurrentCategory, &s.Category, &s.Reason,
+				&s.Samples, &s.Share, &s.Status, &createdAt); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read suggestions: %v", err),
+				})
+			}
+			s.CreatedAt = createdAt.Format(time.RFC3339)
+			suggestions = append(suggestions, s)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"suggestions": suggestions,
+		})
+	})
+
+	decide := func(approve bool) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			id, err := c.ParamsInt("id")
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid suggestion ID",
+				})
+			}
+
+			err = decideSuggestion(id, approve)
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Suggestion not found",
+				})
+			}
+			if err != nil {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+
+			return c.JSON(fiber.Map{
+				"success": true,
+				"id":      id,
+			})
+		}
+	}
+	app.Post("/categorization/suggestions/:id/approve", decide(true))
+	app.Post("/categorization/suggestions/:id/reject", decide(false))
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// minTrendHistory is how many of the trailing months need spend in a
+// category before its month is compared with them
+const minTrendHistory = 3
+
+// minTrendSpread is the smallest standard deviation assumed, as a share of
+// the average, so a category with very steady spend isn't flagged for a few
+// cents
+const minTrendSpread = 0.1
+
+// CategoryTrendConfig controls the monthly comparison of category spend
+// with its trailing months
+type CategoryTrendConfig struct {
+	// Months is the length of the trailing window (CATEGORY_TREND_MONTHS,
+	// default 6)
+	Months int
+	// Threshold is how many standard deviations from the trailing average
+	// a month's spend must be to be reported (CATEGORY_TREND_THRESHOLD,
+	// default 2)
+	Threshold float64
+	// Notify sends a webhook and email for new insights
+	// (CATEGORY_TREND_NOTIFY, default true)
+	Notify bool
+}
+
+// loadCategoryTrendConfig reads the trend settings. It returns nil when
+// CATEGORY_TREND_MONTHS is "off".
+func loadCategoryTrendConfig() (*CategoryTrendConfig, error) {
+	cfg := &CategoryTrendConfig{Months: 6, Threshold: 2, Notify: true}
+	if v := os.Getenv("CATEGORY_TREND_MONTHS"); v == "off" {
+		return nil, nil
+	} else if v != "" {
+		months, err := strconv.Atoi(v)
+		if err != nil || months < minTrendHistory || months > 36 {
+			return nil, fmt.Errorf("CATEGORY_TREND_MONTHS must be between %d and 36", minTrendHistory)
+		}
+		cfg.Months = months
+	}
+	if v := os.Getenv("CATEGORY_TREND_THRESHOLD"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("CATEGORY_TREND_THRESHOLD must be a positive number of standard deviations")
+		}
+		cfg.Threshold = threshold
+	}
+	if v := os.Getenv("CATEGORY_TREND_NOTIFY"); v != "" {
+		notify, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("CATEGORY_TREND_NOTIFY must be true or false")
+		}
+		cfg.Notify = notify
+	}
+	return cfg, nil
+}
+
+// CategoryInsight is a month whose spend in a category deviates from the
+// trailing months. Amounts are in the home currency.
+type CategoryInsight struct {
+	ID       int64   `json:"id"`
+	Month    string  `json:"month"`
+	Category string  `json:"category"`
+	Spend    float64 `json:"spend"`
+	// Average and StdDev are over the trailing months, counting months
+	// without spend as zero
+	Average   float64 `json:"average"`
+	StdDev    float64 `json:"std_dev"`
+	ZScore    float64 `json:"z_score"`
+	ChangePct float64 `json:"change_pct"`
+	// Direction is above or below
+	Direction  string  `json:"direction"`
+	Currency   string  `json:"currency"`
+	Message    string  `json:"message"`
+	NotifiedAt *string `json:"notified_at"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// monthStart returns the first day of the month of t
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// monthIndex numbers months consecutively
+func monthIndex(t time.Time) int {
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+// findCategoryTrends compares each category's spend in the month of month
+// with the cfg.Months before it and returns the categories that deviate
+// by at least cfg.Threshold standard deviations, largest deviation first
+func findCategoryTrends(cfg *CategoryTrendConfig, month time.Time) ([]CategoryInsight, error) {
+	start := monthStart(month)
+	from := start.AddDate(0, -cfg.Months, 0)
+	rows, err := db.Query(
+		`SELECT LOWER(category), YEAR(date) * 12 + MONTH(date) - 1, SUM(home_amount)
+		FROM `+transactionsTableSince(from)+`
+		WHERE category IS NOT NULL AND category <> '' AND home_amount IS NOT NULL AND date >= ? AND date < ?
+		GROUP BY 1, 2`,
+		from, start.AddDate(0, 1, 0),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum category spend: %v", err)
+	}
+	defer rows.Close()
+
+	// spend[category][i] is the spend i months before month
+	current := monthIndex(start)
+	spend := map[string][]float64{}
+	for rows.Next() {
+		var category string
+		var index int
+		var amount float64
+		if err := rows.Scan(&category, &index, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan category spend: %v", err)
+		}
+		if spend[category] == nil {
+			spend[category] = make([]float64, cfg.Months+1)
+		}
+		if ago := current - index; ago >= 0 && ago <= cfg.Months {
+			spend[category][ago] += amount
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	home := homeCurrency()
+	label := start.Format("2006-01")
+	var insights []CategoryInsight
+	for category, months := range spend {
+		history := months[1:]
+		active := 0
+		var mean float64
+		for _, v := range history {
+			if v > 0 {
+				active++
+			}
+			mean += v
+		}
+		if active < minTrendHistory {
+			continue
+		}
+		mean /= float64(len(history))
+		var variance float64
+		for _, v := range history {
+			variance += (v - mean) * (v - mean)
+		}
+		stdDev := math.Max(math.Sqrt(variance/float64(len(history)-1)), mean*minTrendSpread)
+		z := (months[0] - mean) / stdDev
+		if math.Abs(z) < cfg.Threshold {
+			continue
+		}
+
+		insight := CategoryInsight{
+			Month:     label,
+			Category:  category,
+			Spend:     roundCents(months[0]),
+			Average:   roundCents(mean),
+			StdDev:    roundCents(stdDev),
+			ZScore:    math.Round(z*100) / 100,
+			ChangePct: math.Round((months[0]-mean)/mean*1000) / 10,
+			Direction: "above",
+			Currency:  home,
+		}
+		if z < 0 {
+			insight.Direction = "below"
+		}
+		insight.Message = fmt.Sprintf("%s spend in %s was %s, %.0f%% %s the %d-month average of %s",
+			category, label, formatAmount(insight.Spend, home), math.Abs(insight.ChangePct), insight.Direction,
+			cfg.Months, formatAmount(insight.Average, home))
+		insights = append(insights, insight)
+	}
+	sort.Slice(insights, func(i, j int) bool { return math.Abs(insights[i].ZScore) > math.Abs(insights[j].ZScore) })
+	return insights, nil
+}
+
+// analyzeCategoryTrends stores the insights of a month, replacing those of
+// an earlier run, and notifies about insights not reported before. Running
+// it again for the same month picks up receipts that arrived late.
+func analyzeCategoryTrends(cfg *CategoryTrendConfig, month time.Time) ([]CategoryInsight, error) {
+	insights, err := findCategoryTrends(cfg, month)
+	if err != nil {
+		return nil, err
+	}
+	label := monthStart(month).Format("2006-01")
+
+	// Categories that no longer stand out are dropped
+	conds, args := "month = ?", []any{label}
+	if len(insights) > 0 {
+		conds += " AND category NOT IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(insights)), ", ") + ")"
+		for _, in := range insights {
+			args = append(args, in.Category)
+		}
+	}
+	if _, err := execWithRetry("DELETE FROM category_insights WHERE "+conds, args...); err != nil {
+		return nil, fmt.Errorf("failed to clear category insights: %v", err)
+	}
+	for _, in := range insights {
+		if _, err := execWithRetry(
+			`INSERT INTO category_insights (month, category, spend, average, std_dev, z_score, change_pct, direction, currency, message)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE spend = VALUES(spend), average = VALUES(average), std_dev = VALUES(std_dev),
+				z_score = VALUES(z_score), change_pct = VALUES(change_pct), direction = VALUES(direction),
+				currency = VALUES(currency), message = VALUES(message)`,
+			in.Month, in.Category, in.Spend, in.Average, in.StdDev, in.ZScore, in.ChangePct, in.Direction, in.Currency, in.Message,
+		); err != nil {
+			return nil, fmt.Errorf("failed to store category insight: %v", err)
+		}
+	}
+
+	if cfg.Notify {
+		if err := notifyCategoryInsights(label); err != nil {
+			log.Printf("Insights: %v", err)
+		}
+	}
+	return loadCategoryInsights("month = ?", []any{label}, maxReceiptPageSize)
+}
+
+// notifyCategoryInsights sends an insight.category_trend webhook for each
+// insight of a month not reported yet, and one email listing them
+func notifyCategoryInsights(month string) error {
+	pending, err := loadCategoryInsights("month = ? AND notified_at IS NULL", []any{month}, maxReceiptPageSize)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Category spending in %s that stands out from the previous months:\n\n", month)
+	for _, in := range pending {
+		if err := sendWebhook(eventCategoryTrend, in); err != nil {
+			log.Printf("Insights: %v", err)
+		}
+		fmt.Fprintf(&b, "  %s\n", in.Message)
+	}
+	if err := sendEmail(fmt.Sprintf("%d spending insight(s) for %s", len(pending), month), b.String()); err != nil {
+		log.Printf("Insights: %v", err)
+	}
+
+	if _, err := execWithRetry(
+		"UPDATE category_insights SET notified_at = NOW() WHERE month = ? AND notified_at IS NULL", month,
+	); err != nil {
+		return fmt.Errorf("failed to mark insights notified: %v", err)
+	}
+	return nil
+}
+
+// loadCategoryInsights returns stored insights matching where, newest month
+// and largest deviation first
+func loadCategoryInsights(where string, args []any, limit int) ([]CategoryInsight, error) {
+	rows, err := db.Query(
+		`SELECT id, month, category, spend, average, std_dev, z_score, change_pct, direction, currency, message,
+			notified_at, created_at
+		FROM category_insights
+		WHERE `+where+`
+		ORDER BY month DESC, ABS(z_score) DESC, id
+		LIMIT ?`,
+		append(args, limit)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load category insights: %v", err)
+	}
+	defer rows.Close()
+
+	insights := []CategoryInsight{}
+	for rows.Next() {
+		var in CategoryInsight
+		var notifiedAt sql.NullTime
+		var createdAt time.Time
+		if err := rows.Scan(&in.ID, &in.Month, &in.Category, &in.Spend, &in.Average, &in.StdDev, &in.ZScore,
+			&in.ChangePct, &in.Direction, &in.Currency, &in.Message, &notifiedAt, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan category insight: %v", err)
+		}
+		if notifiedAt.Valid {
+			s := notifiedAt.Time.Format(time.RFC3339)
+			in.NotifiedAt = &s
+		}
+		in.CreatedAt = createdAt.Format(time.RFC3339)
+		insights = append(insights, in)
+	}
+	return insights, rows.Err()
+}
+
+// startCategoryTrendScheduler analyzes the previous month once a day
+func startCategoryTrendScheduler() {
+	cfg, err := loadCategoryTrendConfig()
+	if err != nil {
+		log.Printf("Insights: %v, category trend analysis disabled", err)
+		return
+	}
+	if cfg == nil {
+		return
+	}
+
+	log.Printf("Insights: category spend is compared with the previous %d months", cfg.Months)
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			insights, err := analyzeCategoryTrends(cfg, monthStart(time.Now()).AddDate(0, -1, 0))
+			if err != nil {
+				log.Printf("Insights: scheduled analysis failed: %v", err)
+				continue
+			}
+			if len(insights) > 0 {
+				log.Printf("Insights: %d category trend(s) last month", len(insights))
+			}
+		}
+	}()
+}
+
+// parseInsightMonth reads a YYYY-MM month
+func parseInsightMonth(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("month must look like 2024-03")
+	}
+	return t, nil
+}
+
+// registerCategoryTrendRoutes adds the category trend insights
+func registerCategoryTrendRoutes(app *fiber.App) {
+	// Stored insights, optionally for one month (YYYY-MM) or category
+	app.Get("/insights", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", defaultReceiptPageSize)
+		if limit < 1 || limit > maxReceiptPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxReceiptPageSize),
+			})
+		}
+		conds, args := []string{"TRUE"}, []any{}
+		if s := c.Query("month"); s != "" {
+			month, err := parseInsightMonth(s)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			conds = append(conds, "month = ?")
+			args = append(args, month.Format("2006-01"))
+		}
+		if category := c.Query("category"); category != "" {
+			conds = append(conds, "category = ?")
+			args = append(args, strings.ToLower(strings.TrimSpace(category)))
+		}
+
+		insights, err := loadCategoryInsights(strings.Join(conds, " AND "), args, limit)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"insights": insights,
+		})
+	})
+
+	// Analyze a month (default the previous one) right away
+	app.Post("/admin/insights/run", func(c *fiber.Ctx) error {
+		cfg, err := loadCategoryTrendConfig()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if cfg == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Category trend analysis is disabled",
+			})
+		}
+		month := monthStart(time.Now()).AddDate(0, -1, 0)
+		if s := c.Query("month"); s != "" {
+			if month, err = parseInsightMonth(s); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+		}
+
+		insights, err := analyzeCategoryTrends(cfg, month)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"month":    monthStart(month).Format("2006-01"),
+			"insights": insights,
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Ingest channels a receipt can arrive through. n8n workflows that poll a
+// mailbox, a Telegram bot, a Drive folder or a watched directory name their
+// channel on upload; capture and paperless are set by the server.
+const (
+	channelAPI         = "api"
+	channelEmail       = "email"
+	channelTelegram    = "telegram"
+	channelDrivePoll   = "drive-poll"
+	channelFolderWatch = "folder-watch"
+	channelCapture     = "capture"
+	channelPaperless   = "paperless"
+)
+
+// ingestChannels are the channels receipts are tagged with
+var ingestChannels = []string{
+	channelAPI, channelEmail, channelTelegram, channelDrivePoll, channelFolderWatch, channelCapture, channelPaperless,
+}
+
+// uploadChannels are the channels an upload may name
+var uploadChannels = []string{channelAPI, channelEmail, channelTelegram, channelDrivePoll, channelFolderWatch}
+
+// uploadChannel reads the channel form field or X-Ingest-Channel header of
+// an upload, api when neither is set
+func uploadChannel(c *fiber.Ctx) (string, error) {
+	channel := strings.ToLower(strings.TrimSpace(c.FormValue("channel", c.Get("X-Ingest-Channel"))))
+	if channel == "" {
+		return channelAPI, nil
+	}
+	if !containsString(uploadChannels, channel) {
+		return "", fmt.Errorf("invalid channel %q, expected one of %s", channel, strings.Join(uploadChannels, ", "))
+	}
+	return channel, nil
+}
+
+// ChannelMetrics counts the receipts of one ingest channel by outcome
+type ChannelMetrics struct {
+	Channel     string `json:"channel"`
+	Received    int    `json:"received"`
+	Processed   int    `json:"processed"`
+	NeedsReview int    `json:"needs_review"`
+	Errors      int    `json:"errors"`
+	// InProgress are pending or processing and not counted in FailureRate
+	InProgress int `json:"in_progress"`
+	// FailureRate is the share of finished receipts that errored
+	FailureRate    float64 `json:"failure_rate"`
+	LastReceivedAt *string `json:"last_received_at"`
+	LastErrorAt    *string `json:"last_error_at"`
+}
+
+// loadChannelMetrics counts receipts uploaded in [from, to) per channel.
+// Channels without receipts are listed with zero counts.
+func loadChannelMetrics(from, to time.Time) ([]ChannelMetrics, error) {
+	rows, err := db.Query(
+		`SELECT channel, COUNT(*),
+			COALESCE(SUM(status IN ('processed', 'pending_approval', 'rejected')), 0),
+			COALESCE(SUM(status = 'needs_review'), 0),
+			COALESCE(SUM(status = 'error'), 0),
+			COALESCE(SUM(status IN ('pending', 'processing')), 0),
+			MAX(uploaded_at),
+			MAX(CASE WHEN status = 'error' THEN uploaded_at END)
+		FROM receipts
+		WHERE uploaded_at >= ? AND uploaded_at < ?
+		GROUP BY channel`,
+		from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count receipts per channel: %v", err)
+	}
+	defer rows.Close()
+
+	byChannel := map[string]ChannelMetrics{}
+	for rows.Next() {
+		var m ChannelMetrics
+		var lastReceived, lastError sql.NullTime
+		if err := rows.Scan(&m.Channel, &m.Received, &m.Processed, &m.NeedsReview, &m.Errors, &m.InProgress,
+			&lastReceived, &lastError); err != nil {
+			return nil, fmt.Errorf("failed to scan channel metrics: %v", err)
+		}
+		if finished := m.Received - m.InProgress; finished > 0 {
+			m.FailureRate = float64(m.Errors) / float64(finished)
+		}
+		for _, f := range []struct {
+			v   sql.NullTime
+			out **string
+		}{{lastReceived, &m.LastReceivedAt}, {lastError, &m.LastErrorAt}} {
+			if f.v.Valid {
+				s := f.v.Time.Format(time.RFC3339)
+				*f.out = &s
+			}
+		}
+		byChannel[m.Channel] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	metrics := []ChannelMetrics{}
+	for _, channel := range ingestChannels {
+		m, ok := byChannel[channel]
+		if !ok {
+			m.Channel = channel
+		}
+		metrics = append(metrics, m)
+		delete(byChannel, channel)
+	}
+	// Channels no longer known are still reported
+	for _, m := range byChannel {
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// registerChannelRoutes adds the per-channel ingest metrics
+func registerChannelRoutes(app *fiber.App) {
+	// Receipt volume and failures per ingest channel for uploads between
+	// from and to (YYYY-MM-DD, default the last 30 days)
+	app.Get("/admin/ingest/channels", func(c *fiber.Ctx) error {
+		now := time.Now()
+		to := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		from := to.AddDate(0, 0, -30)
+		if s := c.Query("from"); s != "" {
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid from date, expected YYYY-MM-DD",
+				})
+			}
+			from = t
+		}
+		if s := c.Query("to"); s != "" {
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid to date, expected YYYY-MM-DD",
+				})
+			}
+			// Include the whole to day
+			to = t.AddDate(0, 0, 1)
+		}
+
+		metrics, err := loadChannelMetrics(from, to)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"from":     from.Format("2006-01-02"),
+			"to":       to.AddDate(0, 0, -1).Format("2006-01-02"),
+			"channels": metrics,
+		})
+	})
+}
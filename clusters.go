@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Clustering parameters
+const (
+	// clusterSimilarity is the minimum Jaccard similarity between a receipt's
+	// layout features and a cluster's to join it
+	clusterSimilarity = 0.4
+	// clusterHeaderLines are the top lines whose words identify the merchant
+	clusterHeaderLines = 5
+	// clusterSampleSize is how many receipt IDs are kept per cluster
+	clusterSampleSize = 5
+	// clusterReceiptLimit caps how many recent receipts are analysed
+	clusterReceiptLimit = 2000
+)
+
+// LayoutCluster is a group of receipts with similar merchant and layout
+type LayoutCluster struct {
+	ID          int      `json:"id"`
+	Merchant    string   `json:"merchant"`
+	Size        int      `json:"size"`
+	Failures    int      `json:"failures"`
+	FailureRate float64  `json:"failure_rate"`
+	Keywords    []string `json:"keywords"`
+	Samples     []int64  `json:"sample_receipt_ids"`
+	Suggestion  string   `json:"suggestion"`
+
+	features  map[string]bool
+	merchants map[string]int
+}
+
+// layoutFeatures describes a receipt's layout as a set of line shapes
+// (digits as 9, letter runs as a) plus the words of its header lines
+func layoutFeatures(text string) map[string]bool {
+	features := make(map[string]bool)
+	header := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if header < clusterHeaderLines {
+			header++
+			for _, word := range strings.Fields(strings.ToUpper(line)) {
+				word = strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) })
+				if len([]rune(word)) >= 3 {
+					features["w:"+word] = true
+				}
+			}
+		}
+		features["s:"+lineShape(line)] = true
+	}
+	return features
+}
+
+// lineShape reduces a line to its character classes with runs collapsed,
+// so "TOTAL 12.50" and "TOTAL 9.99" share the shape "a 9.9"
+func lineShape(line string) string {
+	var b strings.Builder
+	var last rune
+	for _, r := range line {
+		switch {
+		case unicode.IsDigit(r):
+			r = '9'
+		case unicode.IsLetter(r):
+			r = 'a'
+		case unicode.IsSpace(r):
+			r = ' '
+		}
+		if r != last {
+			b.WriteRune(r)
+			last = r
+		}
+	}
+	return b.String()
+}
+
+// jaccard returns the Jaccard similarity of two feature sets
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	shared := 0
+	for f := range a {
+		if b[f] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// analyzeLayoutClusters groups recent receipts by merchant and layout
+// similarity and stores the clusters with their failure rates. A receipt
+// counts as failed when it was not processed cleanly or needed a repair
+// prompt.
+func analyzeLayoutClusters() ([]*LayoutCluster, error) {
+	rows, err := db.Query(
+		`SELECT r.id, r.status,
+			(SELECT a.content FROM receipt_artifacts a WHERE a.receipt_id = r.id AND a.kind = ? ORDER BY a.id DESC LIMIT 1),
+			(SELECT COALESCE(t.merchant_clean, t.merchant_raw) FROM transactions t WHERE t.receipt_id = r.id ORDER BY t.id LIMIT 1),
+			EXISTS (SELECT 1 FROM parse_repairs p WHERE p.receipt_id = r.id)
+		FROM receipts r
+		WHERE r.deleted_at IS NULL
+		ORDER BY r.id DESC
+		LIMIT ?`,
+		artifactOCRText, clusterReceiptLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipts for clustering: %v", err)
+	}
+	defer rows.Close()
+
+	var clusters []*LayoutCluster
+	for rows.Next() {
+		var id int64
+		var status string
+		var content []byte
+		var merchant sql.NullString
+		var repaired bool
+		if err := rows.Scan(&id, &status, &content, &merchant, &repaired); err != nil {
+			return nil, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		text := decodeArtifact(content)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		features := layoutFeatures(text)
+		var best *LayoutCluster
+		bestScore := clusterSimilarity
+		for _, c := range clusters {
+			if score := jaccard(features, c.features); score >= bestScore {
+				best, bestScore = c, score
+			}
+		}
+		if best == nil {
+			best = &LayoutCluster{features: features, merchants: map[string]int{}}
+			clusters = append(clusters, best)
+		}
+
+		best.Size++
+		if status != "processed" || repaired {
+			best.Failures++
+		}
+		if merchant.Valid {
+			best.merchants[merchant.String]++
+		}
+		if len(best.Samples) < clusterSampleSize {
+			best.Samples = append(best.Samples, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range clusters {
+		c.FailureRate = float64(c.Failures) / float64(c.Size)
+		for name, n := range c.merchants {
+			if n > c.merchants[c.Merchant] || (n == c.merchants[c.Merchant] && name < c.Merchant) {
+				c.Merchant = name
+			}
+		}
+		for f := range c.features {
+			if strings.HasPrefix(f, "w:") {
+				c.Keywords = append(c.Keywords, strings.TrimPrefix(f, "w:"))
+			}
+		}
+		sort.Strings(c.Keywords)
+		c.Suggestion = clusterSuggestion(c)
+	}
+
+	// Most failures first
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Failures != clusters[j].Failures {
+			return clusters[i].Failures > clusters[j].Failures
+		}
+		return clusters[i].Size > clusters[j].Size
+	})
+	for i, c := range clusters {
+		c.ID = i + 1
+	}
+
+	if err := saveLayoutClusters(clusters); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// clusterSuggestion points out what would fix a failing cluster
+func clusterSuggestion(c *LayoutCluster) string {
+	switch {
+	case c.Failures == 0 || c.FailureRate < 0.25:
+		return ""
+	case c.Merchant != "":
+		return fmt.Sprintf("Add prompt hints for %q via PATCH /merchants/{id} with keywords from this layout", c.Merchant)
+	default:
+		return "Inspect the sample receipts; this format may need an extraction profile or merchant record"
+	}
+}
+
+// saveLayoutClusters replaces the stored clusters with a new analysis
+func saveLayoutClusters(clusters []*LayoutCluster) error {
+	return inTx("save layout clusters", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM layout_clusters"); err != nil {
+			return fmt.Errorf("failed to clear layout clusters: %v", err)
+		}
+		for _, c := range clusters {
+			keywords, _ := json.Marshal(c.Keywords)
+			samples, _ := json.Marshal(c.Samples)
+			if _, err := tx.Exec(
+				`INSERT INTO layout_clusters (id, merchant, size, failures, failure_rate, keywords, sample_receipt_ids, suggestion)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				c.ID, sql.NullString{String: c.Merchant, Valid: c.Merchant != ""}, c.Size, c.Failures, c.FailureRate,
+				string(keywords), string(samples), c.Suggestion,
+			); err != nil {
+				return fmt.Errorf("failed to save layout cluster: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// startClusterScheduler re-runs the cluster analysis every CLUSTER_INTERVAL
+// (empty disables it)
+func startClusterScheduler() {
+	intervalStr := os.Getenv("CLUSTER_INTERVAL")
+	if intervalStr == "" {
+		return
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		log.Printf("Clusters: invalid CLUSTER_INTERVAL %q, scheduled analysis disabled", intervalStr)
+		return
+	}
+
+	log.Printf("Clusters: analysis scheduled every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			clusters, err := analyzeLayoutClusters()
+			if err != nil {
+				log.Printf("Clusters: scheduled analysis failed: %v", err)
+				continue
+			}
+			log.Printf("Clusters: found %d layout cluster(s)", len(clusters))
+		}
+	}()
+}
+
+// registerClusterRoutes adds the cluster analysis endpoints
+func registerClusterRoutes(app *fiber.App) {
+	app.Post("/admin/clusters/analyze", func(c *fiber.Ctx) error {
+		clusters, err := analyzeLayoutClusters()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"clusters": len(clusters),
+		})
+	})
+
+	// Clusters from the last analysis with at least min_size receipts
+	// (default 3), highest failure rate first
+	app.Get("/reports/clusters", func(c *fiber.Ctx) error {
+		minSize := c.QueryInt("min_size", 3)
+
+		rows, err := db.Query(
+			`SELECT id, COALESCE(merchant, ''), size, failures, failure_rate, keywords, sample_receipt_ids,
+				COALESCE(suggestion, ''), analyzed_at
+			FROM layout_clusters
+			WHERE size >= ?
+			ORDER BY failure_rate DESC, size DESC`,
+			minSize,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load clusters: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		clusters := []LayoutCluster{}
+		var analyzedAt *string
+		for rows.Next() {
+			var cl LayoutCluster
+			var keywords, samples string
+			var at time.Time
+			if err := rows.Scan(&cl.ID, &cl.Merchant, &cl.Size, &cl.Failures, &cl.FailureRate,
+				&keywords, &samples, &cl.Suggestion, &at); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read clusters: %v", err),
+				})
+			}
+			json.Unmarshal([]byte(keywords), &cl.Keywords)
+			json.Unmarshal([]byte(samples), &cl.Samples)
+			formatted := at.Format(time.RFC3339)
+			analyzedAt = &formatted
+			clusters = append(clusters, cl)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"analyzed_at": analyzedAt,
+			"clusters":    clusters,
+		})
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands maps CLI subcommand names to their implementations.
+// Running the binary without a subcommand starts the HTTP server.
+var commands = map[string]func(args []string) error{
+	"anonymize":       runAnonymize,
+	"archive":         runArchive,
+	"bench":           runBench,
+	"create-token":    runCreateToken,
+	"migrate-storage": runMigrateStorage,
+	"purge-trash":     runPurgeTrash,
+	"requeue":         runRequeue,
+	"tui":             runTUI,
+	"verify-ledger":   runVerifyLedger,
+	"verify-storage":  runVerifyStorage,
+}
+
+// runCommand dispatches a CLI subcommand
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
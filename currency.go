@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Conversion statuses stored in transactions.conversion_status
+const (
+	conversionNotNeeded = "not_needed"
+	conversionConverted = "converted"
+	conversionPending   = "pending"
+)
+
+// homeCurrency is the currency reports are converted into (HOME_CURRENCY, default USD)
+func homeCurrency() string {
+	if v := strings.ToUpper(strings.TrimSpace(os.Getenv("HOME_CURRENCY"))); v != "" {
+		return v
+	}
+	return "USD"
+}
+
+// maxRateAgeDays is how many days back a rate may be used when there is no
+// rate for the exact transaction date (FX_MAX_RATE_AGE_DAYS, default 3)
+func maxRateAgeDays() int {
+	if v, err := strconv.Atoi(os.Getenv("FX_MAX_RATE_AGE_DAYS")); err == nil && v >= 0 {
+		return v
+	}
+	return 3
+}
+
+// lookupExchangeRate returns the rate (home currency per unit of currency)
+// for a date, falling back to the most recent rate within maxRateAgeDays
+func lookupExchangeRate(currency string, date time.Time) (float64, bool, error) {
+	var rate float64
+	err := db.QueryRow(
+		`SELECT rate FROM exchange_rates
+		WHERE currency = ? AND rate_date <= ? AND rate_date >= ?
+		ORDER BY rate_date DESC LIMIT 1`,
+		currency, date, date.AddDate(0, 0, -maxRateAgeDays()),
+	).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to look up exchange rate: %v", err)
+	}
+	return rate, true, nil
+}
+
+// convertToHome works out the conversion status and home-currency amount
+// for a transaction. A foreign-currency transaction without a usable rate
+// is left pending until rates arrive.
+func convertToHome(amount float64, currency string, date time.Time) (string, sql.NullFloat64, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if amount <= 0 {
+		return conversionNotNeeded, sql.NullFloat64{}, nil
+	}
+	if currency == "" || currency == homeCurrency() {
+		return conversionNotNeeded, sql.NullFloat64{Float64: amount, Valid: true}, nil
+	}
+
+	rate, ok, err := lookupExchangeRate(currency, date)
+	if err != nil {
+		return conversionPending, sql.NullFloat64{}, err
+	}
+	if !ok {
+		return conversionPending, sql.NullFloat64{}, nil
+	}
+	return conversionConverted, sql.NullFloat64{Float64: math.Round(amount*rate*100) / 100, Valid: true}, nil
+}
+
+// backfillConversions converts pending transactions for which rates are now
+// available and returns how many were converted
+func backfillConversions() (int, error) {
+	rows, err := db.Query(
+		`SELECT id, amount, currency, COALESCE(date, DATE(created_at))
+		FROM transactions WHERE conversion_status = ?`,
+		conversionPending,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query pending conversions: %v", err)
+	}
+
+	type pending struct {
+		id       int64
+		amount   float64
+		currency string
+		date     time.Time
+	}
+	var queue []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.amount, &p.currency, &p.date); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan pending conversion: %v", err)
+		}
+		queue = append(queue, p)
+	}
+	rows.Close()
+
+	converted := 0
+	for _, p := range queue {
+		status, homeAmount, err := convertToHome(p.amount, p.currency, p.date)
+		if err != nil {
+			return converted, err
+		}
+		if status == conversionPending {
+			continue
+		}
+		if _, err := db.Exec(
+			"UPDATE transactions SET conversion_status = ?, home_amount = ? WHERE id = ?",
+			status, homeAmount, p.id,
+		); err != nil {
+			return converted, fmt.Errorf("failed to update transaction %d: %v", p.id, err)
+		}
+		converted++
+	}
+	return converted, nil
+}
+
+// registerCurrencyRoutes adds exchange rate management and conversion tracking
+func registerCurrencyRoutes(app *fiber.App) {
+	// Load exchange rates; pending conversions are backfilled right after
+	app.Post("/exchange-rates", func(c *fiber.Ctx) error {
+		type RateInput struct {
+			Date     string  `json:"date"`
+			Currency string  `json:"currency"`
+			Rate     float64 `json:"rate"`
+		}
+		type RatesRequest struct {
+			Rates []RateInput `json:"rates"`
+		}
+
+		var req RatesRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if len(req.Rates) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "rates must contain at least one rate",
+			})
+		}
+
+		for i, r := range req.Rates {
+			date, err := time.Parse("2006-01-02", r.Date)
+			if err != nil || len(r.Currency) != 3 || r.Rate <= 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": fmt.Sprintf("rates[%d]: expected date (YYYY-MM-DD), 3-letter currency and positive rate", i),
+				})
+			}
+			if _, err := db.Exec(
+				`INSERT INTO exchange_rates (rate_date, currency, rate) VALUES (?, ?, ?)
+				ON DUPLICATE KEY UPDATE rate = VALUES(rate)`,
+				date, strings.ToUpper(r.Currency), r.Rate,
+			); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to store rate: %v", err),
+				})
+			}
+		}
+
+		converted, err := backfillConversions()
+		if err != nil {
+			log.Printf("Currency backfill failed: %v", err)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"stored":        len(req.Rates),
+			"backfilled":    converted,
+			"home_currency": homeCurrency(),
+		})
+	})
+
+	// Transactions in a foreign currency still waiting for an exchange rate
+	app.Get("/transactions/unconverted", func(c *fiber.Ctx) error {
+		rows, err := db.Query(
+			`SELECT id, receipt_id, date, merchant_clean, amount, currency, created_at
+			FROM transactions WHERE conversion_status = ?
+			ORDER BY date, id`,
+			conversionPending,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list unconverted transactions: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		transactions := []fiber.Map{}
+		for rows.Next() {
+			var id, receiptID int64
+			var date sql.NullTime
+			var merchant, currency sql.NullString
+			var amount sql.NullFloat64
+			var createdAt time.Time
+			if err := rows.Scan(&id, &receiptID, &date, &merchant, &amount, &currency, &createdAt); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read transaction: %v", err),
+				})
+			}
+			t := fiber.Map{
+				"id":         id,
+				"receipt_id": receiptID,
+				"merchant":   merchant.String,
+				"amount":     amount.Float64,
+				"currency":   currency.String,
+				"created_at": createdAt,
+			}
+			if date.Valid {
+				t["date"] = date.Time.Format("2006-01-02")
+			}
+			transactions = append(transactions, t)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"home_currency": homeCurrency(),
+			"transactions":  transactions,
+			"count":         len(transactions),
+		})
+	})
+}
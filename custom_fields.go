@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// fieldEnum is a custom field type restricted to a list of values
+const fieldEnum = "enum"
+
+// customFieldNamePattern keeps field names usable as JSON keys and CSV
+// headers
+var customFieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// CustomField is a deployment-defined transaction field such as a cost
+// center or client code, stored in transactions.custom_fields
+type CustomField struct {
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"`
+	// Type is string, number, date or enum
+	Type   string   `json:"type"`
+	Values []string `json:"values,omitempty"`
+	// Description tells Gemini what to look for when Extract is set
+	Description string `json:"description,omitempty"`
+	Extract     bool   `json:"extract"`
+}
+
+// customFields are loaded from CUSTOM_FIELDS_FILE on startup
+var customFields = loadCustomFields(os.Getenv("CUSTOM_FIELDS_FILE"))
+
+// loadCustomFields reads the custom field definitions from a JSON file
+// holding an array of fields. Without a file no custom fields exist; an
+// invalid file is reported and ignored.
+func loadCustomFields(path string) []CustomField {
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Custom fields: %v, no custom fields defined", err)
+		return nil
+	}
+	var fields []CustomField
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		log.Printf("Custom fields: invalid %s: %v", path, err)
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		var problem string
+		switch {
+		case !customFieldNamePattern.MatchString(f.Name):
+			problem = "name must be lowercase letters, digits and underscores"
+		case seen[f.Name]:
+			problem = "defined twice"
+		case f.Type != fieldString && f.Type != fieldNumber && f.Type != fieldDate && f.Type != fieldEnum:
+			problem = "type must be string, number, date or enum"
+		case f.Type == fieldEnum && len(f.Values) == 0:
+			problem = "enum fields need values"
+		}
+		if problem != "" {
+			log.Printf("Custom fields: invalid field %q in %s: %s", f.Name, path, problem)
+			return nil
+		}
+		seen[f.Name] = true
+	}
+	log.Printf("Custom fields: %d field(s) defined", len(fields))
+	return fields
+}
+
+// customFieldByName returns the named custom field or nil
+func customFieldByName(name string) *CustomField {
+	for i := range customFields {
+		if customFields[i].Name == name {
+			return &customFields[i]
+		}
+	}
+	return nil
+}
+
+// normalize checks a value against the field type and returns it in its
+// stored form
+func (f *CustomField) normalize(v any) (any, error) {
+	switch f.Type {
+	case fieldNumber:
+		n, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return n, nil
+	case fieldDate:
+		s, ok := v.(string)
+		if _, err := time.Parse("2006-01-02", s); !ok || err != nil {
+			return nil, fmt.Errorf("must be a YYYY-MM-DD date")
+		}
+		return s, nil
+	case fieldEnum:
+		s, _ := v.(string)
+		for _, allowed := range f.Values {
+			if strings.EqualFold(s, allowed) {
+				return allowed, nil
+			}
+		}
+		return nil, fmt.Errorf("must be one of %s", strings.Join(f.Values, ", "))
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		if len(s) > 255 {
+			return nil, fmt.Errorf("must be at most 255 characters")
+		}
+		return strings.TrimSpace(s), nil
+	}
+}
+
+// validateCustomFields checks values against the field definitions and
+// returns the valid ones. Unknown fields are errors; null or empty values
+// are dropped.
+func validateCustomFields(values map[string]any) (map[string]any, []FieldError) {
+	valid := make(map[string]any)
+	var errs []FieldError
+	for name, v := range values {
+		f := customFieldByName(name)
+		if f == nil {
+			errs = append(errs, FieldError{"custom_fields." + name, "is not a defined custom field"})
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		n, err := f.normalize(v)
+		if err != nil {
+			errs = append(errs, FieldError{"custom_fields." + name, err.Error()})
+			continue
+		}
+		if n != "" {
+			valid[name] = n
+		}
+	}
+	return valid, errs
+}
+
+// customFieldsPrompt asks Gemini for the custom fields marked for
+// extraction
+func customFieldsPrompt(prompt string) string {
+	var b strings.Builder
+	for _, f := range customFields {
+		if !f.Extract {
+			continue
+		}
+		desc := f.Description
+		if desc == "" {
+			desc = f.Label
+		}
+		if f.Type == fieldEnum {
+			desc += " (one of: " + strings.Join(f.Values, ", ") + ")"
+		}
+		fmt.Fprintf(&b, "- %s: %s\n", f.Name, desc)
+	}
+	if b.Len() == 0 {
+		return prompt
+	}
+	return prompt + "\n\nAlso include a \"custom_fields\" object in the same JSON object with these fields (null if not shown):\n" + b.String()
+}
+
+// encodeCustomFields returns the custom_fields column value
+func encodeCustomFields(values map[string]any) (sql.NullString, error) {
+	if len(values) == 0 {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode custom fields: %v", err)
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+// decodeCustomFields parses a custom_fields column value
+func decodeCustomFields(raw []byte) map[string]any {
+	if len(raw) == 0 {
+		return nil
+	}
+	var values map[string]any
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil
+	}
+	return values
+}
+
+// customFieldHeaders returns the CSV column headers of the custom fields
+func customFieldHeaders() []string {
+	headers := make([]string, len(customFields))
+	for i, f := range customFields {
+		headers[i] = f.Label
+		if headers[i] == "" {
+			headers[i] = f.Name
+		}
+	}
+	return headers
+}
+
+// customFieldCells renders a transaction's custom field values in
+// definition order
+func customFieldCells(values map[string]any) []string {
+	cells := make([]string, len(customFields))
+	for i, f := range customFields {
+		if v, ok := values[f.Name]; ok && v != nil {
+			cells[i] = fmt.Sprint(v)
+		}
+	}
+	return cells
+}
+
+// registerCustomFieldRoutes adds the field definitions and editing of a
+// transaction's values
+func registerCustomFieldRoutes(app *fiber.App) {
+	app.Get("/custom-fields", func(c *fiber.Ctx) error {
+		fields := customFields
+		if fields == nil {
+			fields = []CustomField{}
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"fields":  fields,
+		})
+	})
+
+	// Set custom field values of a transaction; fields missing from the
+	// body keep their value and null clears one
+	app.Patch("/transactions/:id/custom-fields", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+		var req map[string]any
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		var raw []byte
+		err = db.QueryRow("SELECT custom_fields FROM transactions WHERE id = ?", id).Scan(&raw)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Transaction not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transaction: %v", err),
+			})
+		}
+
+		// Values of fields no longer defined are dropped
+		values := make(map[string]any)
+		for name, v := range decodeCustomFields(raw) {
+			if customFieldByName(name) != nil {
+				values[name] = v
+			}
+		}
+		for name, v := range req {
+			values[name] = v
+		}
+		valid, errs := validateCustomFields(values)
+		if len(errs) > 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  "Invalid custom fields",
+				"fields": errs,
+			})
+		}
+
+		column, err := encodeCustomFields(valid)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if _, err := db.Exec("UPDATE transactions SET custom_fields = ? WHERE id = ?", column, id); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save custom fields: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"custom_fields": valid,
+		})
+	})
+}
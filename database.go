@@ -0,0 +1,979 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Initialize database connection
+func initDB() error {
+	// Get database connection string from environment variable
+	// Format: username:password@tcp(host:port)/database
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		dsn = "root:@tcp(127.0.0.1:3306)/receipt_processor?parseTime=true"
+		log.Println("MYSQL_DSN not set, using default:", dsn)
+	}
+
+	var err error
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+
+	pool, err := loadDBPoolConfig()
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(pool.MaxOpen)
+	db.SetMaxIdleConns(pool.MaxIdle)
+	db.SetConnMaxLifetime(pool.MaxLifetime)
+	db.SetConnMaxIdleTime(pool.MaxIdleTime)
+
+	// Test connection, waiting for the server to come up if configured
+	if err := waitForDB(pool.WaitTimeout); err != nil {
+		return fmt.Errorf("failed to ping database: %v", err)
+	}
+
+	log.Println("Database connection established")
+	return nil
+}
+
+// DBPoolConfig holds the connection pool settings
+type DBPoolConfig struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+	// MaxIdleTime should stay below the server's wait_timeout so idle
+	// connections are closed here before MySQL drops them
+	MaxIdleTime time.Duration
+	// WaitTimeout is how long startup retries an unreachable server
+	WaitTimeout time.Duration
+}
+
+// loadDBPoolConfig reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME, DB_CONN_MAX_IDLE_TIME and DB_WAIT_TIMEOUT
+func loadDBPoolConfig() (*DBPoolConfig, error) {
+	cfg := &DBPoolConfig{
+		MaxOpen:     25,
+		MaxIdle:     5,
+		MaxLifetime: 5 * time.Minute,
+		MaxIdleTime: time.Minute,
+	}
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{
+		{"DB_MAX_OPEN_CONNS", &cfg.MaxOpen},
+		{"DB_MAX_IDLE_CONNS", &cfg.MaxIdle},
+	} {
+		if s := os.Getenv(v.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", v.name, s)
+			}
+			*v.dst = n
+		}
+	}
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"DB_CONN_MAX_LIFETIME", &cfg.MaxLifetime},
+		{"DB_CONN_MAX_IDLE_TIME", &cfg.MaxIdleTime},
+		{"DB_WAIT_TIMEOUT", &cfg.WaitTimeout},
+	} {
+		if s := os.Getenv(v.name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s %q", v.name, s)
+			}
+			*v.dst = d
+		}
+	}
+	if cfg.MaxIdle > cfg.MaxOpen {
+		cfg.MaxIdle = cfg.MaxOpen
+	}
+	return cfg, nil
+}
+
+// waitForDB pings the database, retrying with backoff for up to timeout so
+// the service can start alongside MySQL in Docker Compose
+func waitForDB(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := 500 * time.Millisecond
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Printf("Database not reachable yet (%v), retrying in %v", err, delay)
+		time.Sleep(delay)
+		if delay < 5*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// schemaTables are created in order on startup if they don't exist;
+// tables referencing others come after them
+var schemaTables = []struct {
+	Name string
+	DDL  string
+}{
+	{"receipts", `
+		CREATE TABLE IF NOT EXISTS receipts (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			file_name VARCHAR(255) NOT NULL,
+			drive_file_id VARCHAR(255),
+			status ENUM('processed', 'needs_review', 'error', 'pending_approval', 'rejected', 'pending', 'processing', 'duplicate') NOT NULL DEFAULT 'needs_review',
+			uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_status (status),
+			INDEX idx_uploaded_at (uploaded_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"transactions", `
+		CREATE TABLE IF NOT EXISTS transactions (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			receipt_id BIGINT NOT NULL,
+			date DATE,
+			merchant_raw VARCHAR(255),
+			merchant_clean VARCHAR(255),
+			category VARCHAR(100),
+			amount DECIMAL(10, 2),
+			currency VARCHAR(3),
+			confidence DECIMAL(5, 4),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_receipt_id (receipt_id),
+			INDEX idx_date (date),
+			INDEX idx_merchant_clean (merchant_clean),
+			INDEX idx_category (category)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	// Old transactions moved out of the live table by the archive command;
+	// missing columns are added by syncArchiveColumns
+	{"transactions_archive", `
+		CREATE TABLE IF NOT EXISTS transactions_archive LIKE transactions;
+	`},
+	// Transactions of receipts in the trash, until they are restored or
+	// purged; missing columns are added by syncArchiveColumns
+	{"transactions_trash", `
+		CREATE TABLE IF NOT EXISTS transactions_trash LIKE transactions;
+	`},
+	{"exchange_rates", `
+		CREATE TABLE IF NOT EXISTS exchange_rates (
+			rate_date DATE NOT NULL,
+			currency CHAR(3) NOT NULL,
+			rate DECIMAL(18, 8) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (rate_date, currency)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"pipeline_configs", `
+		CREATE TABLE IF NOT EXISTS pipeline_configs (
+			tenant_key VARCHAR(128) PRIMARY KEY,
+			config JSON NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"merchants", `
+		CREATE TABLE IF NOT EXISTS merchants (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			keywords TEXT,
+			prompt_hints TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY uq_merchant_name (name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"category_suggestions", `
+		CREATE TABLE IF NOT EXISTS category_suggestions (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			merchant_id BIGINT NOT NULL,
+			current_category VARCHAR(100),
+			category VARCHAR(100) NOT NULL,
+			reason VARCHAR(255),
+			samples INT NOT NULL DEFAULT 0,
+			share DECIMAL(5, 4),
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			decided_at TIMESTAMP NULL,
+			FOREIGN KEY (merchant_id) REFERENCES merchants(id) ON DELETE CASCADE,
+			INDEX idx_status (status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"subscriptions", `
+		CREATE TABLE IF NOT EXISTS subscriptions (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			merchant_id BIGINT,
+			name VARCHAR(255) NOT NULL,
+			amount DECIMAL(10, 2) NOT NULL,
+			currency VARCHAR(3),
+			billing_cycle VARCHAR(16) NOT NULL,
+			last_charged DATE,
+			next_renewal DATE,
+			cancel_by DATE,
+			remind_days INT NOT NULL DEFAULT 3,
+			reminded_for DATE,
+			status VARCHAR(16) NOT NULL DEFAULT 'active',
+			source VARCHAR(16) NOT NULL DEFAULT 'manual',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (merchant_id) REFERENCES merchants(id) ON DELETE SET NULL,
+			INDEX idx_merchant_id (merchant_id),
+			INDEX idx_status_renewal (status, next_renewal)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"parse_repairs", `
+		CREATE TABLE IF NOT EXISTS parse_repairs (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			receipt_id BIGINT NOT NULL,
+			attempt INT NOT NULL,
+			validation_errors TEXT,
+			response TEXT,
+			succeeded BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_receipt_id (receipt_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"receipt_artifacts", `
+		CREATE TABLE IF NOT EXISTS receipt_artifacts (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			receipt_id BIGINT NOT NULL,
+			kind VARCHAR(50) NOT NULL,
+			content MEDIUMBLOB,
+			content_hash CHAR(64),
+			content_size INT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_receipt_kind (receipt_id, kind)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"layout_clusters", `
+		CREATE TABLE IF NOT EXISTS layout_clusters (
+			id INT PRIMARY KEY,
+			merchant VARCHAR(255),
+			size INT NOT NULL,
+			failures INT NOT NULL,
+			failure_rate DECIMAL(5, 4) NOT NULL,
+			keywords JSON,
+			sample_receipt_ids JSON,
+			suggestion VARCHAR(255),
+			analyzed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"capture_goals", `
+		CREATE TABLE IF NOT EXISTS capture_goals (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			tenant_key VARCHAR(128) NOT NULL,
+			month DATE NOT NULL,
+			max_latency_hours INT NOT NULL,
+			target_percent DECIMAL(5, 2) NOT NULL DEFAULT 100,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uniq_tenant_month (tenant_key, month)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"paperless_documents", `
+		CREATE TABLE IF NOT EXISTS paperless_documents (
+			document_id INT PRIMARY KEY,
+			receipt_id BIGINT,
+			status VARCHAR(16) NOT NULL,
+			error TEXT,
+			imported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE SET NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"ses_messages", `
+		CREATE TABLE IF NOT EXISTS ses_messages (
+			object_hash CHAR(64) PRIMARY KEY,
+			object_key VARCHAR(1024) NOT NULL,
+			message_id VARCHAR(255),
+			sender VARCHAR(255),
+			subject VARCHAR(512),
+			status VARCHAR(16) NOT NULL,
+			receipt_ids JSON,
+			error TEXT,
+			imported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"firefly_mappings", `
+		CREATE TABLE IF NOT EXISTS firefly_mappings (
+			kind VARCHAR(32) NOT NULL,
+			local_value VARCHAR(100) NOT NULL,
+			firefly_value VARCHAR(255) NOT NULL,
+			PRIMARY KEY (kind, local_value)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"ynab_category_mappings", `
+		CREATE TABLE IF NOT EXISTS ynab_category_mappings (
+			category VARCHAR(100) PRIMARY KEY,
+			ynab_category_id VARCHAR(64) NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"approval_rules", `
+		CREATE TABLE IF NOT EXISTS approval_rules (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			submitter VARCHAR(128) NOT NULL DEFAULT '*',
+			category VARCHAR(100),
+			min_amount DECIMAL(12, 2) NOT NULL,
+			approver VARCHAR(128) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_submitter (submitter)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"receipt_approvals", `
+		CREATE TABLE IF NOT EXISTS receipt_approvals (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			receipt_id BIGINT NOT NULL UNIQUE,
+			transaction_id BIGINT NOT NULL,
+			rule_id BIGINT,
+			submitter VARCHAR(128) NOT NULL,
+			approver VARCHAR(128) NOT NULL,
+			amount DECIMAL(12, 2) NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			comment TEXT,
+			requested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			decided_at TIMESTAMP NULL,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_approver_status (approver, status),
+			INDEX idx_submitter_status (submitter, status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"projects", `
+		CREATE TABLE IF NOT EXISTS projects (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			client VARCHAR(255),
+			budget DECIMAL(12, 2),
+			start_date DATE,
+			end_date DATE,
+			billable BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"project_budget_alerts", `
+		CREATE TABLE IF NOT EXISTS project_budget_alerts (
+			project_id BIGINT NOT NULL,
+			kind VARCHAR(32) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (project_id, kind),
+			FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"invoices", `
+		CREATE TABLE IF NOT EXISTS invoices (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			project_id BIGINT NOT NULL,
+			number VARCHAR(64) UNIQUE,
+			markup JSON NOT NULL,
+			subtotal DECIMAL(12, 2) NOT NULL,
+			markup_total DECIMAL(12, 2) NOT NULL,
+			total DECIMAL(12, 2) NOT NULL,
+			billed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"user_settings", `
+		CREATE TABLE IF NOT EXISTS user_settings (
+			tenant_key VARCHAR(128) PRIMARY KEY,
+			settings JSON NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"receipt_tags", `
+		CREATE TABLE IF NOT EXISTS receipt_tags (
+			receipt_id BIGINT NOT NULL,
+			tag VARCHAR(64) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (receipt_id, tag),
+			INDEX idx_tag (tag),
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"webhook_subscriptions", `
+		CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			url VARCHAR(2048) NOT NULL,
+			events JSON NOT NULL,
+			description VARCHAR(255),
+			secret VARCHAR(100) NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			last_delivery_at TIMESTAMP NULL,
+			last_error TEXT,
+			consecutive_failures INT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"tax_line_mappings", `
+		CREATE TABLE IF NOT EXISTS tax_line_mappings (
+			jurisdiction VARCHAR(32) NOT NULL,
+			category VARCHAR(100) NOT NULL,
+			line VARCHAR(50) NOT NULL,
+			label VARCHAR(255),
+			deductible_percent DECIMAL(5, 2) NOT NULL DEFAULT 100,
+			PRIMARY KEY (jurisdiction, category)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"ingest_jobs", `
+		CREATE TABLE IF NOT EXISTS ingest_jobs (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			receipt_id BIGINT NOT NULL,
+			file_path VARCHAR(512) NOT NULL,
+			is_pdf BOOLEAN NOT NULL DEFAULT FALSE,
+			profile VARCHAR(50),
+			ocr_options JSON,
+			priority VARCHAR(10) NOT NULL DEFAULT 'normal',
+			tenant VARCHAR(128) NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'queued',
+			attempts INT NOT NULL DEFAULT 0,
+			claim_token CHAR(36),
+			error TEXT,
+			result JSON,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			started_at TIMESTAMP NULL,
+			finished_at TIMESTAMP NULL,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_status (status),
+			INDEX idx_claim_token (claim_token)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"price_checks", `
+		CREATE TABLE IF NOT EXISTS price_checks (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			receipt_id BIGINT NOT NULL,
+			transaction_id BIGINT NOT NULL,
+			item_name VARCHAR(255) NOT NULL,
+			barcode VARCHAR(32),
+			quantity DECIMAL(10, 3) NOT NULL DEFAULT 1,
+			charged_price DECIMAL(10, 2) NOT NULL,
+			shelf_price DECIMAL(10, 2),
+			currency VARCHAR(3),
+			overcharge DECIMAL(10, 2) NOT NULL DEFAULT 0,
+			flagged BOOLEAN NOT NULL DEFAULT FALSE,
+			checked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_transaction (transaction_id),
+			INDEX idx_flagged (flagged)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"transaction_items", `
+		CREATE TABLE IF NOT EXISTS transaction_items (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			transaction_id BIGINT NOT NULL,
+			receipt_id BIGINT NOT NULL,
+			position INT NOT NULL,
+			description VARCHAR(500),
+			barcode VARCHAR(32),
+			quantity DECIMAL(10, 3) NOT NULL DEFAULT 1,
+			unit_price DECIMAL(10, 2),
+			total DECIMAL(10, 2) NOT NULL,
+			category VARCHAR(100),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_transaction (transaction_id),
+			INDEX idx_category (category)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"vehicles", `
+		CREATE TABLE IF NOT EXISTS vehicles (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			plate VARCHAR(20),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"fuel_logs", `
+		CREATE TABLE IF NOT EXISTS fuel_logs (
+			receipt_id BIGINT PRIMARY KEY,
+			vehicle_id BIGINT NOT NULL,
+			odometer DECIMAL(10, 1),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			FOREIGN KEY (vehicle_id) REFERENCES vehicles(id) ON DELETE CASCADE,
+			INDEX idx_vehicle_odometer (vehicle_id, odometer)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"receipt_quality", `
+		CREATE TABLE IF NOT EXISTS receipt_quality (
+			receipt_id BIGINT PRIMARY KEY,
+			width INT,
+			height INT,
+			blur_score DECIMAL(12, 2),
+			brightness DECIMAL(6, 2),
+			contrast DECIMAL(6, 2),
+			ocr_confidence DECIMAL(5, 2),
+			ocr_words INT,
+			rotation INT NOT NULL DEFAULT 0,
+			preprocessing JSON,
+			processing_method VARCHAR(50),
+			measured_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"expense_policies", `
+		CREATE TABLE IF NOT EXISTS expense_policies (
+			tenant_key VARCHAR(128) PRIMARY KEY,
+			policy JSON NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"inventory_ledger", `
+		CREATE TABLE IF NOT EXISTS inventory_ledger (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			tenant_key VARCHAR(128) NOT NULL,
+			receipt_id BIGINT NOT NULL,
+			transaction_id BIGINT NOT NULL,
+			product VARCHAR(100) NOT NULL,
+			description VARCHAR(500) NOT NULL,
+			quantity DECIMAL(12, 4) NOT NULL,
+			unit VARCHAR(8) NOT NULL,
+			purchased_on DATE NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_transaction (transaction_id),
+			INDEX idx_tenant_product (tenant_key, product, purchased_on)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"inventory_rules", `
+		CREATE TABLE IF NOT EXISTS inventory_rules (
+			tenant_key VARCHAR(128) PRIMARY KEY,
+			rules JSON NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"webhook_events", `
+		CREATE TABLE IF NOT EXISTS webhook_events (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			event_id CHAR(36) NOT NULL UNIQUE,
+			event VARCHAR(64) NOT NULL,
+			envelope JSON NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_event (event, id),
+			INDEX idx_created_at (created_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"quarantined_files", `
+		CREATE TABLE IF NOT EXISTS quarantined_files (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			file_name VARCHAR(255) NOT NULL,
+			original_name VARCHAR(255) NOT NULL,
+			reason VARCHAR(32) NOT NULL,
+			detail VARCHAR(500),
+			content_type VARCHAR(128),
+			size BIGINT NOT NULL DEFAULT 0,
+			checksum CHAR(64),
+			channel VARCHAR(64),
+			tenant_key VARCHAR(255) NOT NULL,
+			priority VARCHAR(16) NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'quarantined',
+			receipt_id BIGINT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			decided_by VARCHAR(255),
+			decided_at TIMESTAMP NULL,
+			INDEX idx_status (status, id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"quarantine_audit", `
+		CREATE TABLE IF NOT EXISTS quarantine_audit (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			quarantine_id BIGINT,
+			action VARCHAR(32) NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			detail VARCHAR(500),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_quarantine_id (quarantine_id, id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"loyalty_points", `
+		CREATE TABLE IF NOT EXISTS loyalty_points (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			tenant_key VARCHAR(128) NOT NULL,
+			receipt_id BIGINT NOT NULL,
+			transaction_id BIGINT NOT NULL,
+			program VARCHAR(100) NOT NULL,
+			program_name VARCHAR(100) NOT NULL,
+			merchant VARCHAR(255) NULL,
+			card_last4 CHAR(4) NULL,
+			points_earned DECIMAL(14, 2) NOT NULL DEFAULT 0,
+			points_balance DECIMAL(14, 2) NULL,
+			earned_on DATE NOT NULL,
+			expires_on DATE NULL,
+			reminded_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
+			INDEX idx_transaction (transaction_id),
+			INDEX idx_tenant_program (tenant_key, program, earned_on),
+			INDEX idx_reminded (reminded_at, expires_on)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"loyalty_programs", `
+		CREATE TABLE IF NOT EXISTS loyalty_programs (
+			tenant_key VARCHAR(128) PRIMARY KEY,
+			programs JSON NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"label_translations", `
+		CREATE TABLE IF NOT EXISTS label_translations (
+			tenant_key VARCHAR(128) PRIMARY KEY,
+			labels JSON NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"digest_runs", `
+		CREATE TABLE IF NOT EXISTS digest_runs (
+			period VARCHAR(16) NOT NULL,
+			period_start DATE NOT NULL,
+			sent_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (period, period_start)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"users", `
+		CREATE TABLE IF NOT EXISTS users (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			subject VARCHAR(255) NOT NULL UNIQUE,
+			email VARCHAR(255),
+			name VARCHAR(255),
+			role VARCHAR(16) NOT NULL,
+			idp_groups JSON,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_login_at TIMESTAMP NULL DEFAULT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"user_sessions", `
+		CREATE TABLE IF NOT EXISTS user_sessions (
+			token_hash CHAR(64) PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_expires_at (expires_at),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"api_tokens", `
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			token_hash CHAR(64) NOT NULL UNIQUE,
+			prefix VARCHAR(16) NOT NULL,
+			scopes JSON NOT NULL,
+			tenant_key VARCHAR(128) NOT NULL,
+			user_id BIGINT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP NULL DEFAULT NULL,
+			expires_at DATETIME NULL DEFAULT NULL,
+			revoked_at TIMESTAMP NULL DEFAULT NULL,
+			INDEX idx_tenant_key (tenant_key),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	// Gemini spend per month and model for GEMINI_MONTHLY_BUDGET; cost is
+	// in USD
+	{"gemini_usage", `
+		CREATE TABLE IF NOT EXISTS gemini_usage (
+			month CHAR(7) NOT NULL,
+			model VARCHAR(100) NOT NULL,
+			requests INT NOT NULL DEFAULT 0,
+			prompt_tokens BIGINT NOT NULL DEFAULT 0,
+			output_tokens BIGINT NOT NULL DEFAULT 0,
+			cost DECIMAL(12, 6) NOT NULL DEFAULT 0,
+			PRIMARY KEY (month, model)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"category_insights", `
+		CREATE TABLE IF NOT EXISTS category_insights (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			month CHAR(7) NOT NULL,
+			category VARCHAR(100) NOT NULL,
+			spend DECIMAL(12, 2) NOT NULL,
+			average DECIMAL(12, 2) NOT NULL,
+			std_dev DECIMAL(12, 2) NOT NULL,
+			z_score DECIMAL(8, 2) NOT NULL,
+			change_pct DECIMAL(10, 1) NOT NULL,
+			direction VARCHAR(8) NOT NULL,
+			currency VARCHAR(3) NOT NULL,
+			message TEXT NOT NULL,
+			notified_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uniq_month_category (month, category)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+	{"oidc_logins", `
+		CREATE TABLE IF NOT EXISTS oidc_logins (
+			state VARCHAR(64) PRIMARY KEY,
+			nonce VARCHAR(64) NOT NULL,
+			verifier VARCHAR(128) NOT NULL,
+			redirect VARCHAR(512) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`},
+}
+
+// Create database tables if they don't exist
+func createTables() error {
+	for _, table := range schemaTables {
+		if _, err := db.Exec(table.DDL); err != nil {
+			return fmt.Errorf("failed to create %s table: %v", table.Name, err)
+		}
+	}
+
+	if err := migrateColumns(); err != nil {
+		return err
+	}
+	if err := migrateReceiptStatuses(); err != nil {
+		return err
+	}
+	if err := migrateCaptureGoalKey(); err != nil {
+		return err
+	}
+	if err := migrateArtifactContent(); err != nil {
+		return err
+	}
+	if err := syncArchiveColumns(); err != nil {
+		return err
+	}
+	if err := linkTransactionMerchants(); err != nil {
+		return err
+	}
+	if err := normalizeStoredItemUnits(); err != nil {
+		return err
+	}
+
+	log.Println("Database tables created/verified")
+	return nil
+}
+
+// columnMigration describes a column added to an existing table after its
+// CREATE TABLE statement was first shipped
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+// columnMigrations are applied in order on startup; each is skipped when the
+// column already exists so older databases are upgraded in place
+var columnMigrations = []columnMigration{
+	{"receipts", "storage_backend", "VARCHAR(32) NOT NULL DEFAULT 'local'"},
+	{"receipts", "checksum", "CHAR(64)"},
+	{"receipts", "source_url", "VARCHAR(2048)"},
+	{"receipts", "source_title", "VARCHAR(512)"},
+	{"receipts", "verified_at", "TIMESTAMP NULL"},
+	{"receipts", "review_reminders", "INT NOT NULL DEFAULT 0"},
+	{"receipts", "last_reminded_at", "TIMESTAMP NULL"},
+	{"receipts", "gemini_tokens", "INT NOT NULL DEFAULT 0"},
+	{"receipts", "priority", "VARCHAR(10) NOT NULL DEFAULT 'normal'"},
+	{"receipts", "updated_at", "TIMESTAMP NULL DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP"},
+	{"receipts", "channel", "VARCHAR(32) NOT NULL DEFAULT 'api'"},
+	{"receipts", "image_hash", "BIGINT UNSIGNED"},
+	{"receipts", "duplicate_of", "BIGINT"},
+	{"receipts", "duplicate_reason", "VARCHAR(32)"},
+	{"receipts", "deleted_at", "TIMESTAMP NULL"},
+	{"ingest_jobs", "storage_backend", "VARCHAR(32) NOT NULL DEFAULT 'local'"},
+	{"ingest_jobs", "transaction_id", "BIGINT"},
+	{"transactions", "reference_number", "VARCHAR(100)"},
+	{"transactions", "subtotal", "DECIMAL(10, 2)"},
+	{"transactions", "tip", "DECIMAL(10, 2)"},
+	{"transactions", "tip_percentage", "DECIMAL(6, 2)"},
+	{"transactions", "tip_unusual", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"transactions", "home_amount", "DECIMAL(12, 2)"},
+	{"transactions", "conversion_status", "VARCHAR(16) NOT NULL DEFAULT 'not_needed'"},
+	{"transactions", "merchant_country", "CHAR(2)"},
+	{"transactions", "date_ambiguous", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"transactions", "branch_name", "VARCHAR(100)"},
+	{"transactions", "store_number", "VARCHAR(50)"},
+	{"transactions", "store_address", "VARCHAR(255)"},
+	{"transactions", "merchant_id", "BIGINT"},
+	{"transactions", "category_corrected", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"transactions", "category_corrected_at", "TIMESTAMP NULL"},
+	{"transactions", "updated_at", "TIMESTAMP NULL DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP"},
+	{"transactions", "firefly_id", "VARCHAR(32)"},
+	{"transactions", "firefly_journal_id", "VARCHAR(32)"},
+	{"transactions", "firefly_synced_at", "TIMESTAMP NULL"},
+	{"transactions", "ynab_id", "VARCHAR(64)"},
+	{"transactions", "ynab_cleared", "VARCHAR(16)"},
+	{"transactions", "profile", "VARCHAR(32)"},
+	{"transactions", "extra_fields", "JSON"},
+	{"transactions", "anonymized_at", "TIMESTAMP NULL"},
+	{"transactions", "project_id", "BIGINT"},
+	{"transactions", "invoice_id", "BIGINT"},
+	{"transactions", "billed_at", "TIMESTAMP NULL"},
+	{"transactions", "custom_fields", "JSON"},
+	{"transactions", "policy_violations", "JSON"},
+	{"transactions", "fingerprint", "CHAR(64)"},
+	{"merchants", "default_category", "VARCHAR(100)"},
+	{"receipt_artifacts", "content_hash", "CHAR(64)"},
+	{"receipt_artifacts", "content_size", "INT"},
+	{"transactions_archive", "archived_at", "TIMESTAMP NULL"},
+	{"transactions_trash", "trashed_from", "VARCHAR(32)"},
+	{"transaction_items", "unit", "VARCHAR(16)"},
+	{"transaction_items", "canonical_quantity", "DECIMAL(14, 4)"},
+	{"transaction_items", "canonical_unit", "VARCHAR(8)"},
+	{"transaction_items", "price_per_unit", "DECIMAL(14, 4)"},
+	{"users", "email_verified", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"paperless_documents", "attempts", "INT NOT NULL DEFAULT 1"},
+	{"webhook_subscriptions", "previous_secret", "VARCHAR(100)"},
+	{"webhook_subscriptions", "previous_secret_expires_at", "TIMESTAMP NULL"},
+	{"transactions", "purchase_time", "TIME"},
+	{"capture_goals", "tenant_key", "VARCHAR(128) NOT NULL DEFAULT 'default'"},
+}
+
+// indexMigration describes an index added to an existing table
+type indexMigration struct {
+	Table   string
+	Name    string
+	Columns string
+}
+
+// indexMigrations are created on startup when missing
+var indexMigrations = []indexMigration{
+	{"transactions", "idx_merchant_reference", "merchant_clean, reference_number"},
+	{"transactions", "idx_conversion_status", "conversion_status"},
+	{"transactions", "idx_merchant_store", "merchant_clean, store_number"},
+	{"transactions", "idx_merchant_id", "merchant_id"},
+	{"transactions", "idx_project_id", "project_id"},
+	{"transactions", "idx_invoice_id", "invoice_id"},
+	{"receipts", "idx_channel_uploaded", "channel, uploaded_at"},
+	{"receipts", "idx_duplicate_of", "duplicate_of"},
+	{"receipts", "idx_deleted_at", "deleted_at"},
+	{"transactions", "idx_fingerprint", "fingerprint"},
+}
+
+// migrateColumns adds any missing columns and indexes listed in
+// columnMigrations and indexMigrations
+func migrateColumns() error {
+	for _, m := range columnMigrations {
+		exists, err := columnExists(m.Table, m.Column)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s.%s: %v", m.Table, m.Column, err)
+		}
+		if exists {
+			continue
+		}
+
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.Table, m.Column, m.Definition)
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", m.Table, m.Column, err)
+		}
+		log.Printf("Added column %s.%s", m.Table, m.Column)
+	}
+
+	for _, m := range indexMigrations {
+		var count int
+		err := db.QueryRow(
+			`SELECT COUNT(*) FROM information_schema.statistics
+			WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?`,
+			m.Table, m.Name,
+		).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to inspect index %s: %v", m.Name, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		stmt := fmt.Sprintf("CREATE INDEX %s ON %s (%s)", m.Name, m.Table, m.Columns)
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create index %s: %v", m.Name, err)
+		}
+		log.Printf("Created index %s on %s", m.Name, m.Table)
+	}
+	return nil
+}
+
+// receiptStatuses are the values of receipts.status
+const receiptStatuses = "'processed', 'needs_review', 'error', 'pending_approval', 'rejected', 'pending', 'processing', 'duplicate'"
+
+// migrateReceiptStatuses widens the receipts.status enum of databases
+// created before the approval, ingest queue and duplicate statuses were
+// added
+func migrateReceiptStatuses() error {
+	var columnType string
+	err := db.QueryRow(
+		`SELECT column_type FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'receipts' AND column_name = 'status'`,
+	).Scan(&columnType)
+	if err != nil {
+		return fmt.Errorf("failed to inspect receipts.status: %v", err)
+	}
+	if strings.Contains(columnType, "'duplicate'") {
+		return nil
+	}
+
+	stmt := fmt.Sprintf("ALTER TABLE receipts MODIFY status ENUM(%s) NOT NULL DEFAULT 'needs_review'", receiptStatuses)
+	if _, err := db.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to widen receipts.status: %v", err)
+	}
+	log.Println("Added new statuses to receipts.status")
+	return nil
+}
+
+// migrateCaptureGoalKey replaces the month-only unique key of capture_goals
+// created before goals were set per tenant, which kept a second tenant from
+// setting a goal for a month another tenant already had one for
+func migrateCaptureGoalKey() error {
+	var count int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'capture_goals' AND index_name = 'uniq_month'`,
+	).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to inspect capture_goals keys: %v", err)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(
+		"ALTER TABLE capture_goals DROP INDEX uniq_month, ADD UNIQUE KEY uniq_tenant_month (tenant_key, month)",
+	); err != nil {
+		return fmt.Errorf("failed to migrate capture_goals keys: %v", err)
+	}
+	log.Println("Made capture_goals unique per tenant and month")
+	return nil
+}
+
+// migrateArtifactContent turns receipt_artifacts.content into a binary
+// column so it can hold compressed artifacts
+func migrateArtifactContent() error {
+	var dataType string
+	err := db.QueryRow(
+		`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'receipt_artifacts' AND column_name = 'content'`,
+	).Scan(&dataType)
+	if err != nil {
+		return fmt.Errorf("failed to inspect receipt_artifacts.content: %v", err)
+	}
+	if dataType == "mediumblob" {
+		return nil
+	}
+
+	if _, err := db.Exec("ALTER TABLE receipt_artifacts MODIFY content MEDIUMBLOB"); err != nil {
+		return fmt.Errorf("failed to convert receipt_artifacts.content: %v", err)
+	}
+	log.Println("Converted receipt_artifacts.content to MEDIUMBLOB")
+	return nil
+}
+
+// columnExists checks whether a column exists in the current database
+func columnExists(table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`,
+		table, column,
+	).Scan(&count)
+	return count > 0, err
+}
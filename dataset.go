@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DatasetFields are the final transaction fields of a dataset example
+type DatasetFields struct {
+	Date            *string  `json:"date"`
+	MerchantRaw     *string  `json:"merchant_raw"`
+	MerchantClean   *string  `json:"merchant_clean"`
+	Category        *string  `json:"category"`
+	Amount          *float64 `json:"amount"`
+	Subtotal        *float64 `json:"subtotal"`
+	Tip             *float64 `json:"tip"`
+	Currency        *string  `json:"currency"`
+	ReferenceNumber *string  `json:"reference_number"`
+}
+
+// DatasetExample is one line of the training dataset export
+type DatasetExample struct {
+	ReceiptID int64 `json:"receipt_id"`
+	// Image references the stored receipt file as "<backend>:<key>"
+	Image    string        `json:"image"`
+	Checksum string        `json:"checksum,omitempty"`
+	OCRText  string        `json:"ocr_text"`
+	Fields   DatasetFields `json:"fields"`
+	Verified bool          `json:"verified"`
+}
+
+// datasetExportSQL selects receipts with their first transaction and the
+// most recent OCR text stored for them
+const datasetExportSQL = `SELECT r.id, r.storage_backend, r.file_name, COALESCE(r.checksum, ''), r.verified_at IS NOT NULL,
+		(SELECT a.content FROM receipt_artifacts a
+			WHERE a.receipt_id = r.id AND a.kind = ? ORDER BY a.id DESC LIMIT 1),
+		t.date, t.merchant_raw, t.merchant_clean, t.category, t.amount, t.subtotal, t.tip, t.currency, t.reference_number
+	FROM receipts r
+	JOIN transactions t ON t.id = (SELECT MIN(id) FROM transactions WHERE receipt_id = r.id)`
+
+// nullStringPtr returns a pointer to a valid string, or nil
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// nullFloatPtr returns a pointer to a valid float, or nil
+func nullFloatPtr(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	return &f.Float64
+}
+
+// scanDatasetExample reads one datasetExportSQL row and redacts its OCR text
+func scanDatasetExample(rows *sql.Rows) (*DatasetExample, error) {
+	var ex DatasetExample
+	var backend, fileName string
+	var ocrText []byte
+	var date sql.NullTime
+	var merchantRaw, merchantClean, category, currency, reference sql.NullString
+	var amount, subtotal, tip sql.NullFloat64
+	if err := rows.Scan(&ex.ReceiptID, &backend, &fileName, &ex.Checksum, &ex.Verified, &ocrText,
+		&date, &merchantRaw, &merchantClean, &category, &amount, &subtotal, &tip, &currency, &reference); err != nil {
+		return nil, err
+	}
+
+	ex.Image = backend + ":" + fileName
+	ex.OCRText = redactPII(decodeArtifact(ocrText))
+	ex.Fields = DatasetFields{
+		Date:            formatNullDate(date),
+		MerchantRaw:     nullStringPtr(merchantRaw),
+		MerchantClean:   nullStringPtr(merchantClean),
+		Category:        nullStringPtr(category),
+		Amount:          nullFloatPtr(amount),
+		Subtotal:        nullFloatPtr(subtotal),
+		Tip:             nullFloatPtr(tip),
+		Currency:        nullStringPtr(currency),
+		ReferenceNumber: nullStringPtr(reference),
+	}
+	return &ex, nil
+}
+
+// registerDatasetRoutes adds receipt verification and the dataset export
+func registerDatasetRoutes(app *fiber.App) {
+	// Mark a receipt's extracted fields as checked by a human
+	app.Post("/receipts/:id/verify", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+
+		// Only extracted receipts can be verified; failed, rejected or
+		// trashed ones have nothing checked to mark
+		result, err := db.Exec(
+			`UPDATE receipts SET verified_at = ?, status = ?
+			 WHERE id = ? AND status IN ('needs_review', 'processed') AND deleted_at IS NULL`,
+			time.Now(), "processed", id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to verify receipt: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var status string
+			var deletedAt sql.NullTime
+			err := db.QueryRow("SELECT status, deleted_at FROM receipts WHERE id = ?", id).Scan(&status, &deletedAt)
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Receipt not found",
+				})
+			}
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to load receipt: %v", err),
+				})
+			}
+			if deletedAt.Valid {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "Receipt is in the trash",
+				})
+			}
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("Receipt with status %q cannot be verified", status),
+			})
+		}
+
+		liveQueries.Invalidate()
+		return c.JSON(fiber.Map{
+			"success": true,
+			"id":      id,
+		})
+	})
+
+	// Stream (image reference, OCR text, final fields) examples as JSONL for
+	// fine-tuning or evaluating models. Only human-verified receipts are
+	// included unless include_unverified=true, which adds processed ones.
+	app.Get("/admin/dataset/export", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "r.uploaded_at")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		statusCond := "r.verified_at IS NOT NULL"
+		if c.QueryBool("include_unverified", false) {
+			statusCond = "(r.verified_at IS NOT NULL OR r.status = 'processed')"
+		}
+
+		rows, err := db.Query(
+			datasetExportSQL+` WHERE `+statusCond+` AND `+dateCond+` ORDER BY r.id`,
+			append([]any{artifactOCRText}, args...)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to export dataset: %v", err),
+			})
+		}
+
+		c.Set("Content-Type", "application/x-ndjson")
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="receipts-dataset-%s.jsonl"`, time.Now().Format("20060102")))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer rows.Close()
+
+			enc := json.NewEncoder(w)
+			for rows.Next() {
+				ex, err := scanDatasetExample(rows)
+				if err != nil {
+					log.Printf("Dataset export: failed to read receipt: %v", err)
+					return
+				}
+				if err := enc.Encode(ex); err != nil {
+					return
+				}
+			}
+			if err := rows.Err(); err != nil {
+				log.Printf("Dataset export: %v", err)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// monthFirstCountries write numeric dates month first (MM/DD/YYYY); every
+// other country is treated as day first
+var monthFirstCountries = map[string]bool{
+	"US": true, // United States
+	"PR": true, // Puerto Rico
+	"GU": true, // Guam
+	"VI": true, // US Virgin Islands
+	"AS": true, // American Samoa
+	"MP": true, // Northern Mariana Islands
+	"UM": true, // US Minor Outlying Islands
+	"PH": true, // Philippines
+	"FM": true, // Micronesia
+	"MH": true, // Marshall Islands
+	"PW": true, // Palau
+	"BZ": true, // Belize
+}
+
+// maxReceiptAge is how far back a date interpretation may lie and still be
+// considered plausible for a freshly uploaded receipt
+const maxReceiptAge = 365 * 24 * time.Hour
+
+// numericDatePattern matches a day/month/year date with both leading parts
+// numeric, e.g. 03/04/2024, 3.4.24 or 03-04-2024
+var numericDatePattern = regexp.MustCompile(`^(\d{1,2})[/.\-](\d{1,2})[/.\-](\d{2}|\d{4})$`)
+
+// DateResolution explains how an ambiguous printed date was interpreted
+type DateResolution struct {
+	Raw       string `json:"raw"`
+	Order     string `json:"order"`
+	Country   string `json:"country,omitempty"`
+	Source    string `json:"source"`
+	Ambiguous bool   `json:"ambiguous"`
+	// Alternative is the other reading of the date when both are plausible
+	Alternative string `json:"alternative,omitempty"`
+}
+
+// defaultCountry is the user's locale country used when the merchant
+// country cannot be determined (DEFAULT_COUNTRY, e.g. "GB")
+func defaultCountry() string {
+	return strings.ToUpper(strings.TrimSpace(os.Getenv("DEFAULT_COUNTRY")))
+}
+
+// dateOrderForCountry returns "MDY" or "DMY" for an ISO 3166-1 alpha-2 code
+func dateOrderForCountry(country string) string {
+	if monthFirstCountries[strings.ToUpper(country)] {
+		return "MDY"
+	}
+	return "DMY"
+}
+
+// resolveReceiptDate re-reads the printed date when day and month could be
+// swapped. The order is taken from the merchant country, falling back to the
+// user's home country; Gemini's own reading is kept when neither is known. The
+// date is flagged ambiguous when both readings are plausible receipt dates
+// and the merchant country was not available to settle it.
+func resolveReceiptDate(data *GeminiParsedData, homeCountry string, now time.Time) *DateResolution {
+	m := numericDatePattern.FindStringSubmatch(strings.TrimSpace(data.DateRaw))
+	if m == nil {
+		return nil
+	}
+
+	first, _ := strconv.Atoi(m[1])
+	second, _ := strconv.Atoi(m[2])
+	year, _ := strconv.Atoi(m[3])
+	if len(m[3]) == 2 {
+		year += 2000
+	}
+	if first == second || first > 12 || second > 12 {
+		// Only one reading is a valid date, Gemini gets those right
+		return nil
+	}
+
+	res := &DateResolution{Raw: data.DateRaw}
+	switch {
+	case data.MerchantCountry != "":
+		res.Country, res.Source = strings.ToUpper(data.MerchantCountry), "merchant_country"
+	case homeCountry != "":
+		res.Country, res.Source = homeCountry, "default_country"
+	default:
+		res.Source = "gemini"
+	}
+
+	dmy := time.Date(year, time.Month(second), first, 0, 0, 0, 0, time.UTC)
+	mdy := time.Date(year, time.Month(first), second, 0, 0, 0, 0, time.UTC)
+
+	chosen, other := dmy, mdy
+	if res.Source == "gemini" {
+		// Keep Gemini's reading and only judge whether it is ambiguous
+		res.Order = "DMY"
+		if data.Date == mdy.Format("2006-01-02") {
+			chosen, other = mdy, dmy
+			res.Order = "MDY"
+		}
+	} else {
+		res.Order = dateOrderForCountry(res.Country)
+		if res.Order == "MDY" {
+			chosen, other = mdy, dmy
+		}
+	}
+	data.Date = chosen.Format("2006-01-02")
+
+	if res.Source != "merchant_country" && plausibleReceiptDate(chosen, now) && plausibleReceiptDate(other, now) {
+		res.Ambiguous = true
+		res.Alternative = other.Format("2006-01-02")
+		data.DateAmbiguous = true
+	}
+	return res
+}
+
+// plausibleReceiptDate reports whether a date could be the purchase date of
+// a receipt uploaded at now
+func plausibleReceiptDate(t time.Time, now time.Time) bool {
+	return !t.After(now.AddDate(0, 0, 1)) && now.Sub(t) <= maxReceiptAge
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers worth retrying: the statement or transaction was
+// aborted but will most likely succeed when run again
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// mysqlErrDuplicateKey is the MySQL error number of a unique key violation
+const mysqlErrDuplicateKey = 1062
+
+// isDuplicateKeyError reports whether err is a unique key violation
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateKey
+}
+
+// transientDBErrorTexts match transient errors that reach callers only as
+// text, since most of this codebase wraps errors with %v
+var transientDBErrorTexts = []string{
+	"Deadlock found",
+	"Lock wait timeout exceeded",
+}
+
+// isTransientDBError reports whether err is a deadlock or lock wait
+// timeout. MySQL rolled the statement back in both cases, so running it
+// again cannot apply it twice. A dropped connection is not retried: the
+// server may have run an INSERT before the connection went away.
+func isTransientDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+	}
+	msg := err.Error()
+	for _, text := range transientDBErrorTexts {
+		if strings.Contains(msg, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// dbRetryAttempts is how often an operation is tried in total when it keeps
+// failing with transient errors (DB_RETRY_ATTEMPTS, default 3)
+func dbRetryAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("DB_RETRY_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return 3
+}
+
+// withDBRetry runs fn, running it again with exponential backoff while it
+// fails with a transient error. fn must be safe to repeat, which holds for
+// a single statement or a whole transaction that was rolled back.
+func withDBRetry(op string, fn func() error) error {
+	attempts := dbRetryAttempts()
+	delay := 100 * time.Millisecond
+	var err error
+	for i := 1; ; i++ {
+		if err = faults.db(); err == nil {
+			err = fn()
+		}
+		if err == nil || !isTransientDBError(err) || i == attempts {
+			return err
+		}
+		log.Printf("Database: %s failed (%v), retrying in %v", op, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// execWithRetry runs a single statement with withDBRetry
+func execWithRetry(query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := withDBRetry("statement", func() error {
+		var err error
+		result, err = db.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// inTx runs fn in a transaction and commits it, retrying the whole
+// transaction when it fails with a transient error
+func inTx(op string, fn func(tx *sql.Tx) error) error {
+	return withDBRetry(op, func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// imageHashMaxDistance is how many of the 64 bits of two image hashes may
+// differ for the photos to count as the same picture, e.g. after a
+// messenger recompressed or resized it
+const imageHashMaxDistance = 6
+
+// imageHashWindowDays limits the image hash comparison to receipts
+// uploaded this many days before
+const imageHashWindowDays = 90
+
+// Why a receipt was linked to an existing transaction
+const (
+	duplicateReference   = "reference_number"
+	duplicateFingerprint = "fingerprint"
+	duplicateImage       = "image"
+	// duplicateDismissed marks a receipt unlinked by hand; it is never
+	// linked again
+	duplicateDismissed = "dismissed"
+)
+
+// imageHash computes the difference hash of a photo: the photo is shrunk
+// to 9x8 gray cells and each bit says whether a cell is brighter than its
+// right neighbour. Hashes of the same picture stay close after resizing,
+// recompression and small crops.
+func imageHash(path string) (uint64, error) {
+	src, err := decodeImageFile(path)
+	if err != nil {
+		return 0, err
+	}
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 9 || height < 8 {
+		return 0, fmt.Errorf("image is too small to hash")
+	}
+
+	// Average a grid of samples per cell; large photos are not read pixel
+	// by pixel
+	const samples = 16
+	var cells [8][9]float64
+	for cy := 0; cy < 8; cy++ {
+		for cx := 0; cx < 9; cx++ {
+			x0, x1 := cx*width/9, (cx+1)*width/9
+			y0, y1 := cy*height/8, (cy+1)*height/8
+			var sum float64
+			n := 0
+			for sy := 0; sy < samples; sy++ {
+				y := y0 + (y1-y0)*sy/samples
+				for sx := 0; sx < samples; sx++ {
+					x := x0 + (x1-x0)*sx/samples
+					sum += float64(color.GrayModel.Convert(src.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+					n++
+				}
+			}
+			cells[cy][cx] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for cy := 0; cy < 8; cy++ {
+		for cx := 0; cx < 8; cx++ {
+			hash <<= 1
+			if cells[cy][cx] > cells[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// saveImageHash stores the image hash of a receipt photo
+func saveImageHash(receiptID int64, hash uint64) error {
+	if _, err := execWithRetry("UPDATE receipts SET image_hash = ? WHERE id = ?", hash, receiptID); err != nil {
+		return fmt.Errorf("failed to save image hash of receipt %d: %v", receiptID, err)
+	}
+	return nil
+}
+
+// transactionFingerprint identifies a purchase by merchant, date, amount and
+// currency, whichever channel its receipt came through. It is empty when
+// one of them is missing.
+func transactionFingerprint(data *GeminiParsedData) string {
+	merchant := data.MerchantClean
+	if merchant == "" {
+		merchant = data.MerchantRaw
+	}
+	// Letters and digits only, so "ACME Market #12" matches "Acme Market 12"
+	merchant = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, merchant)
+	if merchant == "" || data.Date == "" || data.Amount <= 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%.2f|%s", merchant, data.Date, data.Amount, strings.ToUpper(data.Currency))))
+	return hex.EncodeToString(sum[:])
+}
+
+// findCrossChannelDuplicate looks for the transaction of a receipt that
+// already arrived through another channel, e.g. the emailed copy of a
+// photographed receipt. A transaction matches when its fingerprint is the
+// same and its receipt came through a different channel, or when its photo
+// is nearly identical and the date and amount agree. It returns 0 when
+// there is none.
+func findCrossChannelDuplicate(receiptID int64, hash *uint64, data *GeminiParsedData) (int64, string, error) {
+	var channel string
+	if err := db.QueryRow("SELECT channel FROM receipts WHERE id = ?", receiptID).Scan(&channel); err != nil {
+		return 0, "", fmt.Errorf("failed to load receipt %d: %v", receiptID, err)
+	}
+
+	if fingerprint := transactionFingerprint(data); fingerprint != "" {
+		var id int64
+		err := db.QueryRow(
+			`SELECT t.id FROM transactions t JOIN receipts r ON r.id = t.receipt_id
+			WHERE t.fingerprint = ? AND t.receipt_id <> ? AND r.channel <> ?
+			ORDER BY t.id LIMIT 1`,
+			fingerprint, receiptID, channel,
+		).Scan(&id)
+		if err == nil {
+			return id, duplicateFingerprint, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, "", fmt.Errorf("failed to check for duplicate transaction: %v", err)
+		}
+	}
+
+	if hash == nil || data.Date == "" || data.Amount <= 0 {
+		return 0, "", nil
+	}
+	var id int64
+	err := db.QueryRow(
+		`SELECT t.id FROM receipts r JOIN transactions t ON t.receipt_id = r.id
+		WHERE r.image_hash IS NOT NULL AND r.id <> ? AND r.uploaded_at >= ?
+			AND BIT_COUNT(r.image_hash ^ ?) <= ? AND t.date = ? AND ABS(t.amount - ?) < 0.005
+		ORDER BY BIT_COUNT(r.image_hash ^ ?), t.id LIMIT 1`,
+		receiptID, time.Now().AddDate(0, 0, -imageHashWindowDays), *hash, imageHashMaxDistance,
+		data.Date, data.Amount, *hash,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to check for duplicate photo: %v", err)
+	}
+	return id, duplicateImage, nil
+}
+
+// duplicateDismissedFor reports whether a receipt was unlinked by hand
+func duplicateDismissedFor(receiptID int64) (bool, error) {
+	var reason sql.NullString
+	if err := db.QueryRow("SELECT duplicate_reason FROM receipts WHERE id = ?", receiptID).Scan(&reason); err != nil {
+		return false, fmt.Errorf("failed to load receipt %d: %v", receiptID, err)
+	}
+	return reason.String == duplicateDismissed, nil
+}
+
+// linkDuplicateReceipt marks a receipt as another copy of an existing
+// transaction's receipt, so its purchase is not counted twice
+func linkDuplicateReceipt(receiptID, transactionID int64, reason string) error {
+	_, err := execWithRetry(
+		"UPDATE receipts SET status = 'duplicate', duplicate_of = ?, duplicate_reason = ? WHERE id = ?",
+		transactionID, reason, receiptID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to link receipt %d to transaction %d: %v", receiptID, transactionID, err)
+	}
+	return nil
+}
+
+// LinkedReceipt is a receipt of a transaction
+type LinkedReceipt struct {
+	ID         int64  `json:"id"`
+	FileName   string `json:"file_name"`
+	Channel    string `json:"channel"`
+	UploadedAt string `json:"uploaded_at"`
+	// DuplicateReason is empty for the receipt the transaction was read
+	// from
+	DuplicateReason string `json:"duplicate_reason,omitempty"`
+}
+
+// registerDedupRoutes adds the receipts linked to a transaction and undoing
+// a link
+func registerDedupRoutes(app *fiber.App) {
+	// The receipt a transaction was read from and the copies linked to it
+	app.Get("/transactions/:id/receipts", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+		rows, err := db.Query(
+			`SELECT r.id, r.file_name, r.channel, r.uploaded_at, IF(r.status = 'duplicate', COALESCE(r.duplicate_reason, ''), '')
+			FROM receipts r
+			WHERE r.id = (SELECT receipt_id FROM transactions WHERE id = ?)
+				OR (r.duplicate_of = ? AND r.status = 'duplicate')
+			ORDER BY r.uploaded_at, r.id`,
+			id, id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipts: %v", err),
+			})
+		}
+		defer rows.Close()
+		receipts := []LinkedReceipt{}
+		for rows.Next() {
+			var r LinkedReceipt
+			var uploadedAt time.Time
+			if err := rows.Scan(&r.ID, &r.FileName, &r.Channel, &uploadedAt, &r.DuplicateReason); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read receipts: %v", err),
+				})
+			}
+			r.UploadedAt = uploadedAt.Format(time.RFC3339)
+			receipts = append(receipts, r)
+		}
+		if len(receipts) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Transaction not found",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"receipts": receipts,
+		})
+	})
+
+	// Undo a wrong link: the receipt goes back to needs_review and is never
+	// linked again, so analyzing it stores its own transaction
+	app.Delete("/receipts/:id/duplicate", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		res, err := execWithRetry(
+			`UPDATE receipts SET status = 'needs_review', duplicate_of = NULL, duplicate_reason = ?
+			WHERE id = ? AND status = 'duplicate'`,
+			duplicateDismissed, id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to unlink receipt: %v", err),
+			})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt is not linked as a duplicate",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"receipt_id":  id,
+			"status":      "needs_review",
+			"analyze_url": fmt.Sprintf("/receipts/analyze/%d", id),
+		})
+	})
+}
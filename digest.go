@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Lengths of a digest period
+const (
+	digestDaily   = "daily"
+	digestWeekly  = "weekly"
+	digestMonthly = "monthly"
+)
+
+// Sizes of the lists in a digest
+const (
+	digestTopMerchants   = 5
+	digestTopCategories  = 10
+	digestPendingReceipt = 10
+)
+
+// digestPeriodName reads DIGEST_PERIOD (daily, weekly or monthly, default
+// weekly). It returns "" when it is "off".
+func digestPeriodName() (string, error) {
+	switch v := os.Getenv("DIGEST_PERIOD"); v {
+	case "":
+		return digestWeekly, nil
+	case "off":
+		return "", nil
+	case digestDaily, digestWeekly, digestMonthly:
+		return v, nil
+	default:
+		return "", fmt.Errorf("DIGEST_PERIOD must be daily, weekly, monthly or off")
+	}
+}
+
+// lastDigestPeriod returns the first and last day of the latest complete
+// period before now. Weeks start on Monday.
+func lastDigestPeriod(period string, now time.Time) (time.Time, time.Time) {
+	today := startOfDay(now)
+	switch period {
+	case digestDaily:
+		from := today.AddDate(0, 0, -1)
+		return from, from
+	case digestMonthly:
+		from := monthStart(today).AddDate(0, -1, 0)
+		return from, from.AddDate(0, 1, -1)
+	}
+	weekday := (int(today.Weekday()) + 6) % 7
+	from := today.AddDate(0, 0, -weekday-7)
+	return from, from.AddDate(0, 0, 6)
+}
+
+// DigestTotals sums the transactions of a period in the home currency
+type DigestTotals struct {
+	Spend         float64  `json:"spend"`
+	Transactions  int      `json:"transactions"`
+	AvgConfidence *float64 `json:"average_confidence"`
+	Unconverted   int      `json:"unconverted"`
+	// PreviousSpend is the spend of the period before, for comparison;
+	// ChangePct is nil when it was zero
+	PreviousSpend float64  `json:"previous_spend"`
+	ChangePct     *float64 `json:"change_pct"`
+}
+
+// DigestReview is the review backlog when the digest was built
+type DigestReview struct {
+	NeedsReview     int             `json:"needs_review"`
+	PendingApproval int             `json:"pending_approval"`
+	Oldest          *string         `json:"oldest_uploaded_at"`
+	Receipts        []DigestReceipt `json:"receipts"`
+}
+
+// DigestReceipt is a receipt waiting for review
+type DigestReceipt struct {
+	ID         int64  `json:"id"`
+	FileName   string `json:"file_name"`
+	UploadedAt string `json:"uploaded_at"`
+	FileURL    string `json:"file_url"`
+}
+
+// Digest is the pre-aggregated summary of a period sent as the
+// receipts.digest event, so digest workflows need no further API calls
+type Digest struct {
+	Period   string `json:"period"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Currency string `json:"currency"`
+	// Totals and the top lists count transactions by their date
+	Totals       DigestTotals `json:"totals"`
+	Categories   []SpendGroup `json:"categories"`
+	TopMerchants []SpendGroup `json:"top_merchants"`
+	// Receipts counts the receipts uploaded in the period by their status
+	Receipts       map[string]int `json:"receipts"`
+	ReceiptsTotal  int            `json:"receipts_total"`
+	PendingReviews DigestReview   `json:"pending_reviews"`
+}
+
+// buildDigest aggregates the period from..to (both inclusive)
+func buildDigest(period string, from, to time.Time) (*Digest, error) {
+	d := &Digest{
+		Period:   period,
+		From:     from.Format("2006-01-02"),
+		To:       to.Format("2006-01-02"),
+		Currency: homeCurrency(),
+		Receipts: map[string]int{},
+	}
+
+	const where = "date >= ? AND date <= ?"
+	summary, err := loadSpendingSummary("transactions", where, []any{d.From, d.To}, digestTopMerchants)
+	if err != nil {
+		return nil, err
+	}
+	d.Totals = DigestTotals{
+		Spend:         summary.Total.Spend,
+		Transactions:  summary.Total.Transactions,
+		AvgConfidence: summary.Total.AvgConfidence,
+		Unconverted:   summary.Total.Unconverted,
+	}
+	d.Categories = summary.Categories
+	if len(d.Categories) > digestTopCategories {
+		d.Categories = d.Categories[:digestTopCategories]
+	}
+	d.TopMerchants = summary.Merchants
+
+	// The period before has the same length
+	days := int(to.Sub(from).Hours()/24) + 1
+	prevFrom, prevTo := from.AddDate(0, 0, -days), from.AddDate(0, 0, -1)
+	if period == digestMonthly {
+		prevFrom, prevTo = from.AddDate(0, -1, 0), from.AddDate(0, 0, -1)
+	}
+	previous, err := summaryGroup("transactions", "'total'", where,
+		[]any{prevFrom.Format("2006-01-02"), prevTo.Format("2006-01-02")}, "k", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum the previous period: %v", err)
+	}
+	if len(previous) > 0 {
+		d.Totals.PreviousSpend = previous[0].Spend
+	}
+	if d.Totals.PreviousSpend > 0 {
+		change := math.Round((d.Totals.Spend-d.Totals.PreviousSpend)/d.Totals.PreviousSpend*1000) / 10
+		d.Totals.ChangePct = &change
+	}
+
+	rows, err := db.Query(
+		"SELECT status, COUNT(*) FROM receipts WHERE uploaded_at >= ? AND uploaded_at < ? GROUP BY status",
+		from, to.AddDate(0, 0, 1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count receipts: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, fmt.Errorf("failed to count receipts: %v", err)
+		}
+		d.Receipts[status] = n
+		d.ReceiptsTotal += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count receipts: %v", err)
+	}
+
+	if d.PendingReviews, err = loadDigestReview(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadDigestReview counts the receipts waiting for review or approval and
+// lists the oldest ones waiting for review
+func loadDigestReview() (DigestReview, error) {
+	r := DigestReview{Receipts: []DigestReceipt{}}
+	var oldest sql.NullTime
+	if err := db.QueryRow(
+		`SELECT COALESCE(SUM(status = 'needs_review'), 0), COALESCE(SUM(status = 'pending_approval'), 0),
+			MIN(IF(status = 'needs_review', uploaded_at, NULL))
+		FROM receipts WHERE status IN ('needs_review', 'pending_approval') AND deleted_at IS NULL`,
+	).Scan(&r.NeedsReview, &r.PendingApproval, &oldest); err != nil {
+		return r, fmt.Errorf("failed to count receipts waiting for review: %v", err)
+	}
+	if oldest.Valid {
+		s := oldest.Time.Format(time.RFC3339)
+		r.Oldest = &s
+	}
+
+	rows, err := db.Query(
+		"SELECT id, file_name, uploaded_at FROM receipts WHERE status = 'needs_review' AND deleted_at IS NULL ORDER BY uploaded_at, id LIMIT ?",
+		digestPendingReceipt,
+	)
+	if err != nil {
+		return r, fmt.Errorf("failed to load receipts waiting for review: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec DigestReceipt
+		var uploadedAt time.Time
+		if err := rows.Scan(&rec.ID, &rec.FileName, &uploadedAt); err != nil {
+			return r, fmt.Errorf("failed to read receipts waiting for review: %v", err)
+		}
+		rec.UploadedAt = uploadedAt.Format(time.RFC3339)
+		rec.FileURL = receiptFileURL(rec.ID)
+		r.Receipts = append(r.Receipts, rec)
+	}
+	return r, rows.Err()
+}
+
+// sendDigest builds the digest of a period, sends it as a receipts.digest
+// event and records it as sent
+func sendDigest(period string, from, to time.Time) (*Digest, error) {
+	d, err := buildDigest(period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := sendWebhook(eventDigest, d); err != nil {
+		return nil, err
+	}
+	if _, err := execWithRetry(
+		`INSERT INTO digest_runs (period, period_start, sent_at) VALUES (?, ?, NOW())
+		ON DUPLICATE KEY UPDATE sent_at = VALUES(sent_at)`,
+		period, from,
+	); err != nil {
+		return d, fmt.Errorf("failed to record digest: %v", err)
+	}
+	return d, nil
+}
+
+// sendDueDigest sends the digest of the latest complete period unless it
+// was sent already
+func sendDueDigest(period string, now time.Time) (bool, error) {
+	from, to := lastDigestPeriod(period, now)
+	var n int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM digest_runs WHERE period = ? AND period_start = ?", period, from,
+	).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to check digest runs: %v", err)
+	}
+	if n > 0 {
+		return false, nil
+	}
+	if _, err := sendDigest(period, from, to); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// startDigestScheduler checks every hour whether a period ended and sends
+// its digest
+func startDigestScheduler() {
+	period, err := digestPeriodName()
+	if err != nil {
+		log.Printf("Digest: %v, digest disabled", err)
+		return
+	}
+	if period == "" {
+		return
+	}
+
+	log.Printf("Digest: a %s digest is sent as %s", period, eventDigest)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if sent, err := sendDueDigest(period, time.Now()); err != nil {
+				log.Printf("Digest: %v", err)
+			} else if sent {
+				log.Printf("Digest: sent the %s digest", period)
+			}
+		}
+	}()
+}
+
+// digestPeriodFromQuery reads the period query parameter, defaulting to
+// DIGEST_PERIOD
+func digestPeriodFromQuery(c *fiber.Ctx) (string, error) {
+	period := c.Query("period")
+	if period == "" {
+		configured, err := digestPeriodName()
+		if err != nil {
+			return "", err
+		}
+		if configured == "" {
+			configured = digestWeekly
+		}
+		return configured, nil
+	}
+	if period != digestDaily && period != digestWeekly && period != digestMonthly {
+		return "", fmt.Errorf("period must be daily, weekly or monthly")
+	}
+	return period, nil
+}
+
+// registerDigestRoutes adds a preview of the digest and sending it by hand
+func registerDigestRoutes(app *fiber.App) {
+	// The digest of the latest complete period, as the event would carry it
+	app.Get("/digest", func(c *fiber.Ctx) error {
+		period, err := digestPeriodFromQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		from, to := lastDigestPeriod(period, time.Now())
+		d, err := buildDigest(period, from, to)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"digest":  d,
+		})
+	})
+
+	// Sends the digest of the latest complete period now, even if it was
+	// sent already
+	app.Post("/admin/digest/send", func(c *fiber.Ctx) error {
+		period, err := digestPeriodFromQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		from, to := lastDigestPeriod(period, time.Now())
+		d, err := sendDigest(period, from, to)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"digest":  d,
+		})
+	})
+}
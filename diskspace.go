@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// diskArchiveBatch is how many receipt files one archival run moves off the
+// uploads volume
+const diskArchiveBatch = 500
+
+// DiskSpaceMonitor tracks free space on the uploads volume and refuses new
+// uploads while it is below the configured minimum
+type DiskSpaceMonitor struct {
+	mu        sync.Mutex
+	minFree   uint64
+	free      uint64
+	low       bool
+	checkedAt time.Time
+	archiving bool
+}
+
+var diskSpace = &DiskSpaceMonitor{minFree: diskMinFreeBytes()}
+
+// diskMinFreeBytes is the free space below which uploads are rejected
+// (DISK_MIN_FREE_MB, default 500, 0 disables)
+func diskMinFreeBytes() uint64 {
+	mb := 500
+	if v := os.Getenv("DISK_MIN_FREE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Disk: invalid DISK_MIN_FREE_MB %q, using %d", v, mb)
+		} else {
+			mb = n
+		}
+	}
+	return uint64(mb) << 20
+}
+
+// DiskSpaceStatus is a snapshot of the uploads volume
+type DiskSpaceStatus struct {
+	FreeBytes    uint64 `json:"free_bytes"`
+	MinFreeBytes uint64 `json:"min_free_bytes"`
+	Low          bool   `json:"low"`
+	Archiving    bool   `json:"archiving"`
+	CheckedAt    string `json:"checked_at,omitempty"`
+}
+
+// Check measures free space and handles the low state. The alert is sent
+// only when space first drops below the minimum; archival is started on
+// every check while it stays there, so space is freed again after a run
+// that did not move enough.
+func (m *DiskSpaceMonitor) Check() error {
+	if m.minFree == 0 {
+		return nil
+	}
+	free, low, wasLow, err := m.measure()
+	if err != nil {
+		return err
+	}
+	if !low {
+		return nil
+	}
+	if !wasLow {
+		log.Printf("Disk: %s free on the uploads volume, below the %s minimum; rejecting uploads",
+			formatBytes(free), formatBytes(m.minFree))
+		m.alert(free)
+	}
+	m.startArchival()
+	return nil
+}
+
+// measure records the free space on the uploads volume and whether it was
+// low before, logging when uploads are accepted again
+func (m *DiskSpaceMonitor) measure() (free uint64, low, wasLow bool, err error) {
+	free, err = diskFreeBytes(uploadsDir)
+	if err != nil {
+		return 0, false, false, fmt.Errorf("failed to read free space of %s: %v", uploadsDir, err)
+	}
+
+	m.mu.Lock()
+	wasLow = m.low
+	m.free, m.low, m.checkedAt = free, free < m.minFree, time.Now()
+	low = m.low
+	m.mu.Unlock()
+
+	if !low && wasLow {
+		log.Printf("Disk: %s free on the uploads volume, accepting uploads again", formatBytes(free))
+	}
+	return free, low, wasLow, nil
+}
+
+// Guard returns an error when there is not enough space for a new upload
+func (m *DiskSpaceMonitor) Guard() error {
+	if err := m.Check(); err != nil {
+		// Don't block uploads because the measurement itself failed
+		log.Printf("Disk: %v", err)
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.low {
+		return fmt.Errorf("insufficient storage: %s free on the uploads volume, at least %s required",
+			formatBytes(m.free), formatBytes(m.minFree))
+	}
+	return nil
+}
+
+// Status returns the last measurement
+func (m *DiskSpaceMonitor) Status() DiskSpaceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := DiskSpaceStatus{
+		FreeBytes:    m.free,
+		MinFreeBytes: m.minFree,
+		Low:          m.low,
+		Archiving:    m.archiving,
+	}
+	if !m.checkedAt.IsZero() {
+		s.CheckedAt = m.checkedAt.Format(time.RFC3339)
+	}
+	return s
+}
+
+// alert notifies admins that uploads are being rejected
+func (m *DiskSpaceMonitor) alert(free uint64) {
+	data := fiber.Map{
+		"free_bytes":     free,
+		"min_free_bytes": m.minFree,
+		"path":           uploadsDir,
+	}
+	if err := sendWebhook(eventDiskSpaceLow, data); err != nil {
+		log.Printf("Disk: %v", err)
+	}
+	subject := "Receipt uploads paused: disk space low"
+	body := fmt.Sprintf("Only %s is free on the uploads volume (%s), below the configured minimum of %s.\n"+
+		"New receipts are rejected until space is freed.\n", formatBytes(free), uploadsDir, formatBytes(m.minFree))
+	if os.Getenv("DISK_ARCHIVE_BACKEND") != "" {
+		body += fmt.Sprintf("Older receipt files are being archived to the %s backend.\n", os.Getenv("DISK_ARCHIVE_BACKEND"))
+	}
+	if err := sendEmail(subject, body); err != nil {
+		log.Printf("Disk: %v", err)
+	}
+}
+
+// startArchival moves the oldest local receipt files to DISK_ARCHIVE_BACKEND
+// in the background, unless that is unset or a run is already going
+func (m *DiskSpaceMonitor) startArchival() {
+	backend := os.Getenv("DISK_ARCHIVE_BACKEND")
+	if backend == "" {
+		return
+	}
+	m.mu.Lock()
+	if m.archiving {
+		m.mu.Unlock()
+		return
+	}
+	m.archiving = true
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			m.archiving = false
+			m.mu.Unlock()
+			// Only measure: the next check starts another run if space
+			// is still low, instead of looping here
+			if _, _, _, err := m.measure(); err != nil {
+				log.Printf("Disk: %v", err)
+			}
+		}()
+		n, err := archiveLocalReceipts(backend, diskArchiveBatch)
+		if err != nil {
+			log.Printf("Disk: archival failed: %v", err)
+		}
+		log.Printf("Disk: archived %d receipt file(s) to %s", n, backend)
+	}()
+}
+
+// checkDiskArchiveBackend fails when DISK_ARCHIVE_BACKEND is set to a
+// storage backend that is unknown, misconfigured or local storage itself
+func checkDiskArchiveBackend() error {
+	backend := os.Getenv("DISK_ARCHIVE_BACKEND")
+	if backend == "" {
+		return nil
+	}
+	dst, err := newStorage(backend)
+	if err != nil {
+		return err
+	}
+	src, err := newStorage("local")
+	if err != nil {
+		return err
+	}
+	if src.Name() == dst.Name() {
+		return fmt.Errorf("archive backend must not be local storage")
+	}
+	return nil
+}
+
+// archiveLocalReceipts moves up to limit of the oldest receipt files from
+// local storage to another backend, verifying each copy before the local
+// file is deleted
+func archiveLocalReceipts(backend string, limit int) (int, error) {
+	src, err := newStorage("local")
+	if err != nil {
+		return 0, err
+	}
+	dst, err := newStorage(backend)
+	if err != nil {
+		return 0, err
+	}
+	if src.Name() == dst.Name() {
+		return 0, fmt.Errorf("archive backend must not be local storage")
+	}
+
+	rows, err := db.Query(
+		"SELECT id, file_name, checksum FROM receipts WHERE storage_backend = ? ORDER BY uploaded_at LIMIT ?",
+		src.Name(), limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query receipts: %v", err)
+	}
+	type localReceipt struct {
+		id       int64
+		fileName string
+		checksum sql.NullString
+	}
+	var receipts []localReceipt
+	for rows.Next() {
+		var r localReceipt
+		if err := rows.Scan(&r.id, &r.fileName, &r.checksum); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		receipts = append(receipts, r)
+	}
+	rows.Close()
+
+	archived := 0
+	for _, r := range receipts {
+		checksum, err := migrateReceiptFile(src, dst, r.fileName, r.checksum.String)
+		if err != nil {
+			log.Printf("Disk: receipt %d: %v", r.id, err)
+			continue
+		}
+		if _, err := db.Exec(
+			"UPDATE receipts SET storage_backend = ?, checksum = ? WHERE id = ?",
+			dst.Name(), checksum, r.id,
+		); err != nil {
+			return archived, fmt.Errorf("failed to update receipt %d: %v", r.id, err)
+		}
+		if err := src.Delete(r.fileName); err != nil {
+			log.Printf("Disk: receipt %d: failed to delete local file: %v", r.id, err)
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+// formatBytes renders a byte count in MB or GB
+func formatBytes(n uint64) string {
+	if n >= 1<<30 {
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	}
+	return fmt.Sprintf("%.0f MB", float64(n)/(1<<20))
+}
+
+// requireDiskSpace rejects a request with 507 Insufficient Storage while the
+// uploads volume is low on space
+func requireDiskSpace(c *fiber.Ctx) error {
+	if err := diskSpace.Guard(); err != nil {
+		return c.Status(fiber.StatusInsufficientStorage).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Next()
+}
+
+// diskCheckInterval is how often free space is measured in the background
+// (DISK_CHECK_INTERVAL, default 1m, "off" disables)
+func diskCheckInterval() time.Duration {
+	v := os.Getenv("DISK_CHECK_INTERVAL")
+	if v == "" {
+		return time.Minute
+	}
+	if v == "off" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Disk: invalid DISK_CHECK_INTERVAL %q, using 1m", v)
+		return time.Minute
+	}
+	return d
+}
+
+// startDiskSpaceScheduler measures free space periodically so alerts go
+// out even when nothing is being uploaded
+func startDiskSpaceScheduler() {
+	interval := diskCheckInterval()
+	if diskSpace.minFree == 0 || interval == 0 {
+		return
+	}
+	if err := diskSpace.Check(); err != nil {
+		log.Printf("Disk: %v, disk space monitoring disabled", err)
+		return
+	}
+
+	log.Printf("Disk: uploads are rejected below %s free", formatBytes(diskSpace.minFree))
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := diskSpace.Check(); err != nil {
+				log.Printf("Disk: %v", err)
+			}
+		}
+	}()
+}
+
+// registerDiskSpaceRoutes adds the disk space status and a manual archival
+// trigger
+func registerDiskSpaceRoutes(app *fiber.App) {
+	app.Get("/admin/disk", func(c *fiber.Ctx) error {
+		if err := diskSpace.Check(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"disk":    diskSpace.Status(),
+		})
+	})
+
+	// Move the oldest local receipt files to DISK_ARCHIVE_BACKEND now
+	app.Post("/admin/disk/archive", func(c *fiber.Ctx) error {
+		backend := os.Getenv("DISK_ARCHIVE_BACKEND")
+		if backend == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "DISK_ARCHIVE_BACKEND is not configured",
+			})
+		}
+		if _, err := newStorage(backend); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		diskSpace.startArchival()
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"success": true,
+			"backend": backend,
+		})
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// diskFreeBytes is not implemented outside unix; disk space monitoring is
+// disabled there
+func diskFreeBytes(path string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space is not available on this platform")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Donation is one gift in the donations report. Amounts are in the home
+// currency.
+type Donation struct {
+	TransactionID      int64   `json:"transaction_id"`
+	ReceiptID          int64   `json:"receipt_id"`
+	Date               string  `json:"date"`
+	Amount             float64 `json:"amount"`
+	Cash               float64 `json:"cash"`
+	InKind             float64 `json:"in_kind"`
+	GoodsServicesValue float64 `json:"goods_services_value"`
+	Deductible         float64 `json:"deductible"`
+	InKindItems        []any   `json:"in_kind_items,omitempty"`
+	AcknowledgmentDate string  `json:"acknowledgment_date,omitempty"`
+	ReferenceNumber    string  `json:"reference_number,omitempty"`
+}
+
+// DonationOrganization groups a year's donations to one organization
+type DonationOrganization struct {
+	Name        string     `json:"name"`
+	TaxExemptID string     `json:"tax_exempt_id"`
+	Donations   []Donation `json:"donations"`
+	Total       float64    `json:"total"`
+	Deductible  float64    `json:"deductible"`
+	// MissingAcknowledgment is set when no donation carries the
+	// organization's tax-exempt ID, which many tax authorities require
+	MissingAcknowledgment bool `json:"missing_acknowledgment"`
+}
+
+// donationFields are the donation profile fields stored in extra_fields
+type donationFields struct {
+	OrganizationName   string  `json:"organization_name"`
+	TaxExemptID        string  `json:"tax_exempt_id"`
+	DonationAmount     float64 `json:"donation_amount"`
+	GoodsServicesValue float64 `json:"goods_services_value"`
+	AcknowledgmentDate string  `json:"acknowledgment_date"`
+	InKind             []any   `json:"in_kind"`
+}
+
+// inKindValue sums the stated values of donated goods
+func (f donationFields) inKindValue() float64 {
+	total := 0.0
+	for _, item := range f.InKind {
+		if m, ok := item.(map[string]any); ok {
+			if v, ok := m["value"].(float64); ok && v > 0 {
+				total += v
+			}
+		}
+	}
+	return total
+}
+
+// registerDonationRoutes adds the year-end donations report
+func registerDonationRoutes(app *fiber.App) {
+	// Donations of a tax year per organization, from receipts extracted
+	// with the donation profile. Archived transactions are included.
+	app.Get("/reports/donations", func(c *fiber.Ctx) error {
+		year := time.Now().Year()
+		if v := c.Query("year"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1900 || n > 9999 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid year",
+				})
+			}
+			year = n
+		}
+
+		rows, err := db.Query(
+			`SELECT id, receipt_id, date, COALESCE(merchant_clean, merchant_raw, ''), amount, home_amount,
+				COALESCE(reference_number, ''), extra_fields
+			FROM `+transactionsAllView+`
+			WHERE profile = ? AND date >= ? AND date < ?
+			ORDER BY date, id`,
+			"donation", time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC),
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build donations report: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		organizations := []*DonationOrganization{}
+		byName := map[string]*DonationOrganization{}
+		var total, deductible float64
+		unconverted := 0
+		for rows.Next() {
+			var d Donation
+			var date time.Time
+			var merchant string
+			var amount, homeAmount sql.NullFloat64
+			var extra []byte
+			if err := rows.Scan(&d.TransactionID, &d.ReceiptID, &date, &merchant, &amount, &homeAmount,
+				&d.ReferenceNumber, &extra); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read donations report: %v", err),
+				})
+			}
+			if !homeAmount.Valid || !amount.Valid || amount.Float64 <= 0 {
+				unconverted++
+				continue
+			}
+			var fields donationFields
+			if len(extra) > 0 {
+				if err := json.Unmarshal(extra, &fields); err != nil {
+					fields = donationFields{}
+				}
+			}
+
+			// Profile fields are in the receipt currency
+			rate := homeAmount.Float64 / amount.Float64
+			d.Date = date.Format("2006-01-02")
+			d.Amount = roundCents(homeAmount.Float64)
+			d.InKind = roundCents(fields.inKindValue() * rate)
+			d.Cash = roundCents(fields.DonationAmount * rate)
+			if d.Cash == 0 && d.InKind == 0 {
+				d.Cash = d.Amount
+			}
+			d.GoodsServicesValue = roundCents(fields.GoodsServicesValue * rate)
+			d.Deductible = roundCents(d.Amount - d.GoodsServicesValue)
+			if d.Deductible < 0 {
+				d.Deductible = 0
+			}
+			d.InKindItems = fields.InKind
+			d.AcknowledgmentDate = fields.AcknowledgmentDate
+
+			name := fields.OrganizationName
+			if name == "" {
+				name = merchant
+			}
+			org, ok := byName[name]
+			if !ok {
+				org = &DonationOrganization{Name: name, Donations: []Donation{}, MissingAcknowledgment: true}
+				byName[name] = org
+				organizations = append(organizations, org)
+			}
+			if fields.TaxExemptID != "" {
+				org.TaxExemptID = fields.TaxExemptID
+				org.MissingAcknowledgment = false
+			}
+			org.Donations = append(org.Donations, d)
+			org.Total = roundCents(org.Total + d.Amount)
+			org.Deductible = roundCents(org.Deductible + d.Deductible)
+			total = roundCents(total + d.Amount)
+			deductible = roundCents(deductible + d.Deductible)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read donations report: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"year":          year,
+			"currency":      homeCurrency(),
+			"organizations": organizations,
+			"total":         total,
+			"deductible":    deductible,
+			"unconverted":   unconverted,
+		})
+	})
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Google endpoints used for the Drive upload
+const (
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+	driveUploadURL = "https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart&supportsAllDrives=true&fields=id"
+	driveFilesURL  = "https://www.googleapis.com/drive/v3/files/"
+	// The drive.file scope cannot add files to a folder shared with the
+	// account, so the full Drive scope is requested
+	driveScope = "https://www.googleapis.com/auth/drive"
+)
+
+// maxDriveBackfill caps the receipts uploaded by one backfill request
+const maxDriveBackfill = 500
+
+// driveServiceAccount is the part of a service account key file the upload
+// needs
+type driveServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// DriveClient uploads receipt files to a Google Drive folder, authenticated
+// either as a service account or with an OAuth refresh token
+type DriveClient struct {
+	folderID string
+	account  *driveServiceAccount
+	key      *rsa.PrivateKey
+	// OAuth client credentials and refresh token, used without a service
+	// account
+	clientID     string
+	clientSecret string
+	refreshToken string
+	http         *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// driveClient is set on startup when DRIVE_UPLOAD is enabled
+var driveClient *DriveClient
+
+// newDriveClient returns a client for DRIVE_FOLDER_ID, or nil when
+// DRIVE_UPLOAD is not enabled. Credentials come from the service account
+// key in DRIVE_CREDENTIALS_FILE or from DRIVE_CLIENT_ID,
+// DRIVE_CLIENT_SECRET and DRIVE_REFRESH_TOKEN.
+func newDriveClient() (*DriveClient, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("DRIVE_UPLOAD")); !enabled {
+		return nil, nil
+	}
+	if os.Getenv("DRIVE_FOLDER_ID") == "" {
+		return nil, fmt.Errorf("DRIVE_UPLOAD is enabled but DRIVE_FOLDER_ID is not set")
+	}
+	return newDriveFolderClient(os.Getenv("DRIVE_FOLDER_ID"))
+}
+
+// newDriveFolderClient returns a client for a Drive folder with the
+// credentials newDriveClient reads
+func newDriveFolderClient(folderID string) (*DriveClient, error) {
+	d := &DriveClient{
+		folderID: folderID,
+		http:     &http.Client{Timeout: 60 * time.Second},
+	}
+
+	if path := os.Getenv("DRIVE_CREDENTIALS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DRIVE_CREDENTIALS_FILE: %v", err)
+		}
+		var account driveServiceAccount
+		if err := json.Unmarshal(data, &account); err != nil {
+			return nil, fmt.Errorf("invalid DRIVE_CREDENTIALS_FILE: %v", err)
+		}
+		if account.ClientEmail == "" || account.PrivateKey == "" {
+			return nil, fmt.Errorf("DRIVE_CREDENTIALS_FILE is not a service account key")
+		}
+		if account.TokenURI == "" {
+			account.TokenURI = googleTokenURL
+		}
+		key, err := parseRSAPrivateKey(account.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service account key: %v", err)
+		}
+		d.account, d.key = &account, key
+		return d, nil
+	}
+
+	d.clientID = os.Getenv("DRIVE_CLIENT_ID")
+	d.clientSecret = os.Getenv("DRIVE_CLIENT_SECRET")
+	d.refreshToken = os.Getenv("DRIVE_REFRESH_TOKEN")
+	if d.clientID == "" || d.clientSecret == "" || d.refreshToken == "" {
+		return nil, fmt.Errorf("drive needs DRIVE_CREDENTIALS_FILE or DRIVE_CLIENT_ID, DRIVE_CLIENT_SECRET and DRIVE_REFRESH_TOKEN")
+	}
+	return d, nil
+}
+
+// parseRSAPrivateKey decodes a PEM encoded PKCS#8 or PKCS#1 RSA key
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return key, nil
+}
+
+// accessToken returns a cached access token, fetching a new one shortly
+// before the old one expires
+func (d *DriveClient) accessToken() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.token != "" && time.Now().Before(d.expiry.Add(-time.Minute)) {
+		return d.token, nil
+	}
+
+	form := url.Values{}
+	tokenURL := googleTokenURL
+	if d.account != nil {
+		assertion, err := d.signedAssertion()
+		if err != nil {
+			return "", err
+		}
+		tokenURL = d.account.TokenURI
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	} else {
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", d.clientID)
+		form.Set("client_secret", d.clientSecret)
+		form.Set("refresh_token", d.refreshToken)
+	}
+
+	resp, err := d.http.PostForm(tokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("drive token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("drive token request returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("invalid drive token response: %v", err)
+	}
+	d.token = out.AccessToken
+	d.expiry = time.Now().Add(time.Duration(out.ExpiresIn) * time.Second)
+	return d.token, nil
+}
+
+// signedAssertion builds the JWT a service account exchanges for an access
+// token
+func (d *DriveClient) signedAssertion() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   d.account.ClientEmail,
+		"scope": driveScope,
+		"aud":   d.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign drive token request: %v", err)
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// Upload stores a file in the configured folder and returns its Drive file
+// ID
+func (d *DriveClient) Upload(name string, r io.Reader, receiptID int64) (string, error) {
+	return d.upload(name, r, map[string]string{"receipt_id": strconv.FormatInt(receiptID, 10)})
+}
+
+// upload stores a file in the configured folder, tagged with the given app
+// properties, and returns its Drive file ID
+func (d *DriveClient) upload(name string, r io.Reader, properties map[string]string) (string, error) {
+	token, err := d.accessToken()
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := json.Marshal(map[string]any{
+		"name":          name,
+		"parents":       []string{d.folderID},
+		"appProperties": properties,
+	})
+	if err != nil {
+		return "", err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(metadata); err != nil {
+		return "", err
+	}
+	part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return "", fmt.Errorf("failed to read receipt file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", driveUploadURL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "multipart/related; boundary="+mw.Boundary())
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("drive upload failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("drive upload returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.ID == "" {
+		return "", fmt.Errorf("invalid drive upload response: %v", err)
+	}
+	return out.ID, nil
+}
+
+// Trash moves a file to the Drive trash, where it can still be restored
+// until the trash is emptied. A file that no longer exists is not an error.
+func (d *DriveClient) Trash(fileID string) error {
+	token, err := d.accessToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", driveFilesURL+url.PathEscape(fileID)+"?supportsAllDrives=true&fields=id",
+		strings.NewReader(`{"trashed": true}`))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("drive trash failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("drive trash returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// uploadReceiptToDrive uploads a receipt's original file read from r and
+// records the returned Drive file ID
+func uploadReceiptToDrive(receiptID int64, fileName string, r io.Reader) (string, error) {
+	fileID, err := driveClient.Upload(fileName, r, receiptID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := execWithRetry(
+		"UPDATE receipts SET drive_file_id = ? WHERE id = ? AND drive_file_id IS NULL", fileID, receiptID,
+	); err != nil {
+		return "", fmt.Errorf("failed to save drive file ID: %v", err)
+	}
+	return fileID, nil
+}
+
+// uploadIngestedReceipt uploads a receipt the ingest queue just processed
+// from its local copy at path
+func uploadIngestedReceipt(receiptID int64, path string) {
+	var fileName string
+	var fileID sql.NullString
+	if err := db.QueryRow(
+		"SELECT file_name, drive_file_id FROM receipts WHERE id = ?", receiptID,
+	).Scan(&fileName, &fileID); err != nil {
+		log.Printf("Drive: failed to load receipt %d: %v", receiptID, err)
+		return
+	}
+	if fileID.Valid {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Drive: failed to open receipt %d: %v", receiptID, err)
+		return
+	}
+	defer f.Close()
+	if _, err := uploadReceiptToDrive(receiptID, fileName, f); err != nil {
+		log.Printf("Drive: failed to upload receipt %d: %v", receiptID, err)
+	}
+}
+
+// DriveBackfillResult summarizes a backfill of receipts missing on Drive
+type DriveBackfillResult struct {
+	Uploaded int      `json:"uploaded"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors"`
+}
+
+// backfillDrive uploads stored receipts that have no Drive file ID yet,
+// oldest first
+func backfillDrive(limit int) (*DriveBackfillResult, error) {
+	rows, err := db.Query(
+		`SELECT id, file_name, storage_backend FROM receipts
+		WHERE drive_file_id IS NULL AND status NOT IN ('pending', 'processing')
+		ORDER BY id LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipts: %v", err)
+	}
+	type pending struct {
+		id       int64
+		fileName string
+		backend  string
+	}
+	var receipts []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.fileName, &p.backend); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		receipts = append(receipts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load receipts: %v", err)
+	}
+
+	result := &DriveBackfillResult{Errors: []string{}}
+	for _, p := range receipts {
+		err := func() error {
+			store, err := newStorage(p.backend)
+			if err != nil {
+				return err
+			}
+			r, err := store.Open(p.fileName)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = uploadReceiptToDrive(p.id, p.fileName, r)
+			return err
+		}()
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("receipt %d: %v", p.id, err))
+			continue
+		}
+		result.Uploaded++
+	}
+	return result, nil
+}
+
+// registerDriveRoutes adds the Drive backfill
+func registerDriveRoutes(app *fiber.App) {
+	// Uploads receipts stored before DRIVE_UPLOAD was enabled, up to limit
+	// per request (default 100)
+	app.Post("/integrations/drive/upload", func(c *fiber.Ctx) error {
+		if driveClient == nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Drive upload is not enabled (DRIVE_UPLOAD)",
+			})
+		}
+		limit := c.QueryInt("limit", 100)
+		if limit < 1 || limit > maxDriveBackfill {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxDriveBackfill),
+			})
+		}
+
+		result, err := backfillDrive(limit)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"result":  result,
+		})
+	})
+}
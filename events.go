@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// webhookEnvelopeVersion is the version of the WebhookEvent format
+const webhookEnvelopeVersion = 1
+
+// defaultEventRetentionDays is how long events stay listed by GET /events
+const defaultEventRetentionDays = 30
+
+// eventSettleDelaySeconds holds back the newest events from GET /events. Cursors
+// are assigned on insert, so an event logged concurrently may become
+// visible after one with a higher cursor; waiting until both are committed
+// keeps a poller from skipping it.
+const eventSettleDelaySeconds = 2
+
+// EventReceipt is the receipt an event concerns
+type EventReceipt struct {
+	ID         int64  `json:"id"`
+	FileName   string `json:"file_name"`
+	Status     string `json:"status"`
+	UploadedAt string `json:"uploaded_at"`
+}
+
+// EventTransaction is the transaction an event concerns
+type EventTransaction struct {
+	ID       int64    `json:"id"`
+	Date     *string  `json:"date"`
+	Merchant *string  `json:"merchant"`
+	Category *string  `json:"category"`
+	Amount   *float64 `json:"amount"`
+	Currency *string  `json:"currency"`
+}
+
+// receiptFileURL is where the file of a receipt is downloaded, absolute
+// when PUBLIC_URL is set
+func receiptFileURL(receiptID int64) string {
+	return strings.TrimRight(os.Getenv("PUBLIC_URL"), "/") + "/receipts/" + strconv.FormatInt(receiptID, 10) + "/file"
+}
+
+// attachReceipt adds the current state of a receipt and its transaction to
+// an event. Rows that cannot be loaded are left null.
+func (e *WebhookEvent) attachReceipt(receiptID, transactionID int64) {
+	var r EventReceipt
+	var uploadedAt time.Time
+	err := db.QueryRow(
+		"SELECT id, file_name, status, uploaded_at FROM receipts WHERE id = ?", receiptID,
+	).Scan(&r.ID, &r.FileName, &r.Status, &uploadedAt)
+	if err != nil {
+		log.Printf("Webhooks: failed to load receipt %d for %s: %v", receiptID, e.Event, err)
+		return
+	}
+	r.UploadedAt = uploadedAt.Format(time.RFC3339)
+	e.Receipt = &r
+	fileURL := receiptFileURL(receiptID)
+	e.FileURL = &fileURL
+
+	if transactionID == 0 {
+		return
+	}
+	t := EventTransaction{ID: transactionID}
+	var date sql.NullTime
+	var merchant, category, currency sql.NullString
+	var amount sql.NullFloat64
+	err = db.QueryRow(
+		`SELECT date, COALESCE(merchant_clean, merchant_raw), category, amount, currency
+		FROM `+transactionsAllView+` WHERE id = ?`,
+		transactionID,
+	).Scan(&date, &merchant, &category, &amount, &currency)
+	if err != nil {
+		log.Printf("Webhooks: failed to load transaction %d for %s: %v", transactionID, e.Event, err)
+		return
+	}
+	t.Date = formatNullDate(date)
+	t.Merchant = nullStringPtr(merchant)
+	t.Category = nullStringPtr(category)
+	t.Amount = nullFloatPtr(amount)
+	t.Currency = nullStringPtr(currency)
+	e.Transaction = &t
+}
+
+// sendReceiptWebhook sends an event about a receipt with the receipt, its
+// transaction and the file URL in the envelope
+func sendReceiptWebhook(event string, receiptID, transactionID int64, data any) error {
+	e := newWebhookEvent(event, data)
+	e.attachReceipt(receiptID, transactionID)
+	return publishEvent(e)
+}
+
+// logWebhookEvent stores an event for GET /events and sets its cursor
+func logWebhookEvent(e *WebhookEvent) error {
+	envelope, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event %s: %v", e.Event, err)
+	}
+	res, err := execWithRetry(
+		"INSERT INTO webhook_events (event_id, event, envelope) VALUES (?, ?, ?)",
+		e.ID, e.Event, envelope,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to log event %s: %v", e.Event, err)
+	}
+	e.Cursor, err = res.LastInsertId()
+	return err
+}
+
+// eventRetentionDays reads EVENT_RETENTION_DAYS
+func eventRetentionDays() int {
+	if days, err := strconv.Atoi(os.Getenv("EVENT_RETENTION_DAYS")); err == nil && days > 0 {
+		return days
+	}
+	return defaultEventRetentionDays
+}
+
+// startEventPruner deletes logged events older than EVENT_RETENTION_DAYS
+// once a day
+func startEventPruner() {
+	days := eventRetentionDays()
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			res, err := execWithRetry(
+				"DELETE FROM webhook_events WHERE created_at < NOW() - INTERVAL ? DAY", days,
+			)
+			if err != nil {
+				log.Printf("Events: failed to prune: %v", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("Events: pruned %d event(s) older than %d day(s)", n, days)
+			}
+		}
+	}()
+}
+
+// registerEventRoutes adds polling for webhook events
+func registerEventRoutes(app *fiber.App) {
+	// Events after the cursor since, oldest first, in the webhook envelope.
+	// Poll again with next_cursor; without since, polling starts at the
+	// oldest retained event. event limits the result to one event type.
+	app.Get("/events", func(c *fiber.Ctx) error {
+		since, err := strconv.ParseInt(c.Query("since", "0"), 10, 64)
+		if err != nil || since < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "since must be a cursor returned as next_cursor",
+			})
+		}
+		limit := c.QueryInt("limit", defaultReceiptPageSize)
+		if limit < 1 || limit > maxReceiptPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxReceiptPageSize),
+			})
+		}
+
+		cond, args := "id > ? AND created_at <= NOW() - INTERVAL ? SECOND", []any{since, eventSettleDelaySeconds}
+		if event := c.Query("event"); event != "" {
+			if _, err := validateWebhookEvents([]string{event}); err != nil || event == eventAll {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": fmt.Sprintf("unknown event type %q", event),
+				})
+			}
+			cond += " AND event = ?"
+			args = append(args, event)
+		}
+		rows, err := db.Query(
+			"SELECT id, envelope FROM webhook_events WHERE "+cond+" ORDER BY id LIMIT ?",
+			append(args, limit+1)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load events: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		events := []WebhookEvent{}
+		next, hasMore := since, false
+		for rows.Next() {
+			if len(events) == limit {
+				hasMore = true
+				break
+			}
+			var cursor int64
+			var envelope []byte
+			if err := rows.Scan(&cursor, &envelope); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read events: %v", err),
+				})
+			}
+			next = cursor
+			var e WebhookEvent
+			if err := json.Unmarshal(envelope, &e); err != nil {
+				log.Printf("Events: skipping unreadable event %d: %v", cursor, err)
+				continue
+			}
+			// The cursor is assigned after the envelope is stored
+			e.Cursor = cursor
+			events = append(events, e)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read events: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"events":      events,
+			"next_cursor": next,
+			"has_more":    hasMore,
+		})
+	})
+}
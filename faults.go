@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// FaultConfig sets the faults injected into the pipeline to exercise its
+// retries and error handling. Rates are probabilities from 0 to 1.
+type FaultConfig struct {
+	// OCRFailureRate fails OCR calls
+	OCRFailureRate float64 `json:"ocr_failure_rate"`
+	// GeminiTimeoutRate makes Gemini calls hang for GeminiTimeoutMs and
+	// then fail with a deadline error
+	GeminiTimeoutRate float64 `json:"gemini_timeout_rate"`
+	GeminiTimeoutMs   int     `json:"gemini_timeout_ms"`
+	// DBDelayRate delays statements run with retry by DBDelayMs
+	DBDelayRate float64 `json:"db_delay_rate"`
+	DBDelayMs   int     `json:"db_delay_ms"`
+	// DBErrorRate fails statements run with retry with a deadlock, which
+	// they retry
+	DBErrorRate float64 `json:"db_error_rate"`
+}
+
+// validate checks the rates and delays
+func (f FaultConfig) validate() error {
+	for name, rate := range map[string]float64{
+		"ocr_failure_rate":    f.OCRFailureRate,
+		"gemini_timeout_rate": f.GeminiTimeoutRate,
+		"db_delay_rate":       f.DBDelayRate,
+		"db_error_rate":       f.DBErrorRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	}
+	if f.GeminiTimeoutMs < 0 || f.DBDelayMs < 0 {
+		return fmt.Errorf("gemini_timeout_ms and db_delay_ms must not be negative")
+	}
+	return nil
+}
+
+// faultInjector injects the configured faults. Its methods do nothing on a
+// nil injector, so call sites need no checks.
+type faultInjector struct {
+	mu  sync.RWMutex
+	cfg FaultConfig
+}
+
+// faults is set on startup when FAULT_INJECTION is enabled; never enable it
+// in production
+var faults *faultInjector
+
+// envRate reads a probability from the environment, 0 when unset or invalid
+func envRate(name string) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v >= 0 && v <= 1 {
+		return v
+	}
+	return 0
+}
+
+// newFaultInjector returns an injector configured from the FAULT_*
+// variables, or nil unless FAULT_INJECTION is true
+func newFaultInjector() *faultInjector {
+	if enabled, _ := strconv.ParseBool(os.Getenv("FAULT_INJECTION")); !enabled {
+		return nil
+	}
+	cfg := FaultConfig{
+		OCRFailureRate:    envRate("FAULT_OCR_FAILURE_RATE"),
+		GeminiTimeoutRate: envRate("FAULT_GEMINI_TIMEOUT_RATE"),
+		GeminiTimeoutMs:   5000,
+		DBDelayRate:       envRate("FAULT_DB_DELAY_RATE"),
+		DBErrorRate:       envRate("FAULT_DB_ERROR_RATE"),
+	}
+	if d, err := time.ParseDuration(os.Getenv("FAULT_GEMINI_TIMEOUT")); err == nil && d >= 0 {
+		cfg.GeminiTimeoutMs = int(d.Milliseconds())
+	}
+	if d, err := time.ParseDuration(os.Getenv("FAULT_DB_DELAY")); err == nil && d >= 0 {
+		cfg.DBDelayMs = int(d.Milliseconds())
+	}
+	return &faultInjector{cfg: cfg}
+}
+
+// config returns the current configuration
+func (f *faultInjector) config() FaultConfig {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cfg
+}
+
+// set replaces the configuration
+func (f *faultInjector) set(cfg FaultConfig) {
+	f.mu.Lock()
+	f.cfg = cfg
+	f.mu.Unlock()
+}
+
+// faultStrikes reports whether a fault with the given rate strikes
+func faultStrikes(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// ocr fails an OCR call
+func (f *faultInjector) ocr() error {
+	if f == nil || !faultStrikes(f.config().OCRFailureRate) {
+		return nil
+	}
+	return fmt.Errorf("injected fault: OCR failed")
+}
+
+// gemini makes a Gemini call hang and time out, returning early when ctx
+// is done
+func (f *faultInjector) gemini(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	cfg := f.config()
+	if !faultStrikes(cfg.GeminiTimeoutRate) {
+		return nil
+	}
+	select {
+	case <-time.After(time.Duration(cfg.GeminiTimeoutMs) * time.Millisecond):
+	case <-ctx.Done():
+	}
+	return fmt.Errorf("injected fault: %w", context.DeadlineExceeded)
+}
+
+// db delays or fails a database operation
+func (f *faultInjector) db() error {
+	if f == nil {
+		return nil
+	}
+	cfg := f.config()
+	if faultStrikes(cfg.DBDelayRate) {
+		time.Sleep(time.Duration(cfg.DBDelayMs) * time.Millisecond)
+	}
+	if faultStrikes(cfg.DBErrorRate) {
+		return fmt.Errorf("injected fault: %w", &mysql.MySQLError{
+			Number:  mysqlErrDeadlock,
+			Message: "Deadlock found when trying to get lock; try restarting transaction",
+		})
+	}
+	return nil
+}
+
+// describe lists the active faults for the startup log
+func (f FaultConfig) describe() string {
+	var parts []string
+	if f.OCRFailureRate > 0 {
+		parts = append(parts, fmt.Sprintf("OCR failures %.0f%%", f.OCRFailureRate*100))
+	}
+	if f.GeminiTimeoutRate > 0 {
+		parts = append(parts, fmt.Sprintf("Gemini timeouts %.0f%% after %dms", f.GeminiTimeoutRate*100, f.GeminiTimeoutMs))
+	}
+	if f.DBDelayRate > 0 {
+		parts = append(parts, fmt.Sprintf("DB delays %.0f%% of %dms", f.DBDelayRate*100, f.DBDelayMs))
+	}
+	if f.DBErrorRate > 0 {
+		parts = append(parts, fmt.Sprintf("DB errors %.0f%%", f.DBErrorRate*100))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// registerFaultRoutes adds endpoints for integration tests to change the
+// injected faults while the server runs
+func registerFaultRoutes(app *fiber.App) {
+	app.Get("/admin/faults", func(c *fiber.Ctx) error {
+		if faults == nil {
+			return c.JSON(fiber.Map{
+				"success": true,
+				"enabled": false,
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"enabled": true,
+			"faults":  faults.config(),
+		})
+	})
+
+	// The body replaces every rate; {} turns all faults off
+	app.Put("/admin/faults", func(c *fiber.Ctx) error {
+		if faults == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Fault injection is disabled; start the server with FAULT_INJECTION=true",
+			})
+		}
+		var cfg FaultConfig
+		if err := json.Unmarshal(c.Body(), &cfg); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if err := cfg.validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		faults.set(cfg)
+		log.Printf("WARNING: injected faults changed: %s", cfg.describe())
+		return c.JSON(fiber.Map{
+			"success": true,
+			"enabled": true,
+			"faults":  cfg,
+		})
+	})
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Firefly mapping kinds: local category to Firefly category, and local
+// category to the asset account the money is paid from ("*" is the default)
+const (
+	fireflyMapCategory      = "category"
+	fireflyMapSourceAccount = "source_account"
+	fireflyMapDefault       = "*"
+)
+
+// fireflyExternalIDPrefix marks transactions created by this service so
+// re-syncs find them instead of creating duplicates
+const fireflyExternalIDPrefix = "receipt-processor:transaction:"
+
+// FireflyClient talks to the Firefly III REST API
+type FireflyClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// newFireflyClient returns a client for FIREFLY_URL authenticated with the
+// personal access token FIREFLY_TOKEN, or nil when not configured
+func newFireflyClient() *FireflyClient {
+	baseURL := strings.TrimRight(os.Getenv("FIREFLY_URL"), "/")
+	if baseURL == "" || os.Getenv("FIREFLY_TOKEN") == "" {
+		return nil
+	}
+	return &FireflyClient{
+		baseURL: baseURL,
+		token:   os.Getenv("FIREFLY_TOKEN"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends an API request and decodes the JSON response into out (if not nil)
+func (f *FireflyClient) do(method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, f.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.token)
+	req.Header.Set("Accept", "application/vnd.api+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("firefly request %s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("firefly %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fireflyGroup is a transaction group as returned by Firefly
+type fireflyGroup struct {
+	ID         string `json:"id"`
+	Attributes struct {
+		UpdatedAt    time.Time `json:"updated_at"`
+		Transactions []struct {
+			JournalID string `json:"transaction_journal_id"`
+		} `json:"transactions"`
+	} `json:"attributes"`
+}
+
+// findByExternalID returns the transaction group with the external ID, or
+// nil when there is none
+func (f *FireflyClient) findByExternalID(externalID string) (*fireflyGroup, error) {
+	var resp struct {
+		Data []fireflyGroup `json:"data"`
+	}
+	query := url.QueryEscape(fmt.Sprintf(`external_id_is:"%s"`, externalID))
+	if err := f.do("GET", "/api/v1/search/transactions?query="+query, nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, nil
+	}
+	return &resp.Data[0], nil
+}
+
+// group loads a transaction group by ID, or nil when it was deleted
+func (f *FireflyClient) group(id string) (*fireflyGroup, error) {
+	var resp struct {
+		Data fireflyGroup `json:"data"`
+	}
+	err := f.do("GET", "/api/v1/transactions/"+id, nil, &resp)
+	if err != nil && strings.Contains(err.Error(), "returned 404") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// fireflyMappings loads the mappings of a kind keyed by local value
+func fireflyMappings(kind string) (map[string]string, error) {
+	rows, err := db.Query("SELECT local_value, firefly_value FROM firefly_mappings WHERE kind = ?", kind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load firefly mappings: %v", err)
+	}
+	defer rows.Close()
+
+	mappings := make(map[string]string)
+	for rows.Next() {
+		var local, remote string
+		if err := rows.Scan(&local, &remote); err != nil {
+			return nil, fmt.Errorf("failed to scan firefly mapping: %v", err)
+		}
+		mappings[local] = remote
+	}
+	return mappings, rows.Err()
+}
+
+// fireflyTransaction is a local transaction ready to push
+type fireflyTransaction struct {
+	ID          int64
+	Date        time.Time
+	Merchant    string
+	Category    string
+	Amount      float64
+	Currency    string
+	HomeAmount  sql.NullFloat64
+	Reference   string
+	FireflyID   sql.NullString
+	JournalID   sql.NullString
+	SyncedAt    sql.NullTime
+	ReceiptID   int64
+	ReceiptFile string
+}
+
+// split builds the Firefly transaction split. Amounts are booked in the home
+// currency with the receipt currency as foreign amount.
+func (t *fireflyTransaction) split(categories, accounts map[string]string) map[string]any {
+	category := strings.ToLower(t.Category)
+	split := map[string]any{
+		"type":             "withdrawal",
+		"date":             t.Date.Format("2006-01-02"),
+		"description":      t.Merchant,
+		"destination_name": t.Merchant,
+		"external_id":      fireflyExternalIDPrefix + strconv.FormatInt(t.ID, 10),
+		"tags":             []string{"receipt-processor"},
+		"notes":            fmt.Sprintf("Receipt #%d (%s)", t.ReceiptID, t.ReceiptFile),
+	}
+
+	home := homeCurrency()
+	if t.Currency == "" || strings.EqualFold(t.Currency, home) || !t.HomeAmount.Valid {
+		split["amount"] = strconv.FormatFloat(t.Amount, 'f', 2, 64)
+		if t.Currency != "" {
+			split["currency_code"] = strings.ToUpper(t.Currency)
+		}
+	} else {
+		split["amount"] = strconv.FormatFloat(t.HomeAmount.Float64, 'f', 2, 64)
+		split["currency_code"] = home
+		split["foreign_amount"] = strconv.FormatFloat(t.Amount, 'f', 2, 64)
+		split["foreign_currency_code"] = strings.ToUpper(t.Currency)
+	}
+
+	if mapped, ok := categories[category]; ok {
+		split["category_name"] = mapped
+	} else if t.Category != "" {
+		split["category_name"] = t.Category
+	}
+
+	source := os.Getenv("FIREFLY_SOURCE_ACCOUNT")
+	if mapped, ok := accounts[category]; ok {
+		source = mapped
+	} else if mapped, ok := accounts[fireflyMapDefault]; ok {
+		source = mapped
+	}
+	if id, err := strconv.Atoi(source); err == nil {
+		split["source_id"] = strconv.Itoa(id)
+	} else if source != "" {
+		split["source_name"] = source
+	}
+
+	if t.Reference != "" {
+		split["internal_reference"] = t.Reference
+	}
+	if t.JournalID.Valid {
+		split["transaction_journal_id"] = t.JournalID.String
+	}
+	return split
+}
+
+// FireflySyncResult summarizes a Firefly sync run
+type FireflySyncResult struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Linked    int `json:"linked"`
+	Conflicts int `json:"conflicts"`
+	Failed    int `json:"failed"`
+}
+
+// fireflySyncMu serializes scheduled and manual syncs
+var fireflySyncMu sync.Mutex
+
+// syncFirefly pushes transactions to Firefly III. Only receipts that are
+// processed (not waiting for review) are pushed, so corrections made during
+// review land before the first sync. Transactions changed here after their
+// last sync are updated, unless the Firefly copy was edited since then, in
+// which case the user's edit in Firefly wins and a conflict is counted.
+func syncFirefly(f *FireflyClient) (*FireflySyncResult, error) {
+	fireflySyncMu.Lock()
+	defer fireflySyncMu.Unlock()
+
+	categories, err := fireflyMappings(fireflyMapCategory)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := fireflyMappings(fireflyMapSourceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		`SELECT t.id, t.date, COALESCE(t.merchant_clean, t.merchant_raw), COALESCE(t.category, ''), t.amount,
+			COALESCE(t.currency, ''), t.home_amount, COALESCE(t.reference_number, ''),
+			t.firefly_id, t.firefly_journal_id, t.firefly_synced_at, r.id, r.file_name
+		FROM transactions t
+		JOIN receipts r ON r.id = t.receipt_id
+		WHERE r.status = 'processed' AND t.date IS NOT NULL AND t.amount > 0 AND t.anonymized_at IS NULL
+			AND COALESCE(t.merchant_clean, t.merchant_raw) IS NOT NULL
+			AND (t.firefly_id IS NULL OR t.updated_at > t.firefly_synced_at)
+		ORDER BY t.id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transactions to sync: %v", err)
+	}
+	var pending []fireflyTransaction
+	for rows.Next() {
+		var t fireflyTransaction
+		if err := rows.Scan(&t.ID, &t.Date, &t.Merchant, &t.Category, &t.Amount, &t.Currency, &t.HomeAmount,
+			&t.Reference, &t.FireflyID, &t.JournalID, &t.SyncedAt, &t.ReceiptID, &t.ReceiptFile); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan transaction: %v", err)
+		}
+		pending = append(pending, t)
+	}
+	rows.Close()
+
+	res := &FireflySyncResult{}
+	for i := range pending {
+		t := &pending[i]
+		if err := pushFireflyTransaction(f, t, categories, accounts, res); err != nil {
+			log.Printf("Firefly: transaction %d: %v", t.ID, err)
+			res.Failed++
+		}
+	}
+	return res, nil
+}
+
+// pushFireflyTransaction creates or updates one transaction in Firefly
+func pushFireflyTransaction(f *FireflyClient, t *fireflyTransaction, categories, accounts map[string]string, res *FireflySyncResult) error {
+	var existing *fireflyGroup
+	var err error
+	if t.FireflyID.Valid {
+		existing, err = f.group(t.FireflyID.String)
+	} else {
+		// A previous run may have created it without recording the ID
+		existing, err = f.findByExternalID(fireflyExternalIDPrefix + strconv.FormatInt(t.ID, 10))
+		if existing != nil {
+			res.Linked++
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Data fireflyGroup `json:"data"`
+	}
+	switch {
+	case existing == nil:
+		t.JournalID = sql.NullString{}
+		body := map[string]any{
+			"error_if_duplicate_hash": true,
+			"apply_rules":             true,
+			"transactions":            []any{t.split(categories, accounts)},
+		}
+		if err := f.do("POST", "/api/v1/transactions", body, &resp); err != nil {
+			return err
+		}
+		res.Created++
+	case t.SyncedAt.Valid && existing.Attributes.UpdatedAt.After(t.SyncedAt.Time.Add(time.Minute)):
+		// Edited in Firefly after our last push: keep the user's version
+		res.Conflicts++
+		resp.Data = *existing
+	default:
+		if len(existing.Attributes.Transactions) > 0 {
+			t.JournalID = sql.NullString{String: existing.Attributes.Transactions[0].JournalID, Valid: true}
+		}
+		body := map[string]any{
+			"apply_rules":  false,
+			"transactions": []any{t.split(categories, accounts)},
+		}
+		if err := f.do("PUT", "/api/v1/transactions/"+existing.ID, body, &resp); err != nil {
+			return err
+		}
+		res.Updated++
+	}
+
+	journalID := sql.NullString{}
+	if len(resp.Data.Attributes.Transactions) > 0 {
+		journalID = sql.NullString{String: resp.Data.Attributes.Transactions[0].JournalID, Valid: true}
+	}
+	// updated_at moves to the same NOW(), so the row only becomes pending
+	// again on the next local change
+	if _, err := db.Exec(
+		"UPDATE transactions SET firefly_id = ?, firefly_journal_id = ?, firefly_synced_at = NOW() WHERE id = ?",
+		resp.Data.ID, journalID, t.ID,
+	); err != nil {
+		return fmt.Errorf("failed to record firefly sync: %v", err)
+	}
+	return nil
+}
+
+// startFireflyScheduler pushes transactions every FIREFLY_SYNC_INTERVAL
+// (default 1h, "off" disables it)
+func startFireflyScheduler() {
+	client := newFireflyClient()
+	if client == nil {
+		return
+	}
+	intervalStr := os.Getenv("FIREFLY_SYNC_INTERVAL")
+	if intervalStr == "off" {
+		return
+	}
+	interval := time.Hour
+	if intervalStr != "" {
+		v, err := time.ParseDuration(intervalStr)
+		if err != nil || v <= 0 {
+			log.Printf("Firefly: invalid FIREFLY_SYNC_INTERVAL %q, scheduled sync disabled", intervalStr)
+			return
+		}
+		interval = v
+	}
+
+	log.Printf("Firefly: syncing transactions every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			res, err := syncFirefly(client)
+			if err != nil {
+				log.Printf("Firefly: sync failed: %v", err)
+				continue
+			}
+			if res.Created+res.Updated+res.Failed > 0 {
+				log.Printf("Firefly: created %d, updated %d, %d conflict(s), %d failed",
+					res.Created, res.Updated, res.Conflicts, res.Failed)
+			}
+		}
+	}()
+}
+
+// registerFireflyRoutes adds the Firefly III sync and mapping endpoints
+func registerFireflyRoutes(app *fiber.App) {
+	app.Post("/integrations/firefly/sync", func(c *fiber.Ctx) error {
+		client := newFireflyClient()
+		if client == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Firefly III integration is not configured (FIREFLY_URL, FIREFLY_TOKEN)",
+			})
+		}
+		res, err := syncFirefly(client)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"result":  res,
+		})
+	})
+
+	app.Get("/integrations/firefly/mappings", func(c *fiber.Ctx) error {
+		mappings := fiber.Map{}
+		for _, kind := range []string{fireflyMapCategory, fireflyMapSourceAccount} {
+			m, err := fireflyMappings(kind)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			mappings[kind] = m
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"mappings": mappings,
+		})
+	})
+
+	// Map a local category to a Firefly category or source account; an
+	// empty firefly value removes the mapping
+	app.Put("/integrations/firefly/mappings", func(c *fiber.Ctx) error {
+		var req struct {
+			Kind    string `json:"kind"`
+			Local   string `json:"local"`
+			Firefly string `json:"firefly"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if req.Kind != fireflyMapCategory && req.Kind != fireflyMapSourceAccount {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "kind must be category or source_account",
+			})
+		}
+		local := strings.ToLower(strings.TrimSpace(req.Local))
+		if local == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "local is required",
+			})
+		}
+
+		var err error
+		if strings.TrimSpace(req.Firefly) == "" {
+			_, err = db.Exec("DELETE FROM firefly_mappings WHERE kind = ? AND local_value = ?", req.Kind, local)
+		} else {
+			_, err = db.Exec(
+				`INSERT INTO firefly_mappings (kind, local_value, firefly_value) VALUES (?, ?, ?)
+				ON DUPLICATE KEY UPDATE firefly_value = VALUES(firefly_value)`,
+				req.Kind, local, strings.TrimSpace(req.Firefly),
+			)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save mapping: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+}
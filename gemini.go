@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
@@ -37,18 +40,22 @@ func NewGeminiClient(ctx context.Context) (*GeminiClient, error) {
 		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
 	}
 
-	modelName := os.Getenv("GEMINI_MODEL")
-	if modelName == "" {
-		modelName = "gemini-1.5-flash" // Default model
-	}
-
 	return &GeminiClient{
 		client: client,
-		model:  modelName,
+		model:  geminiModelName(),
 		ctx:    ctx,
 	}, nil
 }
 
+// geminiModelName is the configured model (GEMINI_MODEL, default
+// gemini-1.5-flash)
+func geminiModelName() string {
+	if name := os.Getenv("GEMINI_MODEL"); name != "" {
+		return name
+	}
+	return "gemini-1.5-flash"
+}
+
 // Close closes the Gemini client
 func (g *GeminiClient) Close() error {
 	return g.client.Close()
@@ -56,15 +63,40 @@ func (g *GeminiClient) Close() error {
 
 // GenerateText generates text from a prompt
 func (g *GeminiClient) GenerateText(prompt string) (*GeminiResponse, error) {
-	model := g.client.GenerativeModel(g.model)
+	return g.generate(nil, genai.Text(prompt))
+}
+
+// generate sends content parts (text and/or images) to the model. With a
+// schema the model answers with JSON matching it.
+func (g *GeminiClient) generate(schema *genai.Schema, parts ...genai.Part) (*GeminiResponse, error) {
+	if err := faults.gemini(g.ctx); err != nil {
+		return &GeminiResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to generate content: %v", err),
+		}, err
+	}
+
+	// Close to the monthly budget a cheaper model takes over
+	modelName := geminiBudget.model(g.model)
+	model := g.client.GenerativeModel(modelName)
 
 	// Configure model parameters
 	model.SetTemperature(0.2) // Lower temperature for more consistent responses
 	model.SetTopP(0.8)
 	model.SetTopK(40)
 	model.SetMaxOutputTokens(2048)
+	if schema != nil {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = schema
+	}
 
-	resp, err := model.GenerateContent(g.ctx, genai.Text(prompt))
+	start := time.Now()
+	resp, err := model.GenerateContent(g.ctx, parts...)
+	var usage *genai.UsageMetadata
+	if resp != nil {
+		usage = resp.UsageMetadata
+	}
+	recordGeminiMetrics(modelName, time.Since(start), usage, err)
 	if err != nil {
 		return &GeminiResponse{
 			Success: false,
@@ -84,35 +116,106 @@ func (g *GeminiClient) GenerateText(prompt string) (*GeminiResponse, error) {
 		text += fmt.Sprintf("%v", part)
 	}
 
+	geminiBudget.record(modelName, resp.UsageMetadata)
+	tokenCount := 0
+	if resp.UsageMetadata != nil {
+		tokenCount = int(resp.UsageMetadata.TotalTokenCount)
+	}
+
 	return &GeminiResponse{
 		Text:       text,
 		Success:    true,
-		TokenCount: int(resp.UsageMetadata.TotalTokenCount),
+		TokenCount: tokenCount,
 	}, nil
 }
 
-// AnalyzeReceiptTextWithPrompt analyzes receipt text using a custom prompt from environment
-func (g *GeminiClient) AnalyzeReceiptTextWithPrompt(ocrText string) (*GeminiResponse, error) {
-	promptTemplate := os.Getenv("GEMINI_PROMPT")
-	if promptTemplate == "" {
-		// Default prompt if not set
-		promptTemplate = `Analyze the following receipt text and extract structured information in JSON format.
+// defaultReceiptPrompt is used when GEMINI_PROMPT is not set
+const defaultReceiptPrompt = `Analyze the following receipt text and extract structured information in JSON format.
 
 Extract the following information:
 - date: transaction date (YYYY-MM-DD format)
+- date_raw: the date exactly as printed on the receipt
+- time: time of purchase (HH:MM, 24-hour) if printed
 - merchant_raw: merchant name as it appears
 - merchant_clean: cleaned/normalized merchant name
 - category: spending category (e.g., groceries, restaurant, gas, shopping, entertainment, etc.)
 - amount: total amount
+- subtotal: amount before tax and tip (if printed)
+- tip: tip/gratuity amount (if printed)
+- tax: total tax/VAT charged (if printed)
 - currency: currency code (e.g., USD, EUR, IDR)
 - confidence: your confidence level (0.0 to 1.0)
+- reference_number: receipt/transaction reference number printed by the POS (e.g. receipt no., invoice no., transaction ID)
+- merchant_country: ISO 3166-1 alpha-2 country code of the merchant, judged from the address, phone number, tax ID or currency (e.g. US, GB, ID)
+- branch_name: the store/branch name for chain merchants (e.g. "Airport", "Main St"), if printed
+- store_number: the store/branch number for chain merchants (e.g. the "1234" in "WALMART #1234"), if printed
+- store_address: the store's street address as printed
 
 Return ONLY a valid JSON object with these fields. If you cannot extract a field, use null.
-Example: {"date":"2024-01-15","merchant_raw":"WALMART #1234","merchant_clean":"Walmart","category":"groceries","amount":45.67,"currency":"USD","confidence":0.95}`
+Example: {"date":"2024-01-15","merchant_raw":"WALMART #1234","merchant_clean":"Walmart","category":"groceries","amount":45.67,"currency":"USD","confidence":0.95,"reference_number":"0042-1187","date_raw":"01/15/2024","merchant_country":"US","store_number":"1234"}`
+
+// receiptPrompt returns the extraction prompt from GEMINI_PROMPT or the default
+func receiptPrompt() string {
+	if prompt := os.Getenv("GEMINI_PROMPT"); prompt != "" {
+		return prompt
 	}
+	return defaultReceiptPrompt
+}
 
-	prompt := fmt.Sprintf("%s\n\nReceipt Text:\n%s", promptTemplate, ocrText)
-	return g.GenerateText(prompt)
+// AnalyzeReceiptTextWithPrompt analyzes receipt text using a custom prompt from environment
+func (g *GeminiClient) AnalyzeReceiptTextWithPrompt(ocrText string) (*GeminiResponse, error) {
+	return g.AnalyzeReceiptTextWithHints(ocrText, "")
+}
+
+// AnalyzeReceiptTextWithHints analyzes receipt text with the configured prompt
+// plus extraction hints for the detected merchant's receipt layout
+func (g *GeminiClient) AnalyzeReceiptTextWithHints(ocrText string, hints string) (*GeminiResponse, error) {
+	return g.AnalyzeTextWithPrompt(receiptPrompt(), ocrText, hints, receiptResponseSchema(nil, false, false))
+}
+
+// AnalyzeTextWithPrompt analyzes receipt text with the given extraction
+// prompt plus optional merchant layout hints; schema is the expected
+// response, nil for free text
+func (g *GeminiClient) AnalyzeTextWithPrompt(prompt string, ocrText string, hints string, schema *genai.Schema) (*GeminiResponse, error) {
+	if hints != "" {
+		prompt = fmt.Sprintf("%s\n\nHints for this merchant's receipt layout:\n%s", prompt, hints)
+	}
+	prompt = fmt.Sprintf("%s\n\nReceipt Text:\n%s", prompt, ocrText)
+	return g.generate(schema, genai.Text(prompt))
+}
+
+// RepairReceiptJSON asks Gemini to correct a previous response that failed
+// validation, listing the problems found. prompt and schema are those the
+// previous response was produced with.
+func (g *GeminiClient) RepairReceiptJSON(prompt, ocrText, previousResponse, problems string, schema *genai.Schema) (*GeminiResponse, error) {
+	prompt = fmt.Sprintf(`Your previous answer for this receipt did not pass validation.
+
+Problems found:
+%s
+
+Previous answer:
+%s
+
+Fix the problems and return ONLY the corrected JSON object with the same fields. Dates must be YYYY-MM-DD, numbers must be plain JSON numbers, currency must be an uppercase ISO 4217 code and confidence between 0.0 and 1.0. Use null for any field you cannot determine.
+
+%s
+
+Receipt Text:
+%s`, problems, previousResponse, prompt, ocrText)
+	return g.generate(schema, genai.Text(prompt))
+}
+
+// AnalyzeReceiptImage sends the receipt image itself to Gemini using the
+// extraction prompt; used as a fallback when OCR yields no usable text.
+// format is the image subtype, e.g. "jpeg" or "png".
+func (g *GeminiClient) AnalyzeReceiptImage(imageData []byte, format string) (*GeminiResponse, error) {
+	return g.AnalyzeImageWithPrompt(receiptPrompt(), imageData, format, receiptResponseSchema(nil, false, false))
+}
+
+// AnalyzeImageWithPrompt sends an image to Gemini with the given extraction
+// prompt and expected response schema
+func (g *GeminiClient) AnalyzeImageWithPrompt(prompt string, imageData []byte, format string, schema *genai.Schema) (*GeminiResponse, error) {
+	return g.generate(schema, genai.ImageData(format, imageData), genai.Text(prompt))
 }
 
 // AnalyzeReceiptText analyzes receipt text and extracts structured data
@@ -124,17 +227,27 @@ Receipt Text:
 
 Extract the following information:
 - date: transaction date (YYYY-MM-DD format)
+- date_raw: the date exactly as printed on the receipt
+- time: time of purchase (HH:MM, 24-hour) if printed
 - merchant_raw: merchant name as it appears
 - merchant_clean: cleaned/normalized merchant name
 - category: spending category (e.g., groceries, restaurant, gas, shopping, entertainment, etc.)
 - amount: total amount
+- subtotal: amount before tax and tip (if printed)
+- tip: tip/gratuity amount (if printed)
+- tax: total tax/VAT charged (if printed)
 - currency: currency code (e.g., USD, EUR, IDR)
 - confidence: your confidence level (0.0 to 1.0)
+- reference_number: receipt/transaction reference number printed by the POS (e.g. receipt no., invoice no., transaction ID)
+- merchant_country: ISO 3166-1 alpha-2 country code of the merchant, judged from the address, phone number, tax ID or currency (e.g. US, GB, ID)
+- branch_name: the store/branch name for chain merchants (e.g. "Airport", "Main St"), if printed
+- store_number: the store/branch number for chain merchants (e.g. the "1234" in "WALMART #1234"), if printed
+- store_address: the store's street address as printed
 
 Return ONLY a valid JSON object with these fields. If you cannot extract a field, use null.
-Example: {"date":"2024-01-15","merchant_raw":"WALMART #1234","merchant_clean":"Walmart","category":"groceries","amount":45.67,"currency":"USD","confidence":0.95}`, ocrText)
+Example: {"date":"2024-01-15","merchant_raw":"WALMART #1234","merchant_clean":"Walmart","category":"groceries","amount":45.67,"currency":"USD","confidence":0.95,"reference_number":"0042-1187","date_raw":"01/15/2024","merchant_country":"US","store_number":"1234"}`, ocrText)
 
-	return g.GenerateText(prompt)
+	return g.generate(receiptResponseSchema(nil, false, false), genai.Text(prompt))
 }
 
 // AnalyzeReceiptWithContext provides more detailed receipt analysis
@@ -192,3 +305,22 @@ func (g *GeminiClient) ListModels() ([]string, error) {
 
 	return models, nil
 }
+
+// parseGeminiJSON parses the structured receipt data out of a Gemini response
+func parseGeminiJSON(text string) (*GeminiParsedData, error) {
+	var data GeminiParsedData
+	if err := json.Unmarshal([]byte(cleanGeminiJSON(text)), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// cleanGeminiJSON strips the markdown code fences Gemini wraps JSON in when
+// structured output is turned off
+func cleanGeminiJSON(text string) string {
+	cleanedText := strings.TrimSpace(text)
+	cleanedText = strings.TrimPrefix(cleanedText, "```json")
+	cleanedText = strings.TrimPrefix(cleanedText, "```")
+	cleanedText = strings.TrimSuffix(cleanedText, "```")
+	return strings.TrimSpace(cleanedText)
+}
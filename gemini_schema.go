@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// structuredOutput reports whether extraction requests ask Gemini for JSON
+// matching a response schema (GEMINI_STRUCTURED_OUTPUT, default true).
+// Turn it off for models without response schema support.
+func structuredOutput() bool {
+	if v, err := strconv.ParseBool(os.Getenv("GEMINI_STRUCTURED_OUTPUT")); err == nil {
+		return v
+	}
+	return true
+}
+
+// nullableSchema returns a nullable schema of a primitive type
+func nullableSchema(t genai.Type, description string) *genai.Schema {
+	return &genai.Schema{Type: t, Description: description, Nullable: true}
+}
+
+// fieldSchema returns the schema of a profile or custom field type
+func fieldSchema(fieldType, description string, values []string) *genai.Schema {
+	switch fieldType {
+	case fieldNumber:
+		return nullableSchema(genai.TypeNumber, description)
+	case fieldDate:
+		return nullableSchema(genai.TypeString, description+" (YYYY-MM-DD)")
+	case fieldEnum:
+		s := nullableSchema(genai.TypeString, description)
+		s.Format, s.Enum = "enum", values
+		return s
+	}
+	return nullableSchema(genai.TypeString, description)
+}
+
+// objectSchema returns the schema of an object with the given fields
+func objectSchema(fields []ProfileField) *genai.Schema {
+	s := &genai.Schema{Type: genai.TypeObject, Properties: map[string]*genai.Schema{}}
+	for _, f := range fields {
+		s.Properties[f.Name] = fieldSchema(f.Type, f.Description, nil)
+	}
+	return s
+}
+
+// receiptResponseSchema describes the JSON object of GeminiParsedData for
+// an extraction request, with the custom fields marked for extraction, the
+// line items when lineItems is set, the loyalty program when loyalty is set
+// and the extra fields of the profile.
+// It returns nil when structured output is turned off.
+func receiptResponseSchema(profile *ExtractionProfile, lineItems, loyalty bool) *genai.Schema {
+	if !structuredOutput() {
+		return nil
+	}
+	props := map[string]*genai.Schema{
+		"date":             nullableSchema(genai.TypeString, "transaction date (YYYY-MM-DD)"),
+		"date_raw":         nullableSchema(genai.TypeString, "the date exactly as printed"),
+		"time":             nullableSchema(genai.TypeString, "time of purchase (HH:MM, 24-hour)"),
+		"merchant_raw":     nullableSchema(genai.TypeString, "merchant name as it appears"),
+		"merchant_clean":   nullableSchema(genai.TypeString, "cleaned/normalized merchant name"),
+		"category":         nullableSchema(genai.TypeString, "spending category"),
+		"amount":           nullableSchema(genai.TypeNumber, "total amount"),
+		"subtotal":         nullableSchema(genai.TypeNumber, "amount before tax and tip"),
+		"tip":              nullableSchema(genai.TypeNumber, "tip/gratuity amount"),
+		"tax":              nullableSchema(genai.TypeNumber, "total tax/VAT charged"),
+		"currency":         nullableSchema(genai.TypeString, "ISO 4217 currency code"),
+		"confidence":       nullableSchema(genai.TypeNumber, "confidence from 0.0 to 1.0"),
+		"reference_number": nullableSchema(genai.TypeString, "receipt/transaction reference number"),
+		"merchant_country": nullableSchema(genai.TypeString, "ISO 3166-1 alpha-2 country code of the merchant"),
+		"branch_name":      nullableSchema(genai.TypeString, "store/branch name of a chain merchant"),
+		"store_number":     nullableSchema(genai.TypeString, "store/branch number of a chain merchant"),
+		"store_address":    nullableSchema(genai.TypeString, "store street address"),
+	}
+
+	custom := map[string]*genai.Schema{}
+	for _, f := range customFields {
+		if !f.Extract {
+			continue
+		}
+		desc := f.Description
+		if desc == "" {
+			desc = f.Label
+		}
+		custom[f.Name] = fieldSchema(f.Type, desc, f.Values)
+	}
+	if len(custom) > 0 {
+		props["custom_fields"] = &genai.Schema{Type: genai.TypeObject, Properties: custom, Nullable: true}
+	}
+
+	if profile != nil {
+		for _, f := range profile.Fields {
+			if f.Type != fieldList {
+				props[f.Name] = fieldSchema(f.Type, f.Description, nil)
+				continue
+			}
+			items := nullableSchema(genai.TypeString, "")
+			if elements, ok := profile.ListElements[f.Name]; ok {
+				items = objectSchema(elements)
+			}
+			props[f.Name] = &genai.Schema{Type: genai.TypeArray, Description: f.Description, Items: items, Nullable: true}
+		}
+	}
+
+	// Line items take the items key over a profile's own item list
+	if lineItems {
+		props["items"] = &genai.Schema{
+			Type: genai.TypeArray,
+			Items: objectSchema([]ProfileField{
+				{"name", fieldString, "item name as printed"},
+				{"barcode", fieldString, "EAN/UPC digits if printed"},
+				{"quantity", fieldNumber, "quantity, 1 if not shown"},
+				{"unit", fieldString, "unit of the quantity for weighed or measured items, e.g. kg"},
+				{"size", fieldString, "package size if printed, e.g. 500 g"},
+				{"unit_price", fieldNumber, "price of one unit"},
+				{"total", fieldNumber, "line total after line discounts"},
+				{"category", fieldString, "spending category of the item"},
+			}),
+			Nullable: true,
+		}
+	}
+
+	if loyalty {
+		s := objectSchema([]ProfileField{
+			{"program", fieldString, "loyalty program name as printed"},
+			{"card_number", fieldString, "loyalty card or member number as printed"},
+			{"points_earned", fieldNumber, "points collected with this purchase"},
+			{"points_balance", fieldNumber, "points balance printed after this purchase"},
+			{"points_expiry", fieldDate, "date the points expire"},
+		})
+		s.Nullable = true
+		props["loyalty"] = s
+	}
+
+	return &genai.Schema{Type: genai.TypeObject, Properties: props}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Category and status names are stored and accepted in their canonical
+// (English) form. Responses read by people get a display label next to
+// them in the language of the request, so a review UI can show
+// "Lebensmittel" while PATCHing "groceries" back.
+
+// LabelSet holds the display names of one locale, keyed by the canonical
+// category (lower case) and receipt status
+type LabelSet struct {
+	Categories map[string]string `json:"categories"`
+	Statuses   map[string]string `json:"statuses"`
+}
+
+// builtinLabels translate the receipt statuses and the categories Gemini
+// and the extraction profiles commonly use. Tenants add their own with
+// PUT /i18n/labels.
+var builtinLabels = map[string]LabelSet{
+	"de": {
+		Categories: map[string]string{
+			"groceries": "Lebensmittel", "dining": "Gastronomie", "restaurant": "Restaurant", "restaurants": "Restaurants",
+			"cafe": "Café", "bar": "Bar", "fuel": "Kraftstoff", "transport": "Verkehr", "travel": "Reisen",
+			"shopping": "Einkäufe", "household": "Haushalt", "clothing": "Kleidung", "electronics": "Elektronik",
+			"health": "Gesundheit", "medical": "Medizin", "pharmacy": "Apotheke", "utilities": "Nebenkosten",
+			"entertainment": "Unterhaltung", "education": "Bildung", "office": "Büro", "donation": "Spende",
+			"gifts": "Geschenke", "insurance": "Versicherung", "subscriptions": "Abonnements", "other": "Sonstiges",
+		},
+		Statuses: map[string]string{
+			"processed": "Verarbeitet", "needs_review": "Prüfung nötig", "error": "Fehler",
+			"pending_approval": "Wartet auf Freigabe", "rejected": "Abgelehnt", "pending": "Wartend",
+			"processing": "In Bearbeitung", "duplicate": "Duplikat",
+		},
+	},
+	"fr": {
+		Categories: map[string]string{
+			"groceries": "Courses", "dining": "Restauration", "restaurant": "Restaurant", "restaurants": "Restaurants",
+			"cafe": "Café", "bar": "Bar", "fuel": "Carburant", "transport": "Transport", "travel": "Voyages",
+			"shopping": "Achats", "household": "Maison", "clothing": "Vêtements", "electronics": "Électronique",
+			"health": "Santé", "medical": "Médical", "pharmacy": "Pharmacie", "utilities": "Charges",
+			"entertainment": "Loisirs", "education": "Éducation", "office": "Bureau", "donation": "Don",
+			"gifts": "Cadeaux", "insurance": "Assurance", "subscriptions": "Abonnements", "other": "Autre",
+		},
+		Statuses: map[string]string{
+			"processed": "Traité", "needs_review": "À vérifier", "error": "Erreur",
+			"pending_approval": "En attente d'approbation", "rejected": "Refusé", "pending": "En attente",
+			"processing": "En cours", "duplicate": "Doublon",
+		},
+	},
+	"es": {
+		Categories: map[string]string{
+			"groceries": "Supermercado", "dining": "Restauración", "restaurant": "Restaurante", "restaurants": "Restaurantes",
+			"cafe": "Cafetería", "bar": "Bar", "fuel": "Combustible", "transport": "Transporte", "travel": "Viajes",
+			"shopping": "Compras", "household": "Hogar", "clothing": "Ropa", "electronics": "Electrónica",
+			"health": "Salud", "medical": "Médico", "pharmacy": "Farmacia", "utilities": "Suministros",
+			"entertainment": "Ocio", "education": "Educación", "office": "Oficina", "donation": "Donación",
+			"gifts": "Regalos", "insurance": "Seguros", "subscriptions": "Suscripciones", "other": "Otros",
+		},
+		Statuses: map[string]string{
+			"processed": "Procesado", "needs_review": "Por revisar", "error": "Error",
+			"pending_approval": "Pendiente de aprobación", "rejected": "Rechazado", "pending": "Pendiente",
+			"processing": "Procesando", "duplicate": "Duplicado",
+		},
+	},
+}
+
+// localePattern matches a BCP 47 language tag such as de or pt-br, after
+// lower-casing
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// maxLabelLength caps a display label
+const maxLabelLength = 100
+
+// normalizeLocale lower-cases a language tag and uses - as separator
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// localeBase returns the language of a tag, e.g. de for de-at
+func localeBase(locale string) string {
+	base, _, _ := strings.Cut(locale, "-")
+	return base
+}
+
+// loadCustomLabels returns the labels a tenant set, by locale, falling
+// back to those of the default tenant
+func loadCustomLabels(tenant string) map[string]LabelSet {
+	for _, key := range []string{tenant, defaultTenant} {
+		var raw []byte
+		err := db.QueryRow("SELECT labels FROM label_translations WHERE tenant_key = ?", key).Scan(&raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load labels for %s: %v", key, err)
+			break
+		}
+		var labels map[string]LabelSet
+		if err := json.Unmarshal(raw, &labels); err != nil {
+			log.Printf("Invalid labels for %s: %v", key, err)
+			break
+		}
+		return labels
+	}
+	return map[string]LabelSet{}
+}
+
+// saveCustomLabels stores the labels of a tenant
+func saveCustomLabels(tenant string, labels map[string]LabelSet) error {
+	raw, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(
+		`INSERT INTO label_translations (tenant_key, labels) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE labels = VALUES(labels)`,
+		tenant, raw,
+	); err != nil {
+		return fmt.Errorf("failed to save labels: %v", err)
+	}
+	return nil
+}
+
+// mergedLabels combines the built-in and custom labels of a locale. A
+// regional locale such as de-at inherits those of its language.
+func mergedLabels(locale string, custom map[string]LabelSet) LabelSet {
+	merged := LabelSet{Categories: map[string]string{}, Statuses: map[string]string{}}
+	sources := []string{localeBase(locale)}
+	if locale != sources[0] {
+		sources = append(sources, locale)
+	}
+	for _, tag := range sources {
+		for _, set := range []LabelSet{builtinLabels[tag], custom[tag]} {
+			for k, v := range set.Categories {
+				merged.Categories[k] = v
+			}
+			for k, v := range set.Statuses {
+				merged.Statuses[k] = v
+			}
+		}
+	}
+	return merged
+}
+
+// resolveLocale picks the locale of a request: the most preferred language
+// of the Accept-Language header that has labels, otherwise the fallback
+// (the user's locale setting). English, the canonical language, and
+// locales without labels resolve to "".
+func resolveLocale(acceptLanguage, fallback string, custom map[string]LabelSet) string {
+	known := func(tag string) bool {
+		_, builtin := builtinLabels[tag]
+		_, own := custom[tag]
+		return builtin || own
+	}
+	match := func(tag string) (string, bool) {
+		if known(tag) {
+			return tag, true
+		}
+		if base := localeBase(tag); known(base) {
+			return base, true
+		}
+		// An English speaker sees canonical names, not the fallback
+		return "", localeBase(tag) == "en"
+	}
+
+	type preference struct {
+		tag string
+		q   float64
+	}
+	var prefs []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = normalizeLocale(tag)
+		if !localePattern.MatchString(tag) {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if locale, ok := match(p.tag); ok {
+			return locale
+		}
+	}
+
+	if fallback = normalizeLocale(fallback); fallback != "" {
+		locale, _ := match(fallback)
+		return locale
+	}
+	return ""
+}
+
+// Localizer adds display labels to responses. A nil Localizer, used when
+// the request asks for canonical names, adds none.
+type Localizer struct {
+	Locale string
+	labels LabelSet
+}
+
+// newLocalizer resolves the locale of a request and loads its labels. It
+// sets Content-Language when labels are added.
+func newLocalizer(c *fiber.Ctx) *Localizer {
+	c.Vary(fiber.HeaderAcceptLanguage)
+	tenant := tenantKey(c)
+	custom := loadCustomLabels(tenant)
+	locale := resolveLocale(c.Get(fiber.HeaderAcceptLanguage), loadUserSettings(tenant).Locale, custom)
+	if locale == "" {
+		return nil
+	}
+	c.Set(fiber.HeaderContentLanguage, locale)
+	return &Localizer{Locale: locale, labels: mergedLabels(locale, custom)}
+}
+
+// Category returns the label of a category, or the category itself when it
+// has none
+func (l *Localizer) Category(category string) string {
+	if label, ok := l.labels.Categories[strings.ToLower(strings.TrimSpace(category))]; ok {
+		return label
+	}
+	return category
+}
+
+// Status returns the label of a receipt status, or the status itself when
+// it has none
+func (l *Localizer) Status(status string) string {
+	if label, ok := l.labels.Statuses[status]; ok {
+		return label
+	}
+	return status
+}
+
+// categoryLabel returns the label to set next to a nullable category
+func (l *Localizer) categoryLabel(category *string) *string {
+	if l == nil || category == nil {
+		return nil
+	}
+	label := l.Category(*category)
+	return &label
+}
+
+// Receipts adds status and category labels to receipts and their loaded
+// transactions
+func (l *Localizer) Receipts(receipts []ReceiptSummary) {
+	if l == nil {
+		return
+	}
+	for i := range receipts {
+		receipts[i].StatusLabel = l.Status(receipts[i].Status)
+		if receipts[i].Transactions == nil {
+			continue
+		}
+		transactions := *receipts[i].Transactions
+		for j := range transactions {
+			transactions[j].CategoryLabel = l.categoryLabel(transactions[j].Category)
+		}
+	}
+}
+
+// Transactions adds category labels to transactions
+func (l *Localizer) Transactions(transactions []TransactionSummary) {
+	for i := range transactions {
+		transactions[i].CategoryLabel = l.categoryLabel(transactions[i].Category)
+	}
+}
+
+// LabelUpdate sets or, with an empty label, removes custom labels of a
+// locale
+type LabelUpdate struct {
+	Locale     string            `json:"locale"`
+	Categories map[string]string `json:"categories"`
+	Statuses   map[string]string `json:"statuses"`
+}
+
+// apply merges the update into the custom labels of a tenant
+func (u LabelUpdate) apply(labels map[string]LabelSet) error {
+	locale := normalizeLocale(u.Locale)
+	if !localePattern.MatchString(locale) {
+		return fmt.Errorf("locale must be a language tag such as de or pt-BR")
+	}
+	set := labels[locale]
+	if set.Categories == nil {
+		set.Categories = map[string]string{}
+	}
+	if set.Statuses == nil {
+		set.Statuses = map[string]string{}
+	}
+
+	update := func(target map[string]string, key, label string) error {
+		label = strings.TrimSpace(label)
+		if len([]rune(label)) > maxLabelLength {
+			return fmt.Errorf("label %q is longer than %d characters", label, maxLabelLength)
+		}
+		if label == "" {
+			delete(target, key)
+		} else {
+			target[key] = label
+		}
+		return nil
+	}
+	for category, label := range u.Categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" {
+			return fmt.Errorf("category names must not be empty")
+		}
+		if err := update(set.Categories, category, label); err != nil {
+			return err
+		}
+	}
+	for status, label := range u.Statuses {
+		if !strings.Contains(receiptStatuses, "'"+status+"'") {
+			return fmt.Errorf("invalid status %q, expected one of %s", status, receiptStatuses)
+		}
+		if err := update(set.Statuses, status, label); err != nil {
+			return err
+		}
+	}
+
+	if len(set.Categories) == 0 && len(set.Statuses) == 0 {
+		delete(labels, locale)
+	} else {
+		labels[locale] = set
+	}
+	return nil
+}
+
+// registerI18nRoutes adds the label catalog and custom labels
+func registerI18nRoutes(app *fiber.App) {
+	// The labels of a locale (locale=, default the locale of the request)
+	// and the locales that have labels
+	app.Get("/i18n/labels", func(c *fiber.Ctx) error {
+		custom := loadCustomLabels(tenantKey(c))
+		locale := normalizeLocale(c.Query("locale"))
+		if locale == "" {
+			if l := newLocalizer(c); l != nil {
+				locale = l.Locale
+			}
+		} else if !localePattern.MatchString(locale) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "locale must be a language tag such as de or pt-BR",
+			})
+		}
+
+		locales := []string{}
+		for tag := range builtinLabels {
+			locales = append(locales, tag)
+		}
+		for tag := range custom {
+			if _, ok := builtinLabels[tag]; !ok {
+				locales = append(locales, tag)
+			}
+		}
+		sort.Strings(locales)
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"locale":  locale,
+			"locales": locales,
+			"labels":  mergedLabels(locale, custom),
+			"custom":  custom[locale],
+		})
+	})
+
+	// Sets or removes custom labels of one locale; they take precedence
+	// over the built-in ones
+	app.Put("/i18n/labels", func(c *fiber.Ctx) error {
+		var req LabelUpdate
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		tenant := tenantKey(c)
+		labels := loadCustomLabels(tenant)
+		if err := req.apply(labels); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err := saveCustomLabels(tenant, labels); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		locale := normalizeLocale(req.Locale)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"locale":  locale,
+			"labels":  mergedLabels(locale, labels),
+			"custom":  labels[locale],
+		})
+	})
+}
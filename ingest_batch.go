@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxBatchFiles caps the receipts queued by one batch upload, counting
+// the files inside ZIP archives
+const maxBatchFiles = 100
+
+// maxBatchEntrySize caps the unpacked size of one file inside a ZIP archive
+const maxBatchEntrySize = 32 << 20
+
+// ingestExtensions are the receipt file types accepted by the batch upload
+var ingestExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".pdf": true,
+}
+
+// maxRequestBody is the largest request body accepted, in bytes
+// (MAX_REQUEST_SIZE_MB, default 64), so batches of receipts fit in one
+// upload
+func maxRequestBody() int {
+	if mb, err := strconv.Atoi(os.Getenv("MAX_REQUEST_SIZE_MB")); err == nil && mb > 0 {
+		return mb << 20
+	}
+	return 64 << 20
+}
+
+// BatchIngestFile is the outcome of one file of a batch upload
+type BatchIngestFile struct {
+	// Name is the uploaded file name; files from a ZIP archive are named
+	// archive.zip/path/in/archive
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	ReceiptID int64  `json:"receipt_id,omitempty"`
+	JobID     int64  `json:"job_id,omitempty"`
+	StatusURL string `json:"status_url,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// QuarantineID is set when the file failed screening
+	QuarantineID int64 `json:"quarantine_id,omitempty"`
+}
+
+// isZipUpload reports whether an uploaded part is a ZIP archive
+func isZipUpload(file *multipart.FileHeader) bool {
+	switch file.Header.Get("Content-Type") {
+	case "application/zip", "application/x-zip-compressed":
+		return true
+	}
+	return strings.ToLower(filepath.Ext(file.Filename)) == ".zip"
+}
+
+// newUploadName returns a unique stored file name keeping the extension
+func newUploadName(ext string) string {
+	return fmt.Sprintf("%s_%s%s", uuid.New().String(), time.Now().Format("20060102_150405"), strings.ToLower(ext))
+}
+
+// queueUploadedReceipt records a file saved in uploadsDir as a pending
+// receipt from an ingest channel, moves it to STORAGE_BACKEND and queues
+// it; in carries the pipeline options and gets the receipt ID and path
+// filled in
+func queueUploadedReceipt(storedName, channel string, in PipelineInput) (int64, int64, error) {
+	savePath := filepath.Join(uploadsDir, storedName)
+	checksum, err := fileChecksum(savePath)
+	if err != nil {
+		log.Printf("Failed to checksum %s: %v", savePath, err)
+	}
+
+	backend, err := storeReceiptFile(storedName)
+	if err != nil {
+		os.Remove(savePath)
+		return 0, 0, err
+	}
+	in.Path = savePath
+	if backend != "local" {
+		in.Path = storedName
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO receipts (file_name, status, storage_backend, checksum, priority, channel, uploaded_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		storedName,
+		"pending",
+		backend,
+		sql.NullString{String: checksum, Valid: checksum != ""},
+		in.Priority,
+		channel,
+		time.Now(),
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to save receipt to database: %v", err)
+	}
+	if in.ReceiptID, err = result.LastInsertId(); err != nil {
+		return 0, 0, fmt.Errorf("failed to get receipt ID: %v", err)
+	}
+
+	jobID, err := ingestQueue.Enqueue(in, backend)
+	if err != nil {
+		if _, err := db.Exec("UPDATE receipts SET status = 'error' WHERE id = ?", in.ReceiptID); err != nil {
+			log.Printf("Failed to mark receipt %d as errored: %v", in.ReceiptID, err)
+		}
+		return in.ReceiptID, 0, err
+	}
+	return in.ReceiptID, jobID, nil
+}
+
+// batchIngester queues the files of one batch upload
+type batchIngester struct {
+	in      PipelineInput
+	channel string
+	files   []BatchIngestFile
+	// queued counts the files that were accepted for processing
+	queued int
+}
+
+// reject records a file that was not queued
+func (b *batchIngester) reject(name, reason string) {
+	b.files = append(b.files, BatchIngestFile{Name: name, Status: "rejected", Error: reason})
+}
+
+// full reports whether the batch reached maxBatchFiles; later files are
+// rejected
+func (b *batchIngester) full(name string) bool {
+	if len(b.files) < maxBatchFiles {
+		return false
+	}
+	b.reject(name, fmt.Sprintf("batch is limited to %d files", maxBatchFiles))
+	return true
+}
+
+// queue records and queues a file already saved in uploadsDir
+func (b *batchIngester) queue(name, storedName string) {
+	in := b.in
+	in.IsPDF = strings.ToLower(filepath.Ext(storedName)) == ".pdf"
+	quarantineID, reason, err := quarantineUpload(storedName, name, b.channel, in)
+	if err != nil {
+		log.Printf("Batch ingest: %s: %v", name, err)
+		b.files = append(b.files, BatchIngestFile{Name: name, Status: "error", Error: "Failed to screen file"})
+		return
+	}
+	if reason != "" {
+		b.files = append(b.files, BatchIngestFile{
+			Name:         name,
+			Status:       "quarantined",
+			Error:        "The file failed screening (" + reason + ") and was quarantined for review",
+			QuarantineID: quarantineID,
+		})
+		return
+	}
+	receiptID, jobID, err := queueUploadedReceipt(storedName, b.channel, in)
+	if err != nil {
+		log.Printf("Batch ingest: %s: %v", name, err)
+		b.files = append(b.files, BatchIngestFile{Name: name, Status: "error", ReceiptID: receiptID, Error: "Failed to queue receipt for processing"})
+		return
+	}
+	b.queued++
+	b.files = append(b.files, BatchIngestFile{
+		Name:      name,
+		Status:    "pending",
+		ReceiptID: receiptID,
+		JobID:     jobID,
+		StatusURL: fmt.Sprintf("/receipts/%d/status", receiptID),
+	})
+}
+
+// addUpload queues one uploaded receipt file
+func (b *batchIngester) addUpload(c *fiber.Ctx, file *multipart.FileHeader) {
+	if b.full(file.Filename) {
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if !ingestExtensions[ext] {
+		b.reject(file.Filename, "Invalid file type. Allowed: images (jpg, png, gif, webp), PDF and ZIP archives of them")
+		return
+	}
+	storedName := newUploadName(ext)
+	if err := c.SaveFile(file, filepath.Join(uploadsDir, storedName)); err != nil {
+		log.Printf("Batch ingest: failed to save %s: %v", file.Filename, err)
+		b.reject(file.Filename, "Failed to save file")
+		return
+	}
+	b.queue(file.Filename, storedName)
+}
+
+// addZip queues every receipt file inside a ZIP archive. Folders, hidden
+// files and macOS metadata are skipped silently, other file types are
+// rejected.
+func (b *batchIngester) addZip(file *multipart.FileHeader) {
+	f, err := file.Open()
+	if err != nil {
+		b.reject(file.Filename, "Failed to read archive")
+		return
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, file.Size)
+	if err != nil {
+		b.reject(file.Filename, fmt.Sprintf("Invalid ZIP archive: %v", err))
+		return
+	}
+
+	for _, entry := range zr.File {
+		base := path.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.HasPrefix(entry.Name, "__MACOSX/") {
+			continue
+		}
+		name := file.Filename + "/" + entry.Name
+		if b.full(name) {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(base))
+		if !ingestExtensions[ext] {
+			b.reject(name, "Invalid file type. Allowed: images (jpg, png, gif, webp) and PDF")
+			continue
+		}
+		if entry.UncompressedSize64 > maxBatchEntrySize {
+			b.reject(name, fmt.Sprintf("File is larger than %d MB", maxBatchEntrySize>>20))
+			continue
+		}
+
+		storedName := newUploadName(ext)
+		if err := extractZipEntry(entry, filepath.Join(uploadsDir, storedName)); err != nil {
+			log.Printf("Batch ingest: failed to extract %s: %v", name, err)
+			b.reject(name, "Failed to extract file")
+			continue
+		}
+		b.queue(name, storedName)
+	}
+}
+
+// extractZipEntry writes one archive entry to dest, refusing entries that
+// unpack to more than maxBatchEntrySize whatever their header claims
+func extractZipEntry(entry *zip.File, dest string) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.LimitReader(r, maxBatchEntrySize+1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > maxBatchEntrySize {
+		err = fmt.Errorf("file is larger than %d MB", maxBatchEntrySize>>20)
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// registerBatchIngestRoutes adds the batch upload
+func registerBatchIngestRoutes(app *fiber.App) {
+	// Queue many receipts in one multipart request: any number of files
+	// fields (file works too), each an image, a PDF or a ZIP archive of
+	// them. profile, priority, channel and the OCR options apply to every
+	// file.
+	// Each file is reported with its receipt ID and status URL, or why it
+	// was not queued.
+	app.Post("/receipts/ingest/batch", requireDiskSpace, func(c *fiber.Ctx) error {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Expected a multipart form with files",
+			})
+		}
+		uploads := append(form.File["files"], form.File["file"]...)
+		if len(uploads) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "No files provided",
+			})
+		}
+
+		profile := c.FormValue("profile")
+		if profile != "" && profile != profileGeneric && profileByName(profile) == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Unknown extraction profile %q", profile),
+			})
+		}
+		ocrOptions, err := ocrOptionsFromForm(c.FormValue)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		priority, err := parsePriority(c.FormValue("priority"), priorityNormal)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		channel, err := uploadChannel(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		tenant := tenantKey(c)
+		b := &batchIngester{channel: channel, in: PipelineInput{
+			Profile:  profile,
+			OCR:      &ocrOptions,
+			Priority: priority,
+			Tenant:   tenant,
+		}}
+		for _, file := range uploads {
+			if isZipUpload(file) {
+				b.addZip(file)
+			} else {
+				b.addUpload(c, file)
+			}
+		}
+
+		status := fiber.StatusAccepted
+		if b.queued == 0 {
+			status = fiber.StatusBadRequest
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"success":  b.queued > 0,
+			"queued":   b.queued,
+			"rejected": len(b.files) - b.queued,
+			"priority": priority,
+			"files":    b.files,
+			"pipeline": fiber.Map{
+				"tenant": tenant,
+			},
+		})
+	})
+}
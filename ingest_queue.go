@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ingest job states
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// maxIngestAttempts is how often a job interrupted by a restart is started
+// again before its receipt is marked as errored
+const maxIngestAttempts = 3
+
+// ingestPollInterval is how often idle workers look for jobs they were not
+// notified about, e.g. ones left queued by a restart
+const ingestPollInterval = 10 * time.Second
+
+// IngestJob is an uploaded receipt waiting for or going through the
+// processing pipeline
+type IngestJob struct {
+	ID         int64   `json:"id"`
+	ReceiptID  int64   `json:"receipt_id"`
+	Status     string  `json:"status"`
+	Priority   string  `json:"priority"`
+	Attempts   int     `json:"attempts"`
+	Error      *string `json:"error,omitempty"`
+	Result     any     `json:"result,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	StartedAt  *string `json:"started_at"`
+	FinishedAt *string `json:"finished_at"`
+
+	// path is a local file, or the storage key when storageBackend is not
+	// local storage
+	path           string
+	storageBackend string
+	isPDF          bool
+	profile        string
+	ocrOptions     *OCROptions
+	tenant         string
+	transactionID  int64
+}
+
+// IngestQueue hands stored uploads to a pool of background workers. Jobs
+// live in the ingest_jobs table so uploads accepted before a restart are
+// still processed; the channel only wakes idle workers early.
+type IngestQueue struct {
+	workers int
+	notify  chan struct{}
+}
+
+var ingestQueue = &IngestQueue{workers: ingestWorkerCount(), notify: make(chan struct{}, 1)}
+
+// ingestWorkerCount reads INGEST_WORKERS (default: PIPELINE_CONCURRENCY).
+// Workers still wait for a pipeline slot, so more workers than slots only
+// lets high priority uploads overtake queued ones sooner.
+func ingestWorkerCount() int {
+	n := pipelineScheduler.slots
+	if v := os.Getenv("INGEST_WORKERS"); v != "" {
+		if w, err := strconv.Atoi(v); err == nil && w > 0 {
+			n = w
+		} else {
+			log.Printf("Invalid INGEST_WORKERS %q, using %d", v, n)
+		}
+	}
+	return n
+}
+
+// Enqueue stores a job for a saved receipt and wakes a worker. in.Path is a
+// local file for local storage and the storage key for other backends.
+func (q *IngestQueue) Enqueue(in PipelineInput, backend string) (int64, error) {
+	var ocrOptions sql.NullString
+	if in.OCR != nil {
+		encoded, err := json.Marshal(in.OCR)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode OCR options: %v", err)
+		}
+		ocrOptions = sql.NullString{String: string(encoded), Valid: true}
+	}
+	result, err := execWithRetry(
+		`INSERT INTO ingest_jobs (receipt_id, file_path, storage_backend, is_pdf, profile, ocr_options, priority, tenant, transaction_id, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		in.ReceiptID, in.Path, backend, in.IsPDF, sql.NullString{String: in.Profile, Valid: in.Profile != ""},
+		ocrOptions, in.Priority, in.Tenant, sql.NullInt64{Int64: in.TransactionID, Valid: in.TransactionID > 0}, jobQueued,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue receipt %d: %v", in.ReceiptID, err)
+	}
+	progressTracker.Update(in.ReceiptID, stageQueued, 0, "waiting for a worker")
+	q.wake()
+	return result.LastInsertId()
+}
+
+// wake signals one idle worker without blocking
+func (q *IngestQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// claim marks the next queued job as running and returns it, or nil when
+// the queue is empty. High priority jobs are taken first, oldest first
+// within a priority; priorities held by the Gemini budget are skipped.
+func (q *IngestQueue) claim() (*IngestJob, error) {
+	token := uuid.New().String()
+	where, args := "status = ?", []any{jobRunning, token, jobQueued}
+	// Receipts held by the Gemini budget wait for the next month
+	if held := geminiBudget.heldPriorities(); len(held) > 0 {
+		where += " AND priority NOT IN (?" + strings.Repeat(", ?", len(held)-1) + ")"
+		for _, p := range held {
+			args = append(args, p)
+		}
+	}
+	result, err := execWithRetry(
+		`UPDATE ingest_jobs SET status = ?, claim_token = ?, attempts = attempts + 1, started_at = NOW()
+		WHERE `+where+`
+		ORDER BY FIELD(priority, 'high', 'normal', 'low'), id
+		LIMIT 1`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim ingest job: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+
+	job := &IngestJob{Status: jobRunning}
+	var profile, ocrOptions sql.NullString
+	var transactionID sql.NullInt64
+	err = db.QueryRow(
+		`SELECT id, receipt_id, file_path, storage_backend, is_pdf, profile, ocr_options, priority, tenant, transaction_id, attempts
+		FROM ingest_jobs WHERE claim_token = ?`,
+		token,
+	).Scan(&job.ID, &job.ReceiptID, &job.path, &job.storageBackend, &job.isPDF, &profile, &ocrOptions, &job.Priority,
+		&job.tenant, &transactionID, &job.Attempts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load claimed ingest job: %v", err)
+	}
+	job.profile = profile.String
+	job.transactionID = transactionID.Int64
+	if ocrOptions.Valid {
+		var opts OCROptions
+		if err := json.Unmarshal([]byte(ocrOptions.String), &opts); err != nil {
+			log.Printf("Ingest: job %d has invalid OCR options, using defaults: %v", job.ID, err)
+		} else {
+			job.ocrOptions = &opts
+		}
+	}
+	return job, nil
+}
+
+// process runs a claimed job through the pipeline and records the outcome.
+// The receipt is pending while queued and processing while its job runs;
+// the pipeline then moves it on, and receipts it leaves alone end up in
+// needs_review as before.
+func (q *IngestQueue) process(job *IngestJob) {
+	if _, err := execWithRetry("UPDATE receipts SET status = 'processing' WHERE id = ?", job.ReceiptID); err != nil {
+		log.Printf("Ingest: failed to mark receipt %d as processing: %v", job.ReceiptID, err)
+	}
+
+	path := job.path
+	if job.storageBackend != "local" {
+		tmp, err := newTempDir()
+		if err == nil {
+			defer tmp.Cleanup()
+			path, err = fetchReceiptFile(job.storageBackend, job.path, tmp.Path)
+		}
+		if err != nil {
+			q.fail(job, fmt.Sprintf("failed to fetch receipt file: %v", err))
+			return
+		}
+	}
+
+	res := processReceipt(context.Background(), PipelineInput{
+		ReceiptID:     job.ReceiptID,
+		TransactionID: job.transactionID,
+		Path:          path,
+		IsPDF:         job.isPDF,
+		Config:        loadPipelineConfig(job.tenant),
+		Profile:       job.profile,
+		OCR:           job.ocrOptions,
+		Priority:      job.Priority,
+		Tenant:        job.tenant,
+		Settings:      loadUserSettings(job.tenant),
+	})
+
+	if _, err := execWithRetry(
+		"UPDATE receipts SET status = 'needs_review' WHERE id = ? AND status = 'processing'", job.ReceiptID,
+	); err != nil {
+		log.Printf("Ingest: failed to update receipt %d: %v", job.ReceiptID, err)
+	}
+
+	// The original is archived on Drive even when processing failed
+	if driveClient != nil {
+		uploadIngestedReceipt(job.ReceiptID, path)
+	}
+
+	status, jobErr := jobDone, sql.NullString{}
+	if res.OCRStatus == "failed" {
+		status, jobErr = jobFailed, sql.NullString{String: res.OCRError, Valid: true}
+	} else if res.GeminiError != "" {
+		jobErr = sql.NullString{String: res.GeminiError, Valid: true}
+	}
+	result, err := json.Marshal(map[string]any{
+		"ocr":            res.ocrResponse(),
+		"gemini":         res.geminiResponse(),
+		"stages":         res.Stages,
+		"transaction_id": res.TransactionID,
+	})
+	if err != nil {
+		log.Printf("Ingest: failed to encode result of job %d: %v", job.ID, err)
+		result = nil
+	}
+	if _, err := execWithRetry(
+		"UPDATE ingest_jobs SET status = ?, error = ?, result = ?, claim_token = NULL, finished_at = NOW() WHERE id = ?",
+		status, jobErr, sql.NullString{String: string(result), Valid: result != nil}, job.ID,
+	); err != nil {
+		log.Printf("Ingest: failed to finish job %d: %v", job.ID, err)
+	}
+}
+
+// fail marks a job that could not be started and errors its receipt
+func (q *IngestQueue) fail(job *IngestJob, reason string) {
+	log.Printf("Ingest: job %d: %s", job.ID, reason)
+	progressTracker.Update(job.ReceiptID, stageFailed, 1, reason)
+	if _, err := execWithRetry("UPDATE receipts SET status = 'error' WHERE id = ?", job.ReceiptID); err != nil {
+		log.Printf("Ingest: failed to mark receipt %d as errored: %v", job.ReceiptID, err)
+	}
+	if _, err := execWithRetry(
+		"UPDATE ingest_jobs SET status = ?, error = ?, claim_token = NULL, finished_at = NOW() WHERE id = ?",
+		jobFailed, reason, job.ID,
+	); err != nil {
+		log.Printf("Ingest: failed to finish job %d: %v", job.ID, err)
+	}
+}
+
+// fetchReceiptFile copies a receipt file from a storage backend into dir
+// and returns the local path
+func fetchReceiptFile(backend, key, dir string) (string, error) {
+	store, err := newStorage(backend)
+	if err != nil {
+		return "", err
+	}
+	r, err := store.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	path := filepath.Join(dir, filepath.Base(key))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// work processes jobs until the queue is empty, then waits for a wake-up
+// or the next poll
+func (q *IngestQueue) work() {
+	ticker := time.NewTicker(ingestPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			job, err := q.claim()
+			if err != nil {
+				log.Printf("Ingest: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			// Let another idle worker look at the rest of the queue
+			q.wake()
+			q.process(job)
+		}
+		select {
+		case <-q.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// requeueInterrupted requeues jobs that were running when the server stopped. Jobs
+// that keep getting interrupted are failed and their receipt marked as
+// errored.
+func (q *IngestQueue) requeueInterrupted() error {
+	_, err := execWithRetry(
+		`UPDATE receipts r JOIN ingest_jobs j ON j.receipt_id = r.id
+		SET r.status = 'error'
+		WHERE j.status = ? AND j.attempts >= ?`,
+		jobRunning, maxIngestAttempts,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to fail interrupted ingest jobs: %v", err)
+	}
+	if _, err := execWithRetry(
+		"UPDATE ingest_jobs SET status = ?, error = 'interrupted too often', claim_token = NULL, finished_at = NOW() WHERE status = ? AND attempts >= ?",
+		jobFailed, jobRunning, maxIngestAttempts,
+	); err != nil {
+		return fmt.Errorf("failed to fail interrupted ingest jobs: %v", err)
+	}
+
+	result, err := execWithRetry(
+		"UPDATE ingest_jobs SET status = ?, claim_token = NULL WHERE status = ?",
+		jobQueued, jobRunning,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to requeue interrupted ingest jobs: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Ingest: requeued %d job(s) interrupted by a restart", n)
+	}
+	if _, err := execWithRetry(
+		"UPDATE receipts r JOIN ingest_jobs j ON j.receipt_id = r.id SET r.status = 'pending' WHERE j.status = ? AND r.status = 'processing'",
+		jobQueued,
+	); err != nil {
+		return fmt.Errorf("failed to reset interrupted receipts: %v", err)
+	}
+	return nil
+}
+
+// Stats counts jobs per state
+func (q *IngestQueue) Stats() (map[string]int, error) {
+	stats := map[string]int{jobQueued: 0, jobRunning: 0, jobDone: 0, jobFailed: 0}
+	rows, err := db.Query("SELECT status, COUNT(*) FROM ingest_jobs GROUP BY status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count ingest jobs: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan ingest job counts: %v", err)
+		}
+		stats[status] = n
+	}
+	return stats, rows.Err()
+}
+
+// latestIngestJob returns the most recent ingest job of a receipt, or nil
+// when it was not uploaded through the queue
+func latestIngestJob(receiptID int64) (*IngestJob, error) {
+	job := &IngestJob{}
+	var jobErr, result sql.NullString
+	var createdAt time.Time
+	var startedAt, finishedAt sql.NullTime
+	err := db.QueryRow(
+		`SELECT id, receipt_id, status, priority, attempts, error, result, created_at, started_at, finished_at
+		FROM ingest_jobs WHERE receipt_id = ? ORDER BY id DESC LIMIT 1`,
+		receiptID,
+	).Scan(&job.ID, &job.ReceiptID, &job.Status, &job.Priority, &job.Attempts, &jobErr, &result,
+		&createdAt, &startedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ingest job: %v", err)
+	}
+	job.Error = nullStringPtr(jobErr)
+	if result.Valid {
+		job.Result = json.RawMessage(result.String)
+	}
+	job.CreatedAt = createdAt.Format(time.RFC3339)
+	if startedAt.Valid {
+		s := startedAt.Time.Format(time.RFC3339)
+		job.StartedAt = &s
+	}
+	if finishedAt.Valid {
+		s := finishedAt.Time.Format(time.RFC3339)
+		job.FinishedAt = &s
+	}
+	return job, nil
+}
+
+// startIngestWorkers requeues interrupted jobs and starts the worker pool
+func startIngestWorkers() {
+	if err := ingestQueue.requeueInterrupted(); err != nil {
+		log.Printf("Ingest: %v", err)
+	}
+	log.Printf("Ingest: %d worker(s) processing uploads", ingestQueue.workers)
+	for i := 0; i < ingestQueue.workers; i++ {
+		go ingestQueue.work()
+	}
+}
+
+// requeueReceipt queues a stored receipt for processing again with the
+// profile, OCR options and tenant of its last ingest job. Like
+// /receipts/analyze/:id, the receipt's first transaction is updated in
+// place unless it is on an invoice.
+func requeueReceipt(id int64) (int64, error) {
+	var fileName, backend, status, priority string
+	var deletedAt sql.NullTime
+	err := db.QueryRow(
+		"SELECT file_name, storage_backend, status, priority, deleted_at FROM receipts WHERE id = ?", id,
+	).Scan(&fileName, &backend, &status, &priority, &deletedAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load receipt: %v", err)
+	}
+	if deletedAt.Valid {
+		return 0, fmt.Errorf("receipt is in the trash")
+	}
+	if status == "pending" || status == "processing" {
+		return 0, fmt.Errorf("receipt is already being processed")
+	}
+
+	var transactionID int64
+	var invoiceID sql.NullInt64
+	err = db.QueryRow(
+		"SELECT id, invoice_id FROM "+transactionsAllView+" WHERE receipt_id = ? ORDER BY id LIMIT 1", id,
+	).Scan(&transactionID, &invoiceID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load transaction: %v", err)
+	}
+	if invoiceID.Valid {
+		return 0, fmt.Errorf("transaction %d is on invoice %d", transactionID, invoiceID.Int64)
+	}
+
+	in := PipelineInput{
+		ReceiptID:     id,
+		TransactionID: transactionID,
+		Path:          fileName,
+		IsPDF:         strings.ToLower(filepath.Ext(fileName)) == ".pdf",
+		Priority:      priority,
+		Tenant:        defaultTenant,
+	}
+	if backend == "local" {
+		in.Path = filepath.Join(uploadsDir, fileName)
+	}
+	var profile, ocrOptions sql.NullString
+	err = db.QueryRow(
+		"SELECT profile, ocr_options, tenant FROM ingest_jobs WHERE receipt_id = ? ORDER BY id DESC LIMIT 1", id,
+	).Scan(&profile, &ocrOptions, &in.Tenant)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load last ingest job: %v", err)
+	}
+	in.Profile = profile.String
+	if ocrOptions.Valid {
+		var opts OCROptions
+		if err := json.Unmarshal([]byte(ocrOptions.String), &opts); err == nil {
+			in.OCR = &opts
+		}
+	}
+
+	if _, err := execWithRetry("UPDATE receipts SET status = 'pending' WHERE id = ?", id); err != nil {
+		return 0, fmt.Errorf("failed to update receipt: %v", err)
+	}
+	if _, err := unarchiveReceiptTransactions(id); err != nil {
+		if _, err := execWithRetry("UPDATE receipts SET status = ? WHERE id = ?", status, id); err != nil {
+			log.Printf("Failed to restore status of receipt %d: %v", id, err)
+		}
+		return 0, err
+	}
+	jobID, err := ingestQueue.Enqueue(in, backend)
+	if err != nil {
+		if _, err := execWithRetry("UPDATE receipts SET status = ? WHERE id = ?", status, id); err != nil {
+			log.Printf("Failed to restore status of receipt %d: %v", id, err)
+		}
+		return 0, err
+	}
+	return jobID, nil
+}
+
+// runRequeue queues receipts in a given state for processing again, e.g.
+// the errored ones after an outage. The jobs are picked up by the workers
+// of the running server.
+//
+// Usage: requeue [-status error] [-id N] [-limit N] [-dry-run]
+func runRequeue(args []string) error {
+	fs := flag.NewFlagSet("requeue", flag.ContinueOnError)
+	status := fs.String("status", "error", "requeue receipts in this state")
+	id := fs.Int64("id", 0, "requeue only this receipt, whatever its state")
+	limit := fs.Int("limit", 0, "requeue at most this many receipts, oldest first (0 for all)")
+	dryRun := fs.Bool("dry-run", false, "list the receipts that would be requeued")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !strings.Contains(receiptStatuses, "'"+*status+"'") {
+		return fmt.Errorf("invalid -status %q, expected one of %s", *status, receiptStatuses)
+	}
+	if *status == "pending" || *status == "processing" {
+		return fmt.Errorf("%s receipts are already queued", *status)
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	query, queryArgs := "SELECT id, file_name FROM receipts WHERE status = ? AND deleted_at IS NULL ORDER BY uploaded_at, id", []any{*status}
+	if *id > 0 {
+		query, queryArgs = "SELECT id, file_name FROM receipts WHERE id = ?", []any{*id}
+	}
+	if *limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", *limit)
+	}
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to query receipts: %v", err)
+	}
+	type receipt struct {
+		id       int64
+		fileName string
+	}
+	var receipts []receipt
+	for rows.Next() {
+		var r receipt
+		if err := rows.Scan(&r.id, &r.fileName); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		receipts = append(receipts, r)
+	}
+	rows.Close()
+
+	requeued, failed := 0, 0
+	for _, r := range receipts {
+		if *dryRun {
+			fmt.Printf("%d\t%s\n", r.id, r.fileName)
+			continue
+		}
+		jobID, err := requeueReceipt(r.id)
+		if err != nil {
+			failed++
+			log.Printf("Receipt %d: %v", r.id, err)
+			continue
+		}
+		requeued++
+		fmt.Printf("%d\tjob %d\n", r.id, jobID)
+	}
+
+	if *dryRun {
+		fmt.Printf("%d receipt(s) would be requeued\n", len(receipts))
+		return nil
+	}
+	fmt.Printf("Requeued %d receipt(s)\n", requeued)
+	if failed > 0 {
+		return fmt.Errorf("%d receipt(s) could not be requeued", failed)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// SpendingInsight puts a newly processed receipt in context of earlier spending
+type SpendingInsight struct {
+	Merchant           string  `json:"merchant"`
+	VisitsThisMonth    int     `json:"visits_this_month"`
+	AverageBasket      float64 `json:"average_basket,omitempty"`
+	DiffFromAveragePct float64 `json:"diff_from_average_pct,omitempty"`
+	CategorySpendMonth float64 `json:"category_spend_this_month,omitempty"`
+	PreviousMonthSpend float64 `json:"category_spend_previous_month,omitempty"`
+	Message            string  `json:"message"`
+}
+
+// buildSpendingInsight compares a just-inserted transaction with the existing
+// transactions for the same merchant and category. Returns nil when there is
+// not enough information (no merchant or amount).
+func buildSpendingInsight(transactionID int64, data *GeminiParsedData) (*SpendingInsight, error) {
+	merchant := data.MerchantClean
+	if merchant == "" {
+		merchant = data.MerchantRaw
+	}
+	if merchant == "" || data.Amount <= 0 {
+		return nil, nil
+	}
+
+	date := time.Now()
+	if t, err := time.Parse("2006-01-02", data.Date); err == nil {
+		date = t
+	}
+	monthStart := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	nextMonth := monthStart.AddDate(0, 1, 0)
+	prevMonth := monthStart.AddDate(0, -1, 0)
+
+	insight := &SpendingInsight{Merchant: merchant}
+
+	// Visits this month, counting this one
+	if err := db.QueryRow(
+		`SELECT COUNT(*) FROM transactions
+		WHERE COALESCE(merchant_clean, merchant_raw) = ? AND date >= ? AND date < ?`,
+		merchant, monthStart, nextMonth,
+	).Scan(&insight.VisitsThisMonth); err != nil {
+		return nil, fmt.Errorf("failed to count merchant visits: %v", err)
+	}
+
+	// Average basket at this merchant, excluding this transaction and only
+	// comparing amounts in the same currency
+	var avg sql.NullFloat64
+	if err := db.QueryRow(
+		`SELECT AVG(amount) FROM transactions
+		WHERE COALESCE(merchant_clean, merchant_raw) = ? AND id <> ? AND amount IS NOT NULL AND currency <=> ?`,
+		merchant, transactionID, sql.NullString{String: data.Currency, Valid: data.Currency != ""},
+	).Scan(&avg); err != nil {
+		return nil, fmt.Errorf("failed to compute average basket: %v", err)
+	}
+	if avg.Valid && avg.Float64 > 0 {
+		insight.AverageBasket = math.Round(avg.Float64*100) / 100
+		insight.DiffFromAveragePct = math.Round((data.Amount-avg.Float64)/avg.Float64*1000) / 10
+	}
+
+	if data.Category != "" {
+		var current, previous sql.NullFloat64
+		if err := db.QueryRow(
+			`SELECT
+				SUM(CASE WHEN date >= ? AND date < ? THEN home_amount END),
+				SUM(CASE WHEN date >= ? AND date < ? THEN home_amount END)
+			FROM transactions WHERE category = ?`,
+			monthStart, nextMonth, prevMonth, monthStart, data.Category,
+		).Scan(&current, &previous); err != nil {
+			return nil, fmt.Errorf("failed to compute category spend: %v", err)
+		}
+		insight.CategorySpendMonth = math.Round(current.Float64*100) / 100
+		insight.PreviousMonthSpend = math.Round(previous.Float64*100) / 100
+	}
+
+	insight.Message = insight.describe(data.Category)
+	return insight, nil
+}
+
+// describe renders the insight as a short human-readable sentence
+func (i *SpendingInsight) describe(category string) string {
+	parts := []string{fmt.Sprintf("%s visit to %s this month", ordinal(i.VisitsThisMonth), i.Merchant)}
+
+	if i.AverageBasket > 0 {
+		switch {
+		case math.Abs(i.DiffFromAveragePct) < 5:
+			parts = append(parts, "in line with your average basket")
+		case i.DiffFromAveragePct > 0:
+			parts = append(parts, fmt.Sprintf("%.0f%% above your average basket", i.DiffFromAveragePct))
+		default:
+			parts = append(parts, fmt.Sprintf("%.0f%% below your average basket", -i.DiffFromAveragePct))
+		}
+	} else {
+		parts = append(parts, "first recorded purchase here")
+	}
+
+	if category != "" && i.PreviousMonthSpend > 0 {
+		parts = append(parts, fmt.Sprintf("%s spend this month is %.2f vs %.2f last month",
+			category, i.CategorySpendMonth, i.PreviousMonthSpend))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// ordinal formats 1 as "1st", 2 as "2nd", etc.
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 100 {
+	case 11, 12, 13:
+	default:
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
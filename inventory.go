@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// InventoryRule groups the line items of a product and says how fast it is
+// used up. Without LifeDays or PerDay only purchases are counted.
+type InventoryRule struct {
+	Product string `json:"product"`
+	// Match lists words of which one must appear in an item's description;
+	// the product name is used when empty
+	Match []string `json:"match"`
+	// LifeDays is how long a purchase lasts; it is used up evenly over
+	// that time
+	LifeDays int `json:"life_days,omitempty"`
+	// PerDay is how much of the product (in its canonical unit) is used
+	// per day, oldest purchases first
+	PerDay float64 `json:"per_day,omitempty"`
+}
+
+// InventoryRules are the inventory rules of a tenant
+type InventoryRules struct {
+	Rules []InventoryRule `json:"rules"`
+}
+
+// normalize lower-cases names and match words and checks the values
+func (r *InventoryRules) normalize() error {
+	seen := map[string]bool{}
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		rule.Product = strings.ToLower(strings.TrimSpace(rule.Product))
+		if rule.Product == "" {
+			return fmt.Errorf("every rule needs a product")
+		}
+		if seen[rule.Product] {
+			return fmt.Errorf("product %q has more than one rule", rule.Product)
+		}
+		seen[rule.Product] = true
+		if len([]rune(rule.Product)) > 100 {
+			return fmt.Errorf("product %q is longer than 100 characters", rule.Product)
+		}
+		if rule.LifeDays < 0 || rule.PerDay < 0 {
+			return fmt.Errorf("life_days and per_day of %s must not be negative", rule.Product)
+		}
+		if rule.LifeDays > 0 && rule.PerDay > 0 {
+			return fmt.Errorf("%s can use life_days or per_day, not both", rule.Product)
+		}
+		match := []string{}
+		for _, word := range rule.Match {
+			if word = strings.ToLower(strings.TrimSpace(word)); word != "" && !containsString(match, word) {
+				match = append(match, word)
+			}
+		}
+		if len(match) == 0 {
+			match = []string{rule.Product}
+		}
+		rule.Match = match
+	}
+	return nil
+}
+
+// matches reports whether an item description belongs to the rule's
+// product
+func (rule InventoryRule) matches(description string) bool {
+	description = strings.ToLower(description)
+	for _, word := range rule.Match {
+		if strings.Contains(description, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadInventoryRules returns the stored rules of a tenant, falling back to
+// the default tenant's rules
+func loadInventoryRules(tenant string) InventoryRules {
+	for _, key := range []string{tenant, defaultTenant} {
+		var raw []byte
+		err := db.QueryRow("SELECT rules FROM inventory_rules WHERE tenant_key = ?", key).Scan(&raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load inventory rules for %s: %v", key, err)
+			break
+		}
+		var rules InventoryRules
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			log.Printf("Invalid inventory rules for %s: %v", key, err)
+			break
+		}
+		return rules
+	}
+	return InventoryRules{Rules: []InventoryRule{}}
+}
+
+// saveInventoryRules stores the rules of a tenant
+func saveInventoryRules(tenant string, rules InventoryRules) error {
+	raw, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(
+		`INSERT INTO inventory_rules (tenant_key, rules) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE rules = VALUES(rules)`,
+		tenant, raw,
+	); err != nil {
+		return fmt.Errorf("failed to save inventory rules: %v", err)
+	}
+	return nil
+}
+
+// inventoryProduct returns the product an item is stocked as: the first
+// rule it matches, else its own description
+func inventoryProduct(rules InventoryRules, description string) string {
+	for _, rule := range rules.Rules {
+		if rule.matches(description) {
+			return rule.Product
+		}
+	}
+	return strings.ToLower(truncate(description, 100))
+}
+
+// recordInventory adds the purchased items of a transaction to the
+// tenant's inventory, replacing what an earlier analysis added
+func recordInventory(tenant string, receiptID, transactionID int64, date string, items []ReceiptItem) error {
+	purchased := time.Now()
+	if t, err := time.Parse("2006-01-02", date); err == nil {
+		purchased = t
+	}
+	rules := loadInventoryRules(tenant)
+
+	err := inTx("record inventory", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM inventory_ledger WHERE transaction_id = ?", transactionID); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if !normalizeItem(&item) || item.Total < 0 {
+				continue
+			}
+			quantity, unit := itemMeasure(item)
+			if _, err := tx.Exec(
+				`INSERT INTO inventory_ledger (tenant_key, receipt_id, transaction_id, product, description, quantity, unit, purchased_on)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				tenant, receiptID, transactionID, inventoryProduct(rules, item.Name), truncate(item.Name, 500), quantity, unit, purchased,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record inventory of transaction %d: %v", transactionID, err)
+	}
+	return nil
+}
+
+// inventoryPurchase is one purchase of a product
+type inventoryPurchase struct {
+	quantity float64
+	date     time.Time
+}
+
+// InventoryProduct is the stock of one product in one unit
+type InventoryProduct struct {
+	Product string `json:"product"`
+	Unit    string `json:"unit"`
+	// Purchased is the quantity bought between from and to
+	Purchased     float64 `json:"purchased"`
+	Purchases     int     `json:"purchases"`
+	LastPurchased string  `json:"last_purchased"`
+	// OnHand estimates what is left today from the product's rule; nil
+	// without a rule
+	OnHand *float64 `json:"on_hand"`
+	// RunsOutOn is when the estimated stock reaches zero
+	RunsOutOn *string        `json:"runs_out_on"`
+	Rule      *InventoryRule `json:"rule,omitempty"`
+}
+
+// estimateStock returns what is left on now of purchases in date order
+// and the day it runs out
+func estimateStock(rule InventoryRule, purchases []inventoryPurchase, now time.Time) (float64, *time.Time) {
+	days := func(from, to time.Time) float64 { return math.Max(0, to.Sub(from).Hours()/24) }
+	switch {
+	case rule.LifeDays > 0:
+		life := float64(rule.LifeDays)
+		stock := 0.0
+		var last time.Time
+		for _, p := range purchases {
+			if left := 1 - days(p.date, now)/life; left > 0 {
+				stock += p.quantity * left
+				if end := p.date.AddDate(0, 0, rule.LifeDays); end.After(last) {
+					last = end
+				}
+			}
+		}
+		if stock <= 0 {
+			return 0, nil
+		}
+		return stock, &last
+	case rule.PerDay > 0:
+		stock := 0.0
+		for i, p := range purchases {
+			if i > 0 {
+				stock = math.Max(0, stock-rule.PerDay*days(purchases[i-1].date, p.date))
+			}
+			stock += p.quantity
+		}
+		if len(purchases) > 0 {
+			stock = math.Max(0, stock-rule.PerDay*days(purchases[len(purchases)-1].date, now))
+		}
+		if stock <= 0 {
+			return 0, nil
+		}
+		end := now.Add(time.Duration(stock / rule.PerDay * 24 * float64(time.Hour)))
+		return stock, &end
+	}
+	return 0, nil
+}
+
+// loadInventory sums a tenant's purchases per product and unit, leaving
+// out receipts in the trash. Purchased counts [from, to]; the stock
+// estimate uses every purchase up to now.
+func loadInventory(tenant string, from, to time.Time, product string) ([]InventoryProduct, error) {
+	cond, args := "l.tenant_key = ? AND r.deleted_at IS NULL", []any{tenant}
+	if product != "" {
+		cond += " AND l.product = ?"
+		args = append(args, strings.ToLower(strings.TrimSpace(product)))
+	}
+	rows, err := db.Query(
+		`SELECT l.product, l.unit, l.quantity, l.purchased_on
+		FROM inventory_ledger l
+		JOIN receipts r ON r.id = l.receipt_id
+		WHERE `+cond+`
+		ORDER BY l.product, l.unit, l.purchased_on, l.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load inventory: %v", err)
+	}
+	defer rows.Close()
+
+	type key struct{ product, unit string }
+	var order []key
+	products := map[key]*InventoryProduct{}
+	purchases := map[key][]inventoryPurchase{}
+	for rows.Next() {
+		var k key
+		var p inventoryPurchase
+		if err := rows.Scan(&k.product, &k.unit, &p.quantity, &p.date); err != nil {
+			return nil, fmt.Errorf("failed to scan inventory: %v", err)
+		}
+		item, ok := products[k]
+		if !ok {
+			item = &InventoryProduct{Product: k.product, Unit: k.unit}
+			products[k] = item
+			order = append(order, k)
+		}
+		purchases[k] = append(purchases[k], p)
+		item.LastPurchased = p.date.Format("2006-01-02")
+		if !p.date.Before(from) && !p.date.After(to) {
+			item.Purchased += p.quantity
+			item.Purchases++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rules := map[string]InventoryRule{}
+	for _, rule := range loadInventoryRules(tenant).Rules {
+		rules[rule.Product] = rule
+	}
+	now := time.Now()
+	result := []InventoryProduct{}
+	for _, k := range order {
+		item := products[k]
+		item.Purchased = math.Round(item.Purchased*1000) / 1000
+		if rule, ok := rules[k.product]; ok {
+			item.Rule = &rule
+			if rule.LifeDays > 0 || rule.PerDay > 0 {
+				stock, runsOut := estimateStock(rule, purchases[k], now)
+				stock = math.Round(stock*1000) / 1000
+				item.OnHand = &stock
+				if runsOut != nil {
+					s := runsOut.Format("2006-01-02")
+					item.RunsOutOn = &s
+				}
+			}
+		}
+		// Products without purchases in the range are only listed while
+		// some is estimated to be left
+		if item.Purchases == 0 && (item.OnHand == nil || *item.OnHand == 0) {
+			continue
+		}
+		result = append(result, *item)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Purchases > result[j].Purchases })
+	return result, nil
+}
+
+// registerInventoryRoutes adds the household inventory and its rules
+func registerInventoryRoutes(app *fiber.App) {
+	// Products bought between from and to (YYYY-MM-DD, default the last
+	// 90 days), with the stock left for products with a consumption rule
+	app.Get("/inventory", func(c *fiber.Ctx) error {
+		now := time.Now()
+		to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		from := to.AddDate(0, 0, -90)
+		for _, p := range []struct {
+			name string
+			dst  *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if s := c.Query(p.name); s != "" {
+				t, err := time.Parse("2006-01-02", s)
+				if err != nil {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": fmt.Sprintf("Invalid %s date, expected YYYY-MM-DD", p.name),
+					})
+				}
+				*p.dst = t
+			}
+		}
+
+		products, err := loadInventory(tenantKey(c), from, to, c.Query("product"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"from":     from.Format("2006-01-02"),
+			"to":       to.Format("2006-01-02"),
+			"products": products,
+		})
+	})
+
+	app.Get("/inventory/rules", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenant":  tenant,
+			"rules":   loadInventoryRules(tenant).Rules,
+		})
+	})
+
+	// The body replaces all rules; items already recorded keep their
+	// product
+	app.Put("/inventory/rules", func(c *fiber.Ctx) error {
+		var rules InventoryRules
+		if err := json.Unmarshal(c.Body(), &rules); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if rules.Rules == nil {
+			rules.Rules = []InventoryRule{}
+		}
+		if err := rules.normalize(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		tenant := tenantKey(c)
+		if err := saveInventoryRules(tenant, rules); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenant":  tenant,
+			"rules":   rules.Rules,
+		})
+	})
+}
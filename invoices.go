@@ -0,0 +1,632 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// InvoiceMarkup is the markup added on top of expenses: Percent applies to
+// every line unless Categories has a percentage for the line's category
+type InvoiceMarkup struct {
+	Percent    float64            `json:"percent"`
+	Categories map[string]float64 `json:"categories,omitempty"`
+}
+
+// percentFor returns the markup percentage for a category
+func (m InvoiceMarkup) percentFor(category string) float64 {
+	if p, ok := m.Categories[strings.ToLower(category)]; ok {
+		return p
+	}
+	return m.Percent
+}
+
+// InvoiceLine is one billable transaction on an invoice
+type InvoiceLine struct {
+	TransactionID int64   `json:"transaction_id"`
+	ReceiptID     int64   `json:"receipt_id"`
+	Date          *string `json:"date"`
+	Merchant      string  `json:"merchant"`
+	Category      string  `json:"category"`
+	Amount        float64 `json:"amount"`
+	MarkupPercent float64 `json:"markup_percent"`
+	Markup        float64 `json:"markup"`
+	Total         float64 `json:"total"`
+	// CustomFields are the transaction's custom field values
+	CustomFields map[string]any `json:"custom_fields,omitempty"`
+	// Receipt is the attachment's file name inside the ZIP bundle
+	Receipt string `json:"receipt"`
+
+	fileName       string
+	storageBackend string
+}
+
+// Invoice is a draft or billed client invoice for a project's expenses.
+// Amounts are in the home currency.
+type Invoice struct {
+	ID        int64         `json:"id,omitempty"`
+	Number    string        `json:"number,omitempty"`
+	ProjectID int64         `json:"project_id"`
+	Project   string        `json:"project"`
+	Client    string        `json:"client"`
+	Currency  string        `json:"currency"`
+	Markup    InvoiceMarkup `json:"markup"`
+	Lines     []InvoiceLine `json:"lines"`
+	Subtotal  float64       `json:"subtotal"`
+	MarkupSum float64       `json:"markup_total"`
+	Total     float64       `json:"total"`
+	// Skipped counts transactions left off because they have no amount in
+	// the home currency yet
+	Skipped  int     `json:"skipped_pending_conversion"`
+	Draft    bool    `json:"draft"`
+	BilledAt *string `json:"billed_at"`
+}
+
+// loadInvoiceLines loads a project's unbilled transactions of processed
+// receipts (invoiceID 0) or the transactions billed on an invoice, which
+// may have been archived since, and prices them with the markup
+func loadInvoiceLines(inv *Invoice, invoiceID int64) error {
+	cond, arg := "t.project_id = ? AND t.invoice_id IS NULL AND r.status = 'processed'", any(inv.ProjectID)
+	if invoiceID != 0 {
+		cond, arg = "t.invoice_id = ?", invoiceID
+	}
+	rows, err := db.Query(
+		`SELECT t.id, t.receipt_id, t.date, COALESCE(t.merchant_clean, t.merchant_raw, ''), COALESCE(t.category, ''),
+			t.home_amount, t.custom_fields, r.file_name, r.storage_backend
+		FROM `+transactionsAllView+` t
+		JOIN receipts r ON r.id = t.receipt_id
+		WHERE `+cond+`
+		ORDER BY t.date, t.id`,
+		arg,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to load invoice lines: %v", err)
+	}
+	defer rows.Close()
+
+	inv.Lines = []InvoiceLine{}
+	for rows.Next() {
+		var l InvoiceLine
+		var date sql.NullTime
+		var amount sql.NullFloat64
+		var custom []byte
+		if err := rows.Scan(&l.TransactionID, &l.ReceiptID, &date, &l.Merchant, &l.Category, &amount,
+			&custom, &l.fileName, &l.storageBackend); err != nil {
+			return fmt.Errorf("failed to scan invoice line: %v", err)
+		}
+		if !amount.Valid {
+			inv.Skipped++
+			continue
+		}
+		l.Date = formatNullDate(date)
+		l.CustomFields = decodeCustomFields(custom)
+		l.Amount = roundCents(amount.Float64)
+		l.MarkupPercent = inv.Markup.percentFor(l.Category)
+		l.Markup = roundCents(l.Amount * l.MarkupPercent / 100)
+		l.Total = roundCents(l.Amount + l.Markup)
+		l.Receipt = fmt.Sprintf("receipts/%d_%s", l.TransactionID, path.Base(l.fileName))
+		inv.Lines = append(inv.Lines, l)
+		inv.Subtotal += l.Amount
+		inv.MarkupSum += l.Markup
+	}
+	inv.Subtotal = roundCents(inv.Subtotal)
+	inv.MarkupSum = roundCents(inv.MarkupSum)
+	inv.Total = roundCents(inv.Subtotal + inv.MarkupSum)
+	return rows.Err()
+}
+
+// invoiceMarkupFromQuery reads markup (percent) and category_markups
+// ("travel:0,meals:15") from the query string
+func invoiceMarkupFromQuery(c *fiber.Ctx) (InvoiceMarkup, error) {
+	var m InvoiceMarkup
+	if v := c.Query("markup"); v != "" {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 {
+			return m, fmt.Errorf("markup must be a non-negative percentage")
+		}
+		m.Percent = p
+	}
+	if v := c.Query("category_markups"); v != "" {
+		m.Categories = make(map[string]float64)
+		for _, part := range strings.Split(v, ",") {
+			category, value, ok := strings.Cut(part, ":")
+			p, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if !ok || err != nil || p < 0 {
+				return m, fmt.Errorf("category_markups must look like travel:0,meals:15")
+			}
+			m.Categories[strings.ToLower(strings.TrimSpace(category))] = p
+		}
+	}
+	return m, nil
+}
+
+// renderInvoiceCSV writes one row per line plus totals
+func renderInvoiceCSV(inv *Invoice) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(append([]string{"Date", "Merchant", "Category", "Amount", "Markup %", "Markup", "Total", "Currency", "Receipt"},
+		customFieldHeaders()...))
+	for _, l := range inv.Lines {
+		date := ""
+		if l.Date != nil {
+			date = *l.Date
+		}
+		w.Write(append([]string{
+			date, l.Merchant, l.Category,
+			strconv.FormatFloat(l.Amount, 'f', 2, 64),
+			strconv.FormatFloat(l.MarkupPercent, 'f', -1, 64),
+			strconv.FormatFloat(l.Markup, 'f', 2, 64),
+			strconv.FormatFloat(l.Total, 'f', 2, 64),
+			inv.Currency, l.Receipt,
+		}, customFieldCells(l.CustomFields)...))
+	}
+	w.Write([]string{"", "Total", "",
+		strconv.FormatFloat(inv.Subtotal, 'f', 2, 64), "",
+		strconv.FormatFloat(inv.MarkupSum, 'f', 2, 64),
+		strconv.FormatFloat(inv.Total, 'f', 2, 64),
+		inv.Currency, "",
+	})
+	w.Flush()
+	return buf.Bytes()
+}
+
+// invoiceTextLines lays the invoice out as fixed-width text for the PDF
+func invoiceTextLines(inv *Invoice) []string {
+	title := "INVOICE DRAFT"
+	if !inv.Draft {
+		title = "INVOICE " + inv.Number
+	}
+	lines := []string{
+		title,
+		"",
+		"Client:  " + inv.Client,
+		"Project: " + inv.Project,
+		"Date:    " + time.Now().Format("2006-01-02"),
+		"",
+		fmt.Sprintf("%-10s  %-24s  %-14s  %10s  %9s  %10s", "Date", "Merchant", "Category", "Amount", "Markup", "Total"),
+		strings.Repeat("-", 86),
+	}
+	for _, l := range inv.Lines {
+		date := ""
+		if l.Date != nil {
+			date = *l.Date
+		}
+		lines = append(lines, fmt.Sprintf("%-10s  %-24s  %-14s  %10.2f  %9.2f  %10.2f",
+			date, truncate(l.Merchant, 24), truncate(l.Category, 14), l.Amount, l.Markup, l.Total))
+	}
+	lines = append(lines,
+		strings.Repeat("-", 86),
+		fmt.Sprintf("%-54s  %10.2f  %9.2f  %10.2f", "Total ("+inv.Currency+")", inv.Subtotal, inv.MarkupSum, inv.Total),
+	)
+	return lines
+}
+
+// pdfEscape makes text safe for a PDF string in a WinAnsi-encoded font
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '…':
+			// truncate's ellipsis, kept one character wide
+			b.WriteByte('.')
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+// renderInvoicePDF writes the invoice as a plain A4 PDF in Courier so the
+// columns line up, without needing a PDF library
+func renderInvoicePDF(inv *Invoice) []byte {
+	const linesPerPage = 60
+	text := invoiceTextLines(inv)
+	var pages [][]string
+	for len(text) > 0 {
+		n := min(linesPerPage, len(text))
+		pages = append(pages, text[:n])
+		text = text[n:]
+	}
+
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 9 Tf 12 TL 40 800 Td\n")
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// checkInvoiceFormat rejects formats renderInvoice cannot produce
+func checkInvoiceFormat(format string) error {
+	if format != "json" && format != "csv" && format != "pdf" {
+		return fmt.Errorf("format must be json, csv or pdf")
+	}
+	return nil
+}
+
+// renderInvoice encodes an invoice as json, csv or pdf
+func renderInvoice(inv *Invoice, format string) ([]byte, string, error) {
+	switch format {
+	case "json":
+		body, err := json.MarshalIndent(inv, "", "  ")
+		return body, "application/json", err
+	case "csv":
+		return renderInvoiceCSV(inv), "text/csv; charset=utf-8", nil
+	case "pdf":
+		return renderInvoicePDF(inv), "application/pdf", nil
+	}
+	return nil, "", checkInvoiceFormat(format)
+}
+
+// writeInvoiceBundle writes a ZIP with the rendered invoice and the receipt
+// file of every line
+func writeInvoiceBundle(w io.Writer, inv *Invoice, name string, rendered []byte) error {
+	zw := zip.NewWriter(w)
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(rendered); err != nil {
+		return err
+	}
+	for _, l := range inv.Lines {
+		if err := addReceiptFile(zw, l.storageBackend, l.fileName, l.Receipt); err != nil {
+			log.Printf("Invoice: skipping receipt for transaction %d: %v", l.TransactionID, err)
+		}
+	}
+	return zw.Close()
+}
+
+// sendInvoice renders an invoice in the requested format (default json),
+// bundled with the receipt files when attachments=true
+func sendInvoice(c *fiber.Ctx, inv *Invoice) error {
+	format := c.Query("format", "json")
+	rendered, contentType, err := renderInvoice(inv, format)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	base := fmt.Sprintf("invoice-project-%d-draft", inv.ProjectID)
+	if !inv.Draft {
+		base = "invoice-" + inv.Number
+	}
+	if !c.QueryBool("attachments") {
+		if format == "json" {
+			return c.JSON(fiber.Map{
+				"success": true,
+				"invoice": inv,
+			})
+		}
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, base, format))
+		return c.Send(rendered)
+	}
+
+	var buf bytes.Buffer
+	if err := writeInvoiceBundle(&buf, inv, base+"."+format, rendered); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to build invoice bundle: %v", err),
+		})
+	}
+	c.Set("Content-Type", "application/zip")
+	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, base))
+	return c.Send(buf.Bytes())
+}
+
+// loadInvoice loads a billed invoice with its lines. The totals are the
+// ones billed, even if a line was corrected since.
+func loadInvoice(id int64) (*Invoice, error) {
+	inv := &Invoice{ID: id, Currency: homeCurrency()}
+	var markup []byte
+	var billedAt time.Time
+	var subtotal, markupSum, total float64
+	err := db.QueryRow(
+		`SELECT i.number, i.project_id, p.name, COALESCE(p.client, ''), i.markup, i.subtotal, i.markup_total, i.total, i.billed_at
+		FROM invoices i JOIN projects p ON p.id = i.project_id
+		WHERE i.id = ?`,
+		id,
+	).Scan(&inv.Number, &inv.ProjectID, &inv.Project, &inv.Client, &markup, &subtotal, &markupSum, &total, &billedAt)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(markup, &inv.Markup)
+	formatted := billedAt.Format(time.RFC3339)
+	inv.BilledAt = &formatted
+	if err := loadInvoiceLines(inv, id); err != nil {
+		return nil, err
+	}
+	inv.Subtotal, inv.MarkupSum, inv.Total = subtotal, markupSum, total
+	return inv, nil
+}
+
+// registerInvoiceRoutes adds client invoicing of billable project expenses
+func registerInvoiceRoutes(app *fiber.App) {
+	// Draft invoice of a billable project's unbilled transactions. Nothing
+	// is marked billed; query options: format (json, csv, pdf), markup,
+	// category_markups and attachments.
+	app.Get("/projects/:id/invoice", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid project ID",
+			})
+		}
+		p, err := loadProject(int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Project not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project: %v", err),
+			})
+		}
+		if !p.Billable {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Project is not billable",
+			})
+		}
+		markup, err := invoiceMarkupFromQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		inv := &Invoice{
+			ProjectID: p.ID,
+			Project:   p.Name,
+			Client:    p.Client,
+			Currency:  homeCurrency(),
+			Markup:    markup,
+			Draft:     true,
+		}
+		if err := loadInvoiceLines(inv, 0); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return sendInvoice(c, inv)
+	})
+
+	// Bill the current draft: the transactions are linked to a new invoice
+	// so they cannot be invoiced again. Takes the same query options as the
+	// draft plus an optional invoice number.
+	app.Post("/projects/:id/invoice", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid project ID",
+			})
+		}
+		p, err := loadProject(int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Project not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project: %v", err),
+			})
+		}
+		if !p.Billable {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Project is not billable",
+			})
+		}
+		markup, err := invoiceMarkupFromQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		// An unknown format would only show once the invoice is saved
+		if err := checkInvoiceFormat(c.Query("format", "json")); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		inv := &Invoice{
+			ProjectID: p.ID,
+			Project:   p.Name,
+			Client:    p.Client,
+			Currency:  homeCurrency(),
+			Markup:    markup,
+		}
+		if err := loadInvoiceLines(inv, 0); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if len(inv.Lines) == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "No unbilled transactions to invoice",
+			})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to start transaction: %v", err),
+			})
+		}
+		defer tx.Rollback()
+
+		markupJSON, _ := json.Marshal(markup)
+		result, err := tx.Exec(
+			"INSERT INTO invoices (project_id, number, markup, subtotal, markup_total, total) VALUES (?, ?, ?, ?, ?, ?)",
+			p.ID, sql.NullString{String: c.Query("number"), Valid: c.Query("number") != ""}, markupJSON,
+			inv.Subtotal, inv.MarkupSum, inv.Total,
+		)
+		if isDuplicateKeyError(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invoice number %q is already taken", c.Query("number")),
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save invoice: %v", err),
+			})
+		}
+		inv.ID, _ = result.LastInsertId()
+		inv.Number = c.Query("number")
+		if inv.Number == "" {
+			inv.Number = fmt.Sprintf("INV-%s-%04d", time.Now().Format("2006"), inv.ID)
+			if _, err := tx.Exec("UPDATE invoices SET number = ? WHERE id = ?", inv.Number, inv.ID); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to number invoice: %v", err),
+				})
+			}
+		}
+
+		for _, l := range inv.Lines {
+			// The invoice_id check catches transactions billed concurrently
+			result, err := tx.Exec(
+				"UPDATE transactions SET invoice_id = ?, billed_at = NOW() WHERE id = ? AND invoice_id IS NULL",
+				inv.ID, l.TransactionID,
+			)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to mark transaction %d billed: %v", l.TransactionID, err),
+				})
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": fmt.Sprintf("Transaction %d was billed in the meantime", l.TransactionID),
+				})
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save invoice: %v", err),
+			})
+		}
+
+		billedAt := time.Now().Format(time.RFC3339)
+		inv.BilledAt = &billedAt
+		c.Status(fiber.StatusCreated)
+		return sendInvoice(c, inv)
+	})
+
+	// Download a billed invoice again (format and attachments as above)
+	app.Get("/invoices/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid invoice ID",
+			})
+		}
+		inv, err := loadInvoice(int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Invoice not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load invoice: %v", err),
+			})
+		}
+		return sendInvoice(c, inv)
+	})
+
+	// Void an invoice so its transactions can be billed again
+	app.Delete("/invoices/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid invoice ID",
+			})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to start transaction: %v", err),
+			})
+		}
+		defer tx.Rollback()
+
+		// Billed transactions may have been archived since
+		var released int64
+		for _, table := range []string{"transactions", "transactions_archive"} {
+			result, err := tx.Exec("UPDATE "+table+" SET invoice_id = NULL, billed_at = NULL WHERE invoice_id = ?", id)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to release transactions: %v", err),
+				})
+			}
+			n, _ := result.RowsAffected()
+			released += n
+		}
+		result, err := tx.Exec("DELETE FROM invoices WHERE id = ?", id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to delete invoice: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Invoice not found",
+			})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to void invoice: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"released": released,
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Canonical units line item quantities are converted to
+const (
+	unitKilogram = "kg"
+	unitLiter    = "l"
+	unitPieces   = "pcs"
+)
+
+// itemUnit converts a printed unit to a canonical one
+type itemUnit struct {
+	base   string
+	factor float64
+}
+
+// itemUnits maps printed units to canonical ones
+var itemUnits = map[string]itemUnit{
+	"kg":     {unitKilogram, 1},
+	"kilo":   {unitKilogram, 1},
+	"g":      {unitKilogram, 0.001},
+	"gr":     {unitKilogram, 0.001},
+	"mg":     {unitKilogram, 0.000001},
+	"lb":     {unitKilogram, 0.45359237},
+	"lbs":    {unitKilogram, 0.45359237},
+	"oz":     {unitKilogram, 0.028349523125},
+	"l":      {unitLiter, 1},
+	"ltr":    {unitLiter, 1},
+	"liter":  {unitLiter, 1},
+	"litre":  {unitLiter, 1},
+	"liters": {unitLiter, 1},
+	"litres": {unitLiter, 1},
+	"dl":     {unitLiter, 0.1},
+	"cl":     {unitLiter, 0.01},
+	"ml":     {unitLiter, 0.001},
+	"fl oz":  {unitLiter, 0.0295735295625},
+	"gal":    {unitLiter, 3.785411784},
+	"pcs":    {unitPieces, 1},
+	"pc":     {unitPieces, 1},
+	"piece":  {unitPieces, 1},
+	"pieces": {unitPieces, 1},
+	"ea":     {unitPieces, 1},
+	"each":   {unitPieces, 1},
+	"st":     {unitPieces, 1},
+	"stk":    {unitPieces, 1},
+	"x":      {unitPieces, 1},
+	"un":     {unitPieces, 1},
+}
+
+// measurePattern finds an amount with a weight or volume unit such as
+// 1,5 kg, 500g or a multipack like 6x330ml. Longer units come first so
+// ml isn't read as m.
+var measurePattern = regexp.MustCompile(
+	`(?i)(?:(\d+)\s*[x×*]\s*)?(\d+(?:[.,]\d+)?)\s*(fl\.?\s?oz|kilo|kg|mg|gr|g|lbs|lb|oz|ltr|liters|litres|liter|litre|dl|cl|ml|l|gal)\b`)
+
+// lookupUnit returns the canonical unit of a printed unit
+func lookupUnit(s string) (itemUnit, bool) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	s = strings.Join(strings.Fields(strings.ReplaceAll(s, ".", " ")), " ")
+	u, ok := itemUnits[s]
+	return u, ok
+}
+
+// parseMeasure finds the first weight or volume in s and returns it in
+// kilograms or liters. A decimal comma is accepted.
+func parseMeasure(s string) (float64, string, bool) {
+	m := measurePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, "", false
+	}
+	amount, err := strconv.ParseFloat(strings.Replace(m[2], ",", ".", 1), 64)
+	if err != nil || amount <= 0 {
+		return 0, "", false
+	}
+	if m[1] != "" {
+		count, _ := strconv.Atoi(m[1])
+		if count > 0 {
+			amount *= float64(count)
+		}
+	}
+	u, ok := lookupUnit(m[3])
+	if !ok {
+		return 0, "", false
+	}
+	return amount * u.factor, u.base, true
+}
+
+// itemMeasure returns the canonical quantity and unit of a line item.
+// Weighed items use their quantity and unit; counted items are measured by
+// the package size, from the size field or the name, and otherwise stay
+// pieces.
+func itemMeasure(item ReceiptItem) (float64, string) {
+	quantity := item.Quantity
+	if quantity <= 0 {
+		quantity = 1
+	}
+	round := func(v float64) float64 { return math.Round(v*10000) / 10000 }
+	if u, ok := lookupUnit(item.Unit); ok && u.base != unitPieces {
+		return round(quantity * u.factor), u.base
+	}
+	for _, s := range []string{item.Size, item.Unit, item.Name} {
+		if amount, base, ok := parseMeasure(s); ok {
+			return round(quantity * amount), base
+		}
+	}
+	return quantity, unitPieces
+}
+
+// unitPrice returns the price of one canonical unit, e.g. per kg
+func unitPrice(total, quantity float64) float64 {
+	return math.Round(total/quantity*10000) / 10000
+}
+
+// normalizeStoredItemUnits measures line items stored before units were
+// normalized, from their quantity and description
+func normalizeStoredItemUnits() error {
+	for {
+		rows, err := db.Query(
+			`SELECT id, COALESCE(description, ''), COALESCE(unit, ''), quantity, total
+			FROM transaction_items WHERE canonical_unit IS NULL LIMIT 1000`,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to load line items to measure: %v", err)
+		}
+		type measured struct {
+			id              int64
+			quantity, price float64
+			unit            string
+		}
+		var batch []measured
+		for rows.Next() {
+			var id int64
+			var item ReceiptItem
+			if err := rows.Scan(&id, &item.Name, &item.Unit, &item.Quantity, &item.Total); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan line item: %v", err)
+			}
+			quantity, unit := itemMeasure(item)
+			batch = append(batch, measured{id, quantity, unitPrice(item.Total, quantity), unit})
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, m := range batch {
+			if _, err := db.Exec(
+				"UPDATE transaction_items SET canonical_quantity = ?, canonical_unit = ?, price_per_unit = ? WHERE id = ?",
+				m.quantity, m.unit, m.price, m.id,
+			); err != nil {
+				return fmt.Errorf("failed to measure line item %d: %v", m.id, err)
+			}
+		}
+	}
+}
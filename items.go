@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxTransactionItems caps the line items stored for one transaction
+const maxTransactionItems = 200
+
+// ReceiptItem is a purchased line item as extracted by Gemini
+type ReceiptItem struct {
+	Name string `json:"name"`
+	// Barcode is the EAN/UPC code when the receipt prints one
+	Barcode  string  `json:"barcode"`
+	Quantity float64 `json:"quantity"`
+	// Unit is the unit of the quantity as printed, e.g. kg for weighed
+	// items; empty for counted items
+	Unit string `json:"unit"`
+	// Size is the package size of a counted item, e.g. 500 g
+	Size      string  `json:"size"`
+	UnitPrice float64 `json:"unit_price"`
+	// Total is the line total after quantity and line discounts
+	Total    float64 `json:"total"`
+	Category string  `json:"category"`
+}
+
+// TransactionItem is a stored line item of a transaction
+type TransactionItem struct {
+	ID          int64    `json:"id"`
+	Description *string  `json:"description"`
+	Barcode     *string  `json:"barcode,omitempty"`
+	Quantity    float64  `json:"quantity"`
+	Unit        *string  `json:"unit"`
+	UnitPrice   *float64 `json:"unit_price"`
+	Total       float64  `json:"total"`
+	Category    *string  `json:"category"`
+	// CanonicalQuantity is the quantity in CanonicalUnit (kg, l or pcs)
+	// and PricePerUnit the price of one of those units
+	CanonicalQuantity *float64 `json:"canonical_quantity"`
+	CanonicalUnit     *string  `json:"canonical_unit"`
+	PricePerUnit      *float64 `json:"price_per_unit"`
+}
+
+// lineItemsPrompt asks Gemini for the purchased line items
+func lineItemsPrompt(prompt string) string {
+	return prompt + "\n\nAlso include an \"items\" array in the same JSON object with one entry per purchased line item: " +
+		"name (as printed), barcode (EAN/UPC digits if printed, else null), quantity (number, 1 if not shown), " +
+		"unit (unit of the quantity for weighed or measured items, e.g. kg, g, l, else null), " +
+		"size (package size if printed, e.g. 500 g or 6x330 ml, else null), " +
+		"unit_price (number, price of one unit), total (number, line total after line discounts) " +
+		"and category (spending category of the item, e.g. groceries, household, alcohol). " +
+		"Do not list subtotals, taxes, tips, deposits returned or payment lines as items."
+}
+
+// normalizeItem fills in quantity, unit price or total from the others and
+// reports whether the item is usable
+func normalizeItem(item *ReceiptItem) bool {
+	item.Name = strings.TrimSpace(item.Name)
+	if item.Name == "" {
+		return false
+	}
+	if item.Quantity <= 0 {
+		item.Quantity = 1
+	}
+	if item.Total == 0 && item.UnitPrice != 0 {
+		item.Total = roundCents(item.UnitPrice * item.Quantity)
+	}
+	if item.UnitPrice == 0 && item.Total != 0 {
+		item.UnitPrice = roundCents(item.Total / item.Quantity)
+	}
+	return item.Total != 0
+}
+
+// saveTransactionItems replaces the stored line items of a transaction
+func saveTransactionItems(receiptID, transactionID int64, items []ReceiptItem) error {
+	if len(items) > maxTransactionItems {
+		items = items[:maxTransactionItems]
+	}
+	err := inTx("save line items", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM transaction_items WHERE transaction_id = ?", transactionID); err != nil {
+			return err
+		}
+		for i, item := range items {
+			if !normalizeItem(&item) {
+				continue
+			}
+			quantity, unit := itemMeasure(item)
+			if len(item.Name) > 500 {
+				item.Name = item.Name[:500]
+			}
+			if len(item.Unit) > 16 {
+				item.Unit = item.Unit[:16]
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO transaction_items (transaction_id, receipt_id, position, description, barcode, quantity, unit, unit_price, total, category,
+					canonical_quantity, canonical_unit, price_per_unit)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				transactionID, receiptID, i+1, item.Name, sql.NullString{String: item.Barcode, Valid: item.Barcode != ""},
+				item.Quantity, sql.NullString{String: item.Unit, Valid: item.Unit != ""}, item.UnitPrice, item.Total,
+				sql.NullString{String: strings.ToLower(item.Category), Valid: item.Category != ""},
+				quantity, unit, unitPrice(item.Total, quantity),
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save line items of transaction %d: %v", transactionID, err)
+	}
+	return nil
+}
+
+// loadTransactionItems returns the line items of the given transactions
+// keyed by transaction ID
+func loadTransactionItems(transactionIDs []int64) (map[int64][]TransactionItem, error) {
+	result := make(map[int64][]TransactionItem)
+	if len(transactionIDs) == 0 {
+		return result, nil
+	}
+	args := make([]any, len(transactionIDs))
+	for i, id := range transactionIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(
+		`SELECT id, transaction_id, description, barcode, quantity, unit, unit_price, total, category,
+			canonical_quantity, canonical_unit, price_per_unit
+		FROM transaction_items
+		WHERE transaction_id IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")+`)
+		ORDER BY transaction_id, position, id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load line items: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var it TransactionItem
+		var transactionID int64
+		var description, barcode, unit, category, canonicalUnit sql.NullString
+		var price, canonicalQuantity, pricePerUnit sql.NullFloat64
+		if err := rows.Scan(&it.ID, &transactionID, &description, &barcode, &it.Quantity, &unit, &price, &it.Total, &category,
+			&canonicalQuantity, &canonicalUnit, &pricePerUnit); err != nil {
+			return nil, fmt.Errorf("failed to scan line item: %v", err)
+		}
+		it.Description = nullStringPtr(description)
+		it.Barcode = nullStringPtr(barcode)
+		it.Unit = nullStringPtr(unit)
+		it.UnitPrice = nullFloatPtr(price)
+		it.Category = nullStringPtr(category)
+		it.CanonicalQuantity = nullFloatPtr(canonicalQuantity)
+		it.CanonicalUnit = nullStringPtr(canonicalUnit)
+		it.PricePerUnit = nullFloatPtr(pricePerUnit)
+		result[transactionID] = append(result[transactionID], it)
+	}
+	return result, rows.Err()
+}
+
+// registerItemRoutes adds the line items of a transaction
+func registerItemRoutes(app *fiber.App) {
+	// Archived transactions keep their items
+	app.Get("/transactions/:id/items", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+
+		var currency sql.NullString
+		var total sql.NullFloat64
+		err = db.QueryRow("SELECT currency, amount FROM "+transactionsAllView+" WHERE id = ?", id).Scan(&currency, &total)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Transaction not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transaction: %v", err),
+			})
+		}
+
+		byTransaction, err := loadTransactionItems([]int64{int64(id)})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		items := byTransaction[int64(id)]
+		if items == nil {
+			items = []TransactionItem{}
+		}
+		itemsTotal := 0.0
+		for _, it := range items {
+			itemsTotal = roundCents(itemsTotal + it.Total)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"transaction_id": id,
+			"currency":       nullStringPtr(currency),
+			"amount":         nullFloatPtr(total),
+			"items_total":    itemsTotal,
+			"items":          items,
+		})
+	})
+}
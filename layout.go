@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// layoutColumnTolerance is how far (share of the page width) the right
+// edge of a price may be left of the rightmost price and still count as
+// part of the price column
+const layoutColumnTolerance = 0.08
+
+// layoutAmountTolerance is the difference below which amounts agree
+const layoutAmountTolerance = 0.01
+
+// hocrBox is the bounding box of an hOCR element: left, top, right, bottom
+type hocrBox [4]int
+
+// hocrWord is a recognised word and where it was found
+type hocrWord struct {
+	Text string
+	Box  hocrBox
+}
+
+// hocrLine is a line of words, left to right
+type hocrLine struct {
+	Box   hocrBox
+	Words []hocrWord
+}
+
+// hocrLineClasses are the hOCR classes Tesseract uses for lines of text
+var hocrLineClasses = map[string]bool{
+	"ocr_line":      true,
+	"ocr_header":    true,
+	"ocr_caption":   true,
+	"ocr_textfloat": true,
+}
+
+// parseHOCRBox reads the bbox property of an hOCR title attribute
+func parseHOCRBox(title string) (hocrBox, bool) {
+	var b hocrBox
+	for _, prop := range strings.Split(title, ";") {
+		fields := strings.Fields(prop)
+		if len(fields) != 5 || fields[0] != "bbox" {
+			continue
+		}
+		for i := range b {
+			v, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return b, false
+			}
+			b[i] = v
+		}
+		return b, true
+	}
+	return b, false
+}
+
+// parseHOCR reads the lines and words of Tesseract's hOCR output and the
+// width of the page
+func parseHOCR(hocr string) ([]hocrLine, int, error) {
+	d := xml.NewDecoder(strings.NewReader(hocr))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var lines []hocrLine
+	pageWidth := 0
+	depth, wordDepth := 0, 0
+	var word *hocrWord
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to parse hOCR: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			var class, title string
+			for _, a := range t.Attr {
+				switch a.Name.Local {
+				case "class":
+					class = a.Value
+				case "title":
+					title = a.Value
+				}
+			}
+			box, ok := parseHOCRBox(title)
+			if !ok {
+				continue
+			}
+			switch {
+			case class == "ocr_page":
+				pageWidth = box[2] - box[0]
+			case hocrLineClasses[class]:
+				lines = append(lines, hocrLine{Box: box})
+			case class == "ocrx_word" && len(lines) > 0:
+				word, wordDepth = &hocrWord{Box: box}, depth
+			}
+		case xml.CharData:
+			if word != nil {
+				word.Text += string(t)
+			}
+		case xml.EndElement:
+			if word != nil && depth == wordDepth {
+				if text := strings.TrimSpace(word.Text); text != "" {
+					word.Text = text
+					last := &lines[len(lines)-1]
+					last.Words = append(last.Words, *word)
+				}
+				word = nil
+			}
+			depth--
+		}
+	}
+	for i := range lines {
+		sort.SliceStable(lines[i].Words, func(a, b int) bool { return lines[i].Words[a].Box[0] < lines[i].Words[b].Box[0] })
+	}
+	return lines, pageWidth, nil
+}
+
+// layoutPricePattern matches a printed amount with two decimals, optionally
+// with a currency symbol, thousands separators, a trailing minus for
+// discounts and a trailing tax code such as A or *
+var layoutPricePattern = regexp.MustCompile(`^(-)?[^\d\s-]{0,3}(\d{1,3}(?:[.,' ]\d{3})+|\d+)[.,](\d{2})(-)?[A-Z*]{0,2}$`)
+
+// parseLayoutPrice reads a word printed in the price column
+func parseLayoutPrice(word string) (float64, bool) {
+	m := layoutPricePattern.FindStringSubmatch(word)
+	if m == nil {
+		return 0, false
+	}
+	whole := strings.NewReplacer(".", "", ",", "", "'", "", " ", "").Replace(m[2])
+	v, err := strconv.ParseFloat(whole+"."+m[3], 64)
+	if err != nil {
+		return 0, false
+	}
+	if m[1] != "" || m[4] != "" {
+		v = -v
+	}
+	return v, true
+}
+
+// LayoutPrice is an amount found in the rightmost column of the receipt
+// with the text printed left of it on the same line
+type LayoutPrice struct {
+	Label  string  `json:"label"`
+	Amount float64 `json:"amount"`
+}
+
+// layoutPrices returns the amounts of the price column: the last word of
+// each line that reads as an amount and is aligned with the rightmost
+// amount on the receipt
+func layoutPrices(lines []hocrLine, pageWidth int) []LayoutPrice {
+	type candidate struct {
+		price LayoutPrice
+		right int
+	}
+	var candidates []candidate
+	right := 0
+	for _, line := range lines {
+		if len(line.Words) < 2 {
+			continue
+		}
+		last := line.Words[len(line.Words)-1]
+		amount, ok := parseLayoutPrice(last.Text)
+		if !ok {
+			continue
+		}
+		label := make([]string, 0, len(line.Words)-1)
+		for _, w := range line.Words[:len(line.Words)-1] {
+			label = append(label, w.Text)
+		}
+		candidates = append(candidates, candidate{LayoutPrice{strings.Join(label, " "), amount}, last.Box[2]})
+		if last.Box[2] > right {
+			right = last.Box[2]
+		}
+	}
+
+	tolerance := int(float64(pageWidth) * layoutColumnTolerance)
+	prices := []LayoutPrice{}
+	for _, c := range candidates {
+		if c.right >= right-tolerance {
+			prices = append(prices, c.price)
+		}
+	}
+	return prices
+}
+
+// Labels of the summary lines, lowercase
+var (
+	layoutTotalLabels    = []string{"total", "summe", "gesamt", "amount due", "balance due", "to pay", "zu zahlen", "montant", "importe"}
+	layoutSubtotalLabels = []string{"subtotal", "sub total", "sub-total", "zwischensumme", "sous-total"}
+	// layoutNotTotalLabels mark lines that mention a total but are not
+	// the amount paid
+	layoutNotTotalLabels = []string{"tax", "vat", "mwst", "saving", "discount", "items", "qty", "tip"}
+)
+
+// containsAny reports whether s contains one of the substrings
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// LayoutDisagreement is an amount Gemini read differently from the price
+// column
+type LayoutDisagreement struct {
+	Field   string   `json:"field"`
+	Gemini  float64  `json:"gemini"`
+	Layout  *float64 `json:"layout"`
+	Message string   `json:"message"`
+}
+
+// LayoutCheck compares Gemini's amounts with the price column of the hOCR
+// layout
+type LayoutCheck struct {
+	Prices        []LayoutPrice        `json:"prices"`
+	Total         *float64             `json:"total"`
+	Subtotal      *float64             `json:"subtotal"`
+	Disagreements []LayoutDisagreement `json:"disagreements"`
+}
+
+// checkLayout reads the price column from the hOCR layout and flags the
+// total, subtotal and line item totals that Gemini read differently.
+// Without a price column there is nothing to compare and no disagreement.
+func checkLayout(hocr string, data *GeminiParsedData) (*LayoutCheck, error) {
+	lines, pageWidth, err := parseHOCR(hocr)
+	if err != nil {
+		return nil, err
+	}
+	check := &LayoutCheck{Prices: layoutPrices(lines, pageWidth), Disagreements: []LayoutDisagreement{}}
+	if len(check.Prices) == 0 {
+		return check, nil
+	}
+
+	// The first total and subtotal lines are taken; payment and change
+	// lines usually follow them
+	for _, p := range check.Prices {
+		label := strings.ToLower(p.Label)
+		switch {
+		case containsAny(label, layoutSubtotalLabels):
+			if check.Subtotal == nil {
+				check.Subtotal = floatPtr(p.Amount)
+			}
+		case containsAny(label, layoutTotalLabels) && !containsAny(label, layoutNotTotalLabels):
+			if check.Total == nil {
+				check.Total = floatPtr(p.Amount)
+			}
+		}
+	}
+
+	disagree := func(field string, gemini float64, layout *float64, message string) {
+		check.Disagreements = append(check.Disagreements, LayoutDisagreement{field, gemini, layout, message})
+	}
+	if check.Total != nil && math.Abs(*check.Total-data.Amount) >= layoutAmountTolerance {
+		disagree("amount", data.Amount, check.Total,
+			fmt.Sprintf("amount %.2f differs from the total %.2f printed in the price column", data.Amount, *check.Total))
+	}
+	if check.Subtotal != nil && data.Subtotal != 0 && math.Abs(*check.Subtotal-data.Subtotal) >= layoutAmountTolerance {
+		disagree("subtotal", data.Subtotal, check.Subtotal,
+			fmt.Sprintf("subtotal %.2f differs from the subtotal %.2f printed in the price column", data.Subtotal, *check.Subtotal))
+	}
+
+	// Every item total must be printed in the price column; each printed
+	// amount matches one item only
+	used := make([]bool, len(check.Prices))
+	for i, item := range data.Items {
+		if item.Total == 0 {
+			continue
+		}
+		found := false
+		for j, p := range check.Prices {
+			if !used[j] && math.Abs(p.Amount-item.Total) < layoutAmountTolerance {
+				used[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			disagree(fmt.Sprintf("items[%d].total", i), item.Total, nil,
+				fmt.Sprintf("%s: total %.2f is not printed in the price column", item.Name, item.Total))
+		}
+	}
+	return check, nil
+}
+
+// registerLayoutRoutes adds the stored hOCR layout and layout check of a
+// receipt
+func registerLayoutRoutes(app *fiber.App) {
+	// Tesseract's hOCR output, as a download so a browser never renders it
+	app.Get("/receipts/:id/hocr", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		hocr, found, err := loadArtifact(int64(id), artifactHOCR)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No hOCR stored for this receipt",
+			})
+		}
+		c.Set("Content-Type", "text/html; charset=utf-8")
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="receipt-%d.hocr"`, id))
+		c.Set("X-Content-Type-Options", "nosniff")
+		return c.SendString(hocr)
+	})
+
+	// The price column read from the layout and where Gemini disagreed
+	// with it, as of the last run of the layout_check stage
+	app.Get("/receipts/:id/layout", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		stored, found, err := loadArtifact(int64(id), artifactLayoutCheck)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No layout check for this receipt",
+			})
+		}
+		var check LayoutCheck
+		if err := json.Unmarshal([]byte(stored), &check); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read layout check: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":      true,
+			"layout_check": check,
+		})
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ledgerGenesisHash is the previous hash of the first record of a chain
+const ledgerGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// ledgerHashPattern matches a SHA-256 hash in hex
+var ledgerHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LedgerEntry is the transaction data of a ledger record
+type LedgerEntry struct {
+	TransactionID   int64    `json:"transaction_id"`
+	ReceiptID       int64    `json:"receipt_id"`
+	Date            *string  `json:"date"`
+	Merchant        string   `json:"merchant"`
+	Category        *string  `json:"category"`
+	Amount          *float64 `json:"amount"`
+	Currency        *string  `json:"currency"`
+	HomeAmount      *float64 `json:"home_amount"`
+	HomeCurrency    string   `json:"home_currency"`
+	ReferenceNumber *string  `json:"reference_number"`
+	// ReceiptChecksum is the SHA-256 of the stored receipt file
+	ReceiptChecksum *string `json:"receipt_checksum"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+// LedgerRecord is one line of a ledger export. Hash is the SHA-256 of
+// PrevHash followed by the exact bytes of Entry, so changing, removing or
+// reordering records breaks the chain.
+type LedgerRecord struct {
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+	Entry    json.RawMessage `json:"entry"`
+}
+
+// ledgerHash chains an entry to the previous record
+func ledgerHash(prevHash string, entry []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write(entry)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LedgerVerification is the result of checking a ledger export
+type LedgerVerification struct {
+	Records int `json:"records"`
+	// Head is the hash of the last record, to be given as prev_hash when
+	// appending the next export
+	Head string `json:"head"`
+	// LastTransactionID is to be given as after when appending the next
+	// export
+	LastTransactionID int64 `json:"last_transaction_id"`
+}
+
+// verifyLedger checks that every record of a ledger export links to the
+// one before it, starting from prevHash, and that its hash matches its
+// entry. It stops at the first broken record, reported by line number.
+func verifyLedger(r io.Reader, prevHash string) (*LedgerVerification, error) {
+	res := &LedgerVerification{Head: prevHash}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec LedgerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return res, fmt.Errorf("line %d: invalid record: %v", line, err)
+		}
+		if rec.PrevHash != res.Head {
+			return res, fmt.Errorf("line %d: prev_hash %s does not match the previous record's hash %s", line, rec.PrevHash, res.Head)
+		}
+		if sum := ledgerHash(rec.PrevHash, rec.Entry); sum != rec.Hash {
+			return res, fmt.Errorf("line %d: hash %s does not match its entry (expected %s)", line, rec.Hash, sum)
+		}
+		var entry LedgerEntry
+		if err := json.Unmarshal(rec.Entry, &entry); err != nil {
+			return res, fmt.Errorf("line %d: invalid entry: %v", line, err)
+		}
+		res.Records++
+		res.Head = rec.Hash
+		res.LastTransactionID = entry.TransactionID
+	}
+	if err := scanner.Err(); err != nil {
+		return res, fmt.Errorf("failed to read ledger: %v", err)
+	}
+	return res, nil
+}
+
+// registerLedgerRoutes adds the hash-chained ledger export
+func registerLedgerRoutes(app *fiber.App) {
+	// Stream transactions in the order they were recorded as JSONL, each
+	// record carrying the hash of the one before it. after (a transaction
+	// ID) and prev_hash continue a previous export, whose verification
+	// reports both, so the exports can be appended to one file. Archived
+	// transactions are included.
+	app.Get("/export/ledger", func(c *fiber.Ctx) error {
+		prevHash := strings.ToLower(c.Query("prev_hash", ledgerGenesisHash))
+		if !ledgerHashPattern.MatchString(prevHash) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "prev_hash must be a hex SHA-256 hash",
+			})
+		}
+		after := c.QueryInt("after", 0)
+		if after < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid after transaction ID",
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT t.id, t.receipt_id, t.date, COALESCE(t.merchant_clean, t.merchant_raw, ''), t.category,
+				t.amount, t.currency, t.home_amount, t.reference_number, r.checksum, t.created_at
+			FROM `+transactionsAllView+` t
+			JOIN receipts r ON r.id = t.receipt_id
+			WHERE t.id > ?
+			ORDER BY t.id`,
+			after,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to export ledger: %v", err),
+			})
+		}
+
+		home := homeCurrency()
+		c.Set("Content-Type", "application/x-ndjson")
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ledger-%s.jsonl"`, time.Now().Format("20060102")))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer rows.Close()
+
+			enc := json.NewEncoder(w)
+			for rows.Next() {
+				entry := LedgerEntry{HomeCurrency: home}
+				var date sql.NullTime
+				var category, currency, reference, checksum sql.NullString
+				var amount, homeAmount sql.NullFloat64
+				var createdAt time.Time
+				if err := rows.Scan(&entry.TransactionID, &entry.ReceiptID, &date, &entry.Merchant, &category,
+					&amount, &currency, &homeAmount, &reference, &checksum, &createdAt); err != nil {
+					log.Printf("Ledger export: failed to read transaction: %v", err)
+					return
+				}
+				entry.Date = formatNullDate(date)
+				entry.Category = nullStringPtr(category)
+				entry.Amount = nullFloatPtr(amount)
+				entry.Currency = nullStringPtr(currency)
+				entry.HomeAmount = nullFloatPtr(homeAmount)
+				entry.ReferenceNumber = nullStringPtr(reference)
+				entry.ReceiptChecksum = nullStringPtr(checksum)
+				entry.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+
+				raw, err := json.Marshal(entry)
+				if err != nil {
+					log.Printf("Ledger export: %v", err)
+					return
+				}
+				rec := LedgerRecord{PrevHash: prevHash, Hash: ledgerHash(prevHash, raw), Entry: raw}
+				if err := enc.Encode(rec); err != nil {
+					return
+				}
+				prevHash = rec.Hash
+			}
+			if err := rows.Err(); err != nil {
+				log.Printf("Ledger export: %v", err)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+// runVerifyLedger checks the hash chain of a ledger export file
+func runVerifyLedger(args []string) error {
+	fs := flag.NewFlagSet("verify-ledger", flag.ContinueOnError)
+	file := fs.String("file", "", "ledger export (JSONL) to verify; - reads stdin")
+	prevHash := fs.String("prev-hash", ledgerGenesisHash, "hash the first record links to, for a continued export")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+	if !ledgerHashPattern.MatchString(*prevHash) {
+		return fmt.Errorf("-prev-hash must be a hex SHA-256 hash")
+	}
+
+	r := io.Reader(os.Stdin)
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	res, err := verifyLedger(r, *prevHash)
+	if err != nil {
+		return fmt.Errorf("ledger verification failed after %d valid record(s): %v", res.Records, err)
+	}
+	fmt.Printf("Ledger OK: %d record(s)\nHead hash: %s\nLast transaction: %d\n", res.Records, res.Head, res.LastTransactionID)
+	return nil
+}
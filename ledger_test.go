@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// ledgerLines chains entries from prevHash into export lines and returns
+// them with the hash of the last one
+func ledgerLines(prevHash string, entries ...string) ([]string, string) {
+	var lines []string
+	for _, entry := range entries {
+		rec := LedgerRecord{PrevHash: prevHash, Hash: ledgerHash(prevHash, []byte(entry)), Entry: json.RawMessage(entry)}
+		line, _ := json.Marshal(rec)
+		lines = append(lines, string(line))
+		prevHash = rec.Hash
+	}
+	return lines, prevHash
+}
+
+func TestVerifyLedger(t *testing.T) {
+	chain, head := ledgerLines(ledgerGenesisHash,
+		`{"transaction_id":1,"merchant":"Bakery"}`,
+		`{"transaction_id":2,"merchant":"Grocer"}`,
+		`{"transaction_id":5,"merchant":"Pharmacy"}`,
+	)
+	appended, _ := ledgerLines(head, `{"transaction_id":7,"merchant":"Cafe"}`)
+	tampered := strings.Replace(chain[1], "Grocer", "Grocer2", 1)
+
+	tests := []struct {
+		name     string
+		lines    []string
+		prevHash string
+		records  int
+		lastID   int64
+		errLine  string
+	}{
+		{"valid chain", chain, ledgerGenesisHash, 3, 5, ""},
+		{"empty export", nil, ledgerGenesisHash, 0, 0, ""},
+		{"blank lines", []string{chain[0], "", "  ", chain[1], chain[2], ""}, ledgerGenesisHash, 3, 5, ""},
+		{"appended export", appended, head, 1, 7, ""},
+		{"appended export from genesis", appended, ledgerGenesisHash, 0, 0, "line 1:"},
+		{"changed entry", []string{chain[0], tampered, chain[2]}, ledgerGenesisHash, 1, 1, "line 2:"},
+		{"removed record", []string{chain[0], chain[2]}, ledgerGenesisHash, 1, 1, "line 2:"},
+		{"reordered records", []string{chain[1], chain[0], chain[2]}, ledgerGenesisHash, 0, 0, "line 1:"},
+		{"invalid json", []string{chain[0], "{"}, ledgerGenesisHash, 1, 1, "line 2:"},
+	}
+	for _, tt := range tests {
+		res, err := verifyLedger(strings.NewReader(strings.Join(tt.lines, "\n")), tt.prevHash)
+		if tt.errLine == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.errLine != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.errLine)) {
+			t.Errorf("%s: error = %v, want one starting with %q", tt.name, err, tt.errLine)
+		}
+		if res.Records != tt.records || res.LastTransactionID != tt.lastID {
+			t.Errorf("%s: got %d records up to transaction %d, want %d up to %d",
+				tt.name, res.Records, res.LastTransactionID, tt.records, tt.lastID)
+		}
+	}
+
+	res, err := verifyLedger(strings.NewReader(strings.Join(chain, "\n")), ledgerGenesisHash)
+	if err != nil || res.Head != head {
+		t.Errorf("head = %s (%v), want %s", res.Head, err, head)
+	}
+}
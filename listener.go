@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// allowlistListener drops connections from addresses outside its networks
+// before any byte is read from them
+type allowlistListener struct {
+	net.Listener
+	nets []*net.IPNet
+}
+
+// Accept returns the next connection from an allowed address
+func (l *allowlistListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Printf("Rejected connection from %s: not in ALLOWED_CIDRS", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// allowed reports whether an address is in one of the networks
+func (l *allowlistListener) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs reads a comma-separated list of networks in CIDR notation;
+// plain addresses stand for themselves
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", part)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// serverTLSConfig returns the TLS configuration for TLS_CERT_FILE and
+// TLS_KEY_FILE, or nil when they are not set. With TLS_CLIENT_CA_FILE,
+// clients must present a certificate signed by one of its CAs.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, caFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE contains no PEM certificates")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serverListener listens on addr, accepting only ALLOWED_CIDRS when set and
+// terminating TLS, optionally mutual, when a certificate is configured
+func serverListener(addr string) (net.Listener, error) {
+	nets, err := parseCIDRs(os.Getenv("ALLOWED_CIDRS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALLOWED_CIDRS: %v", err)
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) > 0 {
+		ln = &allowlistListener{Listener: ln, nets: nets}
+		log.Printf("Accepting connections from %d allowed network(s) only", len(nets))
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		if tlsConfig.ClientCAs != nil {
+			log.Println("TLS enabled, client certificates required")
+		} else {
+			log.Println("TLS enabled")
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// recentTransactionsLimit is how many transactions the live feed shows
+const recentTransactionsLimit = 20
+
+// liveQuery is a query whose result is pushed to subscribers whenever it
+// changes. While anyone is subscribed it is re-run every poll interval and
+// right away when data is known to have changed.
+type liveQuery struct {
+	load        func() (any, error)
+	subscribers map[chan []byte]struct{}
+	last        []byte
+	wake        chan struct{}
+}
+
+// LiveQueryHub runs the live queries shared by all dashboard streams
+type LiveQueryHub struct {
+	mu       sync.Mutex
+	interval time.Duration
+	queries  map[string]*liveQuery
+}
+
+var liveQueries = &LiveQueryHub{
+	interval: liveQueryInterval(),
+	queries: map[string]*liveQuery{
+		"review_queue":        {load: loadLiveReviewQueue},
+		"recent_transactions": {load: loadRecentTransactions},
+	},
+}
+
+// liveQueryInterval is how often live queries are re-run when nothing
+// signalled a change (LIVE_POLL_INTERVAL, default 10s); it catches changes
+// made outside this process
+func liveQueryInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LIVE_POLL_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// Subscribe returns a channel receiving the JSON result of a live query
+// each time it changes, starting with the current result, and a function
+// to stop the subscription
+func (h *LiveQueryHub) Subscribe(name string) (chan []byte, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q, ok := h.queries[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown live query %q", name)
+	}
+
+	ch := make(chan []byte, 4)
+	if q.subscribers == nil {
+		q.subscribers = make(map[chan []byte]struct{})
+	}
+	q.subscribers[ch] = struct{}{}
+	if q.last != nil {
+		ch <- q.last
+	}
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+		go h.run(name, q)
+	}
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(q.subscribers, ch)
+		h.mu.Unlock()
+	}, nil
+}
+
+// Invalidate re-runs every live query that has subscribers
+func (h *LiveQueryHub) Invalidate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, q := range h.queries {
+		if q.wake == nil {
+			continue
+		}
+		select {
+		case q.wake <- struct{}{}:
+		default:
+			// A refresh is already pending
+		}
+	}
+}
+
+// run refreshes a query until its last subscriber leaves
+func (h *LiveQueryHub) run(name string, q *liveQuery) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		result, err := q.load()
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(result)
+		}
+		if err != nil {
+			log.Printf("Live query %s: %v", name, err)
+		}
+
+		h.mu.Lock()
+		if len(q.subscribers) == 0 {
+			q.wake, q.last = nil, nil
+			h.mu.Unlock()
+			return
+		}
+		if err == nil && !bytes.Equal(data, q.last) {
+			q.last = data
+			for ch := range q.subscribers {
+				select {
+				case ch <- data:
+				default:
+					// Slow subscriber; it gets the next change
+				}
+			}
+		}
+		wake := q.wake
+		h.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// loadLiveReviewQueue returns the inbox counters and the oldest receipts
+// waiting for review
+func loadLiveReviewQueue() (any, error) {
+	inbox, err := loadInboxStats()
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := loadStatusReceipts("needs_review", false)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"inbox":    inbox,
+		"receipts": receipts,
+	}, nil
+}
+
+// RecentTransaction is a row of the live recent transactions feed
+type RecentTransaction struct {
+	ID        int64    `json:"id"`
+	ReceiptID int64    `json:"receipt_id"`
+	Status    string   `json:"status"`
+	Date      *string  `json:"date"`
+	Merchant  string   `json:"merchant"`
+	Category  string   `json:"category"`
+	Amount    *float64 `json:"amount"`
+	Currency  string   `json:"currency"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// loadRecentTransactions returns the newest transactions
+func loadRecentTransactions() (any, error) {
+	rows, err := db.Query(
+		`SELECT t.id, t.receipt_id, r.status, t.date, COALESCE(t.merchant_clean, t.merchant_raw, ''),
+			COALESCE(t.category, ''), t.amount, COALESCE(t.currency, ''), t.created_at
+		FROM transactions t
+		JOIN receipts r ON r.id = t.receipt_id
+		ORDER BY t.id DESC
+		LIMIT ?`,
+		recentTransactionsLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recent transactions: %v", err)
+	}
+	defer rows.Close()
+
+	transactions := []RecentTransaction{}
+	for rows.Next() {
+		var t RecentTransaction
+		var date sql.NullTime
+		var amount sql.NullFloat64
+		var createdAt time.Time
+		if err := rows.Scan(&t.ID, &t.ReceiptID, &t.Status, &date, &t.Merchant, &t.Category, &amount, &t.Currency, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %v", err)
+		}
+		t.Date = formatNullDate(date)
+		if amount.Valid {
+			t.Amount = &amount.Float64
+		}
+		t.CreatedAt = createdAt.Format(time.RFC3339)
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// registerLiveRoutes adds the dashboard live query stream
+func registerLiveRoutes(app *fiber.App) {
+	// Server-sent events stream with one event per live query (named after
+	// the query) whenever its result changes. queries selects a comma
+	// separated subset of review_queue and recent_transactions.
+	app.Get("/live", func(c *fiber.Ctx) error {
+		names := strings.Split(c.Query("queries", "review_queue,recent_transactions"), ",")
+
+		type subscription struct {
+			name    string
+			updates chan []byte
+		}
+		var subs []subscription
+		var unsubscribes []func()
+		for _, name := range names {
+			updates, unsubscribe, err := liveQueries.Subscribe(strings.TrimSpace(name))
+			if err != nil {
+				for _, u := range unsubscribes {
+					u()
+				}
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			subs = append(subs, subscription{strings.TrimSpace(name), updates})
+			unsubscribes = append(unsubscribes, unsubscribe)
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer func() {
+				for _, u := range unsubscribes {
+					u()
+				}
+			}()
+
+			// Fan the per-query channels into one so a single loop writes
+			type update struct {
+				name string
+				data []byte
+			}
+			merged := make(chan update, 8)
+			done := make(chan struct{})
+			defer close(done)
+			for _, s := range subs {
+				go func(s subscription) {
+					for {
+						select {
+						case data := <-s.updates:
+							select {
+							case merged <- update{s.name, data}:
+							case <-done:
+								return
+							}
+						case <-done:
+							return
+						}
+					}
+				}(s)
+			}
+
+			keepAlive := time.NewTicker(15 * time.Second)
+			defer keepAlive.Stop()
+			for {
+				select {
+				case u := <-merged:
+					if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", u.name, u.data); err != nil {
+						return
+					}
+					if err := w.Flush(); err != nil {
+						return
+					}
+				case <-keepAlive.C:
+					// Comment lines keep proxies from closing idle streams
+					if _, err := w.WriteString(": keep-alive\n\n"); err != nil {
+						return
+					}
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		})
+		return nil
+	})
+}
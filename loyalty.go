@@ -0,0 +1,569 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultLoyaltyRemindDays is how many days ahead expiring points are
+// reminded about unless LOYALTY_REMIND_DAYS says otherwise
+const defaultLoyaltyRemindDays = 30
+
+// LoyaltyInfo is the loyalty program printed on a receipt
+type LoyaltyInfo struct {
+	Program string `json:"program"`
+	// CardNumber is reduced to its last four digits before it is stored
+	CardNumber   string  `json:"card_number"`
+	PointsEarned float64 `json:"points_earned"`
+	// PointsBalance is the balance printed after this purchase, if any
+	PointsBalance *float64 `json:"points_balance"`
+	// PointsExpiry is the expiry date printed for the points (YYYY-MM-DD)
+	PointsExpiry string `json:"points_expiry"`
+}
+
+// loyaltyPrompt asks Gemini for the loyalty program printed on the receipt
+func loyaltyPrompt(prompt string) string {
+	return prompt + "\n\nAlso include a \"loyalty\" object in the same JSON object if the receipt shows a loyalty, " +
+		"rewards or bonus program: program (the program name as printed, e.g. Payback or ExtraCare), " +
+		"card_number (the loyalty card or member number as printed, masked digits included), " +
+		"points_earned (number, points collected with this purchase, 0 if none are shown), " +
+		"points_balance (number, the points balance printed after this purchase, else null) " +
+		"and points_expiry (YYYY-MM-DD, the date printed points expire on, else null). " +
+		"Use null for loyalty if no program is shown. Do not report payment card numbers as loyalty cards."
+}
+
+// loyaltyProgramKey identifies a program whatever its spelling on a
+// receipt: lower-case words of letters and digits
+func loyaltyProgramKey(name string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, name)
+	return truncate(strings.Join(strings.Fields(cleaned), " "), 100)
+}
+
+// loyaltyCardLast4 returns the last four digits of a card number, or ""
+// when fewer are printed
+func loyaltyCardLast4(number string) string {
+	var digits []rune
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) < 4 {
+		return ""
+	}
+	return string(digits[len(digits)-4:])
+}
+
+// LoyaltyProgram says how long a program's points last and what they are
+// worth, for programs that do not print an expiry date
+type LoyaltyProgram struct {
+	Program string `json:"program"`
+	// ExpiryMonths is how long points last after the purchase that earned
+	// them; 0 means they do not expire
+	ExpiryMonths int `json:"expiry_months,omitempty"`
+	// PointValue is what one point is worth in the home currency
+	PointValue float64 `json:"point_value,omitempty"`
+}
+
+// LoyaltyPrograms are the loyalty program settings of a tenant
+type LoyaltyPrograms struct {
+	Programs []LoyaltyProgram `json:"programs"`
+}
+
+// normalize keys the programs and checks the values
+func (p *LoyaltyPrograms) normalize() error {
+	seen := map[string]bool{}
+	for i := range p.Programs {
+		program := &p.Programs[i]
+		program.Program = loyaltyProgramKey(program.Program)
+		if program.Program == "" {
+			return fmt.Errorf("every entry needs a program")
+		}
+		if seen[program.Program] {
+			return fmt.Errorf("program %q is listed more than once", program.Program)
+		}
+		seen[program.Program] = true
+		if program.ExpiryMonths < 0 || program.PointValue < 0 {
+			return fmt.Errorf("expiry_months and point_value of %s must not be negative", program.Program)
+		}
+	}
+	return nil
+}
+
+// find returns the settings of a program
+func (p LoyaltyPrograms) find(key string) (LoyaltyProgram, bool) {
+	for _, program := range p.Programs {
+		if program.Program == key {
+			return program, true
+		}
+	}
+	return LoyaltyProgram{}, false
+}
+
+// loadLoyaltyPrograms returns the stored program settings of a tenant,
+// falling back to the default tenant's settings
+func loadLoyaltyPrograms(tenant string) LoyaltyPrograms {
+	for _, key := range []string{tenant, defaultTenant} {
+		var raw []byte
+		err := db.QueryRow("SELECT programs FROM loyalty_programs WHERE tenant_key = ?", key).Scan(&raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load loyalty programs for %s: %v", key, err)
+			break
+		}
+		var programs LoyaltyPrograms
+		if err := json.Unmarshal(raw, &programs); err != nil {
+			log.Printf("Invalid loyalty programs for %s: %v", key, err)
+			break
+		}
+		return programs
+	}
+	return LoyaltyPrograms{Programs: []LoyaltyProgram{}}
+}
+
+// saveLoyaltyPrograms stores the program settings of a tenant
+func saveLoyaltyPrograms(tenant string, programs LoyaltyPrograms) error {
+	raw, err := json.Marshal(programs)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(
+		`INSERT INTO loyalty_programs (tenant_key, programs) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE programs = VALUES(programs)`,
+		tenant, raw,
+	); err != nil {
+		return fmt.Errorf("failed to save loyalty programs: %v", err)
+	}
+	return nil
+}
+
+// recordLoyalty stores the points a transaction earned, replacing what an
+// earlier analysis stored. Only the last four digits of the card number
+// are kept, in the stored row and in data.
+func recordLoyalty(tenant string, receiptID, transactionID int64, data *GeminiParsedData) error {
+	if data.Loyalty != nil {
+		data.Loyalty.CardNumber = loyaltyCardLast4(data.Loyalty.CardNumber)
+	}
+	err := inTx("record loyalty points", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM loyalty_points WHERE transaction_id = ?", transactionID); err != nil {
+			return err
+		}
+		info := data.Loyalty
+		if info == nil {
+			return nil
+		}
+		key := loyaltyProgramKey(info.Program)
+		if key == "" || (info.PointsEarned == 0 && info.PointsBalance == nil) {
+			return nil
+		}
+
+		earned := time.Now()
+		if t, err := time.Parse("2006-01-02", data.Date); err == nil {
+			earned = t
+		}
+		var expires sql.NullTime
+		if t, err := time.Parse("2006-01-02", info.PointsExpiry); err == nil {
+			expires = sql.NullTime{Time: t, Valid: true}
+		}
+		merchant := truncate(data.MerchantClean, 255)
+		if merchant == "" {
+			merchant = truncate(data.MerchantRaw, 255)
+		}
+		_, err := tx.Exec(
+			`INSERT INTO loyalty_points
+			(tenant_key, receipt_id, transaction_id, program, program_name, merchant, card_last4,
+				points_earned, points_balance, expires_on, earned_on)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			tenant, receiptID, transactionID, key, truncate(strings.TrimSpace(info.Program), 100),
+			sql.NullString{String: merchant, Valid: merchant != ""},
+			sql.NullString{String: info.CardNumber, Valid: info.CardNumber != ""},
+			roundTo(info.PointsEarned, 2), info.PointsBalance, expires, earned,
+		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record loyalty points of receipt %d: %v", receiptID, err)
+	}
+	return nil
+}
+
+// loyaltyEntry is one receipt's points of a program
+type loyaltyEntry struct {
+	id        int64
+	receiptID int64
+	program   string
+	name      string
+	merchant  string
+	cardLast4 string
+	earned    float64
+	balance   *float64
+	earnedOn  time.Time
+	expiresOn *time.Time
+}
+
+// expiry returns when the points of an entry expire: the printed date,
+// else the program's expiry_months after the purchase, else nil
+func (e loyaltyEntry) expiry(programs LoyaltyPrograms) *time.Time {
+	if e.expiresOn != nil {
+		return e.expiresOn
+	}
+	if program, ok := programs.find(e.program); ok && program.ExpiryMonths > 0 {
+		t := e.earnedOn.AddDate(0, program.ExpiryMonths, 0)
+		return &t
+	}
+	return nil
+}
+
+// LoyaltyExpiry is an amount of points that expires soon
+type LoyaltyExpiry struct {
+	Program   string  `json:"program"`
+	Points    float64 `json:"points"`
+	ExpiresOn string  `json:"expires_on"`
+	DaysLeft  int     `json:"days_left"`
+	ReceiptID int64   `json:"receipt_id"`
+}
+
+// LoyaltySummary is what is known about the points of one program
+type LoyaltySummary struct {
+	Program   string   `json:"program"`
+	Name      string   `json:"name"`
+	Merchants []string `json:"merchants"`
+	CardLast4 *string  `json:"card_last4"`
+	Receipts  int      `json:"receipts"`
+	// PointsEarned is the total collected on the recorded receipts
+	PointsEarned  float64 `json:"points_earned"`
+	PointsExpired float64 `json:"points_expired"`
+	// PrintedBalance is the last balance printed on a receipt
+	PrintedBalance *float64 `json:"printed_balance"`
+	BalanceAsOf    *string  `json:"balance_as_of"`
+	// EstimatedBalance is the printed balance plus points earned since,
+	// minus points that expired since; without a printed balance it is
+	// the points earned that have not expired
+	EstimatedBalance float64 `json:"estimated_balance"`
+	// EstimatedValue is the estimated balance times the point_value of
+	// the program, when one is set
+	EstimatedValue *float64        `json:"estimated_value"`
+	LastEarnedOn   string          `json:"last_earned_on"`
+	Expiring       []LoyaltyExpiry `json:"expiring"`
+}
+
+// loadLoyaltyEntries returns the recorded points of a tenant, optionally
+// of one program, oldest first. Points of receipts in the trash are left
+// out.
+func loadLoyaltyEntries(tenant, program string) ([]loyaltyEntry, error) {
+	query := `SELECT l.id, l.receipt_id, l.program, l.program_name, COALESCE(l.merchant, ''), COALESCE(l.card_last4, ''),
+			l.points_earned, l.points_balance, l.earned_on, l.expires_on
+		FROM loyalty_points l
+		JOIN receipts r ON r.id = l.receipt_id
+		WHERE l.tenant_key = ? AND r.deleted_at IS NULL`
+	args := []any{tenant}
+	if program != "" {
+		query += " AND l.program = ?"
+		args = append(args, program)
+	}
+	rows, err := db.Query(query+" ORDER BY l.earned_on, l.id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load loyalty points: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []loyaltyEntry
+	for rows.Next() {
+		var e loyaltyEntry
+		var balance sql.NullFloat64
+		var expires sql.NullTime
+		if err := rows.Scan(&e.id, &e.receiptID, &e.program, &e.name, &e.merchant, &e.cardLast4,
+			&e.earned, &balance, &e.earnedOn, &expires); err != nil {
+			return nil, fmt.Errorf("failed to read loyalty points: %v", err)
+		}
+		e.balance = nullFloatPtr(balance)
+		if expires.Valid {
+			e.expiresOn = &expires.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// summarizeLoyalty adds up the points per program as of today, listing the
+// points that expire within the next days days
+func summarizeLoyalty(entries []loyaltyEntry, programs LoyaltyPrograms, today time.Time, days int) []LoyaltySummary {
+	byProgram := map[string][]loyaltyEntry{}
+	var keys []string
+	for _, e := range entries {
+		if _, ok := byProgram[e.program]; !ok {
+			keys = append(keys, e.program)
+		}
+		byProgram[e.program] = append(byProgram[e.program], e)
+	}
+	sort.Strings(keys)
+
+	horizon := today.AddDate(0, 0, days)
+	summaries := []LoyaltySummary{}
+	for _, key := range keys {
+		list := byProgram[key]
+		s := LoyaltySummary{Program: key, Merchants: []string{}, Receipts: len(list), Expiring: []LoyaltyExpiry{}}
+
+		// The last printed balance already includes the points earned up
+		// to that receipt
+		anchor := -1
+		for i, e := range list {
+			if e.balance != nil {
+				anchor = i
+			}
+		}
+		var anchorDate time.Time
+		if anchor >= 0 {
+			s.PrintedBalance = floatPtr(*list[anchor].balance)
+			anchorDate = list[anchor].earnedOn
+			asOf := anchorDate.Format("2006-01-02")
+			s.BalanceAsOf = &asOf
+			s.EstimatedBalance = *list[anchor].balance
+		}
+
+		for i, e := range list {
+			s.Name = e.name
+			if e.merchant != "" && !containsString(s.Merchants, e.merchant) {
+				s.Merchants = append(s.Merchants, e.merchant)
+			}
+			if e.cardLast4 != "" {
+				s.CardLast4 = &e.cardLast4
+			}
+			s.PointsEarned += e.earned
+			s.LastEarnedOn = e.earnedOn.Format("2006-01-02")
+
+			expiry := e.expiry(programs)
+			expired := expiry != nil && !expiry.After(today)
+			switch {
+			case expired && i > anchor:
+				s.PointsExpired += e.earned
+			case expired && expiry.After(anchorDate):
+				// Counted in the printed balance, expired since
+				s.PointsExpired += e.earned
+				s.EstimatedBalance -= e.earned
+			case expired:
+				s.PointsExpired += e.earned
+			case i > anchor:
+				s.EstimatedBalance += e.earned
+			}
+			if !expired && expiry != nil && !expiry.After(horizon) && e.earned > 0 {
+				s.Expiring = append(s.Expiring, LoyaltyExpiry{
+					Program:   key,
+					Points:    e.earned,
+					ExpiresOn: expiry.Format("2006-01-02"),
+					DaysLeft:  int(expiry.Sub(today).Hours() / 24),
+					ReceiptID: e.receiptID,
+				})
+			}
+		}
+
+		s.EstimatedBalance = roundTo(math.Max(s.EstimatedBalance, 0), 2)
+		s.PointsEarned = roundTo(s.PointsEarned, 2)
+		s.PointsExpired = roundTo(s.PointsExpired, 2)
+		if program, ok := programs.find(key); ok && program.PointValue > 0 {
+			s.EstimatedValue = floatPtr(roundTo(s.EstimatedBalance*program.PointValue, 2))
+		}
+		sort.SliceStable(s.Expiring, func(a, b int) bool { return s.Expiring[a].ExpiresOn < s.Expiring[b].ExpiresOn })
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+// loyaltyRemindDays reads LOYALTY_REMIND_DAYS
+func loyaltyRemindDays() int {
+	if v := os.Getenv("LOYALTY_REMIND_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+		log.Printf("Invalid LOYALTY_REMIND_DAYS %q, using %d", v, defaultLoyaltyRemindDays)
+	}
+	return defaultLoyaltyRemindDays
+}
+
+// startOfDay returns midnight UTC of t's date, the way DATE columns are read
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// sendLoyaltyReminders posts a loyalty.points_expiring webhook for the
+// points of every receipt that expire within LOYALTY_REMIND_DAYS. Each
+// receipt's points are reminded about once.
+func sendLoyaltyReminders(now time.Time) (int, error) {
+	today := startOfDay(now)
+	horizon := today.AddDate(0, 0, loyaltyRemindDays())
+	rows, err := db.Query(
+		`SELECT l.id, l.tenant_key, l.receipt_id, l.program, l.program_name, COALESCE(l.card_last4, ''), l.points_earned,
+			l.earned_on, l.expires_on
+		FROM loyalty_points l
+		JOIN receipts r ON r.id = l.receipt_id
+		WHERE l.reminded_at IS NULL AND l.points_earned > 0 AND (l.expires_on IS NULL OR l.expires_on BETWEEN ? AND ?)
+			AND r.deleted_at IS NULL`,
+		today, horizon,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expiring loyalty points: %v", err)
+	}
+
+	type reminder struct {
+		id      int64
+		payload fiber.Map
+	}
+	var due []reminder
+	programs := map[string]LoyaltyPrograms{}
+	for rows.Next() {
+		var e loyaltyEntry
+		var tenant string
+		var expires sql.NullTime
+		if err := rows.Scan(&e.id, &tenant, &e.receiptID, &e.program, &e.name, &e.cardLast4, &e.earned, &e.earnedOn, &expires); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan loyalty points: %v", err)
+		}
+		if expires.Valid {
+			e.expiresOn = &expires.Time
+		}
+		if _, ok := programs[tenant]; !ok {
+			programs[tenant] = loadLoyaltyPrograms(tenant)
+		}
+		expiry := e.expiry(programs[tenant])
+		if expiry == nil || expiry.Before(today) || expiry.After(horizon) {
+			continue
+		}
+		payload := fiber.Map{
+			"program":    e.name,
+			"card_last4": nil,
+			"points":     e.earned,
+			"expires_on": expiry.Format("2006-01-02"),
+			"days_left":  int(expiry.Sub(today).Hours() / 24),
+			"receipt_id": e.receiptID,
+		}
+		if e.cardLast4 != "" {
+			payload["card_last4"] = e.cardLast4
+		}
+		due = append(due, reminder{e.id, payload})
+	}
+	rows.Close()
+
+	sent := 0
+	for _, r := range due {
+		if err := sendWebhook(eventLoyaltyExpiring, r.payload); err != nil {
+			log.Printf("Loyalty: %v", err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE loyalty_points SET reminded_at = ? WHERE id = ?", now, r.id); err != nil {
+			return sent, fmt.Errorf("failed to mark loyalty reminder sent: %v", err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// startLoyaltyScheduler checks for expiring points every hour
+func startLoyaltyScheduler() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if sent, err := sendLoyaltyReminders(time.Now()); err != nil {
+				log.Printf("Loyalty: reminder check failed: %v", err)
+			} else if sent > 0 {
+				log.Printf("Loyalty: sent %d expiry reminder(s)", sent)
+			}
+		}
+	}()
+}
+
+// registerLoyaltyRoutes adds the loyalty points overview and the program
+// settings
+func registerLoyaltyRoutes(app *fiber.App) {
+	// Points per program with the estimated balance and the points that
+	// expire within days (default LOYALTY_REMIND_DAYS)
+	app.Get("/loyalty", func(c *fiber.Ctx) error {
+		days := loyaltyRemindDays()
+		if s := c.Query("days"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid days, expected a non-negative number",
+				})
+			}
+			days = n
+		}
+
+		tenant := tenantKey(c)
+		entries, err := loadLoyaltyEntries(tenant, loyaltyProgramKey(c.Query("program")))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		summaries := summarizeLoyalty(entries, loadLoyaltyPrograms(tenant), startOfDay(time.Now()), days)
+		reminders := []LoyaltyExpiry{}
+		for _, s := range summaries {
+			reminders = append(reminders, s.Expiring...)
+		}
+		sort.SliceStable(reminders, func(a, b int) bool { return reminders[a].ExpiresOn < reminders[b].ExpiresOn })
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"days":      days,
+			"programs":  summaries,
+			"reminders": reminders,
+		})
+	})
+
+	app.Get("/loyalty/programs", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"tenant":   tenant,
+			"programs": loadLoyaltyPrograms(tenant).Programs,
+		})
+	})
+
+	// The body replaces all program settings
+	app.Put("/loyalty/programs", func(c *fiber.Ctx) error {
+		var programs LoyaltyPrograms
+		if err := json.Unmarshal(c.Body(), &programs); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if programs.Programs == nil {
+			programs.Programs = []LoyaltyProgram{}
+		}
+		if err := programs.normalize(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		tenant := tenantKey(c)
+		if err := saveLoyaltyPrograms(tenant, programs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"tenant":   tenant,
+			"programs": programs.Programs,
+		})
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// sendEmail sends a plain-text notification to NOTIFY_EMAIL_TO through
+// SMTP_HOST. It does nothing when either is not configured.
+func sendEmail(subject, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	to := os.Getenv("NOTIFY_EMAIL_TO")
+	if host == "" || to == "" {
+		return nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("NOTIFY_EMAIL_FROM")
+	if from == "" {
+		from = os.Getenv("SMTP_USER")
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	recipients := strings.Split(to, ",")
+	for i := range recipients {
+		recipients[i] = strings.TrimSpace(recipients[i])
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		from, strings.Join(recipients, ", "), subject, body)
+
+	if err := smtp.SendMail(host+":"+port, auth, from, recipients, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send email %q: %v", subject, err)
+	}
+	return nil
+}
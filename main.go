@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -19,17 +17,25 @@ import (
 
 // Receipt model
 type Receipt struct {
-	ID          int64
-	FileName    string
-	DriveFileID sql.NullString
-	Status      string
-	UploadedAt  time.Time
+	ID             int64
+	FileName       string
+	DriveFileID    sql.NullString
+	Status         string
+	StorageBackend string
+	Checksum       sql.NullString
+	// SourceURL and SourceTitle describe the web page a browser capture came from
+	SourceURL   sql.NullString
+	SourceTitle sql.NullString
+	// VerifiedAt is set when a human confirmed the extracted fields
+	VerifiedAt sql.NullTime
+	UploadedAt time.Time
 }
 
 // Transaction model
 type Transaction struct {
 	ID            int64
 	ReceiptID     int64
+	MerchantID    sql.NullInt64
 	Date          sql.NullTime
 	MerchantRaw   sql.NullString
 	MerchantClean sql.NullString
@@ -37,196 +43,347 @@ type Transaction struct {
 	Amount        sql.NullFloat64
 	Currency      sql.NullString
 	Confidence    sql.NullFloat64
-	CreatedAt     time.Time
+	// ReferenceNumber is the receipt/transaction number printed by the POS
+	ReferenceNumber sql.NullString
+	// HomeAmount is Amount converted into HOME_CURRENCY; ConversionStatus is
+	// not_needed, converted or pending (waiting for an exchange rate)
+	HomeAmount       sql.NullFloat64
+	ConversionStatus string
+	Subtotal         sql.NullFloat64
+	Tip              sql.NullFloat64
+	TipPercentage    sql.NullFloat64
+	TipUnusual       bool
+	MerchantCountry  sql.NullString
+	DateAmbiguous    bool
+	BranchName       sql.NullString
+	StoreNumber      sql.NullString
+	StoreAddress     sql.NullString
+	Profile          sql.NullString
+	ExtraFields      sql.NullString
+	CreatedAt        time.Time
 }
 
 // GeminiParsedData represents parsed receipt data from Gemini
 type GeminiParsedData struct {
-	Date          string  `json:"date"`
+	Date string `json:"date"`
+	// Time is the time of purchase (HH:MM) when the receipt prints one
+	Time          string  `json:"time"`
 	MerchantRaw   string  `json:"merchant_raw"`
 	MerchantClean string  `json:"merchant_clean"`
 	Category      string  `json:"category"`
 	Amount        float64 `json:"amount"`
 	Currency      string  `json:"currency"`
 	Confidence    float64 `json:"confidence"`
+	// ReferenceNumber is the receipt/transaction number printed by the POS
+	ReferenceNumber string  `json:"reference_number"`
+	Subtotal        float64 `json:"subtotal"`
+	Tip             float64 `json:"tip"`
+	// Tax is only used to tell the tip apart from the tax in the total
+	Tax float64 `json:"tax"`
+	// DateRaw is the date exactly as printed; MerchantCountry is the ISO
+	// 3166-1 alpha-2 country of the merchant. Both are used to settle
+	// day/month order, and DateAmbiguous is set when that stays uncertain.
+	DateRaw         string `json:"date_raw"`
+	MerchantCountry string `json:"merchant_country"`
+	DateAmbiguous   bool   `json:"date_ambiguous"`
+	// Branch details distinguish locations of chain merchants
+	BranchName   string `json:"branch_name"`
+	StoreNumber  string `json:"store_number"`
+	StoreAddress string `json:"store_address"`
+	// Profile names the extraction profile used; Extra holds its
+	// document-specific fields
+	Profile string         `json:"profile,omitempty"`
+	Extra   map[string]any `json:"extra,omitempty"`
+	// Custom holds the deployment's custom fields (see CUSTOM_FIELDS_FILE)
+	Custom map[string]any `json:"custom_fields,omitempty"`
+	// Items are the line items, requested with the line_items or
+	// price_check pipeline stage
+	Items []ReceiptItem `json:"items,omitempty"`
+	// Loyalty is the loyalty program, requested with the loyalty pipeline
+	// stage
+	Loyalty *LoyaltyInfo `json:"loyalty,omitempty"`
 }
 
 var db *sql.DB
 
-// isPDFTextBased checks if a PDF contains extractable text using pdftotext
-func isPDFTextBased(pdfPath string) (bool, error) {
-	// Try to extract text using pdftotext
-	cmd := exec.Command("pdftotext", "-l", "1", pdfPath, "-")
-	output, err := cmd.Output()
-	if err != nil {
-		return false, fmt.Errorf("failed to run pdftotext: %v", err)
+func main() {
+	// Subcommands (e.g. "bench") run instead of the HTTP server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	// Check if extracted text has meaningful content (more than whitespace)
-	text := strings.TrimSpace(string(output))
-	return len(text) > 10, nil // If more than 10 characters, consider it text-based
-}
-
-// extractTextFromPDF extracts text from a text-based PDF using pdftotext
-func extractTextFromPDF(pdfPath string) (string, error) {
-	cmd := exec.Command("pdftotext", "-layout", pdfPath, "-")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to extract text from PDF: %v", err)
+	if !localOCRAvailable && remoteOCREndpoint() == "" {
+		log.Fatal("This build has no local OCR (remoteocr tag); set OCR_ENDPOINT")
 	}
-	return string(output), nil
-}
 
-// convertPDFToImagesAndOCR converts PDF to images using pdftoppm and performs OCR
-func convertPDFToImagesAndOCR(pdfPath string) (string, error) {
-	// Create temp directory for images
-	tempDir, err := os.MkdirTemp("", "pdf-ocr-*")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	// Initialize database
+	if err := initDB(); err != nil {
+		log.Fatal("Database initialization failed:", err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer db.Close()
 
-	// Convert PDF to PNG images using pdftoppm
-	outputPrefix := filepath.Join(tempDir, "page")
-	cmd := exec.Command("pdftoppm", "-png", "-r", "300", pdfPath, outputPrefix)
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to convert PDF to images: %v", err)
+	// Create tables
+	if err := createTables(); err != nil {
+		log.Fatal("Failed to create tables:", err)
 	}
 
-	// Find all generated images
-	images, err := filepath.Glob(filepath.Join(tempDir, "*.png"))
-	if err != nil || len(images) == 0 {
-		return "", fmt.Errorf("no images generated from PDF")
+	// Fail early on a misconfigured receipt storage backend
+	if _, err := newStorage(receiptStorageName()); err != nil {
+		log.Fatal("Invalid STORAGE_BACKEND: ", err)
 	}
-
-	// Perform OCR on each image using command-line tesseract
-	var allText bytes.Buffer
-
-	for _, imagePath := range images {
-		cmd := exec.Command("tesseract", imagePath, "stdout")
-		output, err := cmd.Output()
-		if err != nil {
-			log.Printf("Warning: OCR failed for %s: %v", imagePath, err)
-			continue
-		}
-
-		allText.Write(output)
-		allText.WriteString("\n\n---PAGE BREAK---\n\n")
+	if err := checkDiskArchiveBackend(); err != nil {
+		log.Fatal("Invalid DISK_ARCHIVE_BACKEND: ", err)
 	}
 
-	return allText.String(), nil
-}
-
-// Initialize database connection
-func initDB() error {
-	// Get database connection string from environment variable
-	// Format: username:password@tcp(host:port)/database
-	dsn := os.Getenv("MYSQL_DSN")
-	if dsn == "" {
-		dsn = "root:@tcp(127.0.0.1:3306)/receipt_processor?parseTime=true"
-		log.Println("MYSQL_DSN not set, using default:", dsn)
+	// Optional upload of receipt originals to Google Drive
+	client, err := newDriveClient()
+	if err != nil {
+		log.Fatal(err)
 	}
+	driveClient = client
 
-	var err error
-	db, err = sql.Open("mysql", dsn)
+	// Optional single sign-on with the company's identity provider
+	provider, err := newOIDCProvider()
 	if err != nil {
-		return fmt.Errorf("failed to open database: %v", err)
+		log.Fatal(err)
 	}
+	oidcProvider = provider
 
-	// Test connection
-	if err := db.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %v", err)
+	// Optional static API keys and JWT bearer tokens for scripts and services
+	keys, err := parseStaticAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		log.Fatal("Invalid API_KEYS: ", err)
 	}
-
-	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
-
-	log.Println("Database connection established")
-	return nil
-}
-
-// Create database tables if they don't exist
-func createTables() error {
-	receiptsTable := `
-	CREATE TABLE IF NOT EXISTS receipts (
-		id BIGINT AUTO_INCREMENT PRIMARY KEY,
-		file_name VARCHAR(255) NOT NULL,
-		drive_file_id VARCHAR(255),
-		status ENUM('processed', 'needs_review', 'error') NOT NULL DEFAULT 'needs_review',
-		uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		INDEX idx_status (status),
-		INDEX idx_uploaded_at (uploaded_at)
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-	`
-
-	transactionsTable := `
-	CREATE TABLE IF NOT EXISTS transactions (
-		id BIGINT AUTO_INCREMENT PRIMARY KEY,
-		receipt_id BIGINT NOT NULL,
-		date DATE,
-		merchant_raw VARCHAR(255),
-		merchant_clean VARCHAR(255),
-		category VARCHAR(100),
-		amount DECIMAL(10, 2),
-		currency VARCHAR(3),
-		confidence DECIMAL(5, 4),
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (receipt_id) REFERENCES receipts(id) ON DELETE CASCADE,
-		INDEX idx_receipt_id (receipt_id),
-		INDEX idx_date (date),
-		INDEX idx_merchant_clean (merchant_clean),
-		INDEX idx_category (category)
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-	`
-
-	if _, err := db.Exec(receiptsTable); err != nil {
-		return fmt.Errorf("failed to create receipts table: %v", err)
+	staticAPIKeys = keys
+	if jwtAuth, err = newJWTAuth(); err != nil {
+		log.Fatal(err)
 	}
 
-	if _, err := db.Exec(transactionsTable); err != nil {
-		return fmt.Errorf("failed to create transactions table: %v", err)
+	// Optional monthly Gemini spend cap that degrades processing near it
+	if geminiBudget, err = newGeminiBudget(); err != nil {
+		log.Fatal(err)
 	}
 
-	log.Println("Database tables created/verified")
-	return nil
-}
-
-func main() {
-	// Initialize database
-	if err := initDB(); err != nil {
-		log.Fatal("Database initialization failed:", err)
+	// Development only: inject faults to exercise retries and error handling
+	faults = newFaultInjector()
+	if faults != nil {
+		log.Printf("WARNING: fault injection is enabled: %s", faults.config().describe())
 	}
-	defer db.Close()
 
-	// Create tables
-	if err := createTables(); err != nil {
-		log.Fatal("Failed to create tables:", err)
-	}
+	// Remove temp files left behind by a previous crash
+	cleanupStaleTempDirs(time.Hour)
 
-	app := fiber.New()
+	// Routes are case-sensitive so paths match what the role and scope
+	// checks in authenticate compare
+	app := fiber.New(fiber.Config{
+		BodyLimit:     maxRequestBody(),
+		CaseSensitive: true,
+	})
 
 	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll("./uploads", os.ModePerm); err != nil {
+	if err := os.MkdirAll(uploadsDir, os.ModePerm); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
 		log.Fatal(err)
 	}
 
+	// Requests are counted before authentication so rejected ones show up
+	app.Use(recordRequestMetrics)
+
+	// Sessions are resolved before any other route
+	registerAuthRoutes(app)
+	registerAPITokenRoutes(app)
+
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
 			"message": "Receipt Processor API",
 			"version": "1.0.0",
 			"endpoints": fiber.Map{
-				"POST /ocr":                   "Upload an image to extract text using OCR",
-				"POST /receipts/ingest":       "Upload and store a receipt file",
-				"POST /gemini/test":           "Test Gemini AI connection",
-				"GET  /gemini/models":         "List available Gemini AI models",
-				"POST /gemini/analyze":        "Analyze text with Gemini AI",
-				"POST /receipts/analyze/{id}": "Analyze a receipt using Gemini AI",
+				"GET  /metrics":                                 "Prometheus metrics: requests, OCR, Gemini, queue and database pool",
+				"GET  /health":                                  "Health check; answers 503 while the database is unreachable",
+				"GET  /auth/login":                              "Sign in with the company identity provider (OIDC)",
+				"GET  /auth/me":                                 "The signed-in user and their role",
+				"POST /auth/logout":                             "End the session",
+				"GET  /me/tokens":                               "List your API tokens",
+				"POST /me/tokens":                               "Create an API token with ingest, read or admin scope",
+				"DELETE /me/tokens/:id":                         "Revoke one of your API tokens",
+				"GET  /admin/tokens":                            "List every API token with its last use",
+				"DELETE /admin/tokens/:id":                      "Revoke any API token",
+				"GET  /admin/faults":                            "Faults injected for testing, if FAULT_INJECTION is enabled",
+				"PUT  /admin/faults":                            "Change the injected faults while the server runs",
+				"GET  /admin/users":                             "List users provisioned by single sign-on",
+				"PATCH /admin/users/:id":                        "Disable or re-enable a user",
+				"POST /ocr":                                     "Upload an image to extract text using OCR",
+				"GET  /receipts":                                "List receipts with filters, pagination and optional fields",
+				"GET  /receipts/{id}":                           "Receipt with its transactions and optional fields",
+				"GET  /receipts/export/files":                   "ZIP of receipt files by transaction date range and category",
+				"POST /receipts/capture":                        "Ingest a browser extension screenshot of an online order page",
+				"POST /receipts/ingest/batch":                   "Upload many receipt files or ZIP archives and queue each",
+				"POST /receipts/ingest":                         "Upload a receipt file and queue it for processing",
+				"GET  /profiles":                                "List extraction profiles for specialized document types",
+				"POST /gemini/test":                             "Test Gemini AI connection",
+				"GET  /gemini/models":                           "List available Gemini AI models",
+				"POST /gemini/analyze":                          "Analyze text with Gemini AI",
+				"POST /receipts/analyze/{id}":                   "Re-run OCR and Gemini on a stored receipt",
+				"DELETE /receipts/{id}":                         "Move a receipt to the trash (permanent=true deletes it with its file)",
+				"POST /receipts/{id}/restore":                   "Restore a receipt from the trash",
+				"POST /admin/trash/purge":                       "Permanently delete receipts in the trash",
+				"POST /exchange-rates":                          "Load exchange rates and backfill pending conversions",
+				"GET  /transactions":                            "Search transactions by date, category, merchant, amount, currency and confidence",
+				"GET  /transactions/export":                     "Download the filtered transaction list as CSV or Excel (format=csv|xlsx)",
+				"PATCH /transactions/{id}":                      "Correct a transaction's merchant, category, amount, currency or date",
+				"PATCH /receipts/{id}":                          "Correct a receipt's transaction and set its review status",
+				"GET  /transactions/unconverted":                "List foreign-currency transactions awaiting a rate",
+				"GET  /reports/summary":                         "Spend and average confidence per month, category and merchant",
+				"GET  /reports/prices":                          "Price history of an item per kg, liter or piece across merchants",
+				"GET  /reports/dining":                          "Dining spend and tip statistics",
+				"GET  /reports/cashflow":                        "Outflow per week, month or quarter by category with running totals",
+				"POST /webhooks/test":                           "Send a signed sample webhook",
+				"GET  /export/ynab.csv":                         "Processed transactions as YNAB / Actual Budget CSV",
+				"GET  /export/ledger":                           "Hash-chained JSONL ledger of all transactions for audits",
+				"GET  /webhooks/events":                         "List webhook event types",
+				"GET  /events":                                  "Poll webhook events after a cursor (since, event, limit)",
+				"GET  /receipts/{id}/file":                      "The stored receipt file, or a JPEG thumbnail with thumbnail=true",
+				"GET  /webhooks/subscriptions":                  "List webhook subscriptions",
+				"POST /webhooks/subscriptions":                  "Subscribe a URL to webhook events",
+				"GET  /webhooks/subscriptions/:id":              "Get a webhook subscription",
+				"PATCH /webhooks/subscriptions/:id":             "Update a webhook subscription or rotate its secret",
+				"DELETE /webhooks/subscriptions/:id":            "Delete a webhook subscription",
+				"POST /integrations/ynab/push":                  "Push processed transactions to YNAB",
+				"GET  /integrations/ynab/mappings":              "Category to YNAB category mappings",
+				"PUT  /integrations/ynab/mappings":              "Set or remove a YNAB category mapping",
+				"POST /integrations/firefly/sync":               "Push processed transactions to Firefly III",
+				"GET  /integrations/firefly/mappings":           "Category and source account mappings for Firefly III",
+				"PUT  /integrations/firefly/mappings":           "Set or remove a Firefly III mapping",
+				"POST /integrations/paperless/sync":             "Import new documents tagged as receipts from Paperless-ngx",
+				"POST /integrations/ses/sns":                    "SNS notifications of emails received by SES",
+				"POST /integrations/ses/sync":                   "Import new emails from the SES inbound bucket",
+				"GET  /projects":                                "List projects with their spend",
+				"POST /projects":                                "Create a project or trip with an optional budget",
+				"PATCH /projects/:id":                           "Update a project's budget, dates or client",
+				"POST /projects/:id/transactions":               "Assign transactions to a project",
+				"GET  /projects/:id/report":                     "Project budget burn-down, forecast and alerts",
+				"GET  /projects/:id/invoice":                    "Draft client invoice of unbilled project expenses (json, csv, pdf)",
+				"POST /projects/:id/invoice":                    "Bill the draft invoice and mark its transactions billed",
+				"GET  /invoices/:id":                            "Download a billed invoice",
+				"DELETE /invoices/:id":                          "Void an invoice so its transactions can be billed again",
+				"GET  /approvals":                               "Receipts waiting for your approval (role=submitter for your own)",
+				"POST /approvals/:id/decision":                  "Approve or reject a receipt assigned to you",
+				"GET  /approvals/rules":                         "List approval assignment rules",
+				"POST /approvals/rules":                         "Require approval above an amount for a submitter or category",
+				"DELETE /approvals/rules/:id":                   "Delete an approval rule",
+				"GET  /inventory":                               "Products bought in a date range with the estimated stock left",
+				"GET  /inventory/rules":                         "Show the inventory product and consumption rules",
+				"PUT  /inventory/rules":                         "Set which items make up a product and how fast it is used up",
+				"GET  /loyalty":                                 "Loyalty points per program with estimated balances and expiry reminders",
+				"GET  /loyalty/programs":                        "Show the loyalty program expiry and point value settings",
+				"PUT  /loyalty/programs":                        "Set how long a program's points last and what they are worth",
+				"GET  /public/dashboard":                        "Aggregate monthly spend for a shared display (PUBLIC_DASHBOARD)",
+				"GET  /policy":                                  "Show the expense policy for the caller",
+				"PUT  /policy":                                  "Set claim age, per-category amount limits and required fields",
+				"GET  /policy/violations":                       "Transactions flagged by the expense policy",
+				"GET  /me/settings":                             "Your default currency, home country, auto-approve threshold, notifications and tags",
+				"PUT  /me/settings":                             "Change your default settings",
+				"GET  /i18n/labels":                             "Category and status labels of a locale",
+				"PUT  /i18n/labels":                             "Set or remove custom category and status labels",
+				"GET  /schema":                                  "Entity schemas, allowed values and enabled modules as JSON",
+				"GET  /live":                                    "Server-sent events with review queue and recent transaction changes",
+				"GET  /admin/queue":                             "Running and waiting receipts per processing priority",
+				"GET  /admin/ingest/channels":                   "Receipt volume and failure rate per ingest channel",
+				"GET  /admin/budget":                            "Monthly Gemini spend against GEMINI_MONTHLY_BUDGET and the degradation in effect",
+				"GET  /insights":                                "Category spend that deviates from the trailing months",
+				"POST /admin/insights/run":                      "Analyze category trends for a month now",
+				"GET  /digest":                                  "Preview the summary of the last complete period sent as receipts.digest",
+				"POST /admin/digest/send":                       "Send the receipts.digest event for the last complete period now",
+				"GET  /admin/status":                            "Processing, review queue, errors and token usage snapshot",
+				"POST /admin/reminders/stale":                   "Send reminders about receipts stuck in review now",
+				"GET  /goals/capture":                           "Capture latency goals",
+				"PUT  /goals/capture":                           "Set the capture latency goal for a month",
+				"GET  /reports/utilities":                       "Usage and cost trends per utility account",
+				"GET  /reports/donations":                       "Year-end charitable donations per organization",
+				"GET  /reports/medical":                         "Annual medical out-of-pocket costs per patient",
+				"GET  /reports/vehicles":                        "Fuel cost, consumption and cost per km per vehicle",
+				"GET  /vehicles":                                "List vehicles",
+				"POST /vehicles":                                "Add a vehicle for fuel tracking",
+				"DELETE /vehicles/{id}":                         "Delete a vehicle",
+				"PUT  /receipts/{id}/fuel":                      "Link a fuel receipt to a vehicle and odometer reading",
+				"GET  /reports/capture-latency":                 "Monthly capture latency against the goal, with trend",
+				"GET  /stats/inbox":                             "Review queue size and age for the inbox-zero dashboard",
+				"GET  /stats/streaks":                           "Capture and fully-processed day streaks",
+				"GET  /reports/clusters":                        "Receipt layout clusters with the highest failure rates",
+				"GET  /receipts/{id}/quality":                   "Photo and OCR quality metrics of a receipt",
+				"GET  /receipts/{id}/hocr":                      "Tesseract's hOCR layout of a receipt photo",
+				"GET  /receipts/{id}/layout":                    "Price column of the layout and amounts Gemini read differently",
+				"GET  /admin/quality/report":                    "Parse success by photo quality, with tips for better photos",
+				"POST /admin/clusters/analyze":                  "Re-run the receipt layout cluster analysis",
+				"GET  /reports/merchants":                       "Spend per merchant with a per-branch breakdown",
+				"GET  /pipeline/config":                         "Show the pipeline stage configuration for the caller",
+				"PUT  /pipeline/config":                         "Enable or disable optional pipeline stages for the caller",
+				"GET  /merchants":                               "List merchants with visit and spend statistics",
+				"GET  /merchants/{id}":                          "Merchant statistics with category and branch breakdown",
+				"POST /merchants":                               "Create a merchant with detection keywords and prompt hints",
+				"PATCH /merchants/{id}":                         "Update a merchant's keywords or prompt hints",
+				"DELETE /merchants/{id}":                        "Delete a merchant",
+				"PATCH /transactions/{id}/category":             "Correct a transaction's category",
+				"POST /categorization/review":                   "Queue merchant default category suggestions from recent corrections",
+				"GET  /categorization/suggestions":              "List category suggestions awaiting approval",
+				"POST /categorization/suggestions/{id}/approve": "Approve a suggestion and set the merchant's default category",
+				"POST /categorization/suggestions/{id}/reject":  "Reject a category suggestion",
+				"GET  /receipts/{id}/status":                    "Receipt status and processing progress",
+				"GET  /receipts/{id}/events":                    "Server-sent events with processing progress",
+				"GET  /subscriptions":                           "List subscriptions with annualized totals",
+				"POST /subscriptions":                           "Add a subscription by hand",
+				"PATCH /subscriptions/{id}":                     "Update or cancel a subscription, set a cancel-by date",
+				"POST /subscriptions/detect":                    "Detect subscriptions from recurring charges",
+				"POST /receipts/{id}/verify":                    "Mark a receipt's extracted fields as checked by a human",
+				"GET  /admin/dataset/export":                    "Export verified receipts as a redacted JSONL training dataset",
+				"GET  /admin/artifacts/stats":                   "Stored and uncompressed artifact sizes per kind",
+				"POST /admin/artifacts/prune":                   "Delete artifacts older than the retention period",
+				"GET  /admin/quarantine":                        "Uploads held back because they failed content or virus screening",
+				"GET  /admin/quarantine/:id":                    "A quarantined upload with its audit trail",
+				"GET  /admin/quarantine/:id/download":           "Download a quarantined upload as an attachment",
+				"POST /admin/quarantine/:id/release":            "Release a quarantined upload for processing",
+				"DELETE /admin/quarantine/:id":                  "Delete a quarantined upload",
+				"GET  /admin/disk":                              "Free space on the uploads volume and whether uploads are paused",
+				"POST /admin/disk/archive":                      "Move the oldest local receipt files to DISK_ARCHIVE_BACKEND",
+				"GET  /tax/mappings":                            "Category to tax deduction line mappings of a jurisdiction",
+				"PUT  /tax/mappings":                            "Map a category to a tax deduction line",
+				"GET  /tax/export":                              "Tax year spend per deduction line, optionally as a ZIP with receipts",
+				"GET  /custom-fields":                           "Custom transaction fields defined for this deployment",
+				"PATCH /transactions/{id}/custom-fields":        "Set custom field values of a transaction",
+				"POST /transactions/{id}/shopping-list":         "Reconcile a shopping list with the receipt: bought, missing and extra items",
+				"GET  /transactions/{id}/items":                 "Line items of a transaction",
+				"GET  /transactions/{id}/receipts":              "The receipt of a transaction and copies linked to it as duplicates",
+				"DELETE /receipts/{id}/duplicate":               "Unlink a receipt wrongly linked as a duplicate",
+				"GET  /transactions/{id}/price-checks":          "Line items of a transaction compared with shelf prices",
+				"POST /integrations/drive/upload":               "Upload receipts stored before Drive upload was enabled",
+				"POST /admin/backup":                            "Create a backup archive in object storage",
+				"GET  /admin/backups":                           "List stored backups",
+				"POST /admin/restore":                           "Restore data from a backup archive",
 			},
 		})
 	})
 
+	// Health check for load balancers and orchestrators, open even when
+	// credentials are required
+	app.Get("/health", func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.Context(), 2*time.Second)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"status": "unavailable",
+				"error":  fmt.Sprintf("Database unreachable: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"status": "ok",
+		})
+	})
+
 	// Gemini test endpoint
 	app.Post("/gemini/test", func(c *fiber.Ctx) error {
 		geminiClient, err := NewGeminiClient(c.Context())
@@ -325,58 +482,58 @@ func main() {
 			})
 		}
 
-		// Save file temporarily
-		tempPath := filepath.Join("./uploads", file.Filename)
+		ocrOptions, err := ocrOptionsFromForm(c.FormValue)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// Save file temporarily; concurrent uploads with the same name get
+		// their own directories
+		tmp, err := newTempDir()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create temp directory",
+			})
+		}
+		defer tmp.Cleanup()
+		tempPath := filepath.Join(tmp.Path, filepath.Base(file.Filename))
 		if err := c.SaveFile(file, tempPath); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Failed to save file",
 			})
 		}
-		defer os.Remove(tempPath)
 
-		var text string
-		var processingMethod string
-
-		// Check if file is a PDF
-		if strings.ToLower(filepath.Ext(file.Filename)) == ".pdf" {
-			// Detect PDF type
-			isTextPDF, err := isPDFTextBased(tempPath)
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": fmt.Sprintf("Failed to detect PDF type: %v", err),
-				})
+		isPDF := strings.ToLower(filepath.Ext(file.Filename)) == ".pdf"
+		preprocessing := []string{}
+		if steps, _ := parsePreprocessSteps(ocrOptions.Preprocess); len(steps) > 0 && !isPDF {
+			oriented, orientation := tempPath, 1
+			var err error
+			if containsString(steps, preprocessEXIF) {
+				oriented, orientation, err = exifOrientImageFile(tempPath, tmp.Path)
 			}
-
-			if isTextPDF {
-				// Text-based PDF: use pdftotext (Poppler)
-				processingMethod = "pdftotext"
-				text, err = extractTextFromPDF(tempPath)
-				if err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": fmt.Sprintf("Failed to extract text from PDF: %v", err),
-					})
-				}
-			} else {
-				// Image-based PDF: convert to images and use OCR
-				processingMethod = "pdftoppm + OCR"
-				text, err = convertPDFToImagesAndOCR(tempPath)
-				if err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": fmt.Sprintf("Failed to OCR PDF: %v", err),
-					})
+			var preprocessed string
+			var applied []string
+			if err == nil {
+				if orientation > 1 {
+					preprocessing = append(preprocessing, preprocessEXIF)
 				}
+				preprocessed, applied, err = preprocessImage(oriented, tmp.Path, steps)
 			}
-		} else {
-			// Regular image: use OCR directly
-			processingMethod = "OCR"
-			cmd := exec.Command("tesseract", tempPath, "stdout")
-			output, err := cmd.Output()
 			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": fmt.Sprintf("OCR failed: %v", err),
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+					"error": fmt.Sprintf("Preprocessing failed: %v", err),
 				})
 			}
-			text = string(output)
+			tempPath = preprocessed
+			preprocessing = append(preprocessing, applied...)
+		}
+		text, processingMethod, err := extractReceiptText(tempPath, isPDF, ocrOptions, nil)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("OCR failed: %v", err),
+			})
 		}
 
 		return c.JSON(fiber.Map{
@@ -384,10 +541,12 @@ func main() {
 			"filename":          file.Filename,
 			"text":              text,
 			"processing_method": processingMethod,
+			"ocr_options":       ocrOptions,
+			"preprocessing":     preprocessing,
 		})
 	})
 	// Receipt ingest endpoint
-	app.Post("/receipts/ingest", func(c *fiber.Ctx) error {
+	app.Post("/receipts/ingest", requireDiskSpace, func(c *fiber.Ctx) error {
 		// Get uploaded file
 		file, err := c.FormFile("file")
 		if err != nil {
@@ -407,17 +566,57 @@ func main() {
 		}
 
 		contentType := file.Header.Get("Content-Type")
-		if contentType != "" && !allowedTypes[contentType] {
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		if (contentType != "" && !allowedTypes[contentType]) || !ingestExtensions[ext] {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "Invalid file type. Allowed: images (jpg, png, gif, webp) and PDF",
 			})
 		}
 
+		// Optional extraction profile; detected from the OCR text when omitted
+		profile := c.FormValue("profile")
+		if profile != "" && profile != profileGeneric && profileByName(profile) == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Unknown extraction profile %q", profile),
+			})
+		}
+
+		ocrOptions, err := ocrOptionsFromForm(c.FormValue)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// Fuel receipts may carry the vehicle and its odometer reading
+		fuelLog, err := fuelLogFromForm(c.FormValue)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// Live captures from the mobile app send priority=high; bulk
+		// backfills should send low
+		priority, err := parsePriority(c.FormValue("priority"), priorityNormal)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// n8n workflows name the channel the receipt came in through
+		channel, err := uploadChannel(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
 		// Generate unique filename
 		receiptID := uuid.New().String()
-		ext := filepath.Ext(file.Filename)
 		uniqueFilename := fmt.Sprintf("%s_%s%s", receiptID, time.Now().Format("20060102_150405"), ext)
-		savePath := filepath.Join("./uploads", uniqueFilename)
+		savePath := filepath.Join(uploadsDir, uniqueFilename)
 
 		// Save the file
 		if err := c.SaveFile(file, savePath); err != nil {
@@ -426,6 +625,22 @@ func main() {
 			})
 		}
 
+		// Files that are not really images or PDFs, or that fail the virus
+		// scan, are held for review instead of processed
+		quarantineID, reason, err := quarantineUpload(uniqueFilename, file.Filename, channel, PipelineInput{
+			Priority: priority,
+			Tenant:   tenantKey(c),
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to screen file",
+			})
+		}
+		if reason != "" {
+			return quarantineResponse(c, quarantineID, reason)
+		}
+
 		// Get file info
 		fileInfo, err := os.Stat(savePath)
 		if err != nil {
@@ -434,11 +649,35 @@ func main() {
 			})
 		}
 
-		// Insert receipt into database
+		checksum, err := fileChecksum(savePath)
+		if err != nil {
+			log.Printf("Failed to checksum %s: %v", savePath, err)
+		}
+
+		// Move the file to STORAGE_BACKEND; workers fetch it from there
+		backend, err := storeReceiptFile(uniqueFilename)
+		if err != nil {
+			log.Printf("%v", err)
+			os.Remove(savePath)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to store file",
+			})
+		}
+		jobPath := savePath
+		if backend != "local" {
+			jobPath = uniqueFilename
+		}
+
+		// Insert receipt into database; it stays pending until a worker
+		// picks up its job
 		result, err := db.Exec(
-			"INSERT INTO receipts (file_name, status, uploaded_at) VALUES (?, ?, ?)",
+			"INSERT INTO receipts (file_name, status, storage_backend, checksum, priority, channel, uploaded_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
 			uniqueFilename,
-			"needs_review",
+			"pending",
+			backend,
+			sql.NullString{String: checksum, Valid: checksum != ""},
+			priority,
+			channel,
 			time.Now(),
 		)
 		if err != nil {
@@ -456,134 +695,36 @@ func main() {
 			})
 		}
 
-		// Perform OCR or text extraction on the uploaded file
-		ocrText := ""
-		ocrStatus := "success"
-		ocrError := ""
-		processingMethod := ""
-
-		// Check if file is a PDF
-		isPDF := contentType == "application/pdf" || strings.ToLower(ext) == ".pdf"
-
-		if isPDF {
-			// Detect PDF type
-			isTextPDF, err := isPDFTextBased(savePath)
-			if err != nil {
-				log.Printf("PDF Detection: Failed: %v", err)
-				ocrStatus = "failed"
-				ocrError = fmt.Sprintf("Failed to detect PDF type: %v", err)
-			} else if isTextPDF {
-				// Text-based PDF: use pdftotext
-				processingMethod = "pdftotext"
-				ocrText, err = extractTextFromPDF(savePath)
-				if err != nil {
-					log.Printf("PDF Text Extraction: Failed: %v", err)
-					ocrStatus = "failed"
-					ocrError = fmt.Sprintf("Failed to extract text: %v", err)
-				}
-			} else {
-				// Image-based PDF: convert to images and use OCR
-				processingMethod = "pdftoppm + OCR"
-				ocrText, err = convertPDFToImagesAndOCR(savePath)
-				if err != nil {
-					log.Printf("PDF OCR: Failed: %v", err)
-					ocrStatus = "failed"
-					ocrError = fmt.Sprintf("Failed to OCR PDF: %v", err)
-				}
-			}
-		} else {
-			// Regular image: use OCR directly
-			processingMethod = "OCR"
-			cmd := exec.Command("tesseract", savePath, "stdout")
-			output, err := cmd.Output()
-			if err != nil {
-				log.Printf("OCR: Failed to extract text: %v", err)
-				ocrStatus = "failed"
-				ocrError = fmt.Sprintf("Failed to extract text: %v", err)
-			} else {
-				ocrText = string(output)
+		if fuelLog != nil {
+			if err := saveFuelLog(receiptDBID, fuelLog); err != nil {
+				log.Printf("%v", err)
 			}
 		}
 
-		// Parse OCR text with Gemini if OCR was successful
-		var geminiAnalysis string
-		var geminiStatus string
-		var geminiError string
-		var parsedData *GeminiParsedData
-
-		if ocrStatus == "success" && ocrText != "" {
-			geminiClient, err := NewGeminiClient(c.Context())
-			if err != nil {
-				log.Printf("Gemini: Failed to create client: %v", err)
-				geminiStatus = "failed"
-				geminiError = fmt.Sprintf("Failed to create client: %v", err)
-			} else {
-				defer geminiClient.Close()
-
-				response, err := geminiClient.AnalyzeReceiptTextWithPrompt(ocrText)
-				if err != nil {
-					log.Printf("Gemini: Failed to analyze: %v", err)
-					geminiStatus = "failed"
-					geminiError = fmt.Sprintf("Failed to analyze: %v", err)
-				} else if !response.Success {
-					log.Printf("Gemini: Analysis unsuccessful: %s", response.Error)
-					geminiStatus = "failed"
-					geminiError = response.Error
-				} else {
-					geminiAnalysis = response.Text
-					geminiStatus = "success"
-
-					// Try to parse JSON from Gemini response
-					// Clean the response - sometimes Gemini wraps JSON in markdown code blocks
-					cleanedText := strings.TrimSpace(response.Text)
-					cleanedText = strings.TrimPrefix(cleanedText, "```json")
-					cleanedText = strings.TrimPrefix(cleanedText, "```")
-					cleanedText = strings.TrimSuffix(cleanedText, "```")
-					cleanedText = strings.TrimSpace(cleanedText)
-
-					var data GeminiParsedData
-					if err := json.Unmarshal([]byte(cleanedText), &data); err != nil {
-						log.Printf("Gemini: Failed to parse JSON: %v", err)
-						geminiError = fmt.Sprintf("Failed to parse JSON: %v", err)
-					} else {
-						parsedData = &data
-
-						// Insert into transactions table
-						var transactionDate sql.NullTime
-						if data.Date != "" {
-							if t, err := time.Parse("2006-01-02", data.Date); err == nil {
-								transactionDate = sql.NullTime{Time: t, Valid: true}
-							}
-						}
-
-						_, err := db.Exec(
-							`INSERT INTO transactions (receipt_id, date, merchant_raw, merchant_clean, category, amount, currency, confidence, created_at) 
-							VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-							receiptDBID,
-							transactionDate,
-							sql.NullString{String: data.MerchantRaw, Valid: data.MerchantRaw != ""},
-							sql.NullString{String: data.MerchantClean, Valid: data.MerchantClean != ""},
-							sql.NullString{String: data.Category, Valid: data.Category != ""},
-							sql.NullFloat64{Float64: data.Amount, Valid: data.Amount > 0},
-							sql.NullString{String: data.Currency, Valid: data.Currency != ""},
-							sql.NullFloat64{Float64: data.Confidence, Valid: data.Confidence > 0},
-							time.Now(),
-						)
-						if err != nil {
-							log.Printf("Failed to insert transaction: %v", err)
-						} else {
-							// Update receipt status to processed
-							db.Exec("UPDATE receipts SET status = ? WHERE id = ?", "processed", receiptDBID)
-						}
-					}
-				}
+		// OCR, Gemini parsing and storage run in the background with the
+		// tenant's pipeline configuration; progress is reported by
+		// /receipts/:id/status and /receipts/:id/events
+		tenant := tenantKey(c)
+		jobID, err := ingestQueue.Enqueue(PipelineInput{
+			ReceiptID: receiptDBID,
+			Path:      jobPath,
+			IsPDF:     contentType == "application/pdf" || strings.ToLower(ext) == ".pdf",
+			Profile:   profile,
+			OCR:       &ocrOptions,
+			Priority:  priority,
+			Tenant:    tenant,
+		}, backend)
+		if err != nil {
+			log.Printf("%v", err)
+			if _, err := db.Exec("UPDATE receipts SET status = 'error' WHERE id = ?", receiptDBID); err != nil {
+				log.Printf("Failed to mark receipt %d as errored: %v", receiptDBID, err)
 			}
-		} else {
-			geminiStatus = "skipped"
-			geminiError = "No OCR text available"
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to queue receipt for processing",
+			})
 		}
 
-		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
 			"success":       true,
 			"receipt_id":    receiptDBID,
 			"uuid":          receiptID,
@@ -592,23 +733,110 @@ func main() {
 			"file_size":     fileInfo.Size(),
 			"content_type":  contentType,
 			"upload_time":   time.Now().Format(time.RFC3339),
-			"file_path":     savePath,
-			"status":        "needs_review",
-			"ocr": fiber.Map{
-				"status":            ocrStatus,
-				"text":              ocrText,
-				"error":             ocrError,
-				"processing_method": processingMethod,
-			},
-			"gemini": fiber.Map{
-				"status":   geminiStatus,
-				"analysis": geminiAnalysis,
-				"error":    geminiError,
-				"parsed":   parsedData,
+			"file_path":     jobPath,
+			"storage":       backend,
+			"status":        "pending",
+			"priority":      priority,
+			"channel":       channel,
+			"job_id":        jobID,
+			"status_url":    fmt.Sprintf("/receipts/%d/status", receiptDBID),
+			"pipeline": fiber.Map{
+				"tenant": tenant,
 			},
 		})
 	})
 
+	registerCaptureRoutes(app)
+	registerBatchIngestRoutes(app)
+	registerProfileRoutes(app)
+	registerDatasetRoutes(app)
+	registerClusterRoutes(app)
+	registerQualityRoutes(app)
+	registerLayoutRoutes(app)
+	registerStreakRoutes(app)
+	registerReminderRoutes(app)
+	registerCaptureGoalRoutes(app)
+	registerUtilityRoutes(app)
+	registerDonationRoutes(app)
+	registerMedicalRoutes(app)
+	registerVehicleRoutes(app)
+	registerStatusRoutes(app)
+	registerChannelRoutes(app)
+	registerBudgetRoutes(app)
+	registerCategoryTrendRoutes(app)
+	registerPaperlessRoutes(app)
+	registerSESRoutes(app)
+	registerFireflyRoutes(app)
+	registerYNABRoutes(app)
+	registerLedgerRoutes(app)
+	registerDriveRoutes(app)
+	registerWebhookRoutes(app)
+	registerWebhookSubscriptionRoutes(app)
+	registerQueueRoutes(app)
+	registerSettingsRoutes(app)
+	registerApprovalRoutes(app)
+	registerPolicyRoutes(app)
+	registerProjectRoutes(app)
+	registerInvoiceRoutes(app)
+	registerLiveRoutes(app)
+	registerSchemaRoutes(app)
+	registerArtifactRoutes(app)
+	registerDiskSpaceRoutes(app)
+	registerFaultRoutes(app)
+	registerReceiptRoutes(app)
+	registerTrashRoutes(app)
+	registerI18nRoutes(app)
+	registerReceiptExportRoutes(app)
+	registerTransactionRoutes(app)
+	registerDedupRoutes(app)
+	registerTransactionExportRoutes(app)
+	registerReviewRoutes(app)
+	registerTaxRoutes(app)
+	registerCustomFieldRoutes(app)
+	registerPriceCheckRoutes(app)
+	registerItemRoutes(app)
+	registerPriceHistoryRoutes(app)
+	registerShoppingListRoutes(app)
+	registerInventoryRoutes(app)
+	registerLoyaltyRoutes(app)
+	registerDigestRoutes(app)
+	registerEventRoutes(app)
+	registerPublicDashboardRoutes(app)
+	registerMetricsRoutes(app)
+	registerQuarantineRoutes(app)
+	registerBackupRoutes(app)
+	registerReportRoutes(app)
+	registerCurrencyRoutes(app)
+	registerPipelineConfigRoutes(app)
+	registerMerchantRoutes(app)
+	registerMerchantStatsRoutes(app)
+	registerCategorizationRoutes(app)
+	registerSubscriptionRoutes(app)
+	registerProgressRoutes(app)
+	startBackupScheduler()
+	startCategorizationScheduler()
+	startSubscriptionScheduler()
+	startAnonymizeScheduler()
+	startClusterScheduler()
+	startStaleReminderScheduler()
+	startPaperlessScheduler()
+	startSESScheduler()
+	startFireflyScheduler()
+	startArtifactScheduler()
+	startDiskSpaceScheduler()
+	startArchiveScheduler()
+	startCategoryTrendScheduler()
+	startLoyaltyScheduler()
+	startDigestScheduler()
+	startTrashScheduler()
+	startEventPruner()
+	startIngestWorkers()
+
+	// Private deployments can restrict clients by address and certificate
+	ln, err := serverListener(":3000")
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Println("Server starting on :3000")
-	log.Fatal(app.Listen(":3000"))
+	log.Fatal(app.Listener(ln))
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MedicalExpense is one bill in the medical expenses report. Amounts are in
+// the home currency.
+type MedicalExpense struct {
+	TransactionID int64   `json:"transaction_id"`
+	ReceiptID     int64   `json:"receipt_id"`
+	Date          string  `json:"date"`
+	Provider      string  `json:"provider"`
+	ProviderID    string  `json:"provider_id,omitempty"`
+	Billed        float64 `json:"billed"`
+	InsurancePaid float64 `json:"insurance_paid"`
+	OutOfPocket   float64 `json:"out_of_pocket"`
+	ServiceCodes  []any   `json:"service_codes,omitempty"`
+	ClaimNumber   string  `json:"claim_number,omitempty"`
+	// ReferenceNumber is the invoice or statement number
+	ReferenceNumber string `json:"reference_number,omitempty"`
+}
+
+// MedicalPatient groups a year's medical expenses of one patient
+type MedicalPatient struct {
+	Name          string           `json:"name"`
+	Expenses      []MedicalExpense `json:"expenses"`
+	Billed        float64          `json:"billed"`
+	InsurancePaid float64          `json:"insurance_paid"`
+	OutOfPocket   float64          `json:"out_of_pocket"`
+	// Unclaimed counts expenses with out-of-pocket costs but no insurance
+	// claim number, which may still be submitted
+	Unclaimed int `json:"unclaimed"`
+}
+
+// medicalFields are the medical profile fields stored in extra_fields
+type medicalFields struct {
+	ProviderName  string   `json:"provider_name"`
+	ProviderID    string   `json:"provider_id"`
+	PatientName   string   `json:"patient_name"`
+	ServiceCodes  []any    `json:"service_codes"`
+	BilledAmount  *float64 `json:"billed_amount"`
+	InsurancePaid float64  `json:"insurance_paid"`
+	OutOfPocket   *float64 `json:"out_of_pocket"`
+	ClaimNumber   string   `json:"claim_number"`
+}
+
+// unknownPatient groups expenses whose patient was not extracted
+const unknownPatient = "unknown"
+
+// registerMedicalRoutes adds the annual medical expenses report
+func registerMedicalRoutes(app *fiber.App) {
+	// Out-of-pocket medical costs of a year per patient, from receipts
+	// extracted with the medical profile, for insurance claims and tax
+	// deductions. patient filters by name. Archived transactions are
+	// included.
+	app.Get("/reports/medical", func(c *fiber.Ctx) error {
+		year := time.Now().Year()
+		if v := c.Query("year"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1900 || n > 9999 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid year",
+				})
+			}
+			year = n
+		}
+		patientFilter := strings.TrimSpace(c.Query("patient"))
+
+		rows, err := db.Query(
+			`SELECT id, receipt_id, date, COALESCE(merchant_clean, merchant_raw, ''), amount, home_amount,
+				COALESCE(reference_number, ''), extra_fields
+			FROM `+transactionsAllView+`
+			WHERE profile = ? AND date >= ? AND date < ?
+			ORDER BY date, id`,
+			"medical", time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC),
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build medical report: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		patients := []*MedicalPatient{}
+		byName := map[string]*MedicalPatient{}
+		var billed, insurancePaid, outOfPocket float64
+		unconverted := 0
+		for rows.Next() {
+			var e MedicalExpense
+			var date time.Time
+			var merchant string
+			var amount, homeAmount sql.NullFloat64
+			var extra []byte
+			if err := rows.Scan(&e.TransactionID, &e.ReceiptID, &date, &merchant, &amount, &homeAmount,
+				&e.ReferenceNumber, &extra); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read medical report: %v", err),
+				})
+			}
+			var fields medicalFields
+			if len(extra) > 0 {
+				if err := json.Unmarshal(extra, &fields); err != nil {
+					fields = medicalFields{}
+				}
+			}
+
+			name := strings.TrimSpace(fields.PatientName)
+			if name == "" {
+				name = unknownPatient
+			}
+			if patientFilter != "" && !strings.EqualFold(name, patientFilter) {
+				continue
+			}
+			if !homeAmount.Valid || !amount.Valid || amount.Float64 <= 0 {
+				unconverted++
+				continue
+			}
+
+			// Profile fields are in the receipt currency; the amount is
+			// what the patient paid or owes
+			rate := homeAmount.Float64 / amount.Float64
+			e.Date = date.Format("2006-01-02")
+			e.Provider = fields.ProviderName
+			if e.Provider == "" {
+				e.Provider = merchant
+			}
+			e.ProviderID = fields.ProviderID
+			e.OutOfPocket = roundCents(homeAmount.Float64)
+			if fields.OutOfPocket != nil && *fields.OutOfPocket >= 0 {
+				e.OutOfPocket = roundCents(*fields.OutOfPocket * rate)
+			}
+			e.InsurancePaid = roundCents(fields.InsurancePaid * rate)
+			e.Billed = roundCents(e.OutOfPocket + e.InsurancePaid)
+			if fields.BilledAmount != nil && *fields.BilledAmount > 0 {
+				e.Billed = roundCents(*fields.BilledAmount * rate)
+			}
+			e.ServiceCodes = fields.ServiceCodes
+			e.ClaimNumber = fields.ClaimNumber
+
+			p, ok := byName[strings.ToLower(name)]
+			if !ok {
+				p = &MedicalPatient{Name: name, Expenses: []MedicalExpense{}}
+				byName[strings.ToLower(name)] = p
+				patients = append(patients, p)
+			}
+			p.Expenses = append(p.Expenses, e)
+			p.Billed = roundCents(p.Billed + e.Billed)
+			p.InsurancePaid = roundCents(p.InsurancePaid + e.InsurancePaid)
+			p.OutOfPocket = roundCents(p.OutOfPocket + e.OutOfPocket)
+			if e.OutOfPocket > 0 && e.ClaimNumber == "" {
+				p.Unclaimed++
+			}
+			billed = roundCents(billed + e.Billed)
+			insurancePaid = roundCents(insurancePaid + e.InsurancePaid)
+			outOfPocket = roundCents(outOfPocket + e.OutOfPocket)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read medical report: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"year":           year,
+			"currency":       homeCurrency(),
+			"patients":       patients,
+			"billed":         billed,
+			"insurance_paid": insurancePaid,
+			"out_of_pocket":  outOfPocket,
+			"unconverted":    unconverted,
+		})
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// resolveMerchantID returns the merchants row for a transaction's cleaned
+// merchant name, creating it on first sight so every transaction is linked
+// to the normalized merchant table
+func resolveMerchantID(data *GeminiParsedData) (sql.NullInt64, error) {
+	name := strings.TrimSpace(data.MerchantClean)
+	if name == "" {
+		name = strings.TrimSpace(data.MerchantRaw)
+	}
+	if name == "" {
+		return sql.NullInt64{}, nil
+	}
+
+	// LAST_INSERT_ID(id) makes the existing row's ID available on duplicates
+	result, err := db.Exec(
+		"INSERT INTO merchants (name) VALUES (?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)",
+		name,
+	)
+	if err != nil {
+		return sql.NullInt64{}, fmt.Errorf("failed to resolve merchant %q: %v", name, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return sql.NullInt64{}, fmt.Errorf("failed to resolve merchant %q: %v", name, err)
+	}
+	return sql.NullInt64{Int64: id, Valid: true}, nil
+}
+
+// linkTransactionMerchants links live and archived transactions stored
+// before merchant_id existed to their merchants, creating merchant rows as
+// needed
+func linkTransactionMerchants() error {
+	for _, table := range []string{"transactions", "transactions_archive"} {
+		if _, err := db.Exec(
+			`INSERT IGNORE INTO merchants (name)
+			SELECT DISTINCT COALESCE(merchant_clean, merchant_raw) FROM ` + table + `
+			WHERE merchant_id IS NULL AND COALESCE(merchant_clean, merchant_raw) IS NOT NULL`,
+		); err != nil {
+			return fmt.Errorf("failed to create merchants for existing %s: %v", table, err)
+		}
+		if _, err := db.Exec(
+			`UPDATE ` + table + ` t JOIN merchants m ON m.name = COALESCE(t.merchant_clean, t.merchant_raw)
+			SET t.merchant_id = m.id
+			WHERE t.merchant_id IS NULL`,
+		); err != nil {
+			return fmt.Errorf("failed to link %s to merchants: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// merchantStatsSQL selects a merchant with the aggregates of its live and
+// archived transactions
+const merchantStatsSQL = `SELECT m.id, m.name, COUNT(t.id), SUM(t.amount), AVG(t.amount), MIN(t.date), MAX(t.date)
+	FROM merchants m
+	LEFT JOIN ` + transactionsAllView + ` t ON t.merchant_id = m.id`
+
+// scanMerchantStats reads one merchantStatsSQL row into a response map
+func scanMerchantStats(scan func(dest ...any) error) (fiber.Map, error) {
+	var id int64
+	var name string
+	var visits int
+	var total, avg sql.NullFloat64
+	var first, last sql.NullTime
+	if err := scan(&id, &name, &visits, &total, &avg, &first, &last); err != nil {
+		return nil, err
+	}
+
+	stats := fiber.Map{
+		"id":             id,
+		"name":           name,
+		"visits":         visits,
+		"total_spend":    total.Float64,
+		"average_basket": avg.Float64,
+		"first_visit":    nil,
+		"last_visit":     nil,
+	}
+	if first.Valid {
+		stats["first_visit"] = first.Time.Format("2006-01-02")
+		stats["last_visit"] = last.Time.Format("2006-01-02")
+	}
+	return stats, nil
+}
+
+// registerMerchantStatsRoutes adds the merchant listing endpoints
+func registerMerchantStatsRoutes(app *fiber.App) {
+	// List merchants with visit count and spend, most visited first
+	app.Get("/merchants", func(c *fiber.Ctx) error {
+		rows, err := db.Query(merchantStatsSQL + `
+			GROUP BY m.id, m.name
+			ORDER BY COUNT(t.id) DESC, m.name`)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list merchants: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		merchants := []fiber.Map{}
+		for rows.Next() {
+			stats, err := scanMerchantStats(rows.Scan)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read merchants: %v", err),
+				})
+			}
+			merchants = append(merchants, stats)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"merchants": merchants,
+		})
+	})
+
+	// Merchant statistics with category distribution and branches
+	app.Get("/merchants/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid merchant ID",
+			})
+		}
+
+		stats, err := scanMerchantStats(db.QueryRow(merchantStatsSQL+`
+			WHERE m.id = ?
+			GROUP BY m.id, m.name`, id).Scan)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Merchant not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load merchant: %v", err),
+			})
+		}
+
+		var keywords, hints sql.NullString
+		if err := db.QueryRow("SELECT keywords, prompt_hints FROM merchants WHERE id = ?", id).Scan(&keywords, &hints); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load merchant: %v", err),
+			})
+		}
+		stats["keywords"] = splitKeywords(keywords.String)
+		stats["prompt_hints"] = hints.String
+
+		rows, err := db.Query(
+			`SELECT COALESCE(category, 'uncategorized'), COUNT(*), SUM(amount)
+			FROM `+transactionsAllView+` WHERE merchant_id = ?
+			GROUP BY COALESCE(category, 'uncategorized')
+			ORDER BY COUNT(*) DESC`,
+			id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load categories: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		visits := stats["visits"].(int)
+		categories := []fiber.Map{}
+		for rows.Next() {
+			var category string
+			var count int
+			var total sql.NullFloat64
+			if err := rows.Scan(&category, &count, &total); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read categories: %v", err),
+				})
+			}
+			categories = append(categories, fiber.Map{
+				"category":    category,
+				"visits":      count,
+				"share":       float64(count) / float64(visits),
+				"total_spend": total.Float64,
+			})
+		}
+		stats["categories"] = categories
+
+		branchRows, err := db.Query(
+			`SELECT `+branchLabelSQL+` AS branch, COUNT(*), SUM(amount)
+			FROM `+transactionsAllView+` WHERE merchant_id = ?
+			GROUP BY branch
+			ORDER BY COUNT(*) DESC`,
+			id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load branches: %v", err),
+			})
+		}
+		defer branchRows.Close()
+
+		branches := []fiber.Map{}
+		for branchRows.Next() {
+			var branch sql.NullString
+			var count int
+			var total sql.NullFloat64
+			if err := branchRows.Scan(&branch, &count, &total); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read branches: %v", err),
+				})
+			}
+			if !branch.Valid {
+				continue
+			}
+			branches = append(branches, fiber.Map{
+				"branch":      branch.String,
+				"visits":      count,
+				"total_spend": total.Float64,
+			})
+		}
+		stats["branches"] = branches
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"merchant": stats,
+		})
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MerchantPromptHint is a merchant-specific snippet injected into the
+// extraction prompt when one of the merchant's keywords appears in OCR text
+type MerchantPromptHint struct {
+	MerchantID int64
+	Name       string
+	Keywords   []string
+	Hints      string
+}
+
+// splitKeywords parses the comma-separated keywords column
+func splitKeywords(raw string) []string {
+	var keywords []string
+	for _, k := range strings.Split(raw, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+// detectMerchantHint returns the prompt hint of the first merchant whose
+// keyword occurs in the OCR text (case-insensitive), or nil if none match.
+// Longer keywords are checked first so specific matches win.
+func detectMerchantHint(ocrText string) (*MerchantPromptHint, error) {
+	rows, err := db.Query(
+		`SELECT id, name, keywords, prompt_hints FROM merchants
+		WHERE keywords IS NOT NULL AND keywords <> '' AND prompt_hints IS NOT NULL AND prompt_hints <> ''`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load merchant hints: %v", err)
+	}
+	defer rows.Close()
+
+	upper := strings.ToUpper(ocrText)
+	var best *MerchantPromptHint
+	bestLen := 0
+	for rows.Next() {
+		var h MerchantPromptHint
+		var keywords string
+		if err := rows.Scan(&h.MerchantID, &h.Name, &keywords, &h.Hints); err != nil {
+			return nil, fmt.Errorf("failed to scan merchant hint: %v", err)
+		}
+		h.Keywords = splitKeywords(keywords)
+		for _, k := range h.Keywords {
+			if len(k) > bestLen && strings.Contains(upper, strings.ToUpper(k)) {
+				hint := h
+				best, bestLen = &hint, len(k)
+			}
+		}
+	}
+	return best, rows.Err()
+}
+
+// registerMerchantRoutes adds merchant management endpoints
+func registerMerchantRoutes(app *fiber.App) {
+	type MerchantRequest struct {
+		Name        *string `json:"name"`
+		Keywords    *string `json:"keywords"`
+		PromptHints *string `json:"prompt_hints"`
+	}
+
+	// Create a merchant record, optionally with detection keywords
+	// (comma-separated) and extraction hints for its receipt layout
+	app.Post("/merchants", func(c *fiber.Ctx) error {
+		var req MerchantRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Name field is required",
+			})
+		}
+
+		result, err := db.Exec(
+			"INSERT INTO merchants (name, keywords, prompt_hints) VALUES (?, ?, ?)",
+			strings.TrimSpace(*req.Name), nullableString(req.Keywords), nullableString(req.PromptHints),
+		)
+		if err != nil {
+			log.Printf("Failed to create merchant: %v", err)
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Failed to create merchant (name must be unique)",
+			})
+		}
+		id, _ := result.LastInsertId()
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"id":      id,
+		})
+	})
+
+	// Update a merchant's name, keywords or prompt hints; omitted fields are unchanged
+	app.Patch("/merchants/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid merchant ID",
+			})
+		}
+
+		var req MerchantRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		var sets []string
+		var args []any
+		if req.Name != nil {
+			if strings.TrimSpace(*req.Name) == "" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Name cannot be empty",
+				})
+			}
+			sets = append(sets, "name = ?")
+			args = append(args, strings.TrimSpace(*req.Name))
+		}
+		if req.Keywords != nil {
+			sets = append(sets, "keywords = ?")
+			args = append(args, nullableString(req.Keywords))
+		}
+		if req.PromptHints != nil {
+			sets = append(sets, "prompt_hints = ?")
+			args = append(args, nullableString(req.PromptHints))
+		}
+		if len(sets) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing to update",
+			})
+		}
+
+		args = append(args, id)
+		result, err := db.Exec("UPDATE merchants SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update merchant: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists int
+			if err := db.QueryRow("SELECT COUNT(*) FROM merchants WHERE id = ?", id).Scan(&exists); err == nil && exists == 0 {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Merchant not found",
+				})
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"id":      id,
+		})
+	})
+
+	app.Delete("/merchants/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid merchant ID",
+			})
+		}
+
+		result, err := db.Exec("DELETE FROM merchants WHERE id = ?", id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to delete merchant: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Merchant not found",
+			})
+		}
+		if _, err := db.Exec("UPDATE transactions SET merchant_id = NULL WHERE merchant_id = ?", id); err != nil {
+			log.Printf("Failed to unlink transactions from merchant %d: %v", id, err)
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+}
+
+// nullableString converts an optional, possibly blank string to a SQL value
+func nullableString(s *string) sql.NullString {
+	if s == nil || strings.TrimSpace(*s) == "" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strings.TrimSpace(*s), Valid: true}
+}
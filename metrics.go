@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/generative-ai-go/genai"
+)
+
+// metricsPrefix namespaces the exported metrics
+const metricsPrefix = "receipt_processor_"
+
+// Histogram buckets in seconds
+var (
+	requestBuckets    = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	processingBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+)
+
+// metricCounter is a counter with labels
+type metricCounter struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+// newCounter creates a counter; the name gets the metrics prefix
+func newCounter(name, help string, labels ...string) *metricCounter {
+	return &metricCounter{name: metricsPrefix + name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Add increases the series with the given label values
+func (m *metricCounter) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+// write renders the counter in the Prometheus text format
+func (m *metricCounter) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, metricLabels(m.labels, key, ""), formatMetric(m.values[key]))
+	}
+}
+
+// histogramSeries counts the observations of one label set
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// metricHistogram is a histogram with labels
+type metricHistogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+// newHistogram creates a histogram; the name gets the metrics prefix
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{
+		name: metricsPrefix + name, help: help, labels: labels, buckets: buckets,
+		series: map[string]*histogramSeries{},
+	}
+}
+
+// Observe records a value for the given label values
+func (m *metricHistogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// write renders the histogram in the Prometheus text format
+func (m *metricHistogram) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		for i, upper := range m.buckets {
+			le := `le="` + formatMetric(upper) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, metricLabels(m.labels, key, le), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, metricLabels(m.labels, key, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, metricLabels(m.labels, key, ""), formatMetric(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, metricLabels(m.labels, key, ""), s.count)
+	}
+}
+
+// writeGauge renders a gauge read at scrape time; values are keyed by the
+// label values joined with \x00
+func writeGauge(w io.Writer, name, help string, labels []string, values map[string]float64) {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, metricLabels(labels, key, ""), formatMetric(values[key]))
+	}
+}
+
+// sortedKeys returns the keys of a series map in order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper escapes label values for the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels renders the label set of a series, with extra (e.g. the
+// le of a bucket) appended
+func metricLabels(names []string, key, extra string) string {
+	var parts []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			if i < len(names) {
+				parts = append(parts, names[i]+`="`+labelEscaper.Replace(v)+`"`)
+			}
+		}
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatMetric formats a sample value
+func formatMetric(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics recorded while the server runs
+var (
+	httpRequests = newCounter("http_requests_total",
+		"HTTP requests by method, route and status code.", "method", "route", "status")
+	httpRequestDuration = newHistogram("http_request_duration_seconds",
+		"HTTP request latency by method and route.", requestBuckets, "method", "route")
+	ocrDuration = newHistogram("ocr_duration_seconds",
+		"Time spent extracting text from a receipt, by method.", processingBuckets, "method")
+	geminiDuration = newHistogram("gemini_request_duration_seconds",
+		"Gemini request latency by model and outcome.", processingBuckets, "model", "outcome")
+	geminiTokens = newCounter("gemini_tokens_total",
+		"Gemini tokens used by model and kind (prompt or response).", "model", "kind")
+	receiptsProcessed = newCounter("receipts_processed_total",
+		"Receipts run through the pipeline by result.", "result")
+	receiptProcessingDuration = newHistogram("receipt_processing_duration_seconds",
+		"Time a receipt spends in the pipeline, excluding the wait for a slot.", processingBuckets)
+)
+
+// recordRequestMetrics counts requests and their latency per route. The
+// route pattern is used as label, so IDs in paths don't create series.
+func recordRequestMetrics(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		// The error handler sets the status after this middleware returns
+		status = fiber.StatusInternalServerError
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			status = fe.Code
+		}
+	}
+	route := c.Route().Path
+	if route == "/" && c.Path() != "/" {
+		// Only middleware, mounted at /, ran: the path is unknown or the
+		// request was rejected, e.g. by authentication
+		route = "none"
+	}
+	httpRequests.Add(1, c.Method(), route, strconv.Itoa(status))
+	httpRequestDuration.Observe(time.Since(start).Seconds(), c.Method(), route)
+	return err
+}
+
+// recordGeminiMetrics records the latency and token usage of a Gemini
+// request
+func recordGeminiMetrics(model string, elapsed time.Duration, usage *genai.UsageMetadata, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	geminiDuration.Observe(elapsed.Seconds(), model, outcome)
+	if usage != nil {
+		geminiTokens.Add(float64(usage.PromptTokenCount), model, "prompt")
+		geminiTokens.Add(float64(usage.CandidatesTokenCount), model, "response")
+	}
+}
+
+// recordProcessingMetrics counts a finished pipeline run
+func recordProcessingMetrics(res *PipelineResult, elapsed time.Duration) {
+	result := "success"
+	switch {
+	case res.OCRStatus == "failed":
+		result = "ocr_failed"
+	case res.GeminiStatus == "failed":
+		result = "gemini_failed"
+	case res.GeminiStatus == "skipped":
+		result = "gemini_skipped"
+	}
+	receiptsProcessed.Add(1, result)
+	receiptProcessingDuration.Observe(elapsed.Seconds())
+}
+
+// writeMetrics renders every metric, reading queue and database pool state
+// at scrape time
+func writeMetrics(w io.Writer) {
+	httpRequests.write(w)
+	httpRequestDuration.write(w)
+	ocrDuration.write(w)
+	geminiDuration.write(w)
+	geminiTokens.write(w)
+	receiptsProcessed.write(w)
+	receiptProcessingDuration.write(w)
+
+	if jobs, err := ingestQueue.Stats(); err != nil {
+		log.Printf("Metrics: %v", err)
+	} else {
+		values := map[string]float64{}
+		for status, n := range jobs {
+			values[status] = float64(n)
+		}
+		writeGauge(w, "ingest_jobs", "Ingest jobs by status.", []string{"status"}, values)
+	}
+
+	slots := map[string]float64{}
+	for _, q := range pipelineScheduler.Stats() {
+		slots[q.Priority+"\x00running"] = float64(q.Running)
+		slots[q.Priority+"\x00waiting"] = float64(q.Waiting)
+	}
+	writeGauge(w, "pipeline_receipts", "Receipts holding or waiting for a pipeline slot, by priority.",
+		[]string{"priority", "state"}, slots)
+
+	ocr := ocrWorkers.Stats()
+	writeGauge(w, "ocr_workers", "OCR calls running on or waiting for an OCR worker, and the number of workers.",
+		[]string{"state"}, map[string]float64{
+			"running": float64(ocr.Running),
+			"waiting": float64(ocr.Waiting),
+			"workers": float64(ocr.Workers),
+		})
+
+	stats := db.Stats()
+	writeGauge(w, "db_connections", "Database connections by state.", []string{"state"}, map[string]float64{
+		"in_use": float64(stats.InUse),
+		"idle":   float64(stats.Idle),
+	})
+	writeGauge(w, "db_max_open_connections", "Maximum number of open database connections (0 is unlimited).",
+		nil, map[string]float64{"": float64(stats.MaxOpenConnections)})
+	fmt.Fprintf(w, "# HELP %[1]sdb_wait_total Connections waited for.\n# TYPE %[1]sdb_wait_total counter\n%[1]sdb_wait_total %d\n",
+		metricsPrefix, stats.WaitCount)
+	fmt.Fprintf(w, "# HELP %[1]sdb_wait_seconds_total Time spent waiting for a connection.\n# TYPE %[1]sdb_wait_seconds_total counter\n%[1]sdb_wait_seconds_total %s\n",
+		metricsPrefix, formatMetric(stats.WaitDuration.Seconds()))
+}
+
+// registerMetricsRoutes adds the Prometheus scrape endpoint
+func registerMetricsRoutes(app *fiber.App) {
+	app.Get("/metrics", func(c *fiber.Ctx) error {
+		var buf bytes.Buffer
+		writeMetrics(&buf)
+		c.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		return c.Send(buf.Bytes())
+	})
+}
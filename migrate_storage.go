@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runMigrateStorage copies receipt files from one storage backend to another,
+// verifies the copy by checksum and then points the receipt at the new backend.
+//
+// Usage: migrate-storage -from local -to <backend> [-progress file] [-delete-source] [-dry-run]
+//
+// Every receipt is appended to the progress log as it is handled, so an
+// interrupted run can be restarted and picks up where it stopped.
+func runMigrateStorage(args []string) error {
+	fs := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	from := fs.String("from", "local", "source storage backend")
+	to := fs.String("to", "", "destination storage backend")
+	progressPath := fs.String("progress", "", "resumable progress log (default migrate-storage-<from>-<to>.log)")
+	deleteSource := fs.Bool("delete-source", false, "delete files from the source backend after verification")
+	dryRun := fs.Bool("dry-run", false, "list receipts that would be migrated without copying")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return fmt.Errorf("-to is required")
+	}
+	if *from == *to {
+		return fmt.Errorf("source and destination backends are the same")
+	}
+	if *progressPath == "" {
+		*progressPath = fmt.Sprintf("migrate-storage-%s-%s.log", *from, *to)
+	}
+
+	src, err := newStorage(*from)
+	if err != nil {
+		return err
+	}
+	dst, err := newStorage(*to)
+	if err != nil {
+		return err
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	done, err := readMigrationProgress(*progressPath)
+	if err != nil {
+		return err
+	}
+
+	progress, err := os.OpenFile(*progressPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open progress log: %v", err)
+	}
+	defer progress.Close()
+
+	rows, err := db.Query(
+		"SELECT id, file_name, checksum FROM receipts WHERE storage_backend = ? ORDER BY id",
+		src.Name(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query receipts: %v", err)
+	}
+
+	type pending struct {
+		id       int64
+		fileName string
+		checksum sql.NullString
+	}
+	var receipts []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.fileName, &p.checksum); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		if !done[p.id] {
+			receipts = append(receipts, p)
+		}
+	}
+	rows.Close()
+
+	log.Printf("Migrating %d receipt file(s) from %s to %s", len(receipts), src.Name(), dst.Name())
+
+	migrated, failed := 0, 0
+	for _, r := range receipts {
+		if *dryRun {
+			fmt.Printf("%d\t%s\n", r.id, r.fileName)
+			continue
+		}
+
+		checksum, err := migrateReceiptFile(src, dst, r.fileName, r.checksum.String)
+		if err != nil {
+			failed++
+			log.Printf("Receipt %d: %v", r.id, err)
+			fmt.Fprintf(progress, "%d\tfailed\t%s\t%s\n", r.id, time.Now().Format(time.RFC3339), err)
+			continue
+		}
+
+		if _, err := db.Exec(
+			"UPDATE receipts SET storage_backend = ?, checksum = ? WHERE id = ?",
+			dst.Name(), checksum, r.id,
+		); err != nil {
+			failed++
+			log.Printf("Receipt %d: failed to update database: %v", r.id, err)
+			fmt.Fprintf(progress, "%d\tfailed\t%s\tdatabase update: %v\n", r.id, time.Now().Format(time.RFC3339), err)
+			continue
+		}
+
+		if *deleteSource {
+			if err := src.Delete(r.fileName); err != nil {
+				log.Printf("Receipt %d: failed to delete source file: %v", r.id, err)
+			}
+		}
+
+		migrated++
+		fmt.Fprintf(progress, "%d\tdone\t%s\t%s\n", r.id, time.Now().Format(time.RFC3339), checksum)
+	}
+
+	log.Printf("Storage migration finished: %d migrated, %d failed", migrated, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d receipt(s) failed to migrate; re-run to retry", failed)
+	}
+	return nil
+}
+
+// migrateReceiptFile copies one file between backends and verifies the copy.
+// When the receipt already has a recorded checksum the source must match it.
+func migrateReceiptFile(src, dst Storage, key, expectedChecksum string) (string, error) {
+	r, err := src.Open(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if err := dst.Save(key, io.TeeReader(r, h)); err != nil {
+		return "", fmt.Errorf("failed to write destination file: %v", err)
+	}
+	sourceChecksum := hex.EncodeToString(h.Sum(nil))
+
+	if expectedChecksum != "" && expectedChecksum != sourceChecksum {
+		return "", fmt.Errorf("source checksum %s does not match recorded checksum %s", sourceChecksum, expectedChecksum)
+	}
+
+	copiedChecksum, err := storedChecksum(dst, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back destination file: %v", err)
+	}
+	if copiedChecksum != sourceChecksum {
+		return "", fmt.Errorf("checksum mismatch after copy: source %s, destination %s", sourceChecksum, copiedChecksum)
+	}
+
+	return sourceChecksum, nil
+}
+
+// readMigrationProgress returns the receipt IDs already marked done in a
+// progress log. A missing log means nothing has been migrated yet.
+func readMigrationProgress(path string) (map[int64]bool, error) {
+	done := make(map[int64]bool)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open progress log: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		done[id] = fields[1] == "done"
+	}
+	return done, scanner.Err()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// OCROptions tune Tesseract for a request
+type OCROptions struct {
+	// Lang names the trained data to use, several joined with +, e.g.
+	// ind+eng; empty uses eng
+	Lang string `json:"lang,omitempty"`
+	// PSM is the page segmentation mode; 4 (single column of text of
+	// variable sizes) suits narrow receipts better than the default 3
+	PSM int `json:"psm"`
+	// OEM is the OCR engine mode: 0 legacy, 1 LSTM, 2 both, 3 default
+	OEM int `json:"oem"`
+	// Whitelist restricts recognised characters when not empty
+	Whitelist string `json:"whitelist,omitempty"`
+	// DPI is passed to Tesseract for images without resolution metadata and
+	// used to render scanned PDF pages
+	DPI int `json:"dpi"`
+	// Preprocess selects the image preprocessing steps for this request
+	// as a comma-separated list, or "none"; empty uses the pipeline
+	// configuration
+	Preprocess string `json:"preprocess,omitempty"`
+}
+
+// ocrLangPattern matches Tesseract language codes joined with +
+var ocrLangPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*(\+[A-Za-z][A-Za-z0-9_]*)*$`)
+
+// defaultOCROptions returns the receipt defaults, overridden by OCR_LANG,
+// OCR_PSM, OCR_OEM, OCR_WHITELIST and OCR_DPI
+func defaultOCROptions() OCROptions {
+	opts := OCROptions{Lang: "eng", PSM: 4, OEM: 1, DPI: 300}
+	if v := strings.TrimSpace(os.Getenv("OCR_LANG")); v != "" {
+		opts.Lang = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("OCR_PSM")); err == nil {
+		opts.PSM = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("OCR_OEM")); err == nil {
+		opts.OEM = v
+	}
+	if v := os.Getenv("OCR_WHITELIST"); v != "" {
+		opts.Whitelist = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("OCR_DPI")); err == nil {
+		opts.DPI = v
+	}
+	return opts
+}
+
+// ocrOptionsFromForm applies per-request overrides from the lang, psm, oem,
+// whitelist, dpi and preprocess form fields on top of the defaults
+func ocrOptionsFromForm(formValue func(key string, defaultValue ...string) string) (OCROptions, error) {
+	opts := defaultOCROptions()
+	for _, field := range []struct {
+		name string
+		dst  *int
+	}{{"psm", &opts.PSM}, {"oem", &opts.OEM}, {"dpi", &opts.DPI}} {
+		raw := formValue(field.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be a number", field.name)
+		}
+		*field.dst = v
+	}
+	if v := strings.TrimSpace(formValue("lang")); v != "" {
+		opts.Lang = v
+	}
+	if v := formValue("whitelist"); v != "" {
+		opts.Whitelist = v
+	}
+	opts.Preprocess = strings.TrimSpace(formValue("preprocess"))
+	return opts, opts.validate()
+}
+
+// validate checks the options against the ranges Tesseract accepts
+func (o OCROptions) validate() error {
+	if o.Lang != "" && !ocrLangPattern.MatchString(o.Lang) {
+		return fmt.Errorf("lang must be Tesseract language codes joined with +, e.g. ind+eng")
+	}
+	if o.PSM < 0 || o.PSM > 13 {
+		return fmt.Errorf("psm must be between 0 and 13")
+	}
+	if o.OEM < 0 || o.OEM > 3 {
+		return fmt.Errorf("oem must be between 0 and 3")
+	}
+	if o.DPI < 70 || o.DPI > 1200 {
+		return fmt.Errorf("dpi must be between 70 and 1200")
+	}
+	if strings.ContainsAny(o.Whitelist, "\n\r") {
+		return fmt.Errorf("whitelist must not contain line breaks")
+	}
+	if _, err := parsePreprocessSteps(o.Preprocess); err != nil {
+		return err
+	}
+	return nil
+}
+
+// args returns the tesseract command-line options
+func (o OCROptions) args() []string {
+	args := []string{
+		"-l", o.language(),
+		"--psm", strconv.Itoa(o.PSM),
+		"--oem", strconv.Itoa(o.OEM),
+		"--dpi", strconv.Itoa(o.DPI),
+	}
+	if o.Whitelist != "" {
+		args = append(args, "-c", "tessedit_char_whitelist="+o.Whitelist)
+	}
+	return args
+}
+
+// language returns the languages to run Tesseract with
+func (o OCROptions) language() string {
+	if o.Lang == "" {
+		// Jobs queued before languages were configurable
+		return "eng"
+	}
+	return o.Lang
+}
+
+// runTesseract performs OCR on a single image using command-line tesseract,
+// or the OCR service when OCR_ENDPOINT is set
+func runTesseract(imagePath string, opts OCROptions) (string, error) {
+	if err := faults.ocr(); err != nil {
+		return "", err
+	}
+	if endpoint := remoteOCREndpoint(); endpoint != "" {
+		return runRemoteTesseract(endpoint, imagePath, opts)
+	}
+	return runLocalTesseract(imagePath, opts.args()...)
+}
+
+// OCRConfidence is Tesseract's mean confidence (0-100) over the words it
+// recognised in an image
+type OCRConfidence struct {
+	Mean  float64 `json:"mean"`
+	Words int     `json:"words"`
+}
+
+// ocrImage performs OCR on a single image like runTesseract. With local
+// tesseract it also returns the word confidences and the hOCR layout, using
+// dir for the output files; the OCR service only returns text, so
+// confidence is nil and the hOCR empty then.
+func ocrImage(imagePath, dir string, opts OCROptions) (string, *OCRConfidence, string, error) {
+	if err := faults.ocr(); err != nil {
+		return "", nil, "", err
+	}
+	if endpoint := remoteOCREndpoint(); endpoint != "" {
+		text, err := runRemoteTesseract(endpoint, imagePath, opts)
+		return text, nil, "", err
+	}
+	return runLocalTesseractWithConfidence(imagePath, dir, opts.args()...)
+}
+
+// parseTesseractTSV averages the confidence of the word rows (level 5) of
+// Tesseract's TSV output, or returns nil when no word was recognised
+func parseTesseractTSV(tsv string) *OCRConfidence {
+	var sum float64
+	words := 0
+	for i, line := range strings.Split(tsv, "\n") {
+		cols := strings.Split(line, "\t")
+		if i == 0 || len(cols) < 12 || cols[0] != "5" || strings.TrimSpace(cols[11]) == "" {
+			continue
+		}
+		conf, err := strconv.ParseFloat(cols[10], 64)
+		if err != nil || conf < 0 {
+			continue
+		}
+		sum += conf
+		words++
+	}
+	if words == 0 {
+		return nil
+	}
+	return &OCRConfidence{Mean: sum / float64(words), Words: words}
+}
+
+// extractReceiptText extracts text from a stored receipt file, picking
+// pdftotext, pdftoppm + OCR or plain OCR depending on the file type.
+// It returns the extracted text and the processing method used.
+// onPage, if not nil, is called as each page of a scanned PDF is OCR'd.
+func extractReceiptText(path string, isPDF bool, opts OCROptions, onPage func(page, total int)) (string, string, error) {
+	if !isPDF {
+		// Regular image: use OCR directly
+		text, err := runTesseract(path, opts)
+		return text, "OCR", err
+	}
+
+	// Detect PDF type
+	isTextPDF, err := isPDFTextBased(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to detect PDF type: %v", err)
+	}
+
+	if isTextPDF {
+		// Text-based PDF: use pdftotext (Poppler)
+		text, err := extractTextFromPDF(path)
+		return text, "pdftotext", err
+	}
+
+	// Image-based PDF: convert to images and use OCR
+	text, err := convertPDFToImagesAndOCR(path, opts, onPage)
+	return text, "pdftoppm + OCR", err
+}
@@ -0,0 +1,64 @@
+//go:build !remoteocr
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// localOCRAvailable reports whether this build can run tesseract locally;
+// builds with the remoteocr tag require OCR_ENDPOINT instead
+const localOCRAvailable = true
+
+// tesseractCommand prepares a tesseract run. Parallel runs are bounded by
+// the OCR worker pool, so each is kept to one OpenMP thread unless
+// OMP_THREAD_LIMIT says otherwise; otherwise every run would start a
+// thread per CPU.
+func tesseractCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("tesseract", args...)
+	if os.Getenv("OMP_THREAD_LIMIT") == "" {
+		cmd.Env = append(os.Environ(), "OMP_THREAD_LIMIT=1")
+	}
+	return cmd
+}
+
+// runLocalTesseract runs the tesseract binary on an image with extra
+// command-line arguments on an OCR worker and returns its standard output
+func runLocalTesseract(imagePath string, args ...string) (string, error) {
+	var output []byte
+	var err error
+	ocrWorkers.Do(func() {
+		output, err = tesseractCommand(append([]string{imagePath, "stdout"}, args...)...).Output()
+	})
+	if err != nil {
+		return "", fmt.Errorf("tesseract failed: %v", err)
+	}
+	return string(output), nil
+}
+
+// runLocalTesseractWithConfidence runs tesseract once on an OCR worker with
+// text, TSV and hOCR output written to dir and returns the text, the word confidences
+// and the hOCR document
+func runLocalTesseractWithConfidence(imagePath, dir string, args ...string) (string, *OCRConfidence, string, error) {
+	base := filepath.Join(dir, "ocr-confidence")
+	cmdArgs := append(append([]string{imagePath, base}, args...), "txt", "tsv", "hocr")
+	var err error
+	ocrWorkers.Do(func() { err = tesseractCommand(cmdArgs...).Run() })
+	if err != nil {
+		return "", nil, "", fmt.Errorf("tesseract failed: %v", err)
+	}
+	text, err := os.ReadFile(base + ".txt")
+	if err != nil {
+		return "", nil, "", fmt.Errorf("failed to read tesseract output: %v", err)
+	}
+	// TSV and hOCR are extras; the text is usable without them
+	hocr, _ := os.ReadFile(base + ".hocr")
+	tsv, err := os.ReadFile(base + ".tsv")
+	if err != nil {
+		return string(text), nil, string(hocr), nil
+	}
+	return string(text), parseTesseractTSV(string(tsv)), string(hocr), nil
+}
@@ -0,0 +1,20 @@
+//go:build remoteocr
+
+package main
+
+import "fmt"
+
+// localOCRAvailable is false in remoteocr builds, which leave out the local
+// tesseract path so the binary can be built fully static (CGO_ENABLED=0)
+// and deployed without Tesseract installed
+const localOCRAvailable = false
+
+// runLocalTesseract always fails in remoteocr builds
+func runLocalTesseract(imagePath string, args ...string) (string, error) {
+	return "", fmt.Errorf("built with remoteocr: set OCR_ENDPOINT to an OCR service")
+}
+
+// runLocalTesseractWithConfidence always fails in remoteocr builds
+func runLocalTesseractWithConfidence(imagePath, dir string, args ...string) (string, *OCRConfidence, string, error) {
+	return "", nil, "", fmt.Errorf("built with remoteocr: set OCR_ENDPOINT to an OCR service")
+}
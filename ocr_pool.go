@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// OCRPool runs Tesseract calls on a fixed set of long-lived workers, so
+// OCR from the pipeline, POST /ocr, orientation detection and scanned PDF
+// pages together never starts more Tesseract processes (or OCR service
+// requests) than there are workers. Callers beyond that wait their turn.
+// Workers hold no Tesseract state: local OCR runs the tesseract command once
+// per call (see runLocalTesseract), so the pool bounds concurrency rather
+// than reusing clients.
+type OCRPool struct {
+	workers int
+	tasks   chan *ocrTask
+	running atomic.Int64
+	waiting atomic.Int64
+}
+
+// ocrTask is one call queued on the pool; done is closed once it ran, with
+// panicked holding a panic to re-raise on the caller's goroutine
+type ocrTask struct {
+	run      func()
+	done     chan struct{}
+	panicked any
+}
+
+// OCRPoolStats is a snapshot of the pool
+type OCRPoolStats struct {
+	Workers int   `json:"workers"`
+	Running int64 `json:"running"`
+	Waiting int64 `json:"waiting"`
+}
+
+var ocrWorkers = newOCRPool(ocrWorkerCount())
+
+// ocrWorkerCount reads OCR_WORKERS (default: the number of CPUs)
+func ocrWorkerCount() int {
+	n := runtime.NumCPU()
+	if v := os.Getenv("OCR_WORKERS"); v != "" {
+		if w, err := strconv.Atoi(v); err == nil && w > 0 {
+			n = w
+		} else {
+			log.Printf("Invalid OCR_WORKERS %q, using %d", v, n)
+		}
+	}
+	return n
+}
+
+// newOCRPool starts the workers of a pool
+func newOCRPool(workers int) *OCRPool {
+	p := &OCRPool{workers: workers, tasks: make(chan *ocrTask)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work runs queued calls until the process exits. A panicking call does
+// not take its worker down.
+func (p *OCRPool) work() {
+	for t := range p.tasks {
+		p.waiting.Add(-1)
+		p.running.Add(1)
+		func() {
+			defer func() { t.panicked = recover() }()
+			t.run()
+		}()
+		p.running.Add(-1)
+		close(t.done)
+	}
+}
+
+// Do runs fn on a worker and waits for it to finish
+func (p *OCRPool) Do(fn func()) {
+	t := &ocrTask{run: fn, done: make(chan struct{})}
+	p.waiting.Add(1)
+	p.tasks <- t
+	<-t.done
+	if t.panicked != nil {
+		panic(t.panicked)
+	}
+}
+
+// Stats returns how many calls are running and waiting
+func (p *OCRPool) Stats() OCRPoolStats {
+	return OCRPoolStats{Workers: p.workers, Running: p.running.Load(), Waiting: p.waiting.Load()}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteOCRClient talks to the OCR service configured with OCR_ENDPOINT
+var remoteOCRClient = &http.Client{Timeout: remoteOCRTimeout()}
+
+// remoteOCREndpoint returns the URL of a tesseract-server compatible OCR
+// service (OCR_ENDPOINT, e.g. http://tesseract:8884/tesseract). When set,
+// OCR requests are sent there instead of running the local tesseract binary.
+func remoteOCREndpoint() string {
+	return os.Getenv("OCR_ENDPOINT")
+}
+
+// remoteOCRTimeout is the per-request timeout for the OCR service
+// (OCR_ENDPOINT_TIMEOUT, default 60s)
+func remoteOCRTimeout() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("OCR_ENDPOINT_TIMEOUT")); err == nil && v > 0 {
+		return v
+	}
+	return 60 * time.Second
+}
+
+// remoteOCROptions is the "options" form field of a tesseract-server request
+type remoteOCROptions struct {
+	Languages    []string          `json:"languages"`
+	DPI          int               `json:"dpi,omitempty"`
+	PSM          int               `json:"pageSegmentationMethod"`
+	OEM          int               `json:"ocrEngineMode"`
+	ConfigParams map[string]string `json:"configParams,omitempty"`
+}
+
+// runRemoteTesseract uploads an image to the OCR service on an OCR worker
+// and returns Tesseract's output
+func runRemoteTesseract(endpoint, imagePath string, opts OCROptions) (string, error) {
+	var text string
+	var err error
+	ocrWorkers.Do(func() { text, err = postRemoteOCR(endpoint, imagePath, opts) })
+	return text, err
+}
+
+// postRemoteOCR sends one OCR request to the OCR service
+func postRemoteOCR(endpoint, imagePath string, opts OCROptions) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	options := remoteOCROptions{
+		Languages: strings.Split(opts.language(), "+"),
+		DPI:       opts.DPI,
+		PSM:       opts.PSM,
+		OEM:       opts.OEM,
+	}
+	if opts.Whitelist != "" {
+		options.ConfigParams = map[string]string{"tessedit_char_whitelist": opts.Whitelist}
+	}
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("options", string(optionsJSON)); err != nil {
+		return "", err
+	}
+	part, err := w.CreateFormFile("file", filepath.Base(imagePath))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := remoteOCRClient.Post(endpoint, w.FormDataContentType(), &body)
+	if err != nil {
+		return "", fmt.Errorf("remote OCR request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data struct {
+			Stdout string `json:"stdout"`
+			Stderr string `json:"stderr"`
+		} `json:"data"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode remote OCR response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode >= 300 {
+		msg := result.Error
+		if msg == "" {
+			msg = result.Data.Stderr
+		}
+		return "", fmt.Errorf("remote OCR failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return result.Data.Stdout, nil
+}
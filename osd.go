@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// detectRotation runs Tesseract orientation and script detection (--psm 0)
+// and returns the clockwise rotation in degrees (0, 90, 180 or 270) needed
+// to make the text upright
+func detectRotation(imagePath string) (int, error) {
+	var output string
+	var err error
+	if endpoint := remoteOCREndpoint(); endpoint != "" {
+		output, err = runRemoteTesseract(endpoint, imagePath, OCROptions{PSM: 0, OEM: 3})
+	} else {
+		output, err = runLocalTesseract(imagePath, "--psm", "0")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("orientation detection failed: %v", err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Rotate:") {
+			continue
+		}
+		degrees, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Rotate:")))
+		if err != nil {
+			return 0, fmt.Errorf("unexpected OSD output %q", line)
+		}
+		return degrees % 360, nil
+	}
+	return 0, fmt.Errorf("no rotation found in OSD output")
+}
+
+// rotateImageFile writes a copy of an image rotated clockwise by degrees to
+// a temporary PNG in dir (the system temp directory when empty)
+func rotateImageFile(path string, degrees int, dir string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	rotated := rotateImage(src, degrees)
+
+	out, err := os.CreateTemp(dir, "receipt-rotated-*.png")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer out.Close()
+	if err := png.Encode(out, rotated); err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("failed to encode image: %v", err)
+	}
+	return out.Name(), nil
+}
+
+// rotateImage rotates an image clockwise by 90, 180 or 270 degrees
+func rotateImage(src image.Image, degrees int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	var dst *image.RGBA
+	switch degrees {
+	case 90, 270:
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	case 180:
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	default:
+		return src
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := src.At(b.Min.X+x, b.Min.Y+y)
+			switch degrees {
+			case 90:
+				dst.Set(h-1-y, x, c)
+			case 180:
+				dst.Set(w-1-x, h-1-y, c)
+			case 270:
+				dst.Set(y, w-1-x, c)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Custom fields written back to Paperless-ngx documents, with their
+// Paperless data types
+var paperlessCustomFields = []struct {
+	Name     string
+	DataType string
+}{
+	{"Receipt Merchant", "string"},
+	{"Receipt Date", "date"},
+	{"Receipt Amount", "float"},
+	{"Receipt Currency", "string"},
+	{"Receipt Category", "string"},
+}
+
+// PaperlessClient talks to the Paperless-ngx REST API
+type PaperlessClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	// fieldIDs caches custom field IDs by name
+	fieldIDs map[string]int
+}
+
+// newPaperlessClient returns a client for PAPERLESS_URL authenticated with
+// PAPERLESS_TOKEN, or nil when the integration is not configured
+func newPaperlessClient() *PaperlessClient {
+	baseURL := strings.TrimRight(os.Getenv("PAPERLESS_URL"), "/")
+	if baseURL == "" || os.Getenv("PAPERLESS_TOKEN") == "" {
+		return nil
+	}
+	return &PaperlessClient{
+		baseURL:  baseURL,
+		token:    os.Getenv("PAPERLESS_TOKEN"),
+		http:     &http.Client{Timeout: 60 * time.Second},
+		fieldIDs: make(map[string]int),
+	}
+}
+
+// defaultPaperlessMaxAttempts is how often a document that fails to import
+// is tried unless PAPERLESS_MAX_ATTEMPTS says otherwise
+const defaultPaperlessMaxAttempts = 3
+
+// paperlessMaxAttempts reads PAPERLESS_MAX_ATTEMPTS
+func paperlessMaxAttempts() int {
+	if v, err := strconv.Atoi(os.Getenv("PAPERLESS_MAX_ATTEMPTS")); err == nil && v > 0 {
+		return v
+	}
+	return defaultPaperlessMaxAttempts
+}
+
+// paperlessTag is the tag marking documents to import (PAPERLESS_TAG,
+// default "receipt")
+func paperlessTag() string {
+	if tag := os.Getenv("PAPERLESS_TAG"); tag != "" {
+		return tag
+	}
+	return "receipt"
+}
+
+// do sends an API request and decodes the JSON response into out (if not nil)
+func (p *PaperlessClient) do(method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+p.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("paperless request %s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("paperless %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// paperlessList is a page of a Paperless list endpoint
+type paperlessList[T any] struct {
+	Next    *string `json:"next"`
+	Results []T     `json:"results"`
+}
+
+// PaperlessDocument is the part of a Paperless document the import uses
+type PaperlessDocument struct {
+	ID               int    `json:"id"`
+	Title            string `json:"title"`
+	OriginalFileName string `json:"original_file_name"`
+	CustomFields     []struct {
+		Field int `json:"field"`
+		Value any `json:"value"`
+	} `json:"custom_fields"`
+}
+
+// tagID looks up a tag by name
+func (p *PaperlessClient) tagID(name string) (int, error) {
+	var list paperlessList[struct {
+		ID int `json:"id"`
+	}]
+	if err := p.do("GET", "/api/tags/?name__iexact="+url.QueryEscape(name), nil, &list); err != nil {
+		return 0, err
+	}
+	if len(list.Results) == 0 {
+		return 0, fmt.Errorf("paperless tag %q not found", name)
+	}
+	return list.Results[0].ID, nil
+}
+
+// taggedDocuments returns all documents with the tag
+func (p *PaperlessClient) taggedDocuments(tagID int) ([]PaperlessDocument, error) {
+	var docs []PaperlessDocument
+	for page := 1; ; page++ {
+		var list paperlessList[PaperlessDocument]
+		path := fmt.Sprintf("/api/documents/?tags__id__all=%d&ordering=added&page_size=100&page=%d", tagID, page)
+		if err := p.do("GET", path, nil, &list); err != nil {
+			return nil, err
+		}
+		docs = append(docs, list.Results...)
+		if list.Next == nil {
+			return docs, nil
+		}
+	}
+}
+
+// download saves a document's original file to dest
+func (p *PaperlessClient) download(docID int, dest string) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/documents/%d/download/?original=true", p.baseURL, docID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+p.token)
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download paperless document %d: %v", docID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download paperless document %d: status %d", docID, resp.StatusCode)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+// customFieldID returns the ID of a custom field, creating it if needed
+func (p *PaperlessClient) customFieldID(name, dataType string) (int, error) {
+	if id, ok := p.fieldIDs[name]; ok {
+		return id, nil
+	}
+
+	var list paperlessList[struct {
+		ID int `json:"id"`
+	}]
+	if err := p.do("GET", "/api/custom_fields/?name__iexact="+url.QueryEscape(name), nil, &list); err != nil {
+		return 0, err
+	}
+	if len(list.Results) > 0 {
+		p.fieldIDs[name] = list.Results[0].ID
+		return list.Results[0].ID, nil
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	if err := p.do("POST", "/api/custom_fields/", map[string]string{"name": name, "data_type": dataType}, &created); err != nil {
+		return 0, err
+	}
+	p.fieldIDs[name] = created.ID
+	return created.ID, nil
+}
+
+// writeBack stores the parsed receipt fields as custom fields on the
+// document, keeping its other custom fields
+func (p *PaperlessClient) writeBack(doc PaperlessDocument, data *GeminiParsedData) error {
+	merchant := data.MerchantClean
+	if merchant == "" {
+		merchant = data.MerchantRaw
+	}
+	values := map[string]any{
+		"Receipt Merchant": merchant,
+		"Receipt Date":     data.Date,
+		"Receipt Amount":   data.Amount,
+		"Receipt Currency": data.Currency,
+		"Receipt Category": data.Category,
+	}
+
+	fields := make(map[int]any)
+	for _, f := range doc.CustomFields {
+		fields[f.Field] = f.Value
+	}
+	for _, f := range paperlessCustomFields {
+		v := values[f.Name]
+		if v == "" || v == 0.0 {
+			continue
+		}
+		id, err := p.customFieldID(f.Name, f.DataType)
+		if err != nil {
+			return err
+		}
+		fields[id] = v
+	}
+
+	payload := []map[string]any{}
+	for id, v := range fields {
+		payload = append(payload, map[string]any{"field": id, "value": v})
+	}
+	return p.do("PATCH", fmt.Sprintf("/api/documents/%d/", doc.ID), map[string]any{"custom_fields": payload}, nil)
+}
+
+// PaperlessSyncResult summarizes a Paperless import run
+type PaperlessSyncResult struct {
+	Imported    []int64 `json:"imported_receipt_ids"`
+	Skipped     int     `json:"skipped"`
+	Quarantined int     `json:"quarantined"`
+	Failed      int     `json:"failed"`
+}
+
+// paperlessSyncMu keeps scheduled and manual syncs from importing the same
+// document twice
+var paperlessSyncMu sync.Mutex
+
+// syncPaperless imports tagged documents that have not been imported yet,
+// runs them through the pipeline and writes the parsed fields back.
+// Documents are recorded in paperless_documents so they are only imported
+// once. Quarantined documents are not tried again; documents that failed to
+// import are retried by later syncs until PAPERLESS_MAX_ATTEMPTS is reached.
+func syncPaperless(ctx context.Context, p *PaperlessClient) (*PaperlessSyncResult, error) {
+	paperlessSyncMu.Lock()
+	defer paperlessSyncMu.Unlock()
+
+	tagID, err := p.tagID(paperlessTag())
+	if err != nil {
+		return nil, err
+	}
+	docs, err := p.taggedDocuments(tagID)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts := paperlessMaxAttempts()
+	res := &PaperlessSyncResult{Imported: []int64{}}
+	for _, doc := range docs {
+		var status string
+		var attempts int
+		err := db.QueryRow(
+			"SELECT status, attempts FROM paperless_documents WHERE document_id = ?", doc.ID,
+		).Scan(&status, &attempts)
+		if err != nil && err != sql.ErrNoRows {
+			return res, fmt.Errorf("failed to check paperless document %d: %v", doc.ID, err)
+		}
+		if err == nil && (status != "failed" || attempts >= maxAttempts) {
+			res.Skipped++
+			continue
+		}
+		// Stop before downloading; the remaining documents are picked up by
+		// the next sync
+		if err := diskSpace.Guard(); err != nil {
+			return res, err
+		}
+
+		receiptID, err := importPaperlessDocument(ctx, p, doc)
+		status, errMsg := "imported", ""
+		if errors.Is(err, errQuarantined) {
+			log.Printf("Paperless: document %d: %v", doc.ID, err)
+			status, errMsg = "quarantined", err.Error()
+			res.Quarantined++
+		} else if err != nil {
+			log.Printf("Paperless: document %d: %v", doc.ID, err)
+			status, errMsg = "failed", err.Error()
+			res.Failed++
+		} else {
+			res.Imported = append(res.Imported, receiptID)
+		}
+		if _, err := db.Exec(
+			`INSERT INTO paperless_documents (document_id, receipt_id, status, error) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE receipt_id = VALUES(receipt_id), status = VALUES(status), error = VALUES(error),
+				attempts = attempts + 1, imported_at = CURRENT_TIMESTAMP`,
+			doc.ID, sql.NullInt64{Int64: receiptID, Valid: receiptID != 0}, status, sql.NullString{String: errMsg, Valid: errMsg != ""},
+		); err != nil {
+			return res, fmt.Errorf("failed to record paperless document %d: %v", doc.ID, err)
+		}
+	}
+	return res, nil
+}
+
+// importPaperlessDocument downloads one document and processes it as a
+// receipt
+func importPaperlessDocument(ctx context.Context, p *PaperlessClient, doc PaperlessDocument) (int64, error) {
+	ext := strings.ToLower(filepath.Ext(doc.OriginalFileName))
+	if ext == "" {
+		ext = ".pdf"
+	}
+	storedName := fmt.Sprintf("%s_%s%s", uuid.New().String(), time.Now().Format("20060102_150405"), ext)
+	savePath := filepath.Join(uploadsDir, storedName)
+	// Failed imports are retried, so their files are not left behind
+	if err := p.download(doc.ID, savePath); err != nil {
+		os.Remove(savePath)
+		return 0, err
+	}
+
+	quarantineID, reason, err := quarantineUpload(storedName, doc.OriginalFileName, channelPaperless, PipelineInput{
+		Priority: priorityLow,
+		Tenant:   defaultTenant,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if reason != "" {
+		return 0, fmt.Errorf("%w as %s (%s)", errQuarantined, formatQuarantineID(quarantineID), reason)
+	}
+
+	checksum, err := fileChecksum(savePath)
+	if err != nil {
+		log.Printf("Failed to checksum %s: %v", savePath, err)
+	}
+
+	title := doc.Title
+	if len(title) > 512 {
+		title = title[:512]
+	}
+	result, err := db.Exec(
+		`INSERT INTO receipts (file_name, status, storage_backend, checksum, source_url, source_title, priority, channel, uploaded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		storedName,
+		"needs_review",
+		"local",
+		sql.NullString{String: checksum, Valid: checksum != ""},
+		fmt.Sprintf("%s/documents/%d/details", p.baseURL, doc.ID),
+		sql.NullString{String: title, Valid: title != ""},
+		priorityLow,
+		channelPaperless,
+		time.Now(),
+	)
+	if err != nil {
+		os.Remove(savePath)
+		return 0, fmt.Errorf("failed to save receipt to database: %v", err)
+	}
+	receiptID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get receipt ID: %v", err)
+	}
+
+	res := processReceipt(ctx, PipelineInput{
+		ReceiptID: receiptID,
+		Path:      savePath,
+		IsPDF:     ext == ".pdf",
+		Config:    loadPipelineConfig(defaultTenant),
+		Priority:  priorityLow,
+		Tenant:    defaultTenant,
+		Settings:  loadUserSettings(defaultTenant),
+	})
+	offloadReceiptFile(receiptID, storedName)
+	if res.Parsed == nil {
+		return receiptID, nil
+	}
+	if err := p.writeBack(doc, res.Parsed); err != nil {
+		log.Printf("Paperless: failed to write fields back to document %d: %v", doc.ID, err)
+	}
+	return receiptID, nil
+}
+
+// startPaperlessScheduler imports new tagged documents every
+// PAPERLESS_SYNC_INTERVAL (default 15m, "off" disables it)
+func startPaperlessScheduler() {
+	client := newPaperlessClient()
+	if client == nil {
+		return
+	}
+	intervalStr := os.Getenv("PAPERLESS_SYNC_INTERVAL")
+	if intervalStr == "off" {
+		return
+	}
+	interval := 15 * time.Minute
+	if intervalStr != "" {
+		v, err := time.ParseDuration(intervalStr)
+		if err != nil || v <= 0 {
+			log.Printf("Paperless: invalid PAPERLESS_SYNC_INTERVAL %q, scheduled sync disabled", intervalStr)
+			return
+		}
+		interval = v
+	}
+
+	log.Printf("Paperless: importing documents tagged %q every %v", paperlessTag(), interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			res, err := syncPaperless(context.Background(), client)
+			if err != nil {
+				log.Printf("Paperless: sync failed: %v", err)
+				continue
+			}
+			if len(res.Imported) > 0 || res.Failed > 0 {
+				log.Printf("Paperless: imported %d document(s), %d failed", len(res.Imported), res.Failed)
+			}
+		}
+	}()
+}
+
+// registerPaperlessRoutes adds the manual Paperless sync endpoint
+func registerPaperlessRoutes(app *fiber.App) {
+	app.Post("/integrations/paperless/sync", func(c *fiber.Ctx) error {
+		client := newPaperlessClient()
+		if client == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Paperless integration is not configured (PAPERLESS_URL, PAPERLESS_TOKEN)",
+			})
+		}
+
+		res, err := syncPaperless(c.Context(), client)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"result":  res,
+		})
+	})
+}
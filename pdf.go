@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isPDFTextBased checks if a PDF contains extractable text using pdftotext
+func isPDFTextBased(pdfPath string) (bool, error) {
+	// Try to extract text using pdftotext
+	cmd := exec.Command("pdftotext", "-l", "1", pdfPath, "-")
+	output, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to run pdftotext: %v", err)
+	}
+
+	// Check if extracted text has meaningful content (more than whitespace)
+	text := strings.TrimSpace(string(output))
+	return len(text) > 10, nil // If more than 10 characters, consider it text-based
+}
+
+// extractTextFromPDF extracts text from a text-based PDF using pdftotext
+func extractTextFromPDF(pdfPath string) (string, error) {
+	cmd := exec.Command("pdftotext", "-layout", pdfPath, "-")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract text from PDF: %v", err)
+	}
+	return string(output), nil
+}
+
+// convertPDFToImagesAndOCR converts PDF to images using pdftoppm and performs OCR.
+// onPage, if not nil, is called after each page with the page number and page count.
+func convertPDFToImagesAndOCR(pdfPath string, opts OCROptions, onPage func(page, total int)) (string, error) {
+	// Create temp directory for images
+	tempDir, err := os.MkdirTemp("", "pdf-ocr-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Convert PDF to PNG images using pdftoppm
+	outputPrefix := filepath.Join(tempDir, "page")
+	cmd := exec.Command("pdftoppm", "-png", "-r", strconv.Itoa(opts.DPI), pdfPath, outputPrefix)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to convert PDF to images: %v", err)
+	}
+
+	// Find all generated images
+	images, err := filepath.Glob(filepath.Join(tempDir, "*.png"))
+	if err != nil || len(images) == 0 {
+		return "", fmt.Errorf("no images generated from PDF")
+	}
+
+	// Perform OCR on each image
+	var allText bytes.Buffer
+
+	for i, imagePath := range images {
+		output, err := runTesseract(imagePath, opts)
+		if err != nil {
+			log.Printf("Warning: OCR failed for %s: %v", imagePath, err)
+			continue
+		}
+
+		allText.WriteString(output)
+		allText.WriteString("\n\n---PAGE BREAK---\n\n")
+		if onPage != nil {
+			onPage(i+1, len(images))
+		}
+	}
+
+	return allText.String(), nil
+}
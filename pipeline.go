@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/generative-ai-go/genai"
+)
+
+// minUsableOCRText is the amount of text below which OCR output is treated
+// as unusable and the vision fallback (when enabled) takes over
+const minUsableOCRText = 20
+
+// PipelineInput is a stored receipt file to run through the processing pipeline
+type PipelineInput struct {
+	ReceiptID int64
+	Path      string
+	IsPDF     bool
+	Config    PipelineConfig
+	// Prompt replaces the configured extraction prompt when set
+	Prompt string
+	// Profile names the extraction profile to use; empty detects one from
+	// the OCR text and "generic" disables profiles
+	Profile string
+	// OCR tunes Tesseract; nil uses the configured defaults
+	OCR *OCROptions
+	// Priority decides the order in which waiting receipts get a
+	// processing slot; empty means normal
+	Priority string
+	// Tenant is the uploading user; Settings are their defaults
+	Tenant   string
+	Settings UserSettings
+	// TransactionID is the existing transaction of a receipt being
+	// analyzed again; it is updated instead of a new one being stored
+	TransactionID int64
+}
+
+// PipelineResult collects the outcome of each pipeline stage
+type PipelineResult struct {
+	OCRStatus        string
+	OCRText          string
+	OCRError         string
+	ProcessingMethod string
+	// Rotation is the clockwise rotation applied after orientation detection
+	Rotation int
+
+	GeminiStatus   string
+	GeminiAnalysis string
+	GeminiError    string
+	Parsed         *GeminiParsedData
+	DuplicateOf    *int64
+	// DuplicateReason says how the duplicate was recognised
+	DuplicateReason string
+	Tip             *TipAnalysis
+	Insight         *SpendingInsight
+	PriceCheck      *PriceCheckResult
+	TransactionID   int64
+	// MerchantHint names the merchant whose prompt hints were applied
+	MerchantHint string
+	// Profile is the extraction profile applied, if any
+	Profile string
+	// RepairAttempts counts follow-up prompts sent to fix invalid output;
+	// ValidationErrors lists what was still invalid afterwards
+	RepairAttempts   int
+	ValidationErrors []FieldError
+	// DateResolution explains how a day/month-ambiguous date was read
+	DateResolution *DateResolution
+	// PolicyViolations lists the expense policy rules the transaction breaks
+	PolicyViolations []PolicyViolation
+	// LayoutCheck compares the amounts with the receipt's price column
+	LayoutCheck *LayoutCheck
+
+	// Stages lists the optional stages that were applied
+	Stages []string
+}
+
+// Pipeline holds the resources used while processing one receipt. Close
+// releases all of them, whichever stage processing stopped at.
+type Pipeline struct {
+	ctx    context.Context
+	in     PipelineInput
+	res    *PipelineResult
+	tmp    *TempDir
+	gemini *GeminiClient
+	// failure is set when processing aborted with an internal error
+	failure string
+}
+
+// newPipeline prepares a pipeline run for a stored receipt file
+func newPipeline(ctx context.Context, in PipelineInput) *Pipeline {
+	return &Pipeline{
+		ctx: ctx,
+		in:  in,
+		res: &PipelineResult{OCRStatus: "success", Stages: []string{}},
+	}
+}
+
+// tempDir returns the run's temp directory, creating it on first use
+func (p *Pipeline) tempDir() (*TempDir, error) {
+	if p.tmp == nil {
+		tmp, err := newTempDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		p.tmp = tmp
+	}
+	return p.tmp, nil
+}
+
+// geminiClient returns the run's Gemini client, creating it on first use
+func (p *Pipeline) geminiClient() (*GeminiClient, error) {
+	if p.gemini == nil {
+		client, err := NewGeminiClient(p.ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.gemini = client
+	}
+	return p.gemini, nil
+}
+
+// recoverPanic turns a panic in any stage into a failed result and marks
+// the receipt as errored instead of crashing the server. It must be
+// deferred directly.
+func (p *Pipeline) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.Printf("Pipeline: panic while processing receipt %d: %v\n%s", p.in.ReceiptID, r, debug.Stack())
+	p.failure = fmt.Sprintf("internal error: %v", r)
+	if p.res.GeminiStatus == "" || p.res.GeminiStatus == "success" {
+		p.res.GeminiStatus = "failed"
+	}
+	p.res.GeminiError = p.failure
+	if _, err := execWithRetry("UPDATE receipts SET status = ? WHERE id = ?", "error", p.in.ReceiptID); err != nil {
+		log.Printf("Failed to mark receipt %d as errored: %v", p.in.ReceiptID, err)
+	}
+}
+
+// Close reports the final progress state, refreshes the dashboard live
+// queries, closes the Gemini client and removes all temporary files of the run
+func (p *Pipeline) Close() {
+	switch {
+	case p.failure != "":
+		progressTracker.Update(p.in.ReceiptID, stageFailed, 1, p.failure)
+	case p.res.OCRStatus == "failed":
+		progressTracker.Update(p.in.ReceiptID, stageFailed, 1, p.res.OCRError)
+	default:
+		progressTracker.Update(p.in.ReceiptID, stageDone, 1, "")
+	}
+	liveQueries.Invalidate()
+
+	if p.gemini != nil {
+		p.gemini.Close()
+		p.gemini = nil
+	}
+	p.tmp.Cleanup()
+}
+
+// processReceipt runs OCR, Gemini parsing and transaction storage for a
+// receipt file, honouring the optional stages enabled in the input config.
+// The receipt is marked processed when a transaction was stored cleanly.
+func processReceipt(ctx context.Context, in PipelineInput) *PipelineResult {
+	if in.Priority == "" {
+		in.Priority = priorityNormal
+	}
+	release, err := pipelineScheduler.Acquire(ctx, in.Priority)
+	if err != nil {
+		// The receipt stays in needs_review and can be reprocessed later
+		log.Printf("Receipt %d was not processed while waiting for a slot: %v", in.ReceiptID, err)
+		return &PipelineResult{
+			OCRStatus:    "failed",
+			OCRError:     fmt.Sprintf("cancelled while queued: %v", err),
+			GeminiStatus: "skipped",
+			Stages:       []string{},
+		}
+	}
+	defer release()
+
+	p := newPipeline(ctx, in)
+	defer p.Close()
+	start := time.Now()
+	defer func() { recordProcessingMetrics(p.res, time.Since(start)) }()
+	defer p.recoverPanic()
+	p.run()
+	return p.res
+}
+
+// run executes the pipeline stages in order
+func (p *Pipeline) run() {
+	in, res := p.in, p.res
+	progressTracker.Update(in.ReceiptID, stageUpload, 1, "file stored")
+	if err := addReceiptTags(in.ReceiptID, in.Settings.DefaultTags); err != nil {
+		log.Printf("%v", err)
+	}
+
+	ocrOptions := defaultOCROptions()
+	if in.OCR != nil {
+		ocrOptions = *in.OCR
+	}
+	var steps []string
+	if !in.IsPDF {
+		steps = preprocessSteps(in.Config, ocrOptions)
+	}
+
+	ocrPath := in.Path
+	if (in.Config.AutoRotate || len(steps) > 0) && !in.IsPDF {
+		progressTracker.Update(in.ReceiptID, stagePreprocessing, 0, "")
+	}
+	if containsString(steps, preprocessEXIF) {
+		// Phone cameras store the sensor image and an orientation tag,
+		// which Tesseract ignores
+		var oriented string
+		var orientation int
+		tmp, err := p.tempDir()
+		if err == nil {
+			oriented, orientation, err = exifOrientImageFile(ocrPath, tmp.Path)
+		}
+		if err != nil {
+			log.Printf("Preprocessing: Failed to apply EXIF orientation: %v", err)
+		} else if orientation > 1 {
+			ocrPath = oriented
+			res.Stages = append(res.Stages, preprocessEXIF)
+		}
+	}
+	if in.Config.AutoRotate && !in.IsPDF {
+		// Sideways or upside-down photos produce garbage OCR
+		degrees, err := detectRotation(ocrPath)
+		if err != nil {
+			log.Printf("OSD: %v", err)
+		} else if degrees != 0 {
+			var rotated string
+			tmp, err := p.tempDir()
+			if err == nil {
+				rotated, err = rotateImageFile(ocrPath, degrees, tmp.Path)
+			}
+			if err != nil {
+				log.Printf("OSD: Failed to rotate image: %v", err)
+			} else {
+				ocrPath = rotated
+				res.Rotation = degrees
+				res.Stages = append(res.Stages, "auto_rotate")
+				if err := saveArtifact(in.ReceiptID, artifactRotation, strconv.Itoa(degrees)); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+		}
+	}
+
+	if len(steps) > 0 {
+		var preprocessed string
+		var applied []string
+		tmp, err := p.tempDir()
+		if err == nil {
+			preprocessed, applied, err = preprocessImage(ocrPath, tmp.Path, steps)
+		}
+		if err != nil {
+			log.Printf("Preprocessing: Failed: %v", err)
+		} else {
+			ocrPath = preprocessed
+			res.Stages = append(res.Stages, applied...)
+		}
+	}
+
+	progressTracker.Update(in.ReceiptID, stageOCR, 0, "")
+	quality := &ReceiptQuality{Rotation: res.Rotation, Preprocessing: append([]string{}, res.Stages...)}
+	var text, method, hocr string
+	var photoHash *uint64
+	var err error
+	var tmp *TempDir
+	if !in.IsPDF {
+		tmp, err = p.tempDir()
+	}
+	ocrStart := time.Now()
+	if tmp != nil && err == nil {
+		// Photos are read with word confidences for the quality report and
+		// the hOCR layout for the layout check
+		text, hocr, err = ocrImageQuality(ocrPath, tmp.Path, ocrOptions, quality)
+		method = "OCR"
+	} else {
+		text, method, err = extractReceiptText(ocrPath, in.IsPDF, ocrOptions, func(page, total int) {
+			progressTracker.Update(in.ReceiptID, stageOCR, float64(page)/float64(total), fmt.Sprintf("page %d/%d", page, total))
+		})
+	}
+	ocrDuration.Observe(time.Since(ocrStart).Seconds(), method)
+	res.OCRText = text
+	res.ProcessingMethod = method
+	quality.ProcessingMethod = method
+	if !in.IsPDF {
+		if qErr := measureImageQuality(in.Path, quality); qErr != nil {
+			log.Printf("Quality: receipt %d: %v", in.ReceiptID, qErr)
+		}
+		// The same photo sent through two channels is recognised by its hash
+		if hash, hErr := imageHash(in.Path); hErr != nil {
+			log.Printf("Image hash of receipt %d: %v", in.ReceiptID, hErr)
+		} else if hErr := saveImageHash(in.ReceiptID, hash); hErr != nil {
+			log.Printf("%v", hErr)
+		} else {
+			photoHash = &hash
+		}
+	}
+	if qErr := saveReceiptQuality(in.ReceiptID, quality); qErr != nil {
+		log.Printf("%v", qErr)
+	}
+	if err != nil {
+		log.Printf("OCR: Failed to extract text: %v", err)
+		res.OCRStatus = "failed"
+		res.OCRError = fmt.Sprintf("Failed to extract text: %v", err)
+	} else {
+		if err := saveArtifact(in.ReceiptID, artifactOCRText, text); err != nil {
+			log.Printf("%v", err)
+		}
+		if hocr != "" {
+			if err := saveArtifact(in.ReceiptID, artifactHOCR, hocr); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+
+	usableText := res.OCRStatus == "success" && len(strings.TrimSpace(text)) >= minUsableOCRText
+	useVision := !usableText && in.Config.VisionFallback && !in.IsPDF && geminiBudget.visionAllowed()
+	if !useVision && (res.OCRStatus != "success" || text == "") {
+		res.GeminiStatus = "skipped"
+		res.GeminiError = "No OCR text available"
+		return
+	}
+
+	geminiClient, err := p.geminiClient()
+	if err != nil {
+		log.Printf("Gemini: Failed to create client: %v", err)
+		res.GeminiStatus = "failed"
+		res.GeminiError = fmt.Sprintf("Failed to create client: %v", err)
+		return
+	}
+
+	prompt := in.Prompt
+	if prompt == "" {
+		prompt = receiptPrompt()
+	}
+
+	// Specialized document types get their own instructions and extra fields
+	var profile *ExtractionProfile
+	switch in.Profile {
+	case "":
+		if !useVision {
+			profile = detectExtractionProfile(text)
+		}
+	case profileGeneric:
+	default:
+		profile = profileByName(in.Profile)
+	}
+	prompt = customFieldsPrompt(prompt)
+	priceClient := newPriceClient()
+	lineItems := in.Config.LineItems || in.Config.Inventory || (in.Config.PriceCheck && priceClient != nil)
+	if lineItems {
+		prompt = lineItemsPrompt(prompt)
+	}
+	if in.Config.Loyalty {
+		prompt = loyaltyPrompt(prompt)
+	}
+	if profile != nil {
+		prompt = profilePrompt(prompt, profile)
+		res.Profile = profile.Name
+		res.Stages = append(res.Stages, "profile:"+profile.Name)
+		if err := addReceiptTags(in.ReceiptID, profile.Tags); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	// The answer must be JSON matching the fields asked for
+	schema := receiptResponseSchema(profile, lineItems, in.Config.Loyalty)
+
+	progressTracker.Update(in.ReceiptID, stageParsing, 0, "")
+	var response *GeminiResponse
+	if useVision {
+		res.Stages = append(res.Stages, "vision_fallback")
+		response, err = analyzeReceiptImageFile(geminiClient, prompt, in.Path, schema)
+	} else {
+		promptText := text
+		if in.Config.Redaction {
+			promptText = redactPII(text)
+			res.Stages = append(res.Stages, "redaction")
+		}
+
+		// Merchants with known awkward layouts get their hints injected
+		hints := ""
+		if hint, hintErr := detectMerchantHint(text); hintErr != nil {
+			log.Printf("%v", hintErr)
+		} else if hint != nil {
+			hints = hint.Hints
+			res.MerchantHint = hint.Name
+		}
+		response, err = geminiClient.AnalyzeTextWithPrompt(prompt, promptText, hints, schema)
+	}
+	if response != nil {
+		addGeminiTokens(in.ReceiptID, response.TokenCount)
+	}
+	if err != nil {
+		log.Printf("Gemini: Failed to analyze: %v", err)
+		res.GeminiStatus = "failed"
+		res.GeminiError = fmt.Sprintf("Failed to analyze: %v", err)
+		return
+	}
+	if !response.Success {
+		log.Printf("Gemini: Analysis unsuccessful: %s", response.Error)
+		res.GeminiStatus = "failed"
+		res.GeminiError = response.Error
+		return
+	}
+
+	res.GeminiAnalysis = response.Text
+	res.GeminiStatus = "success"
+	if err := saveArtifact(in.ReceiptID, artifactGeminiResponse, response.Text); err != nil {
+		log.Printf("%v", err)
+	}
+
+	data, problems := parseAndValidate(response.Text)
+
+	// Ask Gemini to repair output that does not match the schema before
+	// falling back to manual review
+	previous := response.Text
+	for attempt := 1; problems != "" && attempt <= maxRepairAttempts(); attempt++ {
+		res.RepairAttempts = attempt
+		repaired, err := geminiClient.RepairReceiptJSON(prompt, text, previous, problems, schema)
+		if repaired != nil {
+			addGeminiTokens(in.ReceiptID, repaired.TokenCount)
+		}
+		if err != nil || !repaired.Success {
+			log.Printf("Gemini: Repair attempt %d failed: %v", attempt, err)
+			recordRepairAttempt(in.ReceiptID, attempt, problems, "", false)
+			break
+		}
+
+		repairedData, repairedProblems := parseAndValidate(repaired.Text)
+		if err := recordRepairAttempt(in.ReceiptID, attempt, problems, repaired.Text, repairedProblems == ""); err != nil {
+			log.Printf("%v", err)
+		}
+		if repairedData != nil {
+			data = repairedData
+			res.GeminiAnalysis = repaired.Text
+		}
+		previous, problems = repaired.Text, repairedProblems
+	}
+
+	if data == nil {
+		log.Printf("Gemini: Failed to parse JSON: %s", problems)
+		res.GeminiError = fmt.Sprintf("Failed to parse JSON: %s", problems)
+		return
+	}
+	if problems != "" {
+		// Keep what is valid and leave the receipt for review
+		log.Printf("Gemini: Output failed validation for receipt %d:\n%s", in.ReceiptID, problems)
+		res.GeminiError = "Validation failed: " + problems
+		res.ValidationErrors = validateParsedData(data)
+		clearInvalidFields(data, res.ValidationErrors)
+	}
+	if profile != nil {
+		var extraErrs []FieldError
+		data.Profile = profile.Name
+		data.Extra, extraErrs = extractProfileFields(profile, res.GeminiAnalysis)
+		if len(extraErrs) > 0 {
+			log.Printf("Receipt %d: dropped invalid %s fields:\n%s", in.ReceiptID, profile.Name, formatFieldErrors(extraErrs))
+		}
+	}
+	if len(data.Custom) > 0 {
+		var customErrs []FieldError
+		data.Custom, customErrs = validateCustomFields(data.Custom)
+		if len(customErrs) > 0 {
+			log.Printf("Receipt %d: dropped invalid custom fields:\n%s", in.ReceiptID, formatFieldErrors(customErrs))
+		}
+	}
+	if data.Currency == "" && in.Settings.DefaultCurrency != "" {
+		data.Currency = in.Settings.DefaultCurrency
+	}
+	// Settle DD/MM vs MM/DD from the merchant country or the user's locale
+	country := in.Settings.HomeCountry
+	if country == "" {
+		country = defaultCountry()
+	}
+	res.DateResolution = resolveReceiptDate(data, country, time.Now())
+	// Approved merchant defaults override Gemini's category guess
+	if applied, err := applyMerchantCategory(data); err != nil {
+		log.Printf("%v", err)
+	} else if applied {
+		res.Stages = append(res.Stages, "merchant_category")
+	}
+	res.Parsed = data
+
+	// The rightmost column of the layout holds the prices, a deterministic
+	// cross-check of the amounts Gemini read
+	if in.Config.LayoutCheck && hocr != "" && !useVision {
+		if check, err := checkLayout(hocr, data); err != nil {
+			log.Printf("Layout check of receipt %d: %v", in.ReceiptID, err)
+		} else {
+			res.LayoutCheck = check
+			res.Stages = append(res.Stages, "layout_check")
+			if stored, err := json.Marshal(check); err == nil {
+				if err := saveArtifact(in.ReceiptID, artifactLayoutCheck, string(stored)); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+		}
+	}
+
+	// Skip receipts already recorded under the same merchant and POS
+	// reference number, or that arrived through another channel before,
+	// unless a wrong link was undone by hand
+	var duplicateID int64
+	duplicateReason := duplicateReference
+	dismissed, err := duplicateDismissedFor(in.ReceiptID)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	if !dismissed {
+		if duplicateID, err = findDuplicateTransaction(data); err != nil {
+			log.Printf("%v", err)
+		}
+		if duplicateID == 0 && in.TransactionID == 0 {
+			if duplicateID, duplicateReason, err = findCrossChannelDuplicate(in.ReceiptID, photoHash, data); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+	res.Tip = analyzeTip(data)
+	if duplicateID > 0 && duplicateID != in.TransactionID {
+		log.Printf("Receipt %d duplicates transaction %d (%s)", in.ReceiptID, duplicateID, duplicateReason)
+		res.DuplicateOf = &duplicateID
+		res.DuplicateReason = duplicateReason
+		if in.TransactionID == 0 {
+			// Linked instead of stored again, so the purchase counts once
+			if err := linkDuplicateReceipt(in.ReceiptID, duplicateID, duplicateReason); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+		return
+	}
+
+	transactionID := in.TransactionID
+	if transactionID > 0 {
+		err = updateTransaction(transactionID, data)
+	} else {
+		transactionID, err = insertTransaction(in.ReceiptID, data)
+	}
+	if err != nil {
+		log.Printf("Failed to store transaction: %v", err)
+		return
+	}
+	res.TransactionID = transactionID
+
+	if in.Config.LineItems {
+		if err := saveTransactionItems(in.ReceiptID, transactionID, data.Items); err != nil {
+			log.Printf("%v", err)
+		}
+		res.Stages = append(res.Stages, "line_items")
+	}
+
+	if in.Config.Inventory {
+		if err := recordInventory(in.Tenant, in.ReceiptID, transactionID, data.Date, data.Items); err != nil {
+			log.Printf("%v", err)
+		}
+		res.Stages = append(res.Stages, "inventory")
+	}
+
+	if in.Config.Loyalty {
+		if err := recordLoyalty(in.Tenant, in.ReceiptID, transactionID, data); err != nil {
+			log.Printf("%v", err)
+		}
+		res.Stages = append(res.Stages, "loyalty")
+	}
+
+	if res.PolicyViolations, err = checkExpensePolicy(in, transactionID, data); err != nil {
+		log.Printf("Expense policy of receipt %d: %v", in.ReceiptID, err)
+	}
+
+	if in.Config.Enrichment {
+		progressTracker.Update(in.ReceiptID, stageEnrichment, 0, "")
+		if res.Insight, err = buildSpendingInsight(transactionID, data); err != nil {
+			log.Printf("Failed to build spending insight: %v", err)
+		}
+		res.Stages = append(res.Stages, "enrichment")
+	}
+
+	if in.Config.PriceCheck && priceClient != nil && len(data.Items) > 0 {
+		if res.PriceCheck, err = runPriceCheck(priceClient, in.ReceiptID, transactionID, data); err != nil {
+			log.Printf("Price check of receipt %d: %v", in.ReceiptID, err)
+		}
+		res.Stages = append(res.Stages, "price_check")
+		if res.PriceCheck != nil && res.PriceCheck.Flagged > 0 {
+			log.Printf("Receipt %d: %d item(s) charged above shelf price", in.ReceiptID, res.PriceCheck.Flagged)
+			if in.Settings.Notifications.AnomalyDetected {
+				go notifyReceiptEvent(eventAnomalyDetected, in.ReceiptID, transactionID, data, fiber.Map{
+					"kind":       "overcharge",
+					"reason":     fmt.Sprintf("%d item(s) charged %.2f above shelf price", res.PriceCheck.Flagged, res.PriceCheck.Overcharge),
+					"overcharge": res.PriceCheck.Overcharge,
+					"items":      res.PriceCheck.Items,
+				})
+			}
+		}
+	}
+
+	if res.Tip != nil && res.Tip.Unusual {
+		// Leave the receipt in needs_review so the total gets checked
+		log.Printf("Receipt %d has an unusual tip: %s", in.ReceiptID, res.Tip.Reason)
+		if in.Settings.Notifications.AnomalyDetected {
+			go notifyReceiptEvent(eventAnomalyDetected, in.ReceiptID, transactionID, data, fiber.Map{
+				"kind":   "unusual_tip",
+				"reason": res.Tip.Reason,
+			})
+		}
+	} else if len(res.ValidationErrors) > 0 {
+		log.Printf("Receipt %d left for review after failed validation", in.ReceiptID)
+	} else if res.LayoutCheck != nil && len(res.LayoutCheck.Disagreements) > 0 {
+		log.Printf("Receipt %d left for review: %d amount(s) disagree with the price column",
+			in.ReceiptID, len(res.LayoutCheck.Disagreements))
+	} else if data.DateAmbiguous {
+		log.Printf("Receipt %d left for review: date %q could be %s or %s",
+			in.ReceiptID, data.DateRaw, data.Date, res.DateResolution.Alternative)
+	} else if len(res.PolicyViolations) > 0 {
+		log.Printf("Receipt %d left for review: %d expense policy violation(s)", in.ReceiptID, len(res.PolicyViolations))
+		if in.Settings.Notifications.AnomalyDetected {
+			go notifyReceiptEvent(eventAnomalyDetected, in.ReceiptID, transactionID, data, fiber.Map{
+				"kind":       "policy_violation",
+				"reason":     res.PolicyViolations[0].Message,
+				"violations": res.PolicyViolations,
+			})
+		}
+	} else if data.Confidence < in.Settings.AutoApproveThreshold {
+		log.Printf("Receipt %d left for review: confidence %.2f is below the auto-approve threshold %.2f",
+			in.ReceiptID, data.Confidence, in.Settings.AutoApproveThreshold)
+	} else if pending, err := requestApproval(in, transactionID, data); pending || err != nil {
+		if err != nil {
+			log.Printf("Receipt %d left for review: %v", in.ReceiptID, err)
+		}
+	} else {
+		// Update receipt status to processed
+		if _, err := execWithRetry("UPDATE receipts SET status = ? WHERE id = ?", "processed", in.ReceiptID); err != nil {
+			log.Printf("Failed to mark receipt %d as processed: %v", in.ReceiptID, err)
+		}
+		if in.Settings.Notifications.ReceiptProcessed {
+			go notifyReceiptEvent(eventReceiptProcessed, in.ReceiptID, transactionID, data, nil)
+		}
+	}
+
+}
+
+// analyzeReceiptImageFile sends an image file straight to Gemini
+func analyzeReceiptImageFile(client *GeminiClient, prompt string, path string, schema *genai.Schema) (*GeminiResponse, error) {
+	imageData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	return client.AnalyzeImageWithPrompt(prompt, imageData, format, schema)
+}
+
+// ocrResponse renders the OCR stage for API responses
+func (r *PipelineResult) ocrResponse() fiber.Map {
+	return fiber.Map{
+		"status":            r.OCRStatus,
+		"text":              r.OCRText,
+		"error":             r.OCRError,
+		"processing_method": r.ProcessingMethod,
+		"rotation":          r.Rotation,
+	}
+}
+
+// geminiResponse renders the Gemini stage for API responses
+func (r *PipelineResult) geminiResponse() fiber.Map {
+	return fiber.Map{
+		"status":            r.GeminiStatus,
+		"analysis":          r.GeminiAnalysis,
+		"error":             r.GeminiError,
+		"parsed":            r.Parsed,
+		"duplicate_of":      r.DuplicateOf,
+		"duplicate_reason":  r.DuplicateReason,
+		"tip":               r.Tip,
+		"insight":           r.Insight,
+		"price_check":       r.PriceCheck,
+		"merchant_hint":     r.MerchantHint,
+		"profile":           r.Profile,
+		"repair_attempts":   r.RepairAttempts,
+		"validation_errors": r.ValidationErrors,
+		"date_resolution":   r.DateResolution,
+		"policy_violations": r.PolicyViolations,
+		"layout_check":      r.LayoutCheck,
+	}
+}
+
+// parseAndValidate parses a Gemini response and validates it against the
+// schema. problems is empty when the data is valid; data is nil when the
+// response could not be parsed at all.
+func parseAndValidate(text string) (*GeminiParsedData, string) {
+	data, err := parseGeminiJSON(text)
+	if err != nil {
+		return nil, fmt.Sprintf("- response is not valid JSON for the schema: %v", err)
+	}
+	if errs := validateParsedData(data); len(errs) > 0 {
+		return data, formatFieldErrors(errs)
+	}
+	return data, ""
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultTenant is the tenant key used when a request carries no tenant or
+// API key, and whose stored configuration applies to tenants without their own
+const defaultTenant = "default"
+
+// PipelineConfig enables or disables optional pipeline stages
+type PipelineConfig struct {
+	// AutoRotate uses Tesseract orientation detection to straighten photos before OCR
+	AutoRotate bool `json:"auto_rotate"`
+	// Preprocessing converts photos to high-contrast grayscale before OCR
+	Preprocessing bool `json:"preprocessing"`
+	// Redaction masks card numbers, emails and phone numbers before text is sent to Gemini
+	Redaction bool `json:"redaction"`
+	// VisionFallback sends the image to Gemini when OCR yields no usable text
+	VisionFallback bool `json:"vision_fallback"`
+	// Enrichment adds spending insights to processed receipts
+	Enrichment bool `json:"enrichment"`
+	// LineItems extracts the purchased items and stores them per transaction
+	LineItems bool `json:"line_items"`
+	// PriceCheck extracts line items and compares them with the shelf
+	// prices of the price API at PRICE_CHECK_URL
+	PriceCheck bool `json:"price_check"`
+	// Inventory extracts line items and adds them to the household
+	// inventory
+	Inventory bool `json:"inventory"`
+	// Loyalty extracts the loyalty program, card and points printed on
+	// receipts and tracks the points per program
+	Loyalty bool `json:"loyalty"`
+	// LayoutCheck compares Gemini's amounts with the price column of the
+	// hOCR layout and leaves receipts where they disagree for review
+	LayoutCheck bool `json:"layout_check"`
+}
+
+// builtinPipelineConfig applies when neither the tenant nor the default
+// tenant has a stored configuration
+func builtinPipelineConfig() PipelineConfig {
+	return PipelineConfig{AutoRotate: true, Enrichment: true, LineItems: true}
+}
+
+// tenantKey identifies the tenant of a request: the signed-in user, else the
+// owner of the API token, else the X-Tenant-ID header, else a hash of the
+// X-API-Key header, else the default tenant
+func tenantKey(c *fiber.Ctx) string {
+	if u := currentUser(c); u != nil {
+		return u.tenantKey()
+	}
+	if t := currentToken(c); t != nil {
+		return t.TenantKey
+	}
+	if tenant := c.Get("X-Tenant-ID"); tenant != "" {
+		return "tenant:" + tenant
+	}
+	if key := c.Get("X-API-Key"); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:])[:16]
+	}
+	return defaultTenant
+}
+
+// loadPipelineConfig returns the stored configuration for a tenant, falling
+// back to the default tenant's configuration and then the built-in defaults
+func loadPipelineConfig(tenant string) PipelineConfig {
+	for _, key := range []string{tenant, defaultTenant} {
+		var raw []byte
+		err := db.QueryRow("SELECT config FROM pipeline_configs WHERE tenant_key = ?", key).Scan(&raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load pipeline config for %s: %v", key, err)
+			break
+		}
+
+		cfg := builtinPipelineConfig()
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			log.Printf("Invalid pipeline config for %s: %v", key, err)
+			break
+		}
+		return cfg
+	}
+	return builtinPipelineConfig()
+}
+
+// savePipelineConfig stores the configuration for a tenant
+func savePipelineConfig(tenant string, cfg PipelineConfig) error {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO pipeline_configs (tenant_key, config) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE config = VALUES(config)`,
+		tenant, raw,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save pipeline config: %v", err)
+	}
+	return nil
+}
+
+// registerPipelineConfigRoutes adds endpoints to view and change the pipeline
+// configuration of the calling tenant
+func registerPipelineConfigRoutes(app *fiber.App) {
+	app.Get("/pipeline/config", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenant":  tenant,
+			"config":  loadPipelineConfig(tenant),
+		})
+	})
+
+	// Fields missing from the body keep their current value
+	app.Put("/pipeline/config", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		cfg := loadPipelineConfig(tenant)
+		if err := json.Unmarshal(c.Body(), &cfg); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		if err := savePipelineConfig(tenant, cfg); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenant":  tenant,
+			"config":  cfg,
+		})
+	})
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Policy rules a transaction can violate
+const (
+	policyClaimAge      = "max_claim_age"
+	policyMaxAmount     = "max_amount"
+	policyRequiredField = "required_field"
+)
+
+// policyAnyCategory is the max_amounts key that applies to categories
+// without a limit of their own
+const policyAnyCategory = "*"
+
+// policyCoreFields are the extracted fields a policy can require, besides
+// custom fields
+var policyCoreFields = []string{"date", "merchant", "category", "amount", "currency", "reference_number"}
+
+// ExpensePolicy is the expense policy receipts are checked against when
+// they are processed. Zero values disable a rule.
+type ExpensePolicy struct {
+	// MaxClaimAgeDays is how old a receipt may be when it is submitted
+	MaxClaimAgeDays int `json:"max_claim_age_days"`
+	// MaxAmounts limits the amount per category in the home currency; "*"
+	// applies to every other category
+	MaxAmounts map[string]float64 `json:"max_amounts"`
+	// RequiredFields must be extracted: date, merchant, category, amount,
+	// currency, reference_number or a custom field
+	RequiredFields []string `json:"required_fields"`
+}
+
+// PolicyViolation is a policy rule a transaction breaks
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// normalize lower-cases categories and field names and checks the values
+func (p *ExpensePolicy) normalize() error {
+	if p.MaxClaimAgeDays < 0 {
+		return fmt.Errorf("max_claim_age_days must not be negative")
+	}
+	amounts := map[string]float64{}
+	for category, limit := range p.MaxAmounts {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" {
+			return fmt.Errorf("max_amounts needs category names, or * for every category")
+		}
+		if limit <= 0 {
+			return fmt.Errorf("max_amounts of %s must be positive", category)
+		}
+		amounts[category] = limit
+	}
+	p.MaxAmounts = amounts
+
+	fields := []string{}
+	for _, name := range p.RequiredFields {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || containsString(fields, name) {
+			continue
+		}
+		if !containsString(policyCoreFields, name) && customFieldByName(name) == nil {
+			return fmt.Errorf("unknown required field %q, expected one of %s or a custom field", name, strings.Join(policyCoreFields, ", "))
+		}
+		fields = append(fields, name)
+	}
+	p.RequiredFields = fields
+	return nil
+}
+
+// loadExpensePolicy returns the stored policy for a tenant, falling back to
+// the default tenant's policy, or nil when neither has one
+func loadExpensePolicy(tenant string) *ExpensePolicy {
+	for _, key := range []string{tenant, defaultTenant} {
+		var raw []byte
+		err := db.QueryRow("SELECT policy FROM expense_policies WHERE tenant_key = ?", key).Scan(&raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load expense policy for %s: %v", key, err)
+			return nil
+		}
+
+		var policy ExpensePolicy
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			log.Printf("Invalid expense policy for %s: %v", key, err)
+			return nil
+		}
+		return &policy
+	}
+	return nil
+}
+
+// saveExpensePolicy stores the policy of a tenant
+func saveExpensePolicy(tenant string, policy ExpensePolicy) error {
+	raw, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO expense_policies (tenant_key, policy) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE policy = VALUES(policy)`,
+		tenant, raw,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save expense policy: %v", err)
+	}
+	return nil
+}
+
+// policyFieldMissing reports whether a required field was not extracted
+func policyFieldMissing(name string, data *GeminiParsedData) bool {
+	switch name {
+	case "date":
+		return data.Date == ""
+	case "merchant":
+		return data.MerchantClean == "" && data.MerchantRaw == ""
+	case "category":
+		return data.Category == ""
+	case "amount":
+		return data.Amount == 0
+	case "currency":
+		return data.Currency == ""
+	case "reference_number":
+		return data.ReferenceNumber == ""
+	}
+	v, ok := data.Custom[name]
+	return !ok || v == nil || v == ""
+}
+
+// evaluate checks a transaction against the policy. homeAmount is the
+// transaction amount in the home currency.
+func (p *ExpensePolicy) evaluate(data *GeminiParsedData, homeAmount float64, now time.Time) []PolicyViolation {
+	violations := []PolicyViolation{}
+	for _, name := range p.RequiredFields {
+		if policyFieldMissing(name, data) {
+			violations = append(violations, PolicyViolation{
+				Rule:    policyRequiredField,
+				Field:   name,
+				Message: name + " is required",
+			})
+		}
+	}
+
+	if p.MaxClaimAgeDays > 0 && data.Date != "" {
+		if date, err := time.Parse("2006-01-02", data.Date); err == nil {
+			if age := int(now.Sub(date).Hours() / 24); age > p.MaxClaimAgeDays {
+				violations = append(violations, PolicyViolation{
+					Rule:    policyClaimAge,
+					Field:   "date",
+					Message: fmt.Sprintf("receipt is %d days old, claims are accepted for %d days", age, p.MaxClaimAgeDays),
+				})
+			}
+		}
+	}
+
+	category := strings.ToLower(data.Category)
+	limit, ok := p.MaxAmounts[category]
+	if !ok {
+		limit, ok = p.MaxAmounts[policyAnyCategory]
+	}
+	if ok && homeAmount > limit {
+		label := category
+		if label == "" {
+			label = "uncategorized"
+		}
+		violations = append(violations, PolicyViolation{
+			Rule:    policyMaxAmount,
+			Field:   "amount",
+			Message: fmt.Sprintf("%.2f %s exceeds the %s limit of %.2f", homeAmount, homeCurrency(), label, limit),
+		})
+	}
+	return violations
+}
+
+// checkExpensePolicy evaluates the submitter's expense policy for a stored
+// transaction and records the violations on it. It returns nil when no
+// policy applies.
+func checkExpensePolicy(in PipelineInput, transactionID int64, data *GeminiParsedData) ([]PolicyViolation, error) {
+	tenant := in.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	policy := loadExpensePolicy(tenant)
+	// A transaction analyzed again loses flags of a removed policy
+	if policy == nil && in.TransactionID == 0 {
+		return nil, nil
+	}
+
+	var violations []PolicyViolation
+	if policy != nil {
+		var homeAmount float64
+		err := db.QueryRow(
+			"SELECT COALESCE(home_amount, amount, 0) FROM transactions WHERE id = ?", transactionID,
+		).Scan(&homeAmount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load transaction %d: %v", transactionID, err)
+		}
+		violations = policy.evaluate(data, homeAmount, time.Now())
+	}
+
+	var stored sql.NullString
+	if len(violations) > 0 {
+		raw, err := json.Marshal(violations)
+		if err != nil {
+			return violations, err
+		}
+		stored = sql.NullString{String: string(raw), Valid: true}
+	}
+	if _, err := execWithRetry("UPDATE transactions SET policy_violations = ? WHERE id = ?", stored, transactionID); err != nil {
+		return violations, fmt.Errorf("failed to store policy violations of transaction %d: %v", transactionID, err)
+	}
+	return violations, nil
+}
+
+// decodePolicyViolations reads the stored policy_violations column
+func decodePolicyViolations(raw []byte) []PolicyViolation {
+	if len(raw) == 0 {
+		return nil
+	}
+	var violations []PolicyViolation
+	if err := json.Unmarshal(raw, &violations); err != nil {
+		return nil
+	}
+	return violations
+}
+
+// registerPolicyRoutes adds endpoints to view and change the expense policy
+// of the calling tenant; the default tenant's policy applies to everyone
+// without their own
+func registerPolicyRoutes(app *fiber.App) {
+	app.Get("/policy", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenant":  tenant,
+			"policy":  loadExpensePolicy(tenant),
+		})
+	})
+
+	// The body replaces the whole policy
+	app.Put("/policy", func(c *fiber.Ctx) error {
+		var policy ExpensePolicy
+		if err := json.Unmarshal(c.Body(), &policy); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if err := policy.normalize(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		tenant := tenantKey(c)
+		if err := saveExpensePolicy(tenant, policy); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"tenant":  tenant,
+			"policy":  policy,
+		})
+	})
+
+	// Transactions with policy violations, newest first, for the review
+	// queue; rule filters by rule name
+	app.Get("/policy/violations", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 50)
+		if limit < 1 || limit > 200 {
+			limit = 50
+		}
+		rule := c.Query("rule")
+		if rule != "" && rule != policyClaimAge && rule != policyMaxAmount && rule != policyRequiredField {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("rule must be %s, %s or %s", policyClaimAge, policyMaxAmount, policyRequiredField),
+			})
+		}
+
+		cond := "t.policy_violations IS NOT NULL"
+		var args []any
+		if rule != "" {
+			cond += " AND JSON_CONTAINS(t.policy_violations, JSON_OBJECT('rule', ?))"
+			args = append(args, rule)
+		}
+		rows, err := db.Query(
+			`SELECT t.id, t.receipt_id, r.status, t.date, COALESCE(t.merchant_clean, t.merchant_raw), t.category,
+				t.amount, t.currency, t.home_amount, t.policy_violations
+			FROM transactions t
+			JOIN receipts r ON r.id = t.receipt_id
+			WHERE `+cond+`
+			ORDER BY t.id DESC
+			LIMIT ?`,
+			append(args, limit)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list policy violations: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		type flaggedTransaction struct {
+			TransactionID int64             `json:"transaction_id"`
+			ReceiptID     int64             `json:"receipt_id"`
+			Status        string            `json:"status"`
+			Date          *string           `json:"date"`
+			Merchant      *string           `json:"merchant"`
+			Category      *string           `json:"category"`
+			Amount        *float64          `json:"amount"`
+			Currency      *string           `json:"currency"`
+			HomeAmount    *float64          `json:"home_amount"`
+			Violations    []PolicyViolation `json:"violations"`
+		}
+		flagged := []flaggedTransaction{}
+		for rows.Next() {
+			var t flaggedTransaction
+			var date sql.NullTime
+			var merchant, category, currency sql.NullString
+			var amount, homeAmount sql.NullFloat64
+			var raw []byte
+			if err := rows.Scan(&t.TransactionID, &t.ReceiptID, &t.Status, &date, &merchant, &category,
+				&amount, &currency, &homeAmount, &raw); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read policy violations: %v", err),
+				})
+			}
+			t.Violations = decodePolicyViolations(raw)
+			t.Date = formatNullDate(date)
+			t.Merchant = nullStringPtr(merchant)
+			t.Category = nullStringPtr(category)
+			t.Amount = nullFloatPtr(amount)
+			t.Currency = nullStringPtr(currency)
+			t.HomeAmount = nullFloatPtr(homeAmount)
+			flagged = append(flagged, t)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read policy violations: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":      true,
+			"transactions": flagged,
+		})
+	})
+}
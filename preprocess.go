@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// Image preprocessing steps, applied in this order
+const (
+	// preprocessEXIF turns phone photos upright according to their EXIF
+	// orientation tag
+	preprocessEXIF      = "exif"
+	preprocessGrayscale = "grayscale"
+	// preprocessContrast stretches the gray levels to the full range
+	preprocessContrast = "contrast"
+	// preprocessDeskew straightens text lines photographed at a slant
+	preprocessDeskew = "deskew"
+	// preprocessThreshold turns the image black and white against the
+	// local background, which evens out shadows and uneven lighting
+	preprocessThreshold = "threshold"
+)
+
+// preprocessStepOrder lists the known steps in the order they are applied
+var preprocessStepOrder = []string{preprocessEXIF, preprocessGrayscale, preprocessContrast, preprocessDeskew, preprocessThreshold}
+
+// defaultPreprocessing is used when PREPROCESS_STEPS is not set
+const defaultPreprocessing = "exif,grayscale,contrast"
+
+// maxSkewDegrees is the largest slant deskew looks for
+const maxSkewDegrees = 10.0
+
+// parsePreprocessSteps reads a comma-separated list of steps, returned in
+// application order. "none" selects no steps.
+func parsePreprocessSteps(s string) ([]string, error) {
+	selected := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		if !containsString(preprocessStepOrder, name) {
+			return nil, fmt.Errorf("unknown preprocessing step %q, expected none or %s", name, strings.Join(preprocessStepOrder, ", "))
+		}
+		selected[name] = true
+	}
+	steps := []string{}
+	for _, name := range preprocessStepOrder {
+		if selected[name] {
+			steps = append(steps, name)
+		}
+	}
+	return steps, nil
+}
+
+// defaultPreprocessSteps returns the steps applied when the preprocessing
+// stage is enabled, from PREPROCESS_STEPS (default exif, grayscale and
+// contrast)
+func defaultPreprocessSteps() []string {
+	if v := os.Getenv("PREPROCESS_STEPS"); v != "" {
+		steps, err := parsePreprocessSteps(v)
+		if err == nil {
+			return steps
+		}
+		log.Printf("Invalid PREPROCESS_STEPS: %v", err)
+	}
+	steps, _ := parsePreprocessSteps(defaultPreprocessing)
+	return steps
+}
+
+// preprocessSteps returns the steps for a receipt: the request's own
+// selection, else the default steps when the preprocessing stage is enabled
+func preprocessSteps(cfg PipelineConfig, opts OCROptions) []string {
+	if opts.Preprocess != "" {
+		steps, _ := parsePreprocessSteps(opts.Preprocess)
+		return steps
+	}
+	if cfg.Preprocessing {
+		return defaultPreprocessSteps()
+	}
+	return nil
+}
+
+// exifOrientImageFile writes an upright copy of a JPEG photo whose EXIF
+// orientation asks for rotating or mirroring to a temporary PNG in dir. It
+// returns the original path and orientation 1 when nothing needs to change.
+func exifOrientImageFile(path, dir string) (string, int, error) {
+	orientation := jpegOrientation(path)
+	if orientation <= 1 {
+		return path, 1, nil
+	}
+	src, err := decodeImageFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	out, err := writeTempPNG(orientImage(src, orientation), dir, "receipt-oriented-*.png")
+	return out, orientation, err
+}
+
+// preprocessImage applies the grayscale, contrast, deskew and threshold
+// steps among steps to a receipt photo, which noticeably improves Tesseract
+// results on phone photos. The result is a grayscale image written to a
+// temporary PNG in dir (the system temp directory when empty). It returns
+// the original path when steps holds none of these.
+func preprocessImage(path, dir string, steps []string) (string, []string, error) {
+	var applied []string
+	for _, step := range steps {
+		if step != preprocessEXIF {
+			applied = append(applied, step)
+		}
+	}
+	if len(applied) == 0 {
+		return path, nil, nil
+	}
+
+	src, err := decodeImageFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	gray := toGray(src)
+	for _, step := range applied {
+		switch step {
+		case preprocessContrast:
+			stretchContrast(gray)
+		case preprocessDeskew:
+			if angle := estimateSkew(gray); math.Abs(angle) >= 0.2 {
+				gray = rotateGray(gray, angle)
+			}
+		case preprocessThreshold:
+			adaptiveThreshold(gray)
+		}
+	}
+
+	out, err := writeTempPNG(gray, dir, "receipt-preprocessed-*.png")
+	if err != nil {
+		return "", nil, err
+	}
+	return out, applied, nil
+}
+
+// decodeImageFile decodes a JPEG, PNG or GIF file
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return src, nil
+}
+
+// writeTempPNG encodes an image to a new temporary file in dir
+func writeTempPNG(img image.Image, dir, pattern string) (string, error) {
+	out, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer out.Close()
+	if err := png.Encode(out, img); err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("failed to encode image: %v", err)
+	}
+	return out.Name(), nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG file, or 1
+// when the file is not a JPEG or has no orientation tag
+func jpegOrientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+
+	// The EXIF segment precedes the image data, so the first 128 KiB suffice
+	head, err := io.ReadAll(io.LimitReader(f, 128<<10))
+	if err != nil || len(head) < 4 || head[0] != 0xFF || head[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(head); {
+		if head[i] != 0xFF {
+			return 1
+		}
+		marker := head[i+1]
+		size := int(binary.BigEndian.Uint16(head[i+2:]))
+		// Start of scan: no metadata follows
+		if marker == 0xDA || size < 2 || i+2+size > len(head) {
+			return 1
+		}
+		segment := head[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF
+// structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orientImage applies the rotation and mirroring of an EXIF orientation
+func orientImage(src image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return flipHorizontal(src)
+	case 3:
+		return rotateImage(src, 180)
+	case 4:
+		return flipHorizontal(rotateImage(src, 180))
+	case 5:
+		return flipHorizontal(rotateImage(src, 90))
+	case 6:
+		return rotateImage(src, 90)
+	case 7:
+		return flipHorizontal(rotateImage(src, 270))
+	case 8:
+		return rotateImage(src, 270)
+	}
+	return src
+}
+
+// flipHorizontal mirrors an image left to right
+func flipHorizontal(src image.Image) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(w-1-x, y, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// toGray converts an image to grayscale with its origin at 0,0
+func toGray(src image.Image) *image.Gray {
+	b := src.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			gray.SetGray(x, y, color.GrayModel.Convert(src.At(b.Min.X+x, b.Min.Y+y)).(color.Gray))
+		}
+	}
+	return gray
+}
+
+// grayHistogram counts the pixels of each gray level
+func grayHistogram(gray *image.Gray) [256]int {
+	var histogram [256]int
+	for _, v := range gray.Pix {
+		histogram[v]++
+	}
+	return histogram
+}
+
+// stretchContrast stretches the gray levels between the 1st and 99th
+// percentile to the full range, ignoring stray pixels
+func stretchContrast(gray *image.Gray) {
+	histogram := grayHistogram(gray)
+	total := len(gray.Pix)
+	low, high := percentileLevel(histogram, total, 0.01), percentileLevel(histogram, total, 0.99)
+	if high <= low {
+		return
+	}
+	scale := 255.0 / float64(high-low)
+	for i, v := range gray.Pix {
+		switch {
+		case int(v) <= low:
+			gray.Pix[i] = 0
+		case int(v) >= high:
+			gray.Pix[i] = 255
+		default:
+			gray.Pix[i] = uint8(float64(int(v)-low) * scale)
+		}
+	}
+}
+
+// percentileLevel returns the gray level below which the given fraction of pixels fall
+func percentileLevel(histogram [256]int, total int, fraction float64) int {
+	target := int(float64(total) * fraction)
+	count := 0
+	for level, n := range histogram {
+		count += n
+		if count > target {
+			return level
+		}
+	}
+	return 255
+}
+
+// otsuLevel returns the gray level that best separates ink from paper
+func otsuLevel(histogram [256]int, total int) int {
+	var sum float64
+	for level, n := range histogram {
+		sum += float64(level * n)
+	}
+	var sumBackground, best float64
+	weightBackground, level := 0, 127
+	for t, n := range histogram {
+		weightBackground += n
+		weightForeground := total - weightBackground
+		if weightBackground == 0 {
+			continue
+		}
+		if weightForeground == 0 {
+			break
+		}
+		sumBackground += float64(t * n)
+		meanBackground := sumBackground / float64(weightBackground)
+		meanForeground := (sum - sumBackground) / float64(weightForeground)
+		between := float64(weightBackground) * float64(weightForeground) * (meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if between > best {
+			best, level = between, t
+		}
+	}
+	return level
+}
+
+// estimateSkew returns the slant of the text lines in degrees, positive
+// when lines run downwards to the right. It tries angles up to
+// maxSkewDegrees and picks the one whose horizontal projection of dark
+// pixels has the sharpest peaks.
+func estimateSkew(gray *image.Gray) float64 {
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	// Sample about 600 pixels across; skew does not need full resolution
+	step := w / 600
+	if step < 1 {
+		step = 1
+	}
+	level := otsuLevel(grayHistogram(gray), len(gray.Pix))
+	var xs, ys []float64
+	for y := 0; y < h; y += step {
+		for x := 0; x < w; x += step {
+			if int(gray.Pix[y*gray.Stride+x]) < level {
+				xs = append(xs, float64(x/step))
+				ys = append(ys, float64(y/step))
+			}
+		}
+	}
+	if len(xs) < 100 {
+		return 0
+	}
+
+	rowsOffset := w/step + 1
+	counts := make([]int, h/step+2*rowsOffset+2)
+	bestAngle, bestScore := 0.0, -1.0
+	for angle := -maxSkewDegrees; angle <= maxSkewDegrees; angle += 0.25 {
+		slope := math.Tan(angle * math.Pi / 180)
+		for i := range counts {
+			counts[i] = 0
+		}
+		for i := range xs {
+			row := int(ys[i]-xs[i]*slope) + rowsOffset
+			if row >= 0 && row < len(counts) {
+				counts[row]++
+			}
+		}
+		score := 0.0
+		for _, n := range counts {
+			score += float64(n * n)
+		}
+		if score > bestScore {
+			bestAngle, bestScore = angle, score
+		}
+	}
+	return bestAngle
+}
+
+// rotateGray straightens lines slanted by angle degrees, keeping the image
+// size and filling uncovered corners with white
+func rotateGray(src *image.Gray, angle float64) *image.Gray {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+	for y := 0; y < h; y++ {
+		dy := float64(y) - cy
+		for x := 0; x < w; x++ {
+			dx := float64(x) - cx
+			sx := cx + dx*cos - dy*sin
+			sy := cy + dx*sin + dy*cos
+			dst.Pix[y*dst.Stride+x] = sampleGray(src, sx, sy)
+		}
+	}
+	return dst
+}
+
+// sampleGray interpolates the gray level at a fractional position, white
+// outside the image
+func sampleGray(src *image.Gray, x, y float64) uint8 {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	if x0 < 0 || y0 < 0 || x0+1 >= w || y0+1 >= h {
+		return 255
+	}
+	fx, fy := x-float64(x0), y-float64(y0)
+	at := func(px, py int) float64 { return float64(src.Pix[py*src.Stride+px]) }
+	top := at(x0, y0)*(1-fx) + at(x0+1, y0)*fx
+	bottom := at(x0, y0+1)*(1-fx) + at(x0+1, y0+1)*fx
+	return uint8(math.Round(top*(1-fy) + bottom*fy))
+}
+
+// adaptiveThreshold turns pixels black that are more than 15% darker than
+// the mean of their neighbourhood and all others white (Bradley's method)
+func adaptiveThreshold(gray *image.Gray) {
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	radius := w / 32
+	if radius < 7 {
+		radius = 7
+	}
+
+	// Integral image: sum of all pixels above and left of each position
+	integral := make([]int64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var row int64
+		for x := 0; x < w; x++ {
+			row += int64(gray.Pix[y*gray.Stride+x])
+			integral[(y+1)*(w+1)+x+1] = integral[y*(w+1)+x+1] + row
+		}
+	}
+
+	out := make([]uint8, len(gray.Pix))
+	for y := 0; y < h; y++ {
+		y1, y2 := max(y-radius, 0), min(y+radius+1, h)
+		for x := 0; x < w; x++ {
+			x1, x2 := max(x-radius, 0), min(x+radius+1, w)
+			count := int64((x2 - x1) * (y2 - y1))
+			sum := integral[y2*(w+1)+x2] - integral[y1*(w+1)+x2] - integral[y2*(w+1)+x1] + integral[y1*(w+1)+x1]
+			out[y*gray.Stride+x] = 255
+			if int64(gray.Pix[y*gray.Stride+x])*count*100 < sum*85 {
+				out[y*gray.Stride+x] = 0
+			}
+		}
+	}
+	copy(gray.Pix, out)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxPriceHistoryPurchases caps the purchases listed by the price history
+const maxPriceHistoryPurchases = 1000
+
+// ItemPurchase is one purchase of an item in the price history
+type ItemPurchase struct {
+	TransactionID int64    `json:"transaction_id"`
+	Date          *string  `json:"date"`
+	Merchant      *string  `json:"merchant"`
+	Description   *string  `json:"description"`
+	Quantity      float64  `json:"quantity"`
+	Unit          *string  `json:"unit"`
+	Total         float64  `json:"total"`
+	Currency      *string  `json:"currency"`
+	CanonicalUnit string   `json:"canonical_unit"`
+	PricePerUnit  float64  `json:"price_per_unit"`
+	UnitPrice     *float64 `json:"unit_price"`
+}
+
+// MerchantUnitPrice compares what a merchant charged per canonical unit
+type MerchantUnitPrice struct {
+	Merchant      string `json:"merchant"`
+	Currency      string `json:"currency"`
+	CanonicalUnit string `json:"canonical_unit"`
+	Purchases     int    `json:"purchases"`
+	// AveragePrice is weighted by quantity
+	AveragePrice float64 `json:"average_price"`
+	MinPrice     float64 `json:"min_price"`
+	MaxPrice     float64 `json:"max_price"`
+	LatestPrice  float64 `json:"latest_price"`
+	LatestDate   *string `json:"latest_date"`
+	// Cheapest marks the lowest average price among the merchants with the
+	// same currency and unit
+	Cheapest bool `json:"cheapest"`
+
+	quantity, spend float64
+}
+
+// registerPriceHistoryRoutes adds the price history of line items
+func registerPriceHistoryRoutes(app *fiber.App) {
+	// Purchases of the items matching item (description substring) or
+	// barcode between from and to, with the price per kg, liter or piece
+	// and a comparison across merchants. unit limits the result to kg, l
+	// or pcs.
+	app.Get("/reports/prices", func(c *fiber.Ctx) error {
+		item, barcode := strings.TrimSpace(c.Query("item")), strings.TrimSpace(c.Query("barcode"))
+		if item == "" && barcode == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "item or barcode is required",
+			})
+		}
+		dateCond, dateArgs, err := reportDateRange(c, "t.date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		conds, args := []string{"i.price_per_unit IS NOT NULL", dateCond}, dateArgs
+		if item != "" {
+			conds = append(conds, "i.description LIKE ?")
+			args = append(args, "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(item)+"%")
+		}
+		if barcode != "" {
+			conds = append(conds, "i.barcode = ?")
+			args = append(args, barcode)
+		}
+		if unit := c.Query("unit"); unit != "" {
+			if unit != unitKilogram && unit != unitLiter && unit != unitPieces {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "unit must be kg, l or pcs",
+				})
+			}
+			conds = append(conds, "i.canonical_unit = ?")
+			args = append(args, unit)
+		}
+
+		rows, err := db.Query(
+			`SELECT t.id, t.date, COALESCE(t.merchant_clean, t.merchant_raw), i.description, i.quantity, i.unit, i.total,
+				t.currency, i.canonical_quantity, i.canonical_unit, i.price_per_unit, i.unit_price
+			FROM transaction_items i
+			JOIN `+transactionsAllView+` t ON t.id = i.transaction_id
+			JOIN receipts r ON r.id = t.receipt_id
+			WHERE r.deleted_at IS NULL AND `+strings.Join(conds, " AND ")+`
+			ORDER BY t.date IS NULL, t.date, i.id
+			LIMIT ?`,
+			append(args, maxPriceHistoryPurchases+1)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load price history: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		purchases := []ItemPurchase{}
+		byMerchant := map[string]*MerchantUnitPrice{}
+		truncated := false
+		for rows.Next() {
+			if len(purchases) == maxPriceHistoryPurchases {
+				truncated = true
+				break
+			}
+			var p ItemPurchase
+			var date sql.NullTime
+			var merchant, description, unit, currency sql.NullString
+			var printedPrice sql.NullFloat64
+			var quantity float64
+			if err := rows.Scan(&p.TransactionID, &date, &merchant, &description, &p.Quantity, &unit, &p.Total,
+				&currency, &quantity, &p.CanonicalUnit, &p.PricePerUnit, &printedPrice); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read price history: %v", err),
+				})
+			}
+			p.Date = formatNullDate(date)
+			p.Merchant = nullStringPtr(merchant)
+			p.Description = nullStringPtr(description)
+			p.Unit = nullStringPtr(unit)
+			p.Currency = nullStringPtr(currency)
+			p.UnitPrice = nullFloatPtr(printedPrice)
+			purchases = append(purchases, p)
+
+			// Prices are only compared within one currency and unit
+			key := merchant.String + "\x00" + currency.String + "\x00" + p.CanonicalUnit
+			m, ok := byMerchant[key]
+			if !ok {
+				m = &MerchantUnitPrice{
+					Merchant: merchant.String, Currency: currency.String, CanonicalUnit: p.CanonicalUnit,
+					MinPrice: p.PricePerUnit, MaxPrice: p.PricePerUnit,
+				}
+				byMerchant[key] = m
+			}
+			m.Purchases++
+			m.quantity += quantity
+			m.spend += p.Total
+			if p.PricePerUnit < m.MinPrice {
+				m.MinPrice = p.PricePerUnit
+			}
+			if p.PricePerUnit > m.MaxPrice {
+				m.MaxPrice = p.PricePerUnit
+			}
+			m.LatestPrice, m.LatestDate = p.PricePerUnit, p.Date
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read price history: %v", err),
+			})
+		}
+
+		merchants := []*MerchantUnitPrice{}
+		for _, m := range byMerchant {
+			if m.quantity > 0 {
+				m.AveragePrice = unitPrice(m.spend, m.quantity)
+			}
+			merchants = append(merchants, m)
+		}
+		sort.Slice(merchants, func(i, j int) bool {
+			a, b := merchants[i], merchants[j]
+			if a.CanonicalUnit != b.CanonicalUnit {
+				return a.CanonicalUnit < b.CanonicalUnit
+			}
+			if a.Currency != b.Currency {
+				return a.Currency < b.Currency
+			}
+			return a.AveragePrice < b.AveragePrice
+		})
+		for i, m := range merchants {
+			m.Cheapest = i == 0 || merchants[i-1].CanonicalUnit != m.CanonicalUnit || merchants[i-1].Currency != m.Currency
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"purchases": purchases,
+			"merchants": merchants,
+			"truncated": truncated,
+		})
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxPriceCheckItems caps the price API lookups made for one receipt
+const maxPriceCheckItems = 50
+
+// PriceCheckItem compares a line item with the merchant's published price
+type PriceCheckItem struct {
+	Name         string   `json:"name"`
+	Barcode      string   `json:"barcode,omitempty"`
+	Quantity     float64  `json:"quantity"`
+	ChargedPrice float64  `json:"charged_price"`
+	ShelfPrice   *float64 `json:"shelf_price"`
+	// Overcharge is what was paid above the shelf price for all units
+	Overcharge float64 `json:"overcharge"`
+	Flagged    bool    `json:"flagged"`
+}
+
+// PriceCheckResult summarizes the price check of a receipt
+type PriceCheckResult struct {
+	Checked    int              `json:"checked"`
+	Unknown    int              `json:"unknown"`
+	Flagged    int              `json:"flagged"`
+	Overcharge float64          `json:"overcharge"`
+	Currency   string           `json:"currency"`
+	Items      []PriceCheckItem `json:"items"`
+}
+
+// PriceClient looks up shelf prices in the price API at PRICE_CHECK_URL
+type PriceClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// newPriceClient returns a client for PRICE_CHECK_URL, optionally
+// authenticated with PRICE_CHECK_TOKEN, or nil when not configured
+func newPriceClient() *PriceClient {
+	baseURL := os.Getenv("PRICE_CHECK_URL")
+	if baseURL == "" {
+		return nil
+	}
+	return &PriceClient{
+		baseURL: baseURL,
+		token:   os.Getenv("PRICE_CHECK_TOKEN"),
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Lookup asks the price API for the shelf price of an item at a merchant.
+// The API is called as GET PRICE_CHECK_URL?barcode=&name=&merchant=&currency=
+// and answers {"price": 1.99} or 404 when it does not know the item.
+func (p *PriceClient) Lookup(item ReceiptItem, merchant, currency string) (*float64, error) {
+	query := url.Values{}
+	if item.Barcode != "" {
+		query.Set("barcode", item.Barcode)
+	}
+	query.Set("name", item.Name)
+	query.Set("merchant", merchant)
+	query.Set("currency", currency)
+
+	sep := "?"
+	if strings.Contains(p.baseURL, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequest("GET", p.baseURL+sep+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("price lookup failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("price lookup returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Price *float64 `json:"price"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid price lookup response: %v", err)
+	}
+	if out.Price == nil || *out.Price <= 0 {
+		return nil, nil
+	}
+	return out.Price, nil
+}
+
+// priceCheckTolerance is the percentage above the shelf price that is still
+// accepted before an item is flagged (PRICE_CHECK_TOLERANCE, default 2)
+func priceCheckTolerance() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("PRICE_CHECK_TOLERANCE"), 64); err == nil && v >= 0 {
+		return v
+	}
+	return 2
+}
+
+// runPriceCheck looks up the shelf price of each line item and stores the
+// comparison. Items the price API does not know are counted as unknown.
+func runPriceCheck(client *PriceClient, receiptID, transactionID int64, data *GeminiParsedData) (*PriceCheckResult, error) {
+	result := &PriceCheckResult{Currency: data.Currency, Items: []PriceCheckItem{}}
+	merchant := data.MerchantClean
+	if merchant == "" {
+		merchant = data.MerchantRaw
+	}
+	tolerance := priceCheckTolerance()
+
+	// A receipt analyzed again replaces its earlier results
+	if _, err := db.Exec("DELETE FROM price_checks WHERE transaction_id = ?", transactionID); err != nil {
+		return result, fmt.Errorf("failed to clear price checks: %v", err)
+	}
+
+	items := data.Items
+	if len(items) > maxPriceCheckItems {
+		items = items[:maxPriceCheckItems]
+	}
+	for _, item := range items {
+		item.Name = strings.TrimSpace(item.Name)
+		if item.Name == "" || item.UnitPrice <= 0 {
+			continue
+		}
+		if item.Quantity <= 0 {
+			item.Quantity = 1
+		}
+
+		shelf, err := client.Lookup(item, merchant, data.Currency)
+		if err != nil {
+			return result, err
+		}
+		check := PriceCheckItem{
+			Name:         item.Name,
+			Barcode:      item.Barcode,
+			Quantity:     item.Quantity,
+			ChargedPrice: roundCents(item.UnitPrice),
+			ShelfPrice:   shelf,
+		}
+		if shelf == nil {
+			result.Unknown++
+		} else {
+			result.Checked++
+			if item.UnitPrice > *shelf*(1+tolerance/100) {
+				check.Flagged = true
+				check.Overcharge = roundCents((item.UnitPrice - *shelf) * item.Quantity)
+				result.Flagged++
+				result.Overcharge = roundCents(result.Overcharge + check.Overcharge)
+			}
+		}
+
+		if _, err := db.Exec(
+			`INSERT INTO price_checks (receipt_id, transaction_id, item_name, barcode, quantity, charged_price, shelf_price, currency, overcharge, flagged)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			receiptID, transactionID, check.Name, sql.NullString{String: check.Barcode, Valid: check.Barcode != ""}, check.Quantity,
+			check.ChargedPrice, check.ShelfPrice, data.Currency, check.Overcharge, check.Flagged,
+		); err != nil {
+			return result, fmt.Errorf("failed to save price check: %v", err)
+		}
+		result.Items = append(result.Items, check)
+	}
+	return result, nil
+}
+
+// registerPriceCheckRoutes adds the price check results of a transaction
+func registerPriceCheckRoutes(app *fiber.App) {
+	app.Get("/transactions/:id/price-checks", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT item_name, COALESCE(barcode, ''), quantity, charged_price, shelf_price, COALESCE(currency, ''), overcharge, flagged
+			FROM price_checks WHERE transaction_id = ? ORDER BY id`,
+			id,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load price checks: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		result := PriceCheckResult{Items: []PriceCheckItem{}}
+		for rows.Next() {
+			var it PriceCheckItem
+			var shelf sql.NullFloat64
+			if err := rows.Scan(&it.Name, &it.Barcode, &it.Quantity, &it.ChargedPrice, &shelf,
+				&result.Currency, &it.Overcharge, &it.Flagged); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read price checks: %v", err),
+				})
+			}
+			it.ShelfPrice = nullFloatPtr(shelf)
+			if !shelf.Valid {
+				result.Unknown++
+			} else {
+				result.Checked++
+			}
+			if it.Flagged {
+				result.Flagged++
+				result.Overcharge = roundCents(result.Overcharge + it.Overcharge)
+			}
+			result.Items = append(result.Items, it)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read price checks: %v", err),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"price_check": result,
+		})
+	})
+}
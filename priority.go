@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Receipt processing priorities, highest first
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorityOrder = []string{priorityHigh, priorityNormal, priorityLow}
+
+// parsePriority validates a priority, returning def when empty
+func parsePriority(s, def string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return def, nil
+	}
+	for _, p := range priorityOrder {
+		if s == p {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("priority must be one of %s", strings.Join(priorityOrder, ", "))
+}
+
+// PipelineScheduler limits how many receipts are processed at once. Free
+// slots go to waiting high priority receipts first, then normal, then low,
+// and each priority may only hold its share of the slots so a bulk
+// backfill cannot crowd out live captures.
+type PipelineScheduler struct {
+	mu      sync.Mutex
+	slots   int
+	shares  map[string]int
+	running map[string]int
+	waiting map[string][]chan struct{}
+}
+
+// QueueStats is a snapshot of the scheduler for one priority
+type QueueStats struct {
+	Priority string `json:"priority"`
+	Share    int    `json:"share"`
+	Running  int    `json:"running"`
+	Waiting  int    `json:"waiting"`
+}
+
+var pipelineScheduler = newPipelineScheduler()
+
+// newPipelineScheduler reads PIPELINE_CONCURRENCY (total slots, default 4)
+// and PIPELINE_SHARES ("high=4,normal=3,low=1", the most slots each
+// priority may hold; missing priorities may use every slot)
+func newPipelineScheduler() *PipelineScheduler {
+	s := &PipelineScheduler{
+		slots:   4,
+		shares:  map[string]int{priorityHigh: 4, priorityNormal: 3, priorityLow: 1},
+		running: make(map[string]int),
+		waiting: make(map[string][]chan struct{}),
+	}
+	if v := os.Getenv("PIPELINE_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			s.slots = n
+		} else {
+			log.Printf("Invalid PIPELINE_CONCURRENCY %q, using %d", v, s.slots)
+		}
+	}
+	if v := os.Getenv("PIPELINE_SHARES"); v != "" {
+		s.shares = make(map[string]int)
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			p, err := parsePriority(name, "")
+			n, nerr := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || p == "" || nerr != nil || n < 1 {
+				log.Printf("Ignoring invalid PIPELINE_SHARES entry %q", part)
+				continue
+			}
+			s.shares[p] = n
+		}
+	}
+	for _, p := range priorityOrder {
+		if share, ok := s.shares[p]; !ok || share > s.slots {
+			s.shares[p] = s.slots
+		}
+	}
+	return s
+}
+
+// Acquire waits for a processing slot for a receipt of the given priority.
+// The returned function frees the slot and must be called once processing
+// is done.
+func (s *PipelineScheduler) Acquire(ctx context.Context, priority string) (func(), error) {
+	ready := make(chan struct{})
+	s.mu.Lock()
+	s.waiting[priority] = append(s.waiting[priority], ready)
+	s.dispatch()
+	s.mu.Unlock()
+
+	release := func() {
+		s.mu.Lock()
+		s.running[priority]--
+		s.dispatch()
+		s.mu.Unlock()
+	}
+
+	select {
+	case <-ready:
+		return release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		queue := s.waiting[priority]
+		for i, ch := range queue {
+			if ch == ready {
+				s.waiting[priority] = append(queue[:i], queue[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// The slot was granted while the context was cancelled
+		s.running[priority]--
+		s.dispatch()
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch hands free slots to waiting receipts, highest priority first.
+// Callers must hold s.mu.
+func (s *PipelineScheduler) dispatch() {
+	total := 0
+	for _, n := range s.running {
+		total += n
+	}
+	for _, p := range priorityOrder {
+		for total < s.slots && s.running[p] < s.shares[p] && len(s.waiting[p]) > 0 {
+			close(s.waiting[p][0])
+			s.waiting[p] = s.waiting[p][1:]
+			s.running[p]++
+			total++
+		}
+	}
+}
+
+// Stats returns running and waiting counts per priority
+func (s *PipelineScheduler) Stats() []QueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]QueueStats, 0, len(priorityOrder))
+	for _, p := range priorityOrder {
+		stats = append(stats, QueueStats{
+			Priority: p,
+			Share:    s.shares[p],
+			Running:  s.running[p],
+			Waiting:  len(s.waiting[p]),
+		})
+	}
+	return stats
+}
+
+// registerQueueRoutes adds the processing queue endpoint
+func registerQueueRoutes(app *fiber.App) {
+	app.Get("/admin/queue", func(c *fiber.Ctx) error {
+		ingest, err := ingestQueue.Stats()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"slots":          pipelineScheduler.slots,
+			"priorities":     pipelineScheduler.Stats(),
+			"ingest_workers": ingestQueue.workers,
+			"ingest_jobs":    ingest,
+			"ocr":            ocrWorkers.Stats(),
+		})
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Profile field types
+const (
+	fieldString = "string"
+	fieldNumber = "number"
+	fieldDate   = "date"
+	fieldList   = "list"
+)
+
+// profileGeneric forces the generic receipt prompt and skips detection
+const profileGeneric = "generic"
+
+// ProfileField is a document-specific field extracted by a profile and
+// stored in transactions.extra_fields
+type ProfileField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// ExtractionProfile specializes extraction for a document type whose layout
+// the generic receipt prompt handles poorly
+type ExtractionProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Instructions are appended to the extraction prompt
+	Instructions string `json:"-"`
+	// Markers identify the document type in OCR text (case-insensitive);
+	// the profile is picked when at least MinMarkers of them occur
+	Markers    []string       `json:"markers"`
+	MinMarkers int            `json:"min_markers"`
+	Fields     []ProfileField `json:"fields"`
+	// ListElements describes the objects of list fields for the response
+	// schema; lists without an entry hold strings
+	ListElements map[string][]ProfileField `json:"-"`
+	// Tags are added to receipts extracted with the profile
+	Tags []string `json:"tags,omitempty"`
+}
+
+// extractionProfiles are checked in order during detection
+var extractionProfiles = []*ExtractionProfile{
+	{
+		Name:        "ecommerce",
+		Description: "Online order confirmations (Amazon, Shopify order emails and similar)",
+		Instructions: `This document is an online order confirmation. It may list several items, each with its own price and quantity,
+followed by a breakdown of subtotal, shipping, discounts and tax. Use the order total actually charged as "amount" and
+the item subtotal before shipping and tax as "subtotal". Use the order number as "reference_number". The order date
+is the transaction "date"; do not confuse it with the shipping or delivery date.`,
+		Markers: []string{
+			"order #", "order number", "order no", "order id", "order placed", "order confirmation",
+			"amazon", "shopify", "estimated delivery", "expected delivery", "arriving",
+			"shipping address", "ship to", "items ordered", "order summary", "shipping & handling",
+		},
+		MinMarkers: 2,
+		Fields: []ProfileField{
+			{"order_number", fieldString, "order number exactly as shown (e.g. 112-4567890-1234567 or #1042)"},
+			{"order_date", fieldDate, "date the order was placed (YYYY-MM-DD)"},
+			{"delivery_date", fieldDate, "estimated or actual delivery date (YYYY-MM-DD), latest date if a range is given"},
+			{"shipping", fieldNumber, "shipping and handling charged"},
+			{"tax", fieldNumber, "total tax charged"},
+			{"discount", fieldNumber, "total discounts and promotions applied, as a positive number"},
+			{"platform", fieldString, "shop platform if identifiable: amazon, shopify, ebay, etsy or other"},
+			{"items", fieldList, `purchased items as objects {"name": string, "quantity": number, "price": number} where price is the line total`},
+		},
+		ListElements: map[string][]ProfileField{
+			"items": {
+				{"name", fieldString, "item name"},
+				{"quantity", fieldNumber, "quantity ordered"},
+				{"price", fieldNumber, "line total"},
+			},
+		},
+	},
+	{
+		Name:        "utility",
+		Description: "Utility and telecom bills (electricity, gas, water, internet, mobile)",
+		Instructions: `This document is a utility or telecom bill. Use the total amount due for this billing period as "amount",
+excluding any balance carried over from earlier bills. The bill or statement date is the transaction "date"; do not
+confuse it with the billing period or the payment due date. Use the invoice or bill number as "reference_number".
+Report consumption exactly as printed, with the unit used on the bill.`,
+		Markers: []string{
+			"billing period", "service period", "statement period", "account number", "customer number",
+			"due date", "amount due", "meter reading", "meter number", "kwh", "usage", "tariff",
+			"data usage", "previous reading", "current reading",
+		},
+		MinMarkers: 3,
+		Fields: []ProfileField{
+			{"utility_type", fieldString, "one of: electricity, gas, water, internet, mobile, tv, other"},
+			{"account_number", fieldString, "customer or account number exactly as shown"},
+			{"billing_period_start", fieldDate, "first day of the billing period (YYYY-MM-DD)"},
+			{"billing_period_end", fieldDate, "last day of the billing period (YYYY-MM-DD)"},
+			{"due_date", fieldDate, "payment due date (YYYY-MM-DD)"},
+			{"usage", fieldList, `consumption for the period as objects {"quantity": number, "unit": string} (e.g. kWh, m3, GB, minutes)`},
+		},
+		ListElements: map[string][]ProfileField{
+			"usage": {
+				{"quantity", fieldNumber, "quantity consumed"},
+				{"unit", fieldString, "unit as printed, e.g. kWh, m3, GB, minutes"},
+			},
+		},
+	},
+	{
+		Name:        "donation",
+		Description: "Charity donation receipts and acknowledgment letters",
+		Instructions: `This document acknowledges a donation to a charity or non-profit organization. Use the organization's name
+as "merchant_clean" and "donation" as "category". Use the total value donated, cash and goods together, as "amount".
+The date of the donation is the transaction "date"; do not confuse it with the date the letter was issued. Use the
+receipt or acknowledgment number as "reference_number". Goods or services the donor received in return reduce the
+deductible amount, so report their value if the document states one.`,
+		Markers: []string{
+			"donation", "donor", "charity", "charitable", "non-profit", "nonprofit", "tax-exempt", "tax exempt",
+			"tax deductible", "tax-deductible", "501(c)(3)", "registered charity", "gift aid",
+			"thank you for your generous", "no goods or services", "in-kind",
+		},
+		MinMarkers: 2,
+		Fields: []ProfileField{
+			{"organization_name", fieldString, "full legal name of the receiving organization"},
+			{"tax_exempt_id", fieldString, "the organization's tax-exempt or charity registration number (e.g. EIN 12-3456789) exactly as shown"},
+			{"donation_amount", fieldNumber, "cash or monetary amount donated"},
+			{"in_kind", fieldList, `donated goods as objects {"description": string, "value": number} where value is the stated or estimated fair market value, null if not given`},
+			{"goods_services_value", fieldNumber, "value of goods or services received in return, 0 if the document says none were provided"},
+			{"acknowledgment_date", fieldDate, "date the acknowledgment was issued (YYYY-MM-DD)"},
+		},
+		ListElements: map[string][]ProfileField{
+			"in_kind": {
+				{"description", fieldString, "donated goods"},
+				{"value", fieldNumber, "stated or estimated fair market value"},
+			},
+		},
+		Tags: []string{"donation"},
+	},
+	{
+		Name:        "fuel",
+		Description: "Fuel station receipts",
+		Instructions: `This document is a fuel station receipt. Use "fuel" as "category" and the total paid as "amount". Shop items
+bought together with the fuel are part of the amount, but only the fuel itself goes into the fuel fields. Report the
+quantity and unit exactly as printed on the pump line.`,
+		Markers: []string{
+			"fuel", "petrol", "gasoline", "diesel", "unleaded", "super 95", "e10", "pump", "liters", "litres",
+			"gallons", "price/l", "/ltr", "octane",
+		},
+		MinMarkers: 2,
+		Fields: []ProfileField{
+			{"fuel_type", fieldString, "fuel grade as printed (e.g. diesel, unleaded 95, E10)"},
+			{"fuel_quantity", fieldNumber, "amount of fuel pumped"},
+			{"fuel_unit", fieldString, "unit of fuel_quantity: l, gal or imp gal"},
+			{"price_per_unit", fieldNumber, "fuel price per unit"},
+			{"pump_number", fieldString, "pump number if shown"},
+		},
+	},
+	{
+		Name:        "medical",
+		Description: "Medical bills, pharmacy receipts and insurance explanations of benefits",
+		Instructions: `This document is a medical bill, pharmacy receipt or explanation of benefits. Use the provider, practice or
+pharmacy name as "merchant_clean" and "medical" as "category". Use what the patient paid or owes as "amount", not the
+billed total when insurance paid part of it. The date of service is the transaction "date". Use the invoice, statement
+or claim number as "reference_number".`,
+		Markers: []string{
+			"patient", "provider", "diagnosis", "procedure", "cpt", "icd-10", "icd10", "copay", "co-pay", "coinsurance",
+			"deductible", "explanation of benefits", "insurance paid", "plan paid", "patient responsibility",
+			"pharmacy", "prescription", "clinic", "physician", "dental",
+		},
+		MinMarkers: 3,
+		Fields: []ProfileField{
+			{"provider_name", fieldString, "name of the treating provider, practice or pharmacy"},
+			{"provider_id", fieldString, "provider identifier such as NPI or tax ID exactly as shown"},
+			{"patient_name", fieldString, "name of the patient treated"},
+			{"service_codes", fieldList, `services as objects {"code": string, "system": string, "description": string, "amount": number} where system is CPT, HCPCS, ICD-10, NDC or similar, null if unknown`},
+			{"billed_amount", fieldNumber, "total charges billed before insurance"},
+			{"insurance_paid", fieldNumber, "amount paid or adjusted by insurance, 0 if none"},
+			{"out_of_pocket", fieldNumber, "amount the patient paid or owes (copay, coinsurance, deductible)"},
+			{"claim_number", fieldString, "insurance claim number if shown"},
+		},
+		ListElements: map[string][]ProfileField{
+			"service_codes": {
+				{"code", fieldString, "service or diagnosis code"},
+				{"system", fieldString, "CPT, HCPCS, ICD-10, NDC or similar"},
+				{"description", fieldString, "service description"},
+				{"amount", fieldNumber, "amount charged for the service"},
+			},
+		},
+		Tags: []string{"medical"},
+	},
+}
+
+// profileByName returns the named extraction profile or nil
+func profileByName(name string) *ExtractionProfile {
+	for _, p := range extractionProfiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// detectExtractionProfile picks the profile with the most marker matches in
+// the OCR text, or nil when no profile reaches its minimum
+func detectExtractionProfile(text string) *ExtractionProfile {
+	lower := strings.ToLower(text)
+	var best *ExtractionProfile
+	bestCount := 0
+	for _, p := range extractionProfiles {
+		count := 0
+		for _, m := range p.Markers {
+			if strings.Contains(lower, m) {
+				count++
+			}
+		}
+		if count >= p.MinMarkers && count > bestCount {
+			best, bestCount = p, count
+		}
+	}
+	return best
+}
+
+// profilePrompt extends an extraction prompt with the profile's instructions
+// and extra fields
+func profilePrompt(prompt string, p *ExtractionProfile) string {
+	if p == nil {
+		return prompt
+	}
+
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\n")
+	b.WriteString(p.Instructions)
+	b.WriteString("\n\nAlso include these additional fields in the same JSON object (null if not shown):\n")
+	for _, f := range p.Fields {
+		fmt.Fprintf(&b, "- %s: %s\n", f.Name, f.Description)
+	}
+	return b.String()
+}
+
+// extractProfileFields reads a profile's extra fields from a Gemini response.
+// Values that do not match the field type are dropped and reported.
+func extractProfileFields(p *ExtractionProfile, response string) (map[string]any, []FieldError) {
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(cleanGeminiJSON(response)), &raw); err != nil {
+		return nil, nil
+	}
+
+	extra := make(map[string]any)
+	var errs []FieldError
+	for _, f := range p.Fields {
+		v, ok := raw[f.Name]
+		if !ok || v == nil {
+			continue
+		}
+		switch f.Type {
+		case fieldString:
+			s, ok := v.(string)
+			if !ok {
+				errs = append(errs, FieldError{f.Name, "must be a string"})
+				continue
+			}
+			if s = strings.TrimSpace(s); s != "" {
+				extra[f.Name] = s
+			}
+		case fieldNumber:
+			n, ok := v.(float64)
+			if !ok || n < 0 {
+				errs = append(errs, FieldError{f.Name, "must be a non-negative number"})
+				continue
+			}
+			extra[f.Name] = n
+		case fieldDate:
+			s, ok := v.(string)
+			if _, err := time.Parse("2006-01-02", s); !ok || err != nil {
+				errs = append(errs, FieldError{f.Name, "must be a YYYY-MM-DD date"})
+				continue
+			}
+			extra[f.Name] = s
+		case fieldList:
+			list, ok := v.([]any)
+			if !ok {
+				errs = append(errs, FieldError{f.Name, "must be a list"})
+				continue
+			}
+			if len(list) > 0 {
+				extra[f.Name] = list
+			}
+		}
+	}
+	return extra, errs
+}
+
+// registerProfileRoutes adds the extraction profile listing endpoint
+func registerProfileRoutes(app *fiber.App) {
+	app.Get("/profiles", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"profiles": extractionProfiles,
+		})
+	})
+}
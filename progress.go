@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Pipeline stages with the overall progress percentage at which each starts
+const (
+	stageQueued        = "queued"
+	stageUpload        = "upload"
+	stagePreprocessing = "preprocessing"
+	stageOCR           = "ocr"
+	stageParsing       = "parsing"
+	stageEnrichment    = "enrichment"
+	stageDone          = "done"
+	stageFailed        = "failed"
+)
+
+var stageStartPercent = map[string]int{
+	stageQueued:        0,
+	stageUpload:        0,
+	stagePreprocessing: 10,
+	stageOCR:           20,
+	stageParsing:       60,
+	stageEnrichment:    85,
+	stageDone:          100,
+	stageFailed:        100,
+}
+
+// progressRetention is how long finished receipts stay visible in the tracker
+const progressRetention = 10 * time.Minute
+
+// ReceiptProgress is the processing progress of a single receipt
+type ReceiptProgress struct {
+	ReceiptID int64     `json:"receipt_id"`
+	Stage     string    `json:"stage"`
+	Percent   int       `json:"percent"`
+	Detail    string    `json:"detail,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the receipt has left the pipeline
+func (p ReceiptProgress) Finished() bool {
+	return p.Stage == stageDone || p.Stage == stageFailed
+}
+
+// ProgressTracker keeps in-memory progress for receipts being processed and
+// fans updates out to subscribers (SSE streams)
+type ProgressTracker struct {
+	mu          sync.Mutex
+	progress    map[int64]ReceiptProgress
+	subscribers map[int64]map[chan ReceiptProgress]struct{}
+}
+
+var progressTracker = &ProgressTracker{
+	progress:    make(map[int64]ReceiptProgress),
+	subscribers: make(map[int64]map[chan ReceiptProgress]struct{}),
+}
+
+// Update records the progress of a receipt within a stage. fraction is how
+// far the stage itself has got (0.0–1.0), e.g. OCR page 2 of 4 is 0.5.
+func (t *ProgressTracker) Update(receiptID int64, stage string, fraction float64, detail string) {
+	start := stageStartPercent[stage]
+	end := 100
+	for _, next := range []string{stagePreprocessing, stageOCR, stageParsing, stageEnrichment, stageDone} {
+		if s := stageStartPercent[next]; s > start {
+			end = s
+			break
+		}
+	}
+	if fraction < 0 {
+		fraction = 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	p := ReceiptProgress{
+		ReceiptID: receiptID,
+		Stage:     stage,
+		Percent:   start + int(float64(end-start)*fraction),
+		Detail:    detail,
+		UpdatedAt: time.Now(),
+	}
+
+	t.mu.Lock()
+	t.progress[receiptID] = p
+	for ch := range t.subscribers[receiptID] {
+		select {
+		case ch <- p:
+		default:
+			// Slow subscriber; it will pick up the latest state on the next update
+		}
+	}
+	t.mu.Unlock()
+
+	if p.Finished() {
+		time.AfterFunc(progressRetention, func() {
+			t.mu.Lock()
+			if current, ok := t.progress[receiptID]; ok && current.Finished() {
+				delete(t.progress, receiptID)
+			}
+			t.mu.Unlock()
+		})
+	}
+}
+
+// Get returns the current progress of a receipt
+func (t *ProgressTracker) Get(receiptID int64) (ReceiptProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.progress[receiptID]
+	return p, ok
+}
+
+// Active returns the receipts currently in the pipeline, oldest update first
+func (t *ProgressTracker) Active() []ReceiptProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := []ReceiptProgress{}
+	for _, p := range t.progress {
+		if !p.Finished() {
+			active = append(active, p)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].UpdatedAt.Before(active[j].UpdatedAt) })
+	return active
+}
+
+// Subscribe returns a channel receiving progress updates for a receipt and
+// a function to stop the subscription
+func (t *ProgressTracker) Subscribe(receiptID int64) (chan ReceiptProgress, func()) {
+	ch := make(chan ReceiptProgress, 16)
+
+	t.mu.Lock()
+	if t.subscribers[receiptID] == nil {
+		t.subscribers[receiptID] = make(map[chan ReceiptProgress]struct{})
+	}
+	t.subscribers[receiptID][ch] = struct{}{}
+	t.mu.Unlock()
+
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subscribers[receiptID], ch)
+		if len(t.subscribers[receiptID]) == 0 {
+			delete(t.subscribers, receiptID)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// receiptProgressFromDB builds a progress snapshot for receipts that are no
+// longer tracked in memory, based on their stored status
+func receiptProgressFromDB(receiptID int64) (*ReceiptProgress, string, error) {
+	var status string
+	var uploadedAt time.Time
+	err := db.QueryRow("SELECT status, uploaded_at FROM receipts WHERE id = ?", receiptID).Scan(&status, &uploadedAt)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	stage := stageDone
+	switch status {
+	case "error":
+		stage = stageFailed
+	case "pending":
+		stage = stageQueued
+	case "processing":
+		stage = stageUpload
+	}
+	return &ReceiptProgress{
+		ReceiptID: receiptID,
+		Stage:     stage,
+		Percent:   stageStartPercent[stage],
+		UpdatedAt: uploadedAt,
+	}, status, nil
+}
+
+// registerProgressRoutes adds the receipt status and progress event endpoints
+func registerProgressRoutes(app *fiber.App) {
+	app.Get("/receipts/:id/status", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+
+		stored, status, err := receiptProgressFromDB(int64(id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		if stored == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+
+		progress := *stored
+		if p, ok := progressTracker.Get(int64(id)); ok {
+			progress = p
+		}
+
+		// Uploads through /receipts/ingest report their job and, once
+		// finished, the OCR and Gemini output
+		job, err := latestIngestJob(int64(id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"status":   status,
+			"progress": progress,
+			"job":      job,
+		})
+	})
+
+	// Server-sent events stream of progress updates until the receipt finishes
+	app.Get("/receipts/:id/events", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		receiptID := int64(id)
+
+		stored, _, err := receiptProgressFromDB(receiptID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		if stored == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+
+		updates, unsubscribe := progressTracker.Subscribe(receiptID)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer unsubscribe()
+
+			current := *stored
+			if p, ok := progressTracker.Get(receiptID); ok {
+				current = p
+			}
+			if writeSSE(w, "progress", current) != nil || current.Finished() {
+				return
+			}
+
+			keepAlive := time.NewTicker(15 * time.Second)
+			defer keepAlive.Stop()
+			for {
+				select {
+				case p := <-updates:
+					if writeSSE(w, "progress", p) != nil || p.Finished() {
+						return
+					}
+				case <-keepAlive.C:
+					// Comment lines keep proxies from closing idle streams
+					if _, err := w.WriteString(": keep-alive\n\n"); err != nil {
+						return
+					}
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		})
+		return nil
+	})
+}
+
+// writeSSE writes one server-sent event with a JSON payload and flushes it
+func writeSSE(w *bufio.Writer, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
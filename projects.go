@@ -0,0 +1,606 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Budget alert kinds, each sent once until it stops applying
+const (
+	budgetAlertWarning  = "warning"
+	budgetAlertExceeded = "exceeded"
+	budgetAlertForecast = "forecast_overrun"
+)
+
+// budgetWarningRatio is the share of the budget spent that raises a warning
+const budgetWarningRatio = 0.8
+
+// Project groups transactions of a client job or trip. Amounts are in the
+// home currency.
+type Project struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	Client    string   `json:"client,omitempty"`
+	Budget    *float64 `json:"budget"`
+	StartDate *string  `json:"start_date"`
+	EndDate   *string  `json:"end_date"`
+	Billable  bool     `json:"billable"`
+	Spent     float64  `json:"spent"`
+	Count     int      `json:"transaction_count"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// BurnDownPoint is the budget left at the end of a day
+type BurnDownPoint struct {
+	Date       string   `json:"date"`
+	Spent      float64  `json:"spent"`
+	Cumulative float64  `json:"cumulative"`
+	Remaining  *float64 `json:"remaining"`
+	// Ideal is the budget left when spending evenly until the end date
+	Ideal *float64 `json:"ideal"`
+}
+
+// BudgetForecast extrapolates the average daily spend so far
+type BudgetForecast struct {
+	DailyRate      float64  `json:"daily_rate"`
+	ProjectedTotal *float64 `json:"projected_total"`
+	Overrun        *float64 `json:"overrun"`
+	// ExhaustedOn is the day the budget runs out at the current rate
+	ExhaustedOn *string `json:"exhausted_on"`
+}
+
+const projectColumns = `p.id, p.name, COALESCE(p.client, ''), p.budget, p.start_date, p.end_date, p.billable, p.created_at,
+	COALESCE((SELECT SUM(t.home_amount) FROM transactions t WHERE t.project_id = p.id), 0),
+	(SELECT COUNT(*) FROM transactions t WHERE t.project_id = p.id)`
+
+// scanProject reads a row selected with projectColumns
+func scanProject(row interface{ Scan(...any) error }) (*Project, error) {
+	var p Project
+	var budget sql.NullFloat64
+	var start, end sql.NullTime
+	var createdAt time.Time
+	if err := row.Scan(&p.ID, &p.Name, &p.Client, &budget, &start, &end, &p.Billable, &createdAt, &p.Spent, &p.Count); err != nil {
+		return nil, err
+	}
+	if budget.Valid {
+		p.Budget = &budget.Float64
+	}
+	p.StartDate = formatNullDate(start)
+	p.EndDate = formatNullDate(end)
+	p.Spent = roundCents(p.Spent)
+	p.CreatedAt = createdAt.Format(time.RFC3339)
+	return &p, nil
+}
+
+// loadProject returns a project with its spend, or sql.ErrNoRows
+func loadProject(id int64) (*Project, error) {
+	return scanProject(db.QueryRow("SELECT "+projectColumns+" FROM projects p WHERE p.id = ?", id))
+}
+
+// projectBurnDown builds daily burn-down points from the project start (or
+// first transaction) to its end date (or today, whichever is earlier) and
+// forecasts the total at the end date
+func projectBurnDown(p *Project, today time.Time) ([]BurnDownPoint, *BudgetForecast, error) {
+	rows, err := db.Query(
+		`SELECT date, SUM(home_amount) FROM transactions
+		WHERE project_id = ? AND date IS NOT NULL AND home_amount IS NOT NULL
+		GROUP BY date ORDER BY date`,
+		p.ID,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load project spend: %v", err)
+	}
+	defer rows.Close()
+
+	daily := make(map[string]float64)
+	var first time.Time
+	for rows.Next() {
+		var day time.Time
+		var amount float64
+		if err := rows.Scan(&day, &amount); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan project spend: %v", err)
+		}
+		if first.IsZero() {
+			first = day
+		}
+		daily[day.Format("2006-01-02")] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	start := first
+	if p.StartDate != nil {
+		start, _ = time.Parse("2006-01-02", *p.StartDate)
+	}
+	if start.IsZero() {
+		return []BurnDownPoint{}, &BudgetForecast{}, nil
+	}
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	last := today
+	var end time.Time
+	if p.EndDate != nil {
+		end, _ = time.Parse("2006-01-02", *p.EndDate)
+		if end.Before(last) {
+			last = end
+		}
+	}
+
+	totalDays := 0.0
+	if !end.IsZero() {
+		totalDays = end.Sub(start).Hours()/24 + 1
+	}
+
+	points := []BurnDownPoint{}
+	cumulative := 0.0
+	for day := start; !day.After(last); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		cumulative += daily[key]
+		point := BurnDownPoint{Date: key, Spent: roundCents(daily[key]), Cumulative: roundCents(cumulative)}
+		if p.Budget != nil {
+			remaining := roundCents(*p.Budget - cumulative)
+			point.Remaining = &remaining
+			if totalDays > 0 {
+				elapsed := day.Sub(start).Hours()/24 + 1
+				ideal := roundCents(*p.Budget * math.Max(0, 1-elapsed/totalDays))
+				point.Ideal = &ideal
+			}
+		}
+		points = append(points, point)
+	}
+
+	forecast := &BudgetForecast{}
+	if len(points) > 0 {
+		forecast.DailyRate = roundCents(cumulative / float64(len(points)))
+	}
+	if !end.IsZero() {
+		daysLeft := math.Max(0, end.Sub(last).Hours()/24)
+		projected := roundCents(cumulative + forecast.DailyRate*daysLeft)
+		forecast.ProjectedTotal = &projected
+		if p.Budget != nil && projected > *p.Budget {
+			overrun := roundCents(projected - *p.Budget)
+			forecast.Overrun = &overrun
+		}
+	}
+	if p.Budget != nil && forecast.DailyRate > 0 && cumulative < *p.Budget {
+		daysLeft := math.Ceil((*p.Budget - cumulative) / forecast.DailyRate)
+		exhausted := last.AddDate(0, 0, int(daysLeft)).Format("2006-01-02")
+		forecast.ExhaustedOn = &exhausted
+	}
+	return points, forecast, nil
+}
+
+// activeBudgetAlerts returns the alert kinds that currently apply
+func activeBudgetAlerts(p *Project, forecast *BudgetForecast) []string {
+	if p.Budget == nil || *p.Budget <= 0 {
+		return nil
+	}
+	var kinds []string
+	switch {
+	case p.Spent > *p.Budget:
+		kinds = append(kinds, budgetAlertExceeded)
+	case p.Spent >= *p.Budget*budgetWarningRatio:
+		kinds = append(kinds, budgetAlertWarning)
+	}
+	if forecast != nil && forecast.Overrun != nil && p.Spent <= *p.Budget {
+		kinds = append(kinds, budgetAlertForecast)
+	}
+	return kinds
+}
+
+// checkProjectBudget sends a budget.exceeded webhook for each alert that
+// newly applies to a project and forgets alerts that no longer apply, so
+// they fire again if the project crosses the line again
+func checkProjectBudget(projectID int64) ([]string, error) {
+	p, err := loadProject(projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load project %d: %v", projectID, err)
+	}
+	_, forecast, err := projectBurnDown(p, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	active := activeBudgetAlerts(p, forecast)
+
+	sent := make(map[string]bool)
+	rows, err := db.Query("SELECT kind FROM project_budget_alerts WHERE project_id = ?", projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load budget alerts: %v", err)
+	}
+	for rows.Next() {
+		var kind string
+		if err := rows.Scan(&kind); err == nil {
+			sent[kind] = true
+		}
+	}
+	rows.Close()
+
+	for _, kind := range active {
+		if sent[kind] {
+			delete(sent, kind)
+			continue
+		}
+		if _, err := db.Exec("INSERT IGNORE INTO project_budget_alerts (project_id, kind) VALUES (?, ?)", projectID, kind); err != nil {
+			return nil, fmt.Errorf("failed to record budget alert: %v", err)
+		}
+		log.Printf("Project %d (%s): budget alert %s, spent %.2f of %.2f", p.ID, p.Name, kind, p.Spent, *p.Budget)
+		payload := fiber.Map{
+			"project_id": p.ID,
+			"project":    p.Name,
+			"client":     p.Client,
+			"alert":      kind,
+			"budget":     *p.Budget,
+			"spent":      p.Spent,
+			"currency":   homeCurrency(),
+			"forecast":   forecast,
+		}
+		go func() {
+			if err := sendWebhook(eventBudgetExceeded, payload); err != nil {
+				log.Printf("Failed to send %s webhook for project %d: %v", eventBudgetExceeded, projectID, err)
+			}
+		}()
+	}
+	for kind := range sent {
+		db.Exec("DELETE FROM project_budget_alerts WHERE project_id = ? AND kind = ?", projectID, kind)
+	}
+	return active, nil
+}
+
+// registerProjectRoutes adds project management, transaction assignment
+// and the budget report
+func registerProjectRoutes(app *fiber.App) {
+	app.Get("/projects", func(c *fiber.Ctx) error {
+		rows, err := db.Query("SELECT " + projectColumns + " FROM projects p ORDER BY p.created_at DESC")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load projects: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		projects := []*Project{}
+		for rows.Next() {
+			p, err := scanProject(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read projects: %v", err),
+				})
+			}
+			projects = append(projects, p)
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"currency": homeCurrency(),
+			"projects": projects,
+		})
+	})
+
+	app.Post("/projects", func(c *fiber.Ctx) error {
+		var req struct {
+			Name      string   `json:"name"`
+			Client    string   `json:"client"`
+			Budget    *float64 `json:"budget"`
+			StartDate *string  `json:"start_date"`
+			EndDate   *string  `json:"end_date"`
+			Billable  *bool    `json:"billable"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Name must be 1-100 characters",
+			})
+		}
+		if req.Budget != nil && *req.Budget < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "budget cannot be negative",
+			})
+		}
+		start, err := parseOptionalDate(req.StartDate)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		end, err := parseOptionalDate(req.EndDate)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if start.Valid && end.Valid && end.Time.Before(start.Time) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "end_date is before start_date",
+			})
+		}
+		billable := req.Billable == nil || *req.Billable
+
+		result, err := db.Exec(
+			"INSERT INTO projects (name, client, budget, start_date, end_date, billable) VALUES (?, ?, ?, ?, ?, ?)",
+			req.Name, sql.NullString{String: req.Client, Valid: req.Client != ""}, req.Budget, start, end, billable,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save project: %v", err),
+			})
+		}
+		id, _ := result.LastInsertId()
+		p, err := loadProject(id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project: %v", err),
+			})
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"project": p,
+		})
+	})
+
+	// Change project fields; a null budget or date removes it
+	app.Patch("/projects/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid project ID",
+			})
+		}
+		var req map[string]any
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		var sets []string
+		var args []any
+		for field, value := range req {
+			switch field {
+			case "name", "client":
+				s, _ := value.(string)
+				s = strings.TrimSpace(s)
+				if field == "name" && (s == "" || len(s) > 100) {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": "Name must be 1-100 characters",
+					})
+				}
+				sets, args = append(sets, field+" = ?"), append(args, sql.NullString{String: s, Valid: s != ""})
+			case "budget":
+				budget, ok := value.(float64)
+				if value != nil && (!ok || budget < 0) {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": "budget must be a non-negative number or null",
+					})
+				}
+				sets, args = append(sets, "budget = ?"), append(args, value)
+			case "start_date", "end_date":
+				s, _ := value.(string)
+				date, err := parseOptionalDate(&s)
+				if err != nil {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": err.Error(),
+					})
+				}
+				sets, args = append(sets, field+" = ?"), append(args, date)
+			case "billable":
+				b, ok := value.(bool)
+				if !ok {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": "billable must be true or false",
+					})
+				}
+				sets, args = append(sets, "billable = ?"), append(args, b)
+			default:
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": fmt.Sprintf("Unknown field %q", field),
+				})
+			}
+		}
+		if len(sets) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing to update",
+			})
+		}
+
+		if _, err := db.Exec("UPDATE projects SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update project: %v", err),
+			})
+		}
+		p, err := loadProject(int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Project not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project: %v", err),
+			})
+		}
+		if _, err := checkProjectBudget(p.ID); err != nil {
+			log.Printf("%v", err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"project": p,
+		})
+	})
+
+	// Assign transactions to a project. add and remove take transaction
+	// IDs; assign_date_range adds every unassigned transaction dated within
+	// the project's start and end dates (e.g. a trip).
+	app.Post("/projects/:id/transactions", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid project ID",
+			})
+		}
+		var req struct {
+			Add             []int64 `json:"add"`
+			Remove          []int64 `json:"remove"`
+			AssignDateRange bool    `json:"assign_date_range"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		p, err := loadProject(int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Project not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project: %v", err),
+			})
+		}
+		if req.AssignDateRange && (p.StartDate == nil || p.EndDate == nil) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "assign_date_range needs a project start_date and end_date",
+			})
+		}
+
+		var added, removed int64
+		for _, tid := range req.Add {
+			result, err := db.Exec("UPDATE transactions SET project_id = ? WHERE id = ?", p.ID, tid)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to assign transaction %d: %v", tid, err),
+				})
+			}
+			n, _ := result.RowsAffected()
+			added += n
+		}
+		if req.AssignDateRange {
+			result, err := db.Exec(
+				"UPDATE transactions SET project_id = ? WHERE project_id IS NULL AND date BETWEEN ? AND ?",
+				p.ID, *p.StartDate, *p.EndDate,
+			)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to assign transactions: %v", err),
+				})
+			}
+			n, _ := result.RowsAffected()
+			added += n
+		}
+		for _, tid := range req.Remove {
+			result, err := db.Exec("UPDATE transactions SET project_id = NULL WHERE id = ? AND project_id = ?", tid, p.ID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to unassign transaction %d: %v", tid, err),
+				})
+			}
+			n, _ := result.RowsAffected()
+			removed += n
+		}
+
+		alerts, err := checkProjectBudget(p.ID)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"added":   added,
+			"removed": removed,
+			"alerts":  alerts,
+		})
+	})
+
+	// Budget report: spend by category, daily burn-down, forecast and the
+	// alerts that currently apply
+	app.Get("/projects/:id/report", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid project ID",
+			})
+		}
+		p, err := loadProject(int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Project not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project: %v", err),
+			})
+		}
+
+		burnDown, forecast, err := projectBurnDown(p, time.Now())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT COALESCE(category, 'uncategorized'), SUM(home_amount), COUNT(*)
+			FROM transactions WHERE project_id = ?
+			GROUP BY COALESCE(category, 'uncategorized')
+			ORDER BY SUM(home_amount) DESC`,
+			p.ID,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load project categories: %v", err),
+			})
+		}
+		defer rows.Close()
+		categories := []fiber.Map{}
+		for rows.Next() {
+			var category string
+			var total sql.NullFloat64
+			var count int
+			if err := rows.Scan(&category, &total, &count); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read project categories: %v", err),
+				})
+			}
+			categories = append(categories, fiber.Map{
+				"category": category,
+				"total":    roundCents(total.Float64),
+				"count":    count,
+			})
+		}
+
+		var pendingConversion int
+		db.QueryRow(
+			"SELECT COUNT(*) FROM transactions WHERE project_id = ? AND home_amount IS NULL", p.ID,
+		).Scan(&pendingConversion)
+
+		response := fiber.Map{
+			"success":            true,
+			"project":            p,
+			"currency":           homeCurrency(),
+			"categories":         categories,
+			"burn_down":          burnDown,
+			"forecast":           forecast,
+			"alerts":             activeBudgetAlerts(p, forecast),
+			"pending_conversion": pendingConversion,
+		}
+		if p.Budget != nil {
+			response["remaining"] = roundCents(*p.Budget - p.Spent)
+			if *p.Budget > 0 {
+				response["used_percent"] = roundTenth(p.Spent / *p.Budget * 100)
+			}
+		}
+		return c.JSON(response)
+	})
+}
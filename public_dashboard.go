@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// publicDashboardPath is served without credentials when PUBLIC_DASHBOARD
+// is enabled
+const publicDashboardPath = "/public/dashboard"
+
+// publicDashboardCategories is how many categories the dashboard lists
+// before the rest is summed up as other
+const publicDashboardCategories = 8
+
+// publicDashboardMonths is how many months the spend history covers
+const publicDashboardMonths = 12
+
+// DashboardSpend is the spend of a month or category
+type DashboardSpend struct {
+	Key   string  `json:"key"`
+	Spend float64 `json:"spend"`
+}
+
+// PublicDashboard is the aggregate spending shown on a shared display. It
+// never includes merchants, items or single transactions.
+type PublicDashboard struct {
+	Currency string  `json:"currency"`
+	Month    string  `json:"month"`
+	Spend    float64 `json:"spend"`
+	// PreviousMonthToDate is the spend of last month up to the same day,
+	// for comparison
+	PreviousMonthToDate float64          `json:"previous_month_to_date"`
+	Categories          []DashboardSpend `json:"categories"`
+	// Months is the spend per month, oldest first, ending with this month
+	Months      []DashboardSpend `json:"months"`
+	GeneratedAt string           `json:"generated_at"`
+}
+
+// publicDashboardEnabled reads PUBLIC_DASHBOARD
+func publicDashboardEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("PUBLIC_DASHBOARD"))
+	return enabled
+}
+
+// sumSpend returns the spend of the transactions dated in [from, to)
+func sumSpend(from, to time.Time) (float64, error) {
+	groups, err := summaryGroup(transactionsAllView, "'total'", "date >= ? AND date < ?", []any{from, to}, "k", 0)
+	if err != nil || len(groups) == 0 {
+		return 0, err
+	}
+	return roundCents(groups[0].Spend), nil
+}
+
+// loadPublicDashboard sums the spend of the current month, per category and
+// for the months before
+func loadPublicDashboard(now time.Time) (*PublicDashboard, error) {
+	month := monthStart(now)
+	next := month.AddDate(0, 1, 0)
+	d := &PublicDashboard{
+		Currency:    homeCurrency(),
+		Month:       month.Format("2006-01"),
+		Categories:  []DashboardSpend{},
+		Months:      []DashboardSpend{},
+		GeneratedAt: now.Format(time.RFC3339),
+	}
+
+	var err error
+	if d.Spend, err = sumSpend(month, next); err != nil {
+		return nil, fmt.Errorf("failed to sum this month's spend: %v", err)
+	}
+	previous := month.AddDate(0, -1, 0)
+	previousToDate := previous.AddDate(0, 0, now.Day())
+	if previousToDate.After(month) {
+		previousToDate = month
+	}
+	if d.PreviousMonthToDate, err = sumSpend(previous, previousToDate); err != nil {
+		return nil, fmt.Errorf("failed to sum last month's spend: %v", err)
+	}
+
+	categories, err := summaryGroup(transactionsAllView, "COALESCE(LOWER(category), 'uncategorized')",
+		"date >= ? AND date < ?", []any{month, next}, "SUM(home_amount) DESC, k", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum spend per category: %v", err)
+	}
+	other := 0.0
+	for i, g := range categories {
+		if i < publicDashboardCategories {
+			d.Categories = append(d.Categories, DashboardSpend{Key: g.Key, Spend: roundCents(g.Spend)})
+		} else {
+			other += g.Spend
+		}
+	}
+	if other != 0 {
+		d.Categories = append(d.Categories, DashboardSpend{Key: "other", Spend: roundCents(other)})
+	}
+
+	first := month.AddDate(0, 1-publicDashboardMonths, 0)
+	months, err := summaryGroup(transactionsAllView, "DATE_FORMAT(date, '%Y-%m')",
+		"date >= ? AND date < ?", []any{first, next}, "k", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum spend per month: %v", err)
+	}
+	spend := map[string]float64{}
+	for _, g := range months {
+		spend[g.Key] = g.Spend
+	}
+	// Months without transactions are listed with zero spend
+	for m := first; m.Before(next); m = m.AddDate(0, 1, 0) {
+		key := m.Format("2006-01")
+		d.Months = append(d.Months, DashboardSpend{Key: key, Spend: roundCents(spend[key])})
+	}
+	return d, nil
+}
+
+// registerPublicDashboardRoutes adds the public dashboard
+func registerPublicDashboardRoutes(app *fiber.App) {
+	// Monthly spend in the home currency for a shared display, without
+	// credentials. Only served when PUBLIC_DASHBOARD is enabled; with
+	// PUBLIC_DASHBOARD_KEY set, key= must match it.
+	app.Get(publicDashboardPath, func(c *fiber.Ctx) error {
+		if !publicDashboardEnabled() {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "The public dashboard is not enabled",
+			})
+		}
+		if key := os.Getenv("PUBLIC_DASHBOARD_KEY"); key != "" &&
+			subtle.ConstantTimeCompare([]byte(c.Query("key")), []byte(key)) != 1 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid dashboard key",
+			})
+		}
+
+		d, err := loadPublicDashboard(time.Now())
+		if err != nil {
+			// Details stay in the log on a public endpoint
+			log.Printf("Public dashboard: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to load the dashboard",
+			})
+		}
+		c.Set("Cache-Control", "public, max-age=60")
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"dashboard": d,
+		})
+	})
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Quality report parameters
+const (
+	// qualitySampleSize is the longest side images are sampled down to
+	// before measuring, so large photos are measured quickly
+	qualitySampleSize = 1000
+	// qualityReportLimit caps how many recent receipts the report reads
+	qualityReportLimit = 5000
+	// qualityTipMinReceipts is how many receipts a bucket needs before a tip
+	// is derived from it
+	qualityTipMinReceipts = 5
+	// qualityTipGap is how far (0-1) a bucket's parse success rate must be
+	// below the overall rate to produce a tip
+	qualityTipGap = 0.15
+)
+
+// ReceiptQuality are the capture and OCR quality metrics of a receipt
+type ReceiptQuality struct {
+	// Width and Height are the photo's pixel size; image metrics are not
+	// measured for PDFs
+	Width  *int `json:"width"`
+	Height *int `json:"height"`
+	// BlurScore is the variance of the Laplacian of the grayscale photo;
+	// lower is blurrier
+	BlurScore *float64 `json:"blur_score"`
+	// Brightness is the mean gray level (0-255)
+	Brightness *float64 `json:"brightness"`
+	// Contrast is the standard deviation of the gray levels
+	Contrast *float64 `json:"contrast"`
+	// OCRConfidence is Tesseract's mean word confidence (0-100), only
+	// available with local tesseract
+	OCRConfidence *float64 `json:"ocr_confidence"`
+	OCRWords      *int     `json:"ocr_words"`
+	Rotation      int      `json:"rotation"`
+	// Preprocessing lists the image stages applied before OCR
+	Preprocessing    []string `json:"preprocessing"`
+	ProcessingMethod string   `json:"processing_method"`
+	MeasuredAt       string   `json:"measured_at,omitempty"`
+}
+
+// measureImageQuality computes the size, sharpness, brightness and contrast
+// of a photo
+func measureImageQuality(path string, q *ReceiptQuality) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	q.Width, q.Height = &width, &height
+
+	// Sample every step-th pixel so the longest side is at most
+	// qualitySampleSize
+	step := (max(width, height) + qualitySampleSize - 1) / qualitySampleSize
+	if step < 1 {
+		step = 1
+	}
+	w, h := width/step, height/step
+	if w < 3 || h < 3 {
+		return nil
+	}
+	gray := make([]float64, w*h)
+	var sum, sumSq float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			g := color.GrayModel.Convert(src.At(bounds.Min.X+x*step, bounds.Min.Y+y*step)).(color.Gray)
+			v := float64(g.Y)
+			gray[y*w+x] = v
+			sum += v
+			sumSq += v * v
+		}
+	}
+	n := float64(w * h)
+	brightness := sum / n
+	contrast := math.Sqrt(math.Max(sumSq/n-brightness*brightness, 0))
+
+	// Variance of the 4-neighbour Laplacian: sharp edges give high values
+	var lapSum, lapSumSq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			lap := gray[i-w] + gray[i+w] + gray[i-1] + gray[i+1] - 4*gray[i]
+			lapSum += lap
+			lapSumSq += lap * lap
+		}
+	}
+	m := float64((w - 2) * (h - 2))
+	mean := lapSum / m
+	blur := lapSumSq/m - mean*mean
+
+	q.Brightness = floatPtr(roundTo(brightness, 2))
+	q.Contrast = floatPtr(roundTo(contrast, 2))
+	q.BlurScore = floatPtr(roundTo(blur, 2))
+	return nil
+}
+
+// ocrImageQuality runs OCR on a photo and stores the confidence in the
+// quality metrics; it returns the text and the hOCR layout
+func ocrImageQuality(path, dir string, opts OCROptions, q *ReceiptQuality) (string, string, error) {
+	text, confidence, hocr, err := ocrImage(path, dir, opts)
+	if confidence != nil {
+		words := confidence.Words
+		q.OCRConfidence = floatPtr(roundTo(confidence.Mean, 2))
+		q.OCRWords = &words
+	}
+	return text, hocr, err
+}
+
+// floatPtr returns a pointer to v
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// saveReceiptQuality stores a receipt's quality metrics, replacing those of
+// an earlier run
+func saveReceiptQuality(receiptID int64, q *ReceiptQuality) error {
+	preprocessing, err := json.Marshal(q.Preprocessing)
+	if err != nil {
+		return err
+	}
+	var confidence sql.NullFloat64
+	if q.OCRConfidence != nil {
+		confidence = sql.NullFloat64{Float64: *q.OCRConfidence, Valid: true}
+	}
+	_, err = execWithRetry(
+		`INSERT INTO receipt_quality (receipt_id, width, height, blur_score, brightness, contrast, ocr_confidence, ocr_words,
+			rotation, preprocessing, processing_method)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE width = VALUES(width), height = VALUES(height), blur_score = VALUES(blur_score),
+			brightness = VALUES(brightness), contrast = VALUES(contrast), ocr_confidence = VALUES(ocr_confidence),
+			ocr_words = VALUES(ocr_words), rotation = VALUES(rotation), preprocessing = VALUES(preprocessing),
+			processing_method = VALUES(processing_method), measured_at = CURRENT_TIMESTAMP`,
+		receiptID, q.Width, q.Height, q.BlurScore, q.Brightness, q.Contrast, confidence, q.OCRWords,
+		q.Rotation, preprocessing, q.ProcessingMethod,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save quality of receipt %d: %v", receiptID, err)
+	}
+	return nil
+}
+
+// qualityMetric buckets one metric for the quality report
+type qualityMetric struct {
+	name string
+	// bounds are the exclusive upper bounds of all but the last bucket
+	bounds []float64
+	labels []string
+	// tips are shown for labels whose receipts parse notably worse
+	tips  map[string]string
+	value func(q *ReceiptQuality) *float64
+}
+
+// qualityMetrics are the metrics the report correlates with parse success
+var qualityMetrics = []qualityMetric{
+	{
+		name:   "blur_score",
+		bounds: []float64{60, 150, 400},
+		labels: []string{"very_blurry", "blurry", "acceptable", "sharp"},
+		tips: map[string]string{
+			"very_blurry": "Blurry photos parse poorly: hold the phone steady and tap the receipt to focus before taking the picture.",
+			"blurry":      "Slightly blurry photos parse worse: rest your elbows on the table or use the camera's document mode.",
+		},
+		value: func(q *ReceiptQuality) *float64 { return q.BlurScore },
+	},
+	{
+		name:   "brightness",
+		bounds: []float64{70, 190},
+		labels: []string{"dark", "normal", "overexposed"},
+		tips: map[string]string{
+			"dark":        "Dark photos parse poorly: photograph receipts in good light or turn on the flash.",
+			"overexposed": "Overexposed photos lose faint print: avoid direct sunlight and flash glare on glossy paper.",
+		},
+		value: func(q *ReceiptQuality) *float64 { return q.Brightness },
+	},
+	{
+		name:   "contrast",
+		bounds: []float64{30, 60},
+		labels: []string{"low", "medium", "high"},
+		tips: map[string]string{
+			"low": "Low-contrast photos parse poorly: put the receipt on a dark, plain background and enable preprocessing.",
+		},
+		value: func(q *ReceiptQuality) *float64 { return q.Contrast },
+	},
+	{
+		name:   "resolution",
+		bounds: []float64{600, 1200},
+		labels: []string{"low", "medium", "high"},
+		tips: map[string]string{
+			"low": "Low-resolution photos parse poorly: move closer so the receipt fills the frame, or take one photo per half of long receipts.",
+		},
+		value: func(q *ReceiptQuality) *float64 {
+			if q.Width == nil || q.Height == nil {
+				return nil
+			}
+			// The short side limits how small the print may be
+			return floatPtr(float64(min(*q.Width, *q.Height)))
+		},
+	},
+	{
+		name:   "ocr_confidence",
+		bounds: []float64{60, 75, 85},
+		labels: []string{"poor", "fair", "good", "excellent"},
+		value:  func(q *ReceiptQuality) *float64 { return q.OCRConfidence },
+	},
+}
+
+// QualityBucket is one range of a metric in the quality report
+type QualityBucket struct {
+	Bucket           string   `json:"bucket"`
+	Receipts         int      `json:"receipts"`
+	Parsed           int      `json:"parsed"`
+	SuccessRate      float64  `json:"success_rate"`
+	AvgOCRConfidence *float64 `json:"avg_ocr_confidence"`
+
+	confSum   float64
+	confCount int
+}
+
+// add counts a receipt in the bucket
+func (b *QualityBucket) add(q *ReceiptQuality, parsed bool) {
+	b.Receipts++
+	if parsed {
+		b.Parsed++
+	}
+	if q.OCRConfidence != nil {
+		b.confSum += *q.OCRConfidence
+		b.confCount++
+	}
+}
+
+// finish computes the rates of the bucket
+func (b *QualityBucket) finish() {
+	if b.Receipts > 0 {
+		b.SuccessRate = roundTo(float64(b.Parsed)/float64(b.Receipts), 4)
+	}
+	if b.confCount > 0 {
+		b.AvgOCRConfidence = floatPtr(roundTo(b.confSum/float64(b.confCount), 2))
+	}
+}
+
+// QualityReport correlates capture quality with parse success
+type QualityReport struct {
+	Receipts    int                        `json:"receipts"`
+	Parsed      int                        `json:"parsed"`
+	SuccessRate float64                    `json:"success_rate"`
+	Metrics     map[string][]QualityBucket `json:"metrics"`
+	// Preprocessing groups receipts by the image stages applied
+	Preprocessing []QualityBucket `json:"preprocessing"`
+	Tips          []string        `json:"tips"`
+}
+
+// buildQualityReport reads the quality metrics of recent receipts uploaded
+// in [from, to). A receipt counts as parsed when it was processed cleanly
+// without Gemini repair prompts.
+func buildQualityReport(from, to *time.Time) (*QualityReport, error) {
+	conds := []string{"r.status NOT IN ('pending', 'processing')"}
+	var args []any
+	if from != nil {
+		conds = append(conds, "r.uploaded_at >= ?")
+		args = append(args, *from)
+	}
+	if to != nil {
+		conds = append(conds, "r.uploaded_at < ?")
+		args = append(args, *to)
+	}
+	rows, err := db.Query(
+		`SELECT q.width, q.height, q.blur_score, q.brightness, q.contrast, q.ocr_confidence, q.preprocessing,
+			r.status = 'processed' AND NOT EXISTS (SELECT 1 FROM parse_repairs p WHERE p.receipt_id = r.id)
+		FROM receipt_quality q
+		JOIN receipts r ON r.id = q.receipt_id
+		WHERE `+strings.Join(conds, " AND ")+`
+		ORDER BY q.receipt_id DESC
+		LIMIT ?`,
+		append(args, qualityReportLimit)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt quality: %v", err)
+	}
+	defer rows.Close()
+
+	report := &QualityReport{Metrics: map[string][]QualityBucket{}, Preprocessing: []QualityBucket{}, Tips: []string{}}
+	buckets := make(map[string][]QualityBucket)
+	for _, m := range qualityMetrics {
+		list := make([]QualityBucket, len(m.labels))
+		for i, label := range m.labels {
+			list[i].Bucket = label
+		}
+		buckets[m.name] = list
+	}
+	byStages := map[string]*QualityBucket{}
+	for rows.Next() {
+		var q ReceiptQuality
+		var width, height sql.NullInt64
+		var blur, brightness, contrast, confidence sql.NullFloat64
+		var preprocessing []byte
+		var parsed bool
+		if err := rows.Scan(&width, &height, &blur, &brightness, &contrast, &confidence, &preprocessing, &parsed); err != nil {
+			return nil, fmt.Errorf("failed to scan receipt quality: %v", err)
+		}
+		if width.Valid && height.Valid {
+			w, h := int(width.Int64), int(height.Int64)
+			q.Width, q.Height = &w, &h
+		}
+		q.BlurScore = nullFloatPtr(blur)
+		q.Brightness = nullFloatPtr(brightness)
+		q.Contrast = nullFloatPtr(contrast)
+		q.OCRConfidence = nullFloatPtr(confidence)
+		json.Unmarshal(preprocessing, &q.Preprocessing)
+
+		report.Receipts++
+		if parsed {
+			report.Parsed++
+		}
+		for _, m := range qualityMetrics {
+			v := m.value(&q)
+			if v == nil {
+				continue
+			}
+			i := sort.SearchFloat64s(m.bounds, *v)
+			if i < len(m.bounds) && m.bounds[i] == *v {
+				i++
+			}
+			buckets[m.name][i].add(&q, parsed)
+		}
+		stages := "none"
+		if len(q.Preprocessing) > 0 {
+			stages = strings.Join(q.Preprocessing, "+")
+		}
+		if byStages[stages] == nil {
+			byStages[stages] = &QualityBucket{Bucket: stages}
+		}
+		byStages[stages].add(&q, parsed)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if report.Receipts > 0 {
+		report.SuccessRate = roundTo(float64(report.Parsed)/float64(report.Receipts), 4)
+	}
+
+	for _, m := range qualityMetrics {
+		list := buckets[m.name]
+		for i := range list {
+			list[i].finish()
+			b := list[i]
+			if tip, ok := m.tips[b.Bucket]; ok && b.Receipts >= qualityTipMinReceipts &&
+				b.SuccessRate <= report.SuccessRate-qualityTipGap {
+				report.Tips = append(report.Tips, tip)
+			}
+		}
+		report.Metrics[m.name] = list
+	}
+	for _, b := range byStages {
+		b.finish()
+		report.Preprocessing = append(report.Preprocessing, *b)
+	}
+	sort.Slice(report.Preprocessing, func(i, j int) bool {
+		return report.Preprocessing[i].Receipts > report.Preprocessing[j].Receipts
+	})
+	return report, nil
+}
+
+// registerQualityRoutes adds the per-receipt quality metrics and the admin
+// quality report
+func registerQualityRoutes(app *fiber.App) {
+	app.Get("/receipts/:id/quality", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+
+		var q ReceiptQuality
+		var width, height, words sql.NullInt64
+		var blur, brightness, contrast, confidence sql.NullFloat64
+		var preprocessing []byte
+		var measuredAt time.Time
+		err = db.QueryRow(
+			`SELECT width, height, blur_score, brightness, contrast, ocr_confidence, ocr_words, rotation,
+				preprocessing, COALESCE(processing_method, ''), measured_at
+			FROM receipt_quality WHERE receipt_id = ?`,
+			id,
+		).Scan(&width, &height, &blur, &brightness, &contrast, &confidence, &words, &q.Rotation,
+			&preprocessing, &q.ProcessingMethod, &measuredAt)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No quality metrics for this receipt",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load quality metrics: %v", err),
+			})
+		}
+		if width.Valid && height.Valid {
+			w, h := int(width.Int64), int(height.Int64)
+			q.Width, q.Height = &w, &h
+		}
+		if words.Valid {
+			n := int(words.Int64)
+			q.OCRWords = &n
+		}
+		q.BlurScore = nullFloatPtr(blur)
+		q.Brightness = nullFloatPtr(brightness)
+		q.Contrast = nullFloatPtr(contrast)
+		q.OCRConfidence = nullFloatPtr(confidence)
+		q.Preprocessing = []string{}
+		json.Unmarshal(preprocessing, &q.Preprocessing)
+		q.MeasuredAt = measuredAt.Format(time.RFC3339)
+
+		return c.JSON(fiber.Map{
+			"success":    true,
+			"receipt_id": id,
+			"quality":    q,
+		})
+	})
+
+	// Parse success rate per blur, brightness, contrast, resolution and OCR
+	// confidence range and per preprocessing combination, with photo tips
+	// for ranges that parse notably worse. from/to limit the upload days.
+	app.Get("/admin/quality/report", func(c *fiber.Ctx) error {
+		var from, to *time.Time
+		if v := c.Query("from"); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid from date, expected YYYY-MM-DD",
+				})
+			}
+			from = &t
+		}
+		if v := c.Query("to"); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid to date, expected YYYY-MM-DD",
+				})
+			}
+			t = t.AddDate(0, 0, 1)
+			to = &t
+		}
+
+		report, err := buildQualityReport(from, to)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"report":  report,
+		})
+	})
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// quarantineDir keeps uploads that failed screening, apart from uploadsDir
+// so storage verification and migration never pick them up
+const quarantineDir = "./quarantine"
+
+// Reasons an upload is quarantined
+const (
+	quarantineInvalidContent = "invalid_content"
+	quarantineVirus          = "virus"
+	quarantineScanFailed     = "scan_failed"
+)
+
+// Quarantine states
+const (
+	quarantineHeld     = "quarantined"
+	quarantineReleased = "released"
+	quarantinePurged   = "purged"
+)
+
+// errQuarantined is returned by importers for a file that failed screening
+var errQuarantined = errors.New("file failed screening and was quarantined")
+
+// screenedContentTypes are the sniffed content types accepted as receipts
+var screenedContentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// clamdTimeout bounds a virus scan
+const clamdTimeout = 60 * time.Second
+
+// QuarantinedFile is an upload held back from processing
+type QuarantinedFile struct {
+	ID           int64   `json:"id"`
+	OriginalName string  `json:"original_name"`
+	Reason       string  `json:"reason"`
+	Detail       string  `json:"detail"`
+	ContentType  string  `json:"content_type"`
+	Size         int64   `json:"size"`
+	Checksum     string  `json:"checksum"`
+	Channel      string  `json:"channel"`
+	Tenant       string  `json:"tenant"`
+	Status       string  `json:"status"`
+	ReceiptID    *int64  `json:"receipt_id"`
+	CreatedAt    string  `json:"created_at"`
+	DecidedBy    *string `json:"decided_by"`
+	DecidedAt    *string `json:"decided_at"`
+
+	fileName, priority string
+}
+
+// QuarantineAuditEntry records one action on the quarantine
+type QuarantineAuditEntry struct {
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	Detail    string `json:"detail,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// scanWithClamd streams a file to the clamd daemon at CLAMAV_ADDR (host:port,
+// or a unix socket path) and returns the signature found, "" when clean
+func scanWithClamd(addr, path string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, 32<<10)
+	size := make([]byte, 4)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			w.Write(size)
+			w.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to send file to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// sniffFileContentType detects the content type of a file from its first
+// bytes
+func sniffFileContentType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n]), nil
+}
+
+// screenUpload checks that a saved upload really is an image or PDF and,
+// with CLAMAV_ADDR set, free of malware. It returns the quarantine reason
+// and detail, or "" when the file may be processed. A failed scan
+// quarantines the file too, so nothing unscanned is processed.
+func screenUpload(path string) (string, string, string) {
+	contentType, err := sniffFileContentType(path)
+	if err != nil {
+		return quarantineInvalidContent, fmt.Sprintf("file cannot be read: %v", err), ""
+	}
+	if !screenedContentTypes[contentType] {
+		return quarantineInvalidContent, fmt.Sprintf("content is %s, not an image or PDF", contentType), contentType
+	}
+
+	addr := os.Getenv("CLAMAV_ADDR")
+	if addr == "" {
+		return "", "", contentType
+	}
+	signature, err := scanWithClamd(addr, path)
+	if err != nil {
+		return quarantineScanFailed, err.Error(), contentType
+	}
+	if signature != "" {
+		return quarantineVirus, signature, contentType
+	}
+	return "", "", contentType
+}
+
+// quarantineUpload screens a file saved in uploadsDir. A file that fails
+// is moved to quarantineDir and recorded; its quarantine ID and reason are
+// returned. in carries the tenant and priority used on release.
+func quarantineUpload(storedName, originalName, channel string, in PipelineInput) (int64, string, error) {
+	path := filepath.Join(uploadsDir, storedName)
+	reason, detail, contentType := screenUpload(path)
+	if reason == "" {
+		return 0, "", nil
+	}
+	log.Printf("Quarantine: %s (%s): %s", originalName, reason, detail)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, reason, err
+	}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		log.Printf("Failed to checksum %s: %v", path, err)
+	}
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
+		return 0, reason, fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	if err := os.Rename(path, filepath.Join(quarantineDir, storedName)); err != nil {
+		os.Remove(path)
+		return 0, reason, fmt.Errorf("failed to move %s to quarantine: %v", storedName, err)
+	}
+
+	res, err := execWithRetry(
+		`INSERT INTO quarantined_files (file_name, original_name, reason, detail, content_type, size, checksum,
+			channel, tenant_key, priority, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		storedName, truncate(originalName, 255), reason, truncate(detail, 500), contentType, info.Size(), checksum,
+		channel, in.Tenant, in.Priority, quarantineHeld,
+	)
+	if err != nil {
+		return 0, reason, fmt.Errorf("failed to record quarantined file: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, reason, err
+	}
+	auditQuarantine(id, "quarantine", "system", reason+": "+detail)
+	return id, reason, nil
+}
+
+// auditQuarantine records an action on the quarantine; id is 0 for actions
+// on the whole quarantine such as listing it
+func auditQuarantine(id int64, action, actor, detail string) {
+	log.Printf("Quarantine audit: %s %s by %s %s", action, formatQuarantineID(id), actor, detail)
+	if _, err := execWithRetry(
+		"INSERT INTO quarantine_audit (quarantine_id, action, actor, detail) VALUES (?, ?, ?, ?)",
+		sql.NullInt64{Int64: id, Valid: id != 0}, action, actor, truncate(detail, 500),
+	); err != nil {
+		log.Printf("Quarantine: failed to record audit entry: %v", err)
+	}
+}
+
+// formatQuarantineID names a quarantined file in log lines
+func formatQuarantineID(id int64) string {
+	if id == 0 {
+		return "quarantine"
+	}
+	return fmt.Sprintf("file %d", id)
+}
+
+const quarantinedFileColumns = `id, file_name, original_name, reason, COALESCE(detail, ''), COALESCE(content_type, ''),
+	size, COALESCE(checksum, ''), COALESCE(channel, ''), tenant_key, priority, status, receipt_id, created_at,
+	decided_by, decided_at`
+
+// scanQuarantinedFile reads a row selected with quarantinedFileColumns
+func scanQuarantinedFile(row interface{ Scan(...any) error }) (*QuarantinedFile, error) {
+	var q QuarantinedFile
+	var receiptID sql.NullInt64
+	var decidedBy sql.NullString
+	var decidedAt sql.NullTime
+	var createdAt time.Time
+	if err := row.Scan(&q.ID, &q.fileName, &q.OriginalName, &q.Reason, &q.Detail, &q.ContentType, &q.Size,
+		&q.Checksum, &q.Channel, &q.Tenant, &q.priority, &q.Status, &receiptID, &createdAt,
+		&decidedBy, &decidedAt); err != nil {
+		return nil, err
+	}
+	if receiptID.Valid {
+		q.ReceiptID = &receiptID.Int64
+	}
+	q.DecidedBy = nullStringPtr(decidedBy)
+	if decidedAt.Valid {
+		s := decidedAt.Time.Format(time.RFC3339)
+		q.DecidedAt = &s
+	}
+	q.CreatedAt = createdAt.Format(time.RFC3339)
+	return &q, nil
+}
+
+// loadQuarantinedFile returns a quarantined file, nil when there is none
+// with the ID
+func loadQuarantinedFile(id int) (*QuarantinedFile, error) {
+	q, err := scanQuarantinedFile(db.QueryRow("SELECT "+quarantinedFileColumns+" FROM quarantined_files WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quarantined file: %v", err)
+	}
+	return q, nil
+}
+
+// heldQuarantinedFile loads the quarantined file of the :id parameter and
+// answers the request itself when it is missing or no longer held
+func heldQuarantinedFile(c *fiber.Ctx) (*QuarantinedFile, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid quarantine ID",
+		})
+	}
+	q, err := loadQuarantinedFile(id)
+	if err != nil {
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if q == nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Quarantined file not found",
+		})
+	}
+	if q.Status != quarantineHeld {
+		return nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("The file was already %s", q.Status),
+		})
+	}
+	return q, nil
+}
+
+// decideQuarantinedFile marks a held file as released or purged
+func decideQuarantinedFile(id int64, status, actor string, receiptID int64) error {
+	_, err := execWithRetry(
+		`UPDATE quarantined_files SET status = ?, receipt_id = ?, decided_by = ?, decided_at = NOW()
+		WHERE id = ?`,
+		status, sql.NullInt64{Int64: receiptID, Valid: receiptID != 0}, actor, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update quarantined file %d: %v", id, err)
+	}
+	return nil
+}
+
+// registerQuarantineRoutes adds the review of quarantined uploads. They
+// live below /admin/, so only admins reach them; every action is audited.
+func registerQuarantineRoutes(app *fiber.App) {
+	// Quarantined files, newest first; status defaults to quarantined, all
+	// lists every state
+	app.Get("/admin/quarantine", func(c *fiber.Ctx) error {
+		status := c.Query("status", quarantineHeld)
+		cond, args := "status = ?", []any{status}
+		switch status {
+		case quarantineHeld, quarantineReleased, quarantinePurged:
+		case "all":
+			cond, args = "1=1", nil
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "status must be quarantined, released, purged or all",
+			})
+		}
+		limit := c.QueryInt("limit", defaultReceiptPageSize)
+		if limit < 1 || limit > maxReceiptPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxReceiptPageSize),
+			})
+		}
+
+		rows, err := db.Query(
+			"SELECT "+quarantinedFileColumns+" FROM quarantined_files WHERE "+cond+" ORDER BY id DESC LIMIT ?",
+			append(args, limit)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load quarantine: %v", err),
+			})
+		}
+		defer rows.Close()
+		files := []*QuarantinedFile{}
+		for rows.Next() {
+			q, err := scanQuarantinedFile(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read quarantine: %v", err),
+				})
+			}
+			files = append(files, q)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read quarantine: %v", err),
+			})
+		}
+		auditQuarantine(0, "list", tenantKey(c), "status="+status)
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"files":   files,
+		})
+	})
+
+	// One quarantined file with its audit trail
+	app.Get("/admin/quarantine/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid quarantine ID",
+			})
+		}
+		q, err := loadQuarantinedFile(id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if q == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Quarantined file not found",
+			})
+		}
+		auditQuarantine(q.ID, "view", tenantKey(c), "")
+
+		rows, err := db.Query(
+			"SELECT action, actor, COALESCE(detail, ''), created_at FROM quarantine_audit WHERE quarantine_id = ? ORDER BY id",
+			q.ID,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load audit trail: %v", err),
+			})
+		}
+		defer rows.Close()
+		audit := []QuarantineAuditEntry{}
+		for rows.Next() {
+			var e QuarantineAuditEntry
+			var createdAt time.Time
+			if err := rows.Scan(&e.Action, &e.Actor, &e.Detail, &createdAt); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read audit trail: %v", err),
+				})
+			}
+			e.CreatedAt = createdAt.Format(time.RFC3339)
+			audit = append(audit, e)
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"file":    q,
+			"audit":   audit,
+		})
+	})
+
+	// The file itself, always as an opaque attachment so a browser never
+	// renders or runs it
+	app.Get("/admin/quarantine/:id/download", func(c *fiber.Ctx) error {
+		q, err := heldQuarantinedFile(c)
+		if q == nil {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(quarantineDir, q.fileName))
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": fmt.Sprintf("Quarantined file is not available: %v", err),
+			})
+		}
+		auditQuarantine(q.ID, "download", tenantKey(c), "")
+
+		c.Set("Content-Type", "application/octet-stream")
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="quarantine-%d.bin"`, q.ID))
+		c.Set("X-Content-Type-Options", "nosniff")
+		c.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		c.Set("Cache-Control", "no-store")
+		return c.Send(data)
+	})
+
+	// Release a file that was held by mistake: it is processed like a new
+	// upload from its original channel, with the default profile and OCR
+	// options
+	app.Post("/admin/quarantine/:id/release", requireDiskSpace, func(c *fiber.Ctx) error {
+		q, err := heldQuarantinedFile(c)
+		if q == nil {
+			return err
+		}
+		var body struct {
+			Comment string `json:"comment"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid request body",
+				})
+			}
+		}
+
+		if err := os.Rename(filepath.Join(quarantineDir, q.fileName), filepath.Join(uploadsDir, q.fileName)); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to release file: %v", err),
+			})
+		}
+		receiptID, jobID, err := queueUploadedReceipt(q.fileName, q.Channel, PipelineInput{
+			Priority: q.priority,
+			Tenant:   q.Tenant,
+			IsPDF:    q.ContentType == "application/pdf" || strings.ToLower(filepath.Ext(q.fileName)) == ".pdf",
+		})
+		if err != nil && receiptID == 0 {
+			// Put the file back so it can be released again
+			if mvErr := os.Rename(filepath.Join(uploadsDir, q.fileName), filepath.Join(quarantineDir, q.fileName)); mvErr != nil {
+				log.Printf("Quarantine: failed to return file %d: %v", q.ID, mvErr)
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to queue released file: %v", err),
+			})
+		}
+		actor := tenantKey(c)
+		if err := decideQuarantinedFile(q.ID, quarantineReleased, actor, receiptID); err != nil {
+			log.Printf("%v", err)
+		}
+		auditQuarantine(q.ID, "release", actor, strings.TrimSpace(fmt.Sprintf("receipt %d %s", receiptID, body.Comment)))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":      "Failed to queue receipt for processing",
+				"receipt_id": receiptID,
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":    true,
+			"receipt_id": receiptID,
+			"job_id":     jobID,
+			"status_url": fmt.Sprintf("/receipts/%d/status", receiptID),
+		})
+	})
+
+	// Delete the file for good; the record and its audit trail are kept
+	app.Delete("/admin/quarantine/:id", func(c *fiber.Ctx) error {
+		q, err := heldQuarantinedFile(c)
+		if q == nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(quarantineDir, q.fileName)); err != nil && !os.IsNotExist(err) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to delete file: %v", err),
+			})
+		}
+		actor := tenantKey(c)
+		if err := decideQuarantinedFile(q.ID, quarantinePurged, actor, 0); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		auditQuarantine(q.ID, "purge", actor, "")
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"id":      q.ID,
+			"status":  quarantinePurged,
+		})
+	})
+}
+
+// quarantineResponse answers an upload that was quarantined
+func quarantineResponse(c *fiber.Ctx, id int64, reason string) error {
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+		"error":         "The file failed screening and was quarantined for review",
+		"reason":        reason,
+		"quarantine_id": id,
+	})
+}
@@ -0,0 +1,942 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Page sizes of the receipt list
+const (
+	defaultReceiptPageSize = 50
+	maxReceiptPageSize     = 200
+)
+
+// ReceiptSummary is a receipt as returned by the receipt list
+type ReceiptSummary struct {
+	ID       int64  `json:"id"`
+	FileName string `json:"file_name"`
+	Status   string `json:"status"`
+	// StatusLabel is the status in the language of the request, see i18n.go
+	StatusLabel    string  `json:"status_label,omitempty"`
+	Priority       string  `json:"priority"`
+	Channel        string  `json:"channel"`
+	StorageBackend string  `json:"storage_backend"`
+	Checksum       *string `json:"checksum"`
+	SourceURL      *string `json:"source_url,omitempty"`
+	// DriveFileID is the Google Drive copy of the original, if uploaded
+	DriveFileID *string `json:"drive_file_id,omitempty"`
+	UploadedAt  string  `json:"uploaded_at"`
+	VerifiedAt  *string `json:"verified_at"`
+	UpdatedAt   *string `json:"updated_at"`
+	// DeletedAt is set while the receipt is in the trash
+	DeletedAt *string `json:"deleted_at,omitempty"`
+	// Transactions is only set with fields=transactions on the list
+	Transactions *[]ReceiptTransaction `json:"transactions,omitempty"`
+	// OCRText and GeminiResponse are the latest stored artifacts, only set
+	// with fields=ocr_text and fields=gemini_response
+	OCRText        *string `json:"ocr_text,omitempty"`
+	GeminiResponse *string `json:"gemini_response,omitempty"`
+}
+
+// receiptOptionalFields are the fields left out of receipt responses unless
+// requested with fields=, because they are large or need extra queries
+var receiptOptionalFields = []string{"transactions", "items", "ocr_text", "gemini_response"}
+
+// deleteReceiptRecords removes a receipt and returns how many transactions
+// went with it. Transactions, line items, artifacts and the other rows
+// referencing the receipt are removed by their foreign keys; archived and
+// trashed transactions have none and are deleted here. Receipts linked as
+// copies of its transactions go back to needs_review, so analyzing one of
+// them stores the purchase again.
+func deleteReceiptRecords(id int64) (int64, error) {
+	var transactions int64
+	err := inTx("delete receipt", func(tx *sql.Tx) error {
+		transactions = 0
+		if _, err := tx.Exec(
+			`UPDATE receipts SET status = 'needs_review', duplicate_of = NULL, duplicate_reason = NULL
+			WHERE status = 'duplicate' AND duplicate_of IN (
+				SELECT id FROM transactions WHERE receipt_id = ?
+				UNION SELECT id FROM transactions_archive WHERE receipt_id = ?
+				UNION SELECT id FROM `+transactionsTrashTable+` WHERE receipt_id = ?)`,
+			id, id, id,
+		); err != nil {
+			return err
+		}
+		for _, table := range []string{"transactions", "transactions_archive", transactionsTrashTable} {
+			res, err := tx.Exec("DELETE FROM "+table+" WHERE receipt_id = ?", id)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			transactions += n
+		}
+		_, err := tx.Exec("DELETE FROM receipts WHERE id = ?", id)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete receipt %d: %v", id, err)
+	}
+	return transactions, nil
+}
+
+// deleteReceiptFile removes the stored file of a deleted receipt. A file
+// that is already gone counts as deleted; otherwise the failure is returned
+// as a warning, since the records are gone by then.
+func deleteReceiptFile(fileName, backend string) (bool, string) {
+	store, err := newStorage(backend)
+	if err != nil {
+		return false, err.Error()
+	}
+	if err := store.Delete(fileName); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Sprintf("failed to delete file %s: %v", fileName, err)
+	}
+	return true, ""
+}
+
+// receiptFields parses the fields parameter (and the older
+// include=transactions) into the set of optional fields to return. items
+// implies transactions.
+func receiptFields(c *fiber.Ctx) (map[string]bool, error) {
+	fields := make(map[string]bool)
+	for _, name := range strings.Split(c.Query("fields")+","+c.Query("include"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, f := range receiptOptionalFields {
+			known = known || f == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", name, strings.Join(receiptOptionalFields, ", "))
+		}
+		fields[name] = true
+	}
+	if fields["items"] {
+		fields["transactions"] = true
+	}
+	return fields, nil
+}
+
+// ReceiptTransaction is a transaction listed with its receipt
+type ReceiptTransaction struct {
+	ID       int64   `json:"id"`
+	Date     *string `json:"date"`
+	Merchant *string `json:"merchant"`
+	Category *string `json:"category"`
+	// CategoryLabel is the category in the language of the request
+	CategoryLabel *string  `json:"category_label,omitempty"`
+	Amount        *float64 `json:"amount"`
+	Currency      *string  `json:"currency"`
+	HomeAmount    *float64 `json:"home_amount"`
+	Confidence    *float64 `json:"confidence"`
+	// CustomFields are the values of the deployment's custom fields
+	CustomFields map[string]any `json:"custom_fields,omitempty"`
+	// PolicyViolations lists the expense policy rules the transaction breaks
+	PolicyViolations []PolicyViolation `json:"policy_violations,omitempty"`
+	// Items is only set with fields=items
+	Items *[]TransactionItem `json:"items,omitempty"`
+}
+
+// receiptListFilter builds the WHERE clause of the receipt list from the
+// status, channel, from, to and filename query parameters. Receipts in the
+// trash are listed instead of the others with deleted=true.
+func receiptListFilter(c *fiber.Ctx) (string, []any, error) {
+	conds := []string{"deleted_at IS NULL"}
+	if c.QueryBool("deleted") {
+		conds = []string{"deleted_at IS NOT NULL"}
+	}
+	var args []any
+
+	if status := c.Query("status"); status != "" {
+		var placeholders []string
+		for _, s := range strings.Split(status, ",") {
+			s = strings.TrimSpace(s)
+			if !strings.Contains(receiptStatuses, "'"+s+"'") {
+				return "", nil, fmt.Errorf("invalid status %q, expected one of %s", s, receiptStatuses)
+			}
+			placeholders = append(placeholders, "?")
+			args = append(args, s)
+		}
+		conds = append(conds, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if channel := c.Query("channel"); channel != "" {
+		var placeholders []string
+		for _, s := range strings.Split(channel, ",") {
+			s = strings.TrimSpace(s)
+			if !containsString(ingestChannels, s) {
+				return "", nil, fmt.Errorf("invalid channel %q, expected one of %s", s, strings.Join(ingestChannels, ", "))
+			}
+			placeholders = append(placeholders, "?")
+			args = append(args, s)
+		}
+		conds = append(conds, "channel IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid from date, expected YYYY-MM-DD")
+		}
+		conds = append(conds, "uploaded_at >= ?")
+		args = append(args, t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid to date, expected YYYY-MM-DD")
+		}
+		// uploaded_at has a time of day, so include the whole to day
+		conds = append(conds, "uploaded_at < ?")
+		args = append(args, t.AddDate(0, 0, 1))
+	}
+	if name := c.Query("filename"); name != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(name)
+		conds = append(conds, "file_name LIKE ?")
+		args = append(args, "%"+escaped+"%")
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// loadReceiptTransactions returns the transactions of the given receipts,
+// archived and trashed ones included, keyed by receipt ID
+func loadReceiptTransactions(receiptIDs []int64) (map[int64][]ReceiptTransaction, error) {
+	result := make(map[int64][]ReceiptTransaction)
+	if len(receiptIDs) == 0 {
+		return result, nil
+	}
+	args := make([]any, len(receiptIDs))
+	for i, id := range receiptIDs {
+		args[i] = id
+	}
+
+	const columns = `id, receipt_id, date, COALESCE(merchant_clean, merchant_raw), category, amount, currency, home_amount, confidence,
+		custom_fields, policy_violations`
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	rows, err := db.Query(
+		`SELECT `+columns+` FROM `+transactionsAllView+` WHERE receipt_id IN (`+placeholders+`)
+		UNION ALL
+		SELECT `+columns+` FROM `+transactionsTrashTable+` WHERE receipt_id IN (`+placeholders+`)
+		ORDER BY id`,
+		append(args, args...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transactions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t ReceiptTransaction
+		var receiptID int64
+		var date sql.NullTime
+		var merchant, category, currency sql.NullString
+		var amount, homeAmount, confidence sql.NullFloat64
+		var custom, violations []byte
+		if err := rows.Scan(&t.ID, &receiptID, &date, &merchant, &category, &amount, &currency, &homeAmount, &confidence, &custom,
+			&violations); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %v", err)
+		}
+		t.Date = formatNullDate(date)
+		t.Merchant = nullStringPtr(merchant)
+		t.Category = nullStringPtr(category)
+		t.Amount = nullFloatPtr(amount)
+		t.Currency = nullStringPtr(currency)
+		t.HomeAmount = nullFloatPtr(homeAmount)
+		t.Confidence = nullFloatPtr(confidence)
+		t.CustomFields = decodeCustomFields(custom)
+		t.PolicyViolations = decodePolicyViolations(violations)
+		result[receiptID] = append(result[receiptID], t)
+	}
+	return result, rows.Err()
+}
+
+// loadLatestArtifacts returns the newest artifact of a kind per receipt
+func loadLatestArtifacts(receiptIDs []int64, kind string) (map[int64]string, error) {
+	result := make(map[int64]string)
+	if len(receiptIDs) == 0 {
+		return result, nil
+	}
+	args := []any{kind}
+	for _, id := range receiptIDs {
+		args = append(args, id)
+	}
+	rows, err := db.Query(
+		`SELECT receipt_id, content FROM receipt_artifacts
+		WHERE kind = ? AND receipt_id IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(receiptIDs)), ", ")+`)
+		ORDER BY id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s artifacts: %v", kind, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var receiptID int64
+		var content []byte
+		if err := rows.Scan(&receiptID, &content); err != nil {
+			return nil, fmt.Errorf("failed to scan artifact: %v", err)
+		}
+		// Later rows are newer
+		result[receiptID] = decodeArtifact(content)
+	}
+	return result, rows.Err()
+}
+
+// addReceiptFields loads the requested optional fields into receipts
+func addReceiptFields(receipts []ReceiptSummary, fields map[string]bool) error {
+	ids := make([]int64, len(receipts))
+	for i, r := range receipts {
+		ids[i] = r.ID
+	}
+
+	if fields["transactions"] {
+		byReceipt, err := loadReceiptTransactions(ids)
+		if err != nil {
+			return err
+		}
+		var items map[int64][]TransactionItem
+		if fields["items"] {
+			var txIDs []int64
+			for _, transactions := range byReceipt {
+				for _, t := range transactions {
+					txIDs = append(txIDs, t.ID)
+				}
+			}
+			if items, err = loadTransactionItems(txIDs); err != nil {
+				return err
+			}
+		}
+		for i := range receipts {
+			transactions := byReceipt[receipts[i].ID]
+			if transactions == nil {
+				transactions = []ReceiptTransaction{}
+			}
+			if items != nil {
+				for j := range transactions {
+					list := items[transactions[j].ID]
+					if list == nil {
+						list = []TransactionItem{}
+					}
+					transactions[j].Items = &list
+				}
+			}
+			receipts[i].Transactions = &transactions
+		}
+	}
+
+	for _, kind := range []string{artifactOCRText, artifactGeminiResponse} {
+		if !fields[kind] {
+			continue
+		}
+		texts, err := loadLatestArtifacts(ids, kind)
+		if err != nil {
+			return err
+		}
+		for i := range receipts {
+			text, ok := texts[receipts[i].ID]
+			if !ok {
+				continue
+			}
+			if kind == artifactOCRText {
+				receipts[i].OCRText = &text
+			} else {
+				receipts[i].GeminiResponse = &text
+			}
+		}
+	}
+	return nil
+}
+
+// scanReceiptSummary reads a row of receiptSummaryColumns
+func scanReceiptSummary(row interface{ Scan(...any) error }) (ReceiptSummary, error) {
+	var r ReceiptSummary
+	var checksum, sourceURL, driveFileID sql.NullString
+	var uploadedAt time.Time
+	var verifiedAt, updatedAt, deletedAt sql.NullTime
+	if err := row.Scan(&r.ID, &r.FileName, &r.Status, &r.Priority, &r.Channel, &r.StorageBackend,
+		&checksum, &sourceURL, &driveFileID, &uploadedAt, &verifiedAt, &updatedAt, &deletedAt); err != nil {
+		return r, err
+	}
+	r.Checksum = nullStringPtr(checksum)
+	r.SourceURL = nullStringPtr(sourceURL)
+	r.DriveFileID = nullStringPtr(driveFileID)
+	r.UploadedAt = uploadedAt.Format(time.RFC3339)
+	if verifiedAt.Valid {
+		v := verifiedAt.Time.Format(time.RFC3339)
+		r.VerifiedAt = &v
+	}
+	if updatedAt.Valid {
+		v := updatedAt.Time.Format(time.RFC3339)
+		r.UpdatedAt = &v
+	}
+	if deletedAt.Valid {
+		v := deletedAt.Time.Format(time.RFC3339)
+		r.DeletedAt = &v
+	}
+	return r, nil
+}
+
+// receiptSummaryColumns are the receipts columns read by scanReceiptSummary
+const receiptSummaryColumns = "id, file_name, status, priority, channel, storage_backend, checksum, source_url, drive_file_id, uploaded_at, verified_at, updated_at, deleted_at"
+
+// registerReceiptRoutes adds the receipt list, the download of stored
+// receipt files and re-analysis of a stored receipt
+func registerReceiptRoutes(app *fiber.App) {
+	// Receipts newest first. Pages are selected with limit plus either
+	// cursor (the next_cursor of the previous page) or offset. Filters:
+	// status (comma separated), channel, from/to upload day (YYYY-MM-DD), a
+	// filename substring and deleted=true for the trash. fields= adds
+	// optional fields, see receiptOptionalFields; include=transactions is
+	// still accepted.
+	app.Get("/receipts", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", defaultReceiptPageSize)
+		if limit < 1 || limit > maxReceiptPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxReceiptPageSize),
+			})
+		}
+		offset := c.QueryInt("offset", 0)
+		if offset < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "offset must not be negative",
+			})
+		}
+		var cursor int64
+		if v := c.Query("cursor"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid cursor",
+				})
+			}
+			if offset > 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Use either cursor or offset, not both",
+				})
+			}
+			cursor = n
+		}
+		fields, err := receiptFields(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		where, args, err := receiptListFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM receipts WHERE "+where, args...).Scan(&total); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to count receipts: %v", err),
+			})
+		}
+
+		pageWhere, pageArgs := where, args
+		if cursor > 0 {
+			pageWhere += " AND id < ?"
+			pageArgs = append(append([]any{}, args...), cursor)
+		}
+		// One extra row tells whether there is a next page
+		rows, err := db.Query(
+			`SELECT `+receiptSummaryColumns+`
+			FROM receipts
+			WHERE `+pageWhere+`
+			ORDER BY id DESC
+			LIMIT ? OFFSET ?`,
+			append(pageArgs, limit+1, offset)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list receipts: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		receipts := []ReceiptSummary{}
+		for rows.Next() {
+			r, err := scanReceiptSummary(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read receipts: %v", err),
+				})
+			}
+			receipts = append(receipts, r)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read receipts: %v", err),
+			})
+		}
+
+		var nextCursor *int64
+		if len(receipts) > limit {
+			receipts = receipts[:limit]
+			nextCursor = &receipts[limit-1].ID
+		}
+
+		if err := addReceiptFields(receipts, fields); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		newLocalizer(c).Receipts(receipts)
+
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"receipts":    receipts,
+			"total":       total,
+			"limit":       limit,
+			"next_cursor": nextCursor,
+		})
+	})
+
+	// One receipt with its transactions. fields= adds items, ocr_text and
+	// gemini_response.
+	app.Get("/receipts/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		fields, err := receiptFields(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		fields["transactions"] = true
+
+		r, err := scanReceiptSummary(db.QueryRow("SELECT "+receiptSummaryColumns+" FROM receipts WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+
+		receipts := []ReceiptSummary{r}
+		if err := addReceiptFields(receipts, fields); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		newLocalizer(c).Receipts(receipts)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"receipt": receipts[0],
+		})
+	})
+
+	// The stored file of a receipt, shown inline unless download=true.
+	// thumbnail=true returns a JPEG preview instead, width (default 320)
+	// pixels across: the photo upright or the first page of a PDF. Files of
+	// receipts in the trash are not served.
+	app.Get("/receipts/:id/file", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		thumbnail := c.QueryBool("thumbnail")
+		width := c.QueryInt("width", defaultThumbnailWidth)
+		if thumbnail && (width < 16 || width > maxThumbnailWidth) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("width must be between 16 and %d", maxThumbnailWidth),
+			})
+		}
+
+		var fileName, backend string
+		var checksum sql.NullString
+		err = db.QueryRow(
+			"SELECT file_name, storage_backend, checksum FROM receipts WHERE id = ? AND deleted_at IS NULL", id,
+		).Scan(&fileName, &backend, &checksum)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		// Stored files never change, so the checksum identifies the
+		// content and browsers can keep it
+		if checksum.Valid {
+			etag := `"` + checksum.String + `"`
+			if thumbnail {
+				etag = fmt.Sprintf(`"%s-thumb-%d"`, checksum.String, width)
+			}
+			c.Set(fiber.HeaderETag, etag)
+			c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+			if c.Get(fiber.HeaderIfNoneMatch) == etag {
+				return c.SendStatus(fiber.StatusNotModified)
+			}
+		}
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+		if thumbnail {
+			dir, err := newTempDir()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to create temp directory: %v", err),
+				})
+			}
+			defer dir.Cleanup()
+			local, err := fetchReceiptFile(backend, fileName, dir.Path)
+			if err != nil {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": fmt.Sprintf("Receipt file is not available: %v", err),
+				})
+			}
+			contentType, err := sniffFileContentType(local)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read receipt file: %v", err),
+				})
+			}
+			if !screenedContentTypes[contentType] {
+				return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+					"error": "Thumbnails are not available for this file type",
+				})
+			}
+			data, err := renderThumbnail(local, dir.Path, contentType == "application/pdf", width)
+			if errors.Is(err, errNoThumbnail) {
+				return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+					"error": "Thumbnails are not available for this file type",
+				})
+			}
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			c.Set(fiber.HeaderContentType, "image/jpeg")
+			return c.Send(data)
+		}
+
+		store, err := newStorage(backend)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		r, err := store.Open(fileName)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": fmt.Sprintf("Receipt file is not available: %v", err),
+			})
+		}
+
+		// The type is sniffed from the content, never taken from the stored
+		// name, whose extension the uploader chose. Anything that is not an
+		// image or PDF is only offered as a download, so it cannot run as a
+		// page on this origin.
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(512)
+		contentType := http.DetectContentType(head)
+		disposition := "inline"
+		if !screenedContentTypes[contentType] {
+			contentType = "application/octet-stream"
+			disposition = "attachment"
+		}
+		if c.QueryBool("download") {
+			disposition = "attachment"
+		}
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Disposition", fmt.Sprintf(`%s; filename="%s"`, disposition, path.Base(fileName)))
+		c.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		return c.SendStream(struct {
+			io.Reader
+			io.Closer
+		}{br, r})
+	})
+
+	// Moves a receipt with its transactions to the trash, from where it is
+	// restored with POST /receipts/:id/restore or purged after
+	// TRASH_RETENTION_DAYS. permanent=true instead removes the receipt with
+	// everything derived from it right away, deletes the stored file and,
+	// with trash_drive=true, moves the Drive copy to the Drive trash.
+	app.Delete("/receipts/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		permanent := c.QueryBool("permanent")
+		trashDrive := c.QueryBool("trash_drive")
+
+		var fileName, backend, status string
+		var driveFileID sql.NullString
+		var deletedAt sql.NullTime
+		err = db.QueryRow(
+			"SELECT file_name, storage_backend, status, drive_file_id, deleted_at FROM receipts WHERE id = ?", id,
+		).Scan(&fileName, &backend, &status, &driveFileID, &deletedAt)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		if status == "pending" || status == "processing" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Receipt is being processed",
+			})
+		}
+		if deletedAt.Valid && !permanent {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Receipt is already in the trash; use permanent=true to delete it",
+			})
+		}
+
+		// Invoiced transactions must not vanish from under the invoice,
+		// even once archived
+		var invoiced struct {
+			transactionID, invoiceID int64
+		}
+		err = db.QueryRow(
+			"SELECT id, invoice_id FROM "+transactionsAllView+" WHERE receipt_id = ? AND invoice_id IS NOT NULL LIMIT 1", id,
+		).Scan(&invoiced.transactionID, &invoiced.invoiceID)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transactions: %v", err),
+			})
+		}
+		if err == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("Transaction %d is on invoice %d", invoiced.transactionID, invoiced.invoiceID),
+			})
+		}
+
+		if !permanent {
+			transactions, err := trashReceipt(int64(id))
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			liveQueries.Invalidate()
+			log.Printf("Moved receipt %d and %d transaction(s) to the trash", id, transactions)
+
+			var purgeAfter *string
+			if days := trashRetentionDays(); days > 0 {
+				v := time.Now().AddDate(0, 0, days).Format(time.RFC3339)
+				purgeAfter = &v
+			}
+			return c.JSON(fiber.Map{
+				"success":              true,
+				"receipt_id":           id,
+				"trashed":              true,
+				"transactions_trashed": transactions,
+				"purge_after":          purgeAfter,
+			})
+		}
+
+		transactions, err := deleteReceiptRecords(int64(id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		liveQueries.Invalidate()
+		log.Printf("Deleted receipt %d and %d transaction(s)", id, transactions)
+
+		// The records are gone at this point; file cleanup failures are
+		// reported but do not fail the request
+		warnings := []string{}
+		fileDeleted, warning := deleteReceiptFile(fileName, backend)
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+
+		driveTrashed := false
+		if trashDrive && driveFileID.Valid {
+			if driveClient == nil {
+				warnings = append(warnings, "Drive copy kept: Drive upload is not enabled (DRIVE_UPLOAD)")
+			} else if err := driveClient.Trash(driveFileID.String); err != nil {
+				warnings = append(warnings, fmt.Sprintf("failed to trash Drive file %s: %v", driveFileID.String, err))
+			} else {
+				driveTrashed = true
+			}
+		}
+		for _, w := range warnings {
+			log.Printf("Receipt %d: %s", id, w)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":              true,
+			"receipt_id":           id,
+			"transactions_deleted": transactions,
+			"file_deleted":         fileDeleted,
+			"drive_trashed":        driveTrashed,
+			"warnings":             warnings,
+		})
+	})
+
+	// Runs a stored receipt through OCR and Gemini again, e.g. after a
+	// prompt or profile change. The receipt's first transaction is updated
+	// in place; a receipt without one gets a new transaction. Accepts the
+	// same profile, priority and OCR options as /ingest.
+	app.Post("/receipts/analyze/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+
+		var fileName, backend, status, storedPriority string
+		var deletedAt sql.NullTime
+		err = db.QueryRow(
+			"SELECT file_name, storage_backend, status, priority, deleted_at FROM receipts WHERE id = ?", id,
+		).Scan(&fileName, &backend, &status, &storedPriority, &deletedAt)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		if status == "pending" || status == "processing" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Receipt is already being processed",
+			})
+		}
+		if deletedAt.Valid {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Receipt is in the trash; restore it first",
+			})
+		}
+
+		profile := c.FormValue("profile", c.Query("profile"))
+		if profile != "" && profile != profileGeneric && profileByName(profile) == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Unknown extraction profile %q", profile),
+			})
+		}
+		ocrOptions, err := ocrOptionsFromForm(func(key string, defaultValue ...string) string {
+			return c.FormValue(key, c.Query(key, defaultValue...))
+		})
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		priority, err := parsePriority(c.FormValue("priority", c.Query("priority")), storedPriority)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		// Invoiced transactions are not rewritten behind the invoice's back.
+		// The transaction may have been archived; it is moved back below.
+		var transactionID int64
+		var invoiceID sql.NullInt64
+		err = db.QueryRow(
+			"SELECT id, invoice_id FROM "+transactionsAllView+" WHERE receipt_id = ? ORDER BY id LIMIT 1", id,
+		).Scan(&transactionID, &invoiceID)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transaction: %v", err),
+			})
+		}
+		if invoiceID.Valid {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("Transaction %d is on invoice %d", transactionID, invoiceID.Int64),
+			})
+		}
+
+		path := fileName
+		if backend == "local" {
+			path = filepath.Join(uploadsDir, fileName)
+		}
+		if _, err := db.Exec("UPDATE receipts SET status = 'pending', priority = ? WHERE id = ?", priority, id); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update receipt: %v", err),
+			})
+		}
+		// Pending receipts are not archived, so this sticks until the
+		// pipeline has updated the transaction
+		if _, err := unarchiveReceiptTransactions(int64(id)); err != nil {
+			log.Printf("%v", err)
+			if _, err := db.Exec("UPDATE receipts SET status = ? WHERE id = ?", status, id); err != nil {
+				log.Printf("Failed to restore status of receipt %d: %v", id, err)
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to restore archived transactions",
+			})
+		}
+
+		var existing *int64
+		if transactionID > 0 {
+			existing = &transactionID
+		}
+		tenant := tenantKey(c)
+		jobID, err := ingestQueue.Enqueue(PipelineInput{
+			ReceiptID:     int64(id),
+			TransactionID: transactionID,
+			Path:          path,
+			IsPDF:         strings.ToLower(filepath.Ext(fileName)) == ".pdf",
+			Profile:       profile,
+			OCR:           &ocrOptions,
+			Priority:      priority,
+			Tenant:        tenant,
+		}, backend)
+		if err != nil {
+			log.Printf("%v", err)
+			if _, err := db.Exec("UPDATE receipts SET status = ? WHERE id = ?", status, id); err != nil {
+				log.Printf("Failed to restore status of receipt %d: %v", id, err)
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to queue receipt for processing",
+			})
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"success":        true,
+			"receipt_id":     id,
+			"transaction_id": existing,
+			"status":         "pending",
+			"priority":       priority,
+			"job_id":         jobID,
+			"status_url":     fmt.Sprintf("/receipts/%d/status", id),
+			"pipeline": fiber.Map{
+				"tenant": tenant,
+			},
+		})
+	})
+}
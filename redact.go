@@ -0,0 +1,33 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Card numbers: 13-19 digits optionally grouped by spaces or dashes
+	cardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	emailPattern      = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// Phone numbers in international (+62 812 3456 7890) or common
+	// North American ((555) 123-4567, 555-123-4567) formats
+	phonePattern = regexp.MustCompile(`\+\d{1,3}[\s.-]?\(?\d{1,4}\)?(?:[\s.-]?\d{2,4}){2,4}|\(\d{3}\)\s?\d{3}[\s.-]\d{4}|\b\d{3}[.-]\d{3}[.-]\d{4}\b`)
+)
+
+// redactPII masks personal data in receipt text: card numbers keep their
+// last four digits, email addresses and phone numbers are replaced entirely.
+func redactPII(text string) string {
+	// Phone numbers go first so international numbers are not mistaken for cards
+	text = emailPattern.ReplaceAllString(text, "[EMAIL]")
+	text = phonePattern.ReplaceAllString(text, "[PHONE]")
+	text = cardNumberPattern.ReplaceAllStringFunc(text, func(match string) string {
+		digits := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, match)
+		return "[CARD ****" + digits[len(digits)-4:] + "]"
+	})
+	return text
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StaleReminderConfig controls reminders about receipts left in needs_review
+type StaleReminderConfig struct {
+	// After is how long a receipt waits in needs_review before the first
+	// reminder (STALE_REVIEW_AFTER, default 72h)
+	After time.Duration
+	// Interval is the gap before the second reminder; each further reminder
+	// halves it (STALE_REMINDER_INTERVAL, default 24h)
+	Interval time.Duration
+	// MinInterval is the shortest gap escalation can reach
+	// (STALE_REMINDER_MIN_INTERVAL, default 4h)
+	MinInterval time.Duration
+}
+
+// loadStaleReminderConfig reads the reminder settings. It returns nil when
+// STALE_REVIEW_AFTER is "off".
+func loadStaleReminderConfig() (*StaleReminderConfig, error) {
+	if os.Getenv("STALE_REVIEW_AFTER") == "off" {
+		return nil, nil
+	}
+	cfg := &StaleReminderConfig{After: 72 * time.Hour, Interval: 24 * time.Hour, MinInterval: 4 * time.Hour}
+	for _, setting := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"STALE_REVIEW_AFTER", &cfg.After},
+		{"STALE_REMINDER_INTERVAL", &cfg.Interval},
+		{"STALE_REMINDER_MIN_INTERVAL", &cfg.MinInterval},
+	} {
+		raw := os.Getenv(setting.env)
+		if raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(raw)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", setting.env, raw)
+		}
+		*setting.dst = v
+	}
+	return cfg, nil
+}
+
+// nextGap returns the wait after the given number of reminders
+func (cfg *StaleReminderConfig) nextGap(sent int) time.Duration {
+	gap := cfg.Interval
+	for i := 1; i < sent && gap > cfg.MinInterval; i++ {
+		gap /= 2
+	}
+	if gap < cfg.MinInterval {
+		gap = cfg.MinInterval
+	}
+	return gap
+}
+
+// StaleReceipt is a receipt listed in a reminder
+type StaleReceipt struct {
+	ID         int64   `json:"id"`
+	FileName   string  `json:"file_name"`
+	UploadedAt string  `json:"uploaded_at"`
+	AgeHours   float64 `json:"age_hours"`
+	Reminders  int     `json:"reminders"`
+}
+
+// sendStaleReminders sends one webhook and email listing every receipt whose
+// next reminder is due and records the reminder on each of them. Receipts
+// that keep waiting are reminded about more and more often.
+func sendStaleReminders(cfg *StaleReminderConfig, now time.Time) ([]StaleReceipt, error) {
+	rows, err := db.Query(
+		`SELECT id, file_name, uploaded_at, review_reminders, last_reminded_at
+		FROM receipts
+		WHERE status = 'needs_review' AND deleted_at IS NULL AND uploaded_at <= ?
+		ORDER BY uploaded_at`,
+		now.Add(-cfg.After),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find stale receipts: %v", err)
+	}
+
+	due := []StaleReceipt{}
+	for rows.Next() {
+		var r StaleReceipt
+		var uploadedAt time.Time
+		var lastReminded sql.NullTime
+		if err := rows.Scan(&r.ID, &r.FileName, &uploadedAt, &r.Reminders, &lastReminded); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		if lastReminded.Valid && now.Sub(lastReminded.Time) < cfg.nextGap(r.Reminders) {
+			continue
+		}
+		r.UploadedAt = uploadedAt.Format(time.RFC3339)
+		r.AgeHours = float64(int(now.Sub(uploadedAt).Hours()*10)) / 10
+		r.Reminders++
+		due = append(due, r)
+	}
+	rows.Close()
+	if len(due) == 0 {
+		return due, nil
+	}
+
+	if err := sendWebhook(eventReviewReminder, fiber.Map{
+		"count":    len(due),
+		"receipts": due,
+	}); err != nil {
+		return nil, err
+	}
+	if err := sendEmail(staleReminderEmail(due)); err != nil {
+		log.Printf("Reminders: %v", err)
+	}
+
+	for _, r := range due {
+		if _, err := db.Exec(
+			"UPDATE receipts SET review_reminders = ?, last_reminded_at = ? WHERE id = ?",
+			r.Reminders, now, r.ID,
+		); err != nil {
+			return due, fmt.Errorf("failed to record reminder for receipt %d: %v", r.ID, err)
+		}
+	}
+	return due, nil
+}
+
+// staleReminderEmail formats the subject and body of a reminder email
+func staleReminderEmail(receipts []StaleReceipt) (string, string) {
+	subject := fmt.Sprintf("%d receipt(s) waiting for review", len(receipts))
+
+	var b strings.Builder
+	b.WriteString("These receipts are still waiting in the review queue:\n\n")
+	for _, r := range receipts {
+		fmt.Fprintf(&b, "  #%d %s - uploaded %s (%.0f days ago)", r.ID, r.FileName, r.UploadedAt, r.AgeHours/24)
+		if r.Reminders > 1 {
+			fmt.Fprintf(&b, ", reminder %d", r.Reminders)
+		}
+		b.WriteString("\n")
+	}
+	return subject, b.String()
+}
+
+// startStaleReminderScheduler checks for stale receipts every hour
+func startStaleReminderScheduler() {
+	cfg, err := loadStaleReminderConfig()
+	if err != nil {
+		log.Printf("Reminders: %v, stale receipt reminders disabled", err)
+		return
+	}
+	if cfg == nil {
+		return
+	}
+
+	log.Printf("Reminders: receipts in review for more than %v trigger reminders", cfg.After)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			sent, err := sendStaleReminders(cfg, time.Now())
+			if err != nil {
+				log.Printf("Reminders: %v", err)
+				continue
+			}
+			if len(sent) > 0 {
+				log.Printf("Reminders: reminded about %d stale receipt(s)", len(sent))
+			}
+		}
+	}()
+}
+
+// registerReminderRoutes adds an endpoint to send due reminders right away
+func registerReminderRoutes(app *fiber.App) {
+	app.Post("/admin/reminders/stale", func(c *fiber.Ctx) error {
+		cfg, err := loadStaleReminderConfig()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if cfg == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Stale receipt reminders are disabled",
+			})
+		}
+
+		sent, err := sendStaleReminders(cfg, time.Now())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"reminded": sent,
+		})
+	})
+}
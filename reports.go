@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// reportDateRange reads the optional from/to (YYYY-MM-DD) query parameters
+// and returns a SQL condition on the given date column plus its arguments
+func reportDateRange(c *fiber.Ctx, column string) (string, []any, error) {
+	var conds []string
+	var args []any
+
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid from date, expected YYYY-MM-DD")
+		}
+		conds = append(conds, column+" >= ?")
+		args = append(args, t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid to date, expected YYYY-MM-DD")
+		}
+		conds = append(conds, column+" <= ?")
+		args = append(args, t)
+	}
+
+	if len(conds) == 0 {
+		return "1=1", nil, nil
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// roundCents rounds a money amount to two decimals
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// diningCategoryList returns the dining categories as SQL placeholders and args
+func diningCategoryList() (string, []any) {
+	placeholders := make([]string, 0, len(diningCategories))
+	args := make([]any, 0, len(diningCategories))
+	for category := range diningCategories {
+		placeholders = append(placeholders, "?")
+		args = append(args, category)
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// branchLabelSQL names a transaction's branch: the printed branch name,
+// else the store number, else the store address
+const branchLabelSQL = `COALESCE(NULLIF(branch_name, ''), CONCAT('#', NULLIF(store_number, '')), NULLIF(store_address, ''))`
+
+// cashflowPeriods maps a grouping to the SQL expression for the first day
+// of the period a transaction date falls in
+var cashflowPeriods = map[string]string{
+	"week":    "DATE_SUB(date, INTERVAL WEEKDAY(date) DAY)",
+	"month":   "CAST(DATE_FORMAT(date, '%Y-%m-01') AS DATE)",
+	"quarter": "MAKEDATE(YEAR(date), 1) + INTERVAL QUARTER(date) - 1 QUARTER",
+}
+
+// defaultSummaryMerchants is how many merchants the summary report lists
+// unless merchants is set
+const defaultSummaryMerchants = 20
+
+// SpendGroup is one group of a spending summary. Spend is in the home
+// currency.
+type SpendGroup struct {
+	Key           string   `json:"key"`
+	Transactions  int      `json:"transactions"`
+	Spend         float64  `json:"spend"`
+	AvgConfidence *float64 `json:"average_confidence"`
+	// Unconverted transactions wait for an exchange rate and are not part
+	// of Spend
+	Unconverted int `json:"unconverted"`
+}
+
+// SpendingSummary aggregates transactions per month, category and merchant
+type SpendingSummary struct {
+	Currency   string       `json:"currency"`
+	Total      SpendGroup   `json:"total"`
+	Months     []SpendGroup `json:"months"`
+	Categories []SpendGroup `json:"categories"`
+	// Merchants are the merchants with the highest spend
+	Merchants []SpendGroup `json:"merchants"`
+}
+
+// summaryGroup sums the transactions of table matching where per the key
+// expression, ordered by orderBy, at most limit groups (0 for all)
+func summaryGroup(table, keyExpr, where string, args []any, orderBy string, limit int) ([]SpendGroup, error) {
+	query := `SELECT ` + keyExpr + ` AS k, COUNT(*), SUM(home_amount), AVG(confidence), SUM(conversion_status = ?)
+		FROM ` + table + `
+		WHERE ` + where + `
+		GROUP BY k
+		ORDER BY ` + orderBy
+	args = append([]any{conversionPending}, args...)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []SpendGroup{}
+	for rows.Next() {
+		var g SpendGroup
+		var key sql.NullString
+		var spend, confidence sql.NullFloat64
+		var unconverted sql.NullInt64
+		if err := rows.Scan(&key, &g.Transactions, &spend, &confidence, &unconverted); err != nil {
+			return nil, err
+		}
+		g.Key = key.String
+		g.Spend = roundCents(spend.Float64)
+		if confidence.Valid {
+			v := math.Round(confidence.Float64*1000) / 1000
+			g.AvgConfidence = &v
+		}
+		g.Unconverted = int(unconverted.Int64)
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// loadSpendingSummary aggregates the transactions of table matching where
+func loadSpendingSummary(table, where string, args []any, merchants int) (*SpendingSummary, error) {
+	s := &SpendingSummary{Currency: homeCurrency()}
+	total, err := summaryGroup(table, "'total'", where, args, "k", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum transactions: %v", err)
+	}
+	if len(total) > 0 {
+		s.Total = total[0]
+	}
+	s.Total.Key = "total"
+	if s.Months, err = summaryGroup(table, "DATE_FORMAT(date, '%Y-%m')", "date IS NOT NULL AND "+where, args, "k", 0); err != nil {
+		return nil, fmt.Errorf("failed to sum spend per month: %v", err)
+	}
+	if s.Categories, err = summaryGroup(table, "COALESCE(LOWER(category), 'uncategorized')", where, args,
+		"SUM(home_amount) DESC, k", 0); err != nil {
+		return nil, fmt.Errorf("failed to sum spend per category: %v", err)
+	}
+	if s.Merchants, err = summaryGroup(table, "COALESCE(merchant_clean, merchant_raw, 'unknown')", where, args,
+		"SUM(home_amount) DESC, k", merchants); err != nil {
+		return nil, fmt.Errorf("failed to sum spend per merchant: %v", err)
+	}
+	return s, nil
+}
+
+// registerReportRoutes adds the reporting endpoints
+func registerReportRoutes(app *fiber.App) {
+	// Outflow per week, month or quarter in the home currency, stacked by
+	// category with a running total
+	app.Get("/reports/cashflow", func(c *fiber.Ctx) error {
+		group := c.Query("group", "month")
+		periodExpr, ok := cashflowPeriods[group]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "group must be week, month or quarter",
+			})
+		}
+		dateCond, args, err := reportDateRange(c, "date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT `+periodExpr+` AS period, COALESCE(LOWER(category), 'uncategorized') AS cat,
+				SUM(home_amount), COUNT(*), SUM(conversion_status = ?)
+			FROM `+reportTransactionsTable(c)+`
+			WHERE date IS NOT NULL AND amount > 0 AND `+dateCond+`
+			GROUP BY period, cat
+			ORDER BY period, SUM(home_amount) DESC`,
+			append([]any{conversionPending}, args...)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build cash-flow report: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		periods := []fiber.Map{}
+		var current fiber.Map
+		var currentStart string
+		running, grandTotal := 0.0, 0.0
+		totalUnconverted := 0
+		for rows.Next() {
+			var period time.Time
+			var category string
+			var outflow sql.NullFloat64
+			var count, unconverted int
+			if err := rows.Scan(&period, &category, &outflow, &count, &unconverted); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read cash-flow report: %v", err),
+				})
+			}
+
+			start := period.Format("2006-01-02")
+			if current == nil || start != currentStart {
+				current = fiber.Map{
+					"period_start":  start,
+					"outflow":       0.0,
+					"transactions":  0,
+					"unconverted":   0,
+					"categories":    fiber.Map{},
+					"running_total": 0.0,
+				}
+				currentStart = start
+				periods = append(periods, current)
+			}
+
+			current["categories"].(fiber.Map)[category] = roundCents(outflow.Float64)
+			current["outflow"] = roundCents(current["outflow"].(float64) + outflow.Float64)
+			current["transactions"] = current["transactions"].(int) + count
+			current["unconverted"] = current["unconverted"].(int) + unconverted
+			running += outflow.Float64
+			current["running_total"] = roundCents(running)
+			grandTotal += outflow.Float64
+			totalUnconverted += unconverted
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"group":    group,
+			"currency": homeCurrency(),
+			"periods":  periods,
+			"total":    roundCents(grandTotal),
+			// Foreign-currency transactions still waiting for an exchange
+			// rate are counted but not included in the amounts
+			"unconverted": totalUnconverted,
+		})
+	})
+
+	// Spend and average confidence in total and per month, category and
+	// merchant (the top merchants, default 20) between from and to
+	app.Get("/reports/summary", func(c *fiber.Ctx) error {
+		merchants := c.QueryInt("merchants", defaultSummaryMerchants)
+		if merchants < 1 || merchants > maxReceiptPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("merchants must be between 1 and %d", maxReceiptPageSize),
+			})
+		}
+		dateCond, args, err := reportDateRange(c, "date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		summary, err := loadSpendingSummary(reportTransactionsTable(c), dateCond, args, merchants)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build summary report: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"summary": summary,
+		})
+	})
+
+	// Spend per merchant, broken down by branch for chain merchants
+	app.Get("/reports/merchants", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT COALESCE(merchant_clean, merchant_raw) AS merchant, `+branchLabelSQL+` AS branch,
+				MAX(store_address), COUNT(*), SUM(amount), AVG(amount), MIN(date), MAX(date)
+			FROM `+reportTransactionsTable(c)+`
+			WHERE COALESCE(merchant_clean, merchant_raw) IS NOT NULL AND `+dateCond+`
+			GROUP BY merchant, branch
+			ORDER BY merchant, SUM(amount) DESC`,
+			args...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build merchant report: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		merchants := []fiber.Map{}
+		var current fiber.Map
+		for rows.Next() {
+			var merchant string
+			var branch, address sql.NullString
+			var visits int
+			var total, avg sql.NullFloat64
+			var first, last sql.NullTime
+			if err := rows.Scan(&merchant, &branch, &address, &visits, &total, &avg, &first, &last); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read merchant report: %v", err),
+				})
+			}
+
+			if current == nil || current["merchant"] != merchant {
+				current = fiber.Map{
+					"merchant":    merchant,
+					"receipts":    0,
+					"total_spend": 0.0,
+					"branches":    []fiber.Map{},
+				}
+				merchants = append(merchants, current)
+			}
+			current["receipts"] = current["receipts"].(int) + visits
+			current["total_spend"] = current["total_spend"].(float64) + total.Float64
+
+			entry := fiber.Map{
+				"branch":         branch.String,
+				"store_address":  address.String,
+				"receipts":       visits,
+				"total_spend":    total.Float64,
+				"average_basket": avg.Float64,
+			}
+			if !branch.Valid {
+				entry["branch"] = nil
+			}
+			if first.Valid {
+				entry["first_visit"] = first.Time.Format("2006-01-02")
+				entry["last_visit"] = last.Time.Format("2006-01-02")
+			}
+			current["branches"] = append(current["branches"].([]fiber.Map), entry)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"merchants": merchants,
+		})
+	})
+
+	// Dining report with tip statistics
+	app.Get("/reports/dining", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		categories, categoryArgs := diningCategoryList()
+		args = append(categoryArgs, args...)
+
+		var (
+			count, tipped                   int
+			unusual                         sql.NullInt64
+			totalSpend, totalTips           sql.NullFloat64
+			avgBasket, avgTipPct, maxTipPct sql.NullFloat64
+		)
+		err = db.QueryRow(
+			`SELECT COUNT(*), SUM(amount), AVG(amount),
+				COUNT(tip_percentage), SUM(tip), AVG(tip_percentage), MAX(tip_percentage),
+				SUM(tip_unusual)
+			FROM `+reportTransactionsTable(c)+`
+			WHERE LOWER(category) IN (`+categories+`) AND `+dateCond,
+			args...,
+		).Scan(&count, &totalSpend, &avgBasket, &tipped, &totalTips, &avgTipPct, &maxTipPct, &unusual)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build dining report: %v", err),
+			})
+		}
+
+		// List the flagged receipts so they can be checked
+		rows, err := db.Query(
+			`SELECT id, receipt_id, date, merchant_clean, amount, subtotal, tip, tip_percentage
+			FROM `+reportTransactionsTable(c)+`
+			WHERE tip_unusual = TRUE AND LOWER(category) IN (`+categories+`) AND `+dateCond+`
+			ORDER BY date DESC`,
+			args...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list unusual tips: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		flagged := []fiber.Map{}
+		for rows.Next() {
+			var id, receiptID int64
+			var date sql.NullTime
+			var merchant sql.NullString
+			var amount, subtotal, tip, tipPct sql.NullFloat64
+			if err := rows.Scan(&id, &receiptID, &date, &merchant, &amount, &subtotal, &tip, &tipPct); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read unusual tips: %v", err),
+				})
+			}
+			entry := fiber.Map{
+				"transaction_id": id,
+				"receipt_id":     receiptID,
+				"merchant":       merchant.String,
+				"amount":         amount.Float64,
+				"subtotal":       subtotal.Float64,
+				"tip":            tip.Float64,
+				"tip_percentage": tipPct.Float64,
+			}
+			if date.Valid {
+				entry["date"] = date.Time.Format("2006-01-02")
+			}
+			flagged = append(flagged, entry)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"receipts":       count,
+			"total_spend":    totalSpend.Float64,
+			"average_basket": avgBasket.Float64,
+			"tips": fiber.Map{
+				"receipts_with_tip":  tipped,
+				"total":              totalTips.Float64,
+				"average_percentage": avgTipPct.Float64,
+				"max_percentage":     maxTipPct.Float64,
+				"unusual":            unusual.Int64,
+				"max_usual_percent":  maxUsualTipPercent(),
+				"flagged":            flagged,
+			},
+		})
+	})
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Errors of correctTransaction that callers answer with their own status
+var (
+	errTransactionNotFound = errors.New("transaction not found")
+	errTransactionInvoiced = errors.New("transaction is on an invoice")
+)
+
+// reviewStatuses are the receipt statuses a reviewer can set
+var reviewStatuses = []string{"processed", "needs_review", "error"}
+
+// TransactionCorrection holds the fields a reviewer corrects; nil fields
+// keep their stored value
+type TransactionCorrection struct {
+	Merchant *string  `json:"merchant"`
+	Category *string  `json:"category"`
+	Amount   *float64 `json:"amount"`
+	Currency *string  `json:"currency"`
+	// Date is YYYY-MM-DD
+	Date *string `json:"date"`
+}
+
+// empty reports whether the correction changes nothing
+func (c *TransactionCorrection) empty() bool {
+	return c.Merchant == nil && c.Category == nil && c.Amount == nil && c.Currency == nil && c.Date == nil
+}
+
+// normalize trims and upper-cases the values and checks them against the
+// transaction columns
+func (c *TransactionCorrection) normalize() error {
+	if c.Merchant != nil {
+		v := strings.TrimSpace(*c.Merchant)
+		if v == "" || len(v) > 255 {
+			return fmt.Errorf("merchant must be 1-255 characters")
+		}
+		c.Merchant = &v
+	}
+	if c.Category != nil {
+		v := strings.TrimSpace(*c.Category)
+		if v == "" || len(v) > 100 {
+			return fmt.Errorf("category must be 1-100 characters")
+		}
+		c.Category = &v
+	}
+	if c.Amount != nil {
+		if *c.Amount <= 0 || *c.Amount >= 1e8 {
+			return fmt.Errorf("amount must be positive and below 100000000")
+		}
+		v := roundCents(*c.Amount)
+		c.Amount = &v
+	}
+	if c.Currency != nil {
+		v := strings.ToUpper(strings.TrimSpace(*c.Currency))
+		if !iso4217Currencies[v] {
+			return fmt.Errorf("currency must be an ISO 4217 code such as EUR")
+		}
+		c.Currency = &v
+	}
+	if c.Date != nil {
+		if _, err := time.Parse("2006-01-02", *c.Date); err != nil {
+			return fmt.Errorf("date must be YYYY-MM-DD")
+		}
+	}
+	return nil
+}
+
+// correctTransaction applies a reviewer's correction. Changing the amount,
+// currency or date converts the amount to the home currency again; those
+// fields of invoiced transactions cannot change. A category correction
+// feeds the categorization review like PATCH /transactions/:id/category.
+func correctTransaction(id int64, corr TransactionCorrection) error {
+	var merchantID sql.NullInt64
+	if corr.Merchant != nil {
+		var err error
+		if merchantID, err = resolveMerchantID(&GeminiParsedData{MerchantClean: *corr.Merchant}); err != nil {
+			return err
+		}
+	}
+
+	return inTx("correct transaction", func(tx *sql.Tx) error {
+		var date sql.NullTime
+		var amount sql.NullFloat64
+		var currency sql.NullString
+		var invoiceID sql.NullInt64
+		err := tx.QueryRow(
+			"SELECT date, amount, currency, invoice_id FROM transactions WHERE id = ? FOR UPDATE", id,
+		).Scan(&date, &amount, &currency, &invoiceID)
+		if err == sql.ErrNoRows {
+			return errTransactionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var sets []string
+		var args []any
+		if corr.Merchant != nil {
+			sets = append(sets, "merchant_clean = ?", "merchant_id = ?")
+			args = append(args, *corr.Merchant, merchantID)
+		}
+		if corr.Category != nil {
+			sets = append(sets, "category = ?", "category_corrected = TRUE", "category_corrected_at = NOW()")
+			args = append(args, *corr.Category)
+		}
+
+		if corr.Amount != nil || corr.Currency != nil || corr.Date != nil {
+			if invoiceID.Valid {
+				return errTransactionInvoiced
+			}
+			if corr.Amount != nil {
+				amount = sql.NullFloat64{Float64: *corr.Amount, Valid: true}
+			}
+			if corr.Currency != nil {
+				currency = sql.NullString{String: *corr.Currency, Valid: true}
+			}
+			if corr.Date != nil {
+				t, _ := time.Parse("2006-01-02", *corr.Date)
+				date = sql.NullTime{Time: t, Valid: true}
+			}
+			conversionDate := time.Now()
+			if date.Valid {
+				conversionDate = date.Time
+			}
+			conversionStatus, homeAmount, err := convertToHome(amount.Float64, currency.String, conversionDate)
+			if err != nil {
+				return err
+			}
+			sets = append(sets, "date = ?", "amount = ?", "currency = ?", "home_amount = ?", "conversion_status = ?")
+			args = append(args, date, amount, currency, homeAmount, conversionStatus)
+		}
+
+		_, err = tx.Exec("UPDATE transactions SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...)
+		return err
+	})
+}
+
+// sendCorrectionError answers a failed correctTransaction
+func sendCorrectionError(c *fiber.Ctx, id int64, err error) error {
+	switch {
+	case errors.Is(err, errTransactionNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Transaction not found",
+		})
+	case errors.Is(err, errTransactionInvoiced):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("Transaction %d is on an invoice; only merchant and category can be corrected", id),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": fmt.Sprintf("Failed to correct transaction: %v", err),
+	})
+}
+
+// reviewedTransactionData loads a stored transaction in the shape the
+// pipeline checks extracted data in
+func reviewedTransactionData(id int64) (*GeminiParsedData, error) {
+	var date sql.NullTime
+	var merchantRaw, merchantClean, category, currency, reference sql.NullString
+	var amount sql.NullFloat64
+	var custom []byte
+	err := db.QueryRow(
+		`SELECT date, merchant_raw, merchant_clean, category, amount, currency, reference_number, custom_fields
+		FROM transactions WHERE id = ?`, id,
+	).Scan(&date, &merchantRaw, &merchantClean, &category, &amount, &currency, &reference, &custom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transaction %d: %v", id, err)
+	}
+	data := &GeminiParsedData{
+		MerchantRaw:     merchantRaw.String,
+		MerchantClean:   merchantClean.String,
+		Category:        category.String,
+		Amount:          amount.Float64,
+		Currency:        currency.String,
+		ReferenceNumber: reference.String,
+	}
+	if date.Valid {
+		data.Date = date.Time.Format("2006-01-02")
+	}
+	if len(custom) > 0 {
+		json.Unmarshal(custom, &data.Custom)
+	}
+	return data, nil
+}
+
+// approveReviewedReceipt marks a reviewed receipt processed the way the
+// pipeline does: its transaction must pass the submitter's expense policy,
+// and receipts an approval rule matches go to their approver instead. The
+// policy violations that keep the receipt unchanged are returned.
+func approveReviewedReceipt(receiptID, transactionID int64) ([]PolicyViolation, error) {
+	in := PipelineInput{ReceiptID: receiptID, TransactionID: transactionID, Tenant: defaultTenant}
+	err := db.QueryRow(
+		"SELECT tenant FROM ingest_jobs WHERE receipt_id = ? ORDER BY id DESC LIMIT 1", receiptID,
+	).Scan(&in.Tenant)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load last ingest job: %v", err)
+	}
+
+	data, err := reviewedTransactionData(transactionID)
+	if err != nil {
+		return nil, err
+	}
+	violations, err := checkExpensePolicy(in, transactionID, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 {
+		return violations, nil
+	}
+	if pending, err := requestApproval(in, transactionID, data); pending || err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(
+		"UPDATE receipts SET status = ?, verified_at = ? WHERE id = ?", "processed", time.Now(), receiptID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to update receipt: %v", err)
+	}
+	return nil, nil
+}
+
+// registerReviewRoutes adds the manual corrections of the review queue
+func registerReviewRoutes(app *fiber.App) {
+	// Correct merchant, category, amount, currency or date of a transaction
+	app.Patch("/transactions/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+		var corr TransactionCorrection
+		if err := json.Unmarshal(c.Body(), &corr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if corr.empty() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing to correct: set merchant, category, amount, currency or date",
+			})
+		}
+		if err := corr.normalize(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if err := correctTransaction(int64(id), corr); err != nil {
+			return sendCorrectionError(c, int64(id), err)
+		}
+		liveQueries.Invalidate()
+
+		t, err := scanTransactionSummary(db.QueryRow("SELECT "+transactionSummaryColumns+" FROM transactions WHERE id = ?", id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transaction: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"transaction": t,
+		})
+	})
+
+	// Correct the receipt's first transaction like PATCH /transactions/:id
+	// and/or set its status. Setting processed also marks the receipt as
+	// verified by a human, once its transaction passes the expense policy
+	// and any approval rule.
+	app.Patch("/receipts/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		var req struct {
+			TransactionCorrection
+			Status *string `json:"status"`
+		}
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if req.empty() && req.Status == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing to change: set status, merchant, category, amount, currency or date",
+			})
+		}
+		if req.Status != nil && !containsString(reviewStatuses, *req.Status) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("status must be one of %s", strings.Join(reviewStatuses, ", ")),
+			})
+		}
+		if err := req.normalize(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		var status string
+		var deletedAt sql.NullTime
+		err = db.QueryRow("SELECT status, deleted_at FROM receipts WHERE id = ?", id).Scan(&status, &deletedAt)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		// Queued receipts would be overwritten by the pipeline, approvals
+		// are decided through /approvals, and rejected or duplicate
+		// receipts stay out of the totals
+		if status == "pending" || status == "processing" || status == "pending_approval" ||
+			status == "rejected" || status == "duplicate" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("Receipt is %s and cannot be changed", status),
+			})
+		}
+		if deletedAt.Valid {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Receipt is in the trash; restore it first",
+			})
+		}
+
+		var transactionID int64
+		err = db.QueryRow("SELECT id FROM transactions WHERE receipt_id = ? ORDER BY id LIMIT 1", id).Scan(&transactionID)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transaction: %v", err),
+			})
+		}
+
+		if !req.empty() {
+			if transactionID == 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "Receipt has no transaction to correct",
+				})
+			}
+			if err := correctTransaction(transactionID, req.TransactionCorrection); err != nil {
+				return sendCorrectionError(c, transactionID, err)
+			}
+		}
+
+		if req.Status != nil && *req.Status == "processed" {
+			if transactionID == 0 {
+				liveQueries.Invalidate()
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "Receipt has no transaction and cannot be processed",
+				})
+			}
+			violations, err := approveReviewedReceipt(int64(id), transactionID)
+			liveQueries.Invalidate()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to process receipt: %v", err),
+				})
+			}
+			if len(violations) > 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error":             "Transaction violates the expense policy",
+					"policy_violations": violations,
+				})
+			}
+		} else if req.Status != nil {
+			if _, err := db.Exec("UPDATE receipts SET status = ? WHERE id = ?", *req.Status, id); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to update receipt: %v", err),
+				})
+			}
+		}
+		liveQueries.Invalidate()
+
+		r, err := scanReceiptSummary(db.QueryRow("SELECT "+receiptSummaryColumns+" FROM receipts WHERE id = ?", id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		receipts := []ReceiptSummary{r}
+		if err := addReceiptFields(receipts, map[string]bool{"transactions": true}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		newLocalizer(c).Receipts(receipts)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"receipt": receipts[0],
+		})
+	})
+}
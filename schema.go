@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SchemaField describes one column of an entity
+type SchemaField struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default"`
+	Key      string  `json:"key,omitempty"`
+	// Values lists the allowed values of enum and status columns
+	Values []string `json:"values,omitempty"`
+}
+
+// SchemaEntity is a table as clients see it
+type SchemaEntity struct {
+	Name   string        `json:"name"`
+	Fields []SchemaField `json:"fields"`
+}
+
+// columnValues are the allowed values of VARCHAR columns whose values are
+// fixed in code; real ENUM columns are read from the database
+func columnValues() map[string][]string {
+	profiles := []string{profileGeneric}
+	for _, p := range extractionProfiles {
+		profiles = append(profiles, p.Name)
+	}
+	return map[string][]string{
+		"receipts.priority":              priorityOrder,
+		"transactions.conversion_status": {conversionNotNeeded, conversionConverted, conversionPending},
+		"transactions.profile":           profiles,
+		"receipt_artifacts.kind":         {artifactRotation, artifactOCRText, artifactGeminiResponse},
+		"subscriptions.status":           {subscriptionActive, subscriptionCancelled},
+		"receipt_approvals.status":       {approvalPending, approvalApproved, approvalRejected},
+		"project_budget_alerts.kind":     {budgetAlertWarning, budgetAlertExceeded, budgetAlertForecast},
+	}
+}
+
+// parseEnumValues returns the values of an "enum('a','b')" column type
+func parseEnumValues(columnType string) []string {
+	if !strings.HasPrefix(columnType, "enum(") || !strings.HasSuffix(columnType, ")") {
+		return nil
+	}
+	var values []string
+	for _, v := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(columnType, "enum("), ")"), ",") {
+		values = append(values, strings.ReplaceAll(strings.Trim(v, "'"), "''", "'"))
+	}
+	return values
+}
+
+// loadSchemaEntities reads the columns of every table the service creates
+func loadSchemaEntities() ([]SchemaEntity, error) {
+	values := columnValues()
+	entities := make([]SchemaEntity, 0, len(schemaTables))
+	for _, table := range schemaTables {
+		rows, err := db.Query(
+			`SELECT column_name, column_type, is_nullable = 'YES', column_default, column_key
+			FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = ?
+			ORDER BY ordinal_position`,
+			table.Name,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %v", table.Name, err)
+		}
+
+		entity := SchemaEntity{Name: table.Name, Fields: []SchemaField{}}
+		for rows.Next() {
+			var f SchemaField
+			if err := rows.Scan(&f.Name, &f.Type, &f.Nullable, &f.Default, &f.Key); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan %s columns: %v", table.Name, err)
+			}
+			switch f.Key {
+			case "PRI":
+				f.Key = "primary"
+			case "UNI":
+				f.Key = "unique"
+			case "MUL":
+				f.Key = "index"
+			}
+			f.Values = parseEnumValues(f.Type)
+			if v, ok := values[table.Name+"."+f.Name]; ok {
+				f.Values = v
+			}
+			entity.Fields = append(entity.Fields, f)
+		}
+		rows.Close()
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// enabledModules reports which optional integrations are configured
+func enabledModules() map[string]bool {
+	return map[string]bool{
+		"paperless":  newPaperlessClient() != nil,
+		"firefly":    newFireflyClient() != nil,
+		"ynab":       loadYNABConfig() != nil,
+		"drive":      driveClient != nil,
+		"remote_ocr": remoteOCREndpoint() != "",
+		"local_ocr":  localOCRAvailable,
+		"email":      os.Getenv("SMTP_HOST") != "" && os.Getenv("NOTIFY_EMAIL_TO") != "",
+		"webhooks":   os.Getenv("WEBHOOK_URL") != "",
+	}
+}
+
+// registerSchemaRoutes adds the data dictionary endpoint
+func registerSchemaRoutes(app *fiber.App) {
+	// Entity schemas with column types and allowed values, the webhook
+	// events, extraction profiles and which optional modules are enabled
+	app.Get("/schema", func(c *fiber.Ctx) error {
+		entities, err := loadSchemaEntities()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"entities":       entities,
+			"webhook_events": webhookEventTypes,
+			"profiles":       extractionProfiles,
+			"custom_fields":  customFields,
+			"home_currency":  homeCurrency(),
+			"modules":        enabledModules(),
+		})
+	})
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxSESMessageSize caps the size of an email read from the inbound bucket
+const maxSESMessageSize = 40 << 20
+
+// maxEmailDepth caps how deeply nested multiparts and forwarded messages
+// are searched for attachments
+const maxEmailDepth = 5
+
+// minInlineImageSize is the size below which inline images are taken for
+// logos and signature images rather than receipts
+const minInlineImageSize = 10 << 10
+
+// sesSetupObject is the test object SES writes when a receipt rule with an
+// S3 action is created
+const sesSetupObject = "AMAZON_SES_SETUP_NOTIFICATION"
+
+// emailContentTypes map the content types of attachments without a usable
+// file name to an extension
+var emailContentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// SESInbox reads the emails SES stores in an S3 bucket with a receipt rule
+// S3 action and ingests their attachments
+type SESInbox struct {
+	store  *S3Storage
+	bucket string
+	prefix string
+	// deleteProcessed removes an email from the bucket once it is imported
+	deleteProcessed bool
+	// topicARN is the only SNS topic notifications are accepted from; the
+	// notification endpoint is disabled without it
+	topicARN string
+}
+
+// newSESInbox configures the inbox from SES_S3_BUCKET, SES_S3_PREFIX,
+// SES_S3_REGION (default S3_REGION), SES_S3_ENDPOINT, SES_DELETE_PROCESSED
+// and SES_SNS_TOPIC_ARN. It returns nil when SES_S3_BUCKET is not set.
+func newSESInbox() (*SESInbox, error) {
+	bucket := os.Getenv("SES_S3_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	prefix := os.Getenv("SES_S3_PREFIX")
+	store, err := newS3Bucket(bucket, firstEnv("SES_S3_REGION", "S3_REGION"), os.Getenv("SES_S3_ENDPOINT"), prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &SESInbox{
+		store:           store,
+		bucket:          bucket,
+		prefix:          prefix,
+		deleteProcessed: os.Getenv("SES_DELETE_PROCESSED") == "true",
+		topicARN:        os.Getenv("SES_SNS_TOPIC_ARN"),
+	}, nil
+}
+
+// emailAttachment is a receipt file found in an email
+type emailAttachment struct {
+	Name string
+	Ext  string
+	Data []byte
+}
+
+// inboundEmail is what an email contributes to ingest
+type inboundEmail struct {
+	MessageID   string
+	From        string
+	Subject     string
+	Attachments []emailAttachment
+}
+
+// parseInboundEmail reads a raw MIME message and collects the receipt
+// files attached to it, including those of forwarded messages
+func parseInboundEmail(raw []byte) (*inboundEmail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email: %v", err)
+	}
+	dec := new(mime.WordDecoder)
+	decode := func(s string) string {
+		if d, err := dec.DecodeHeader(s); err == nil {
+			return d
+		}
+		return s
+	}
+	email := &inboundEmail{
+		MessageID: strings.Trim(msg.Header.Get("Message-Id"), "<> "),
+		From:      decode(msg.Header.Get("From")),
+		Subject:   decode(msg.Header.Get("Subject")),
+	}
+	if err := collectAttachments(msg.Header.Get, msg.Body, email, 0); err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+// collectAttachments walks one MIME entity, given its header lookup and
+// raw body, and appends the receipt files found in it
+func collectAttachments(header func(string) string, body io.Reader, email *inboundEmail, depth int) error {
+	if depth > maxEmailDepth {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(header("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read email part: %v", err)
+			}
+			if err := collectAttachments(part.Header.Get, part, email, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	// Forwarded emails carry the original, with its attachments, as a part
+	if mediaType == "message/rfc822" {
+		msg, err := mail.ReadMessage(body)
+		if err != nil {
+			return nil
+		}
+		return collectAttachments(msg.Header.Get, msg.Body, email, depth+1)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if d, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = d
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if !ingestExtensions[ext] {
+		if ext = emailContentTypes[mediaType]; ext == "" {
+			return nil
+		}
+	}
+	if name == "" && disposition != "attachment" {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, maxBatchEntrySize+1))
+	if err != nil {
+		return fmt.Errorf("failed to decode attachment %s: %v", name, err)
+	}
+	if len(data) > maxBatchEntrySize {
+		log.Printf("SES: skipping attachment %s larger than %d MB", name, maxBatchEntrySize>>20)
+		return nil
+	}
+	// Logos and signature images are embedded inline by Content-ID
+	if disposition != "attachment" && header("Content-Id") != "" && strings.HasPrefix(mediaType, "image/") &&
+		len(data) < minInlineImageSize {
+		return nil
+	}
+	if name == "" {
+		name = "attachment" + ext
+	}
+	if len(email.Attachments) >= maxBatchFiles {
+		return nil
+	}
+	email.Attachments = append(email.Attachments, emailAttachment{Name: name, Ext: ext, Data: data})
+	return nil
+}
+
+// SESImportResult is the outcome of importing emails from the bucket
+type SESImportResult struct {
+	Emails   int     `json:"emails"`
+	Imported []int64 `json:"imported_receipt_ids"`
+	// Quarantined counts attachments that failed screening
+	Quarantined int `json:"quarantined"`
+	Skipped     int `json:"skipped"`
+	Failed      int `json:"failed"`
+}
+
+// sesImportMu keeps polling and SNS notifications from importing the same
+// email twice
+var sesImportMu sync.Mutex
+
+// sesObjectHash keys an object in ses_messages; object keys can be longer
+// than an index allows
+func sesObjectHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// importObjects imports the emails stored under the given keys (relative
+// to the inbox prefix). Emails are recorded in ses_messages so they are
+// only imported once, even when that fails.
+func (s *SESInbox) importObjects(keys []string) (*SESImportResult, error) {
+	sesImportMu.Lock()
+	defer sesImportMu.Unlock()
+
+	res := &SESImportResult{Imported: []int64{}}
+	for _, key := range keys {
+		if key == "" || strings.HasSuffix(key, "/") || strings.HasSuffix(key, sesSetupObject) {
+			continue
+		}
+		var seen bool
+		if err := db.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM ses_messages WHERE object_hash = ?)", sesObjectHash(key),
+		).Scan(&seen); err != nil {
+			return res, fmt.Errorf("failed to check email %s: %v", key, err)
+		}
+		if seen {
+			res.Skipped++
+			continue
+		}
+		// The remaining emails are picked up by the next poll
+		if err := diskSpace.Guard(); err != nil {
+			return res, err
+		}
+
+		res.Emails++
+		email, receiptIDs, quarantined, err := s.importObject(key)
+		res.Imported = append(res.Imported, receiptIDs...)
+		res.Quarantined += quarantined
+		status, errMsg := "imported", ""
+		switch {
+		case err != nil:
+			log.Printf("SES: email %s: %v", key, err)
+			status, errMsg = "failed", err.Error()
+			res.Failed++
+		case len(receiptIDs) == 0 && quarantined == 0:
+			status = "no_attachments"
+		}
+
+		var messageID, from, subject string
+		if email != nil {
+			messageID, from, subject = email.MessageID, email.From, email.Subject
+		}
+		ids, _ := json.Marshal(receiptIDs)
+		if _, err := db.Exec(
+			`INSERT INTO ses_messages (object_hash, object_key, message_id, sender, subject, status, receipt_ids, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			sesObjectHash(key), truncate(key, 1024),
+			sql.NullString{String: truncate(messageID, 255), Valid: messageID != ""},
+			sql.NullString{String: truncate(from, 255), Valid: from != ""},
+			sql.NullString{String: truncate(subject, 512), Valid: subject != ""},
+			status, ids, sql.NullString{String: errMsg, Valid: errMsg != ""},
+		); err != nil {
+			return res, fmt.Errorf("failed to record email %s: %v", key, err)
+		}
+
+		if s.deleteProcessed && err == nil {
+			if err := s.store.Delete(key); err != nil {
+				log.Printf("SES: failed to delete email %s: %v", key, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+// importObject downloads one email and queues its attachments as receipts
+// from the email channel. It returns the queued receipts and how many
+// attachments were quarantined.
+func (s *SESInbox) importObject(key string) (*inboundEmail, []int64, int, error) {
+	r, err := s.store.Open(key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	raw, err := io.ReadAll(io.LimitReader(r, maxSESMessageSize+1))
+	r.Close()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to download email: %v", err)
+	}
+	if len(raw) > maxSESMessageSize {
+		return nil, nil, 0, fmt.Errorf("email is larger than %d MB", maxSESMessageSize>>20)
+	}
+	email, err := parseInboundEmail(raw)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	source := fmt.Sprintf("s3://%s/%s%s", s.bucket, s.prefix, key)
+	title := email.Subject
+	if title == "" {
+		title = email.From
+	}
+	receiptIDs := []int64{}
+	quarantined := 0
+	for _, a := range email.Attachments {
+		storedName := newUploadName(a.Ext)
+		if err := os.WriteFile(filepath.Join(uploadsDir, storedName), a.Data, 0644); err != nil {
+			return email, receiptIDs, quarantined, fmt.Errorf("failed to save attachment %s: %v", a.Name, err)
+		}
+		in := PipelineInput{
+			IsPDF:    a.Ext == ".pdf",
+			Priority: priorityNormal,
+			Tenant:   defaultTenant,
+		}
+		quarantineID, reason, err := quarantineUpload(storedName, a.Name, channelEmail, in)
+		if err != nil {
+			return email, receiptIDs, quarantined, err
+		}
+		if reason != "" {
+			log.Printf("SES: attachment %s of email %s quarantined as %d (%s)", a.Name, key, quarantineID, reason)
+			quarantined++
+			continue
+		}
+		receiptID, _, err := queueUploadedReceipt(storedName, channelEmail, in)
+		if err != nil {
+			return email, receiptIDs, quarantined, fmt.Errorf("failed to queue attachment %s: %v", a.Name, err)
+		}
+		receiptIDs = append(receiptIDs, receiptID)
+		if _, err := execWithRetry(
+			"UPDATE receipts SET source_url = ?, source_title = ? WHERE id = ?",
+			truncate(source, 2048), sql.NullString{String: truncate(title, 512), Valid: title != ""}, receiptID,
+		); err != nil {
+			log.Printf("SES: failed to record the source of receipt %d: %v", receiptID, err)
+		}
+	}
+	return email, receiptIDs, quarantined, nil
+}
+
+// sync imports every email in the bucket that was not imported before
+func (s *SESInbox) sync() (*SESImportResult, error) {
+	keys, err := s.store.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list inbound emails: %v", err)
+	}
+	return s.importObjects(keys)
+}
+
+// startSESScheduler polls the inbound email bucket every SES_POLL_INTERVAL
+// (default 5m, "off" disables it, e.g. when SNS notifications are used)
+func startSESScheduler() {
+	inbox, err := newSESInbox()
+	if err != nil {
+		log.Printf("SES: %v, inbound email disabled", err)
+		return
+	}
+	if inbox == nil {
+		return
+	}
+	intervalStr := os.Getenv("SES_POLL_INTERVAL")
+	if intervalStr == "off" {
+		return
+	}
+	interval := 5 * time.Minute
+	if intervalStr != "" {
+		v, err := time.ParseDuration(intervalStr)
+		if err != nil || v <= 0 {
+			log.Printf("SES: invalid SES_POLL_INTERVAL %q, polling disabled", intervalStr)
+			return
+		}
+		interval = v
+	}
+
+	log.Printf("SES: importing emails from s3://%s/%s every %v", inbox.bucket, inbox.prefix, interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			res, err := inbox.sync()
+			if err != nil {
+				log.Printf("SES: sync failed: %v", err)
+				continue
+			}
+			if res.Emails > 0 {
+				log.Printf("SES: %d email(s), %d receipt(s) queued, %d failed", res.Emails, len(res.Imported), res.Failed)
+			}
+		}
+	}()
+}
+
+// snsMessage is an Amazon SNS HTTP(S) delivery
+type snsMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SubscribeURL     string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+}
+
+// snsCertHost matches the hosts SNS serves its signing certificates from
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsCerts caches signing certificates by URL
+var snsCerts sync.Map
+
+// snsCertificate downloads the certificate a message was signed with,
+// only from SNS itself
+func snsCertificate(certURL string) (*x509.Certificate, error) {
+	if cert, ok := snsCerts.Load(certURL); ok {
+		return cert.(*x509.Certificate), nil
+	}
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Host) || !strings.HasSuffix(u.Path, ".pem") {
+		return nil, fmt.Errorf("signing certificate %q is not served by SNS", certURL)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(certURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download signing certificate: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signing certificate download returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download signing certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing certificate: %v", err)
+	}
+	snsCerts.Store(certURL, cert)
+	return cert, nil
+}
+
+// verify checks the signature of an SNS message
+func (m *snsMessage) verify() error {
+	var b strings.Builder
+	field := func(name, value string) {
+		b.WriteString(name + "\n" + value + "\n")
+	}
+	field("Message", m.Message)
+	field("MessageId", m.MessageId)
+	switch m.Type {
+	case "Notification":
+		if m.Subject != "" {
+			field("Subject", m.Subject)
+		}
+		field("Timestamp", m.Timestamp)
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		field("SubscribeURL", m.SubscribeURL)
+		field("Timestamp", m.Timestamp)
+		field("Token", m.Token)
+	default:
+		return fmt.Errorf("unknown message type %q", m.Type)
+	}
+	field("TopicArn", m.TopicArn)
+	field("Type", m.Type)
+
+	var hash crypto.Hash
+	var digest []byte
+	switch m.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(b.String()))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(b.String()))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("unsupported signature version %q", m.SignatureVersion)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	cert, err := snsCertificate(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("signing certificate has no RSA key")
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// objectKeys returns the keys of inbound emails announced by a
+// notification, relative to the inbox prefix. Both SES receipt
+// notifications (S3 action with an SNS topic) and S3 event notifications
+// are understood.
+func (s *SESInbox) objectKeys(message string) []string {
+	var payload struct {
+		Receipt struct {
+			Action struct {
+				Type       string `json:"type"`
+				BucketName string `json:"bucketName"`
+				ObjectKey  string `json:"objectKey"`
+			} `json:"action"`
+		} `json:"receipt"`
+		Records []struct {
+			S3 struct {
+				Bucket struct {
+					Name string `json:"name"`
+				} `json:"bucket"`
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal([]byte(message), &payload); err != nil {
+		return nil
+	}
+
+	var keys []string
+	add := func(bucket, key string) {
+		if bucket == s.bucket && strings.HasPrefix(key, s.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, s.prefix))
+		}
+	}
+	if a := payload.Receipt.Action; a.Type == "S3" {
+		add(a.BucketName, a.ObjectKey)
+	}
+	for _, r := range payload.Records {
+		// S3 events form-encode their keys
+		if key, err := url.QueryUnescape(r.S3.Object.Key); err == nil {
+			add(r.S3.Bucket.Name, key)
+		}
+	}
+	return keys
+}
+
+// sesNotificationPath receives SNS notifications without credentials, so
+// it is exempt from authentication
+const sesNotificationPath = "/integrations/ses/sns"
+
+// registerSESRoutes adds the SNS notification endpoint and the manual sync
+// of the inbound email bucket
+func registerSESRoutes(app *fiber.App) {
+	// SNS posts new emails here; the subscription is confirmed on the
+	// first request. Messages must carry a valid SNS signature and come
+	// from SES_SNS_TOPIC_ARN, since any AWS account can sign SNS messages.
+	app.Post(sesNotificationPath, func(c *fiber.Ctx) error {
+		inbox, err := newSESInbox()
+		if err != nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if inbox == nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Inbound email is not configured (SES_S3_BUCKET)",
+			})
+		}
+		if inbox.topicARN == "" {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "SNS notifications are not configured (SES_SNS_TOPIC_ARN)",
+			})
+		}
+
+		var m snsMessage
+		if err := json.Unmarshal(c.Body(), &m); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid SNS message",
+			})
+		}
+		if err := m.verify(); err != nil {
+			log.Printf("SES: rejected SNS message: %v", err)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid SNS message: %v", err),
+			})
+		}
+		if m.TopicArn != inbox.topicARN {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Unexpected SNS topic",
+			})
+		}
+
+		switch m.Type {
+		case "SubscriptionConfirmation":
+			u, err := url.Parse(m.SubscribeURL)
+			if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Host) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid subscribe URL",
+				})
+			}
+			resp, err := (&http.Client{Timeout: 10 * time.Second}).Get(m.SubscribeURL)
+			if err != nil {
+				return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to confirm subscription: %v", err),
+				})
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+					"error": fmt.Sprintf("Subscription confirmation returned %d", resp.StatusCode),
+				})
+			}
+			log.Printf("SES: confirmed SNS subscription to %s", m.TopicArn)
+			return c.JSON(fiber.Map{"success": true, "confirmed": true})
+		case "Notification":
+			keys := inbox.objectKeys(m.Message)
+			if len(keys) > 0 {
+				// Imported in the background so SNS does not time out and
+				// retry
+				go func() {
+					if _, err := inbox.importObjects(keys); err != nil {
+						log.Printf("SES: %v", err)
+					}
+				}()
+			}
+			return c.JSON(fiber.Map{"success": true, "emails": len(keys)})
+		}
+		return c.JSON(fiber.Map{"success": true})
+	})
+
+	// Imports every email in the bucket that was not imported before
+	app.Post("/integrations/ses/sync", func(c *fiber.Ctx) error {
+		inbox, err := newSESInbox()
+		if err != nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if inbox == nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Inbound email is not configured (SES_S3_BUCKET)",
+			})
+		}
+		res, err := inbox.sync()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":  err.Error(),
+				"result": res,
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"result":  res,
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// NotificationSettings chooses which webhooks are sent for a user's receipts
+type NotificationSettings struct {
+	ReceiptProcessed bool `json:"receipt_processed"`
+	AnomalyDetected  bool `json:"anomaly_detected"`
+}
+
+// UserSettings are per-user defaults applied while processing receipts. The
+// user is the tenant of the request (see tenantKey).
+type UserSettings struct {
+	// DefaultCurrency is assumed when a receipt shows no currency
+	DefaultCurrency string `json:"default_currency"`
+	// HomeCountry settles DD/MM vs MM/DD dates when the merchant country is
+	// unknown; empty falls back to DEFAULT_COUNTRY
+	HomeCountry string `json:"home_country"`
+	// Locale is the language of category and status labels when a request
+	// has no Accept-Language header the labels exist for, e.g. "de"
+	Locale string `json:"locale"`
+	// AutoApproveThreshold is the Gemini confidence a receipt needs to be
+	// marked processed without review; 0 approves every clean receipt
+	AutoApproveThreshold float64              `json:"auto_approve_threshold"`
+	Notifications        NotificationSettings `json:"notifications"`
+	// DefaultTags are added to every receipt the user ingests
+	DefaultTags []string `json:"default_tags"`
+}
+
+// maxTagLength matches the receipt_tags.tag column
+const maxTagLength = 64
+
+// builtinUserSettings applies to users without stored settings
+func builtinUserSettings() UserSettings {
+	return UserSettings{
+		Notifications: NotificationSettings{ReceiptProcessed: true, AnomalyDetected: true},
+		DefaultTags:   []string{},
+	}
+}
+
+// normalize upper-cases codes, cleans up tags and checks the values
+func (s *UserSettings) normalize() error {
+	s.DefaultCurrency = strings.ToUpper(strings.TrimSpace(s.DefaultCurrency))
+	if s.DefaultCurrency != "" && !iso4217Currencies[s.DefaultCurrency] {
+		return fmt.Errorf("default_currency must be an ISO 4217 code such as EUR")
+	}
+	s.HomeCountry = strings.ToUpper(strings.TrimSpace(s.HomeCountry))
+	if s.HomeCountry != "" && !countryCodePattern.MatchString(s.HomeCountry) {
+		return fmt.Errorf("home_country must be an ISO 3166-1 alpha-2 code such as GB")
+	}
+	s.Locale = normalizeLocale(s.Locale)
+	if s.Locale != "" && !localePattern.MatchString(s.Locale) {
+		return fmt.Errorf("locale must be a language tag such as de or pt-BR")
+	}
+	if s.AutoApproveThreshold < 0 || s.AutoApproveThreshold > 1 {
+		return fmt.Errorf("auto_approve_threshold must be between 0 and 1")
+	}
+
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, tag := range s.DefaultTags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	s.DefaultTags = tags
+	return nil
+}
+
+// loadUserSettings returns the stored settings of a user, or the built-in
+// defaults
+func loadUserSettings(tenant string) UserSettings {
+	settings := builtinUserSettings()
+	var raw []byte
+	err := db.QueryRow("SELECT settings FROM user_settings WHERE tenant_key = ?", tenant).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return settings
+	}
+	if err != nil {
+		log.Printf("Failed to load settings for %s: %v", tenant, err)
+		return settings
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		log.Printf("Invalid settings for %s: %v", tenant, err)
+		return builtinUserSettings()
+	}
+	return settings
+}
+
+// saveUserSettings stores the settings of a user
+func saveUserSettings(tenant string, settings UserSettings) error {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO user_settings (tenant_key, settings) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE settings = VALUES(settings)`,
+		tenant, raw,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save user settings: %v", err)
+	}
+	return nil
+}
+
+// addReceiptTags tags a receipt, ignoring tags it already has
+func addReceiptTags(receiptID int64, tags []string) error {
+	for _, tag := range tags {
+		if _, err := db.Exec("INSERT IGNORE INTO receipt_tags (receipt_id, tag) VALUES (?, ?)", receiptID, tag); err != nil {
+			return fmt.Errorf("failed to tag receipt %d: %v", receiptID, err)
+		}
+	}
+	return nil
+}
+
+// registerSettingsRoutes adds endpoints to view and change the calling
+// user's default settings
+func registerSettingsRoutes(app *fiber.App) {
+	app.Get("/me/settings", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"tenant":   tenant,
+			"settings": loadUserSettings(tenant),
+		})
+	})
+
+	// Fields missing from the body keep their current value
+	app.Put("/me/settings", func(c *fiber.Ctx) error {
+		tenant := tenantKey(c)
+		settings := loadUserSettings(tenant)
+		if err := json.Unmarshal(c.Body(), &settings); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if err := settings.normalize(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if err := saveUserSettings(tenant, settings); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"tenant":   tenant,
+			"settings": settings,
+		})
+	})
+}
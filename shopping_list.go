@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxShoppingListItems caps the entries of one shopping list
+const maxShoppingListItems = 200
+
+// minItemMatch is the share of a list entry's words that must be found in
+// a receipt item for the two to match
+const minItemMatch = 0.5
+
+// ShoppingListItem is an entry of a shopping list
+type ShoppingListItem struct {
+	Name string `json:"name"`
+	// Quantity is the number of pieces wanted, 0 when not given
+	Quantity float64 `json:"quantity"`
+}
+
+// ReconciledItem is a shopping list entry found on the receipt
+type ReconciledItem struct {
+	ShoppingListItem
+	// Items are the receipt items bought for the entry
+	Items          []TransactionItem `json:"items"`
+	BoughtQuantity float64           `json:"bought_quantity"`
+	Total          float64           `json:"total"`
+	// Short is set when fewer pieces were bought than listed
+	Short bool `json:"short"`
+}
+
+// ShoppingListReconciliation compares a shopping list with a receipt
+type ShoppingListReconciliation struct {
+	Bought  []ReconciledItem   `json:"bought"`
+	Missing []ShoppingListItem `json:"missing"`
+	// Extra are receipt items that are not on the list
+	Extra      []TransactionItem `json:"extra"`
+	ExtraTotal float64           `json:"extra_total"`
+}
+
+// listLeadingQuantity splits a shopping list line into a leading quantity
+// like 2, 2x or 2 x and the item
+var listLeadingQuantity = regexp.MustCompile(`(?i)^(\d+)(?:\s*[x×])?\s+(\S.*)$`)
+
+// listTrailingQuantity finds a trailing quantity like "x2"
+var listTrailingQuantity = regexp.MustCompile(`(?i)\s+[x×]\s*(\d+)$`)
+
+// parseShoppingList reads a shopping list with one entry per line, or
+// comma-separated on a single line. Bullets and checkboxes as written by
+// list apps are ignored.
+func parseShoppingList(text string) []ShoppingListItem {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if len(lines) == 1 {
+		lines = strings.Split(lines[0], ",")
+	}
+	var items []ShoppingListItem
+	for _, line := range lines {
+		if item, ok := parseShoppingListEntry(line); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseShoppingListEntry reads one shopping list entry with an optional
+// quantity like "2 eggs", "2x eggs" or "eggs x2"
+func parseShoppingListEntry(line string) (ShoppingListItem, bool) {
+	line = strings.TrimLeft(strings.TrimSpace(line), "-*•·▢☐☑✓✔ \t")
+	for _, box := range []string{"[ ]", "[x]", "[X]"} {
+		line = strings.TrimSpace(strings.TrimPrefix(line, box))
+	}
+	if line == "" {
+		return ShoppingListItem{}, false
+	}
+	item := ShoppingListItem{Name: line}
+	// A leading package size like "500 g flour" stays part of the name
+	if loc := measurePattern.FindStringIndex(line); loc != nil && loc[0] == 0 {
+		return item, true
+	}
+	if m := listLeadingQuantity.FindStringSubmatch(line); m != nil {
+		item.Quantity, _ = strconv.ParseFloat(m[1], 64)
+		item.Name = strings.TrimSpace(m[2])
+	} else if m := listTrailingQuantity.FindStringSubmatch(line); m != nil {
+		item.Quantity, _ = strconv.ParseFloat(m[1], 64)
+		item.Name = strings.TrimSpace(line[:len(line)-len(m[0])])
+	}
+	return item, true
+}
+
+// itemWords splits an item name into lower-case words, leaving out sizes
+// and other numbers
+func itemWords(name string) []string {
+	name = measurePattern.ReplaceAllString(strings.ToLower(name), " ")
+	var words []string
+	for _, w := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len([]rune(w)) >= 2 {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// wordsMatch compares two words allowing for plurals and the abbreviations
+// printed on receipts: one must start with the other's first letters,
+// at least three of them
+func wordsMatch(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) > len(rb) {
+		ra, rb = rb, ra
+	}
+	return len(ra) >= 3 && strings.HasPrefix(string(rb), string(ra))
+}
+
+// itemMatchScore is the share of the list entry's words found in the
+// receipt item's words
+func itemMatchScore(listWords, receiptWords []string) float64 {
+	if len(listWords) == 0 {
+		return 0
+	}
+	found := 0
+	for _, lw := range listWords {
+		for _, rw := range receiptWords {
+			if wordsMatch(lw, rw) {
+				found++
+				break
+			}
+		}
+	}
+	return float64(found) / float64(len(listWords))
+}
+
+// reconcileShoppingList matches shopping list entries with receipt items.
+// Each receipt item is assigned to the entry it matches best; an entry can
+// be bought as several items, e.g. two kinds of apples.
+func reconcileShoppingList(list []ShoppingListItem, items []TransactionItem) *ShoppingListReconciliation {
+	listWords := make([][]string, len(list))
+	for i, entry := range list {
+		listWords[i] = itemWords(entry.Name)
+	}
+
+	assigned := make([][]TransactionItem, len(list))
+	result := &ShoppingListReconciliation{
+		Bought:  []ReconciledItem{},
+		Missing: []ShoppingListItem{},
+		Extra:   []TransactionItem{},
+	}
+	for _, it := range items {
+		var receiptWords []string
+		if it.Description != nil {
+			receiptWords = itemWords(*it.Description)
+		}
+		best, bestScore := -1, minItemMatch
+		for i := range list {
+			if score := itemMatchScore(listWords[i], receiptWords); score >= bestScore && (best < 0 || score > bestScore) {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			result.Extra = append(result.Extra, it)
+			result.ExtraTotal = roundCents(result.ExtraTotal + it.Total)
+			continue
+		}
+		assigned[best] = append(assigned[best], it)
+	}
+
+	for i, entry := range list {
+		if len(assigned[i]) == 0 {
+			result.Missing = append(result.Missing, entry)
+			continue
+		}
+		r := ReconciledItem{ShoppingListItem: entry, Items: assigned[i]}
+		pieces := true
+		for _, it := range assigned[i] {
+			r.Total = roundCents(r.Total + it.Total)
+			r.BoughtQuantity += it.Quantity
+			if it.CanonicalUnit != nil && *it.CanonicalUnit != unitPieces {
+				pieces = false
+			}
+		}
+		r.Short = pieces && entry.Quantity > 0 && r.BoughtQuantity < entry.Quantity
+		result.Bought = append(result.Bought, r)
+	}
+	sort.SliceStable(result.Extra, func(i, j int) bool { return result.Extra[i].Total > result.Extra[j].Total })
+	return result
+}
+
+// shoppingListRequest reads a shopping list from a text/plain body, or
+// from JSON with either text or an items list as sent by list apps
+func shoppingListRequest(c *fiber.Ctx) ([]ShoppingListItem, error) {
+	var list []ShoppingListItem
+	if strings.HasPrefix(c.Get("Content-Type"), "text/plain") {
+		list = parseShoppingList(string(c.Body()))
+	} else {
+		var body struct {
+			Text  string            `json:"text"`
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return nil, fmt.Errorf("invalid request body")
+		}
+		list = parseShoppingList(body.Text)
+		for _, raw := range body.Items {
+			// Entries are names or {"name": ..., "quantity": ...}
+			var name string
+			if err := json.Unmarshal(raw, &name); err == nil {
+				if entry, ok := parseShoppingListEntry(name); ok {
+					list = append(list, entry)
+				}
+				continue
+			}
+			var entry ShoppingListItem
+			if err := json.Unmarshal(raw, &entry); err != nil || strings.TrimSpace(entry.Name) == "" {
+				return nil, fmt.Errorf("items must be names or objects with a name")
+			}
+			entry.Name = strings.TrimSpace(entry.Name)
+			list = append(list, entry)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("the shopping list is empty")
+	}
+	if len(list) > maxShoppingListItems {
+		return nil, fmt.Errorf("the shopping list has more than %d entries", maxShoppingListItems)
+	}
+	return list, nil
+}
+
+// registerShoppingListRoutes adds the reconciliation of a shopping list
+// with a receipt's line items
+func registerShoppingListRoutes(app *fiber.App) {
+	// Compare a shopping list with what a transaction's receipt shows was
+	// bought. Nothing is stored.
+	app.Post("/transactions/:id/shopping-list", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid transaction ID",
+			})
+		}
+		list, err := shoppingListRequest(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		var currency sql.NullString
+		err = db.QueryRow("SELECT currency FROM "+transactionsAllView+" WHERE id = ?", id).Scan(&currency)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Transaction not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transaction: %v", err),
+			})
+		}
+		byTransaction, err := loadTransactionItems([]int64{int64(id)})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		items := byTransaction[int64(id)]
+		if len(items) == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "The transaction has no line items; enable the line_items stage and analyze the receipt again",
+			})
+		}
+
+		result := reconcileShoppingList(list, items)
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"transaction_id": id,
+			"currency":       nullStringPtr(currency),
+			"summary": fiber.Map{
+				"listed":  len(list),
+				"bought":  len(result.Bought),
+				"missing": len(result.Missing),
+				"extra":   len(result.Extra),
+			},
+			"reconciliation": result,
+		})
+	})
+}
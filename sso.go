@@ -0,0 +1,960 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Roles of signed-in users. Viewers can only read, members can also submit
+// and review receipts, admins can change configuration.
+const (
+	roleAdmin  = "admin"
+	roleMember = "member"
+	roleViewer = "viewer"
+)
+
+// userRoles are ordered from most to least privileged
+var userRoles = []string{roleAdmin, roleMember, roleViewer}
+
+// sessionCookie holds the session token of a signed-in user
+const sessionCookie = "receipt_session"
+
+// oidcLoginTimeout is how long a started login may take at the identity
+// provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// adminWritePaths are configuration endpoints only admins may change; all
+// of /admin/ is admin-only as well. /webhooks/test is among them because it
+// posts to any URL given, signed with WEBHOOK_SECRETS.
+var adminWritePaths = []string{
+	"/pipeline/config", "/policy", "/approvals/rules", "/webhooks/subscriptions", "/webhooks/test",
+	"/integrations/", "/exchange-rates", "/tax/mappings",
+}
+
+// oidcDiscovery is the part of the provider's discovery document the login
+// needs
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider signs users in with an OpenID Connect identity provider
+// using the authorization code flow with PKCE
+type OIDCProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+	// groupsClaim is the ID token claim listing the user's groups; dots
+	// address nested claims such as realm_access.roles
+	groupsClaim string
+	// roleMap assigns a role to members of a group
+	roleMap map[string]string
+	// defaultRole is given to users in no mapped group; empty refuses them
+	defaultRole string
+	sessionTTL  time.Duration
+	http        *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// oidcProvider is set on startup when OIDC_ISSUER is configured
+var oidcProvider *OIDCProvider
+
+// newOIDCProvider returns a provider for OIDC_ISSUER, or nil when it is not
+// set. OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL (this
+// server's /auth/callback) are required.
+func newOIDCProvider() (*OIDCProvider, error) {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	p := &OIDCProvider{
+		issuer:       issuer,
+		clientID:     os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:       os.Getenv("OIDC_SCOPES"),
+		groupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		defaultRole:  strings.ToLower(strings.TrimSpace(os.Getenv("OIDC_DEFAULT_ROLE"))),
+		sessionTTL:   12 * time.Hour,
+		http:         &http.Client{Timeout: 15 * time.Second},
+	}
+	if p.clientID == "" || p.clientSecret == "" || p.redirectURL == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER is set but OIDC_CLIENT_ID, OIDC_CLIENT_SECRET or OIDC_REDIRECT_URL is not")
+	}
+	if p.scopes == "" {
+		p.scopes = "openid email profile"
+	}
+	if p.groupsClaim == "" {
+		p.groupsClaim = "groups"
+	}
+	if p.defaultRole != "" && !containsString(userRoles, p.defaultRole) {
+		return nil, fmt.Errorf("invalid OIDC_DEFAULT_ROLE %q, expected %s", p.defaultRole, strings.Join(userRoles, ", "))
+	}
+	roleMap, err := parseRoleMap(os.Getenv("OIDC_ROLE_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC_ROLE_MAP: %v", err)
+	}
+	p.roleMap = roleMap
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_TTL %q", v)
+		}
+		p.sessionTTL = ttl
+	}
+	return p, nil
+}
+
+// parseRoleMap reads group=role pairs separated by commas
+func parseRoleMap(s string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group = strings.TrimSpace(group)
+		role = strings.ToLower(strings.TrimSpace(role))
+		if !ok || group == "" {
+			return nil, fmt.Errorf("expected group=role, got %q", pair)
+		}
+		if !containsString(userRoles, role) {
+			return nil, fmt.Errorf("unknown role %q for group %s, expected %s", role, group, strings.Join(userRoles, ", "))
+		}
+		roles[group] = role
+	}
+	return roles, nil
+}
+
+// mapRole returns the most privileged role of the user's groups, the
+// default role when no group is mapped, or "" when the user is refused
+func (p *OIDCProvider) mapRole(groups []string) string {
+	best := len(userRoles)
+	for _, group := range groups {
+		role, ok := p.roleMap[group]
+		if !ok {
+			continue
+		}
+		for i, r := range userRoles {
+			if r == role && i < best {
+				best = i
+			}
+		}
+	}
+	if best < len(userRoles) {
+		return userRoles[best]
+	}
+	return p.defaultRole
+}
+
+// getJSON fetches a JSON document from the provider
+func (p *OIDCProvider) getJSON(u string, out any) error {
+	resp, err := p.http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// config returns the provider's discovery document, fetched once
+func (p *OIDCProvider) config() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %s, expected %s", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document lacks an endpoint")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// signingKey returns the provider's RSA key with the given key ID. The key
+// set is fetched again for unknown IDs, at most once a minute, to pick up
+// rotated keys.
+func (p *OIDCProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	d, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetched = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %v", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// startLogin records a new login and returns the provider's authorization
+// URL for it
+func (p *OIDCProvider) startLogin(redirect string) (string, error) {
+	d, err := p.config()
+	if err != nil {
+		return "", err
+	}
+	state, err := randomToken(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomToken(48)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO oidc_logins (state, nonce, verifier, redirect) VALUES (?, ?, ?, ?)",
+		state, nonce, verifier, redirect,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store login: %v", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.clientID)
+	q.Set("redirect_uri", p.redirectURL)
+	q.Set("scope", p.scopes)
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// exchangeCode redeems an authorization code and returns the ID token
+func (p *OIDCProvider) exchangeCode(code, verifier string) (string, error) {
+	d, err := p.config()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OIDC token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("OIDC token request returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("invalid OIDC token response: %v", err)
+	}
+	if out.IDToken == "" {
+		return "", fmt.Errorf("OIDC token response has no id_token")
+	}
+	return out.IDToken, nil
+}
+
+// oidcIdentity is the signed-in user as described by the ID token
+type oidcIdentity struct {
+	Subject string
+	Email   string
+	// EmailVerified is the email_verified claim; providers letting users
+	// enter any address leave it false
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+// verifyIDToken checks the RS256 signature, issuer, audience, expiry and
+// nonce of an ID token and returns the identity it asserts
+func (p *OIDCProvider) verifyIDToken(token, nonce string) (*oidcIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	enc := base64.RawURLEncoding
+	rawHeader, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid ID token signature")
+	}
+
+	rawClaims, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token claims")
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims")
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	}
+	audiences := claimStrings(claims["aud"])
+	if !containsString(audiences, p.clientID) {
+		return nil, fmt.Errorf("ID token is not meant for this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && len(audiences) > 1 && azp != p.clientID {
+		return nil, fmt.Errorf("ID token is not meant for this client")
+	}
+	// A minute of leeway for clock skew
+	now := time.Now().Add(-time.Minute).Unix()
+	if exp, _ := claims["exp"].(float64); int64(exp) < now {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match the login")
+	}
+
+	id := &oidcIdentity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	// Some providers send the claim as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+	id.Name, _ = claims["name"].(string)
+	if id.Subject == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	if id.Name == "" {
+		id.Name, _ = claims["preferred_username"].(string)
+	}
+	var groups any = claims
+	for _, name := range strings.Split(p.groupsClaim, ".") {
+		m, _ := groups.(map[string]any)
+		groups = m[name]
+	}
+	id.Groups = claimStrings(groups)
+	return id, nil
+}
+
+// claimStrings reads a claim that is a string or a list of strings
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// randomToken returns n random bytes encoded for URLs
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how session tokens are stored, so a database dump cannot be
+// used to sign in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// User is an account provisioned on its first single sign-on login
+type User struct {
+	ID            int64    `json:"id"`
+	Subject       string   `json:"subject"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Role          string   `json:"role"`
+	Groups        []string `json:"groups"`
+	Disabled      bool     `json:"disabled"`
+	CreatedAt     string   `json:"created_at"`
+	LastLoginAt   *string  `json:"last_login_at"`
+}
+
+// tenantKey is the identity of the user for settings, approvals and other
+// per-tenant data. Only a verified email is used; otherwise anyone able to
+// set their email at the provider could take over another user's data.
+func (u *User) tenantKey() string {
+	if u.Email != "" && u.EmailVerified {
+		return "user:" + strings.ToLower(u.Email)
+	}
+	return "user:" + u.Subject
+}
+
+// userColumns are the users columns read by scanUser
+const userColumns = "id, subject, COALESCE(email, ''), email_verified, COALESCE(name, ''), role, idp_groups, disabled, created_at, last_login_at"
+
+// scanUser reads a row selected with userColumns
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var u User
+	var groups []byte
+	var createdAt time.Time
+	var lastLogin sql.NullTime
+	if err := row.Scan(&u.ID, &u.Subject, &u.Email, &u.EmailVerified, &u.Name, &u.Role, &groups, &u.Disabled, &createdAt, &lastLogin); err != nil {
+		return nil, err
+	}
+	u.Groups = []string{}
+	if len(groups) > 0 {
+		json.Unmarshal(groups, &u.Groups)
+	}
+	u.CreatedAt = createdAt.Format(time.RFC3339)
+	if lastLogin.Valid {
+		s := lastLogin.Time.Format(time.RFC3339)
+		u.LastLoginAt = &s
+	}
+	return &u, nil
+}
+
+// provisionUser creates the user on their first login and otherwise
+// updates their profile and role from the identity provider, which stays
+// the source of truth for both
+func provisionUser(id *oidcIdentity, role string) (*User, error) {
+	groups, err := json.Marshal(id.Groups)
+	if err != nil {
+		return nil, err
+	}
+	_, err = execWithRetry(
+		`INSERT INTO users (subject, email, email_verified, name, role, idp_groups, last_login_at) VALUES (?, ?, ?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE email = VALUES(email), email_verified = VALUES(email_verified), name = VALUES(name),
+			role = VALUES(role), idp_groups = VALUES(idp_groups), last_login_at = NOW()`,
+		id.Subject, id.Email, id.EmailVerified, id.Name, role, groups,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to provision user: %v", err)
+	}
+	u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE subject = ?", id.Subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %v", err)
+	}
+	return u, nil
+}
+
+// createSession starts a session for the user and returns its token
+func createSession(userID int64, ttl time.Duration) (string, time.Time, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(ttl)
+	if _, err := db.Exec("DELETE FROM user_sessions WHERE expires_at < NOW()"); err != nil {
+		log.Printf("Failed to remove expired sessions: %v", err)
+	}
+	_, err = db.Exec(
+		"INSERT INTO user_sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), userID, expires,
+	)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create session: %v", err)
+	}
+	return token, expires, nil
+}
+
+// sessionUser returns the enabled user of an unexpired session, or nil
+func sessionUser(token string) (*User, error) {
+	u, err := scanUser(db.QueryRow(
+		`SELECT `+userColumns+` FROM users
+		WHERE disabled = FALSE AND id = (
+			SELECT user_id FROM user_sessions WHERE token_hash = ? AND expires_at > NOW()
+		)`,
+		hashToken(token),
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// currentUser returns the user signed in on the request, or nil
+func currentUser(c *fiber.Ctx) *User {
+	u, _ := c.Locals("user").(*User)
+	return u
+}
+
+// authRequired reports whether requests need a signed-in user
+// (AUTH_REQUIRED, default false)
+func authRequired() bool {
+	if v, err := strconv.ParseBool(os.Getenv("AUTH_REQUIRED")); err == nil {
+		return v
+	}
+	// Configuring keys closes the API unless AUTH_REQUIRED=false
+	return len(staticAPIKeys) > 0 || jwtAuth != nil
+}
+
+// authExempt reports whether a path is served without credentials even
+// when they are required: the endpoint list, health checks, the login, the
+// public dashboard when enabled and the SES notification endpoint, which
+// checks the SNS signature instead
+func authExempt(path string) bool {
+	return path == "/" || path == "/health" || strings.HasPrefix(path, "/auth/") ||
+		(path == publicDashboardPath && publicDashboardEnabled()) || path == sesNotificationPath
+}
+
+// routePath is a request path as permission checks compare it: cleaned and
+// lower-cased, so /Admin/restore or /policy/ cannot slip past a check the
+// router would still send to the same handler
+func routePath(p string) string {
+	return strings.ToLower(path.Clean("/" + p))
+}
+
+// roleAllows reports whether a role may make the request: viewers only
+// read, and /admin/ and configuration changes are left to admins
+func roleAllows(role, method, path string) bool {
+	if role == roleAdmin {
+		return true
+	}
+	path = routePath(path)
+	if path == "/admin" || strings.HasPrefix(path, "/admin/") {
+		return false
+	}
+	if method == fiber.MethodGet || method == fiber.MethodHead {
+		return true
+	}
+	if role != roleMember {
+		return false
+	}
+	for _, prefix := range adminWritePaths {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticate resolves an API token, a static API key, a JWT or the
+// session cookie and enforces the token's scopes and the user's role.
+// Without AUTH_REQUIRED, requests without credentials are let through as
+// before.
+func authenticate(c *fiber.Ctx) error {
+	bearer, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	apiKey := c.Get("X-API-Key")
+	secret := bearer
+	if strings.HasPrefix(apiKey, apiTokenPrefix) {
+		secret = apiKey
+	}
+	if strings.HasPrefix(secret, apiTokenPrefix) {
+		t, u, err := apiTokenUser(secret)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load API token: %v", err),
+			})
+		}
+		if t == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid, expired or revoked API token",
+			})
+		}
+		c.Locals("token", t)
+		if u != nil {
+			c.Locals("user", u)
+		}
+	} else if apiKey != "" && len(staticAPIKeys) > 0 {
+		t := staticKeyToken(apiKey)
+		if t == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid API key",
+			})
+		}
+		c.Locals("token", t)
+	} else if bearer != "" && jwtAuth != nil {
+		t, err := jwtAuth.verify(bearer)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid bearer token: %v", err),
+			})
+		}
+		c.Locals("token", t)
+	} else if token := c.Cookies(sessionCookie); token != "" {
+		u, err := sessionUser(token)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load session: %v", err),
+			})
+		}
+		if u != nil {
+			c.Locals("user", u)
+		}
+	}
+
+	if t := currentToken(c); t != nil && !t.allows(c.Method(), c.Path()) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": fmt.Sprintf("The token's scopes (%s) do not allow %s %s", strings.Join(t.Scopes, ", "), c.Method(), c.Path()),
+		})
+	}
+
+	u := currentUser(c)
+	if u == nil {
+		if currentToken(c) != nil {
+			return c.Next()
+		}
+		if authRequired() && !authExempt(c.Path()) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Sign in at /auth/login or send an API token as Authorization: Bearer",
+			})
+		}
+		return c.Next()
+	}
+	if !roleAllows(u.Role, c.Method(), c.Path()) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": fmt.Sprintf("The %s role may not %s %s", u.Role, c.Method(), c.Path()),
+		})
+	}
+	return c.Next()
+}
+
+// safeRedirect accepts only local paths as the page to return to after a
+// login
+func safeRedirect(s string) string {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return "/auth/me"
+	}
+	return s
+}
+
+// registerAuthRoutes adds the single sign-on login and user administration
+func registerAuthRoutes(app *fiber.App) {
+	app.Use(authenticate)
+
+	// Start a login at the identity provider; redirect is the local path to
+	// return to afterwards
+	app.Get("/auth/login", func(c *fiber.Ctx) error {
+		if oidcProvider == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Single sign-on is not configured",
+			})
+		}
+		target, err := oidcProvider.startLogin(safeRedirect(c.Query("redirect")))
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to start login: %v", err),
+			})
+		}
+		return c.Redirect(target, fiber.StatusFound)
+	})
+
+	// The identity provider returns here; the user is provisioned or
+	// updated and gets a session cookie
+	app.Get("/auth/callback", func(c *fiber.Ctx) error {
+		if oidcProvider == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Single sign-on is not configured",
+			})
+		}
+		if e := c.Query("error"); e != "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": fmt.Sprintf("Login failed: %s %s", e, c.Query("error_description")),
+			})
+		}
+
+		// The login is used up whether or not it succeeds
+		state := c.Query("state")
+		var nonce, verifier, redirect string
+		var createdAt time.Time
+		err := db.QueryRow(
+			"SELECT nonce, verifier, redirect, created_at FROM oidc_logins WHERE state = ?", state,
+		).Scan(&nonce, &verifier, &redirect, &createdAt)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load login: %v", err),
+			})
+		}
+		db.Exec("DELETE FROM oidc_logins WHERE state = ? OR created_at < ?", state, time.Now().Add(-oidcLoginTimeout))
+		if err == sql.ErrNoRows || time.Since(createdAt) > oidcLoginTimeout {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown or expired login, start again at /auth/login",
+			})
+		}
+
+		token, err := oidcProvider.exchangeCode(c.Query("code"), verifier)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		id, err := oidcProvider.verifyIDToken(token, nonce)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		role := oidcProvider.mapRole(id.Groups)
+		if role == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "None of your groups has access to the receipt processor",
+			})
+		}
+
+		u, err := provisionUser(id, role)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if u.Disabled {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Your account is disabled",
+			})
+		}
+		session, expires, err := createSession(u.ID, oidcProvider.sessionTTL)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		c.Cookie(&fiber.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     "/",
+			Expires:  expires,
+			HTTPOnly: true,
+			Secure:   strings.HasPrefix(oidcProvider.redirectURL, "https://"),
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+		log.Printf("User %s signed in as %s", u.tenantKey(), u.Role)
+		return c.Redirect(redirect, fiber.StatusFound)
+	})
+
+	// The signed-in user
+	app.Get("/auth/me", func(c *fiber.Ctx) error {
+		u := currentUser(c)
+		if u == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Not signed in",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"user":    u,
+			"tenant":  tenantKey(c),
+		})
+	})
+
+	// End the session; the session at the identity provider is left alone
+	app.Post("/auth/logout", func(c *fiber.Ctx) error {
+		if token := c.Cookies(sessionCookie); token != "" {
+			if _, err := db.Exec("DELETE FROM user_sessions WHERE token_hash = ?", hashToken(token)); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to end session: %v", err),
+				})
+			}
+		}
+		c.ClearCookie(sessionCookie)
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	// Users provisioned by single sign-on, most recent login first
+	app.Get("/admin/users", func(c *fiber.Ctx) error {
+		rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY last_login_at DESC, id DESC")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list users: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		users := []*User{}
+		for rows.Next() {
+			u, err := scanUser(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read user: %v", err),
+				})
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read users: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"users":   users,
+		})
+	})
+
+	// Disable or re-enable a user; disabling ends their sessions. Roles
+	// come from the identity provider's groups on every login.
+	app.Patch("/admin/users/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+		var req struct {
+			Disabled *bool `json:"disabled"`
+		}
+		if err := json.Unmarshal(c.Body(), &req); err != nil || req.Disabled == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Body must set disabled",
+			})
+		}
+		if u := currentUser(c); u != nil && u.ID == int64(id) && *req.Disabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "You cannot disable yourself",
+			})
+		}
+
+		err = inTx("update user", func(tx *sql.Tx) error {
+			res, err := tx.Exec("UPDATE users SET disabled = ? WHERE id = ?", *req.Disabled, id)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				var exists bool
+				if err := tx.QueryRow("SELECT TRUE FROM users WHERE id = ?", id).Scan(&exists); err != nil {
+					return err
+				}
+			}
+			if *req.Disabled {
+				_, err = tx.Exec("DELETE FROM user_sessions WHERE user_id = ?", id)
+			}
+			return err
+		})
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update user: %v", err),
+			})
+		}
+
+		u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load user: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"user":    u,
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, method, path string
+		want               bool
+	}{
+		{roleAdmin, "POST", "/admin/restore", true},
+		{roleAdmin, "PUT", "/policy", true},
+		{roleViewer, "GET", "/receipts", true},
+		{roleViewer, "POST", "/receipts/ingest", false},
+		{roleViewer, "GET", "/admin/users", false},
+		{roleMember, "POST", "/receipts/ingest", true},
+		{roleMember, "PATCH", "/receipts/1", true},
+		{roleMember, "GET", "/admin/users", false},
+		{roleMember, "POST", "/admin/restore", false},
+		{roleMember, "PUT", "/policy", false},
+		{roleMember, "POST", "/webhooks/subscriptions", false},
+		{roleMember, "POST", "/integrations/ses/sync", false},
+		{roleMember, "GET", "/policy", true},
+		{roleMember, "POST", "/webhooks/test", false},
+		{roleAdmin, "POST", "/webhooks/test", true},
+		// Mixed case, trailing slashes and dot segments reach the same
+		// handlers and must be refused the same way
+		{roleMember, "POST", "/Admin/restore", false},
+		{roleMember, "POST", "/ADMIN/restore", false},
+		{roleViewer, "GET", "/aDmIn/users", false},
+		{roleMember, "PUT", "/Policy", false},
+		{roleMember, "PUT", "/policy/", false},
+		{roleMember, "POST", "/Webhooks/Subscriptions", false},
+		{roleMember, "POST", "//admin/restore", false},
+		{roleMember, "POST", "/receipts/../admin/restore", false},
+		{roleMember, "POST", "/admin", false},
+	}
+	for _, tt := range tests {
+		if got := roleAllows(tt.role, tt.method, tt.path); got != tt.want {
+			t.Errorf("roleAllows(%q, %q, %q) = %v, want %v", tt.role, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAPITokenAllows(t *testing.T) {
+	tests := []struct {
+		scopes       []string
+		method, path string
+		want         bool
+	}{
+		{[]string{scopeAdmin}, "DELETE", "/receipts/1", true},
+		{[]string{scopeRead}, "GET", "/receipts", true},
+		{[]string{scopeRead}, "HEAD", "/receipts", true},
+		{[]string{scopeRead}, "POST", "/receipts/ingest", false},
+		{[]string{scopeIngest}, "POST", "/receipts/ingest", true},
+		{[]string{scopeIngest}, "POST", "/receipts/ingest/batch", true},
+		{[]string{scopeIngest}, "POST", "/receipts/capture", true},
+		{[]string{scopeIngest}, "POST", "/Receipts/Ingest", true},
+		{[]string{scopeIngest}, "POST", "/receipts/1/analyze", false},
+		{[]string{scopeIngest}, "GET", "/receipts/1/status", true},
+		{[]string{scopeIngest}, "GET", "/receipts/1/events", true},
+		{[]string{scopeIngest}, "GET", "/receipts/1", false},
+		{[]string{scopeIngest}, "GET", "/receipts/1/file", false},
+		{[]string{scopeIngest}, "DELETE", "/receipts/1", false},
+		{[]string{scopeIngest, scopeRead}, "GET", "/reports/monthly", true},
+		{[]string{scopeIngest, scopeRead}, "PATCH", "/receipts/1", false},
+	}
+	for _, tt := range tests {
+		token := &APIToken{Scopes: tt.scopes}
+		if got := token.allows(tt.method, tt.path); got != tt.want {
+			t.Errorf("%v allows(%q, %q) = %v, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// statusListLimit caps the review queue and error lists in the status
+// snapshot
+const statusListLimit = 10
+
+// addGeminiTokens adds the tokens used by a Gemini call to the receipt's
+// running total
+func addGeminiTokens(receiptID int64, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	if _, err := db.Exec(
+		"UPDATE receipts SET gemini_tokens = gemini_tokens + ? WHERE id = ?", tokens, receiptID,
+	); err != nil {
+		log.Printf("Failed to record token usage for receipt %d: %v", receiptID, err)
+	}
+}
+
+// StatusReceipt is a receipt listed in the status snapshot
+type StatusReceipt struct {
+	ID         int64  `json:"id"`
+	FileName   string `json:"file_name"`
+	UploadedAt string `json:"uploaded_at"`
+	Merchant   string `json:"merchant,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// TokenUsage sums Gemini tokens over receipts uploaded in a period
+type TokenUsage struct {
+	Today     int64 `json:"today"`
+	Last7Days int64 `json:"last_7_days"`
+	ThisMonth int64 `json:"this_month"`
+}
+
+// SystemStatus is the snapshot shown by the admin TUI
+type SystemStatus struct {
+	Processing  []ReceiptProgress `json:"processing"`
+	Queue       []QueueStats      `json:"queue"`
+	Disk        DiskSpaceStatus   `json:"disk"`
+	Inbox       *InboxStats       `json:"inbox"`
+	ReviewQueue []StatusReceipt   `json:"review_queue"`
+	Errors      []StatusReceipt   `json:"recent_errors"`
+	Tokens      TokenUsage        `json:"tokens"`
+	// Budget is nil unless GEMINI_MONTHLY_BUDGET is set
+	Budget      *BudgetStatus `json:"budget"`
+	GeneratedAt string        `json:"generated_at"`
+}
+
+// loadStatusReceipts lists receipts with a status, newest or oldest first.
+// The detail column is the latest failed repair's validation errors.
+func loadStatusReceipts(status string, newestFirst bool) ([]StatusReceipt, error) {
+	order := "r.uploaded_at"
+	if newestFirst {
+		order += " DESC"
+	}
+	rows, err := db.Query(
+		`SELECT r.id, r.file_name, r.uploaded_at,
+			COALESCE((SELECT COALESCE(t.merchant_clean, t.merchant_raw) FROM transactions t WHERE t.receipt_id = r.id ORDER BY t.id LIMIT 1), ''),
+			COALESCE((SELECT p.validation_errors FROM parse_repairs p WHERE p.receipt_id = r.id ORDER BY p.id DESC LIMIT 1), '')
+		FROM receipts r
+		WHERE r.status = ? AND r.deleted_at IS NULL
+		ORDER BY `+order+`
+		LIMIT ?`,
+		status, statusListLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s receipts: %v", status, err)
+	}
+	defer rows.Close()
+
+	receipts := []StatusReceipt{}
+	for rows.Next() {
+		var r StatusReceipt
+		var uploadedAt time.Time
+		if err := rows.Scan(&r.ID, &r.FileName, &uploadedAt, &r.Merchant, &r.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		r.UploadedAt = uploadedAt.Format(time.RFC3339)
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+// loadSystemStatus builds the admin status snapshot
+func loadSystemStatus() (*SystemStatus, error) {
+	status := &SystemStatus{
+		Processing:  progressTracker.Active(),
+		Queue:       pipelineScheduler.Stats(),
+		Disk:        diskSpace.Status(),
+		GeneratedAt: time.Now().Format(time.RFC3339),
+	}
+
+	var err error
+	if status.Inbox, err = loadInboxStats(); err != nil {
+		return nil, err
+	}
+	if status.ReviewQueue, err = loadStatusReceipts("needs_review", false); err != nil {
+		return nil, err
+	}
+	if status.Errors, err = loadStatusReceipts("error", true); err != nil {
+		return nil, err
+	}
+	if status.Budget, err = geminiBudget.status(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if err := db.QueryRow(
+		`SELECT
+			COALESCE(SUM(CASE WHEN uploaded_at >= ? THEN gemini_tokens END), 0),
+			COALESCE(SUM(CASE WHEN uploaded_at >= ? THEN gemini_tokens END), 0),
+			COALESCE(SUM(CASE WHEN uploaded_at >= ? THEN gemini_tokens END), 0)
+		FROM receipts WHERE uploaded_at >= ?`,
+		dayStart, now.AddDate(0, 0, -7), monthStart, minTime(monthStart, now.AddDate(0, 0, -7)),
+	).Scan(&status.Tokens.Today, &status.Tokens.Last7Days, &status.Tokens.ThisMonth); err != nil {
+		return nil, fmt.Errorf("failed to sum token usage: %v", err)
+	}
+	return status, nil
+}
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// registerStatusRoutes adds the status snapshot used by the admin TUI
+func registerStatusRoutes(app *fiber.App) {
+	app.Get("/admin/status", func(c *fiber.Ctx) error {
+		status, err := loadSystemStatus()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"status":  status,
+		})
+	})
+}
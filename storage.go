@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadsDir is where the local storage backend keeps receipt files
+const uploadsDir = "./uploads"
+
+// Storage is a backend that receipt files are stored in. Keys are the
+// stored file names recorded in receipts.file_name.
+type Storage interface {
+	// Name returns the backend name recorded in receipts.storage_backend
+	Name() string
+	Save(key string, r io.Reader) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	// List returns the keys that start with prefix
+	List(prefix string) ([]string, error)
+}
+
+// LocalStorage stores files on the local filesystem
+type LocalStorage struct {
+	Root string
+}
+
+// Name returns the backend name
+func (s *LocalStorage) Name() string {
+	return "local"
+}
+
+// Save writes a file below the storage root
+func (s *LocalStorage) Save(key string, r io.Reader) error {
+	path := filepath.Join(s.Root, key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	return f.Close()
+}
+
+// Open opens a stored file for reading
+func (s *LocalStorage) Open(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Root, key))
+}
+
+// Delete removes a stored file
+func (s *LocalStorage) Delete(key string) error {
+	return os.Remove(filepath.Join(s.Root, key))
+}
+
+// List returns the keys below the storage root that start with prefix
+func (s *LocalStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		key, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// storageFactories builds the storage backends selectable by name
+var storageFactories = map[string]func() (Storage, error){
+	"local": func() (Storage, error) {
+		return &LocalStorage{Root: uploadsDir}, nil
+	},
+	"s3":    newS3Storage,
+	"gcs":   newGCSStorage,
+	"drive": newDriveStorage,
+}
+
+// receiptStorageName is the backend new receipt files are stored in
+// (STORAGE_BACKEND, default local)
+func receiptStorageName() string {
+	if name := os.Getenv("STORAGE_BACKEND"); name != "" {
+		return name
+	}
+	return "local"
+}
+
+// offloadReceiptFile moves the file of a receipt that was processed from
+// uploadsDir to the configured backend and records the new backend. Errors
+// are logged; the local copy is kept then.
+func offloadReceiptFile(receiptID int64, key string) {
+	name, err := storeReceiptFile(key)
+	if err != nil {
+		log.Printf("Receipt %d: %v", receiptID, err)
+		return
+	}
+	if name == "local" {
+		return
+	}
+	if _, err := execWithRetry("UPDATE receipts SET storage_backend = ? WHERE id = ?", name, receiptID); err != nil {
+		log.Printf("Receipt %d: failed to record storage backend: %v", receiptID, err)
+	}
+}
+
+// storeReceiptFile moves a receipt file saved below uploadsDir to the
+// configured storage backend and returns the backend name. Local storage
+// keeps the file where it is.
+func storeReceiptFile(key string) (string, error) {
+	name := receiptStorageName()
+	if name == "local" {
+		return name, nil
+	}
+	store, err := newStorage(name)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(uploadsDir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	err = store.Save(key, f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to store %s in %s: %v", key, name, err)
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove local copy of %s: %v", key, err)
+	}
+	return name, nil
+}
+
+// newStorage returns the storage backend with the given name
+func newStorage(name string) (Storage, error) {
+	factory, ok := storageFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+	return factory()
+}
+
+// configuredStorageNames are the backends receipt files can live in on this
+// deployment: local storage, STORAGE_BACKEND and DISK_ARCHIVE_BACKEND
+func configuredStorageNames() []string {
+	names := []string{"local"}
+	for _, name := range []string{receiptStorageName(), os.Getenv("DISK_ARCHIVE_BACKEND")} {
+		if name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkStorageKey rejects keys that would leave the storage root when
+// joined to it: empty or absolute keys and keys with a ".." segment
+func checkStorageKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty storage key")
+	}
+	if strings.HasPrefix(key, "/") || strings.HasPrefix(key, "\\") || filepath.IsAbs(key) || filepath.VolumeName(key) != "" {
+		return fmt.Errorf("storage key %q must be relative", key)
+	}
+	for _, segment := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("storage key %q must not contain ..", key)
+		}
+	}
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 of a local file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return sha256Hex(f)
+}
+
+// storedChecksum returns the hex SHA-256 of a file in a storage backend
+func storedChecksum(s Storage, key string) (string, error) {
+	r, err := s.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return sha256Hex(r)
+}
+
+// sha256Hex hashes everything read from r
+func sha256Hex(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
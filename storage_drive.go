@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// driveStorageKeyProperty is the app property holding the storage key of a
+// file, since Drive names need not be unique
+const driveStorageKeyProperty = "storage_key"
+
+// DriveStorage stores files in a Google Drive folder, one Drive file per key
+type DriveStorage struct {
+	client *DriveClient
+}
+
+// newDriveStorage configures Drive storage for DRIVE_STORAGE_FOLDER_ID,
+// falling back to DRIVE_FOLDER_ID, with the credentials of the Drive upload.
+// DRIVE_UPLOAD need not be enabled.
+func newDriveStorage() (Storage, error) {
+	folderID := os.Getenv("DRIVE_STORAGE_FOLDER_ID")
+	if folderID == "" {
+		folderID = os.Getenv("DRIVE_FOLDER_ID")
+	}
+	if folderID == "" {
+		return nil, fmt.Errorf("drive storage needs DRIVE_STORAGE_FOLDER_ID or DRIVE_FOLDER_ID")
+	}
+	client, err := newDriveFolderClient(folderID)
+	if err != nil {
+		return nil, err
+	}
+	return &DriveStorage{client: client}, nil
+}
+
+// Name returns the backend name
+func (s *DriveStorage) Name() string {
+	return "drive"
+}
+
+// driveQueryString quotes a value for a Drive search query
+func driveQueryString(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// files returns the keys and IDs of the folder's files matching an extra
+// search condition, following every page
+func (s *DriveStorage) files(cond string) (map[string]string, error) {
+	token, err := s.client.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	q := driveQueryString(s.client.folderID) + " in parents and trashed = false"
+	if cond != "" {
+		q += " and " + cond
+	}
+
+	found := make(map[string]string)
+	pageToken := ""
+	for {
+		params := url.Values{
+			"q":                         {q},
+			"fields":                    {"nextPageToken,files(id,appProperties)"},
+			"pageSize":                  {"1000"},
+			"supportsAllDrives":         {"true"},
+			"includeItemsFromAllDrives": {"true"},
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest("GET", strings.TrimSuffix(driveFilesURL, "/")+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := s.client.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("drive list failed: %v", err)
+		}
+		var out struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				ID            string            `json:"id"`
+				AppProperties map[string]string `json:"appProperties"`
+			} `json:"files"`
+		}
+		if resp.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return nil, fmt.Errorf("drive list returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid drive list response: %v", err)
+		}
+		for _, f := range out.Files {
+			if key := f.AppProperties[driveStorageKeyProperty]; key != "" {
+				found[key] = f.ID
+			}
+		}
+		if out.NextPageToken == "" {
+			return found, nil
+		}
+		pageToken = out.NextPageToken
+	}
+}
+
+// fileID returns the Drive file ID stored under a key
+func (s *DriveStorage) fileID(key string) (string, error) {
+	files, err := s.files(fmt.Sprintf("appProperties has { key=%s and value=%s }",
+		driveQueryString(driveStorageKeyProperty), driveQueryString(key)))
+	if err != nil {
+		return "", err
+	}
+	id, ok := files[key]
+	if !ok {
+		return "", &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	return id, nil
+}
+
+// Save uploads a file, replacing an earlier one with the same key
+func (s *DriveStorage) Save(key string, r io.Reader) error {
+	previous, err := s.fileID(key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	name := key[strings.LastIndex(key, "/")+1:]
+	if _, err := s.client.upload(name, r, map[string]string{driveStorageKeyProperty: key}); err != nil {
+		return err
+	}
+	if previous != "" {
+		return s.deleteFile(previous)
+	}
+	return nil
+}
+
+// Open downloads a stored file
+func (s *DriveStorage) Open(key string) (io.ReadCloser, error) {
+	id, err := s.fileID(key)
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.client.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", driveFilesURL+url.PathEscape(id)+"?alt=media&supportsAllDrives=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("drive download failed: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("drive download returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// Delete removes a stored file permanently
+func (s *DriveStorage) Delete(key string) error {
+	id, err := s.fileID(key)
+	if err != nil {
+		return err
+	}
+	return s.deleteFile(id)
+}
+
+// deleteFile removes a Drive file by ID
+func (s *DriveStorage) deleteFile(id string) error {
+	token, err := s.client.accessToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", driveFilesURL+url.PathEscape(id)+"?supportsAllDrives=true", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("drive delete failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("drive delete returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// List returns the keys that start with prefix
+func (s *DriveStorage) List(prefix string) ([]string, error) {
+	files, err := s.files("")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range files {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
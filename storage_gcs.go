@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/api/option"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// GCSStorage stores files in a Google Cloud Storage bucket
+type GCSStorage struct {
+	bucket  string
+	prefix  string
+	service *gcs.Service
+}
+
+// newGCSStorage configures Cloud Storage from GCS_BUCKET and GCS_PREFIX.
+// Credentials are read from GCS_CREDENTIALS_FILE, or found as application
+// default credentials (GOOGLE_APPLICATION_CREDENTIALS or the metadata
+// server).
+func newGCSStorage() (Storage, error) {
+	bucket := os.Getenv("GCS_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("gcs storage needs GCS_BUCKET")
+	}
+	opts := []option.ClientOption{option.WithScopes(gcs.DevstorageReadWriteScope)}
+	if path := os.Getenv("GCS_CREDENTIALS_FILE"); path != "" {
+		opts = append(opts, option.WithCredentialsFile(path))
+	}
+	service, err := gcs.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client: %v", err)
+	}
+	return &GCSStorage{bucket: bucket, prefix: os.Getenv("GCS_PREFIX"), service: service}, nil
+}
+
+// Name returns the backend name
+func (s *GCSStorage) Name() string {
+	return "gcs"
+}
+
+// Save uploads a file
+func (s *GCSStorage) Save(key string, r io.Reader) error {
+	if _, err := s.service.Objects.Insert(s.bucket, &gcs.Object{Name: s.prefix + key}).Media(r).Do(); err != nil {
+		return fmt.Errorf("gcs upload failed: %v", err)
+	}
+	return nil
+}
+
+// Open downloads a stored file
+func (s *GCSStorage) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.service.Objects.Get(s.bucket, s.prefix+key).Download()
+	if err != nil {
+		return nil, fmt.Errorf("gcs download failed: %v", err)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes a stored file
+func (s *GCSStorage) Delete(key string) error {
+	if err := s.service.Objects.Delete(s.bucket, s.prefix+key).Do(); err != nil {
+		return fmt.Errorf("gcs delete failed: %v", err)
+	}
+	return nil
+}
+
+// List returns the keys that start with prefix
+func (s *GCSStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.service.Objects.List(s.bucket).Prefix(s.prefix+prefix).Fields("items(name),nextPageToken").
+		Pages(context.Background(), func(page *gcs.Objects) error {
+			for _, obj := range page.Items {
+				keys = append(keys, strings.TrimPrefix(obj.Name, s.prefix))
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("gcs list failed: %v", err)
+	}
+	return keys, nil
+}
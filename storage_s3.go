@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage stores files in an S3 bucket or an S3 compatible service such as
+// MinIO or Cloudflare R2. Requests are signed with AWS Signature Version 4.
+type S3Storage struct {
+	bucket    string
+	region    string
+	endpoint  *url.URL
+	pathStyle bool
+	// prefix is prepended to every key, e.g. "receipts/"
+	prefix    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+// newS3Storage configures S3 storage from S3_BUCKET, S3_REGION,
+// S3_ENDPOINT, S3_PREFIX and S3_ACCESS_KEY_ID / S3_SECRET_ACCESS_KEY
+// (falling back to the AWS_ variables)
+func newS3Storage() (Storage, error) {
+	if os.Getenv("S3_BUCKET") == "" {
+		return nil, fmt.Errorf("s3 storage needs S3_BUCKET")
+	}
+	return newS3Bucket(os.Getenv("S3_BUCKET"), os.Getenv("S3_REGION"), os.Getenv("S3_ENDPOINT"), os.Getenv("S3_PREFIX"))
+}
+
+// newS3Bucket returns a client for a bucket, authenticated with
+// S3_ACCESS_KEY_ID / S3_SECRET_ACCESS_KEY (falling back to the AWS_
+// variables). An empty region is us-east-1 and an empty endpoint is AWS.
+func newS3Bucket(bucket, region, endpoint, prefix string) (*S3Storage, error) {
+	s := &S3Storage{
+		bucket:    bucket,
+		region:    region,
+		prefix:    prefix,
+		accessKey: firstEnv("S3_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID"),
+		secretKey: firstEnv("S3_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY"),
+		http:      &http.Client{Timeout: 2 * time.Minute},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("s3 storage needs S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	// Custom endpoints are addressed path-style, AWS virtual-hosted-style
+	if endpoint != "" {
+		s.pathStyle = true
+	} else {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	if v, err := strconv.ParseBool(os.Getenv("S3_PATH_STYLE")); err == nil {
+		s.pathStyle = v
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	s.endpoint = u
+	return s, nil
+}
+
+// firstEnv returns the first of the environment variables that is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Name returns the backend name
+func (s *S3Storage) Name() string {
+	return "s3"
+}
+
+// objectURL returns the URL of an object key, or of the bucket for an empty
+// key
+func (s *S3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path := "/" + s.prefix + key
+	if key == "" {
+		path = "/"
+	}
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = s3EscapePath(path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do signs and sends a request; the caller closes the response body
+func (s *S3Storage) do(method string, u *url.URL, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, u, body, time.Now().UTC())
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s failed: %v", method, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("s3 %s %s returned %d: %s", method, u.Path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to a request
+func (s *S3Storage) sign(req *http.Request, u *url.URL, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.RawPath,
+		u.RawQuery,
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except RFC 3986 unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath escapes each segment of an object path
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name as required by
+// the signature
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Save uploads a file. Receipts are small, so the body is buffered to sign
+// its hash.
+func (s *S3Storage) Save(key string, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	resp, err := s.do("PUT", s.objectURL(key, nil), body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Open downloads a stored file
+func (s *S3Storage) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.objectURL(key, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes a stored file
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", s.objectURL(key, nil), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List returns the keys that start with prefix, following continuation
+// tokens until the listing is complete
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", s.objectURL("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 list response: %v", err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(obj.Key, s.prefix))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// streakWindowDays is how far back streaks are computed
+const streakWindowDays = 365
+
+// InboxStats describes the receipts still waiting for review
+type InboxStats struct {
+	Pending      int     `json:"pending"`
+	NeedsReview  int     `json:"needs_review"`
+	Errors       int     `json:"errors"`
+	InboxZero    bool    `json:"inbox_zero"`
+	OldestHours  float64 `json:"oldest_hours"`
+	AverageHours float64 `json:"average_hours"`
+	// AgeBuckets counts pending receipts by how long they have waited
+	AgeBuckets map[string]int `json:"age_buckets"`
+	// ProcessedThisWeek counts receipts uploaded in the last 7 days that are
+	// already processed
+	ProcessedThisWeek int `json:"processed_this_week"`
+}
+
+// dayActivity is the number of receipts uploaded on a day and how many of
+// them are still pending
+type dayActivity struct {
+	Day      time.Time
+	Uploaded int
+	Pending  int
+}
+
+// Streaks are runs of consecutive days ending today (or yesterday, so a
+// streak isn't lost before the day is over)
+type Streaks struct {
+	// Capture counts days in a row with at least one receipt uploaded
+	CurrentCapture int `json:"current_capture"`
+	LongestCapture int `json:"longest_capture"`
+	// Processed counts upload days in a row whose receipts are all processed;
+	// days without uploads neither extend nor break it
+	CurrentProcessed int `json:"current_processed"`
+	LongestProcessed int `json:"longest_processed"`
+	ActiveDays       int `json:"active_days"`
+}
+
+// loadInboxStats computes the review queue statistics
+func loadInboxStats() (*InboxStats, error) {
+	stats := &InboxStats{AgeBuckets: map[string]int{
+		"under_1d": 0,
+		"1d_3d":    0,
+		"3d_7d":    0,
+		"over_7d":  0,
+	}}
+
+	rows, err := db.Query(
+		"SELECT status, TIMESTAMPDIFF(MINUTE, uploaded_at, NOW()) FROM receipts WHERE status <> 'processed' AND deleted_at IS NULL",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load review queue: %v", err)
+	}
+	defer rows.Close()
+
+	var totalHours float64
+	for rows.Next() {
+		var status string
+		var minutes int64
+		if err := rows.Scan(&status, &minutes); err != nil {
+			return nil, fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		hours := float64(minutes) / 60
+
+		stats.Pending++
+		if status == "error" {
+			stats.Errors++
+		} else {
+			stats.NeedsReview++
+		}
+		totalHours += hours
+		stats.OldestHours = math.Max(stats.OldestHours, hours)
+
+		switch {
+		case hours < 24:
+			stats.AgeBuckets["under_1d"]++
+		case hours < 72:
+			stats.AgeBuckets["1d_3d"]++
+		case hours < 168:
+			stats.AgeBuckets["3d_7d"]++
+		default:
+			stats.AgeBuckets["over_7d"]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.InboxZero = stats.Pending == 0
+	stats.OldestHours = math.Round(stats.OldestHours*10) / 10
+	if stats.Pending > 0 {
+		stats.AverageHours = math.Round(totalHours/float64(stats.Pending)*10) / 10
+	}
+
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM receipts WHERE status = 'processed' AND uploaded_at >= NOW() - INTERVAL 7 DAY",
+	).Scan(&stats.ProcessedThisWeek); err != nil {
+		return nil, fmt.Errorf("failed to count processed receipts: %v", err)
+	}
+	return stats, nil
+}
+
+// loadDayActivity returns per-day upload activity since the given day,
+// most recent first
+func loadDayActivity(since time.Time) ([]dayActivity, error) {
+	rows, err := db.Query(
+		`SELECT DATE(uploaded_at) AS day, COUNT(*), SUM(status <> 'processed')
+		FROM receipts
+		WHERE uploaded_at >= ?
+		GROUP BY day
+		ORDER BY day DESC`,
+		since,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load upload activity: %v", err)
+	}
+	defer rows.Close()
+
+	var days []dayActivity
+	for rows.Next() {
+		var d dayActivity
+		if err := rows.Scan(&d.Day, &d.Uploaded, &d.Pending); err != nil {
+			return nil, fmt.Errorf("failed to scan upload activity: %v", err)
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// computeStreaks derives the capture and processed streaks from per-day
+// activity sorted most recent first
+func computeStreaks(days []dayActivity, today time.Time) Streaks {
+	var s Streaks
+	s.ActiveDays = len(days)
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+
+	dayIndex := func(t time.Time) int {
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return int(today.Sub(t).Hours() / 24)
+	}
+
+	// Capture streaks: runs of consecutive calendar days. The first run is
+	// the current one if it reaches today or yesterday.
+	run, prev := 0, -1
+	current := len(days) > 0 && dayIndex(days[0].Day) <= 1
+	for i, d := range days {
+		idx := dayIndex(d.Day)
+		if i > 0 && idx == prev+1 {
+			run++
+		} else {
+			if i > 0 {
+				current = false
+			}
+			run = 1
+		}
+		if current {
+			s.CurrentCapture = run
+		}
+		if run > s.LongestCapture {
+			s.LongestCapture = run
+		}
+		prev = idx
+	}
+
+	// Processed streaks: runs of upload days without pending receipts
+	run = 0
+	current = true
+	for _, d := range days {
+		if d.Pending == 0 {
+			run++
+			if current {
+				s.CurrentProcessed = run
+			}
+		} else {
+			run = 0
+			current = false
+		}
+		if run > s.LongestProcessed {
+			s.LongestProcessed = run
+		}
+	}
+	return s
+}
+
+// registerStreakRoutes adds the inbox and streak endpoints behind the
+// motivational dashboard
+func registerStreakRoutes(app *fiber.App) {
+	app.Get("/stats/inbox", func(c *fiber.Ctx) error {
+		stats, err := loadInboxStats()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"inbox":   stats,
+		})
+	})
+
+	app.Get("/stats/streaks", func(c *fiber.Ctx) error {
+		now := time.Now()
+		days, err := loadDayActivity(now.AddDate(0, 0, -streakWindowDays))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":     true,
+			"window_days": streakWindowDays,
+			"streaks":     computeStreaks(days, now),
+		})
+	})
+}
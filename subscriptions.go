@@ -0,0 +1,579 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Subscription statuses
+const (
+	subscriptionActive    = "active"
+	subscriptionCancelled = "cancelled"
+)
+
+// billingCycle describes how often a subscription renews and the range of
+// gaps between charges (in days) recognised as that cycle
+type billingCycle struct {
+	Name         string
+	Months, Days int
+	PerYear      float64
+	MinGap       int
+	MaxGap       int
+	MinCharges   int
+}
+
+// billingCycles are the renewal cycles recurring detection recognises
+var billingCycles = []billingCycle{
+	{Name: "weekly", Days: 7, PerYear: 52, MinGap: 6, MaxGap: 8, MinCharges: 3},
+	{Name: "monthly", Months: 1, PerYear: 12, MinGap: 26, MaxGap: 35, MinCharges: 3},
+	{Name: "quarterly", Months: 3, PerYear: 4, MinGap: 84, MaxGap: 98, MinCharges: 3},
+	{Name: "yearly", Months: 12, PerYear: 1, MinGap: 350, MaxGap: 380, MinCharges: 2},
+}
+
+// maxSubscriptionAmountDrift is how far (as a fraction) a charge may differ
+// from the latest one and still count as the same subscription
+const maxSubscriptionAmountDrift = 0.1
+
+// cycleByName returns the named billing cycle
+func cycleByName(name string) (billingCycle, bool) {
+	for _, c := range billingCycles {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return billingCycle{}, false
+}
+
+// next returns the renewal date following a charge on date
+func (c billingCycle) next(date time.Time) time.Time {
+	return date.AddDate(0, c.Months, c.Days)
+}
+
+// Subscription is a managed recurring charge
+type Subscription struct {
+	ID           int64   `json:"id"`
+	MerchantID   *int64  `json:"merchant_id"`
+	Name         string  `json:"name"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency"`
+	BillingCycle string  `json:"billing_cycle"`
+	Annualized   float64 `json:"annualized"`
+	LastCharged  *string `json:"last_charged"`
+	NextRenewal  *string `json:"next_renewal"`
+	CancelBy     *string `json:"cancel_by"`
+	RemindDays   int     `json:"remind_days"`
+	Status       string  `json:"status"`
+	Source       string  `json:"source"`
+	Charges      int     `json:"charges"`
+}
+
+// recurringCharge is one dated charge at a merchant
+type recurringCharge struct {
+	date     time.Time
+	amount   float64
+	currency string
+}
+
+// classifyRecurring works out whether charges (oldest first) follow a
+// billing cycle with a stable amount
+func classifyRecurring(charges []recurringCharge) (billingCycle, bool) {
+	if len(charges) < 2 {
+		return billingCycle{}, false
+	}
+
+	latest := charges[len(charges)-1]
+	gaps := make([]int, 0, len(charges)-1)
+	for i := 1; i < len(charges); i++ {
+		if charges[i].currency != latest.currency {
+			return billingCycle{}, false
+		}
+		if latest.amount > 0 && math.Abs(charges[i].amount-latest.amount)/latest.amount > maxSubscriptionAmountDrift {
+			return billingCycle{}, false
+		}
+		gaps = append(gaps, int(charges[i].date.Sub(charges[i-1].date).Hours()/24+0.5))
+	}
+
+	for _, cycle := range billingCycles {
+		if len(charges) < cycle.MinCharges {
+			continue
+		}
+		matches := true
+		for _, gap := range gaps {
+			if gap < cycle.MinGap || gap > cycle.MaxGap {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return cycle, true
+		}
+	}
+	return billingCycle{}, false
+}
+
+// detectMerchantSubscription promotes a merchant's charges into a managed
+// subscription when the most recent ones recur on a billing cycle. It
+// returns the new subscription ID, or 0 when nothing was detected.
+func detectMerchantSubscription(merchantID int64) (int64, error) {
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE merchant_id = ?", merchantID).Scan(&existing); err != nil {
+		return 0, fmt.Errorf("failed to check subscriptions: %v", err)
+	}
+	if existing > 0 {
+		return 0, nil
+	}
+
+	rows, err := db.Query(
+		`SELECT date, amount, COALESCE(currency, '') FROM transactions
+		WHERE merchant_id = ? AND date IS NOT NULL AND amount > 0 AND date >= ?
+		ORDER BY date`,
+		merchantID, time.Now().AddDate(-2, 0, 0),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load merchant charges: %v", err)
+	}
+	var charges []recurringCharge
+	for rows.Next() {
+		var ch recurringCharge
+		if err := rows.Scan(&ch.date, &ch.amount, &ch.currency); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan merchant charge: %v", err)
+		}
+		charges = append(charges, ch)
+	}
+	rows.Close()
+
+	// Find the longest run of charges up to the latest one that recurs
+	for start := 0; start < len(charges)-1; start++ {
+		cycle, ok := classifyRecurring(charges[start:])
+		if !ok {
+			continue
+		}
+
+		var name string
+		if err := db.QueryRow("SELECT name FROM merchants WHERE id = ?", merchantID).Scan(&name); err != nil {
+			return 0, fmt.Errorf("failed to load merchant: %v", err)
+		}
+		latest := charges[len(charges)-1]
+		result, err := db.Exec(
+			`INSERT INTO subscriptions (merchant_id, name, amount, currency, billing_cycle, last_charged, next_renewal, status, source)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'detected')`,
+			merchantID, name, latest.amount, sql.NullString{String: latest.currency, Valid: latest.currency != ""},
+			cycle.Name, latest.date, cycle.next(latest.date), subscriptionActive,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create subscription: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		log.Printf("Subscriptions: detected %s %s subscription for %s", cycle.Name, formatAmount(latest.amount, latest.currency), name)
+		return id, nil
+	}
+	return 0, nil
+}
+
+// recordSubscriptionCharge moves an active subscription's renewal forward
+// when a charge of about the same amount from its merchant is stored, or
+// runs detection when the merchant has no subscription yet
+func recordSubscriptionCharge(merchantID int64, amount float64, date time.Time) error {
+	var id int64
+	var cycleName string
+	var current float64
+	var lastCharged sql.NullTime
+	err := db.QueryRow(
+		`SELECT id, billing_cycle, amount, last_charged FROM subscriptions
+		WHERE merchant_id = ? AND status = ? ORDER BY id LIMIT 1`,
+		merchantID, subscriptionActive,
+	).Scan(&id, &cycleName, &current, &lastCharged)
+	if err == sql.ErrNoRows {
+		_, err := detectMerchantSubscription(merchantID)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load subscription: %v", err)
+	}
+	if lastCharged.Valid && !date.After(lastCharged.Time) {
+		return nil
+	}
+	// Other purchases at the same merchant are not renewals
+	if current > 0 && math.Abs(amount-current)/current > maxSubscriptionAmountDrift {
+		return nil
+	}
+
+	cycle, ok := cycleByName(cycleName)
+	if !ok {
+		return nil
+	}
+	if _, err := db.Exec(
+		"UPDATE subscriptions SET amount = ?, last_charged = ?, next_renewal = ? WHERE id = ?",
+		amount, date, cycle.next(date), id,
+	); err != nil {
+		return fmt.Errorf("failed to record subscription renewal: %v", err)
+	}
+	return nil
+}
+
+// sendSubscriptionReminders posts a subscription.renewal_reminder webhook
+// for every active subscription whose renewal (or cancel-by date, when set)
+// is within its reminder window. Each renewal is reminded about once.
+func sendSubscriptionReminders(now time.Time) (int, error) {
+	rows, err := db.Query(
+		`SELECT id, name, amount, COALESCE(currency, ''), billing_cycle, next_renewal, cancel_by, remind_days
+		FROM subscriptions
+		WHERE status = ? AND next_renewal IS NOT NULL
+			AND (reminded_for IS NULL OR reminded_for <> next_renewal)
+			AND DATE_SUB(COALESCE(cancel_by, next_renewal), INTERVAL remind_days DAY) <= ?`,
+		subscriptionActive, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find due subscription reminders: %v", err)
+	}
+
+	type reminder struct {
+		id          int64
+		payload     fiber.Map
+		nextRenewal time.Time
+	}
+	var due []reminder
+	for rows.Next() {
+		var id int64
+		var name, currency, cycle string
+		var amount float64
+		var nextRenewal time.Time
+		var cancelBy sql.NullTime
+		var remindDays int
+		if err := rows.Scan(&id, &name, &amount, &currency, &cycle, &nextRenewal, &cancelBy, &remindDays); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan subscription: %v", err)
+		}
+		payload := fiber.Map{
+			"subscription_id": id,
+			"name":            name,
+			"amount":          amount,
+			"currency":        currency,
+			"billing_cycle":   cycle,
+			"next_renewal":    nextRenewal.Format("2006-01-02"),
+			"cancel_by":       nil,
+		}
+		if cancelBy.Valid {
+			payload["cancel_by"] = cancelBy.Time.Format("2006-01-02")
+		}
+		due = append(due, reminder{id, payload, nextRenewal})
+	}
+	rows.Close()
+
+	sent := 0
+	for _, r := range due {
+		if err := sendWebhook(eventSubscriptionReminder, r.payload); err != nil {
+			log.Printf("Subscriptions: %v", err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE subscriptions SET reminded_for = ? WHERE id = ?", r.nextRenewal, r.id); err != nil {
+			return sent, fmt.Errorf("failed to mark reminder sent: %v", err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// startSubscriptionScheduler checks for due renewal reminders every hour
+func startSubscriptionScheduler() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if sent, err := sendSubscriptionReminders(time.Now()); err != nil {
+				log.Printf("Subscriptions: reminder check failed: %v", err)
+			} else if sent > 0 {
+				log.Printf("Subscriptions: sent %d renewal reminder(s)", sent)
+			}
+		}
+	}()
+}
+
+// formatAmount renders an amount with its currency for log messages
+func formatAmount(amount float64, currency string) string {
+	return strings.TrimSpace(fmt.Sprintf("%.2f %s", amount, currency))
+}
+
+// formatNullDate renders an optional date as YYYY-MM-DD
+func formatNullDate(t sql.NullTime) *string {
+	if !t.Valid {
+		return nil
+	}
+	s := t.Time.Format("2006-01-02")
+	return &s
+}
+
+// parseOptionalDate parses an optional YYYY-MM-DD request field
+func parseOptionalDate(s *string) (sql.NullTime, error) {
+	if s == nil || *s == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.Parse("2006-01-02", *s)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", *s)
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// registerSubscriptionRoutes adds the subscription management endpoints
+func registerSubscriptionRoutes(app *fiber.App) {
+	// List subscriptions with annualized totals per currency
+	app.Get("/subscriptions", func(c *fiber.Ctx) error {
+		status := c.Query("status", subscriptionActive)
+
+		rows, err := db.Query(
+			`SELECT s.id, s.merchant_id, s.name, s.amount, COALESCE(s.currency, ''), s.billing_cycle,
+				s.last_charged, s.next_renewal, s.cancel_by, s.remind_days, s.status, s.source,
+				(SELECT COUNT(*) FROM transactions t WHERE t.merchant_id = s.merchant_id)
+			FROM subscriptions s
+			WHERE s.status = ?
+			ORDER BY s.next_renewal IS NULL, s.next_renewal, s.name`,
+			status,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list subscriptions: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		subscriptions := []Subscription{}
+		annualTotals := map[string]float64{}
+		for rows.Next() {
+			var s Subscription
+			var merchantID sql.NullInt64
+			var lastCharged, nextRenewal, cancelBy sql.NullTime
+			if err := rows.Scan(&s.ID, &merchantID, &s.Name, &s.Amount, &s.Currency, &s.BillingCycle,
+				&lastCharged, &nextRenewal, &cancelBy, &s.RemindDays, &s.Status, &s.Source, &s.Charges); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read subscriptions: %v", err),
+				})
+			}
+			if merchantID.Valid {
+				s.MerchantID = &merchantID.Int64
+			}
+			s.LastCharged = formatNullDate(lastCharged)
+			s.NextRenewal = formatNullDate(nextRenewal)
+			s.CancelBy = formatNullDate(cancelBy)
+			if cycle, ok := cycleByName(s.BillingCycle); ok {
+				s.Annualized = math.Round(s.Amount*cycle.PerYear*100) / 100
+			}
+			annualTotals[s.Currency] += s.Annualized
+			subscriptions = append(subscriptions, s)
+		}
+
+		totals := []fiber.Map{}
+		currencies := make([]string, 0, len(annualTotals))
+		for currency := range annualTotals {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		for _, currency := range currencies {
+			annual := math.Round(annualTotals[currency]*100) / 100
+			totals = append(totals, fiber.Map{
+				"currency": currency,
+				"annual":   annual,
+				"monthly":  math.Round(annual/12*100) / 100,
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"subscriptions": subscriptions,
+			"totals":        totals,
+		})
+	})
+
+	type SubscriptionRequest struct {
+		Name         *string  `json:"name"`
+		Amount       *float64 `json:"amount"`
+		Currency     *string  `json:"currency"`
+		BillingCycle *string  `json:"billing_cycle"`
+		NextRenewal  *string  `json:"next_renewal"`
+		CancelBy     *string  `json:"cancel_by"`
+		RemindDays   *int     `json:"remind_days"`
+		Status       *string  `json:"status"`
+	}
+
+	// Add a subscription by hand
+	app.Post("/subscriptions", func(c *fiber.Ctx) error {
+		var req SubscriptionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if req.Name == nil || strings.TrimSpace(*req.Name) == "" || req.Amount == nil || *req.Amount <= 0 || req.BillingCycle == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "name, amount and billing_cycle are required",
+			})
+		}
+		if _, ok := cycleByName(*req.BillingCycle); !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "billing_cycle must be weekly, monthly, quarterly or yearly",
+			})
+		}
+		nextRenewal, err := parseOptionalDate(req.NextRenewal)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		cancelBy, err := parseOptionalDate(req.CancelBy)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		remindDays := 3
+		if req.RemindDays != nil && *req.RemindDays >= 0 {
+			remindDays = *req.RemindDays
+		}
+
+		result, err := db.Exec(
+			`INSERT INTO subscriptions (name, amount, currency, billing_cycle, next_renewal, cancel_by, remind_days, status, source)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'manual')`,
+			strings.TrimSpace(*req.Name), *req.Amount, nullableString(req.Currency), *req.BillingCycle,
+			nextRenewal, cancelBy, remindDays, subscriptionActive,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to create subscription: %v", err),
+			})
+		}
+		id, _ := result.LastInsertId()
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"id":      id,
+		})
+	})
+
+	// Update a subscription, e.g. set a cancel-by date or cancel it
+	app.Patch("/subscriptions/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid subscription ID",
+			})
+		}
+
+		var req SubscriptionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		var sets []string
+		var args []any
+		if req.Name != nil && strings.TrimSpace(*req.Name) != "" {
+			sets, args = append(sets, "name = ?"), append(args, strings.TrimSpace(*req.Name))
+		}
+		if req.Amount != nil && *req.Amount > 0 {
+			sets, args = append(sets, "amount = ?"), append(args, *req.Amount)
+		}
+		if req.Currency != nil {
+			sets, args = append(sets, "currency = ?"), append(args, nullableString(req.Currency))
+		}
+		if req.BillingCycle != nil {
+			if _, ok := cycleByName(*req.BillingCycle); !ok {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "billing_cycle must be weekly, monthly, quarterly or yearly",
+				})
+			}
+			sets, args = append(sets, "billing_cycle = ?"), append(args, *req.BillingCycle)
+		}
+		for column, value := range map[string]*string{"next_renewal": req.NextRenewal, "cancel_by": req.CancelBy} {
+			if value == nil {
+				continue
+			}
+			date, err := parseOptionalDate(value)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			sets, args = append(sets, column+" = ?"), append(args, date)
+		}
+		if req.RemindDays != nil && *req.RemindDays >= 0 {
+			sets, args = append(sets, "remind_days = ?"), append(args, *req.RemindDays)
+		}
+		if req.Status != nil {
+			if *req.Status != subscriptionActive && *req.Status != subscriptionCancelled {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "status must be active or cancelled",
+				})
+			}
+			sets, args = append(sets, "status = ?"), append(args, *req.Status)
+		}
+		if len(sets) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing to update",
+			})
+		}
+
+		args = append(args, id)
+		result, err := db.Exec("UPDATE subscriptions SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update subscription: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists int
+			if err := db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE id = ?", id).Scan(&exists); err == nil && exists == 0 {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Subscription not found",
+				})
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"id":      id,
+		})
+	})
+
+	// Scan every merchant's history for recurring charges
+	app.Post("/subscriptions/detect", func(c *fiber.Ctx) error {
+		rows, err := db.Query(
+			`SELECT merchant_id FROM transactions
+			WHERE merchant_id IS NOT NULL AND date IS NOT NULL
+			GROUP BY merchant_id HAVING COUNT(*) >= 2`,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list merchants: %v", err),
+			})
+		}
+		var merchantIDs []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err == nil {
+				merchantIDs = append(merchantIDs, id)
+			}
+		}
+		rows.Close()
+
+		detected := []int64{}
+		for _, merchantID := range merchantIDs {
+			id, err := detectMerchantSubscription(merchantID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			if id > 0 {
+				detected = append(detected, id)
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"detected": detected,
+		})
+	})
+}
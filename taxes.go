@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// taxLineUnmapped collects categories without a tax line mapping
+const taxLineUnmapped = "unmapped"
+
+// jurisdictionPattern limits jurisdiction keys to something safe in file
+// names, e.g. "us-schedule-c" or "de-euer"
+var jurisdictionPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// TaxLineMapping assigns a spending category to a deduction line of a
+// jurisdiction's tax form
+type TaxLineMapping struct {
+	Category string `json:"category"`
+	Line     string `json:"line"`
+	Label    string `json:"label,omitempty"`
+	// DeductiblePercent is the share of the spend that is deductible, e.g.
+	// 50 for business meals in some jurisdictions
+	DeductiblePercent float64 `json:"deductible_percent"`
+}
+
+// TaxLine sums the transactions mapped to one deduction line
+type TaxLine struct {
+	Line         string   `json:"line"`
+	Label        string   `json:"label,omitempty"`
+	Categories   []string `json:"categories"`
+	Transactions int      `json:"transactions"`
+	Total        float64  `json:"total"`
+	Deductible   float64  `json:"deductible"`
+}
+
+// TaxExportItem is one transaction of the tax export
+type TaxExportItem struct {
+	TransactionID int64   `json:"transaction_id"`
+	ReceiptID     int64   `json:"receipt_id"`
+	Date          string  `json:"date"`
+	Merchant      string  `json:"merchant"`
+	Category      string  `json:"category"`
+	Line          string  `json:"line"`
+	Amount        float64 `json:"amount"`
+	Deductible    float64 `json:"deductible"`
+	// CustomFields are the transaction's custom field values
+	CustomFields map[string]any `json:"custom_fields,omitempty"`
+	// Receipt is the file name inside the ZIP bundle
+	Receipt string `json:"receipt"`
+
+	fileName       string
+	storageBackend string
+}
+
+// TaxExport is a tax year's spend summed per deduction line. Amounts are in
+// the home currency.
+type TaxExport struct {
+	Jurisdiction string          `json:"jurisdiction"`
+	Year         int             `json:"year"`
+	Currency     string          `json:"currency"`
+	Lines        []*TaxLine      `json:"lines"`
+	Total        float64         `json:"total"`
+	Deductible   float64         `json:"deductible"`
+	Unconverted  int             `json:"unconverted"`
+	Items        []TaxExportItem `json:"items"`
+}
+
+// taxLineMappings loads the category mappings of a jurisdiction keyed by
+// lowercase category
+func taxLineMappings(jurisdiction string) (map[string]TaxLineMapping, error) {
+	rows, err := db.Query(
+		"SELECT category, line, COALESCE(label, ''), deductible_percent FROM tax_line_mappings WHERE jurisdiction = ? ORDER BY line, category",
+		jurisdiction,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tax line mappings: %v", err)
+	}
+	defer rows.Close()
+
+	mappings := make(map[string]TaxLineMapping)
+	for rows.Next() {
+		var m TaxLineMapping
+		if err := rows.Scan(&m.Category, &m.Line, &m.Label, &m.DeductiblePercent); err != nil {
+			return nil, fmt.Errorf("failed to scan tax line mapping: %v", err)
+		}
+		mappings[m.Category] = m
+	}
+	return mappings, rows.Err()
+}
+
+// buildTaxExport sums the year's transactions of processed receipts,
+// archived ones included, per deduction line. Transactions still waiting for an exchange rate are
+// counted but left out of the amounts.
+func buildTaxExport(jurisdiction string, year int) (*TaxExport, error) {
+	mappings, err := taxLineMappings(jurisdiction)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		`SELECT t.id, t.receipt_id, t.date, COALESCE(t.merchant_clean, t.merchant_raw, ''),
+			COALESCE(LOWER(t.category), ''), t.home_amount, t.conversion_status, t.custom_fields,
+			r.file_name, r.storage_backend
+		FROM `+transactionsAllView+` t
+		JOIN receipts r ON r.id = t.receipt_id
+		WHERE t.date >= ? AND t.date < ? AND t.amount > 0 AND r.status = 'processed'
+		ORDER BY t.date, t.id`,
+		time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transactions: %v", err)
+	}
+	defer rows.Close()
+
+	export := &TaxExport{
+		Jurisdiction: jurisdiction,
+		Year:         year,
+		Currency:     homeCurrency(),
+		Lines:        []*TaxLine{},
+		Items:        []TaxExportItem{},
+	}
+	lines := map[string]*TaxLine{}
+	for rows.Next() {
+		var it TaxExportItem
+		var date time.Time
+		var homeAmount sql.NullFloat64
+		var conversionStatus string
+		var custom []byte
+		if err := rows.Scan(&it.TransactionID, &it.ReceiptID, &date, &it.Merchant, &it.Category,
+			&homeAmount, &conversionStatus, &custom, &it.fileName, &it.storageBackend); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %v", err)
+		}
+		if conversionStatus == conversionPending || !homeAmount.Valid {
+			export.Unconverted++
+			continue
+		}
+
+		m, ok := mappings[it.Category]
+		if !ok {
+			m = TaxLineMapping{Line: taxLineUnmapped}
+		}
+		it.Date = date.Format("2006-01-02")
+		it.CustomFields = decodeCustomFields(custom)
+		it.Line = m.Line
+		it.Amount = roundCents(homeAmount.Float64)
+		it.Deductible = roundCents(homeAmount.Float64 * m.DeductiblePercent / 100)
+		it.Receipt = fmt.Sprintf("receipts/%s/%d_%s", m.Line, it.TransactionID, path.Base(it.fileName))
+
+		line, ok := lines[m.Line]
+		if !ok {
+			line = &TaxLine{Line: m.Line, Label: m.Label, Categories: []string{}}
+			lines[m.Line] = line
+			export.Lines = append(export.Lines, line)
+		}
+		category := it.Category
+		if category == "" {
+			category = "uncategorized"
+		}
+		if !containsString(line.Categories, category) {
+			line.Categories = append(line.Categories, category)
+		}
+		line.Transactions++
+		line.Total = roundCents(line.Total + it.Amount)
+		line.Deductible = roundCents(line.Deductible + it.Deductible)
+		export.Total = roundCents(export.Total + it.Amount)
+		export.Deductible = roundCents(export.Deductible + it.Deductible)
+		export.Items = append(export.Items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Form line order, with unmapped spend last
+	sort.Slice(export.Lines, func(i, j int) bool {
+		a, b := export.Lines[i].Line, export.Lines[j].Line
+		if (a == taxLineUnmapped) != (b == taxLineUnmapped) {
+			return b == taxLineUnmapped
+		}
+		return a < b
+	})
+	return export, nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTaxSummaryCSV writes one row per deduction line plus totals
+func writeTaxSummaryCSV(out io.Writer, export *TaxExport) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"Line", "Label", "Categories", "Transactions", "Total", "Deductible", "Currency"})
+	for _, l := range export.Lines {
+		w.Write([]string{
+			l.Line, l.Label, strings.Join(l.Categories, "; "), strconv.Itoa(l.Transactions),
+			strconv.FormatFloat(l.Total, 'f', 2, 64),
+			strconv.FormatFloat(l.Deductible, 'f', 2, 64),
+			export.Currency,
+		})
+	}
+	w.Write([]string{"Total", "", "", strconv.Itoa(len(export.Items)),
+		strconv.FormatFloat(export.Total, 'f', 2, 64),
+		strconv.FormatFloat(export.Deductible, 'f', 2, 64),
+		export.Currency,
+	})
+	w.Flush()
+	return w.Error()
+}
+
+// writeTaxItemsCSV writes one row per transaction
+func writeTaxItemsCSV(out io.Writer, export *TaxExport) error {
+	w := csv.NewWriter(out)
+	w.Write(append([]string{"Date", "Merchant", "Category", "Line", "Amount", "Deductible", "Currency", "Receipt"},
+		customFieldHeaders()...))
+	for _, it := range export.Items {
+		w.Write(append([]string{
+			it.Date, it.Merchant, it.Category, it.Line,
+			strconv.FormatFloat(it.Amount, 'f', 2, 64),
+			strconv.FormatFloat(it.Deductible, 'f', 2, 64),
+			export.Currency, it.Receipt,
+		}, customFieldCells(it.CustomFields)...))
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeTaxBundle writes a ZIP with the summary and transaction CSVs and the
+// receipt files grouped in one folder per deduction line
+func writeTaxBundle(w io.Writer, export *TaxExport) error {
+	zw := zip.NewWriter(w)
+	for name, write := range map[string]func(io.Writer, *TaxExport) error{
+		"summary.csv":      writeTaxSummaryCSV,
+		"transactions.csv": writeTaxItemsCSV,
+	} {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if err := write(f, export); err != nil {
+			return err
+		}
+	}
+	for _, it := range export.Items {
+		if err := addReceiptFile(zw, it.storageBackend, it.fileName, it.Receipt); err != nil {
+			log.Printf("Tax export: skipping receipt for transaction %d: %v", it.TransactionID, err)
+		}
+	}
+	return zw.Close()
+}
+
+// addReceiptFile copies a stored receipt file into a ZIP archive
+func addReceiptFile(zw *zip.Writer, backend, key, name string) error {
+	store, err := newStorage(backend)
+	if err != nil {
+		return err
+	}
+	r, err := store.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// registerTaxRoutes adds the tax line mappings and the tax export
+func registerTaxRoutes(app *fiber.App) {
+	app.Get("/tax/mappings", func(c *fiber.Ctx) error {
+		jurisdiction := c.Query("jurisdiction")
+		if !jurisdictionPattern.MatchString(jurisdiction) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "jurisdiction is required, e.g. us-schedule-c",
+			})
+		}
+		mappings, err := taxLineMappings(jurisdiction)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":      true,
+			"jurisdiction": jurisdiction,
+			"mappings":     mappings,
+		})
+	})
+
+	// Map a category to a deduction line of a jurisdiction; an empty line
+	// removes the mapping. deductible_percent defaults to 100.
+	app.Put("/tax/mappings", func(c *fiber.Ctx) error {
+		var req struct {
+			Jurisdiction      string   `json:"jurisdiction"`
+			Category          string   `json:"category"`
+			Line              string   `json:"line"`
+			Label             string   `json:"label"`
+			DeductiblePercent *float64 `json:"deductible_percent"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		jurisdiction := strings.ToLower(strings.TrimSpace(req.Jurisdiction))
+		if !jurisdictionPattern.MatchString(jurisdiction) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "jurisdiction must be 1-32 lowercase letters, digits, - or _",
+			})
+		}
+		category := strings.ToLower(strings.TrimSpace(req.Category))
+		if category == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "category is required",
+			})
+		}
+		line := strings.TrimSpace(req.Line)
+		if line == taxLineUnmapped || strings.ContainsAny(line, `/\`) || len(line) > 50 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "line must be at most 50 characters without slashes",
+			})
+		}
+		percent := 100.0
+		if req.DeductiblePercent != nil {
+			percent = *req.DeductiblePercent
+		}
+		if percent < 0 || percent > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "deductible_percent must be between 0 and 100",
+			})
+		}
+
+		var err error
+		if line == "" {
+			_, err = db.Exec("DELETE FROM tax_line_mappings WHERE jurisdiction = ? AND category = ?", jurisdiction, category)
+		} else {
+			_, err = db.Exec(
+				`INSERT INTO tax_line_mappings (jurisdiction, category, line, label, deductible_percent) VALUES (?, ?, ?, ?, ?)
+				ON DUPLICATE KEY UPDATE line = VALUES(line), label = VALUES(label), deductible_percent = VALUES(deductible_percent)`,
+				jurisdiction, category, line, sql.NullString{String: req.Label, Valid: req.Label != ""}, percent,
+			)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save mapping: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	// Spend per deduction line for a tax year (default last year) as json
+	// or csv, or with attachments=true a ZIP of both CSVs and the receipt
+	// files for the accountant
+	app.Get("/tax/export", func(c *fiber.Ctx) error {
+		jurisdiction := c.Query("jurisdiction")
+		if !jurisdictionPattern.MatchString(jurisdiction) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "jurisdiction is required, e.g. us-schedule-c",
+			})
+		}
+		year := c.QueryInt("year", time.Now().Year()-1)
+		if year < 1900 || year > time.Now().Year() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid tax year",
+			})
+		}
+		format := c.Query("format", "json")
+		if format != "json" && format != "csv" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "format must be json or csv",
+			})
+		}
+
+		export, err := buildTaxExport(jurisdiction, year)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build tax export: %v", err),
+			})
+		}
+
+		base := fmt.Sprintf("tax-%s-%d", jurisdiction, year)
+		if c.QueryBool("attachments") {
+			// Streamed, since a year of receipt files does not fit in
+			// memory; errors past this point can only be logged
+			c.Set("Content-Type", "application/zip")
+			c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, base))
+			c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+				if err := writeTaxBundle(w, export); err != nil {
+					log.Printf("Tax export: failed to build bundle: %v", err)
+				}
+			})
+			return nil
+		}
+		if format == "csv" {
+			c.Set("Content-Type", "text/csv")
+			c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, base))
+			return writeTaxSummaryCSV(c, export)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"export":  export,
+		})
+	})
+}
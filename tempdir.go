@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tempDirPrefix names the per-receipt temporary directories so leftovers
+// from a crashed process can be found and removed
+const tempDirPrefix = "receipt-pipeline-"
+
+// TempDir is a temporary directory holding all intermediate files of one
+// pipeline run; Cleanup removes it with everything inside
+type TempDir struct {
+	Path string
+}
+
+// newTempDir creates a temporary directory for a pipeline run
+func newTempDir() (*TempDir, error) {
+	path, err := os.MkdirTemp("", tempDirPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &TempDir{Path: path}, nil
+}
+
+// Cleanup removes the directory and its contents. It is safe to call on a
+// nil TempDir and more than once.
+func (d *TempDir) Cleanup() {
+	if d == nil || d.Path == "" {
+		return
+	}
+	if err := os.RemoveAll(d.Path); err != nil {
+		log.Printf("Failed to remove temp directory %s: %v", d.Path, err)
+	}
+	d.Path = ""
+}
+
+// cleanupStaleTempDirs removes pipeline temp directories older than maxAge,
+// left behind when the process was killed mid-run
+func cleanupStaleTempDirs(maxAge time.Duration) {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), tempDirPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove stale temp directory %s: %v", dir, err)
+			continue
+		}
+		log.Printf("Removed stale temp directory %s", dir)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Thumbnail widths in pixels
+const (
+	defaultThumbnailWidth = 320
+	maxThumbnailWidth     = 1024
+)
+
+// errNoThumbnail is returned for files no thumbnail can be rendered from,
+// e.g. WebP photos, which the standard library cannot decode
+var errNoThumbnail = errors.New("thumbnails are not available for this file type")
+
+// renderThumbnail renders a JPEG of at most width pixels across from a
+// local receipt file: the photo, upright as its EXIF orientation says, or
+// the first page of a PDF. Temporary files go to dir.
+func renderThumbnail(path, dir string, isPDF bool, width int) ([]byte, error) {
+	var src image.Image
+	if isPDF {
+		page, err := renderPDFPage(path, dir, width)
+		if err != nil {
+			return nil, err
+		}
+		if src, err = decodeImageFile(page); err != nil {
+			return nil, err
+		}
+	} else {
+		img, err := decodeImageFile(path)
+		if err != nil {
+			return nil, errNoThumbnail
+		}
+		src = orientImage(img, jpegOrientation(path))
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleToWidth(src, width), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderPDFPage renders the first page of a PDF to a PNG in dir, scaled to
+// width pixels across
+func renderPDFPage(pdfPath, dir string, width int) (string, error) {
+	prefix := filepath.Join(dir, "thumbnail")
+	cmd := exec.Command("pdftoppm", "-png", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to-x", strconv.Itoa(width), "-scale-to-y", "-1", pdfPath, prefix)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to render PDF page: %v: %s", err, bytes.TrimSpace(out))
+	}
+	page := prefix + ".png"
+	if _, err := os.Stat(page); err != nil {
+		return "", fmt.Errorf("no image rendered from PDF")
+	}
+	return page, nil
+}
+
+// scaleToWidth shrinks an image to width pixels across, keeping its aspect
+// ratio, by averaging the source pixels each target pixel covers. Images
+// that are already narrow enough are returned as they are.
+func scaleToWidth(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return src
+	}
+	height := max(b.Dy()*width/b.Dx(), 1)
+
+	// Converting once gives direct access to the pixels; draw has fast
+	// paths for the JPEG and PNG image types
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*b.Dy()/height, max((y+1)*b.Dy()/height, y*b.Dy()/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*b.Dx()/width, max((x+1)*b.Dx()/width, x*b.Dx()/width+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			off := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[off+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// diningCategories are the categories whose receipts get tip validation
+var diningCategories = map[string]bool{
+	"restaurant":  true,
+	"restaurants": true,
+	"dining":      true,
+	"cafe":        true,
+	"bar":         true,
+}
+
+// TipAnalysis is the tip computed for a dining receipt
+type TipAnalysis struct {
+	Amount     float64 `json:"amount"`
+	Percentage float64 `json:"percentage"`
+	Unusual    bool    `json:"unusual"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// isDiningCategory reports whether a category is a restaurant-style category
+func isDiningCategory(category string) bool {
+	return diningCategories[strings.ToLower(strings.TrimSpace(category))]
+}
+
+// maxUsualTipPercent is the tip percentage above which a tip is flagged,
+// configurable via TIP_MAX_PERCENT (default 35)
+func maxUsualTipPercent() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("TIP_MAX_PERCENT"), 64); err == nil && v > 0 {
+		return v
+	}
+	return 35
+}
+
+// analyzeTip computes the tip percentage of a dining receipt from its
+// subtotal and either the printed tip or what the total adds to subtotal
+// and tax. Unusually high tips are flagged since OCR errors often inflate
+// totals. Returns nil for non-dining receipts, when there is no subtotal,
+// and when neither the tip nor the tax is printed, since the tax would
+// pass for a tip. A subtotal that already includes the printed VAT, so the
+// total covers it but not the tax on top, leaves no tip to derive.
+func analyzeTip(data *GeminiParsedData) *TipAnalysis {
+	if !isDiningCategory(data.Category) || data.Subtotal <= 0 {
+		return nil
+	}
+
+	tip := data.Tip
+	if tip == 0 {
+		if data.Tax <= 0 || data.Amount <= 0 {
+			return nil
+		}
+		tip = data.Amount - data.Subtotal - data.Tax
+		if tip < 0 && data.Amount >= data.Subtotal {
+			return nil
+		}
+	}
+
+	analysis := &TipAnalysis{
+		Amount:     math.Round(tip*100) / 100,
+		Percentage: math.Round(tip/data.Subtotal*10000) / 100,
+	}
+
+	switch {
+	case tip < 0:
+		analysis.Unusual = true
+		analysis.Reason = "total is lower than subtotal plus tax"
+	case analysis.Percentage > maxUsualTipPercent():
+		analysis.Unusual = true
+		analysis.Reason = "tip percentage above usual range, total may be misread"
+	case data.Amount > 0 && data.Tip > 0 && math.Min(
+		math.Abs(data.Subtotal+data.Tax+data.Tip-data.Amount), // tax on top
+		math.Abs(data.Subtotal+data.Tip-data.Amount),          // tax included
+	) > data.Amount*0.25:
+		analysis.Unusual = true
+		analysis.Reason = "subtotal plus tax and tip does not match total"
+	}
+
+	return analysis
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestAnalyzeTip(t *testing.T) {
+	t.Setenv("TIP_MAX_PERCENT", "")
+
+	tests := []struct {
+		name    string
+		data    GeminiParsedData
+		none    bool
+		amount  float64
+		percent float64
+		unusual bool
+	}{
+		{name: "not dining", data: GeminiParsedData{Category: "Groceries", Subtotal: 50, Tip: 9, Amount: 59}, none: true},
+		{name: "no subtotal", data: GeminiParsedData{Category: "Restaurant", Tip: 9, Amount: 59}, none: true},
+		{name: "printed tip", data: GeminiParsedData{Category: "Restaurant", Subtotal: 50, Tax: 4, Tip: 9, Amount: 63},
+			amount: 9, percent: 18},
+		{name: "tip from total minus subtotal and tax", data: GeminiParsedData{Category: "dining", Subtotal: 50, Tax: 4, Amount: 63},
+			amount: 9, percent: 18},
+		{name: "no tip", data: GeminiParsedData{Category: "Cafe", Subtotal: 50, Tax: 4, Amount: 54}},
+		{name: "neither tip nor tax printed", data: GeminiParsedData{Category: "Bar", Subtotal: 50, Amount: 60}, none: true},
+		{name: "VAT-inclusive subtotal", data: GeminiParsedData{Category: "Restaurant", Subtotal: 119, Tax: 19, Amount: 119},
+			none: true},
+		{name: "VAT-inclusive subtotal with printed tip", data: GeminiParsedData{Category: "Restaurant", Subtotal: 119, Tax: 19, Tip: 12, Amount: 131},
+			amount: 12, percent: 10.08},
+		{name: "VAT-inclusive subtotal with high printed tip", data: GeminiParsedData{Category: "Restaurant", Subtotal: 100, Tax: 16, Tip: 50, Amount: 150},
+			amount: 50, percent: 50, unusual: true},
+		{name: "total below subtotal", data: GeminiParsedData{Category: "Restaurant", Subtotal: 50, Tax: 4, Amount: 40},
+			amount: -14, percent: -28, unusual: true},
+		{name: "misread total", data: GeminiParsedData{Category: "Restaurant", Subtotal: 20, Tax: 2, Amount: 40},
+			amount: 18, percent: 90, unusual: true},
+		{name: "printed tip not matching total", data: GeminiParsedData{Category: "Restaurant", Subtotal: 50, Tax: 4, Tip: 9, Amount: 120},
+			amount: 9, percent: 18, unusual: true},
+	}
+	for _, tt := range tests {
+		got := analyzeTip(&tt.data)
+		if tt.none {
+			if got != nil {
+				t.Errorf("%s: analyzeTip = %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: analyzeTip = nil", tt.name)
+			continue
+		}
+		if got.Amount != tt.amount || got.Percentage != tt.percent || got.Unusual != tt.unusual {
+			t.Errorf("%s: analyzeTip = %+v, want amount %v, percentage %v, unusual %v",
+				tt.name, got, tt.amount, tt.percent, tt.unusual)
+		}
+	}
+}
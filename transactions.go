@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// transactionColumns are the transaction columns written from parsed
+// receipt data, in the order of transactionValues
+var transactionColumns = []string{
+	"merchant_id", "date", "purchase_time", "merchant_raw", "merchant_clean", "category", "amount", "currency", "confidence", "reference_number",
+	"subtotal", "tip", "tip_percentage", "tip_unusual", "home_amount", "conversion_status", "merchant_country", "date_ambiguous",
+	"branch_name", "store_number", "store_address", "profile", "extra_fields", "custom_fields", "fingerprint",
+}
+
+// transactionValues converts parsed receipt data to the values of
+// transactionColumns
+func transactionValues(data *GeminiParsedData) ([]any, error) {
+	var transactionDate sql.NullTime
+	if data.Date != "" {
+		if t, err := time.Parse("2006-01-02", data.Date); err == nil {
+			transactionDate = sql.NullTime{Time: t, Valid: true}
+		}
+	}
+
+	var purchaseTime sql.NullString
+	if t, err := time.Parse("15:04", data.Time); err == nil {
+		purchaseTime = sql.NullString{String: t.Format("15:04:05"), Valid: true}
+	}
+
+	var tipAmount, tipPercentage sql.NullFloat64
+	tipUnusual := false
+	if tip := analyzeTip(data); tip != nil {
+		tipAmount = sql.NullFloat64{Float64: tip.Amount, Valid: true}
+		tipPercentage = sql.NullFloat64{Float64: tip.Percentage, Valid: true}
+		tipUnusual = tip.Unusual
+	}
+
+	// Foreign-currency amounts without a rate for that date stay pending
+	// until exchange rates arrive
+	conversionDate := time.Now()
+	if transactionDate.Valid {
+		conversionDate = transactionDate.Time
+	}
+	conversionStatus, homeAmount, err := convertToHome(data.Amount, data.Currency, conversionDate)
+	if err != nil {
+		return nil, err
+	}
+
+	merchantID, err := resolveMerchantID(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var extraFields sql.NullString
+	if len(data.Extra) > 0 {
+		encoded, err := json.Marshal(data.Extra)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode extra fields: %v", err)
+		}
+		extraFields = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	customFieldsColumn, err := encodeCustomFields(data.Custom)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := transactionFingerprint(data)
+
+	return []any{
+		merchantID,
+		transactionDate,
+		purchaseTime,
+		sql.NullString{String: data.MerchantRaw, Valid: data.MerchantRaw != ""},
+		sql.NullString{String: data.MerchantClean, Valid: data.MerchantClean != ""},
+		sql.NullString{String: data.Category, Valid: data.Category != ""},
+		sql.NullFloat64{Float64: data.Amount, Valid: data.Amount > 0},
+		sql.NullString{String: data.Currency, Valid: data.Currency != ""},
+		sql.NullFloat64{Float64: data.Confidence, Valid: data.Confidence > 0},
+		sql.NullString{String: data.ReferenceNumber, Valid: data.ReferenceNumber != ""},
+		sql.NullFloat64{Float64: data.Subtotal, Valid: data.Subtotal > 0},
+		tipAmount,
+		tipPercentage,
+		tipUnusual,
+		homeAmount,
+		conversionStatus,
+		sql.NullString{String: data.MerchantCountry, Valid: data.MerchantCountry != ""},
+		data.DateAmbiguous,
+		sql.NullString{String: data.BranchName, Valid: data.BranchName != ""},
+		sql.NullString{String: data.StoreNumber, Valid: data.StoreNumber != ""},
+		sql.NullString{String: data.StoreAddress, Valid: data.StoreAddress != ""},
+		sql.NullString{String: data.Profile, Valid: data.Profile != ""},
+		extraFields,
+		customFieldsColumn,
+		sql.NullString{String: fingerprint, Valid: fingerprint != ""},
+	}, nil
+}
+
+// insertTransaction stores parsed receipt data as a transaction row
+func insertTransaction(receiptID int64, data *GeminiParsedData) (int64, error) {
+	values, err := transactionValues(data)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := execWithRetry(
+		fmt.Sprintf("INSERT INTO transactions (receipt_id, %s, created_at) VALUES (?, %s?, ?)",
+			strings.Join(transactionColumns, ", "), strings.Repeat("?, ", len(transactionColumns))),
+		append(append([]any{receiptID}, values...), time.Now())...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert transaction: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// Charges from a subscription's merchant move its renewal forward
+	merchantID, date := values[0].(sql.NullInt64), values[1].(sql.NullTime)
+	if merchantID.Valid && date.Valid && data.Amount > 0 {
+		if err := recordSubscriptionCharge(merchantID.Int64, data.Amount, date.Time); err != nil {
+			log.Printf("Subscriptions: %v", err)
+		}
+	}
+	return id, nil
+}
+
+// updateTransaction replaces the parsed fields of an existing transaction,
+// e.g. when its receipt is analyzed again. Project and invoice links are
+// kept.
+func updateTransaction(id int64, data *GeminiParsedData) error {
+	values, err := transactionValues(data)
+	if err != nil {
+		return err
+	}
+	if _, err := execWithRetry(
+		"UPDATE transactions SET "+strings.Join(transactionColumns, " = ?, ")+" = ? WHERE id = ?",
+		append(values, id)...,
+	); err != nil {
+		return fmt.Errorf("failed to update transaction %d: %v", id, err)
+	}
+	return nil
+}
+
+// findDuplicateTransaction returns the ID of an existing transaction with the
+// same merchant and POS reference number, or 0 when there is none. Receipts
+// without a reference number are never considered duplicates.
+func findDuplicateTransaction(data *GeminiParsedData) (int64, error) {
+	merchant := data.MerchantClean
+	if merchant == "" {
+		merchant = data.MerchantRaw
+	}
+	if data.ReferenceNumber == "" || merchant == "" {
+		return 0, nil
+	}
+
+	var id int64
+	err := db.QueryRow(
+		`SELECT id FROM transactions
+		WHERE reference_number = ? AND (merchant_clean = ? OR (merchant_clean IS NULL AND merchant_raw = ?))
+		ORDER BY id LIMIT 1`,
+		data.ReferenceNumber, merchant, merchant,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to check for duplicate transaction: %v", err)
+	}
+	return id, nil
+}
+
+// TransactionSummary is a transaction in the transaction list
+type TransactionSummary struct {
+	ID        int64   `json:"id"`
+	ReceiptID int64   `json:"receipt_id"`
+	Date      *string `json:"date"`
+	Merchant  *string `json:"merchant"`
+	Category  *string `json:"category"`
+	// CategoryLabel is the category in the language of the request
+	CategoryLabel   *string  `json:"category_label,omitempty"`
+	Amount          *float64 `json:"amount"`
+	Currency        *string  `json:"currency"`
+	HomeAmount      *float64 `json:"home_amount"`
+	Confidence      *float64 `json:"confidence"`
+	ReferenceNumber *string  `json:"reference_number"`
+	// CustomFields are the values of the deployment's custom fields
+	CustomFields     map[string]any    `json:"custom_fields,omitempty"`
+	PolicyViolations []PolicyViolation `json:"policy_violations,omitempty"`
+	// UpdatedAt is set once the transaction has been changed after it was
+	// stored
+	UpdatedAt *string `json:"updated_at"`
+}
+
+// transactionSummaryColumns are the transaction columns read by
+// scanTransactionSummary
+const transactionSummaryColumns = `id, receipt_id, date, COALESCE(merchant_clean, merchant_raw), category, amount, currency,
+	home_amount, confidence, reference_number, custom_fields, policy_violations, updated_at`
+
+// scanTransactionSummary reads a row selected with transactionSummaryColumns
+func scanTransactionSummary(row interface{ Scan(...any) error }) (TransactionSummary, error) {
+	var t TransactionSummary
+	var date, updatedAt sql.NullTime
+	var merchant, category, currency, reference sql.NullString
+	var amount, homeAmount, confidence sql.NullFloat64
+	var custom, violations []byte
+	if err := row.Scan(&t.ID, &t.ReceiptID, &date, &merchant, &category, &amount, &currency,
+		&homeAmount, &confidence, &reference, &custom, &violations, &updatedAt); err != nil {
+		return t, err
+	}
+	t.Date = formatNullDate(date)
+	t.Merchant = nullStringPtr(merchant)
+	t.Category = nullStringPtr(category)
+	t.Amount = nullFloatPtr(amount)
+	t.Currency = nullStringPtr(currency)
+	t.HomeAmount = nullFloatPtr(homeAmount)
+	t.Confidence = nullFloatPtr(confidence)
+	t.ReferenceNumber = nullStringPtr(reference)
+	t.CustomFields = decodeCustomFields(custom)
+	t.PolicyViolations = decodePolicyViolations(violations)
+	if updatedAt.Valid {
+		v := updatedAt.Time.Format(time.RFC3339)
+		t.UpdatedAt = &v
+	}
+	return t, nil
+}
+
+// transactionSortColumns maps the sort keys of the transaction list to
+// columns
+var transactionSortColumns = map[string]string{
+	"date":        "date",
+	"amount":      "amount",
+	"home_amount": "home_amount",
+	"merchant":    "COALESCE(merchant_clean, merchant_raw)",
+	"category":    "category",
+	"confidence":  "confidence",
+	"created":     "created_at",
+}
+
+// transactionListFilter builds the WHERE clause of the transaction list
+// from the from/to (transaction day), category (comma separated), merchant
+// (substring), min_amount/max_amount, currency and min_confidence query
+// parameters
+func transactionListFilter(c *fiber.Ctx) (string, []any, error) {
+	dateCond, args, err := reportDateRange(c, "date")
+	if err != nil {
+		return "", nil, err
+	}
+	conds := []string{dateCond}
+
+	if category := c.Query("category"); category != "" {
+		var placeholders []string
+		for _, cat := range strings.Split(category, ",") {
+			placeholders = append(placeholders, "?")
+			args = append(args, strings.ToLower(strings.TrimSpace(cat)))
+		}
+		conds = append(conds, "LOWER(category) IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if merchant := c.Query("merchant"); merchant != "" {
+		escaped := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(merchant) + "%"
+		conds = append(conds, "(merchant_clean LIKE ? OR merchant_raw LIKE ?)")
+		args = append(args, escaped, escaped)
+	}
+	for _, bound := range []struct {
+		param, cond string
+	}{
+		{"min_amount", "amount >= ?"},
+		{"max_amount", "amount <= ?"},
+		{"min_confidence", "confidence >= ?"},
+	} {
+		raw := c.Query(bound.param)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s must be a number", bound.param)
+		}
+		conds = append(conds, bound.cond)
+		args = append(args, v)
+	}
+	if currency := c.Query("currency"); currency != "" {
+		currency = strings.ToUpper(strings.TrimSpace(currency))
+		if !iso4217Currencies[currency] {
+			return "", nil, fmt.Errorf("currency must be an ISO 4217 code such as EUR")
+		}
+		conds = append(conds, "currency = ?")
+		args = append(args, currency)
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// transactionListOrder reads the sort query parameter, a key of
+// transactionSortColumns prefixed with - for descending order (default
+// -date). Ties are broken by ID in the same direction.
+func transactionListOrder(sort string) (string, error) {
+	if sort == "" {
+		sort = "-date"
+	}
+	dir := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		dir = "DESC"
+		sort = sort[1:]
+	}
+	column, ok := transactionSortColumns[sort]
+	if !ok {
+		return "", fmt.Errorf("sort must be one of date, amount, home_amount, merchant, category, confidence or created, optionally prefixed with -")
+	}
+	return column + " " + dir + ", id " + dir, nil
+}
+
+// registerTransactionRoutes adds the transaction list
+func registerTransactionRoutes(app *fiber.App) {
+	// Transactions matching the filters of transactionListFilter, sorted by
+	// sort and paged with limit and offset. total and home_total cover all
+	// matching transactions. include_archived=true also searches the
+	// archive.
+	app.Get("/transactions", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", defaultReceiptPageSize)
+		if limit < 1 || limit > maxReceiptPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxReceiptPageSize),
+			})
+		}
+		offset := c.QueryInt("offset", 0)
+		if offset < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "offset must not be negative",
+			})
+		}
+		order, err := transactionListOrder(c.Query("sort"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		where, args, err := transactionListFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		table := "transactions"
+		if c.QueryBool("include_archived") {
+			table = transactionsAllView
+		}
+
+		var total int
+		var homeTotal sql.NullFloat64
+		if err := db.QueryRow("SELECT COUNT(*), SUM(home_amount) FROM "+table+" WHERE "+where, args...).Scan(&total, &homeTotal); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to count transactions: %v", err),
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT `+transactionSummaryColumns+`
+			FROM `+table+`
+			WHERE `+where+`
+			ORDER BY `+order+`
+			LIMIT ? OFFSET ?`,
+			append(args, limit, offset)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to list transactions: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		transactions := []TransactionSummary{}
+		for rows.Next() {
+			t, err := scanTransactionSummary(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read transactions: %v", err),
+				})
+			}
+			transactions = append(transactions, t)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read transactions: %v", err),
+			})
+		}
+		newLocalizer(c).Transactions(transactions)
+
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"transactions":  transactions,
+			"total":         total,
+			"home_total":    roundCents(homeTotal.Float64),
+			"home_currency": homeCurrency(),
+			"limit":         limit,
+			"offset":        offset,
+		})
+	})
+}
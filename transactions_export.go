@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// transactionExportHeaders are the leading columns of a transaction export;
+// the custom fields follow
+var transactionExportHeaders = []string{
+	"ID", "Receipt", "Date", "Merchant", "Category", "Amount", "Currency", "Home Amount", "Confidence", "Reference",
+}
+
+// sheetWriter writes rows of a spreadsheet export. Cells are nil, string
+// or float64.
+type sheetWriter interface {
+	WriteRow(cells []any) error
+	Close() error
+}
+
+// csvSheet writes rows as CSV
+type csvSheet struct {
+	w *csv.Writer
+}
+
+func (s *csvSheet) WriteRow(cells []any) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case string:
+			record[i] = v
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return s.w.Write(record)
+}
+
+func (s *csvSheet) Close() error {
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// xlsxParts are the fixed parts of a workbook with a single sheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Transactions" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// xlsxSheet writes rows as an Excel workbook with one sheet. Strings are
+// stored inline, so rows are written as they come without a shared string
+// table.
+type xlsxSheet struct {
+	zw    *zip.Writer
+	sheet io.Writer
+}
+
+// newXLSXSheet writes the fixed workbook parts and opens the sheet
+func newXLSXSheet(w io.Writer) (*xlsxSheet, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(sheet, xml.Header+
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return nil, err
+	}
+	return &xlsxSheet{zw: zw, sheet: sheet}, nil
+}
+
+func (s *xlsxSheet) WriteRow(cells []any) error {
+	w := bufio.NewWriter(s.sheet)
+	w.WriteString("<row>")
+	for _, cell := range cells {
+		switch v := cell.(type) {
+		case string:
+			w.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(w, []byte(v))
+			w.WriteString("</t></is></c>")
+		case float64:
+			w.WriteString("<c><v>" + strconv.FormatFloat(v, 'f', -1, 64) + "</v></c>")
+		default:
+			w.WriteString("<c/>")
+		}
+	}
+	w.WriteString("</row>")
+	return w.Flush()
+}
+
+func (s *xlsxSheet) Close() error {
+	if _, err := io.WriteString(s.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	return s.zw.Close()
+}
+
+// transactionExportRow returns the export cells of a transaction
+func transactionExportRow(t TransactionSummary) []any {
+	cells := []any{
+		float64(t.ID), float64(t.ReceiptID), stringCell(t.Date), stringCell(t.Merchant), stringCell(t.Category),
+		numberCell(t.Amount), stringCell(t.Currency), numberCell(t.HomeAmount), numberCell(t.Confidence),
+		stringCell(t.ReferenceNumber),
+	}
+	for _, v := range customFieldCells(t.CustomFields) {
+		cells = append(cells, v)
+	}
+	return cells
+}
+
+// stringCell returns a nullable text column as a cell
+func stringCell(v *string) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// numberCell returns a nullable number column as a cell
+func numberCell(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// registerTransactionExportRoutes adds the spreadsheet export of the
+// transaction list
+func registerTransactionExportRoutes(app *fiber.App) {
+	// All transactions matching the filters and sort of GET /transactions
+	// as a CSV (default) or Excel download
+	app.Get("/transactions/export", func(c *fiber.Ctx) error {
+		format := c.Query("format", "csv")
+		if format != "csv" && format != "xlsx" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "format must be csv or xlsx",
+			})
+		}
+		order, err := transactionListOrder(c.Query("sort"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		where, args, err := transactionListFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		table := "transactions"
+		if c.QueryBool("include_archived") {
+			table = transactionsAllView
+		}
+
+		rows, err := db.Query(
+			`SELECT `+transactionSummaryColumns+`
+			FROM `+table+`
+			WHERE `+where+`
+			ORDER BY `+order,
+			args...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to export transactions: %v", err),
+			})
+		}
+
+		contentType := "text/csv"
+		if format == "xlsx" {
+			contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		}
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="transactions-%s.%s"`, time.Now().Format("20060102"), format))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer rows.Close()
+
+			var sheet sheetWriter = &csvSheet{w: csv.NewWriter(w)}
+			if format == "xlsx" {
+				if sheet, err = newXLSXSheet(w); err != nil {
+					log.Printf("Transaction export: %v", err)
+					return
+				}
+			}
+			headers := []any{}
+			for _, h := range append(transactionExportHeaders, customFieldHeaders()...) {
+				headers = append(headers, h)
+			}
+			if err := sheet.WriteRow(headers); err != nil {
+				log.Printf("Transaction export: %v", err)
+				return
+			}
+			for rows.Next() {
+				t, err := scanTransactionSummary(rows)
+				if err != nil {
+					log.Printf("Transaction export: failed to read transaction: %v", err)
+					return
+				}
+				if err := sheet.WriteRow(transactionExportRow(t)); err != nil {
+					log.Printf("Transaction export: %v", err)
+					return
+				}
+			}
+			if err := rows.Err(); err != nil {
+				log.Printf("Transaction export: failed to read transactions: %v", err)
+				return
+			}
+			if err := sheet.Close(); err != nil {
+				log.Printf("Transaction export: %v", err)
+			}
+		})
+		return nil
+	})
+}
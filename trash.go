@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// transactionsTrashTable holds the transactions of receipts in the trash.
+// Moving them out of transactions and transactions_archive keeps trashed
+// receipts out of the reports and exports that read transactions. Rows
+// keyed by the receipt alone, such as the inventory ledger, loyalty points
+// and approvals, stay in place and are filtered on receipts.deleted_at.
+const transactionsTrashTable = "transactions_trash"
+
+// defaultTrashRetentionDays is how long receipts stay in the trash unless
+// TRASH_RETENTION_DAYS says otherwise
+const defaultTrashRetentionDays = 30
+
+// trashRetentionDays reads TRASH_RETENTION_DAYS; 0 keeps trashed receipts
+// until they are deleted by hand
+func trashRetentionDays() int {
+	v := os.Getenv("TRASH_RETENTION_DAYS")
+	if v == "" {
+		return defaultTrashRetentionDays
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 0 {
+		log.Printf("Invalid TRASH_RETENTION_DAYS %q, using %d", v, defaultTrashRetentionDays)
+		return defaultTrashRetentionDays
+	}
+	return days
+}
+
+// trashReceipt moves a receipt to the trash and returns how many
+// transactions went with it. Its transactions, live and archived, move to
+// transactions_trash, remembering where they came from; line items and the
+// other rows keyed by the receipt stay in place for a restore.
+func trashReceipt(id int64) (int64, error) {
+	columns, err := tableColumns("transactions")
+	if err != nil {
+		return 0, err
+	}
+	list := "`" + strings.Join(columns, "`, `") + "`"
+
+	var transactions int64
+	err = inTx("trash receipt", func(tx *sql.Tx) error {
+		transactions = 0
+		for _, table := range []string{"transactions", "transactions_archive"} {
+			if _, err := tx.Exec(
+				fmt.Sprintf("INSERT INTO %s (%s, trashed_from) SELECT %s, ? FROM %s WHERE receipt_id = ?",
+					transactionsTrashTable, list, list, table),
+				table, id,
+			); err != nil {
+				return fmt.Errorf("failed to copy %s to the trash: %v", table, err)
+			}
+			res, err := tx.Exec("DELETE FROM "+table+" WHERE receipt_id = ?", id)
+			if err != nil {
+				return fmt.Errorf("failed to remove trashed %s: %v", table, err)
+			}
+			n, _ := res.RowsAffected()
+			transactions += n
+		}
+		_, err := tx.Exec("UPDATE receipts SET deleted_at = NOW() WHERE id = ?", id)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to trash receipt %d: %v", id, err)
+	}
+	return transactions, nil
+}
+
+// restoreReceipt takes a receipt out of the trash, moving its transactions
+// back to the table they were trashed from, and returns how many there were
+func restoreReceipt(id int64) (int64, error) {
+	columns, err := tableColumns("transactions")
+	if err != nil {
+		return 0, err
+	}
+	list := "`" + strings.Join(columns, "`, `") + "`"
+
+	var transactions int64
+	err = inTx("restore receipt", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			fmt.Sprintf("INSERT INTO transactions (%s) SELECT %s FROM %s WHERE receipt_id = ? AND trashed_from <> 'transactions_archive'",
+				list, list, transactionsTrashTable),
+			id,
+		); err != nil {
+			return fmt.Errorf("failed to restore transactions: %v", err)
+		}
+		if _, err := tx.Exec(
+			fmt.Sprintf("INSERT INTO transactions_archive (%s, archived_at) SELECT %s, NOW() FROM %s WHERE receipt_id = ? AND trashed_from = 'transactions_archive'",
+				list, list, transactionsTrashTable),
+			id,
+		); err != nil {
+			return fmt.Errorf("failed to restore archived transactions: %v", err)
+		}
+		res, err := tx.Exec("DELETE FROM "+transactionsTrashTable+" WHERE receipt_id = ?", id)
+		if err != nil {
+			return fmt.Errorf("failed to empty the trash: %v", err)
+		}
+		transactions, _ = res.RowsAffected()
+		_, err = tx.Exec("UPDATE receipts SET deleted_at = NULL WHERE id = ?", id)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore receipt %d: %v", id, err)
+	}
+	return transactions, nil
+}
+
+// TrashPurgeResult is the outcome of emptying the trash
+type TrashPurgeResult struct {
+	Purged   []int64  `json:"purged_receipt_ids"`
+	Warnings []string `json:"warnings"`
+}
+
+// purgeTrash permanently deletes the receipts trashed before the cutoff,
+// with their records and stored files. Drive copies are kept.
+func purgeTrash(cutoff time.Time) (*TrashPurgeResult, error) {
+	rows, err := db.Query(
+		"SELECT id, file_name, storage_backend FROM receipts WHERE deleted_at IS NOT NULL AND deleted_at < ? ORDER BY id",
+		cutoff,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find trashed receipts: %v", err)
+	}
+	type trashed struct {
+		id                int64
+		fileName, backend string
+	}
+	var receipts []trashed
+	for rows.Next() {
+		var r trashed
+		if err := rows.Scan(&r.id, &r.fileName, &r.backend); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan trashed receipt: %v", err)
+		}
+		receipts = append(receipts, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trashed receipts: %v", err)
+	}
+
+	res := &TrashPurgeResult{Purged: []int64{}, Warnings: []string{}}
+	for _, r := range receipts {
+		if _, err := deleteReceiptRecords(r.id); err != nil {
+			return res, err
+		}
+		res.Purged = append(res.Purged, r.id)
+		if _, warning := deleteReceiptFile(r.fileName, r.backend); warning != "" {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("receipt %d: %s", r.id, warning))
+		}
+	}
+	return res, nil
+}
+
+// runPurgeTrash empties the trash once from the command line, e.g. from
+// cron when the server runs with TRASH_RETENTION_DAYS=0.
+//
+// Usage: purge-trash [-older-than-days N]
+func runPurgeTrash(args []string) error {
+	fs := flag.NewFlagSet("purge-trash", flag.ContinueOnError)
+	days := fs.Int("older-than-days", 0, "only purge receipts trashed more than this many days ago")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *days < 0 {
+		return fmt.Errorf("-older-than-days must not be negative")
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	res, err := purgeTrash(time.Now().AddDate(0, 0, -*days))
+	if res != nil {
+		for _, w := range res.Warnings {
+			fmt.Printf("Warning: %s\n", w)
+		}
+		fmt.Printf("Purged %d receipt(s) from the trash\n", len(res.Purged))
+	}
+	return err
+}
+
+// startTrashScheduler purges receipts that have been in the trash for
+// longer than TRASH_RETENTION_DAYS, once an hour
+func startTrashScheduler() {
+	days := trashRetentionDays()
+	if days == 0 {
+		return
+	}
+
+	log.Printf("Trash: receipts are purged %d day(s) after they were deleted", days)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			res, err := purgeTrash(time.Now().AddDate(0, 0, -days))
+			if err != nil {
+				log.Printf("Trash: purge failed: %v", err)
+			}
+			if res == nil {
+				continue
+			}
+			for _, w := range res.Warnings {
+				log.Printf("Trash: %s", w)
+			}
+			if len(res.Purged) > 0 {
+				log.Printf("Trash: purged %d receipt(s)", len(res.Purged))
+			}
+		}
+	}()
+}
+
+// registerTrashRoutes adds restoring a receipt from the trash and emptying
+// it by hand
+func registerTrashRoutes(app *fiber.App) {
+	// Takes a receipt out of the trash with its transactions
+	app.Post("/receipts/:id/restore", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+
+		var deletedAt sql.NullTime
+		err = db.QueryRow("SELECT deleted_at FROM receipts WHERE id = ?", id).Scan(&deletedAt)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		if !deletedAt.Valid {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Receipt is not in the trash",
+			})
+		}
+
+		transactions, err := restoreReceipt(int64(id))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		liveQueries.Invalidate()
+		log.Printf("Restored receipt %d and %d transaction(s) from the trash", id, transactions)
+
+		return c.JSON(fiber.Map{
+			"success":               true,
+			"receipt_id":            id,
+			"transactions_restored": transactions,
+		})
+	})
+
+	// Permanently deletes trashed receipts; older_than_days (default 0)
+	// keeps those trashed more recently
+	app.Post("/admin/trash/purge", func(c *fiber.Ctx) error {
+		days := c.QueryInt("older_than_days", 0)
+		if days < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "older_than_days must not be negative",
+			})
+		}
+		res, err := purgeTrash(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":  err.Error(),
+				"result": res,
+			})
+		}
+		liveQueries.Invalidate()
+		return c.JSON(fiber.Map{
+			"success": true,
+			"result":  res,
+		})
+	})
+}
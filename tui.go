@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// ANSI escape sequences used by the TUI
+const (
+	ansiClear = "\033[H\033[2J"
+	ansiBold  = "\033[1m"
+	ansiDim   = "\033[2m"
+	ansiRed   = "\033[31m"
+	ansiGreen = "\033[32m"
+	ansiReset = "\033[0m"
+)
+
+// fetchStatus loads the status snapshot from a running server
+func fetchStatus(client *http.Client, baseURL, apiKey string) (*SystemStatus, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(baseURL, "/")+"/admin/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status *SystemStatus `json:"status"`
+		Error  string        `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("unexpected response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Status == nil {
+		return nil, fmt.Errorf("server returned %d: %s", resp.StatusCode, body.Error)
+	}
+	return body.Status, nil
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// renderStatus draws one frame of the dashboard
+func renderStatus(w io.Writer, baseURL string, s *SystemStatus, fetchErr error) {
+	fmt.Fprint(w, ansiClear)
+	fmt.Fprintf(w, "%sReceipt processor%s  %s%s  %s%s\n\n", ansiBold, ansiReset, ansiDim, baseURL, time.Now().Format("15:04:05"), ansiReset)
+	if fetchErr != nil {
+		fmt.Fprintf(w, "%sCannot reach server: %v%s\n", ansiRed, fetchErr, ansiReset)
+		return
+	}
+	if s.Disk.Low {
+		fmt.Fprintf(w, "%sUploads paused: %s free on the uploads volume%s\n\n", ansiRed, formatBytes(s.Disk.FreeBytes), ansiReset)
+	}
+
+	fmt.Fprintf(w, "%sProcessing (%d)%s\n", ansiBold, len(s.Processing), ansiReset)
+	if len(s.Processing) == 0 {
+		fmt.Fprintf(w, "  %sidle%s\n", ansiDim, ansiReset)
+	}
+	for _, p := range s.Processing {
+		bar := strings.Repeat("█", p.Percent/5) + strings.Repeat("░", 20-p.Percent/5)
+		fmt.Fprintf(w, "  #%-6d %s %3d%%  %-13s %s\n", p.ReceiptID, bar, p.Percent, p.Stage, truncate(p.Detail, 30))
+	}
+
+	var queued []string
+	for _, q := range s.Queue {
+		if q.Waiting > 0 {
+			queued = append(queued, fmt.Sprintf("%d %s", q.Waiting, q.Priority))
+		}
+	}
+	if len(queued) > 0 {
+		fmt.Fprintf(w, "  %swaiting: %s%s\n", ansiDim, strings.Join(queued, ", "), ansiReset)
+	}
+
+	inbox := s.Inbox
+	fmt.Fprintf(w, "\n%sReview queue%s  ", ansiBold, ansiReset)
+	if inbox.InboxZero {
+		fmt.Fprintf(w, "%sinbox zero%s\n", ansiGreen, ansiReset)
+	} else {
+		fmt.Fprintf(w, "%d pending (%d review, %d errors), oldest %.0fh, avg %.0fh\n",
+			inbox.Pending, inbox.NeedsReview, inbox.Errors, inbox.OldestHours, inbox.AverageHours)
+	}
+	for _, r := range s.ReviewQueue {
+		fmt.Fprintf(w, "  #%-6d %-25s %-20s %s\n", r.ID, truncate(r.FileName, 25), truncate(r.Merchant, 20), r.UploadedAt)
+	}
+
+	fmt.Fprintf(w, "\n%sRecent errors%s\n", ansiBold, ansiReset)
+	if len(s.Errors) == 0 {
+		fmt.Fprintf(w, "  %snone%s\n", ansiDim, ansiReset)
+	}
+	for _, r := range s.Errors {
+		fmt.Fprintf(w, "  %s#%-6d%s %-25s %s  %s\n", ansiRed, r.ID, ansiReset, truncate(r.FileName, 25), r.UploadedAt, truncate(r.Detail, 40))
+	}
+
+	fmt.Fprintf(w, "\n%sGemini tokens%s  today %d  ·  7 days %d  ·  this month %d\n",
+		ansiBold, ansiReset, s.Tokens.Today, s.Tokens.Last7Days, s.Tokens.ThisMonth)
+	if b := s.Budget; b != nil {
+		color := ansiGreen
+		if b.Level != budgetNormal {
+			color = ansiRed
+		}
+		fmt.Fprintf(w, "%sGemini budget%s  $%.2f of $%.2f (%.0f%%)  ·  %s%s%s  ·  model %s\n",
+			ansiBold, ansiReset, b.Spent, b.Limit, b.UsedPercent, color, b.Level, ansiReset, b.Model)
+	}
+	fmt.Fprintf(w, "\n%sCtrl-C to quit%s\n", ansiDim, ansiReset)
+}
+
+// runTUI shows a live dashboard of a running server in the terminal.
+//
+// Usage: tui [-url http://localhost:3000] [-interval 2s] [-api-key KEY]
+func runTUI(args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	baseURL := fs.String("url", envOr("RECEIPTCTL_URL", "http://localhost:3000"), "server URL (default RECEIPTCTL_URL)")
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+	apiKey := fs.String("api-key", os.Getenv("RECEIPTCTL_API_KEY"), "X-API-Key header to send (default RECEIPTCTL_API_KEY)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *interval < 500*time.Millisecond {
+		return fmt.Errorf("-interval must be at least 500ms")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		status, err := fetchStatus(client, *baseURL, *apiKey)
+		renderStatus(os.Stdout, *baseURL, status, err)
+
+		select {
+		case <-interrupt:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// envOr returns the environment variable or a default
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
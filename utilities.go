@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// UtilityBill is one bill from a utility account in the utilities report
+type UtilityBill struct {
+	TransactionID int64              `json:"transaction_id"`
+	Date          *string            `json:"date"`
+	PeriodStart   string             `json:"period_start,omitempty"`
+	PeriodEnd     string             `json:"period_end,omitempty"`
+	DueDate       string             `json:"due_date,omitempty"`
+	Cost          float64            `json:"cost"`
+	Usage         map[string]float64 `json:"usage"`
+	// CostPerDay normalizes bills with billing periods of different lengths
+	CostPerDay *float64 `json:"cost_per_day,omitempty"`
+	// CostPerUnit is set when the bill reports usage in a single unit
+	CostPerUnit *float64 `json:"cost_per_unit,omitempty"`
+}
+
+// UtilityAccount groups the bills of one provider account
+type UtilityAccount struct {
+	Provider      string        `json:"provider"`
+	UtilityType   string        `json:"utility_type"`
+	AccountNumber string        `json:"account_number"`
+	Bills         []UtilityBill `json:"bills"`
+	TotalCost     float64       `json:"total_cost"`
+	// Changes compare the latest bill with the one before, in percent
+	CostChangePct  *float64           `json:"cost_change_pct"`
+	UsageChangePct map[string]float64 `json:"usage_change_pct"`
+}
+
+// utilityBillFields are the profile fields stored in extra_fields
+type utilityBillFields struct {
+	UtilityType        string `json:"utility_type"`
+	AccountNumber      string `json:"account_number"`
+	BillingPeriodStart string `json:"billing_period_start"`
+	BillingPeriodEnd   string `json:"billing_period_end"`
+	DueDate            string `json:"due_date"`
+	Usage              []struct {
+		Quantity float64 `json:"quantity"`
+		Unit     string  `json:"unit"`
+	} `json:"usage"`
+}
+
+// percentChange returns the change from previous to current in percent, or
+// nil when there is no previous value
+func percentChange(previous, current float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	pct := math.Round((current-previous)/previous*1000) / 10
+	return &pct
+}
+
+// newUtilityBill builds a report entry from a transaction and its fields
+func newUtilityBill(id int64, date sql.NullTime, cost float64, f utilityBillFields) UtilityBill {
+	bill := UtilityBill{
+		TransactionID: id,
+		Date:          formatNullDate(date),
+		PeriodStart:   f.BillingPeriodStart,
+		PeriodEnd:     f.BillingPeriodEnd,
+		DueDate:       f.DueDate,
+		Cost:          roundCents(cost),
+		Usage:         map[string]float64{},
+	}
+	for _, u := range f.Usage {
+		unit := strings.ToLower(strings.TrimSpace(u.Unit))
+		if unit != "" && u.Quantity > 0 {
+			bill.Usage[unit] += u.Quantity
+		}
+	}
+
+	start, errStart := time.Parse("2006-01-02", f.BillingPeriodStart)
+	end, errEnd := time.Parse("2006-01-02", f.BillingPeriodEnd)
+	if errStart == nil && errEnd == nil && !end.Before(start) {
+		perDay := roundCents(cost / (end.Sub(start).Hours()/24 + 1))
+		bill.CostPerDay = &perDay
+	}
+	if len(bill.Usage) == 1 {
+		for _, qty := range bill.Usage {
+			perUnit := math.Round(cost/qty*10000) / 10000
+			bill.CostPerUnit = &perUnit
+		}
+	}
+	return bill
+}
+
+// registerUtilityRoutes adds the utilities report
+func registerUtilityRoutes(app *fiber.App) {
+	// Usage and cost per utility account for bills extracted with the
+	// utility profile, oldest bill first
+	app.Get("/reports/utilities", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		rows, err := db.Query(
+			`SELECT id, date, COALESCE(merchant_clean, merchant_raw, ''), COALESCE(home_amount, amount, 0), extra_fields
+			FROM `+reportTransactionsTable(c)+`
+			WHERE profile = ? AND extra_fields IS NOT NULL AND `+dateCond+`
+			ORDER BY date, id`,
+			append([]any{"utility"}, args...)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to build utilities report: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		accounts := []*UtilityAccount{}
+		byKey := map[string]*UtilityAccount{}
+		for rows.Next() {
+			var id int64
+			var date sql.NullTime
+			var provider string
+			var cost float64
+			var extra []byte
+			if err := rows.Scan(&id, &date, &provider, &cost, &extra); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read utilities report: %v", err),
+				})
+			}
+			var fields utilityBillFields
+			if err := json.Unmarshal(extra, &fields); err != nil {
+				continue
+			}
+
+			key := provider + "\x00" + fields.AccountNumber
+			account, ok := byKey[key]
+			if !ok {
+				account = &UtilityAccount{
+					Provider:      provider,
+					UtilityType:   fields.UtilityType,
+					AccountNumber: fields.AccountNumber,
+				}
+				byKey[key] = account
+				accounts = append(accounts, account)
+			}
+			if account.UtilityType == "" {
+				account.UtilityType = fields.UtilityType
+			}
+			account.Bills = append(account.Bills, newUtilityBill(id, date, cost, fields))
+			account.TotalCost = roundCents(account.TotalCost + cost)
+		}
+
+		for _, account := range accounts {
+			account.UsageChangePct = map[string]float64{}
+			n := len(account.Bills)
+			if n < 2 {
+				continue
+			}
+			prev, last := account.Bills[n-2], account.Bills[n-1]
+			account.CostChangePct = percentChange(prev.Cost, last.Cost)
+			for unit, qty := range last.Usage {
+				if pct := percentChange(prev.Usage[unit], qty); pct != nil {
+					account.UsageChangePct[unit] = *pct
+				}
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"currency": homeCurrency(),
+			"accounts": accounts,
+		})
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iso4217Currencies are the active ISO 4217 currency codes accepted in parsed data
+var iso4217Currencies = func() map[string]bool {
+	codes := `AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD
+		CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF
+		GTQ GYD HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP
+		LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB
+		PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL
+		THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`
+	set := make(map[string]bool)
+	for _, code := range strings.Fields(codes) {
+		set[code] = true
+	}
+	return set
+}()
+
+// countryCodePattern matches an ISO 3166-1 alpha-2 country code
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// maxRepairAttempts is how many follow-up repair prompts are sent when
+// Gemini output fails validation (GEMINI_REPAIR_ATTEMPTS, default 1)
+func maxRepairAttempts() int {
+	if v, err := strconv.Atoi(os.Getenv("GEMINI_REPAIR_ATTEMPTS")); err == nil && v >= 0 {
+		return v
+	}
+	return 1
+}
+
+// FieldError is a validation failure on a single parsed field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	return e.Field + ": " + e.Message
+}
+
+// validateParsedData checks parsed receipt data against the expected schema:
+// formats, value ranges and the currency enum
+func validateParsedData(data *GeminiParsedData) []FieldError {
+	var errs []FieldError
+
+	if data.Date != "" {
+		t, err := time.Parse("2006-01-02", data.Date)
+		switch {
+		case err != nil:
+			errs = append(errs, FieldError{"date", "must be a YYYY-MM-DD date"})
+		case t.Year() < 2000:
+			errs = append(errs, FieldError{"date", "is before the year 2000"})
+		case t.After(time.Now().AddDate(0, 0, 1)):
+			errs = append(errs, FieldError{"date", "is in the future"})
+		}
+	}
+
+	if data.Time != "" {
+		if _, err := time.Parse("15:04", data.Time); err != nil {
+			errs = append(errs, FieldError{"time", "must be HH:MM (24-hour)"})
+		}
+	}
+
+	if data.Amount < 0 || data.Amount >= 1e8 {
+		errs = append(errs, FieldError{"amount", "must be between 0 and 100000000"})
+	}
+	if data.Subtotal < 0 || data.Subtotal >= 1e8 {
+		errs = append(errs, FieldError{"subtotal", "must be between 0 and 100000000"})
+	} else if data.Subtotal > 0 && data.Amount > 0 && data.Subtotal > data.Amount*1.5 {
+		errs = append(errs, FieldError{"subtotal", "is much larger than the total amount"})
+	}
+	if data.Tip < 0 {
+		errs = append(errs, FieldError{"tip", "must not be negative"})
+	}
+
+	if data.Currency != "" && !iso4217Currencies[data.Currency] {
+		errs = append(errs, FieldError{"currency", "must be an uppercase ISO 4217 code such as USD, EUR or IDR"})
+	}
+	if data.Confidence < 0 || data.Confidence > 1 {
+		errs = append(errs, FieldError{"confidence", "must be between 0.0 and 1.0"})
+	}
+
+	if len(data.MerchantRaw) > 255 {
+		errs = append(errs, FieldError{"merchant_raw", "is longer than 255 characters"})
+	}
+	if len(data.MerchantClean) > 255 {
+		errs = append(errs, FieldError{"merchant_clean", "is longer than 255 characters"})
+	}
+	if len(data.Category) > 100 {
+		errs = append(errs, FieldError{"category", "is longer than 100 characters"})
+	}
+	if len(data.ReferenceNumber) > 100 {
+		errs = append(errs, FieldError{"reference_number", "is longer than 100 characters"})
+	}
+	if len(data.BranchName) > 100 {
+		errs = append(errs, FieldError{"branch_name", "is longer than 100 characters"})
+	}
+	if len(data.StoreNumber) > 50 {
+		errs = append(errs, FieldError{"store_number", "is longer than 50 characters"})
+	}
+	if len(data.StoreAddress) > 255 {
+		errs = append(errs, FieldError{"store_address", "is longer than 255 characters"})
+	}
+	if data.MerchantCountry != "" && !countryCodePattern.MatchString(data.MerchantCountry) {
+		errs = append(errs, FieldError{"merchant_country", "must be an uppercase ISO 3166-1 alpha-2 code such as US or GB"})
+	}
+
+	return errs
+}
+
+// clearInvalidFields resets fields that failed validation so the remaining
+// data can still be stored for review
+func clearInvalidFields(data *GeminiParsedData, errs []FieldError) {
+	for _, e := range errs {
+		switch e.Field {
+		case "date":
+			data.Date = ""
+		case "time":
+			data.Time = ""
+		case "amount":
+			data.Amount = 0
+		case "subtotal":
+			data.Subtotal = 0
+		case "tip":
+			data.Tip = 0
+		case "currency":
+			data.Currency = ""
+		case "confidence":
+			data.Confidence = 0
+		case "merchant_raw":
+			data.MerchantRaw = ""
+		case "merchant_clean":
+			data.MerchantClean = ""
+		case "category":
+			data.Category = ""
+		case "reference_number":
+			data.ReferenceNumber = ""
+		case "merchant_country":
+			data.MerchantCountry = ""
+		case "branch_name":
+			data.BranchName = ""
+		case "store_number":
+			data.StoreNumber = ""
+		case "store_address":
+			data.StoreAddress = ""
+		}
+	}
+}
+
+// formatFieldErrors renders validation errors one per line for prompts and logs
+func formatFieldErrors(errs []FieldError) string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = "- " + e.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// recordRepairAttempt stores a repair prompt round-trip for later analysis
+func recordRepairAttempt(receiptID int64, attempt int, problems string, response string, succeeded bool) error {
+	_, err := db.Exec(
+		`INSERT INTO parse_repairs (receipt_id, attempt, validation_errors, response, succeeded)
+		VALUES (?, ?, ?, ?, ?)`,
+		receiptID, attempt, problems, response, succeeded,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record repair attempt: %v", err)
+	}
+	return nil
+}
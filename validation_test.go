@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validParsedData returns parsed data that passes validation
+func validParsedData() GeminiParsedData {
+	return GeminiParsedData{
+		Date:            "2024-03-15",
+		Time:            "18:45",
+		MerchantRaw:     "TOKO MAJU JAYA",
+		MerchantClean:   "Toko Maju Jaya",
+		Category:        "Groceries",
+		Amount:          125000,
+		Subtotal:        110000,
+		Tip:             5000,
+		Currency:        "IDR",
+		Confidence:      0.9,
+		ReferenceNumber: "INV-001",
+		MerchantCountry: "ID",
+	}
+}
+
+func TestValidateParsedData(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(d *GeminiParsedData)
+		fields []string
+	}{
+		{"valid", func(d *GeminiParsedData) {}, nil},
+		{"empty optional fields", func(d *GeminiParsedData) {
+			d.Date, d.Time, d.Currency, d.MerchantCountry, d.Subtotal = "", "", "", "", 0
+		}, nil},
+		{"date format", func(d *GeminiParsedData) { d.Date = "15/03/2024" }, []string{"date"}},
+		{"date before 2000", func(d *GeminiParsedData) { d.Date = "1999-12-31" }, []string{"date"}},
+		{"date in the future", func(d *GeminiParsedData) { d.Date = time.Now().AddDate(0, 0, 3).Format("2006-01-02") }, []string{"date"}},
+		{"date tomorrow", func(d *GeminiParsedData) { d.Date = time.Now().AddDate(0, 0, 1).Format("2006-01-02") }, nil},
+		{"12-hour time", func(d *GeminiParsedData) { d.Time = "6:45 PM" }, []string{"time"}},
+		{"negative amount", func(d *GeminiParsedData) { d.Amount = -1 }, []string{"amount"}},
+		{"huge amount", func(d *GeminiParsedData) { d.Amount = 1e8 }, []string{"amount"}},
+		{"negative subtotal", func(d *GeminiParsedData) { d.Subtotal = -5 }, []string{"subtotal"}},
+		{"subtotal far above total", func(d *GeminiParsedData) { d.Subtotal = 200000 }, []string{"subtotal"}},
+		{"negative tip", func(d *GeminiParsedData) { d.Tip = -1 }, []string{"tip"}},
+		{"lowercase currency", func(d *GeminiParsedData) { d.Currency = "idr" }, []string{"currency"}},
+		{"currency symbol", func(d *GeminiParsedData) { d.Currency = "Rp" }, []string{"currency"}},
+		{"confidence as percent", func(d *GeminiParsedData) { d.Confidence = 90 }, []string{"confidence"}},
+		{"long merchant", func(d *GeminiParsedData) { d.MerchantRaw = strings.Repeat("x", 256) }, []string{"merchant_raw"}},
+		{"long category", func(d *GeminiParsedData) { d.Category = strings.Repeat("x", 101) }, []string{"category"}},
+		{"long store number", func(d *GeminiParsedData) { d.StoreNumber = strings.Repeat("9", 51) }, []string{"store_number"}},
+		{"country name", func(d *GeminiParsedData) { d.MerchantCountry = "Indonesia" }, []string{"merchant_country"}},
+		{"several fields", func(d *GeminiParsedData) {
+			d.Date, d.Currency, d.Confidence = "yesterday", "RUPIAH", 2
+		}, []string{"date", "currency", "confidence"}},
+	}
+	for _, tt := range tests {
+		data := validParsedData()
+		tt.change(&data)
+		var fields []string
+		for _, e := range validateParsedData(&data) {
+			fields = append(fields, e.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: invalid fields = %v, want %v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestClearInvalidFields(t *testing.T) {
+	data := validParsedData()
+	data.Date = "2024-13-01"
+	data.Amount = -10
+	data.Currency = "rupiah"
+	data.MerchantCountry = "idn"
+	data.BranchName = strings.Repeat("x", 101)
+
+	errs := validateParsedData(&data)
+	if len(errs) != 5 {
+		t.Fatalf("got %d errors, want 5: %v", len(errs), errs)
+	}
+	clearInvalidFields(&data, errs)
+	if errs := validateParsedData(&data); len(errs) != 0 {
+		t.Errorf("still invalid after clearing: %v", errs)
+	}
+
+	want := validParsedData()
+	want.Date, want.Amount, want.Currency, want.MerchantCountry = "", 0, "", ""
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("cleared data = %+v, want %+v", data, want)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Vehicle is a car or other vehicle whose fuel receipts are tracked
+type Vehicle struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Plate     string `json:"plate,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// FuelFill is one fuel receipt in the vehicle report. Costs are in the home
+// currency and distances in km.
+type FuelFill struct {
+	TransactionID int64    `json:"transaction_id"`
+	ReceiptID     int64    `json:"receipt_id"`
+	Date          *string  `json:"date"`
+	Odometer      *float64 `json:"odometer"`
+	// Quantity is in liters; UnitPrice is per unit as printed
+	Quantity  *float64 `json:"quantity"`
+	UnitPrice *float64 `json:"unit_price"`
+	Cost      float64  `json:"cost"`
+	// Distance is driven since the previous fill with an odometer reading;
+	// consumption and cost per km assume every fill tops up the tank
+	Distance    *float64 `json:"distance"`
+	Consumption *float64 `json:"consumption_per_100km"`
+	CostPerKm   *float64 `json:"cost_per_km"`
+}
+
+// VehicleReport sums a vehicle's fuel receipts
+type VehicleReport struct {
+	Vehicle
+	Fills    []FuelFill `json:"fills"`
+	Distance float64    `json:"distance"`
+	Fuel     float64    `json:"fuel"`
+	Cost     float64    `json:"cost"`
+	// Averages over the fills with a known distance
+	Consumption *float64 `json:"consumption_per_100km"`
+	CostPerKm   *float64 `json:"cost_per_km"`
+	// ConsumptionChangePct compares the latest fill with the one before
+	ConsumptionChangePct *float64 `json:"consumption_change_pct"`
+}
+
+// fuelFields are the fuel profile fields stored in extra_fields
+type fuelFields struct {
+	FuelType  string  `json:"fuel_type"`
+	Quantity  float64 `json:"fuel_quantity"`
+	Unit      string  `json:"fuel_unit"`
+	UnitPrice float64 `json:"price_per_unit"`
+}
+
+// fuelLiters converts a pumped quantity to liters
+func fuelLiters(quantity float64, unit string) float64 {
+	switch strings.ToLower(strings.TrimSpace(unit)) {
+	case "gal", "gallon", "gallons", "us gal":
+		return quantity * 3.78541
+	case "imp gal", "imperial gallon":
+		return quantity * 4.54609
+	}
+	return quantity
+}
+
+// roundTo rounds v to the given number of decimals
+func roundTo(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+// vehicleColumns are the columns read by scanVehicle
+const vehicleColumns = "id, name, plate, created_at"
+
+// scanVehicle reads a row selected with vehicleColumns
+func scanVehicle(row interface{ Scan(...any) error }) (*Vehicle, error) {
+	var v Vehicle
+	var plate sql.NullString
+	var createdAt time.Time
+	if err := row.Scan(&v.ID, &v.Name, &plate, &createdAt); err != nil {
+		return nil, err
+	}
+	v.Plate = plate.String
+	v.CreatedAt = createdAt.Format(time.RFC3339)
+	return &v, nil
+}
+
+// vehicleByID returns a vehicle or nil when it does not exist
+func vehicleByID(id int64) (*Vehicle, error) {
+	v, err := scanVehicle(db.QueryRow("SELECT "+vehicleColumns+" FROM vehicles WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load vehicle: %v", err)
+	}
+	return v, nil
+}
+
+// loadVehicles returns the vehicles matching a WHERE clause, by name
+func loadVehicles(where string, args ...any) ([]Vehicle, error) {
+	rows, err := db.Query("SELECT "+vehicleColumns+" FROM vehicles WHERE "+where+" ORDER BY name", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vehicles: %v", err)
+	}
+	defer rows.Close()
+
+	vehicles := []Vehicle{}
+	for rows.Next() {
+		v, err := scanVehicle(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan vehicle: %v", err)
+		}
+		vehicles = append(vehicles, *v)
+	}
+	return vehicles, rows.Err()
+}
+
+// FuelLogInput is the vehicle and odometer reading given with a fuel receipt
+type FuelLogInput struct {
+	VehicleID int64
+	Odometer  sql.NullFloat64
+}
+
+// fuelLogFromForm reads the optional vehicle_id and odometer (km) form
+// fields of an upload. It returns nil when neither is set.
+func fuelLogFromForm(formValue func(string, ...string) string) (*FuelLogInput, error) {
+	vehicle, odometer := formValue("vehicle_id"), formValue("odometer")
+	if vehicle == "" && odometer == "" {
+		return nil, nil
+	}
+	if vehicle == "" {
+		return nil, fmt.Errorf("odometer requires vehicle_id")
+	}
+	id, err := strconv.ParseInt(vehicle, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vehicle_id")
+	}
+	var km *float64
+	if odometer != "" {
+		v, err := strconv.ParseFloat(odometer, 64)
+		if err != nil {
+			return nil, fmt.Errorf("odometer must be a number of km")
+		}
+		km = &v
+	}
+	return newFuelLogInput(id, km)
+}
+
+// newFuelLogInput checks that the vehicle exists and the odometer reading
+// is plausible
+func newFuelLogInput(vehicleID int64, odometer *float64) (*FuelLogInput, error) {
+	if odometer != nil && *odometer < 0 {
+		return nil, fmt.Errorf("odometer must not be negative")
+	}
+	v, err := vehicleByID(vehicleID)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("vehicle %d not found", vehicleID)
+	}
+	in := &FuelLogInput{VehicleID: vehicleID}
+	if odometer != nil {
+		in.Odometer = sql.NullFloat64{Float64: *odometer, Valid: true}
+	}
+	return in, nil
+}
+
+// saveFuelLog links a receipt to a vehicle, replacing an earlier link
+func saveFuelLog(receiptID int64, in *FuelLogInput) error {
+	_, err := db.Exec(
+		`INSERT INTO fuel_logs (receipt_id, vehicle_id, odometer) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE vehicle_id = VALUES(vehicle_id), odometer = VALUES(odometer)`,
+		receiptID, in.VehicleID, in.Odometer,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save fuel log of receipt %d: %v", receiptID, err)
+	}
+	return nil
+}
+
+// buildVehicleReport loads a vehicle's fuel receipts in the date range and
+// derives distance, consumption and cost per km between fills
+func buildVehicleReport(v Vehicle, table, dateCond string, args []any) (*VehicleReport, error) {
+	rows, err := db.Query(
+		`SELECT t.id, t.receipt_id, t.date, f.odometer, COALESCE(t.home_amount, t.amount, 0), t.extra_fields
+		FROM fuel_logs f
+		JOIN `+table+` t ON t.receipt_id = f.receipt_id
+		WHERE f.vehicle_id = ? AND `+dateCond+`
+		ORDER BY f.odometer IS NULL, f.odometer, t.date, t.id`,
+		append([]any{v.ID}, args...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fuel receipts: %v", err)
+	}
+	defer rows.Close()
+
+	report := &VehicleReport{Vehicle: v, Fills: []FuelFill{}}
+	for rows.Next() {
+		var fill FuelFill
+		var date sql.NullTime
+		var odometer sql.NullFloat64
+		var extra []byte
+		if err := rows.Scan(&fill.TransactionID, &fill.ReceiptID, &date, &odometer, &fill.Cost, &extra); err != nil {
+			return nil, fmt.Errorf("failed to scan fuel receipt: %v", err)
+		}
+		fill.Date = formatNullDate(date)
+		fill.Odometer = nullFloatPtr(odometer)
+		fill.Cost = roundCents(fill.Cost)
+		var fields fuelFields
+		if len(extra) > 0 && json.Unmarshal(extra, &fields) == nil && fields.Quantity > 0 {
+			liters := roundTo(fuelLiters(fields.Quantity, fields.Unit), 2)
+			fill.Quantity = &liters
+			if fields.UnitPrice > 0 {
+				fill.UnitPrice = &fields.UnitPrice
+			}
+		}
+		report.Fills = append(report.Fills, fill)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var measuredDistance, measuredFuel, measuredCost float64
+	var consumptions []float64
+	var prev *FuelFill
+	for i := range report.Fills {
+		fill := &report.Fills[i]
+		report.Cost = roundCents(report.Cost + fill.Cost)
+		if fill.Quantity != nil {
+			report.Fuel = roundTo(report.Fuel+*fill.Quantity, 2)
+		}
+		if fill.Odometer == nil {
+			continue
+		}
+		if prev != nil && *fill.Odometer > *prev.Odometer {
+			distance := roundTo(*fill.Odometer-*prev.Odometer, 1)
+			fill.Distance = &distance
+			costPerKm := roundTo(fill.Cost/distance, 4)
+			fill.CostPerKm = &costPerKm
+			measuredDistance += distance
+			measuredCost += fill.Cost
+			if fill.Quantity != nil {
+				consumption := roundTo(*fill.Quantity/distance*100, 2)
+				fill.Consumption = &consumption
+				consumptions = append(consumptions, consumption)
+				measuredFuel += *fill.Quantity
+			}
+		}
+		prev = fill
+	}
+
+	report.Distance = roundTo(measuredDistance, 1)
+	if measuredDistance > 0 {
+		costPerKm := roundTo(measuredCost/measuredDistance, 4)
+		report.CostPerKm = &costPerKm
+		if measuredFuel > 0 {
+			consumption := roundTo(measuredFuel/measuredDistance*100, 2)
+			report.Consumption = &consumption
+		}
+	}
+	if n := len(consumptions); n >= 2 {
+		report.ConsumptionChangePct = percentChange(consumptions[n-2], consumptions[n-1])
+	}
+	return report, nil
+}
+
+// registerVehicleRoutes adds vehicles, fuel receipt links and the vehicle
+// report
+func registerVehicleRoutes(app *fiber.App) {
+	app.Get("/vehicles", func(c *fiber.Ctx) error {
+		vehicles, err := loadVehicles("1=1")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"vehicles": vehicles,
+		})
+	})
+
+	app.Post("/vehicles", func(c *fiber.Ctx) error {
+		var req struct {
+			Name  string `json:"name"`
+			Plate string `json:"plate"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Name must be 1-100 characters",
+			})
+		}
+		req.Plate = strings.TrimSpace(req.Plate)
+		if len(req.Plate) > 20 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Plate must be at most 20 characters",
+			})
+		}
+
+		result, err := db.Exec(
+			"INSERT INTO vehicles (name, plate) VALUES (?, ?)",
+			req.Name, sql.NullString{String: req.Plate, Valid: req.Plate != ""},
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save vehicle: %v", err),
+			})
+		}
+		id, _ := result.LastInsertId()
+		v, err := vehicleByID(id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"vehicle": v,
+		})
+	})
+
+	// Deleting a vehicle also removes its fuel receipt links
+	app.Delete("/vehicles/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid vehicle ID",
+			})
+		}
+		result, err := db.Exec("DELETE FROM vehicles WHERE id = ?", id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to delete vehicle: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Vehicle not found",
+			})
+		}
+		return c.JSON(fiber.Map{"success": true})
+	})
+
+	// Link an already uploaded receipt to a vehicle, e.g. to add a
+	// forgotten odometer reading
+	app.Put("/receipts/:id/fuel", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid receipt ID",
+			})
+		}
+		var req struct {
+			VehicleID int64    `json:"vehicle_id"`
+			Odometer  *float64 `json:"odometer"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if req.VehicleID == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "vehicle_id is required",
+			})
+		}
+		in, err := newFuelLogInput(req.VehicleID, req.Odometer)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM receipts WHERE id = ?)", id).Scan(&exists); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load receipt: %v", err),
+			})
+		}
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Receipt not found",
+			})
+		}
+		if err := saveFuelLog(int64(id), in); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{"success": true})
+	})
+
+	// Fuel cost, consumption and cost per km per vehicle; vehicle= limits
+	// the report to one vehicle
+	app.Get("/reports/vehicles", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "t.date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		where, whereArgs := "1=1", []any{}
+		if v := c.Query("vehicle"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid vehicle ID",
+				})
+			}
+			where, whereArgs = "id = ?", []any{id}
+		}
+		vehicles, err := loadVehicles(where, whereArgs...)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		table := reportTransactionsTable(c)
+		reports := []*VehicleReport{}
+		for _, v := range vehicles {
+			report, err := buildVehicleReport(v, table, dateCond, args)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			reports = append(reports, report)
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"currency": homeCurrency(),
+			"vehicles": reports,
+		})
+	})
+}
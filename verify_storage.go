@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// orphanMinAge keeps verify-storage from deleting uploads that are saved
+// but not yet recorded in the database
+const orphanMinAge = time.Hour
+
+// storageVerifier checks receipt files against the database, opening each
+// storage backend once
+type storageVerifier struct {
+	repair   bool
+	backends map[string]Storage
+	failed   map[string]error
+	// referenced holds backend/key of every file a receipt refers to
+	referenced map[string]bool
+
+	checked, repaired, missing, mismatched, orphans int
+}
+
+// backend returns a storage backend, remembering backends that are not
+// configured
+func (v *storageVerifier) backend(name string) (Storage, error) {
+	if s, ok := v.backends[name]; ok {
+		return s, nil
+	}
+	if err, ok := v.failed[name]; ok {
+		return nil, err
+	}
+	s, err := newStorage(name)
+	if err != nil {
+		v.failed[name] = err
+		return nil, err
+	}
+	v.backends[name] = s
+	return s, nil
+}
+
+// report prints a problem found with a receipt
+func (v *storageVerifier) report(id int64, format string, args ...any) {
+	fmt.Printf("receipt %d: %s\n", id, fmt.Sprintf(format, args...))
+}
+
+// storedReceipt is a receipt file as recorded in the database
+type storedReceipt struct {
+	id         int64
+	fileName   string
+	backend    string
+	checksum   sql.NullString
+	anonymized bool
+}
+
+// check verifies one receipt file. A file missing from its backend is
+// looked for in the other backends, since an interrupted offload or
+// migration can leave it behind; with repair the receipt is pointed at the
+// copy found and missing checksums are recorded.
+func (v *storageVerifier) check(r storedReceipt) {
+	v.checked++
+	store, err := v.backend(r.backend)
+	if err != nil {
+		v.missing++
+		v.report(r.id, "backend %s unavailable: %v", r.backend, err)
+		return
+	}
+
+	sum, err := storedChecksum(store, r.fileName)
+	if err != nil {
+		// Anonymization deletes files on purpose and clears their checksum
+		if r.anonymized && !r.checksum.Valid {
+			return
+		}
+		found, foundSum := v.find(r)
+		if found == "" {
+			v.missing++
+			v.report(r.id, "%s missing from %s", r.fileName, r.backend)
+			return
+		}
+		v.report(r.id, "%s is stored in %s, not %s", r.fileName, found, r.backend)
+		if !v.repair {
+			return
+		}
+		if _, err := db.Exec(
+			"UPDATE receipts SET storage_backend = ?, checksum = ? WHERE id = ?", found, foundSum, r.id,
+		); err != nil {
+			log.Printf("Receipt %d: failed to update storage backend: %v", r.id, err)
+			return
+		}
+		v.referenced[found+"/"+r.fileName] = true
+		v.repaired++
+		return
+	}
+
+	if r.checksum.Valid && r.checksum.String != sum {
+		v.mismatched++
+		v.report(r.id, "%s checksum %s does not match recorded checksum %s", r.fileName, sum, r.checksum.String)
+		return
+	}
+	if !r.checksum.Valid {
+		v.report(r.id, "no checksum recorded")
+		if !v.repair {
+			return
+		}
+		if _, err := db.Exec("UPDATE receipts SET checksum = ? WHERE id = ?", sum, r.id); err != nil {
+			log.Printf("Receipt %d: failed to record checksum: %v", r.id, err)
+			return
+		}
+		v.repaired++
+	}
+}
+
+// find looks for a receipt's file in the other configured backends and
+// returns the backend holding a copy that matches the recorded checksum
+func (v *storageVerifier) find(r storedReceipt) (string, string) {
+	names := make([]string, 0, len(storageFactories))
+	for name := range storageFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == r.backend {
+			continue
+		}
+		store, err := v.backend(name)
+		if err != nil {
+			continue
+		}
+		sum, err := storedChecksum(store, r.fileName)
+		if err == nil && (!r.checksum.Valid || sum == r.checksum.String) {
+			return name, sum
+		}
+	}
+	return "", ""
+}
+
+// findOrphans lists the files of a backend that no receipt refers to.
+// Backups are skipped. With repair, local orphans older than orphanMinAge
+// are deleted; remote ones are only reported.
+func (v *storageVerifier) findOrphans(name string) error {
+	store, err := v.backend(name)
+	if err != nil {
+		return err
+	}
+	keys, err := store.List("")
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v", name, err)
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, backupPrefix) || v.referenced[name+"/"+key] {
+			continue
+		}
+		v.orphans++
+		fmt.Printf("orphan: %s/%s\n", name, key)
+		if !v.repair || name != "local" {
+			continue
+		}
+		path := filepath.Join(uploadsDir, key)
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < orphanMinAge {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to delete orphan %s: %v", path, err)
+			continue
+		}
+		v.repaired++
+	}
+	return nil
+}
+
+// runVerifyStorage checks that every receipt's file exists in its storage
+// backend and matches its recorded checksum, and lists stored files that no
+// receipt refers to.
+//
+// Usage: verify-storage [-repair] [-skip-orphans]
+//
+// With -repair, receipts whose file turns up in another backend are pointed
+// at it, missing checksums are recorded and local orphans older than an
+// hour are deleted. Missing and corrupted files can't be repaired; restore
+// them from a backup.
+func runVerifyStorage(args []string) error {
+	fs := flag.NewFlagSet("verify-storage", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "fix what can be fixed")
+	skipOrphans := fs.Bool("skip-orphans", false, "do not look for files without a receipt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := createTables(); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(
+		`SELECT r.id, r.file_name, r.storage_backend, r.checksum,
+			EXISTS (SELECT 1 FROM ` + transactionsAllView + ` t WHERE t.receipt_id = r.id AND t.anonymized_at IS NOT NULL)
+		FROM receipts r ORDER BY r.id`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query receipts: %v", err)
+	}
+	v := &storageVerifier{
+		repair:     *repair,
+		backends:   map[string]Storage{},
+		failed:     map[string]error{},
+		referenced: map[string]bool{},
+	}
+	var receipts []storedReceipt
+	for rows.Next() {
+		var r storedReceipt
+		if err := rows.Scan(&r.id, &r.fileName, &r.backend, &r.checksum, &r.anonymized); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan receipt: %v", err)
+		}
+		receipts = append(receipts, r)
+		v.referenced[r.backend+"/"+r.fileName] = true
+	}
+	rows.Close()
+
+	log.Printf("Verifying the files of %d receipt(s)", len(receipts))
+	for _, r := range receipts {
+		v.check(r)
+	}
+
+	if !*skipOrphans {
+		backends := map[string]bool{"local": true, receiptStorageName(): true}
+		for _, r := range receipts {
+			backends[r.backend] = true
+		}
+		for name := range backends {
+			if err := v.findOrphans(name); err != nil {
+				log.Printf("Skipping orphan check of %s: %v", name, err)
+			}
+		}
+	}
+
+	fmt.Printf("Checked %d receipt(s): %d missing, %d checksum mismatch(es), %d orphan file(s), %d repaired\n",
+		v.checked, v.missing, v.mismatched, v.orphans, v.repaired)
+	if v.missing > 0 || v.mismatched > 0 {
+		return fmt.Errorf("%d receipt file(s) missing or corrupted", v.missing+v.mismatched)
+	}
+	return nil
+}
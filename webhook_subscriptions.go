@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Webhook event types consumers can subscribe to
+const (
+	eventReceiptProcessed     = "receipt.processed"
+	eventBudgetExceeded       = "budget.exceeded"
+	eventAnomalyDetected      = "anomaly.detected"
+	eventReviewReminder       = "receipts.review_reminder"
+	eventSubscriptionReminder = "subscription.renewal_reminder"
+	eventWebhookTest          = "webhook.test"
+	eventApprovalRequested    = "approval.requested"
+	eventApprovalDecided      = "approval.decided"
+	eventDiskSpaceLow         = "disk.space_low"
+	eventCategoryTrend        = "insight.category_trend"
+	eventLoyaltyExpiring      = "loyalty.points_expiring"
+	eventDigest               = "receipts.digest"
+	// eventAll subscribes to every event
+	eventAll = "*"
+)
+
+var webhookEventTypes = []string{
+	eventReceiptProcessed,
+	eventBudgetExceeded,
+	eventAnomalyDetected,
+	eventReviewReminder,
+	eventSubscriptionReminder,
+	eventWebhookTest,
+	eventApprovalRequested,
+	eventApprovalDecided,
+	eventDiskSpaceLow,
+	eventCategoryTrend,
+	eventLoyaltyExpiring,
+	eventDigest,
+}
+
+// WebhookSubscription is a consumer URL registered for some event types
+type WebhookSubscription struct {
+	ID          int64    `json:"id"`
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Description string   `json:"description,omitempty"`
+	Active      bool     `json:"active"`
+	// Secret signs deliveries to this subscription; it is only returned
+	// when the subscription is created
+	Secret         string  `json:"secret,omitempty"`
+	LastDeliveryAt *string `json:"last_delivery_at"`
+	LastError      string  `json:"last_error,omitempty"`
+	Failures       int     `json:"consecutive_failures"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+// newWebhookSecret generates a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// webhookSecretGrace is how long the previous secret of a subscription keeps
+// signing deliveries after rotate_secret, so consumers can switch over
+// (WEBHOOK_SECRET_GRACE, default 24h, 0 retires it at once)
+func webhookSecretGrace() time.Duration {
+	v := os.Getenv("WEBHOOK_SECRET_GRACE")
+	if v == "" {
+		return 24 * time.Hour
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Webhooks: invalid WEBHOOK_SECRET_GRACE %q, using 24h", v)
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// webhookSubscriptionSecretColumns selects the secret of a subscription and
+// its previous secret while the grace period after a rotation lasts
+const webhookSubscriptionSecretColumns = `secret,
+	CASE WHEN previous_secret_expires_at > NOW() THEN previous_secret END`
+
+// subscriptionSecrets lists the secrets a delivery is signed with, the
+// current one first
+func subscriptionSecrets(secret string, previous sql.NullString) []string {
+	if previous.Valid && previous.String != "" {
+		return []string{secret, previous.String}
+	}
+	return []string{secret}
+}
+
+// validateWebhookEvents checks event types and removes duplicates
+func validateWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("events must list at least one event type")
+	}
+	seen := make(map[string]bool)
+	var result []string
+	for _, e := range events {
+		e = strings.TrimSpace(e)
+		known := e == eventAll
+		for _, t := range webhookEventTypes {
+			known = known || e == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// validateWebhookURL checks that a subscription URL is an absolute http(s)
+// URL whose host resolves to public addresses only, unless
+// WEBHOOK_ALLOW_PRIVATE_URLS allows internal targets
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if len(raw) > 2048 {
+		return fmt.Errorf("url is longer than 2048 characters")
+	}
+	if privateWebhookURLsAllowed() {
+		return nil
+	}
+	ips := []net.IP{net.ParseIP(u.Hostname())}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(u.Hostname()); err != nil {
+			return fmt.Errorf("url host %s cannot be resolved", u.Hostname())
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("url host %s is a private or loopback address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// privateWebhookURLsAllowed reports whether subscriptions and test
+// deliveries may target loopback and private addresses, e.g. an n8n
+// container next to the processor (WEBHOOK_ALLOW_PRIVATE_URLS=true)
+func privateWebhookURLsAllowed() bool {
+	allowed, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE_URLS"))
+	return allowed
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which net.IP does not
+// count as private
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether an address is reachable on the internet rather
+// than loopback, private, link-local (cloud metadata), shared or
+// unspecified
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) ||
+		(ip.To4() != nil && ip.To4()[0] == 0))
+}
+
+// webhookPublicClient posts to subscription and test URLs. It refuses to
+// connect to non-public addresses, so a host that resolves differently
+// after validation cannot reach the internal network either.
+var webhookPublicClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if privateWebhookURLsAllowed() {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+const webhookSubscriptionColumns = `id, url, events, COALESCE(description, ''), active, last_delivery_at,
+	COALESCE(last_error, ''), consecutive_failures, created_at`
+
+// scanWebhookSubscription reads a row selected with webhookSubscriptionColumns
+func scanWebhookSubscription(row interface{ Scan(...any) error }) (*WebhookSubscription, error) {
+	var s WebhookSubscription
+	var events []byte
+	var lastDelivery sql.NullTime
+	var createdAt time.Time
+	if err := row.Scan(&s.ID, &s.URL, &events, &s.Description, &s.Active, &lastDelivery,
+		&s.LastError, &s.Failures, &createdAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal(events, &s.Events)
+	if lastDelivery.Valid {
+		formatted := lastDelivery.Time.Format(time.RFC3339)
+		s.LastDeliveryAt = &formatted
+	}
+	s.CreatedAt = createdAt.Format(time.RFC3339)
+	return &s, nil
+}
+
+// deliverToSubscriptions sends an event to every active subscription that
+// includes it, signed with the subscription's own secret (and the previous
+// one shortly after a rotation), and records the
+// outcome. Failures are logged, not returned, so one broken consumer does
+// not affect the others.
+func deliverToSubscriptions(e WebhookEvent) {
+	event := e.Event
+	rows, err := db.Query(
+		`SELECT id, url, `+webhookSubscriptionSecretColumns+` FROM webhook_subscriptions
+		WHERE active = TRUE AND (JSON_CONTAINS(events, JSON_QUOTE(?)) OR JSON_CONTAINS(events, JSON_QUOTE(?)))`,
+		event, eventAll,
+	)
+	if err != nil {
+		log.Printf("Webhooks: failed to load subscriptions for %s: %v", event, err)
+		return
+	}
+	type target struct {
+		id       int64
+		url      string
+		secret   string
+		previous sql.NullString
+	}
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.id, &t.url, &t.secret, &t.previous); err != nil {
+			log.Printf("Webhooks: failed to scan subscription: %v", err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+
+	for _, t := range targets {
+		w, err := buildWebhook(t.url, e, subscriptionSecrets(t.secret, t.previous))
+		if err == nil {
+			w.client = webhookPublicClient
+			err = w.deliver(event)
+		}
+		if err != nil {
+			log.Printf("Webhooks: subscription %d: %v", t.id, err)
+			db.Exec(
+				`UPDATE webhook_subscriptions SET last_error = ?, consecutive_failures = consecutive_failures + 1
+				WHERE id = ?`,
+				err.Error(), t.id,
+			)
+			continue
+		}
+		db.Exec(
+			"UPDATE webhook_subscriptions SET last_delivery_at = NOW(), last_error = NULL, consecutive_failures = 0 WHERE id = ?",
+			t.id,
+		)
+	}
+}
+
+// notifyReceiptEvent sends a receipt event with the extracted transaction;
+// extra fields are merged into the payload
+func notifyReceiptEvent(event string, receiptID, transactionID int64, data *GeminiParsedData, extra fiber.Map) {
+	payload := fiber.Map{
+		"receipt_id":     receiptID,
+		"transaction_id": transactionID,
+		"date":           data.Date,
+		"merchant":       data.MerchantClean,
+		"category":       data.Category,
+		"amount":         data.Amount,
+		"currency":       data.Currency,
+	}
+	for k, v := range extra {
+		payload[k] = v
+	}
+	if err := sendReceiptWebhook(event, receiptID, transactionID, payload); err != nil {
+		log.Printf("Failed to send %s webhook for receipt %d: %v", event, receiptID, err)
+	}
+}
+
+// registerWebhookSubscriptionRoutes adds the webhook subscription CRUD API
+func registerWebhookSubscriptionRoutes(app *fiber.App) {
+	app.Get("/webhooks/events", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"events":  webhookEventTypes,
+		})
+	})
+
+	app.Get("/webhooks/subscriptions", func(c *fiber.Ctx) error {
+		rows, err := db.Query("SELECT " + webhookSubscriptionColumns + " FROM webhook_subscriptions ORDER BY id")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load subscriptions: %v", err),
+			})
+		}
+		defer rows.Close()
+
+		subs := []*WebhookSubscription{}
+		for rows.Next() {
+			s, err := scanWebhookSubscription(rows)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to read subscriptions: %v", err),
+				})
+			}
+			subs = append(subs, s)
+		}
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"subscriptions": subs,
+		})
+	})
+
+	app.Get("/webhooks/subscriptions/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid subscription ID",
+			})
+		}
+		s, err := scanWebhookSubscription(db.QueryRow(
+			"SELECT "+webhookSubscriptionColumns+" FROM webhook_subscriptions WHERE id = ?", id,
+		))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Subscription not found",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load subscription: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":      true,
+			"subscription": s,
+		})
+	})
+
+	// Register a URL; the response contains the signing secret, which is
+	// not shown again
+	app.Post("/webhooks/subscriptions", func(c *fiber.Ctx) error {
+		var req struct {
+			URL         string   `json:"url"`
+			Events      []string `json:"events"`
+			Description string   `json:"description"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		if err := validateWebhookURL(req.URL); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		events, err := validateWebhookEvents(req.Events)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate secret",
+			})
+		}
+
+		eventsJSON, _ := json.Marshal(events)
+		result, err := db.Exec(
+			"INSERT INTO webhook_subscriptions (url, events, description, secret) VALUES (?, ?, ?, ?)",
+			req.URL, string(eventsJSON), sql.NullString{String: req.Description, Valid: req.Description != ""}, secret,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save subscription: %v", err),
+			})
+		}
+		id, _ := result.LastInsertId()
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success": true,
+			"subscription": WebhookSubscription{
+				ID:          id,
+				URL:         req.URL,
+				Events:      events,
+				Description: req.Description,
+				Active:      true,
+				Secret:      secret,
+				CreatedAt:   time.Now().Format(time.RFC3339),
+			},
+		})
+	})
+
+	// Change the URL, events, description or active flag; rotate_secret
+	// issues a new signing secret, and deliveries are signed with the old
+	// one too for WEBHOOK_SECRET_GRACE
+	app.Patch("/webhooks/subscriptions/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid subscription ID",
+			})
+		}
+		var req struct {
+			URL          *string  `json:"url"`
+			Events       []string `json:"events"`
+			Description  *string  `json:"description"`
+			Active       *bool    `json:"active"`
+			RotateSecret bool     `json:"rotate_secret"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		var sets []string
+		var args []any
+		if req.URL != nil {
+			if err := validateWebhookURL(*req.URL); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			sets, args = append(sets, "url = ?"), append(args, *req.URL)
+		}
+		if req.Events != nil {
+			events, err := validateWebhookEvents(req.Events)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			eventsJSON, _ := json.Marshal(events)
+			sets, args = append(sets, "events = ?"), append(args, string(eventsJSON))
+		}
+		if req.Description != nil {
+			sets, args = append(sets, "description = ?"), append(args, *req.Description)
+		}
+		if req.Active != nil {
+			sets, args = append(sets, "active = ?"), append(args, *req.Active)
+			if *req.Active {
+				sets = append(sets, "consecutive_failures = 0")
+			}
+		}
+		var secret string
+		var previousExpires time.Time
+		if req.RotateSecret {
+			if secret, err = newWebhookSecret(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to generate secret",
+				})
+			}
+			// MySQL assigns left to right, so the old secret is kept first
+			grace := webhookSecretGrace()
+			sets = append(sets, "previous_secret = secret",
+				"previous_secret_expires_at = NOW() + INTERVAL ? SECOND", "secret = ?")
+			args = append(args, int64(grace/time.Second), secret)
+			previousExpires = time.Now().Add(grace)
+		}
+		if len(sets) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing to update",
+			})
+		}
+
+		result, err := db.Exec(
+			"UPDATE webhook_subscriptions SET "+strings.Join(sets, ", ")+" WHERE id = ?",
+			append(args, id)...,
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to update subscription: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists bool
+			db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = ?)", id).Scan(&exists)
+			if !exists {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Subscription not found",
+				})
+			}
+		}
+
+		response := fiber.Map{
+			"success": true,
+			"id":      id,
+		}
+		if secret != "" {
+			response["secret"] = secret
+			response["previous_secret_expires_at"] = previousExpires.Format(time.RFC3339)
+		}
+		return c.JSON(response)
+	})
+
+	app.Delete("/webhooks/subscriptions/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid subscription ID",
+			})
+		}
+		result, err := db.Exec("DELETE FROM webhook_subscriptions WHERE id = ?", id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to delete subscription: %v", err),
+			})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Subscription not found",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+}
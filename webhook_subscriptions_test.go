@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSubscriptionSecrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		previous sql.NullString
+		want     []string
+	}{
+		{"no rotation", "whsec_new", sql.NullString{}, []string{"whsec_new"}},
+		{"grace period", "whsec_new", sql.NullString{String: "whsec_old", Valid: true}, []string{"whsec_new", "whsec_old"}},
+		{"empty previous", "whsec_new", sql.NullString{String: "", Valid: true}, []string{"whsec_new"}},
+	}
+	for _, tt := range tests {
+		if got := subscriptionSecrets(tt.secret, tt.previous); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: subscriptionSecrets = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_URLS", "")
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"ftp://93.184.216.34/hook", false},
+		{"/hook", false},
+		{"http://127.0.0.1:5678/webhook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://localhost/hook", false},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("validateWebhookURL(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_URLS", "true")
+	if err := validateWebhookURL("http://127.0.0.1:5678/webhook"); err != nil {
+		t.Errorf("private URL refused with WEBHOOK_ALLOW_PRIVATE_URLS=true: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// webhookClient posts webhook notifications
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Headers sent with every webhook
+const (
+	webhookIDHeader        = "X-Webhook-Id"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookEvent is the JSON body posted to WEBHOOK_URL and to subscriptions,
+// and listed by GET /events. Fields are only added in a version, never
+// renamed or removed; receipt, transaction and file_url are null for events
+// that don't concern a receipt.
+type WebhookEvent struct {
+	// ID is the same for every delivery of an event, so consumers can drop
+	// duplicates
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	Version   int    `json:"version"`
+	Timestamp string `json:"timestamp"`
+	// Cursor orders the events for GET /events?since=; 0 when the event
+	// could not be logged
+	Cursor      int64             `json:"cursor"`
+	Receipt     *EventReceipt     `json:"receipt"`
+	Transaction *EventTransaction `json:"transaction"`
+	FileURL     *string           `json:"file_url"`
+	Data        any               `json:"data"`
+}
+
+// newWebhookEvent creates the envelope of an event
+func newWebhookEvent(event string, data any) WebhookEvent {
+	return WebhookEvent{
+		ID:        uuid.New().String(),
+		Event:     event,
+		Version:   webhookEnvelopeVersion,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Data:      data,
+	}
+}
+
+// webhookSecrets returns the signing secrets from WEBHOOK_SECRETS, a comma
+// separated list with the current secret first. During a rotation the new
+// secret is added in front and the old one removed once consumers switched;
+// until then every webhook carries a signature for each secret.
+func webhookSecrets() []string {
+	var secrets []string
+	for _, s := range strings.Split(os.Getenv("WEBHOOK_SECRETS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// signWebhook returns the signature header value for a body sent at ts:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">" with one v1 entry
+// per secret
+func signWebhook(body []byte, ts time.Time, secrets []string) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	parts := []string{"t=" + t}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(t + "."))
+		mac.Write(body)
+		parts = append(parts, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// SignedWebhook is a webhook request ready to send
+type SignedWebhook struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// client sends the request; webhookClient when nil
+	client *http.Client
+}
+
+// buildWebhook encodes an event and signs it with the given secrets
+func buildWebhook(url string, e WebhookEvent, secrets []string) (*SignedWebhook, error) {
+	now := time.Now()
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode webhook %s: %v", e.Event, err)
+	}
+
+	headers := map[string]string{
+		"Content-Type":         "application/json",
+		webhookIDHeader:        e.ID,
+		webhookTimestampHeader: strconv.FormatInt(now.Unix(), 10),
+	}
+	if len(secrets) > 0 {
+		headers[webhookSignatureHeader] = signWebhook(body, now, secrets)
+	}
+	return &SignedWebhook{URL: url, Headers: headers, Body: string(body)}, nil
+}
+
+// deliver posts a built webhook
+func (w *SignedWebhook) deliver(event string) error {
+	req, err := http.NewRequest("POST", w.URL, strings.NewReader(w.Body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook %s: %v", event, err)
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := w.client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook %s: %v", event, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s rejected with status %d", event, resp.StatusCode)
+	}
+	return nil
+}
+
+// sendWebhook posts a signed event to every subscription registered for it
+// and to WEBHOOK_URL (e.g. an n8n webhook trigger) when set. Only the
+// WEBHOOK_URL delivery error is returned; subscription failures are
+// recorded on the subscription.
+func sendWebhook(event string, data any) error {
+	return publishEvent(newWebhookEvent(event, data))
+}
+
+// publishEvent logs an event for GET /events and delivers it like
+// sendWebhook
+func publishEvent(e WebhookEvent) error {
+	if err := logWebhookEvent(&e); err != nil {
+		log.Printf("Webhooks: %v", err)
+	}
+	deliverToSubscriptions(e)
+
+	url := os.Getenv("WEBHOOK_URL")
+	if url == "" {
+		return nil
+	}
+	w, err := buildWebhook(url, e, webhookSecrets())
+	if err != nil {
+		return err
+	}
+	return w.deliver(e.Event)
+}
+
+// registerWebhookRoutes adds the webhook test endpoint
+func registerWebhookRoutes(app *fiber.App) {
+	// Send a signed sample event so consumers can check their verification.
+	// The request and the delivery result are returned for comparison.
+	app.Post("/webhooks/test", func(c *fiber.Ctx) error {
+		var req struct {
+			URL            string `json:"url"`
+			SubscriptionID int64  `json:"subscription_id"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid request body",
+				})
+			}
+		}
+		// Any URL but WEBHOOK_URL is checked like a subscription URL and
+		// only reached on a public address
+		external := req.URL != "" && req.URL != os.Getenv("WEBHOOK_URL")
+		if external && req.SubscriptionID == 0 {
+			if err := validateWebhookURL(req.URL); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+		}
+
+		// A subscription is tested with its own URL and secret
+		secrets := webhookSecrets()
+		if req.SubscriptionID != 0 {
+			external = true
+			var secret string
+			var previous sql.NullString
+			err := db.QueryRow(
+				"SELECT url, "+webhookSubscriptionSecretColumns+" FROM webhook_subscriptions WHERE id = ?", req.SubscriptionID,
+			).Scan(&req.URL, &secret, &previous)
+			if err != nil {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "Subscription not found",
+				})
+			}
+			secrets = subscriptionSecrets(secret, previous)
+		}
+		if req.URL == "" {
+			req.URL = os.Getenv("WEBHOOK_URL")
+		}
+		if req.URL == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "No url given and WEBHOOK_URL is not set",
+			})
+		}
+
+		w, err := buildWebhook(req.URL, newWebhookEvent(eventWebhookTest, fiber.Map{
+			"message": "This is a test event from the receipt processor",
+		}), secrets)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if external {
+			w.client = webhookPublicClient
+		}
+		delivered, deliveryError := true, ""
+		if err := w.deliver(eventWebhookTest); err != nil {
+			delivered, deliveryError = false, err.Error()
+		}
+		return c.JSON(fiber.Map{
+			"success":        delivered,
+			"signed":         w.Headers[webhookSignatureHeader] != "",
+			"request":        w,
+			"delivery_error": deliveryError,
+		})
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"receipt.processed"}`)
+	// Expected values computed independently as HMAC-SHA256("<t>.<body>")
+	current := "v1=f0605a7a1792cd5bc2534844e22d0d15b2c1f9b9037063aa1e5dbe403f5d9cc9"
+	previous := "v1=fd2fc76d15327d3ff683e00c4b847e6b0f6c02ecc91c062006fe37bddc2b2fcd"
+
+	tests := []struct {
+		name    string
+		body    []byte
+		ts      time.Time
+		secrets []string
+		want    string
+	}{
+		{"one secret", body, ts, []string{"whsec_current"}, "t=1700000000," + current},
+		{"rotation", body, ts, []string{"whsec_current", "whsec_previous"}, "t=1700000000," + current + "," + previous},
+		{"no secrets", body, ts, nil, "t=1700000000"},
+		{"empty body", nil, ts, []string{"whsec_current"},
+			"t=1700000000,v1=e34f13cf9a0598678d39619fd36d912bb109ba8b21f6578647a0e1b9b5b80d5d"},
+	}
+	for _, tt := range tests {
+		if got := signWebhook(tt.body, tt.ts, tt.secrets); got != tt.want {
+			t.Errorf("%s: signWebhook = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Changing the body or the timestamp changes the signature
+	base := signWebhook(body, ts, []string{"whsec_current"})
+	if signWebhook([]byte(`{"event":"receipt.processed "}`), ts, []string{"whsec_current"}) == base {
+		t.Error("signature does not cover the body")
+	}
+	if later := signWebhook(body, ts.Add(time.Second), []string{"whsec_current"}); later[len("t=1700000001,"):] == base[len("t=1700000000,"):] {
+		t.Error("signature does not cover the timestamp")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ynabAPIBase is the YNAB REST API root
+const ynabAPIBase = "https://api.ynab.com/v1"
+
+// ynabImportIDPrefix makes import IDs of pushed transactions recognizable;
+// YNAB rejects a second transaction with the same import ID
+const ynabImportIDPrefix = "receipt-processor:"
+
+// YNAB cleared states. Receipts a human has verified are cleared, the rest
+// stay uncleared until verification. ynabUnknown marks transactions YNAB
+// already had under their import ID, whose YNAB ID is not known here.
+const (
+	ynabCleared   = "cleared"
+	ynabUncleared = "uncleared"
+	ynabUnknown   = "unknown"
+)
+
+// ynabClient talks to the YNAB API
+var ynabClient = &http.Client{Timeout: 30 * time.Second}
+
+// ynabConfig is the YNAB API configuration
+type ynabConfig struct {
+	Token     string
+	BudgetID  string
+	AccountID string
+}
+
+// loadYNABConfig reads YNAB_TOKEN, YNAB_BUDGET_ID and YNAB_ACCOUNT_ID, or
+// returns nil when not configured. The budget defaults to the last used one.
+func loadYNABConfig() *ynabConfig {
+	cfg := &ynabConfig{
+		Token:     os.Getenv("YNAB_TOKEN"),
+		BudgetID:  os.Getenv("YNAB_BUDGET_ID"),
+		AccountID: os.Getenv("YNAB_ACCOUNT_ID"),
+	}
+	if cfg.Token == "" || cfg.AccountID == "" {
+		return nil
+	}
+	if cfg.BudgetID == "" {
+		cfg.BudgetID = "last-used"
+	}
+	return cfg
+}
+
+// ynabExportRow is a transaction in the export and push
+type ynabExportRow struct {
+	ID       int64
+	Date     time.Time
+	Payee    string
+	Category string
+	Memo     string
+	Amount   float64
+	Cleared  string
+	YNABID   sql.NullString
+}
+
+// loadYNABRows returns processed transactions with an amount in the home
+// currency. Transactions still waiting for an exchange rate are left out.
+func loadYNABRows(cond string, args ...any) ([]ynabExportRow, error) {
+	rows, err := db.Query(
+		`SELECT t.id, t.date, COALESCE(t.merchant_clean, t.merchant_raw, ''), COALESCE(t.category, ''),
+			COALESCE(t.reference_number, ''), t.home_amount, r.verified_at IS NOT NULL, t.ynab_id
+		FROM transactions t
+		JOIN receipts r ON r.id = t.receipt_id
+		WHERE r.status = 'processed' AND t.date IS NOT NULL AND t.home_amount IS NOT NULL AND `+cond+`
+		ORDER BY t.date, t.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transactions: %v", err)
+	}
+	defer rows.Close()
+
+	var result []ynabExportRow
+	for rows.Next() {
+		var r ynabExportRow
+		var reference string
+		var verified bool
+		if err := rows.Scan(&r.ID, &r.Date, &r.Payee, &r.Category, &reference, &r.Amount, &verified, &r.YNABID); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %v", err)
+		}
+		r.Memo = fmt.Sprintf("Receipt transaction #%d", r.ID)
+		if reference != "" {
+			r.Memo += " ref " + reference
+		}
+		r.Cleared = ynabUncleared
+		if verified {
+			r.Cleared = ynabCleared
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// ynabCategoryMappings loads local category to YNAB category ID mappings
+func ynabCategoryMappings() (map[string]string, error) {
+	rows, err := db.Query("SELECT category, ynab_category_id FROM ynab_category_mappings")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load YNAB category mappings: %v", err)
+	}
+	defer rows.Close()
+
+	mappings := make(map[string]string)
+	for rows.Next() {
+		var category, id string
+		if err := rows.Scan(&category, &id); err != nil {
+			return nil, fmt.Errorf("failed to scan YNAB category mapping: %v", err)
+		}
+		mappings[category] = id
+	}
+	return mappings, rows.Err()
+}
+
+// ynabRequest sends a request to the YNAB API
+func ynabRequest(cfg *ynabConfig, method, path string, body any, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, ynabAPIBase+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ynabClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("YNAB request %s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("YNAB %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// YNABPushResult summarizes a YNAB push
+type YNABPushResult struct {
+	Created    int `json:"created"`
+	Duplicates int `json:"duplicates"`
+	Cleared    int `json:"cleared"`
+}
+
+// ynabPushMu serializes pushes so a transaction is never sent twice at once
+var ynabPushMu sync.Mutex
+
+// pushYNAB creates transactions that have not been sent yet and marks sent
+// ones cleared once their receipt is verified. Cleared or reconciled
+// transactions are never set back to uncleared.
+func pushYNAB(cfg *ynabConfig) (*YNABPushResult, error) {
+	ynabPushMu.Lock()
+	defer ynabPushMu.Unlock()
+
+	mappings, err := ynabCategoryMappings()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := loadYNABRows(
+		"((t.ynab_id IS NULL AND t.ynab_cleared IS NULL) OR (t.ynab_cleared = ? AND r.verified_at IS NOT NULL))",
+		ynabUncleared,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &YNABPushResult{}
+	var create, clear []map[string]any
+	for _, r := range rows {
+		if r.YNABID.Valid {
+			clear = append(clear, map[string]any{"id": r.YNABID.String, "cleared": ynabCleared})
+			continue
+		}
+		tx := map[string]any{
+			"account_id": cfg.AccountID,
+			"date":       r.Date.Format("2006-01-02"),
+			// Milliunits; outflows are negative
+			"amount":     -int64(math.Round(r.Amount * 1000)),
+			"payee_name": truncate(r.Payee, 50),
+			"memo":       truncate(r.Memo, 200),
+			"cleared":    r.Cleared,
+			"approved":   true,
+			"import_id":  ynabImportIDPrefix + strconv.FormatInt(r.ID, 10),
+		}
+		if id, ok := mappings[strings.ToLower(r.Category)]; ok {
+			tx["category_id"] = id
+		}
+		create = append(create, tx)
+	}
+
+	if len(create) > 0 {
+		var resp struct {
+			Data struct {
+				DuplicateImportIDs []string `json:"duplicate_import_ids"`
+				Transactions       []struct {
+					ID       string `json:"id"`
+					ImportID string `json:"import_id"`
+					Cleared  string `json:"cleared"`
+				} `json:"transactions"`
+			} `json:"data"`
+		}
+		if err := ynabRequest(cfg, "POST", "/budgets/"+cfg.BudgetID+"/transactions",
+			map[string]any{"transactions": create}, &resp); err != nil {
+			return nil, err
+		}
+		for _, tx := range resp.Data.Transactions {
+			localID, err := strconv.ParseInt(strings.TrimPrefix(tx.ImportID, ynabImportIDPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			if _, err := db.Exec("UPDATE transactions SET ynab_id = ?, ynab_cleared = ? WHERE id = ?", tx.ID, tx.Cleared, localID); err != nil {
+				return res, fmt.Errorf("failed to record YNAB transaction: %v", err)
+			}
+			res.Created++
+		}
+		// Already in YNAB, e.g. imported before the ID was recorded here
+		for _, importID := range resp.Data.DuplicateImportIDs {
+			localID, err := strconv.ParseInt(strings.TrimPrefix(importID, ynabImportIDPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			log.Printf("YNAB: transaction %d was already imported", localID)
+			if _, err := db.Exec("UPDATE transactions SET ynab_cleared = ? WHERE id = ?", ynabUnknown, localID); err != nil {
+				return res, fmt.Errorf("failed to record YNAB duplicate: %v", err)
+			}
+			res.Duplicates++
+		}
+	}
+
+	if len(clear) > 0 {
+		if err := ynabRequest(cfg, "PATCH", "/budgets/"+cfg.BudgetID+"/transactions",
+			map[string]any{"transactions": clear}, nil); err != nil {
+			return res, err
+		}
+		for _, tx := range clear {
+			if _, err := db.Exec("UPDATE transactions SET ynab_cleared = ? WHERE ynab_id = ?", ynabCleared, tx["id"]); err != nil {
+				return res, fmt.Errorf("failed to record YNAB cleared status: %v", err)
+			}
+			res.Cleared++
+		}
+	}
+	return res, nil
+}
+
+// registerYNABRoutes adds the YNAB / Actual Budget export and push endpoints
+func registerYNABRoutes(app *fiber.App) {
+	// CSV in the column layout YNAB and Actual Budget import
+	app.Get("/export/ynab.csv", func(c *fiber.Ctx) error {
+		dateCond, args, err := reportDateRange(c, "t.date")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		rows, err := loadYNABRows(dateCond, args...)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"Date", "Payee", "Category", "Memo", "Outflow", "Inflow", "Cleared"})
+		for _, r := range rows {
+			cleared := "Uncleared"
+			if r.Cleared == ynabCleared {
+				cleared = "Cleared"
+			}
+			w.Write([]string{
+				r.Date.Format("2006-01-02"),
+				r.Payee,
+				r.Category,
+				r.Memo,
+				strconv.FormatFloat(r.Amount, 'f', 2, 64),
+				"",
+				cleared,
+			})
+		}
+		w.Flush()
+
+		c.Set("Content-Type", "text/csv; charset=utf-8")
+		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="receipts-ynab-%s.csv"`, time.Now().Format("20060102")))
+		return c.Send(buf.Bytes())
+	})
+
+	app.Post("/integrations/ynab/push", func(c *fiber.Ctx) error {
+		cfg := loadYNABConfig()
+		if cfg == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "YNAB integration is not configured (YNAB_TOKEN, YNAB_BUDGET_ID, YNAB_ACCOUNT_ID)",
+			})
+		}
+		res, err := pushYNAB(cfg)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"result":  res,
+		})
+	})
+
+	app.Get("/integrations/ynab/mappings", func(c *fiber.Ctx) error {
+		mappings, err := ynabCategoryMappings()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"mappings": mappings,
+		})
+	})
+
+	// Map a local category to a YNAB category ID; an empty ID removes it
+	app.Put("/integrations/ynab/mappings", func(c *fiber.Ctx) error {
+		var req struct {
+			Category       string `json:"category"`
+			YNABCategoryID string `json:"ynab_category_id"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		category := strings.ToLower(strings.TrimSpace(req.Category))
+		if category == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "category is required",
+			})
+		}
+
+		var err error
+		if id := strings.TrimSpace(req.YNABCategoryID); id == "" {
+			_, err = db.Exec("DELETE FROM ynab_category_mappings WHERE category = ?", category)
+		} else {
+			_, err = db.Exec(
+				`INSERT INTO ynab_category_mappings (category, ynab_category_id) VALUES (?, ?)
+				ON DUPLICATE KEY UPDATE ynab_category_id = VALUES(ynab_category_id)`,
+				category, id,
+			)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save mapping: %v", err),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+}